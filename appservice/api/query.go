@@ -20,8 +20,10 @@ package api
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"strings"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
@@ -66,6 +68,100 @@ type UserIDExistsResponse struct {
 	UserIDExists bool `json:"exists"`
 }
 
+// ThirdPartyProtocolsRequest is a request to application services for the
+// metadata of the third party protocols they provide
+type ThirdPartyProtocolsRequest struct {
+	// The protocol to fetch the metadata of, or empty for all protocols
+	Protocol string `json:"protocol"`
+}
+
+// ThirdPartyProtocolsResponse is a response from application services with the
+// metadata of the third party protocols they provide, keyed by protocol
+type ThirdPartyProtocolsResponse struct {
+	Protocols map[string]ThirdPartyProtocol `json:"protocols"`
+}
+
+// ThirdPartyProtocol is the metadata of a third party protocol, merged from
+// every application service providing it
+type ThirdPartyProtocol struct {
+	UserFields     []string                       `json:"user_fields"`
+	LocationFields []string                       `json:"location_fields"`
+	Icon           string                         `json:"icon"`
+	FieldTypes     map[string]ThirdPartyFieldType `json:"field_types"`
+	Instances      []ThirdPartyProtocolInstance   `json:"instances"`
+}
+
+// ThirdPartyFieldType describes a field used to look up third party locations
+// and users
+type ThirdPartyFieldType struct {
+	Regexp      string `json:"regexp"`
+	Placeholder string `json:"placeholder"`
+}
+
+// ThirdPartyProtocolInstance is a network provided by an application service
+// using a third party protocol
+type ThirdPartyProtocolInstance struct {
+	Desc      string          `json:"desc"`
+	Icon      string          `json:"icon,omitempty"`
+	Fields    json.RawMessage `json:"fields"`
+	NetworkID string          `json:"network_id"`
+	// The ID the network's room directory is listed by, as generated by
+	// ThirdPartyInstanceID
+	InstanceID string `json:"instance_id"`
+}
+
+// ThirdPartyLookupRequest is a request to application services for the
+// locations or users on a third party network
+type ThirdPartyLookupRequest struct {
+	// The protocol to look up with the fields, or empty to look up the
+	// Matrix room alias or user ID in the "alias" or "userid" field
+	Protocol string `json:"protocol"`
+	// The fields to look up, as given in the query string of the request
+	Fields map[string][]string `json:"fields"`
+}
+
+// ThirdPartyLocation is a portal room to a location on a third party network
+type ThirdPartyLocation struct {
+	Alias    string          `json:"alias"`
+	Protocol string          `json:"protocol"`
+	Fields   json.RawMessage `json:"fields"`
+}
+
+// ThirdPartyLocationsResponse is a response from application services with
+// the locations matching a lookup
+type ThirdPartyLocationsResponse struct {
+	Locations []ThirdPartyLocation `json:"locations"`
+}
+
+// ThirdPartyUser is a Matrix user representing a user on a third party network
+type ThirdPartyUser struct {
+	UserID   string          `json:"userid"`
+	Protocol string          `json:"protocol"`
+	Fields   json.RawMessage `json:"fields"`
+}
+
+// ThirdPartyUsersResponse is a response from application services with the
+// users matching a lookup
+type ThirdPartyUsersResponse struct {
+	Users []ThirdPartyUser `json:"users"`
+}
+
+// ThirdPartyInstanceID returns the ID that the room directory of an application
+// service's network is listed by.
+func ThirdPartyInstanceID(appserviceID, networkID string) string {
+	return appserviceID + "|" + networkID
+}
+
+// ParseThirdPartyInstanceID splits an ID generated by ThirdPartyInstanceID into
+// the ID of the application service and the ID of its network.
+func ParseThirdPartyInstanceID(instanceID string) (appserviceID, networkID string, err error) {
+	parts := strings.SplitN(instanceID, "|", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", errors.New("invalid third party instance ID")
+	}
+	return parts[0], parts[1], nil
+}
+
 // AppServiceQueryAPI is used to query user and room alias data from application
 // services
 type AppServiceQueryAPI interface {
@@ -81,6 +177,24 @@ type AppServiceQueryAPI interface {
 		req *UserIDExistsRequest,
 		resp *UserIDExistsResponse,
 	) error
+	// Get the metadata of the third party protocols provided by application services
+	ThirdPartyProtocols(
+		ctx context.Context,
+		req *ThirdPartyProtocolsRequest,
+		resp *ThirdPartyProtocolsResponse,
+	) error
+	// Look up portal rooms to third party locations from application services
+	ThirdPartyLocations(
+		ctx context.Context,
+		req *ThirdPartyLookupRequest,
+		resp *ThirdPartyLocationsResponse,
+	) error
+	// Look up users on third party networks from application services
+	ThirdPartyUsers(
+		ctx context.Context,
+		req *ThirdPartyLookupRequest,
+		resp *ThirdPartyUsersResponse,
+	) error
 }
 
 // AppServiceRoomAliasExistsPath is the HTTP path for the RoomAliasExists API
@@ -89,6 +203,15 @@ const AppServiceRoomAliasExistsPath = "/api/appservice/RoomAliasExists"
 // AppServiceUserIDExistsPath is the HTTP path for the UserIDExists API
 const AppServiceUserIDExistsPath = "/api/appservice/UserIDExists"
 
+// AppServiceThirdPartyProtocolsPath is the HTTP path for the ThirdPartyProtocols API
+const AppServiceThirdPartyProtocolsPath = "/api/appservice/ThirdPartyProtocols"
+
+// AppServiceThirdPartyLocationsPath is the HTTP path for the ThirdPartyLocations API
+const AppServiceThirdPartyLocationsPath = "/api/appservice/ThirdPartyLocations"
+
+// AppServiceThirdPartyUsersPath is the HTTP path for the ThirdPartyUsers API
+const AppServiceThirdPartyUsersPath = "/api/appservice/ThirdPartyUsers"
+
 // httpAppServiceQueryAPI contains the URL to an appservice query API and a
 // reference to a httpClient used to reach it
 type httpAppServiceQueryAPI struct {
@@ -135,6 +258,45 @@ func (h *httpAppServiceQueryAPI) UserIDExists(
 	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// ThirdPartyProtocols implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) ThirdPartyProtocols(
+	ctx context.Context,
+	request *ThirdPartyProtocolsRequest,
+	response *ThirdPartyProtocolsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceThirdPartyProtocols")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceThirdPartyProtocolsPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// ThirdPartyLocations implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) ThirdPartyLocations(
+	ctx context.Context,
+	request *ThirdPartyLookupRequest,
+	response *ThirdPartyLocationsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceThirdPartyLocations")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceThirdPartyLocationsPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// ThirdPartyUsers implements AppServiceQueryAPI
+func (h *httpAppServiceQueryAPI) ThirdPartyUsers(
+	ctx context.Context,
+	request *ThirdPartyLookupRequest,
+	response *ThirdPartyUsersResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "appserviceThirdPartyUsers")
+	defer span.Finish()
+
+	apiURL := h.appserviceURL + AppServiceThirdPartyUsersPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // RetrieveUserProfile is a wrapper that queries both the local database and
 // application services for a given user's profile
 func RetrieveUserProfile(
@@ -0,0 +1,34 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import "testing"
+
+func TestThirdPartyInstanceID(t *testing.T) {
+	instanceID := ThirdPartyInstanceID("irc", "freenode|net")
+	appserviceID, networkID, err := ParseThirdPartyInstanceID(instanceID)
+	if err != nil {
+		t.Fatalf("ParseThirdPartyInstanceID(%q) returned %s", instanceID, err)
+	}
+	if appserviceID != "irc" || networkID != "freenode|net" {
+		t.Fatalf("ParseThirdPartyInstanceID(%q) returned %q, %q", instanceID, appserviceID, networkID)
+	}
+
+	for _, invalid := range []string{"", "irc", "|freenode", "irc|"} {
+		if _, _, err := ParseThirdPartyInstanceID(invalid); err == nil {
+			t.Errorf("ParseThirdPartyInstanceID(%q) returned no error", invalid)
+		}
+	}
+}
@@ -17,7 +17,6 @@ package appservice
 import (
 	"context"
 	"net/http"
-	"sync"
 	"time"
 
 	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
@@ -56,15 +55,8 @@ func SetupAppServiceAPIComponent(
 	// Wrap application services in a type that relates the application service and
 	// a sync.Cond object that can be used to notify workers when there are new
 	// events to be sent out.
-	workerStates := make([]types.ApplicationServiceWorkerState, len(base.Cfg.Derived.ApplicationServices))
-	for i, appservice := range base.Cfg.Derived.ApplicationServices {
-		m := sync.Mutex{}
-		ws := types.ApplicationServiceWorkerState{
-			AppService: appservice,
-			Cond:       sync.NewCond(&m),
-		}
-		workerStates[i] = ws
-
+	workerStates := &types.ApplicationServiceWorkerStates{}
+	for _, appservice := range base.Cfg.AppServices() {
 		// Create bot account for this AS if it doesn't already exist
 		if err = generateAppServiceAccount(accountsDB, deviceDB, appservice); err != nil {
 			logrus.WithFields(logrus.Fields{
@@ -73,6 +65,21 @@ func SetupAppServiceAPIComponent(
 		}
 	}
 
+	// Create application service transaction workers
+	workers.UpdateTransactionWorkers(appserviceDB, workerStates, base.Cfg.AppServices())
+
+	// Start and drain workers as application services are added and removed
+	base.Cfg.OnAppServicesReloaded(func(appservices []config.ApplicationService) {
+		for _, appservice := range appservices {
+			if err := generateAppServiceAccount(accountsDB, deviceDB, appservice); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"appservice": appservice.ID,
+				}).WithError(err).Error("failed to generate bot account for appservice")
+			}
+		}
+		workers.UpdateTransactionWorkers(appserviceDB, workerStates, appservices)
+	})
+
 	// Create appserivce query API with an HTTP client that will be used for all
 	// outbound and inbound requests (inbound only for the internal API)
 	appserviceQueryAPI := query.AppServiceQueryAPI{
@@ -94,9 +101,34 @@ func SetupAppServiceAPIComponent(
 		logrus.WithError(err).Panicf("failed to start appservice roomserver consumer")
 	}
 
-	// Create application service transaction workers
-	if err := workers.SetupTransactionWorkers(appserviceDB, workerStates); err != nil {
-		logrus.WithError(err).Panicf("failed to start app service transaction workers")
+	typingConsumer := consumers.NewOutputTypingEventConsumer(
+		base.Cfg, base.KafkaConsumer, accountsDB, appserviceDB,
+		rsAPI, workerStates,
+	)
+	if err := typingConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start appservice typing consumer")
+	}
+
+	receiptConsumer := consumers.NewOutputReceiptEventConsumer(
+		base.Cfg, base.KafkaConsumer, accountsDB, appserviceDB,
+		rsAPI, workerStates,
+	)
+	if err := receiptConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start appservice receipt consumer")
+	}
+
+	presenceConsumer := consumers.NewOutputPresenceEventConsumer(
+		base.Cfg, base.KafkaConsumer, accountsDB, appserviceDB, workerStates,
+	)
+	if err := presenceConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start appservice presence consumer")
+	}
+
+	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEventConsumer(
+		base.Cfg, base.KafkaConsumer, accountsDB, appserviceDB, workerStates,
+	)
+	if err := sendToDeviceConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start appservice send-to-device consumer")
 	}
 
 	// Set up HTTP Endpoints
@@ -0,0 +1,299 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	log "github.com/sirupsen/logrus"
+)
+
+// ephemeralEvent is an event sent in the ephemeral section of a transaction.
+type ephemeralEvent struct {
+	Type    string      `json:"type"`
+	RoomID  string      `json:"room_id,omitempty"`
+	Sender  string      `json:"sender,omitempty"`
+	Content interface{} `json:"content"`
+}
+
+// toDeviceEvent is a message sent in the to-device section of a transaction.
+type toDeviceEvent struct {
+	api.SendToDeviceEvent
+	ToUserID   string `json:"to_user_id"`
+	ToDeviceID string `json:"to_device_id"`
+}
+
+// OutputTypingEventConsumer consumes typing events that originated in the EDU server.
+type OutputTypingEventConsumer struct {
+	consumer     *internal.ContinualConsumer
+	asDB         storage.Database
+	rsAPI        roomserverAPI.RoomserverInternalAPI
+	typingCache  *cache.EDUCache
+	workerStates *types.ApplicationServiceWorkerStates
+}
+
+// NewOutputTypingEventConsumer creates a new OutputTypingEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputTypingEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	store accounts.Database,
+	appserviceDB storage.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	workerStates *types.ApplicationServiceWorkerStates,
+) *OutputTypingEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputTypingEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputTypingEventConsumer{
+		consumer:     &consumer,
+		asDB:         appserviceDB,
+		rsAPI:        rsAPI,
+		typingCache:  cache.New(),
+		workerStates: workerStates,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the EDU server
+func (s *OutputTypingEventConsumer) Start() error {
+	s.typingCache.SetTimeoutCallback(func(userID, roomID string, latestSyncPosition int64) {
+		if err := s.queueTypingUsers(context.TODO(), userID, roomID); err != nil {
+			log.WithField("room_id", roomID).WithError(err).Error("failed to queue typing notification for application services")
+		}
+	})
+	return s.consumer.Start()
+}
+
+// onMessage is called when the appservice component receives a typing event
+// from the EDU server. It sends the users typing in the room to the interested
+// application services.
+func (s *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputTypingEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	typingEvent := output.Event
+	if typingEvent.Typing {
+		s.typingCache.AddTypingUser(typingEvent.UserID, typingEvent.RoomID, output.ExpireTime)
+	} else {
+		s.typingCache.RemoveUser(typingEvent.UserID, typingEvent.RoomID)
+	}
+
+	return s.queueTypingUsers(context.TODO(), typingEvent.UserID, typingEvent.RoomID)
+}
+
+// queueTypingUsers queues an m.typing event listing the users typing in the
+// room, after the given user has started or stopped typing.
+func (s *OutputTypingEventConsumer) queueTypingUsers(ctx context.Context, userID, roomID string) error {
+	userIDs := s.typingCache.GetTypingUsers(roomID)
+	if userIDs == nil {
+		userIDs = []string{}
+	}
+	event := ephemeralEvent{
+		Type:   "m.typing",
+		RoomID: roomID,
+		Content: map[string]interface{}{
+			"user_ids": userIDs,
+		},
+	}
+	return queueEphemeralEvent(ctx, s.asDB, s.workerStates, types.EphemeralEventKind, event, func(appservice *config.ApplicationService) bool {
+		return appservice.IsInterestedInUserID(userID) ||
+			appserviceIsInterestedInRoom(ctx, s.rsAPI, appservice, roomID)
+	})
+}
+
+// OutputReceiptEventConsumer consumes receipt events that originated in the EDU server.
+type OutputReceiptEventConsumer struct {
+	consumer     *internal.ContinualConsumer
+	asDB         storage.Database
+	rsAPI        roomserverAPI.RoomserverInternalAPI
+	workerStates *types.ApplicationServiceWorkerStates
+}
+
+// NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputReceiptEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	store accounts.Database,
+	appserviceDB storage.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	workerStates *types.ApplicationServiceWorkerStates,
+) *OutputReceiptEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputReceiptEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputReceiptEventConsumer{
+		consumer:     &consumer,
+		asDB:         appserviceDB,
+		rsAPI:        rsAPI,
+		workerStates: workerStates,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the EDU server
+func (s *OutputReceiptEventConsumer) Start() error {
+	return s.consumer.Start()
+}
+
+// onMessage is called when the appservice component receives a receipt from
+// the EDU server. It sends the receipt to the interested application services.
+func (s *OutputReceiptEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputReceiptEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	// The content is keyed by event ID, then receipt type, then user ID.
+	event := ephemeralEvent{
+		Type:   "m.receipt",
+		RoomID: output.RoomID,
+		Content: map[string]interface{}{
+			output.EventID: map[string]interface{}{
+				output.Type: map[string]interface{}{
+					output.UserID: map[string]interface{}{
+						"ts": output.Timestamp,
+					},
+				},
+			},
+		},
+	}
+	ctx := context.TODO()
+	return queueEphemeralEvent(ctx, s.asDB, s.workerStates, types.EphemeralEventKind, event, func(appservice *config.ApplicationService) bool {
+		return appservice.IsInterestedInUserID(output.UserID) ||
+			appserviceIsInterestedInRoom(ctx, s.rsAPI, appservice, output.RoomID)
+	})
+}
+
+// OutputSendToDeviceEventConsumer consumes send-to-device messages that
+// originated in the EDU server.
+type OutputSendToDeviceEventConsumer struct {
+	consumer     *internal.ContinualConsumer
+	asDB         storage.Database
+	workerStates *types.ApplicationServiceWorkerStates
+}
+
+// NewOutputSendToDeviceEventConsumer creates a new OutputSendToDeviceEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputSendToDeviceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	store accounts.Database,
+	appserviceDB storage.Database,
+	workerStates *types.ApplicationServiceWorkerStates,
+) *OutputSendToDeviceEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputSendToDeviceEventConsumer{
+		consumer:     &consumer,
+		asDB:         appserviceDB,
+		workerStates: workerStates,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the EDU server
+func (s *OutputSendToDeviceEventConsumer) Start() error {
+	return s.consumer.Start()
+}
+
+// onMessage is called when the appservice component receives a send-to-device
+// message from the EDU server. It sends messages for users within the
+// namespaces of application services on to them.
+func (s *OutputSendToDeviceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputSendToDeviceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	event := toDeviceEvent{
+		SendToDeviceEvent: output.SendToDeviceEvent,
+		ToUserID:          output.UserID,
+		ToDeviceID:        output.DeviceID,
+	}
+	return queueEphemeralEvent(context.TODO(), s.asDB, s.workerStates, types.ToDeviceEventKind, event, func(appservice *config.ApplicationService) bool {
+		return appservice.IsInterestedInUserID(output.UserID)
+	})
+}
+
+// queueEphemeralEvent queues an ephemeral event or send-to-device message to be
+// sent to each application service which receives them and is interested in it.
+func queueEphemeralEvent(
+	ctx context.Context,
+	asDB storage.Database,
+	workerStates *types.ApplicationServiceWorkerStates,
+	kind string,
+	event interface{},
+	isInterested func(*config.ApplicationService) bool,
+) error {
+	var eventJSON []byte
+	for _, ws := range workerStates.Registered() {
+		appservice := ws.AppService()
+		// No reason to queue events if they'll never be sent to the application
+		// service, or it hasn't asked for them
+		if appservice.URL == "" || !appservice.ReceiveEphemeral || !isInterested(&appservice) {
+			continue
+		}
+		if eventJSON == nil {
+			var err error
+			if eventJSON, err = json.Marshal(event); err != nil {
+				return err
+			}
+		}
+		if err := asDB.StoreEphemeralEvent(ctx, appservice.ID, types.EphemeralEvent{
+			Kind:  kind,
+			Event: eventJSON,
+		}); err != nil {
+			log.WithError(err).Warn("failed to insert ephemeral event into appservices database")
+			continue
+		}
+		// Tell our worker to send out the new event
+		ws.NotifyNewEvents()
+	}
+
+	return nil
+}
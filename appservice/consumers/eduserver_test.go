@@ -0,0 +1,283 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// ephemeralDatabase records the ephemeral events queued for each application
+// service.
+type ephemeralDatabase struct {
+	storage.Database
+	queued map[string][]types.EphemeralEvent
+}
+
+func (d *ephemeralDatabase) StoreEphemeralEvent(
+	ctx context.Context, appServiceID string, event types.EphemeralEvent,
+) error {
+	d.queued[appServiceID] = append(d.queued[appServiceID], event)
+	return nil
+}
+
+// aliasesRoomserverAPI returns the given aliases for every room.
+type aliasesRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	aliases []string
+}
+
+func (a *aliasesRoomserverAPI) GetAliasesForRoomID(
+	ctx context.Context,
+	req *roomserverAPI.GetAliasesForRoomIDRequest,
+	res *roomserverAPI.GetAliasesForRoomIDResponse,
+) error {
+	res.Aliases = a.aliases
+	return nil
+}
+
+func namespaces(kind, regex string) map[string][]config.ApplicationServiceNamespace {
+	return map[string][]config.ApplicationServiceNamespace{
+		kind: {{Regex: regex, RegexpObject: regexp.MustCompile(regex)}},
+	}
+}
+
+// setupEphemeral registers a bridge which receives ephemeral events, one which
+// hasn't opted in to them and one which only owns room aliases.
+func setupEphemeral() (*ephemeralDatabase, *types.ApplicationServiceWorkerStates) {
+	db := &ephemeralDatabase{queued: make(map[string][]types.EphemeralEvent)}
+	var workerStates types.ApplicationServiceWorkerStates
+	workerStates.SetRegistered([]*types.ApplicationServiceWorkerState{
+		types.NewApplicationServiceWorkerState(config.ApplicationService{
+			ID: "bridge", URL: "http://bridge", ReceiveEphemeral: true,
+			NamespaceMap: namespaces("users", "@bridge_.*"),
+		}),
+		types.NewApplicationServiceWorkerState(config.ApplicationService{
+			ID: "optout", URL: "http://optout",
+			NamespaceMap: namespaces("users", "@bridge_.*"),
+		}),
+		types.NewApplicationServiceWorkerState(config.ApplicationService{
+			ID: "aliases", URL: "http://aliases", ReceiveEphemeral: true,
+			NamespaceMap: namespaces("aliases", "#aliases_.*"),
+		}),
+	})
+	return db, &workerStates
+}
+
+func mustMessage(t *testing.T, v interface{}) *sarama.ConsumerMessage {
+	value, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal returned %s", err)
+	}
+	return &sarama.ConsumerMessage{Value: value}
+}
+
+// assertQueued checks which application services had events queued, and that
+// their workers were woken up.
+func assertQueued(t *testing.T, db *ephemeralDatabase, workerStates *types.ApplicationServiceWorkerStates, kind string, want ...string) {
+	var got []string
+	for _, ws := range workerStates.Registered() {
+		id := ws.AppService().ID
+		queued := db.queued[id]
+		if len(queued) == 0 {
+			if ws.EventsReady {
+				t.Errorf("worker for %s was woken up without any events", id)
+			}
+			continue
+		}
+		got = append(got, id)
+		if len(queued) != 1 || queued[0].Kind != kind {
+			t.Errorf("%s had %+v queued, want one %s event", id, queued, kind)
+		}
+		if !ws.EventsReady {
+			t.Errorf("worker for %s wasn't woken up", id)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events were queued for %v, want %v", got, want)
+	}
+}
+
+func mustUnmarshalQueued(t *testing.T, event types.EphemeralEvent) map[string]interface{} {
+	var result map[string]interface{}
+	if err := json.Unmarshal(event.Event, &result); err != nil {
+		t.Fatalf("json.Unmarshal returned %s", err)
+	}
+	return result
+}
+
+func TestSendToDeviceQueued(t *testing.T) {
+	db, workerStates := setupEphemeral()
+	s := &OutputSendToDeviceEventConsumer{asDB: db, workerStates: workerStates}
+
+	err := s.onMessage(mustMessage(t, api.OutputSendToDeviceEvent{
+		UserID:   "@bridge_alice:localhost",
+		DeviceID: "DEVICE",
+		SendToDeviceEvent: api.SendToDeviceEvent{
+			Sender:  "@bob:localhost",
+			Type:    "m.room_key_request",
+			Content: json.RawMessage(`{"action":"request"}`),
+		},
+	}))
+	if err != nil {
+		t.Fatalf("onMessage returned %s", err)
+	}
+	assertQueued(t, db, workerStates, types.ToDeviceEventKind, "bridge")
+
+	got := mustUnmarshalQueued(t, db.queued["bridge"][0])
+	want := map[string]interface{}{
+		"sender":       "@bob:localhost",
+		"type":         "m.room_key_request",
+		"content":      map[string]interface{}{"action": "request"},
+		"to_user_id":   "@bridge_alice:localhost",
+		"to_device_id": "DEVICE",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+}
+
+func TestSendToDeviceOutsideNamespaces(t *testing.T) {
+	db, workerStates := setupEphemeral()
+	s := &OutputSendToDeviceEventConsumer{asDB: db, workerStates: workerStates}
+
+	if err := s.onMessage(mustMessage(t, api.OutputSendToDeviceEvent{
+		UserID:   "@alice:localhost",
+		DeviceID: "DEVICE",
+	})); err != nil {
+		t.Fatalf("onMessage returned %s", err)
+	}
+	assertQueued(t, db, workerStates, types.ToDeviceEventKind)
+}
+
+func TestReceiptQueued(t *testing.T) {
+	tests := []struct {
+		name    string
+		userID  string
+		aliases []string
+		want    []string
+	}{
+		{"sender in namespace", "@bridge_alice:localhost", nil, []string{"bridge"}},
+		{"room alias in namespace", "@alice:localhost", []string{"#aliases_room:localhost"}, []string{"aliases"}},
+		{"neither", "@alice:localhost", []string{"#room:localhost"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, workerStates := setupEphemeral()
+			s := &OutputReceiptEventConsumer{
+				asDB:         db,
+				rsAPI:        &aliasesRoomserverAPI{aliases: tt.aliases},
+				workerStates: workerStates,
+			}
+			if err := s.onMessage(mustMessage(t, api.OutputReceiptEvent{
+				UserID:    tt.userID,
+				RoomID:    "!room:localhost",
+				EventID:   "$event:localhost",
+				Type:      "m.read",
+				Timestamp: gomatrixserverlib.Timestamp(1234),
+			})); err != nil {
+				t.Fatalf("onMessage returned %s", err)
+			}
+			assertQueued(t, db, workerStates, types.EphemeralEventKind, tt.want...)
+			if len(tt.want) == 0 {
+				return
+			}
+
+			got := mustUnmarshalQueued(t, db.queued[tt.want[0]][0])
+			want := map[string]interface{}{
+				"type":    "m.receipt",
+				"room_id": "!room:localhost",
+				"content": map[string]interface{}{
+					"$event:localhost": map[string]interface{}{
+						"m.read": map[string]interface{}{
+							tt.userID: map[string]interface{}{"ts": float64(1234)},
+						},
+					},
+				},
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("queued %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTypingQueued(t *testing.T) {
+	db, workerStates := setupEphemeral()
+	s := &OutputTypingEventConsumer{
+		asDB:         db,
+		rsAPI:        &aliasesRoomserverAPI{},
+		typingCache:  cache.New(),
+		workerStates: workerStates,
+	}
+	expireTime := time.Now().Add(time.Minute)
+	if err := s.onMessage(mustMessage(t, api.OutputTypingEvent{
+		Event: api.TypingEvent{
+			Type:   "m.typing",
+			RoomID: "!room:localhost",
+			UserID: "@bridge_alice:localhost",
+			Typing: true,
+		},
+		ExpireTime: &expireTime,
+	})); err != nil {
+		t.Fatalf("onMessage returned %s", err)
+	}
+	assertQueued(t, db, workerStates, types.EphemeralEventKind, "bridge")
+
+	got := mustUnmarshalQueued(t, db.queued["bridge"][0])
+	want := map[string]interface{}{
+		"type":    "m.typing",
+		"room_id": "!room:localhost",
+		"content": map[string]interface{}{
+			"user_ids": []interface{}{"@bridge_alice:localhost"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queued %v, want %v", got, want)
+	}
+
+	// Stopping typing sends the now empty list of typing users.
+	if err := s.onMessage(mustMessage(t, api.OutputTypingEvent{
+		Event: api.TypingEvent{
+			Type:   "m.typing",
+			RoomID: "!room:localhost",
+			UserID: "@bridge_alice:localhost",
+			Typing: false,
+		},
+	})); err != nil {
+		t.Fatalf("onMessage returned %s", err)
+	}
+	queued := db.queued["bridge"]
+	if len(queued) != 2 {
+		t.Fatalf("%d events were queued, want 2", len(queued))
+	}
+	got = mustUnmarshalQueued(t, queued[1])
+	if userIDs := got["content"].(map[string]interface{})["user_ids"]; !reflect.DeepEqual(userIDs, []interface{}{}) {
+		t.Errorf("queued typing users %v after stopping typing, want none", userIDs)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputPresenceEventConsumer consumes presence updates that originated in the EDU server.
+type OutputPresenceEventConsumer struct {
+	consumer     *internal.ContinualConsumer
+	asDB         storage.Database
+	workerStates *types.ApplicationServiceWorkerStates
+}
+
+// NewOutputPresenceEventConsumer creates a new OutputPresenceEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputPresenceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	store accounts.Database,
+	appserviceDB storage.Database,
+	workerStates *types.ApplicationServiceWorkerStates,
+) *OutputPresenceEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	s := &OutputPresenceEventConsumer{
+		consumer:     &consumer,
+		asDB:         appserviceDB,
+		workerStates: workerStates,
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the EDU server
+func (s *OutputPresenceEventConsumer) Start() error {
+	return s.consumer.Start()
+}
+
+// onMessage is called when the appservice component receives a presence update
+// from the EDU server. It sends the presence of users within the namespaces of
+// application services on to them.
+func (s *OutputPresenceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	content := map[string]interface{}{
+		"presence":         output.Presence,
+		"currently_active": output.CurrentlyActive,
+	}
+	if output.StatusMsg != nil {
+		content["status_msg"] = *output.StatusMsg
+	}
+	if output.LastActiveTS != 0 {
+		content["last_active_ago"] = time.Since(output.LastActiveTS.Time()).Milliseconds()
+	}
+	event := ephemeralEvent{
+		Type:    "m.presence",
+		Sender:  output.UserID,
+		Content: content,
+	}
+	return queueEphemeralEvent(context.TODO(), s.asDB, s.workerStates, types.EphemeralEventKind, event, func(appservice *config.ApplicationService) bool {
+		return appservice.IsInterestedInUserID(output.UserID)
+	})
+}
@@ -37,7 +37,7 @@ type OutputRoomEventConsumer struct {
 	asDB               storage.Database
 	rsAPI              api.RoomserverInternalAPI
 	serverName         string
-	workerStates       []types.ApplicationServiceWorkerState
+	workerStates       *types.ApplicationServiceWorkerStates
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call
@@ -48,7 +48,7 @@ func NewOutputRoomEventConsumer(
 	store accounts.Database,
 	appserviceDB storage.Database,
 	rsAPI api.RoomserverInternalAPI,
-	workerStates []types.ApplicationServiceWorkerState,
+	workerStates *types.ApplicationServiceWorkerStates,
 ) *OutputRoomEventConsumer {
 	consumer := internal.ContinualConsumer{
 		Topic:          string(cfg.Kafka.Topics.OutputRoomEvent),
@@ -154,12 +154,13 @@ func (s *OutputRoomEventConsumer) filterRoomserverEvents(
 	ctx context.Context,
 	events []gomatrixserverlib.HeaderedEvent,
 ) error {
-	for _, ws := range s.workerStates {
+	for _, ws := range s.workerStates.Registered() {
+		appservice := ws.AppService()
 		for _, event := range events {
 			// Check if this event is interesting to this application service
-			if s.appserviceIsInterestedInEvent(ctx, event, ws.AppService) {
+			if s.appserviceIsInterestedInEvent(ctx, event, appservice) {
 				// Queue this event to be sent off to the application service
-				if err := s.asDB.StoreEvent(ctx, ws.AppService.ID, &event); err != nil {
+				if err := s.asDB.StoreEvent(ctx, appservice.ID, &event); err != nil {
 					log.WithError(err).Warn("failed to insert incoming event into appservices database")
 				} else {
 					// Tell our worker to send out new messages by updating remaining message
@@ -182,9 +183,8 @@ func (s *OutputRoomEventConsumer) appserviceIsInterestedInEvent(ctx context.Cont
 		return false
 	}
 
-	// Check Room ID and Sender of the event
-	if appservice.IsInterestedInUserID(event.Sender()) ||
-		appservice.IsInterestedInRoomID(event.RoomID()) {
+	// Check Sender of the event
+	if appservice.IsInterestedInUserID(event.Sender()) {
 		return true
 	}
 
@@ -194,10 +194,24 @@ func (s *OutputRoomEventConsumer) appserviceIsInterestedInEvent(ctx context.Cont
 		}
 	}
 
-	// Check all known room aliases of the room the event came from
-	queryReq := api.GetAliasesForRoomIDRequest{RoomID: event.RoomID()}
+	return appserviceIsInterestedInRoom(ctx, s.rsAPI, &appservice, event.RoomID())
+}
+
+// appserviceIsInterestedInRoom returns a boolean depending on whether the ID or
+// any of the known aliases of a room fall within one of a given application
+// service's namespaces.
+func appserviceIsInterestedInRoom(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI,
+	appservice *config.ApplicationService, roomID string,
+) bool {
+	if appservice.IsInterestedInRoomID(roomID) {
+		return true
+	}
+
+	// Check all known room aliases of the room
+	queryReq := api.GetAliasesForRoomIDRequest{RoomID: roomID}
 	var queryRes api.GetAliasesForRoomIDResponse
-	if err := s.rsAPI.GetAliasesForRoomID(ctx, &queryReq, &queryRes); err == nil {
+	if err := rsAPI.GetAliasesForRoomID(ctx, &queryReq, &queryRes); err == nil {
 		for _, alias := range queryRes.Aliases {
 			if appservice.IsInterestedInRoomAlias(alias) {
 				return true
@@ -205,7 +219,7 @@ func (s *OutputRoomEventConsumer) appserviceIsInterestedInEvent(ctx context.Cont
 		}
 	} else {
 		log.WithFields(log.Fields{
-			"room_id": event.RoomID(),
+			"room_id": roomID,
 		}).WithError(err).Errorf("Unable to get aliases for room")
 	}
 
@@ -56,7 +56,7 @@ func (a *AppServiceQueryAPI) RoomAliasExists(
 	}
 
 	// Determine which application service should handle this request
-	for _, appservice := range a.Cfg.Derived.ApplicationServices {
+	for _, appservice := range a.Cfg.AppServices() {
 		if appservice.URL != "" && appservice.IsInterestedInRoomAlias(request.Alias) {
 			// The full path to the rooms API, includes hs token
 			URL, err := url.Parse(appservice.URL + roomAliasExistsPath)
@@ -124,7 +124,7 @@ func (a *AppServiceQueryAPI) UserIDExists(
 	}
 
 	// Determine which application service should handle this request
-	for _, appservice := range a.Cfg.Derived.ApplicationServices {
+	for _, appservice := range a.Cfg.AppServices() {
 		if appservice.URL != "" && appservice.IsInterestedInUserID(request.UserID) {
 			// The full path to the rooms API, includes hs token
 			URL, err := url.Parse(appservice.URL + userIDExistsPath)
@@ -211,4 +211,46 @@ func (a *AppServiceQueryAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.AppServiceThirdPartyProtocolsPath,
+		internal.MakeInternalAPI("appserviceThirdPartyProtocols", func(req *http.Request) util.JSONResponse {
+			var request api.ThirdPartyProtocolsRequest
+			var response api.ThirdPartyProtocolsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.ThirdPartyProtocols(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.AppServiceThirdPartyLocationsPath,
+		internal.MakeInternalAPI("appserviceThirdPartyLocations", func(req *http.Request) util.JSONResponse {
+			var request api.ThirdPartyLookupRequest
+			var response api.ThirdPartyLocationsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.ThirdPartyLocations(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.AppServiceThirdPartyUsersPath,
+		internal.MakeInternalAPI("appserviceThirdPartyUsers", func(req *http.Request) util.JSONResponse {
+			var request api.ThirdPartyLookupRequest
+			var response api.ThirdPartyUsersResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := a.ThirdPartyUsers(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
@@ -0,0 +1,219 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	opentracing "github.com/opentracing/opentracing-go"
+	log "github.com/sirupsen/logrus"
+)
+
+const thirdPartyPath = "/_matrix/app/v1/thirdparty/"
+
+// ThirdPartyProtocols performs a request to '/thirdparty/protocol/{protocol}' on
+// every application service providing each protocol, merging the networks they
+// provide into one set of metadata per protocol
+func (a *AppServiceQueryAPI) ThirdPartyProtocols(
+	ctx context.Context,
+	request *api.ThirdPartyProtocolsRequest,
+	response *api.ThirdPartyProtocolsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceThirdPartyProtocols")
+	defer span.Finish()
+
+	// Create an HTTP client if one does not already exist
+	if a.HTTPClient == nil {
+		a.HTTPClient = makeHTTPClient()
+	}
+
+	response.Protocols = make(map[string]api.ThirdPartyProtocol)
+	for _, appservice := range a.Cfg.AppServices() {
+		if appservice.URL == "" {
+			continue
+		}
+		for _, protocolID := range appservice.Protocols {
+			if request.Protocol != "" && protocolID != request.Protocol {
+				continue
+			}
+			var protocol api.ThirdPartyProtocol
+			if err := a.queryThirdParty(
+				ctx, appservice, "protocol/"+url.PathEscape(protocolID), nil, &protocol,
+			); err != nil {
+				log.WithFields(log.Fields{
+					"appservice_id": appservice.ID,
+					"protocol":      protocolID,
+				}).WithError(err).Warn("Unable to query third party protocol on application service")
+				continue
+			}
+			for i, instance := range protocol.Instances {
+				if instance.NetworkID != "" {
+					protocol.Instances[i].InstanceID = api.ThirdPartyInstanceID(appservice.ID, instance.NetworkID)
+				}
+			}
+			if existing, ok := response.Protocols[protocolID]; ok {
+				existing.Instances = append(existing.Instances, protocol.Instances...)
+				protocol = existing
+			} else if protocol.Instances == nil {
+				protocol.Instances = []api.ThirdPartyProtocolInstance{}
+			}
+			response.Protocols[protocolID] = protocol
+		}
+	}
+
+	return nil
+}
+
+// ThirdPartyLocations performs a request to '/thirdparty/location/{protocol}' on
+// every application service providing the protocol, or to '/thirdparty/location'
+// on the application services whose namespaces include the room alias
+func (a *AppServiceQueryAPI) ThirdPartyLocations(
+	ctx context.Context,
+	request *api.ThirdPartyLookupRequest,
+	response *api.ThirdPartyLocationsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceThirdPartyLocations")
+	defer span.Finish()
+
+	// Create an HTTP client if one does not already exist
+	if a.HTTPClient == nil {
+		a.HTTPClient = makeHTTPClient()
+	}
+
+	response.Locations = []api.ThirdPartyLocation{}
+	appservices := a.thirdPartyLookupServices(request, "alias", (*config.ApplicationService).IsInterestedInRoomAlias)
+	for _, appservice := range appservices {
+		var locations []api.ThirdPartyLocation
+		if err := a.queryThirdParty(
+			ctx, appservice, thirdPartyLookupPath("location", request.Protocol), request.Fields, &locations,
+		); err != nil {
+			log.WithField("appservice_id", appservice.ID).WithError(err).Warn("Unable to look up third party locations on application service")
+			continue
+		}
+		response.Locations = append(response.Locations, locations...)
+	}
+
+	return nil
+}
+
+// ThirdPartyUsers performs a request to '/thirdparty/user/{protocol}' on every
+// application service providing the protocol, or to '/thirdparty/user' on the
+// application services whose namespaces include the user ID
+func (a *AppServiceQueryAPI) ThirdPartyUsers(
+	ctx context.Context,
+	request *api.ThirdPartyLookupRequest,
+	response *api.ThirdPartyUsersResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "ApplicationServiceThirdPartyUsers")
+	defer span.Finish()
+
+	// Create an HTTP client if one does not already exist
+	if a.HTTPClient == nil {
+		a.HTTPClient = makeHTTPClient()
+	}
+
+	response.Users = []api.ThirdPartyUser{}
+	appservices := a.thirdPartyLookupServices(request, "userid", (*config.ApplicationService).IsInterestedInUserID)
+	for _, appservice := range appservices {
+		var users []api.ThirdPartyUser
+		if err := a.queryThirdParty(
+			ctx, appservice, thirdPartyLookupPath("user", request.Protocol), request.Fields, &users,
+		); err != nil {
+			log.WithField("appservice_id", appservice.ID).WithError(err).Warn("Unable to look up third party users on application service")
+			continue
+		}
+		response.Users = append(response.Users, users...)
+	}
+
+	return nil
+}
+
+// thirdPartyLookupServices returns the application services which should handle
+// a lookup: those providing the protocol, or if there is no protocol, those
+// interested in the Matrix ID given in the reverse lookup field.
+func (a *AppServiceQueryAPI) thirdPartyLookupServices(
+	request *api.ThirdPartyLookupRequest, reverseField string,
+	isInterested func(*config.ApplicationService, string) bool,
+) (appservices []config.ApplicationService) {
+	var matrixID string
+	if values := request.Fields[reverseField]; len(values) > 0 {
+		matrixID = values[0]
+	}
+	registered := a.Cfg.AppServices()
+	for i := range registered {
+		appservice := &registered[i]
+		if appservice.URL == "" {
+			continue
+		}
+		if request.Protocol == "" {
+			if matrixID != "" && isInterested(appservice, matrixID) {
+				appservices = append(appservices, *appservice)
+			}
+			continue
+		}
+		for _, protocol := range appservice.Protocols {
+			if protocol == request.Protocol {
+				appservices = append(appservices, *appservice)
+				break
+			}
+		}
+	}
+	return
+}
+
+// thirdPartyLookupPath returns the path of a lookup of the given kind, which
+// is a reverse lookup if there is no protocol.
+func thirdPartyLookupPath(kind, protocol string) string {
+	if protocol == "" {
+		return kind
+	}
+	return kind + "/" + url.PathEscape(protocol)
+}
+
+// queryThirdParty performs a GET request to the given third party API path on
+// an application service, decoding its response into the given value.
+func (a *AppServiceQueryAPI) queryThirdParty(
+	ctx context.Context, appservice config.ApplicationService,
+	path string, fields map[string][]string, response interface{},
+) error {
+	query := url.Values{}
+	for field, values := range fields {
+		query[field] = values
+	}
+	query.Set("access_token", appservice.HSToken)
+	apiURL := appservice.URL + thirdPartyPath + path + "?" + query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, apiURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := a.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, resp.Body, "queryThirdParty: failed to close response body")
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("application service responded with status code %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
@@ -0,0 +1,255 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+// thirdPartyServer is an application service which answers third party
+// requests with the responses keyed by path, recording the requests made.
+type thirdPartyServer struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	requests  []*http.Request
+	responses map[string]interface{}
+}
+
+func newThirdPartyServer(responses map[string]interface{}) *thirdPartyServer {
+	s := &thirdPartyServer{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		s.mutex.Lock()
+		s.requests = append(s.requests, req)
+		s.mutex.Unlock()
+		res, ok := s.responses[req.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(res)
+	}))
+	return s
+}
+
+func (s *thirdPartyServer) paths() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	paths := []string{}
+	for _, req := range s.requests {
+		paths = append(paths, req.URL.Path)
+	}
+	return paths
+}
+
+func mustCompileNamespace(regex string) []config.ApplicationServiceNamespace {
+	return []config.ApplicationServiceNamespace{{Regex: regex, RegexpObject: regexp.MustCompile(regex)}}
+}
+
+// setupThirdParty registers an IRC bridge, a broken IRC bridge and a Gitter
+// bridge.
+func setupThirdParty(t *testing.T) (a *AppServiceQueryAPI, irc, broken, gitter *thirdPartyServer) {
+	irc = newThirdPartyServer(map[string]interface{}{
+		thirdPartyPath + "protocol/irc": api.ThirdPartyProtocol{
+			UserFields: []string{"network", "nickname"},
+			Instances: []api.ThirdPartyProtocolInstance{
+				{Desc: "Freenode", NetworkID: "freenode", Fields: json.RawMessage(`{}`)},
+			},
+		},
+		thirdPartyPath + "location/irc": []api.ThirdPartyLocation{
+			{Alias: "#irc_freenode_#matrix:localhost", Protocol: "irc", Fields: json.RawMessage(`{}`)},
+		},
+		thirdPartyPath + "location": []api.ThirdPartyLocation{
+			{Alias: "#irc_freenode_#matrix:localhost", Protocol: "irc", Fields: json.RawMessage(`{}`)},
+		},
+		thirdPartyPath + "user": []api.ThirdPartyUser{
+			{UserID: "@irc_alice:localhost", Protocol: "irc", Fields: json.RawMessage(`{}`)},
+		},
+	})
+	broken = newThirdPartyServer(map[string]interface{}{})
+	gitter = newThirdPartyServer(map[string]interface{}{
+		thirdPartyPath + "protocol/gitter": api.ThirdPartyProtocol{
+			Instances: []api.ThirdPartyProtocolInstance{
+				{Desc: "Gitter", NetworkID: "gitter", Fields: json.RawMessage(`{}`)},
+			},
+		},
+	})
+
+	cfg := &config.Dendrite{}
+	cfg.Derived.ApplicationServices = []config.ApplicationService{
+		{
+			ID: "irc", URL: irc.URL, HSToken: "irc_token", Protocols: []string{"irc"},
+			NamespaceMap: map[string][]config.ApplicationServiceNamespace{
+				"aliases": mustCompileNamespace("#irc_.*"),
+				"users":   mustCompileNamespace("@irc_.*"),
+			},
+		},
+		{ID: "broken", URL: broken.URL, HSToken: "broken_token", Protocols: []string{"irc"}},
+		{ID: "gitter", URL: gitter.URL, HSToken: "gitter_token", Protocols: []string{"gitter"}},
+		// Application services without URLs can't be asked anything.
+		{ID: "nourl", Protocols: []string{"irc"}},
+	}
+	return &AppServiceQueryAPI{Cfg: cfg}, irc, broken, gitter
+}
+
+func TestThirdPartyProtocols(t *testing.T) {
+	a, irc, broken, gitter := setupThirdParty(t)
+	defer irc.Close()
+	defer broken.Close()
+	defer gitter.Close()
+
+	var res api.ThirdPartyProtocolsResponse
+	if err := a.ThirdPartyProtocols(context.Background(), &api.ThirdPartyProtocolsRequest{}, &res); err != nil {
+		t.Fatalf("ThirdPartyProtocols returned %s", err)
+	}
+	var protocols []string
+	for protocol := range res.Protocols {
+		protocols = append(protocols, protocol)
+	}
+	sort.Strings(protocols)
+	if want := []string{"gitter", "irc"}; !reflect.DeepEqual(protocols, want) {
+		t.Fatalf("ThirdPartyProtocols returned protocols %v, want %v", protocols, want)
+	}
+	// The broken bridge is skipped rather than failing the whole request.
+	ircProtocol := res.Protocols["irc"]
+	if len(ircProtocol.Instances) != 1 || ircProtocol.Instances[0].InstanceID != "irc|freenode" {
+		t.Errorf("ThirdPartyProtocols returned irc instances %+v, want irc|freenode", ircProtocol.Instances)
+	}
+	if want := []string{"network", "nickname"}; !reflect.DeepEqual(ircProtocol.UserFields, want) {
+		t.Errorf("ThirdPartyProtocols returned irc user fields %v, want %v", ircProtocol.UserFields, want)
+	}
+	if gitterProtocol := res.Protocols["gitter"]; len(gitterProtocol.Instances) != 1 || gitterProtocol.Instances[0].InstanceID != "gitter|gitter" {
+		t.Errorf("ThirdPartyProtocols returned gitter instances %+v, want gitter|gitter", gitterProtocol.Instances)
+	}
+	if len(broken.paths()) != 1 {
+		t.Errorf("broken bridge was asked %d times, want once", len(broken.paths()))
+	}
+
+	// Application services are authenticated with their homeserver token.
+	if token := irc.requests[0].URL.Query().Get("access_token"); token != "irc_token" {
+		t.Errorf("irc bridge was sent access_token %q, want irc_token", token)
+	}
+}
+
+func TestThirdPartyProtocolsOneProtocol(t *testing.T) {
+	a, irc, broken, gitter := setupThirdParty(t)
+	defer irc.Close()
+	defer broken.Close()
+	defer gitter.Close()
+
+	var res api.ThirdPartyProtocolsResponse
+	if err := a.ThirdPartyProtocols(context.Background(), &api.ThirdPartyProtocolsRequest{Protocol: "gitter"}, &res); err != nil {
+		t.Fatalf("ThirdPartyProtocols returned %s", err)
+	}
+	if _, ok := res.Protocols["gitter"]; !ok || len(res.Protocols) != 1 {
+		t.Fatalf("ThirdPartyProtocols returned %+v, want only gitter", res.Protocols)
+	}
+	if len(irc.paths()) != 0 {
+		t.Errorf("irc bridge was asked about gitter")
+	}
+}
+
+func TestThirdPartyLocations(t *testing.T) {
+	tests := []struct {
+		name          string
+		request       api.ThirdPartyLookupRequest
+		wantLocations int
+		wantIRCPaths  []string
+		wantGitter    bool
+	}{
+		{
+			name:          "by protocol",
+			request:       api.ThirdPartyLookupRequest{Protocol: "irc", Fields: map[string][]string{"channel": {"#matrix"}}},
+			wantLocations: 1,
+			wantIRCPaths:  []string{thirdPartyPath + "location/irc"},
+		},
+		{
+			name:          "reverse lookup in namespace",
+			request:       api.ThirdPartyLookupRequest{Fields: map[string][]string{"alias": {"#irc_freenode_#matrix:localhost"}}},
+			wantLocations: 1,
+			wantIRCPaths:  []string{thirdPartyPath + "location"},
+		},
+		{
+			name:         "reverse lookup outside namespaces",
+			request:      api.ThirdPartyLookupRequest{Fields: map[string][]string{"alias": {"#matrix:localhost"}}},
+			wantIRCPaths: []string{},
+		},
+		{
+			name:         "unknown protocol",
+			request:      api.ThirdPartyLookupRequest{Protocol: "xmpp"},
+			wantIRCPaths: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, irc, broken, gitter := setupThirdParty(t)
+			defer irc.Close()
+			defer broken.Close()
+			defer gitter.Close()
+
+			var res api.ThirdPartyLocationsResponse
+			if err := a.ThirdPartyLocations(context.Background(), &tt.request, &res); err != nil {
+				t.Fatalf("ThirdPartyLocations returned %s", err)
+			}
+			if res.Locations == nil || len(res.Locations) != tt.wantLocations {
+				t.Errorf("ThirdPartyLocations returned %+v, want %d locations", res.Locations, tt.wantLocations)
+			}
+			if got := irc.paths(); !reflect.DeepEqual(got, tt.wantIRCPaths) {
+				t.Errorf("irc bridge was asked %v, want %v", got, tt.wantIRCPaths)
+			}
+			if len(gitter.paths()) != 0 {
+				t.Errorf("gitter bridge was asked %v, want nothing", gitter.paths())
+			}
+			if tt.request.Protocol != "" && len(tt.wantIRCPaths) > 0 {
+				if got := irc.requests[0].URL.Query()["channel"]; !reflect.DeepEqual(got, []string{"#matrix"}) {
+					t.Errorf("irc bridge was sent channel %v, want #matrix", got)
+				}
+			}
+		})
+	}
+}
+
+func TestThirdPartyUsers(t *testing.T) {
+	a, irc, broken, gitter := setupThirdParty(t)
+	defer irc.Close()
+	defer broken.Close()
+	defer gitter.Close()
+
+	var res api.ThirdPartyUsersResponse
+	if err := a.ThirdPartyUsers(context.Background(), &api.ThirdPartyLookupRequest{
+		Fields: map[string][]string{"userid": {"@irc_alice:localhost"}},
+	}, &res); err != nil {
+		t.Fatalf("ThirdPartyUsers returned %s", err)
+	}
+	if len(res.Users) != 1 || res.Users[0].UserID != "@irc_alice:localhost" {
+		t.Fatalf("ThirdPartyUsers returned %+v, want @irc_alice:localhost", res.Users)
+	}
+	if want := []string{thirdPartyPath + "user"}; !reflect.DeepEqual(irc.paths(), want) {
+		t.Errorf("irc bridge was asked %v, want %v", irc.paths(), want)
+	}
+	if len(broken.paths()) != 0 {
+		t.Errorf("bridge outside the user namespace was asked %v", broken.paths())
+	}
+}
@@ -17,6 +17,7 @@ package storage
 import (
 	"context"
 
+	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -26,5 +27,10 @@ type Database interface {
 	CountEventsWithAppServiceID(ctx context.Context, appServiceID string) (int, error)
 	UpdateTxnIDForEvents(ctx context.Context, appserviceID string, maxID, txnID int) error
 	RemoveEventsBeforeAndIncludingID(ctx context.Context, appserviceID string, eventTableID int) error
+	StoreEphemeralEvent(ctx context.Context, appServiceID string, event types.EphemeralEvent) error
+	GetEphemeralEventsWithAppServiceID(ctx context.Context, appServiceID string, limit int) (int, int, []types.EphemeralEvent, bool, error)
+	CountEphemeralEventsWithAppServiceID(ctx context.Context, appServiceID string) (int, error)
+	UpdateTxnIDForEphemeralEvents(ctx context.Context, appserviceID string, maxID, txnID int) error
+	RemoveEphemeralEventsBeforeAndIncludingID(ctx context.Context, appserviceID string, eventTableID int) error
 	GetLatestTxnID(ctx context.Context) (int, error)
 }
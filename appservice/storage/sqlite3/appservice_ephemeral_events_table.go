@@ -0,0 +1,186 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/dendrite/internal"
+)
+
+const appserviceEphemeralEventsSchema = `
+-- Stores ephemeral events and send-to-device messages to be sent to application
+-- services which have opted in to receiving them
+CREATE TABLE IF NOT EXISTS appservice_ephemeral_events (
+	-- An auto-incrementing id unique to each event in the table
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	-- The ID of the application service the event will be sent to
+	as_id TEXT NOT NULL,
+	-- The section of the transaction the event is sent in
+	kind TEXT NOT NULL,
+	-- JSON representation of the event
+	event_json TEXT NOT NULL,
+	-- The ID of the transaction that this event is a part of
+	txn_id INTEGER NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS appservice_ephemeral_events_as_id ON appservice_ephemeral_events(as_id);
+`
+
+const selectEphemeralEventsByApplicationServiceIDSQL = "" +
+	"SELECT id, kind, event_json, txn_id " +
+	"FROM appservice_ephemeral_events WHERE as_id = $1 ORDER BY txn_id DESC, id ASC"
+
+const countEphemeralEventsByApplicationServiceIDSQL = "" +
+	"SELECT COUNT(id) FROM appservice_ephemeral_events WHERE as_id = $1"
+
+const insertEphemeralEventSQL = "" +
+	"INSERT INTO appservice_ephemeral_events(as_id, kind, event_json, txn_id) " +
+	"VALUES ($1, $2, $3, $4)"
+
+const updateTxnIDForEphemeralEventsSQL = "" +
+	"UPDATE appservice_ephemeral_events SET txn_id = $1 WHERE as_id = $2 AND id <= $3"
+
+const deleteEphemeralEventsBeforeAndIncludingIDSQL = "" +
+	"DELETE FROM appservice_ephemeral_events WHERE as_id = $1 AND id <= $2"
+
+type ephemeralEventsStatements struct {
+	selectEphemeralEventsByApplicationServiceIDStmt *sql.Stmt
+	countEphemeralEventsByApplicationServiceIDStmt  *sql.Stmt
+	insertEphemeralEventStmt                        *sql.Stmt
+	updateTxnIDForEphemeralEventsStmt               *sql.Stmt
+	deleteEphemeralEventsBeforeAndIncludingIDStmt   *sql.Stmt
+}
+
+func (s *ephemeralEventsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(appserviceEphemeralEventsSchema)
+	if err != nil {
+		return
+	}
+
+	if s.selectEphemeralEventsByApplicationServiceIDStmt, err = db.Prepare(selectEphemeralEventsByApplicationServiceIDSQL); err != nil {
+		return
+	}
+	if s.countEphemeralEventsByApplicationServiceIDStmt, err = db.Prepare(countEphemeralEventsByApplicationServiceIDSQL); err != nil {
+		return
+	}
+	if s.insertEphemeralEventStmt, err = db.Prepare(insertEphemeralEventSQL); err != nil {
+		return
+	}
+	if s.updateTxnIDForEphemeralEventsStmt, err = db.Prepare(updateTxnIDForEphemeralEventsSQL); err != nil {
+		return
+	}
+	if s.deleteEphemeralEventsBeforeAndIncludingIDStmt, err = db.Prepare(deleteEphemeralEventsBeforeAndIncludingIDSQL); err != nil {
+		return
+	}
+
+	return
+}
+
+// selectEphemeralEventsByApplicationServiceID returns the ephemeral events that
+// need to be sent to an application service in the same way as
+// selectEventsByApplicationServiceID: those of an unsuccessfully sent
+// transaction first, otherwise up to the limit of the events not yet sent.
+func (s *ephemeralEventsStatements) selectEphemeralEventsByApplicationServiceID(
+	ctx context.Context,
+	applicationServiceID string,
+	limit int,
+) (
+	txnID, maxID int,
+	events []types.EphemeralEvent,
+	eventsRemaining bool,
+	err error,
+) {
+	rows, err := s.selectEphemeralEventsByApplicationServiceIDStmt.QueryContext(ctx, applicationServiceID)
+	if err != nil {
+		return
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEphemeralEventsByApplicationServiceID: rows.close() failed")
+
+	lastTxnID := invalidTxnID
+	for eventsProcessed := 0; rows.Next(); {
+		var event types.EphemeralEvent
+		var eventJSON []byte
+		var id int
+		if err = rows.Scan(&id, &event.Kind, &eventJSON, &txnID); err != nil {
+			return 0, 0, nil, false, err
+		}
+		event.Event = eventJSON
+
+		// If txnID has changed on this event from the previous event, then we've
+		// reached the end of a transaction's events. Return only those events.
+		if lastTxnID > invalidTxnID && lastTxnID != txnID {
+			return lastTxnID, maxID, events, true, nil
+		}
+		lastTxnID = txnID
+
+		// Limit events that aren't part of an old transaction
+		if txnID == -1 {
+			if eventsProcessed++; eventsProcessed > limit {
+				return lastTxnID, maxID, events, true, nil
+			}
+		}
+
+		if id > maxID {
+			maxID = id
+		}
+		events = append(events, event)
+	}
+
+	return txnID, maxID, events, false, rows.Err()
+}
+
+func (s *ephemeralEventsStatements) countEphemeralEventsByApplicationServiceID(
+	ctx context.Context,
+	appServiceID string,
+) (count int, err error) {
+	err = s.countEphemeralEventsByApplicationServiceIDStmt.QueryRowContext(ctx, appServiceID).Scan(&count)
+	return
+}
+
+func (s *ephemeralEventsStatements) insertEphemeralEvent(
+	ctx context.Context,
+	appServiceID string,
+	event types.EphemeralEvent,
+) (err error) {
+	_, err = s.insertEphemeralEventStmt.ExecContext(
+		ctx,
+		appServiceID,
+		event.Kind,
+		[]byte(event.Event),
+		-1, // No transaction ID yet
+	)
+	return
+}
+
+func (s *ephemeralEventsStatements) updateTxnIDForEphemeralEvents(
+	ctx context.Context,
+	appserviceID string,
+	maxID, txnID int,
+) (err error) {
+	_, err = s.updateTxnIDForEphemeralEventsStmt.ExecContext(ctx, txnID, appserviceID, maxID)
+	return
+}
+
+func (s *ephemeralEventsStatements) deleteEphemeralEventsBeforeAndIncludingID(
+	ctx context.Context,
+	appserviceID string,
+	eventTableID int,
+) (err error) {
+	_, err = s.deleteEphemeralEventsBeforeAndIncludingIDStmt.ExecContext(ctx, appserviceID, eventTableID)
+	return
+}
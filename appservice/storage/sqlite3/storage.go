@@ -20,6 +20,7 @@ import (
 	"database/sql"
 
 	// Import SQLite database driver
+	"github.com/matrix-org/dendrite/appservice/types"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -28,9 +29,10 @@ import (
 
 // Database stores events intended to be later sent to application services
 type Database struct {
-	events eventsStatements
-	txnID  txnStatements
-	db     *sql.DB
+	events          eventsStatements
+	ephemeralEvents ephemeralEventsStatements
+	txnID           txnStatements
+	db              *sql.DB
 }
 
 // NewDatabase opens a new database
@@ -50,6 +52,9 @@ func (d *Database) prepare() error {
 	if err := d.events.prepare(d.db); err != nil {
 		return err
 	}
+	if err := d.ephemeralEvents.prepare(d.db); err != nil {
+		return err
+	}
 
 	return d.txnID.prepare(d.db)
 }
@@ -105,6 +110,57 @@ func (d *Database) RemoveEventsBeforeAndIncludingID(
 	return d.events.deleteEventsBeforeAndIncludingID(ctx, appserviceID, eventTableID)
 }
 
+// StoreEphemeralEvent stores an ephemeral event or send-to-device message in
+// the database for a transaction worker to pull and later send to an
+// application service.
+func (d *Database) StoreEphemeralEvent(
+	ctx context.Context,
+	appServiceID string,
+	event types.EphemeralEvent,
+) error {
+	return d.ephemeralEvents.insertEphemeralEvent(ctx, appServiceID, event)
+}
+
+// GetEphemeralEventsWithAppServiceID returns a slice of ephemeral events
+// intended to be sent to an application service, in the same way as
+// GetEventsWithAppServiceID.
+func (d *Database) GetEphemeralEventsWithAppServiceID(
+	ctx context.Context,
+	appServiceID string,
+	limit int,
+) (int, int, []types.EphemeralEvent, bool, error) {
+	return d.ephemeralEvents.selectEphemeralEventsByApplicationServiceID(ctx, appServiceID, limit)
+}
+
+// CountEphemeralEventsWithAppServiceID returns the number of ephemeral events
+// destined for an application service given its ID.
+func (d *Database) CountEphemeralEventsWithAppServiceID(
+	ctx context.Context,
+	appServiceID string,
+) (int, error) {
+	return d.ephemeralEvents.countEphemeralEventsByApplicationServiceID(ctx, appServiceID)
+}
+
+// UpdateTxnIDForEphemeralEvents takes in an application service ID and
+// sets the transaction ID of its ephemeral events up to and including maxID.
+func (d *Database) UpdateTxnIDForEphemeralEvents(
+	ctx context.Context,
+	appserviceID string,
+	maxID, txnID int,
+) error {
+	return d.ephemeralEvents.updateTxnIDForEphemeralEvents(ctx, appserviceID, maxID, txnID)
+}
+
+// RemoveEphemeralEventsBeforeAndIncludingID removes all ephemeral events from
+// the database that are less than or equal to a given maximum ID.
+func (d *Database) RemoveEphemeralEventsBeforeAndIncludingID(
+	ctx context.Context,
+	appserviceID string,
+	eventTableID int,
+) error {
+	return d.ephemeralEvents.deleteEphemeralEventsBeforeAndIncludingID(ctx, appserviceID, eventTableID)
+}
+
 // GetLatestTxnID returns the latest available transaction id
 func (d *Database) GetLatestTxnID(
 	ctx context.Context,
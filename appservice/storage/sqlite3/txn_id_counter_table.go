@@ -18,6 +18,8 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
 )
 
 const txnIDSchema = `
@@ -29,16 +31,20 @@ CREATE TABLE IF NOT EXISTS appservice_counters (
 INSERT OR IGNORE INTO appservice_counters (name, last_id) VALUES('txn_id', 1);
 `
 
-const selectTxnIDSQL = `
-  SELECT last_id FROM appservice_counters WHERE name='txn_id';
-  UPDATE appservice_counters SET last_id=last_id+1 WHERE name='txn_id';
-`
+const selectTxnIDSQL = "" +
+	"SELECT last_id FROM appservice_counters WHERE name='txn_id'"
+
+const incrementTxnIDSQL = "" +
+	"UPDATE appservice_counters SET last_id=last_id+1 WHERE name='txn_id'"
 
 type txnStatements struct {
-	selectTxnIDStmt *sql.Stmt
+	db                 *sql.DB
+	selectTxnIDStmt    *sql.Stmt
+	incrementTxnIDStmt *sql.Stmt
 }
 
 func (s *txnStatements) prepare(db *sql.DB) (err error) {
+	s.db = db
 	_, err = db.Exec(txnIDSchema)
 	if err != nil {
 		return
@@ -47,14 +53,25 @@ func (s *txnStatements) prepare(db *sql.DB) (err error) {
 	if s.selectTxnIDStmt, err = db.Prepare(selectTxnIDSQL); err != nil {
 		return
 	}
+	if s.incrementTxnIDStmt, err = db.Prepare(incrementTxnIDSQL); err != nil {
+		return
+	}
 
 	return
 }
 
-// selectTxnID selects the latest ascending transaction ID
+// selectTxnID selects the latest ascending transaction ID. SQLite only runs the
+// first statement of a prepared statement, so the ID is read and incremented
+// in separate statements within a transaction.
 func (s *txnStatements) selectTxnID(
 	ctx context.Context,
 ) (txnID int, err error) {
-	err = s.selectTxnIDStmt.QueryRowContext(ctx).Scan(&txnID)
+	err = internal.WithTransaction(s.db, func(txn *sql.Tx) error {
+		if err := internal.TxStmt(txn, s.selectTxnIDStmt).QueryRowContext(ctx).Scan(&txnID); err != nil {
+			return err
+		}
+		_, err := internal.TxStmt(txn, s.incrementTxnIDStmt).ExecContext(ctx)
+		return err
+	})
 	return
 }
@@ -13,6 +13,7 @@
 package types
 
 import (
+	"encoding/json"
 	"sync"
 
 	"github.com/matrix-org/dendrite/internal/config"
@@ -23,17 +24,103 @@ const (
 	AppServiceDeviceID = "AS_Device"
 )
 
+const (
+	// EphemeralEventKind is the kind of the typing notifications, receipts and
+	// presence sent in the ephemeral section of a transaction
+	EphemeralEventKind = "ephemeral"
+	// ToDeviceEventKind is the kind of the send-to-device messages sent in the
+	// to-device section of a transaction
+	ToDeviceEventKind = "to_device"
+)
+
+// EphemeralEvent is an ephemeral event or send-to-device message queued to be
+// sent to an application service
+type EphemeralEvent struct {
+	// Which section of the transaction the event is sent in
+	Kind string
+	// The event as it is sent to the application service
+	Event json.RawMessage
+}
+
 // ApplicationServiceWorkerState is a type that couples an application service,
 // a lockable condition as well as some other state variables, allowing the
 // roomserver to notify appservice workers when there are events ready to send
 // externally to application services.
 type ApplicationServiceWorkerState struct {
-	AppService config.ApplicationService
-	Cond       *sync.Cond
+	Cond *sync.Cond
 	// Events ready to be sent
 	EventsReady bool
 	// Backoff exponent (2^x secs). Max 6, aka 64s.
 	Backoff int
+	// The registration of the application service, which can change when the
+	// application service registrations are reloaded
+	appService config.ApplicationService
+	// Whether the application service has been removed, so no more events
+	// will be queued for it
+	removed bool
+	// Whether a worker is running for the application service
+	running bool
+}
+
+// NewApplicationServiceWorkerState creates the worker state of the given
+// application service. No worker is running for it until it is registered with
+// Reregister.
+func NewApplicationServiceWorkerState(
+	appService config.ApplicationService,
+) *ApplicationServiceWorkerState {
+	m := sync.Mutex{}
+	return &ApplicationServiceWorkerState{
+		Cond:       sync.NewCond(&m),
+		appService: appService,
+	}
+}
+
+// AppService returns the current registration of the application service.
+func (a *ApplicationServiceWorkerState) AppService() config.ApplicationService {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	return a.appService
+}
+
+// Reregister replaces the registration of the application service, cancelling
+// its removal if it was removed. Returns true if a worker needs to be started
+// for the application service, in which case it is marked as running.
+func (a *ApplicationServiceWorkerState) Reregister(
+	appService config.ApplicationService,
+) bool {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	a.appService = appService
+	a.removed = false
+	if a.running || appService.URL == "" {
+		return false
+	}
+	a.running = true
+	return true
+}
+
+// Remove marks the application service as removed and wakes up its worker, so
+// that it can send any events still queued for the application service and
+// stop.
+func (a *ApplicationServiceWorkerState) Remove() {
+	a.Cond.L.Lock()
+	a.removed = true
+	a.Cond.Broadcast()
+	a.Cond.L.Unlock()
+}
+
+// StopIfRemoved is called by the worker when it can't send any more events to
+// the application service. Returns true if the application service has been
+// removed, or no longer wants to receive events, in which case the worker is
+// marked as stopped and must stop.
+func (a *ApplicationServiceWorkerState) StopIfRemoved() bool {
+	a.Cond.L.Lock()
+	defer a.Cond.L.Unlock()
+	if !a.removed && a.appService.URL != "" {
+		return false
+	}
+	a.running = false
+	return true
 }
 
 // NotifyNewEvents wakes up all waiting goroutines, notifying that events remain
@@ -54,11 +141,52 @@ func (a *ApplicationServiceWorkerState) FinishEventProcessing() {
 }
 
 // WaitForNewEvents causes the calling goroutine to wait on the worker state's
-// condition for a broadcast or similar wakeup, if there are no events ready.
+// condition for a broadcast or similar wakeup, if there are no events ready
+// and the application service hasn't been removed.
 func (a *ApplicationServiceWorkerState) WaitForNewEvents() {
 	a.Cond.L.Lock()
-	if !a.EventsReady {
+	if !a.EventsReady && !a.removed {
 		a.Cond.Wait()
 	}
 	a.Cond.L.Unlock()
 }
+
+// ApplicationServiceWorkerStates holds the worker states of the application
+// services. Application services can be added and removed while the server is
+// running when their registrations are reloaded, so the worker states of
+// removed application services are kept until their workers have stopped.
+type ApplicationServiceWorkerStates struct {
+	mutex      sync.RWMutex
+	registered []*ApplicationServiceWorkerState
+	all        map[string]*ApplicationServiceWorkerState
+}
+
+// Registered returns the worker states of the application services which are
+// currently registered. The returned slice is never modified.
+func (s *ApplicationServiceWorkerStates) Registered() []*ApplicationServiceWorkerState {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.registered
+}
+
+// Get returns the worker state of the application service with the given ID,
+// which may since have been removed, or nil if there isn't one.
+func (s *ApplicationServiceWorkerStates) Get(appserviceID string) *ApplicationServiceWorkerState {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.all[appserviceID]
+}
+
+// SetRegistered replaces the worker states of the application services which
+// are currently registered.
+func (s *ApplicationServiceWorkerStates) SetRegistered(states []*ApplicationServiceWorkerState) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.all == nil {
+		s.all = make(map[string]*ApplicationServiceWorkerState)
+	}
+	for _, ws := range states {
+		s.all[ws.AppService().ID] = ws
+	}
+	s.registered = states
+}
@@ -37,30 +37,57 @@ var (
 	transactionTimeout = time.Second * 60
 )
 
-// SetupTransactionWorkers spawns a separate goroutine for each application
-// service. Each of these "workers" handle taking all events intended for their
-// app service, batch them up into a single transaction (up to a max transaction
-// size), then send that off to the AS's /transactions/{txnID} endpoint. It also
-// handles exponentially backing off in case the AS isn't currently available.
-func SetupTransactionWorkers(
+// UpdateTransactionWorkers spawns a separate goroutine for each application
+// service which doesn't already have one. Each of these "workers" handle taking
+// all events intended for their app service, batch them up into a single
+// transaction (up to a max transaction size), then send that off to the AS's
+// /transactions/{txnID} endpoint. It also handles exponentially backing off in
+// case the AS isn't currently available.
+//
+// The given application services replace those registered in the worker
+// states. Application services which are no longer registered are drained:
+// they are sent the events already queued for them, after which their workers
+// stop.
+func UpdateTransactionWorkers(
 	appserviceDB storage.Database,
-	workerStates []types.ApplicationServiceWorkerState,
-) error {
-	// Create a worker that handles transmitting events to a single homeserver
-	for _, workerState := range workerStates {
-		// Don't create a worker if this AS doesn't want to receive events
-		if workerState.AppService.URL != "" {
-			go worker(appserviceDB, workerState)
+	workerStates *types.ApplicationServiceWorkerStates,
+	appservices []config.ApplicationService,
+) {
+	registered := make(map[string]bool, len(appservices))
+	states := make([]*types.ApplicationServiceWorkerState, 0, len(appservices))
+	for _, appservice := range appservices {
+		ws := workerStates.Get(appservice.ID)
+		if ws == nil {
+			ws = types.NewApplicationServiceWorkerState(appservice)
+		}
+		// Create a worker that handles transmitting events to a single
+		// homeserver, unless one is already running or this AS doesn't want
+		// to receive events
+		if ws.Reregister(appservice) {
+			go worker(appserviceDB, ws)
+		}
+		states = append(states, ws)
+		registered[appservice.ID] = true
+	}
+
+	previous := workerStates.Registered()
+	workerStates.SetRegistered(states)
+	for _, ws := range previous {
+		if appservice := ws.AppService(); !registered[appservice.ID] {
+			log.WithFields(log.Fields{
+				"appservice": appservice.ID,
+			}).Info("draining removed application service")
+			ws.Remove()
 		}
 	}
-	return nil
 }
 
 // worker is a goroutine that sends any queued events to the application service
-// it is given.
-func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
+// it is given, until the application service is removed.
+func worker(db storage.Database, ws *types.ApplicationServiceWorkerState) {
+	appserviceID := ws.AppService().ID
 	log.WithFields(log.Fields{
-		"appservice": ws.AppService.ID,
+		"appservice": appserviceID,
 	}).Info("starting application service")
 	ctx := context.Background()
 
@@ -70,14 +97,21 @@ func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
 	}
 
 	// Initial check for any leftover events to send from last time
-	eventCount, err := db.CountEventsWithAppServiceID(ctx, ws.AppService.ID)
+	eventCount, err := db.CountEventsWithAppServiceID(ctx, appserviceID)
 	if err != nil {
 		log.WithFields(log.Fields{
-			"appservice": ws.AppService.ID,
+			"appservice": appserviceID,
 		}).WithError(err).Fatal("appservice worker unable to read queued events from DB")
 		return
 	}
-	if eventCount > 0 {
+	ephemeralCount, err := db.CountEphemeralEventsWithAppServiceID(ctx, appserviceID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"appservice": appserviceID,
+		}).WithError(err).Fatal("appservice worker unable to read queued ephemeral events from DB")
+		return
+	}
+	if eventCount > 0 || ephemeralCount > 0 {
 		ws.NotifyNewEvents()
 	}
 
@@ -87,21 +121,40 @@ func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
 		ws.WaitForNewEvents()
 
 		// Batch events up into a transaction
-		transactionJSON, txnID, maxEventID, eventsRemaining, err := createTransaction(ctx, db, ws.AppService.ID)
+		transactionJSON, txnID, maxEventID, maxEphemeralID, eventsRemaining, err := createTransaction(ctx, db, appserviceID)
 		if err != nil {
 			log.WithFields(log.Fields{
-				"appservice": ws.AppService.ID,
+				"appservice": appserviceID,
 			}).WithError(err).Fatal("appservice worker unable to create transaction")
 
 			return
 		}
+		if transactionJSON == nil {
+			// There was nothing queued to send after all
+			ws.FinishEventProcessing()
+			if ws.StopIfRemoved() {
+				log.WithFields(log.Fields{
+					"appservice": appserviceID,
+				}).Info("stopping removed application service")
+				return
+			}
+			continue
+		}
 
 		// Send the events off to the application service
 		// Backoff if the application service does not respond
-		err = send(client, ws.AppService, txnID, transactionJSON)
+		err = send(client, ws.AppService(), txnID, transactionJSON)
 		if err != nil {
+			// Give up on removed application services rather than retrying
+			// forever, leaving the events queued in case they come back
+			if ws.StopIfRemoved() {
+				log.WithFields(log.Fields{
+					"appservice": appserviceID,
+				}).WithError(err).Warn("stopping removed application service with events still queued")
+				return
+			}
 			// Backoff
-			backoff(&ws, err)
+			backoff(ws, err)
 			continue
 		}
 
@@ -115,13 +168,20 @@ func worker(db storage.Database, ws types.ApplicationServiceWorkerState) {
 		}
 
 		// Remove sent events from the DB
-		err = db.RemoveEventsBeforeAndIncludingID(ctx, ws.AppService.ID, maxEventID)
+		err = db.RemoveEventsBeforeAndIncludingID(ctx, appserviceID, maxEventID)
 		if err != nil {
 			log.WithFields(log.Fields{
-				"appservice": ws.AppService.ID,
+				"appservice": appserviceID,
 			}).WithError(err).Fatal("unable to remove appservice events from the database")
 			return
 		}
+		err = db.RemoveEphemeralEventsBeforeAndIncludingID(ctx, appserviceID, maxEphemeralID)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"appservice": appserviceID,
+			}).WithError(err).Fatal("unable to remove appservice ephemeral events from the database")
+			return
+		}
 	}
 }
 
@@ -132,7 +192,7 @@ func backoff(ws *types.ApplicationServiceWorkerState, err error) {
 	backoffSeconds := time.Second * backoffDuration
 
 	log.WithFields(log.Fields{
-		"appservice": ws.AppService.ID,
+		"appservice": ws.AppService().ID,
 	}).WithError(err).Warnf("unable to send transactions successfully, backing off for %ds",
 		backoffDuration)
 
@@ -145,15 +205,26 @@ func backoff(ws *types.ApplicationServiceWorkerState, err error) {
 	time.Sleep(backoffSeconds)
 }
 
-// createTransaction takes in a slice of AS events, stores them in an AS
-// transaction, and JSON-encodes the results.
+// transaction is the body of a transaction sent to an application service. As
+// well as the room events, it contains the ephemeral events and send-to-device
+// messages sent to application services which receive them, as per MSC2409.
+type transaction struct {
+	Events    []gomatrixserverlib.Event `json:"events"`
+	Ephemeral []json.RawMessage         `json:"ephemeral,omitempty"`
+	ToDevice  []json.RawMessage         `json:"de.sorunome.msc2409.to_device,omitempty"`
+}
+
+// createTransaction takes in a slice of AS events and ephemeral events, stores
+// them in an AS transaction, and JSON-encodes the results. If there is nothing
+// to send, the transaction JSON is nil.
+// nolint: gocyclo
 func createTransaction(
 	ctx context.Context,
 	db storage.Database,
 	appserviceID string,
 ) (
 	transactionJSON []byte,
-	txnID, maxID int,
+	txnID, maxID, maxEphemeralID int,
 	eventsRemaining bool,
 	err error,
 ) {
@@ -166,29 +237,68 @@ func createTransaction(
 
 		return
 	}
+	ephemeralTxnID, maxEphemeralID, ephemeralEvents, ephemeralRemaining, err := db.GetEphemeralEventsWithAppServiceID(
+		ctx, appserviceID, transactionBatchSize,
+	)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"appservice": appserviceID,
+		}).WithError(err).Fatalf("appservice worker unable to read queued ephemeral events from DB")
 
-	// Check if these events do not already have a transaction ID
-	if txnID == -1 {
-		// If not, grab next available ID from the DB
+		return
+	}
+	eventsRemaining = eventsRemaining || ephemeralRemaining
+
+	// A transaction which wasn't sent successfully must be sent again with
+	// exactly the same contents, so anything which wasn't part of it is left
+	// for the next transaction.
+	switch {
+	case len(events) > 0 && txnID != -1:
+		if len(ephemeralEvents) > 0 && ephemeralTxnID != txnID {
+			ephemeralEvents, maxEphemeralID, eventsRemaining = nil, 0, true
+		}
+	case len(ephemeralEvents) > 0 && ephemeralTxnID != -1:
+		txnID = ephemeralTxnID
+		if len(events) > 0 {
+			events, maxID, eventsRemaining = nil, 0, true
+		}
+	case len(events) > 0 || len(ephemeralEvents) > 0:
+		// These events do not already have a transaction ID, so grab next
+		// available ID from the DB
 		txnID, err = db.GetLatestTxnID(ctx)
 		if err != nil {
-			return nil, 0, 0, false, err
+			return nil, 0, 0, 0, false, err
 		}
 
 		// Mark new events with current transactionID
-		if err = db.UpdateTxnIDForEvents(ctx, appserviceID, maxID, txnID); err != nil {
-			return nil, 0, 0, false, err
+		if len(events) > 0 {
+			if err = db.UpdateTxnIDForEvents(ctx, appserviceID, maxID, txnID); err != nil {
+				return nil, 0, 0, 0, false, err
+			}
 		}
+		if len(ephemeralEvents) > 0 {
+			if err = db.UpdateTxnIDForEphemeralEvents(ctx, appserviceID, maxEphemeralID, txnID); err != nil {
+				return nil, 0, 0, 0, false, err
+			}
+		}
+	default:
+		return nil, 0, 0, 0, false, nil
 	}
 
-	var ev []gomatrixserverlib.Event
+	// Create a transaction and store the events inside
+	transaction := transaction{
+		Events: make([]gomatrixserverlib.Event, 0, len(events)),
+	}
 	for _, e := range events {
-		ev = append(ev, e.Event)
+		transaction.Events = append(transaction.Events, e.Event)
 	}
-
-	// Create a transaction and store the events inside
-	transaction := gomatrixserverlib.ApplicationServiceTransaction{
-		Events: ev,
+	for _, e := range ephemeralEvents {
+		switch e.Kind {
+		case types.EphemeralEventKind:
+			transaction.Ephemeral = append(transaction.Ephemeral, e.Event)
+		case types.ToDeviceEventKind:
+			transaction.ToDevice = append(transaction.ToDevice, e.Event)
+		}
 	}
 
 	transactionJSON, err = json.Marshal(transaction)
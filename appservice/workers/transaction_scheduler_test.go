@@ -0,0 +1,191 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workers
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/appservice/storage"
+	"github.com/matrix-org/dendrite/appservice/storage/sqlite3"
+	"github.com/matrix-org/dendrite/appservice/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testAppServiceID = "bridge"
+
+func mustCreateDatabase(t *testing.T) (storage.Database, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-appservice")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	db, err := sqlite3.NewDatabase("file:" + filepath.Join(dir, "appservice.db"))
+	if err != nil {
+		t.Fatalf("failed to create appservice database: %s", err)
+	}
+	return db, func() { _ = os.RemoveAll(dir) }
+}
+
+func mustStoreEphemeral(t *testing.T, db storage.Database, kind, eventJSON string) {
+	if err := db.StoreEphemeralEvent(context.Background(), testAppServiceID, types.EphemeralEvent{
+		Kind:  kind,
+		Event: json.RawMessage(eventJSON),
+	}); err != nil {
+		t.Fatalf("StoreEphemeralEvent returned %s", err)
+	}
+}
+
+func mustStoreEvent(t *testing.T, db storage.Database) {
+	eventJSON := `{"auth_events":[],"content":{"body":"hello"},"depth":1,"event_id":"$event:localhost","hashes":{"sha256":"abc"},"origin":"localhost","origin_server_ts":1,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","signatures":{},"type":"m.room.message"}`
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON returned %s", err)
+	}
+	headered := event.Headered(gomatrixserverlib.RoomVersionV1)
+	if err = db.StoreEvent(context.Background(), testAppServiceID, &headered); err != nil {
+		t.Fatalf("StoreEvent returned %s", err)
+	}
+}
+
+// sentTransaction is a transaction as an application service receives it.
+type sentTransaction struct {
+	Events    []json.RawMessage `json:"events"`
+	Ephemeral []json.RawMessage `json:"ephemeral"`
+	ToDevice  []json.RawMessage `json:"de.sorunome.msc2409.to_device"`
+}
+
+func mustUnmarshalTransaction(t *testing.T, transactionJSON []byte) (txn sentTransaction) {
+	if err := json.Unmarshal(transactionJSON, &txn); err != nil {
+		t.Fatalf("json.Unmarshal returned %s", err)
+	}
+	return
+}
+
+func rawStrings(raws []json.RawMessage) []string {
+	result := []string{}
+	for _, raw := range raws {
+		result = append(result, string(raw))
+	}
+	return result
+}
+
+func TestCreateTransactionNothingQueued(t *testing.T) {
+	db, cleanup := mustCreateDatabase(t)
+	defer cleanup()
+
+	transactionJSON, _, _, _, eventsRemaining, err := createTransaction(context.Background(), db, testAppServiceID)
+	if err != nil {
+		t.Fatalf("createTransaction returned %s", err)
+	}
+	if transactionJSON != nil || eventsRemaining {
+		t.Fatalf("createTransaction returned %s, %v, want nothing to send", transactionJSON, eventsRemaining)
+	}
+}
+
+func TestCreateTransactionEphemeral(t *testing.T) {
+	db, cleanup := mustCreateDatabase(t)
+	defer cleanup()
+	ctx := context.Background()
+	typing := `{"type":"m.typing","room_id":"!room:localhost","content":{"user_ids":[]}}`
+	toDevice := `{"sender":"@alice:localhost","type":"m.room_key","content":{},"to_user_id":"@bridge_bob:localhost","to_device_id":"DEVICE"}`
+	mustStoreEphemeral(t, db, types.EphemeralEventKind, typing)
+	mustStoreEphemeral(t, db, types.ToDeviceEventKind, toDevice)
+	mustStoreEvent(t, db)
+
+	transactionJSON, _, maxID, maxEphemeralID, eventsRemaining, err := createTransaction(ctx, db, testAppServiceID)
+	if err != nil {
+		t.Fatalf("createTransaction returned %s", err)
+	}
+	if eventsRemaining {
+		t.Errorf("createTransaction left events for the next transaction, want everything sent")
+	}
+	txn := mustUnmarshalTransaction(t, transactionJSON)
+	if len(txn.Events) != 1 {
+		t.Errorf("transaction has %d room events, want 1", len(txn.Events))
+	}
+	if got := rawStrings(txn.Ephemeral); !reflect.DeepEqual(got, []string{typing}) {
+		t.Errorf("transaction has ephemeral events %v, want %v", got, []string{typing})
+	}
+	if got := rawStrings(txn.ToDevice); !reflect.DeepEqual(got, []string{toDevice}) {
+		t.Errorf("transaction has to-device messages %v, want %v", got, []string{toDevice})
+	}
+
+	// Once sent, the events are removed and there's nothing left to send.
+	if err = db.RemoveEventsBeforeAndIncludingID(ctx, testAppServiceID, maxID); err != nil {
+		t.Fatalf("RemoveEventsBeforeAndIncludingID returned %s", err)
+	}
+	if err = db.RemoveEphemeralEventsBeforeAndIncludingID(ctx, testAppServiceID, maxEphemeralID); err != nil {
+		t.Fatalf("RemoveEphemeralEventsBeforeAndIncludingID returned %s", err)
+	}
+	if transactionJSON, _, _, _, _, err = createTransaction(ctx, db, testAppServiceID); err != nil || transactionJSON != nil {
+		t.Fatalf("createTransaction returned %s, %v after sending, want nothing to send", transactionJSON, err)
+	}
+}
+
+func TestCreateTransactionRetry(t *testing.T) {
+	db, cleanup := mustCreateDatabase(t)
+	defer cleanup()
+	ctx := context.Background()
+	first := `{"type":"m.typing","room_id":"!room:localhost","content":{"user_ids":["@bridge_alice:localhost"]}}`
+	second := `{"type":"m.typing","room_id":"!room:localhost","content":{"user_ids":[]}}`
+	mustStoreEphemeral(t, db, types.EphemeralEventKind, first)
+
+	transactionJSON, txnID, _, maxEphemeralID, _, err := createTransaction(ctx, db, testAppServiceID)
+	if err != nil {
+		t.Fatalf("createTransaction returned %s", err)
+	}
+
+	// The transaction failed to send, and more events arrived since. The
+	// retry must have exactly the same contents and ID.
+	mustStoreEphemeral(t, db, types.EphemeralEventKind, second)
+	mustStoreEvent(t, db)
+	retryJSON, retryTxnID, _, retryMaxEphemeralID, eventsRemaining, err := createTransaction(ctx, db, testAppServiceID)
+	if err != nil {
+		t.Fatalf("createTransaction returned %s", err)
+	}
+	if retryTxnID != txnID || retryMaxEphemeralID != maxEphemeralID {
+		t.Errorf("retry has transaction ID %d and max ID %d, want %d and %d", retryTxnID, retryMaxEphemeralID, txnID, maxEphemeralID)
+	}
+	if string(retryJSON) != string(transactionJSON) {
+		t.Errorf("retry sent %s, want %s", retryJSON, transactionJSON)
+	}
+	if !eventsRemaining {
+		t.Errorf("retry didn't leave the new events for the next transaction")
+	}
+
+	// After the retry succeeds, the new events are sent in a new transaction.
+	if err = db.RemoveEphemeralEventsBeforeAndIncludingID(ctx, testAppServiceID, maxEphemeralID); err != nil {
+		t.Fatalf("RemoveEphemeralEventsBeforeAndIncludingID returned %s", err)
+	}
+	nextJSON, nextTxnID, _, _, _, err := createTransaction(ctx, db, testAppServiceID)
+	if err != nil {
+		t.Fatalf("createTransaction returned %s", err)
+	}
+	if nextTxnID == txnID {
+		t.Errorf("next transaction reused transaction ID %d", txnID)
+	}
+	next := mustUnmarshalTransaction(t, nextJSON)
+	if got := rawStrings(next.Ephemeral); !reflect.DeepEqual(got, []string{second}) {
+		t.Errorf("next transaction has ephemeral events %v, want %v", got, []string{second})
+	}
+	if len(next.Events) != 1 {
+		t.Errorf("next transaction has %d room events, want 1", len(next.Events))
+	}
+}
@@ -52,8 +52,9 @@ type AccountDatabase interface {
 type Data struct {
 	AccountDB AccountDatabase
 	DeviceDB  DeviceDatabase
-	// AppServices is the list of all registered AS
-	AppServices []config.ApplicationService
+	// AppServices returns the list of all registered AS, which can change
+	// when the application services are reloaded
+	AppServices func() []config.ApplicationService
 }
 
 // VerifyUserFromRequest authenticates the HTTP request,
@@ -75,7 +76,11 @@ func VerifyUserFromRequest(
 
 	// Search for app service with given access_token
 	var appService *config.ApplicationService
-	for _, as := range data.AppServices {
+	var appServices []config.ApplicationService
+	if data.AppServices != nil {
+		appServices = data.AppServices()
+	}
+	for _, as := range appServices {
 		if as.ASToken == token {
 			appService = &as
 			break
@@ -88,7 +93,8 @@ func VerifyUserFromRequest(
 			// Use AS dummy device ID
 			ID: types.AppServiceDeviceID,
 			// AS dummy device has AS's token.
-			AccessToken: token,
+			AccessToken:  token,
+			AppServiceID: appService.ID,
 		}
 
 		userID := req.URL.Query().Get("user_id")
@@ -133,6 +139,33 @@ func VerifyUserFromRequest(
 	}
 }
 
+// VerifyAppServiceFromRequest authenticates the HTTP request as coming from
+// one of the given application services, on success returning the application
+// service whose access token was supplied.
+// On failure returns an JSON error response which can be sent to the client.
+func VerifyAppServiceFromRequest(
+	req *http.Request, appServices []config.ApplicationService,
+) (*config.ApplicationService, *util.JSONResponse) {
+	token, err := ExtractAccessToken(req)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: jsonerror.MissingToken(err.Error()),
+		}
+	}
+
+	for i := range appServices {
+		if appServices[i].ASToken == token {
+			return &appServices[i], nil
+		}
+	}
+
+	return nil, &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("Only application services can use this API"),
+	}
+}
+
 // verifyUserParameters ensures that a request coming from a regular user is not
 // using any query parameters reserved for an application service
 func verifyUserParameters(req *http.Request) *util.JSONResponse {
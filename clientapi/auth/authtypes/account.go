@@ -25,7 +25,11 @@ type Account struct {
 	ServerName   gomatrixserverlib.ServerName
 	Profile      *Profile
 	AppServiceID string
-	// TODO: Other flags like IsAdmin, IsGuest
+	IsGuest      bool
+	// Whether the account can use the admin API.
+	IsAdmin bool
+	// Whether the account has been deactivated.
+	IsDeactivated bool
 	// TODO: Devices
 	// TODO: Associations (e.g. with application services)
 }
@@ -25,6 +25,12 @@ type Device struct {
 	// Can be used as a secure substitution in places where data needs to be
 	// associated with access tokens.
 	SessionID int64
+	// Whether the device belongs to a guest account. Guests may only use the
+	// APIs which allow guest access.
+	IsGuest bool
+	// The ID of the application service making the request, if the request
+	// was made with an application service's access token.
+	AppServiceID string
 	// TODO: display name, last used timestamp, keys, etc
 	DisplayName string
 }
@@ -6,7 +6,10 @@ type LoginType string
 // The relevant login types implemented in Dendrite
 const (
 	LoginTypeDummy              = "m.login.dummy"
+	LoginTypePassword           = "m.login.password"
 	LoginTypeSharedSecret       = "org.matrix.login.shared_secret"
 	LoginTypeRecaptcha          = "m.login.recaptcha"
 	LoginTypeApplicationService = "m.login.application_service"
+	LoginTypeToken              = "m.login.token"
+	LoginTypeSSO                = "m.login.sso"
 )
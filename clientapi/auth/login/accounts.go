@@ -0,0 +1,120 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package login
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// accountMapper maps identities in external authentication providers to
+// local accounts, creating the accounts when users log in for the first time.
+type accountMapper struct {
+	db         accounts.Database
+	serverName gomatrixserverlib.ServerName
+}
+
+// ensureAccount creates a passwordless account with the given localpart if
+// it doesn't exist yet.
+func (m *accountMapper) ensureAccount(ctx context.Context, localpart string) error {
+	_, err := m.createAccount(ctx, localpart)
+	return err
+}
+
+// createAccount creates a passwordless account with the given localpart,
+// returning false if the localpart is already taken.
+func (m *accountMapper) createAccount(ctx context.Context, localpart string) (bool, error) {
+	available, err := m.db.CheckAccountAvailability(ctx, localpart)
+	if err != nil || !available {
+		return false, err
+	}
+	acc, err := m.db.CreateAccount(ctx, localpart, "", "")
+	return acc != nil, err
+}
+
+// localpartForExternalID returns the localpart of the account associated with
+// the given identity. If there is none, it creates a new account, using the
+// suggested localpart if it is valid and free and a numeric one otherwise, and
+// associates it with the identity.
+func (m *accountMapper) localpartForExternalID(
+	ctx context.Context, authProvider, externalID, suggestedLocalpart, displayName string,
+) (string, error) {
+	localpart, err := m.db.GetLocalpartForExternalID(ctx, authProvider, externalID)
+	if err != nil || localpart != "" {
+		return localpart, err
+	}
+
+	localpart = m.sanitiseLocalpart(suggestedLocalpart)
+	created := false
+	if localpart != "" {
+		if created, err = m.createAccount(ctx, localpart); err != nil {
+			return "", err
+		}
+	}
+	if !created {
+		// The suggested localpart is unusable or already taken.
+		numericLocalpart, err := m.db.GetNewNumericLocalpart(ctx)
+		if err != nil {
+			return "", err
+		}
+		localpart = strconv.FormatInt(numericLocalpart, 10)
+		if created, err = m.createAccount(ctx, localpart); err != nil {
+			return "", err
+		}
+		if !created {
+			return "", fmt.Errorf("localpart %q is already taken", localpart)
+		}
+	}
+
+	if err = m.db.SaveExternalID(ctx, authProvider, externalID, localpart); err != nil {
+		return "", err
+	}
+	if displayName != "" {
+		if err = m.db.SetDisplayName(ctx, localpart, displayName); err != nil {
+			return "", err
+		}
+	}
+	return localpart, nil
+}
+
+// sanitiseLocalpart turns a username from an external provider into a valid
+// localpart, or returns an empty string if that isn't possible.
+func (m *accountMapper) sanitiseLocalpart(username string) string {
+	// Leave room for the sigil, the separator and the server name within the
+	// maximum user ID length.
+	maxLength := 255 - 2 - len(m.serverName)
+	localpart := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9':
+			return r
+		case r == '_', r == '-', r == '.', r == '/':
+			return r
+		}
+		return '_'
+	}, strings.ToLower(strings.TrimSpace(username)))
+	if len(localpart) > maxLength {
+		localpart = localpart[:maxLength]
+	}
+	// Numeric localparts are reserved for accounts created without one.
+	if _, err := strconv.ParseInt(localpart, 10, 64); err == nil {
+		return ""
+	}
+	return localpart
+}
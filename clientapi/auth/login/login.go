@@ -0,0 +1,114 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package login implements the ways in which users can log in to the client
+// API, beyond the local password database.
+package login
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/util"
+)
+
+// Identifier is the user identifier of a login request.
+type Identifier struct {
+	Type string `json:"type"`
+	User string `json:"user"`
+}
+
+// Request is the body of a POST /login request.
+type Request struct {
+	Type       authtypes.LoginType `json:"type"`
+	Identifier Identifier          `json:"identifier"`
+	// The user ID or localpart, if the client uses the deprecated form
+	// rather than an identifier.
+	User     string `json:"user"`
+	Password string `json:"password"`
+	Token    string `json:"token"`
+	// Both DeviceID and InitialDisplayName can be omitted, or empty strings ("")
+	// Thus a pointer is needed to differentiate between the two
+	InitialDisplayName *string `json:"initial_device_display_name"`
+	DeviceID           *string `json:"device_id"`
+}
+
+// Provider authenticates login requests of a single login type.
+type Provider interface {
+	// Type returns the login type handled by the provider.
+	Type() authtypes.LoginType
+	// Login authenticates the request and returns the localpart of the account
+	// to log in to, creating the account if needed. If the request can't be
+	// authenticated, it returns the response to send to the client instead.
+	Login(ctx context.Context, req *Request) (string, *util.JSONResponse)
+}
+
+// Providers is the set of login providers enabled in the configuration.
+type Providers struct {
+	providers []Provider
+	// SSO is the single sign-on provider, or nil if SSO is disabled.
+	SSO *SSOProvider
+}
+
+// NewProviders creates the login providers enabled in the configuration.
+func NewProviders(cfg *config.Dendrite, accountDB accounts.Database) *Providers {
+	mapper := &accountMapper{db: accountDB, serverName: cfg.Matrix.ServerName}
+	tokens := NewTokenStore(cfg.Login.TokenLifetime)
+
+	var checker PasswordChecker
+	if cfg.Login.ExternalPassword.Enabled {
+		checker = NewHTTPPasswordChecker(cfg.Login.ExternalPassword.URL, cfg.Matrix.ServerName)
+	}
+
+	p := &Providers{
+		providers: []Provider{
+			&passwordProvider{
+				db:         accountDB,
+				mapper:     mapper,
+				checker:    checker,
+				serverName: cfg.Matrix.ServerName,
+			},
+			&tokenProvider{tokens: tokens},
+		},
+	}
+	if cfg.Login.OIDC.Enabled {
+		p.SSO = newSSOProvider(cfg, mapper, tokens)
+	}
+	return p
+}
+
+// Flows returns the login types which clients can use.
+func (p *Providers) Flows() []authtypes.LoginType {
+	flows := make([]authtypes.LoginType, 0, len(p.providers)+1)
+	for _, provider := range p.providers {
+		flows = append(flows, provider.Type())
+	}
+	if p.SSO != nil {
+		flows = append(flows, authtypes.LoginTypeSSO)
+	}
+	return flows
+}
+
+// Provider returns the provider for the given login type, or nil if the type
+// isn't supported.
+func (p *Providers) Provider(loginType authtypes.LoginType) Provider {
+	for _, provider := range p.providers {
+		if provider.Type() == loginType {
+			return provider
+		}
+	}
+	return nil
+}
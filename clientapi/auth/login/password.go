@@ -0,0 +1,171 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package login
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// PasswordChecker checks passwords against an external user directory, such
+// as an LDAP server.
+type PasswordChecker interface {
+	// CheckPassword returns whether the password is correct for the user with
+	// the given localpart.
+	CheckPassword(ctx context.Context, localpart, password string) (bool, error)
+}
+
+// HTTPPasswordChecker is a PasswordChecker which asks a service implementing
+// the REST password provider API, as used by e.g. ma1sd.
+type HTTPPasswordChecker struct {
+	url        string
+	serverName gomatrixserverlib.ServerName
+	client     *http.Client
+}
+
+// NewHTTPPasswordChecker creates a PasswordChecker which POSTs login attempts
+// to the given URL.
+func NewHTTPPasswordChecker(url string, serverName gomatrixserverlib.ServerName) *HTTPPasswordChecker {
+	return &HTTPPasswordChecker{
+		url:        url,
+		serverName: serverName,
+		client:     &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+type checkCredentialsRequest struct {
+	User struct {
+		ID       string `json:"id"`
+		Password string `json:"password"`
+	} `json:"user"`
+}
+
+type checkCredentialsResponse struct {
+	Auth struct {
+		Success bool   `json:"success"`
+		MXID    string `json:"mxid"`
+	} `json:"auth"`
+}
+
+// CheckPassword implements PasswordChecker
+func (c *HTTPPasswordChecker) CheckPassword(ctx context.Context, localpart, password string) (bool, error) {
+	userID := userutil.MakeUserID(localpart, c.serverName)
+	var body checkCredentialsRequest
+	body.User.ID = userID
+	body.User.Password = password
+	data, err := json.Marshal(body)
+	if err != nil {
+		return false, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(data))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := c.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("password provider returned HTTP %d", res.StatusCode)
+	}
+	var result checkCredentialsResponse
+	if err = json.NewDecoder(res.Body).Decode(&result); err != nil {
+		return false, err
+	}
+	// Don't let the provider log the user in to a different account.
+	return result.Auth.Success && (result.Auth.MXID == "" || result.Auth.MXID == userID), nil
+}
+
+// passwordProvider implements m.login.password, checking passwords against
+// the account database and then against the external checker, if any.
+type passwordProvider struct {
+	db         accounts.Database
+	mapper     *accountMapper
+	checker    PasswordChecker
+	serverName gomatrixserverlib.ServerName
+}
+
+func (p *passwordProvider) Type() authtypes.LoginType {
+	return authtypes.LoginTypePassword
+}
+
+func (p *passwordProvider) Login(ctx context.Context, req *Request) (string, *util.JSONResponse) {
+	user := req.User
+	switch req.Identifier.Type {
+	case "m.id.user":
+		user = req.Identifier.User
+	case "":
+	default:
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("login identifier '" + req.Identifier.Type + "' not supported"),
+		}
+	}
+	if user == "" {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("'user' must be supplied."),
+		}
+	}
+
+	util.GetLogger(ctx).WithField("user", user).Info("Processing login request")
+
+	localpart, err := userutil.ParseUsernameParam(user, &p.serverName)
+	if err != nil {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidUsername(err.Error()),
+		}
+	}
+
+	if _, err = p.db.GetAccountByPassword(ctx, localpart, req.Password); err == nil {
+		return localpart, nil
+	}
+	if p.checker != nil {
+		ok, err := p.checker.CheckPassword(ctx, localpart, req.Password)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("Failed to check password with the external provider")
+			resErr := jsonerror.InternalServerError()
+			return "", &resErr
+		}
+		if ok {
+			if err = p.mapper.ensureAccount(ctx, localpart); err != nil {
+				util.GetLogger(ctx).WithError(err).Error("Failed to create account for external user")
+				resErr := jsonerror.InternalServerError()
+				return "", &resErr
+			}
+			return localpart, nil
+		}
+	}
+	// Technically we could tell them if the user does not exist by checking if err == sql.ErrNoRows
+	// but that would leak the existence of the user.
+	return "", &util.JSONResponse{
+		Code: http.StatusForbidden,
+		JSON: jsonerror.Forbidden("username or password was incorrect, or the account does not exist"),
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/util"
+)
+
+// How long users have to complete the SSO flow at the provider.
+const ssoSessionLifetime = 10 * time.Minute
+
+// unsafeURLSchemes can run code in the browser, so clients may not use them
+// for their redirect URLs.
+var unsafeURLSchemes = map[string]bool{"javascript": true, "data": true, "vbscript": true}
+
+const ssoStateLength = 32
+
+type ssoSession struct {
+	redirectURL string
+	expires     time.Time
+}
+
+// SSOProvider implements m.login.sso against an OpenID Connect provider,
+// using the authorization code flow. Once the user has authenticated with the
+// provider, the client is given a login token to use with m.login.token.
+// Sessions are only held in memory, so the callback must be handled by the
+// same server that started the flow.
+type SSOProvider struct {
+	cfg      *config.Dendrite
+	client   *http.Client
+	mapper   *accountMapper
+	tokens   *TokenStore
+	mu       sync.Mutex
+	sessions map[string]ssoSession
+}
+
+// newSSOProvider creates an SSOProvider for the OpenID Connect provider in the
+// configuration.
+func newSSOProvider(cfg *config.Dendrite, mapper *accountMapper, tokens *TokenStore) *SSOProvider {
+	return &SSOProvider{
+		cfg:      cfg,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		mapper:   mapper,
+		tokens:   tokens,
+		sessions: make(map[string]ssoSession),
+	}
+}
+
+// AuthorizationURL starts the SSO flow for a client which wants the user to be
+// sent back to clientRedirectURL afterwards. It returns the URL of the provider
+// to send the user to.
+func (p *SSOProvider) AuthorizationURL(clientRedirectURL string) (string, *util.JSONResponse) {
+	if clientRedirectURL == "" {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("redirectUrl parameter missing"),
+		}
+	}
+	if u, err := url.Parse(clientRedirectURL); err != nil || !u.IsAbs() || unsafeURLSchemes[strings.ToLower(u.Scheme)] {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("redirectUrl must be an absolute URL"),
+		}
+	}
+	authURL, err := url.Parse(p.cfg.Login.OIDC.AuthorizationEndpoint)
+	if err != nil {
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+
+	state := util.RandomString(ssoStateLength)
+	p.mu.Lock()
+	now := time.Now()
+	for s, session := range p.sessions {
+		if now.After(session.expires) {
+			delete(p.sessions, s)
+		}
+	}
+	p.sessions[state] = ssoSession{
+		redirectURL: clientRedirectURL,
+		expires:     now.Add(ssoSessionLifetime),
+	}
+	p.mu.Unlock()
+
+	query := authURL.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", p.cfg.Login.OIDC.ClientID)
+	query.Set("redirect_uri", p.cfg.Login.OIDC.CallbackURL)
+	query.Set("scope", strings.Join(p.cfg.Login.OIDC.Scopes, " "))
+	query.Set("state", state)
+	authURL.RawQuery = query.Encode()
+	return authURL.String(), nil
+}
+
+// ClientWhitelisted returns whether the client at the redirect URL may be sent
+// a login token without the user confirming the login first.
+func (p *SSOProvider) ClientWhitelisted(redirectURL string) bool {
+	u, err := url.Parse(redirectURL)
+	if err != nil {
+		return false
+	}
+	for _, prefix := range p.cfg.Login.OIDC.ClientWhitelist {
+		w, err := url.Parse(prefix)
+		if err != nil {
+			continue
+		}
+		if strings.EqualFold(u.Scheme, w.Scheme) && strings.EqualFold(u.Host, w.Host) &&
+			strings.HasPrefix(u.Path, w.Path) {
+			return true
+		}
+	}
+	return false
+}
+
+// Callback completes the SSO flow once the provider has sent the user back to
+// the callback URL. It returns the URL to send the user back to the client
+// with a login token, creating an account for the user if needed.
+func (p *SSOProvider) Callback(ctx context.Context, state, code string) (string, *util.JSONResponse) {
+	p.mu.Lock()
+	session, ok := p.sessions[state]
+	delete(p.sessions, state)
+	p.mu.Unlock()
+	if !ok || time.Now().After(session.expires) {
+		return "", &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The SSO session is invalid or has expired"),
+		}
+	}
+	if code == "" {
+		return "", &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The identity provider didn't authenticate the user"),
+		}
+	}
+
+	claims, err := p.userinfo(ctx, code)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to retrieve the user from the identity provider")
+		return "", &util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to retrieve the user from the identity provider"),
+		}
+	}
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		util.GetLogger(ctx).Error("The identity provider returned no subject")
+		return "", &util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to retrieve the user from the identity provider"),
+		}
+	}
+	suggestedLocalpart, _ := claims[p.cfg.Login.OIDC.LocalpartClaim].(string)
+	displayName, _ := claims["name"].(string)
+
+	localpart, err := p.mapper.localpartForExternalID(
+		ctx, p.cfg.Login.OIDC.ProviderID, subject, suggestedLocalpart, displayName,
+	)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("Failed to map the SSO user to an account")
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+
+	redirectURL, err := url.Parse(session.redirectURL)
+	if err != nil {
+		resErr := jsonerror.InternalServerError()
+		return "", &resErr
+	}
+	query := redirectURL.Query()
+	query.Set("loginToken", p.tokens.Issue(localpart))
+	redirectURL.RawQuery = query.Encode()
+	return redirectURL.String(), nil
+}
+
+// userinfo exchanges the authorization code for an access token and uses it
+// to retrieve the claims about the user.
+func (p *SSOProvider) userinfo(ctx context.Context, code string) (map[string]interface{}, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.Login.OIDC.CallbackURL)
+	form.Set("client_id", p.cfg.Login.OIDC.ClientID)
+	form.Set("client_secret", p.cfg.Login.OIDC.ClientSecret)
+	req, err := http.NewRequest(http.MethodPost, p.cfg.Login.OIDC.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var tokenRes struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err = p.doJSON(ctx, req, &tokenRes); err != nil {
+		return nil, fmt.Errorf("token endpoint: %w", err)
+	}
+	if tokenRes.AccessToken == "" {
+		return nil, fmt.Errorf("token endpoint returned no access token")
+	}
+
+	req, err = http.NewRequest(http.MethodGet, p.cfg.Login.OIDC.UserinfoEndpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tokenRes.AccessToken)
+	claims := make(map[string]interface{})
+	if err = p.doJSON(ctx, req, &claims); err != nil {
+		return nil, fmt.Errorf("userinfo endpoint: %w", err)
+	}
+	return claims, nil
+}
+
+func (p *SSOProvider) doJSON(ctx context.Context, req *http.Request, res interface{}) error {
+	req.Header.Set("Accept", "application/json")
+	httpRes, err := p.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer httpRes.Body.Close() // nolint: errcheck
+	if httpRes.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP %d", httpRes.StatusCode)
+	}
+	return json.NewDecoder(httpRes.Body).Decode(res)
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package login
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts/sqlite3"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const (
+	testServerName   = gomatrixserverlib.ServerName("localhost")
+	testClientID     = "dendrite"
+	testClientSecret = "s3cret"
+	testCode         = "authcode"
+	testAccessToken  = "accesstoken"
+)
+
+// newMockIdP starts an OpenID Connect provider which authenticates every
+// user as the given subject.
+func newMockIdP(t *testing.T, subject, username string) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/token", func(w http.ResponseWriter, req *http.Request) {
+		if err := req.ParseForm(); err != nil {
+			t.Errorf("failed to parse token request: %s", err)
+		}
+		if req.Form.Get("grant_type") != "authorization_code" ||
+			req.Form.Get("code") != testCode ||
+			req.Form.Get("client_id") != testClientID ||
+			req.Form.Get("client_secret") != testClientSecret {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"access_token": testAccessToken,
+			"token_type":   "Bearer",
+		})
+	})
+	mux.HandleFunc("/userinfo", func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer "+testAccessToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{
+			"sub":                subject,
+			"preferred_username": username,
+			"name":               "Alice Liddell",
+		})
+	})
+	return httptest.NewServer(mux)
+}
+
+func newTestProviders(t *testing.T, idpURL string) (*Providers, *sqlite3.Database, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-login")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	db, err := sqlite3.NewDatabase("file:"+filepath.Join(dir, "accounts.db"), testServerName)
+	if err != nil {
+		t.Fatalf("failed to create account database: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = testServerName
+	cfg.Login.OIDC.Enabled = true
+	cfg.Login.OIDC.AuthorizationEndpoint = idpURL + "/authorize"
+	cfg.Login.OIDC.TokenEndpoint = idpURL + "/token"
+	cfg.Login.OIDC.UserinfoEndpoint = idpURL + "/userinfo"
+	cfg.Login.OIDC.ClientID = testClientID
+	cfg.Login.OIDC.ClientSecret = testClientSecret
+	cfg.Login.OIDC.CallbackURL = "https://localhost/_matrix/client/r0/login/sso/callback"
+	cfg.SetDefaults()
+	return NewProviders(cfg, db), db, func() { _ = os.RemoveAll(dir) }
+}
+
+// ssoLogin runs the SSO flow and returns the localpart logged in with the
+// resulting login token.
+func ssoLogin(t *testing.T, providers *Providers) string {
+	ctx := context.Background()
+	authURL, resErr := providers.SSO.AuthorizationURL("https://client.example.com/done?x=1")
+	if resErr != nil {
+		t.Fatalf("AuthorizationURL failed: %+v", resErr)
+	}
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatalf("invalid authorization URL: %s", err)
+	}
+	query := u.Query()
+	if query.Get("client_id") != testClientID || query.Get("response_type") != "code" {
+		t.Fatalf("unexpected authorization URL %q", authURL)
+	}
+
+	// Pretend the user authenticated with the provider, which sent them back.
+	redirectURL, resErr := providers.SSO.Callback(ctx, query.Get("state"), testCode)
+	if resErr != nil {
+		t.Fatalf("Callback failed: %+v", resErr)
+	}
+	u, err = url.Parse(redirectURL)
+	if err != nil {
+		t.Fatalf("invalid redirect URL: %s", err)
+	}
+	if u.Host != "client.example.com" || u.Query().Get("x") != "1" {
+		t.Fatalf("unexpected redirect URL %q", redirectURL)
+	}
+
+	localpart, resErr := providers.Provider("m.login.token").Login(ctx, &Request{
+		Token: u.Query().Get("loginToken"),
+	})
+	if resErr != nil {
+		t.Fatalf("token login failed: %+v", resErr)
+	}
+	return localpart
+}
+
+func TestSSOLoginCreatesAccount(t *testing.T) {
+	idp := newMockIdP(t, "subject-1", "Alice")
+	defer idp.Close()
+	providers, db, cleanup := newTestProviders(t, idp.URL)
+	defer cleanup()
+
+	localpart := ssoLogin(t, providers)
+	if localpart != "alice" {
+		t.Fatalf("got localpart %q, want %q", localpart, "alice")
+	}
+	profile, err := db.GetProfileByLocalpart(context.Background(), localpart)
+	if err != nil {
+		t.Fatalf("failed to get profile: %s", err)
+	}
+	if profile.DisplayName != "Alice Liddell" {
+		t.Errorf("got display name %q, want %q", profile.DisplayName, "Alice Liddell")
+	}
+
+	// Logging in again should give the same account.
+	if localpart = ssoLogin(t, providers); localpart != "alice" {
+		t.Fatalf("got localpart %q on second login, want %q", localpart, "alice")
+	}
+}
+
+func TestSSOLoginTakenLocalpart(t *testing.T) {
+	idp := newMockIdP(t, "subject-2", "bob")
+	defer idp.Close()
+	providers, db, cleanup := newTestProviders(t, idp.URL)
+	defer cleanup()
+
+	if _, err := db.CreateAccount(context.Background(), "bob", "password", ""); err != nil {
+		t.Fatalf("failed to create account: %s", err)
+	}
+	if localpart := ssoLogin(t, providers); localpart == "bob" {
+		t.Fatalf("SSO user was logged in to an existing local account")
+	}
+}
+
+func TestSSOCallbackRejectsUnknownState(t *testing.T) {
+	idp := newMockIdP(t, "subject-3", "carol")
+	defer idp.Close()
+	providers, _, cleanup := newTestProviders(t, idp.URL)
+	defer cleanup()
+
+	if _, resErr := providers.SSO.Callback(context.Background(), "unknown", testCode); resErr == nil {
+		t.Fatalf("Callback succeeded with an unknown state")
+	}
+}
+
+func TestSSOClientWhitelist(t *testing.T) {
+	idp := newMockIdP(t, "subject-4", "dave")
+	defer idp.Close()
+	providers, _, cleanup := newTestProviders(t, idp.URL)
+	defer cleanup()
+	providers.SSO.cfg.Login.OIDC.ClientWhitelist = []string{"https://client.example.com/app/"}
+
+	for redirectURL, want := range map[string]bool{
+		"https://client.example.com/app/#/home?loginToken=x": true,
+		"https://CLIENT.example.com/app/login":                true,
+		"https://client.example.com/other":                   false,
+		"https://client.example.com.evil.com/app/":           false,
+		"http://client.example.com/app/":                     false,
+	} {
+		if got := providers.SSO.ClientWhitelisted(redirectURL); got != want {
+			t.Errorf("ClientWhitelisted(%q) = %v, want %v", redirectURL, got, want)
+		}
+	}
+
+	if _, resErr := providers.SSO.AuthorizationURL("javascript:alert(1)"); resErr == nil {
+		t.Fatalf("AuthorizationURL accepted a javascript: redirect URL")
+	}
+}
+
+func TestLoginTokenIsSingleUse(t *testing.T) {
+	tokens := NewTokenStore(time.Minute)
+	token := tokens.Issue("alice")
+	if localpart, ok := tokens.Redeem(token); !ok || localpart != "alice" {
+		t.Fatalf("failed to redeem token")
+	}
+	if _, ok := tokens.Redeem(token); ok {
+		t.Fatalf("token was redeemed twice")
+	}
+}
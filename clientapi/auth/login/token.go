@@ -0,0 +1,109 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package login
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+const loginTokenLength = 32
+
+type loginToken struct {
+	localpart string
+	expires   time.Time
+}
+
+// TokenStore holds short-lived, single-use login tokens in memory. Tokens can
+// only be redeemed on the client API server which issued them.
+type TokenStore struct {
+	lifetime time.Duration
+	mu       sync.Mutex
+	tokens   map[string]loginToken
+}
+
+// NewTokenStore creates a TokenStore issuing tokens with the given lifetime.
+func NewTokenStore(lifetime time.Duration) *TokenStore {
+	return &TokenStore{
+		lifetime: lifetime,
+		tokens:   make(map[string]loginToken),
+	}
+}
+
+// Issue returns a new login token for the account with the given localpart.
+func (s *TokenStore) Issue(localpart string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for token, t := range s.tokens {
+		if now.After(t.expires) {
+			delete(s.tokens, token)
+		}
+	}
+	token := util.RandomString(loginTokenLength)
+	s.tokens[token] = loginToken{
+		localpart: localpart,
+		expires:   now.Add(s.lifetime),
+	}
+	return token
+}
+
+// Redeem consumes the login token and returns the localpart it was issued
+// for. It returns false if the token is unknown or has expired.
+func (s *TokenStore) Redeem(token string) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[token]
+	if !ok {
+		return "", false
+	}
+	delete(s.tokens, token)
+	if time.Now().After(t.expires) {
+		return "", false
+	}
+	return t.localpart, true
+}
+
+// tokenProvider implements m.login.token, using the tokens from a TokenStore.
+type tokenProvider struct {
+	tokens *TokenStore
+}
+
+func (p *tokenProvider) Type() authtypes.LoginType {
+	return authtypes.LoginTypeToken
+}
+
+func (p *tokenProvider) Login(ctx context.Context, req *Request) (string, *util.JSONResponse) {
+	if req.Token == "" {
+		return "", &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("'token' must be supplied."),
+		}
+	}
+	localpart, ok := p.tokens.Redeem(req.Token)
+	if !ok {
+		return "", &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("The login token is invalid or has expired"),
+		}
+	}
+	return localpart, nil
+}
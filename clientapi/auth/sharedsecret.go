@@ -0,0 +1,43 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+// SharedSecretRegistrationMAC returns the hex-encoded HMAC which proves
+// knowledge of the registration shared secret when registering a user
+// through /admin/register. It is compatible with Synapse, so that existing
+// provisioning scripts keep working. The user type is only included in the
+// HMAC if it isn't empty.
+func SharedSecretRegistrationMAC(
+	sharedSecret, nonce, username, password string, admin bool, userType string,
+) string {
+	adminString := "notadmin"
+	if admin {
+		adminString = "admin"
+	}
+	fields := []string{nonce, username, password, adminString}
+	if userType != "" {
+		fields = append(fields, userType)
+	}
+	mac := hmac.New(sha1.New, []byte(sharedSecret))
+	_, _ = mac.Write([]byte(strings.Join(fields, "\x00")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,36 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import "testing"
+
+// The expected values were computed in the same way as Synapse's
+// register_new_matrix_user script does.
+func TestSharedSecretRegistrationMAC(t *testing.T) {
+	tests := []struct {
+		admin    bool
+		userType string
+		want     string
+	}{
+		{true, "", "f3290aa9d55fb16b54eb61b61fb519b8fea58042"},
+		{false, "bot", "f5f9cdbf2937a4ba9f9f48075288ce453e9c91c8"},
+	}
+	for _, tt := range tests {
+		got := SharedSecretRegistrationMAC("secret", "abcdef", "alice", "wonderland", tt.admin, tt.userType)
+		if got != tt.want {
+			t.Errorf("SharedSecretRegistrationMAC(admin=%v, userType=%q) = %s, want %s", tt.admin, tt.userType, got, tt.want)
+		}
+	}
+}
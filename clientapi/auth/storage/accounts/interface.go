@@ -25,12 +25,18 @@ import (
 
 type Database interface {
 	internal.PartitionStorer
+	PushServerPartitionStore() internal.PartitionStorer
 	GetAccountByPassword(ctx context.Context, localpart, plaintextPassword string) (*authtypes.Account, error)
 	GetProfileByLocalpart(ctx context.Context, localpart string) (*authtypes.Profile, error)
 	SetAvatarURL(ctx context.Context, localpart string, avatarURL string) error
 	SetDisplayName(ctx context.Context, localpart string, displayName string) error
 	CreateAccount(ctx context.Context, localpart, plaintextPassword, appserviceID string) (*authtypes.Account, error)
 	CreateGuestAccount(ctx context.Context) (*authtypes.Account, error)
+	UpgradeGuestAccount(ctx context.Context, localpart, plaintextPassword string) error
+	SetPassword(ctx context.Context, localpart, plaintextPassword string) error
+	SetAdmin(ctx context.Context, localpart string, isAdmin bool) error
+	DeactivateAccount(ctx context.Context, localpart string) error
+	GetAccounts(ctx context.Context, from string, limit int) ([]authtypes.Account, error)
 	UpdateMemberships(ctx context.Context, eventsToAdd []gomatrixserverlib.Event, idsToRemove []string) error
 	GetMembershipInRoomByLocalpart(ctx context.Context, localpart, roomID string) (authtypes.Membership, error)
 	GetRoomIDsByLocalPart(ctx context.Context, localpart string) ([]string, error)
@@ -43,10 +49,16 @@ type Database interface {
 	RemoveThreePIDAssociation(ctx context.Context, threepid string, medium string) (err error)
 	GetLocalpartForThreePID(ctx context.Context, threepid string, medium string) (localpart string, err error)
 	GetThreePIDsForLocalpart(ctx context.Context, localpart string) (threepids []authtypes.ThreePID, err error)
+	GetLocalpartForExternalID(ctx context.Context, authProvider, externalID string) (localpart string, err error)
+	SaveExternalID(ctx context.Context, authProvider, externalID, localpart string) error
 	GetFilter(ctx context.Context, localpart string, filterID string) (*gomatrixserverlib.Filter, error)
 	PutFilter(ctx context.Context, localpart string, filter *gomatrixserverlib.Filter) (string, error)
 	CheckAccountAvailability(ctx context.Context, localpart string) (bool, error)
 	GetAccountByLocalpart(ctx context.Context, localpart string) (*authtypes.Account, error)
+	SavePusher(ctx context.Context, localpart string, pusher *authtypes.Pusher, exclusive bool) error
+	GetPushersByLocalpart(ctx context.Context, localpart string) ([]authtypes.Pusher, error)
+	RemovePusher(ctx context.Context, appID, pushKey, localpart string) error
+	RemovePushersByDevice(ctx context.Context, localpart, deviceID string) error
 }
 
 // Err3PIDInUse is the error returned when trying to save an association involving
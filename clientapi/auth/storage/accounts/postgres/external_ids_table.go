@@ -0,0 +1,83 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+)
+
+const externalIDsSchema = `
+-- Stores the association between identities in external authentication
+-- providers (e.g. an OpenID Connect provider) and local accounts
+CREATE TABLE IF NOT EXISTS account_external_ids (
+	-- The name of the authentication provider
+	auth_provider TEXT NOT NULL,
+	-- The identifier of the user in the authentication provider
+	external_id TEXT NOT NULL,
+	-- The localpart of the Matrix user ID associated to this identity
+	localpart TEXT NOT NULL,
+
+	PRIMARY KEY(auth_provider, external_id)
+);
+
+CREATE INDEX IF NOT EXISTS account_external_ids_localpart ON account_external_ids(localpart);
+`
+
+const selectLocalpartForExternalIDSQL = "" +
+	"SELECT localpart FROM account_external_ids WHERE auth_provider = $1 AND external_id = $2"
+
+const insertExternalIDSQL = "" +
+	"INSERT INTO account_external_ids (auth_provider, external_id, localpart) VALUES ($1, $2, $3)"
+
+type externalIDStatements struct {
+	selectLocalpartForExternalIDStmt *sql.Stmt
+	insertExternalIDStmt             *sql.Stmt
+}
+
+func (s *externalIDStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(externalIDsSchema)
+	if err != nil {
+		return
+	}
+	if s.selectLocalpartForExternalIDStmt, err = db.Prepare(selectLocalpartForExternalIDSQL); err != nil {
+		return
+	}
+	if s.insertExternalIDStmt, err = db.Prepare(insertExternalIDSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *externalIDStatements) selectLocalpartForExternalID(
+	ctx context.Context, txn *sql.Tx, authProvider, externalID string,
+) (localpart string, err error) {
+	stmt := internal.TxStmt(txn, s.selectLocalpartForExternalIDStmt)
+	err = stmt.QueryRowContext(ctx, authProvider, externalID).Scan(&localpart)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return
+}
+
+func (s *externalIDStatements) insertExternalID(
+	ctx context.Context, txn *sql.Tx, authProvider, externalID, localpart string,
+) (err error) {
+	stmt := internal.TxStmt(txn, s.insertExternalIDStmt)
+	_, err = stmt.ExecContext(ctx, authProvider, externalID, localpart)
+	return
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal"
+)
+
+const pushersSchema = `
+-- Stores the pushers of local users, which are used to send push
+-- notifications to their devices through a push gateway.
+CREATE TABLE IF NOT EXISTS account_pushers (
+	-- The Matrix user ID localpart for this pusher
+	localpart TEXT NOT NULL,
+	-- The device which created this pusher
+	device_id TEXT NOT NULL,
+	-- The application ID, e.g. a reverse-DNS style identifier
+	app_id TEXT NOT NULL,
+	-- The unique identifier of the device for the push gateway
+	pushkey TEXT NOT NULL,
+	-- The kind of pusher, e.g. 'http'
+	kind TEXT NOT NULL,
+	app_display_name TEXT NOT NULL,
+	device_display_name TEXT NOT NULL,
+	profile_tag TEXT NOT NULL,
+	lang TEXT NOT NULL,
+	-- The JSON data for the pusher, including the push gateway URL
+	data TEXT NOT NULL,
+
+	CONSTRAINT account_pushers_unique UNIQUE (app_id, pushkey, localpart)
+);
+
+CREATE INDEX IF NOT EXISTS account_pushers_localpart ON account_pushers(localpart);
+`
+
+const upsertPusherSQL = "" +
+	"INSERT INTO account_pushers (localpart, device_id, app_id, pushkey, kind, app_display_name, device_display_name, profile_tag, lang, data)" +
+	" VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)" +
+	" ON CONFLICT (app_id, pushkey, localpart)" +
+	" DO UPDATE SET device_id = EXCLUDED.device_id, kind = EXCLUDED.kind, app_display_name = EXCLUDED.app_display_name," +
+	" device_display_name = EXCLUDED.device_display_name, profile_tag = EXCLUDED.profile_tag, lang = EXCLUDED.lang, data = EXCLUDED.data"
+
+const selectPushersByLocalpartSQL = "" +
+	"SELECT device_id, app_id, pushkey, kind, app_display_name, device_display_name, profile_tag, lang, data" +
+	" FROM account_pushers WHERE localpart = $1"
+
+const deletePusherSQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2 AND localpart = $3"
+
+const deletePushersByAppIDAndPushKeySQL = "" +
+	"DELETE FROM account_pushers WHERE app_id = $1 AND pushkey = $2"
+
+const deletePushersByDeviceSQL = "" +
+	"DELETE FROM account_pushers WHERE localpart = $1 AND device_id = $2"
+
+type pushersStatements struct {
+	upsertPusherStmt                   *sql.Stmt
+	selectPushersByLocalpartStmt       *sql.Stmt
+	deletePusherStmt                   *sql.Stmt
+	deletePushersByAppIDAndPushKeyStmt *sql.Stmt
+	deletePushersByDeviceStmt          *sql.Stmt
+}
+
+func (s *pushersStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(pushersSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertPusherStmt, err = db.Prepare(upsertPusherSQL); err != nil {
+		return
+	}
+	if s.selectPushersByLocalpartStmt, err = db.Prepare(selectPushersByLocalpartSQL); err != nil {
+		return
+	}
+	if s.deletePusherStmt, err = db.Prepare(deletePusherSQL); err != nil {
+		return
+	}
+	if s.deletePushersByAppIDAndPushKeyStmt, err = db.Prepare(deletePushersByAppIDAndPushKeySQL); err != nil {
+		return
+	}
+	if s.deletePushersByDeviceStmt, err = db.Prepare(deletePushersByDeviceSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *pushersStatements) upsertPusher(
+	ctx context.Context, txn *sql.Tx, localpart string, pusher *authtypes.Pusher,
+) error {
+	data, err := json.Marshal(pusher.Data)
+	if err != nil {
+		return err
+	}
+	stmt := internal.TxStmt(txn, s.upsertPusherStmt)
+	_, err = stmt.ExecContext(
+		ctx, localpart, pusher.DeviceID, pusher.AppID, pusher.PushKey, pusher.Kind,
+		pusher.AppDisplayName, pusher.DeviceDisplayName, pusher.ProfileTag, pusher.Language, string(data),
+	)
+	return err
+}
+
+func (s *pushersStatements) selectPushersByLocalpart(
+	ctx context.Context, localpart string,
+) ([]authtypes.Pusher, error) {
+	rows, err := s.selectPushersByLocalpartStmt.QueryContext(ctx, localpart)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPushersByLocalpart: rows.close() failed")
+
+	pushers := []authtypes.Pusher{}
+	for rows.Next() {
+		var pusher authtypes.Pusher
+		var data string
+		if err = rows.Scan(
+			&pusher.DeviceID, &pusher.AppID, &pusher.PushKey, &pusher.Kind, &pusher.AppDisplayName,
+			&pusher.DeviceDisplayName, &pusher.ProfileTag, &pusher.Language, &data,
+		); err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal([]byte(data), &pusher.Data); err != nil {
+			return nil, err
+		}
+		pushers = append(pushers, pusher)
+	}
+	return pushers, rows.Err()
+}
+
+func (s *pushersStatements) deletePusher(
+	ctx context.Context, txn *sql.Tx, appID, pushKey, localpart string,
+) error {
+	stmt := internal.TxStmt(txn, s.deletePusherStmt)
+	_, err := stmt.ExecContext(ctx, appID, pushKey, localpart)
+	return err
+}
+
+func (s *pushersStatements) deletePushersByAppIDAndPushKey(
+	ctx context.Context, txn *sql.Tx, appID, pushKey string,
+) error {
+	stmt := internal.TxStmt(txn, s.deletePushersByAppIDAndPushKeyStmt)
+	_, err := stmt.ExecContext(ctx, appID, pushKey)
+	return err
+}
+
+func (s *pushersStatements) deletePushersByDevice(
+	ctx context.Context, localpart, deviceID string,
+) error {
+	_, err := s.deletePushersByDeviceStmt.ExecContext(ctx, localpart, deviceID)
+	return err
+}
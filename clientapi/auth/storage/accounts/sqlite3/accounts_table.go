@@ -21,6 +21,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	log "github.com/sirupsen/logrus"
@@ -36,31 +37,58 @@ CREATE TABLE IF NOT EXISTS account_accounts (
     -- The password hash for this account. Can be NULL if this is a passwordless account.
     password_hash TEXT,
     -- Identifies which application service this account belongs to, if any.
-    appservice_id TEXT
+    appservice_id TEXT,
+    -- Whether this is a guest account. Guest accounts are passwordless
+    -- until they are upgraded to full accounts.
+    is_guest BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Whether this account can use the admin API.
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+    -- Whether this account has been deactivated. Deactivated accounts can't
+    -- log in and their localparts can't be registered again.
+    is_deactivated BOOLEAN NOT NULL DEFAULT FALSE
     -- TODO:
-    -- is_guest, is_admin, upgraded_ts, devices, any email reset stuff?
+    -- upgraded_ts, devices, any email reset stuff?
 );
 `
 
 const insertAccountSQL = "" +
-	"INSERT INTO account_accounts(localpart, created_ts, password_hash, appservice_id) VALUES ($1, $2, $3, $4)"
+	"INSERT INTO account_accounts(localpart, created_ts, password_hash, appservice_id, is_guest) VALUES ($1, $2, $3, $4, $5)"
 
 const selectAccountByLocalpartSQL = "" +
-	"SELECT localpart, appservice_id FROM account_accounts WHERE localpart = $1"
+	"SELECT localpart, appservice_id, is_guest, is_admin, is_deactivated FROM account_accounts WHERE localpart = $1"
+
+const selectAccountsSQL = "" +
+	"SELECT localpart, appservice_id, is_guest, is_admin, is_deactivated FROM account_accounts" +
+	" WHERE localpart > $1 ORDER BY localpart ASC LIMIT $2"
 
 const selectPasswordHashSQL = "" +
-	"SELECT password_hash FROM account_accounts WHERE localpart = $1"
+	"SELECT password_hash FROM account_accounts WHERE localpart = $1 AND NOT is_deactivated"
 
 const selectNewNumericLocalpartSQL = "" +
 	"SELECT COUNT(localpart) FROM account_accounts"
 
-// TODO: Update password
+const upgradeGuestAccountSQL = "" +
+	"UPDATE account_accounts SET password_hash = $1, is_guest = FALSE WHERE localpart = $2 AND is_guest"
+
+const updatePasswordSQL = "" +
+	"UPDATE account_accounts SET password_hash = $1 WHERE localpart = $2 AND NOT is_deactivated"
+
+const updateIsAdminSQL = "" +
+	"UPDATE account_accounts SET is_admin = $1 WHERE localpart = $2"
+
+const deactivateAccountSQL = "" +
+	"UPDATE account_accounts SET is_deactivated = TRUE, is_admin = FALSE, password_hash = NULL WHERE localpart = $1"
 
 type accountsStatements struct {
 	insertAccountStmt             *sql.Stmt
 	selectAccountByLocalpartStmt  *sql.Stmt
 	selectPasswordHashStmt        *sql.Stmt
 	selectNewNumericLocalpartStmt *sql.Stmt
+	upgradeGuestAccountStmt       *sql.Stmt
+	selectAccountsStmt            *sql.Stmt
+	updatePasswordStmt            *sql.Stmt
+	updateIsAdminStmt             *sql.Stmt
+	deactivateAccountStmt         *sql.Stmt
 	serverName                    gomatrixserverlib.ServerName
 }
 
@@ -69,6 +97,12 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if err != nil {
 		return
 	}
+	// Add the columns which were added after the table was first created.
+	for _, column := range []string{"is_guest", "is_admin", "is_deactivated"} {
+		if err = internal.SQLiteAddColumnIfNotExists(db, "account_accounts", column, "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+			return
+		}
+	}
 	if s.insertAccountStmt, err = db.Prepare(insertAccountSQL); err != nil {
 		return
 	}
@@ -81,6 +115,21 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 	if s.selectNewNumericLocalpartStmt, err = db.Prepare(selectNewNumericLocalpartSQL); err != nil {
 		return
 	}
+	if s.upgradeGuestAccountStmt, err = db.Prepare(upgradeGuestAccountSQL); err != nil {
+		return
+	}
+	if s.selectAccountsStmt, err = db.Prepare(selectAccountsSQL); err != nil {
+		return
+	}
+	if s.updatePasswordStmt, err = db.Prepare(updatePasswordSQL); err != nil {
+		return
+	}
+	if s.updateIsAdminStmt, err = db.Prepare(updateIsAdminSQL); err != nil {
+		return
+	}
+	if s.deactivateAccountStmt, err = db.Prepare(deactivateAccountSQL); err != nil {
+		return
+	}
 	s.serverName = server
 	return
 }
@@ -89,16 +138,16 @@ func (s *accountsStatements) prepare(db *sql.DB, server gomatrixserverlib.Server
 // this account will be passwordless. Returns an error if this account already exists. Returns the account
 // on success.
 func (s *accountsStatements) insertAccount(
-	ctx context.Context, txn *sql.Tx, localpart, hash, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, hash, appserviceID string, isGuest bool,
 ) (*authtypes.Account, error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
 	stmt := s.insertAccountStmt
 
 	var err error
 	if appserviceID == "" {
-		_, err = txn.Stmt(stmt).ExecContext(ctx, localpart, createdTimeMS, hash, nil)
+		_, err = txn.Stmt(stmt).ExecContext(ctx, localpart, createdTimeMS, hash, nil, isGuest)
 	} else {
-		_, err = txn.Stmt(stmt).ExecContext(ctx, localpart, createdTimeMS, hash, appserviceID)
+		_, err = txn.Stmt(stmt).ExecContext(ctx, localpart, createdTimeMS, hash, appserviceID, isGuest)
 	}
 	if err != nil {
 		return nil, err
@@ -109,6 +158,7 @@ func (s *accountsStatements) insertAccount(
 		UserID:       userutil.MakeUserID(localpart, s.serverName),
 		ServerName:   s.serverName,
 		AppServiceID: appserviceID,
+		IsGuest:      isGuest,
 	}, nil
 }
 
@@ -126,7 +176,9 @@ func (s *accountsStatements) selectAccountByLocalpart(
 	var acc authtypes.Account
 
 	stmt := s.selectAccountByLocalpartStmt
-	err := stmt.QueryRowContext(ctx, localpart).Scan(&acc.Localpart, &appserviceIDPtr)
+	err := stmt.QueryRowContext(ctx, localpart).Scan(
+		&acc.Localpart, &appserviceIDPtr, &acc.IsGuest, &acc.IsAdmin, &acc.IsDeactivated,
+	)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			log.WithError(err).Error("Unable to retrieve user from the db")
@@ -153,3 +205,81 @@ func (s *accountsStatements) selectNewNumericLocalpart(
 	err = stmt.QueryRowContext(ctx).Scan(&id)
 	return
 }
+
+// upgradeGuestAccount gives a guest account a password and turns it into a
+// full account. Returns sql.ErrNoRows if there is no such guest account.
+func (s *accountsStatements) upgradeGuestAccount(
+	ctx context.Context, txn *sql.Tx, localpart, hash string,
+) error {
+	stmt := internal.TxStmt(txn, s.upgradeGuestAccountStmt)
+	return execAffectingOneAccount(stmt.ExecContext(ctx, hash, localpart))
+}
+
+// selectAccounts returns up to limit accounts, ordered by localpart and
+// starting after the given localpart.
+func (s *accountsStatements) selectAccounts(
+	ctx context.Context, from string, limit int,
+) ([]authtypes.Account, error) {
+	rows, err := s.selectAccountsStmt.QueryContext(ctx, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectAccounts: rows.close() failed")
+
+	var accounts []authtypes.Account
+	for rows.Next() {
+		var appserviceIDPtr sql.NullString
+		var acc authtypes.Account
+		if err = rows.Scan(
+			&acc.Localpart, &appserviceIDPtr, &acc.IsGuest, &acc.IsAdmin, &acc.IsDeactivated,
+		); err != nil {
+			return nil, err
+		}
+		acc.AppServiceID = appserviceIDPtr.String
+		acc.UserID = userutil.MakeUserID(acc.Localpart, s.serverName)
+		acc.ServerName = s.serverName
+		accounts = append(accounts, acc)
+	}
+	return accounts, rows.Err()
+}
+
+// updatePassword replaces the password hash of an account. Returns
+// sql.ErrNoRows if there is no such account or it has been deactivated.
+func (s *accountsStatements) updatePassword(
+	ctx context.Context, txn *sql.Tx, localpart, hash string,
+) error {
+	stmt := internal.TxStmt(txn, s.updatePasswordStmt)
+	return execAffectingOneAccount(stmt.ExecContext(ctx, hash, localpart))
+}
+
+// updateIsAdmin sets whether an account is an admin. Returns sql.ErrNoRows if
+// there is no such account.
+func (s *accountsStatements) updateIsAdmin(
+	ctx context.Context, txn *sql.Tx, localpart string, isAdmin bool,
+) error {
+	stmt := internal.TxStmt(txn, s.updateIsAdminStmt)
+	return execAffectingOneAccount(stmt.ExecContext(ctx, isAdmin, localpart))
+}
+
+// deactivateAccount marks an account as deactivated and removes its
+// password. Returns sql.ErrNoRows if there is no such account.
+func (s *accountsStatements) deactivateAccount(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	stmt := internal.TxStmt(txn, s.deactivateAccountStmt)
+	return execAffectingOneAccount(stmt.ExecContext(ctx, localpart))
+}
+
+// execAffectingOneAccount checks the result of an update to a single account,
+// returning sql.ErrNoRows if no account was updated.
+func execAffectingOneAccount(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
@@ -35,13 +35,16 @@ import (
 type Database struct {
 	db *sql.DB
 	internal.PartitionOffsetStatements
-	accounts     accountsStatements
-	profiles     profilesStatements
-	memberships  membershipStatements
-	accountDatas accountDataStatements
-	threepids    threepidStatements
-	filter       filterStatements
-	serverName   gomatrixserverlib.ServerName
+	pushserverPartitions internal.PartitionOffsetStatements
+	accounts             accountsStatements
+	profiles             profilesStatements
+	memberships          membershipStatements
+	accountDatas         accountDataStatements
+	threepids            threepidStatements
+	filter               filterStatements
+	pushers              pushersStatements
+	externalIDs          externalIDStatements
+	serverName           gomatrixserverlib.ServerName
 
 	createGuestAccountMu sync.Mutex
 }
@@ -57,6 +60,10 @@ func NewDatabase(dataSourceName string, serverName gomatrixserverlib.ServerName)
 	if err = partitions.Prepare(db, "account"); err != nil {
 		return nil, err
 	}
+	pushserverPartitions := internal.PartitionOffsetStatements{}
+	if err = pushserverPartitions.Prepare(db, "pushserver"); err != nil {
+		return nil, err
+	}
 	a := accountsStatements{}
 	if err = a.prepare(db, serverName); err != nil {
 		return nil, err
@@ -81,7 +88,22 @@ func NewDatabase(dataSourceName string, serverName gomatrixserverlib.ServerName)
 	if err = f.prepare(db); err != nil {
 		return nil, err
 	}
-	return &Database{db, partitions, a, p, m, ac, t, f, serverName, sync.Mutex{}}, nil
+	pu := pushersStatements{}
+	if err = pu.prepare(db); err != nil {
+		return nil, err
+	}
+	e := externalIDStatements{}
+	if err = e.prepare(db); err != nil {
+		return nil, err
+	}
+	return &Database{db, partitions, pushserverPartitions, a, p, m, ac, t, f, pu, e, serverName, sync.Mutex{}}, nil
+}
+
+// PushServerPartitionStore returns the partition offsets used by the push
+// server, which are kept apart from the client API's offsets since both
+// consume the same topics.
+func (d *Database) PushServerPartitionStore() internal.PartitionStorer {
+	return &d.pushserverPartitions
 }
 
 // GetAccountByPassword returns the account associated with the given localpart and password.
@@ -140,7 +162,7 @@ func (d *Database) CreateGuestAccount(ctx context.Context) (acc *authtypes.Accou
 			return err
 		}
 		localpart := strconv.FormatInt(numLocalpart, 10)
-		acc, err = d.createAccount(ctx, txn, localpart, "", "")
+		acc, err = d.createAccount(ctx, txn, localpart, "", "", true)
 		return err
 	})
 	return acc, err
@@ -153,14 +175,14 @@ func (d *Database) CreateAccount(
 	ctx context.Context, localpart, plaintextPassword, appserviceID string,
 ) (acc *authtypes.Account, err error) {
 	err = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
-		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID)
+		acc, err = d.createAccount(ctx, txn, localpart, plaintextPassword, appserviceID, false)
 		return err
 	})
 	return
 }
 
 func (d *Database) createAccount(
-	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string,
+	ctx context.Context, txn *sql.Tx, localpart, plaintextPassword, appserviceID string, isGuest bool,
 ) (*authtypes.Account, error) {
 	var err error
 	// Generate a password hash if this is not a password-less user
@@ -189,7 +211,65 @@ func (d *Database) createAccount(
 	}`); err != nil {
 		return nil, err
 	}
-	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID)
+	return d.accounts.insertAccount(ctx, txn, localpart, hash, appserviceID, isGuest)
+}
+
+// UpgradeGuestAccount turns the guest account with the given localpart into a
+// full account with the given password. Returns sql.ErrNoRows if there is no
+// guest account with that localpart.
+func (d *Database) UpgradeGuestAccount(
+	ctx context.Context, localpart, plaintextPassword string,
+) error {
+	hash, err := hashPassword(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.accounts.upgradeGuestAccount(ctx, txn, localpart, hash)
+	})
+}
+
+// SetPassword replaces the password of an account. Returns sql.ErrNoRows if
+// there is no such account or it has been deactivated.
+func (d *Database) SetPassword(
+	ctx context.Context, localpart, plaintextPassword string,
+) error {
+	hash, err := hashPassword(plaintextPassword)
+	if err != nil {
+		return err
+	}
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.accounts.updatePassword(ctx, txn, localpart, hash)
+	})
+}
+
+// SetAdmin sets whether an account can use the admin API. Returns
+// sql.ErrNoRows if there is no such account.
+func (d *Database) SetAdmin(
+	ctx context.Context, localpart string, isAdmin bool,
+) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.accounts.updateIsAdmin(ctx, txn, localpart, isAdmin)
+	})
+}
+
+// DeactivateAccount stops an account from being logged into again. The
+// account isn't deleted, so that its localpart can't be reused. Returns
+// sql.ErrNoRows if there is no such account.
+func (d *Database) DeactivateAccount(
+	ctx context.Context, localpart string,
+) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.accounts.deactivateAccount(ctx, txn, localpart)
+	})
+}
+
+// GetAccounts returns up to limit accounts, ordered by localpart and starting
+// after the given localpart.
+func (d *Database) GetAccounts(
+	ctx context.Context, from string, limit int,
+) ([]authtypes.Account, error) {
+	return d.accounts.selectAccounts(ctx, from, limit)
 }
 
 // SaveMembership saves the user matching a given localpart as a member of a given
@@ -394,6 +474,26 @@ func (d *Database) GetLocalpartForThreePID(
 	return d.threepids.selectLocalpartForThreePID(ctx, nil, threepid, medium)
 }
 
+// GetLocalpartForExternalID looks up the localpart associated with the given
+// identity in an external authentication provider.
+// If no association is known for this identity, returns an empty string.
+// Returns an error if there was a problem talking to the database.
+func (d *Database) GetLocalpartForExternalID(
+	ctx context.Context, authProvider, externalID string,
+) (localpart string, err error) {
+	return d.externalIDs.selectLocalpartForExternalID(ctx, nil, authProvider, externalID)
+}
+
+// SaveExternalID associates the given identity in an external authentication
+// provider with a local account.
+// Returns an error if the identity is already associated with an account, or if
+// there was a problem talking to the database.
+func (d *Database) SaveExternalID(
+	ctx context.Context, authProvider, externalID, localpart string,
+) error {
+	return d.externalIDs.insertExternalID(ctx, nil, authProvider, externalID, localpart)
+}
+
 // GetThreePIDsForLocalpart looks up the third-party identifiers associated with
 // a given local user.
 // If no association is known for this user, returns an empty slice.
@@ -440,3 +540,41 @@ func (d *Database) GetAccountByLocalpart(ctx context.Context, localpart string,
 ) (*authtypes.Account, error) {
 	return d.accounts.selectAccountByLocalpart(ctx, localpart)
 }
+
+// SavePusher stores a pusher for the given local user, replacing any pusher
+// with the same app ID and pushkey. If exclusive is true, pushers with the same
+// app ID and pushkey belonging to other users are removed.
+func (d *Database) SavePusher(
+	ctx context.Context, localpart string, pusher *authtypes.Pusher, exclusive bool,
+) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if exclusive {
+			if err := d.pushers.deletePushersByAppIDAndPushKey(ctx, txn, pusher.AppID, pusher.PushKey); err != nil {
+				return err
+			}
+		}
+		return d.pushers.upsertPusher(ctx, txn, localpart, pusher)
+	})
+}
+
+// GetPushersByLocalpart returns all the pushers of the given local user.
+func (d *Database) GetPushersByLocalpart(
+	ctx context.Context, localpart string,
+) ([]authtypes.Pusher, error) {
+	return d.pushers.selectPushersByLocalpart(ctx, localpart)
+}
+
+// RemovePusher removes the pusher with the given app ID and pushkey for the
+// given local user. Does nothing if there is no such pusher.
+func (d *Database) RemovePusher(
+	ctx context.Context, appID, pushKey, localpart string,
+) error {
+	return d.pushers.deletePusher(ctx, nil, appID, pushKey, localpart)
+}
+
+// RemovePushersByDevice removes all pushers created by the given device.
+func (d *Database) RemovePushersByDevice(
+	ctx context.Context, localpart, deviceID string,
+) error {
+	return d.pushers.deletePushersByDevice(ctx, localpart, deviceID)
+}
@@ -25,6 +25,8 @@ type Database interface {
 	GetDeviceByID(ctx context.Context, localpart, deviceID string) (*authtypes.Device, error)
 	GetDevicesByLocalpart(ctx context.Context, localpart string) ([]authtypes.Device, error)
 	CreateDevice(ctx context.Context, localpart string, deviceID *string, accessToken string, displayName *string) (dev *authtypes.Device, returnErr error)
+	CreateGuestDevice(ctx context.Context, localpart string, accessToken string, displayName *string) (*authtypes.Device, error)
+	UpgradeGuestDevices(ctx context.Context, localpart string) error
 	UpdateDevice(ctx context.Context, localpart, deviceID string, displayName *string) error
 	RemoveDevice(ctx context.Context, deviceID, localpart string) error
 	RemoveDevices(ctx context.Context, localpart string, devices []string) error
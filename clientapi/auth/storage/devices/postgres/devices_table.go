@@ -50,20 +50,25 @@ CREATE TABLE IF NOT EXISTS device_devices (
     -- When this devices was first recognised on the network, as a unix timestamp (ms resolution).
     created_ts BIGINT NOT NULL,
     -- The display name, human friendlier than device_id and updatable
-    display_name TEXT
+    display_name TEXT,
+    -- Whether this device belongs to a guest account.
+    is_guest BOOLEAN NOT NULL DEFAULT FALSE
     -- TODO: device keys, device display names, last used ts and IP address?, token restrictions (if 3rd-party OAuth app)
 );
 
 -- Device IDs must be unique for a given user.
 CREATE UNIQUE INDEX IF NOT EXISTS device_localpart_id_idx ON device_devices(localpart, device_id);
+
+-- Add the columns which were added after the table was first created.
+ALTER TABLE device_devices ADD COLUMN IF NOT EXISTS is_guest BOOLEAN NOT NULL DEFAULT FALSE;
 `
 
 const insertDeviceSQL = "" +
-	"INSERT INTO device_devices(device_id, localpart, access_token, created_ts, display_name) VALUES ($1, $2, $3, $4, $5)" +
+	"INSERT INTO device_devices(device_id, localpart, access_token, created_ts, display_name, is_guest) VALUES ($1, $2, $3, $4, $5, $6)" +
 	" RETURNING session_id"
 
 const selectDeviceByTokenSQL = "" +
-	"SELECT session_id, device_id, localpart FROM device_devices WHERE access_token = $1"
+	"SELECT session_id, device_id, localpart, is_guest FROM device_devices WHERE access_token = $1"
 
 const selectDeviceByIDSQL = "" +
 	"SELECT display_name FROM device_devices WHERE localpart = $1 and device_id = $2"
@@ -71,6 +76,9 @@ const selectDeviceByIDSQL = "" +
 const selectDevicesByLocalpartSQL = "" +
 	"SELECT device_id, display_name FROM device_devices WHERE localpart = $1"
 
+const upgradeGuestDevicesSQL = "" +
+	"UPDATE device_devices SET is_guest = FALSE WHERE localpart = $1"
+
 const updateDeviceNameSQL = "" +
 	"UPDATE device_devices SET display_name = $1 WHERE localpart = $2 AND device_id = $3"
 
@@ -89,6 +97,7 @@ type devicesStatements struct {
 	selectDeviceByIDStmt         *sql.Stmt
 	selectDevicesByLocalpartStmt *sql.Stmt
 	updateDeviceNameStmt         *sql.Stmt
+	upgradeGuestDevicesStmt      *sql.Stmt
 	deleteDeviceStmt             *sql.Stmt
 	deleteDevicesByLocalpartStmt *sql.Stmt
 	deleteDevicesStmt            *sql.Stmt
@@ -115,6 +124,9 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 	if s.updateDeviceNameStmt, err = db.Prepare(updateDeviceNameSQL); err != nil {
 		return
 	}
+	if s.upgradeGuestDevicesStmt, err = db.Prepare(upgradeGuestDevicesSQL); err != nil {
+		return
+	}
 	if s.deleteDeviceStmt, err = db.Prepare(deleteDeviceSQL); err != nil {
 		return
 	}
@@ -133,12 +145,12 @@ func (s *devicesStatements) prepare(db *sql.DB, server gomatrixserverlib.ServerN
 // Returns the device on success.
 func (s *devicesStatements) insertDevice(
 	ctx context.Context, txn *sql.Tx, id, localpart, accessToken string,
-	displayName *string,
+	displayName *string, isGuest bool,
 ) (*authtypes.Device, error) {
 	createdTimeMS := time.Now().UnixNano() / 1000000
 	var sessionID int64
 	stmt := internal.TxStmt(txn, s.insertDeviceStmt)
-	if err := stmt.QueryRowContext(ctx, id, localpart, accessToken, createdTimeMS, displayName).Scan(&sessionID); err != nil {
+	if err := stmt.QueryRowContext(ctx, id, localpart, accessToken, createdTimeMS, displayName, isGuest).Scan(&sessionID); err != nil {
 		return nil, err
 	}
 	return &authtypes.Device{
@@ -146,6 +158,7 @@ func (s *devicesStatements) insertDevice(
 		UserID:      userutil.MakeUserID(localpart, s.serverName),
 		AccessToken: accessToken,
 		SessionID:   sessionID,
+		IsGuest:     isGuest,
 	}, nil
 }
 
@@ -186,13 +199,23 @@ func (s *devicesStatements) updateDeviceName(
 	return err
 }
 
+// upgradeGuestDevices marks all of the devices for the given user localpart
+// as belonging to a full account.
+func (s *devicesStatements) upgradeGuestDevices(
+	ctx context.Context, txn *sql.Tx, localpart string,
+) error {
+	stmt := internal.TxStmt(txn, s.upgradeGuestDevicesStmt)
+	_, err := stmt.ExecContext(ctx, localpart)
+	return err
+}
+
 func (s *devicesStatements) selectDeviceByToken(
 	ctx context.Context, accessToken string,
 ) (*authtypes.Device, error) {
 	var dev authtypes.Device
 	var localpart string
 	stmt := s.selectDeviceByTokenStmt
-	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart)
+	err := stmt.QueryRowContext(ctx, accessToken).Scan(&dev.SessionID, &dev.ID, &localpart, &dev.IsGuest)
 	if err == nil {
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		dev.AccessToken = accessToken
@@ -206,12 +229,13 @@ func (s *devicesStatements) selectDeviceByID(
 	ctx context.Context, localpart, deviceID string,
 ) (*authtypes.Device, error) {
 	var dev authtypes.Device
-	var created sql.NullInt64
+	var displayName sql.NullString
 	stmt := s.selectDeviceByIDStmt
-	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&created)
+	err := stmt.QueryRowContext(ctx, localpart, deviceID).Scan(&displayName)
 	if err == nil {
 		dev.ID = deviceID
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
+		dev.DisplayName = displayName.String
 	}
 	return &dev, err
 }
@@ -230,10 +254,12 @@ func (s *devicesStatements) selectDevicesByLocalpart(
 
 	for rows.Next() {
 		var dev authtypes.Device
-		err = rows.Scan(&dev.ID, &dev.DisplayName)
+		var displayName sql.NullString
+		err = rows.Scan(&dev.ID, &displayName)
 		if err != nil {
 			return devices, err
 		}
+		dev.DisplayName = displayName.String
 		dev.UserID = userutil.MakeUserID(localpart, s.serverName)
 		devices = append(devices, dev)
 	}
@@ -81,6 +81,32 @@ func (d *Database) GetDevicesByLocalpart(
 func (d *Database) CreateDevice(
 	ctx context.Context, localpart string, deviceID *string, accessToken string,
 	displayName *string,
+) (dev *authtypes.Device, returnErr error) {
+	return d.createDevice(ctx, localpart, deviceID, accessToken, displayName, false)
+}
+
+// CreateGuestDevice makes a new device for the guest account with the given
+// user ID localpart. Guests can't choose their own device IDs, so one is
+// always generated. Returns the device on success.
+func (d *Database) CreateGuestDevice(
+	ctx context.Context, localpart string, accessToken string, displayName *string,
+) (*authtypes.Device, error) {
+	return d.createDevice(ctx, localpart, nil, accessToken, displayName, true)
+}
+
+// UpgradeGuestDevices marks the devices of the given user ID localpart as
+// belonging to a full account, once a guest account has been upgraded.
+func (d *Database) UpgradeGuestDevices(
+	ctx context.Context, localpart string,
+) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		return d.devices.upgradeGuestDevices(ctx, txn, localpart)
+	})
+}
+
+func (d *Database) createDevice(
+	ctx context.Context, localpart string, deviceID *string, accessToken string,
+	displayName *string, isGuest bool,
 ) (dev *authtypes.Device, returnErr error) {
 	if deviceID != nil {
 		returnErr = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
@@ -90,7 +116,7 @@ func (d *Database) CreateDevice(
 				return err
 			}
 
-			dev, err = d.devices.insertDevice(ctx, txn, *deviceID, localpart, accessToken, displayName)
+			dev, err = d.devices.insertDevice(ctx, txn, *deviceID, localpart, accessToken, displayName, isGuest)
 			return err
 		})
 	} else {
@@ -105,7 +131,7 @@ func (d *Database) CreateDevice(
 
 			returnErr = internal.WithTransaction(d.db, func(txn *sql.Tx) error {
 				var err error
-				dev, err = d.devices.insertDevice(ctx, txn, newDeviceID, localpart, accessToken, displayName)
+				dev, err = d.devices.insertDevice(ctx, txn, newDeviceID, localpart, accessToken, displayName, isGuest)
 				return err
 			})
 			if returnErr == nil {
@@ -17,15 +17,18 @@ import (
 	"net/http"
 	"strconv"
 	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 )
 
-// ParseTSParam takes a req (typically from an application service) and parses a Time object
-// from the req if it exists in the query parameters. If it doesn't exist, the
-// current time is returned.
-func ParseTSParam(req *http.Request) (time.Time, error) {
+// ParseTSParam takes a req from an application service and parses a Time object
+// from the req if it exists in the query parameters. If it doesn't exist, or the
+// device doesn't belong to an application service, the current time is returned
+// so that ordinary clients can't forge the timestamps of their events.
+func ParseTSParam(req *http.Request, device *authtypes.Device) (time.Time, error) {
 	// Use the ts parameter's value for event time if present
 	tsStr := req.URL.Query().Get("ts")
-	if tsStr == "" {
+	if tsStr == "" || device.AppServiceID == "" {
 		return time.Now(), nil
 	}
 
@@ -35,5 +38,5 @@ func ParseTSParam(req *http.Request) (time.Time, error) {
 		return time.Time{}, fmt.Errorf("Param 'ts' is no valid int (%s)", err.Error())
 	}
 
-	return time.Unix(ts/1000, 0), nil
+	return time.Unix(ts/1000, (ts%1000)*int64(time.Millisecond)), nil
 }
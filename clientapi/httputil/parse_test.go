@@ -0,0 +1,77 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+var appServiceDevice = &authtypes.Device{UserID: "@irc_bot:localhost", AppServiceID: "irc"}
+
+func TestParseTSParam(t *testing.T) {
+	tests := []struct {
+		ts   string
+		want time.Time
+	}{
+		{"0", time.Unix(0, 0)},
+		{"1000", time.Unix(1, 0)},
+		{"1592384567123", time.Unix(1592384567, 123*int64(time.Millisecond))},
+		{"1592384567001", time.Unix(1592384567, int64(time.Millisecond))},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("PUT", "/?ts="+tt.ts, nil)
+		got, err := ParseTSParam(req, appServiceDevice)
+		if err != nil {
+			t.Fatalf("ParseTSParam(%s) returned %s", tt.ts, err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("ParseTSParam(%s) returned %s, want %s", tt.ts, got, tt.want)
+		}
+	}
+}
+
+func TestParseTSParamMissing(t *testing.T) {
+	before := time.Now()
+	got, err := ParseTSParam(httptest.NewRequest("PUT", "/", nil), appServiceDevice)
+	if err != nil {
+		t.Fatalf("ParseTSParam returned %s", err)
+	}
+	if got.Before(before) || got.After(time.Now()) {
+		t.Fatalf("ParseTSParam returned %s, want the current time", got)
+	}
+}
+
+func TestParseTSParamInvalid(t *testing.T) {
+	if _, err := ParseTSParam(httptest.NewRequest("PUT", "/?ts=yesterday", nil), appServiceDevice); err == nil {
+		t.Fatalf("ParseTSParam returned no error for an invalid ts")
+	}
+}
+
+func TestParseTSParamNotAppService(t *testing.T) {
+	// Ordinary users can't backdate their events.
+	device := &authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"}
+	before := time.Now()
+	got, err := ParseTSParam(httptest.NewRequest("PUT", "/?ts=1000", nil), device)
+	if err != nil {
+		t.Fatalf("ParseTSParam returned %s", err)
+	}
+	if got.Before(before) || got.After(time.Now()) {
+		t.Fatalf("ParseTSParam returned %s, want the current time", got)
+	}
+}
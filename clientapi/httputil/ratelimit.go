@@ -0,0 +1,107 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/util"
+)
+
+// RateLimits limits how quickly each user can make requests. Each user may make
+// up to a threshold of requests, each of which counts towards the threshold
+// until the cooloff period after it has passed.
+type RateLimits struct {
+	cfg              *config.Dendrite
+	enabled          bool
+	requestThreshold int64
+	cooloffDuration  time.Duration
+	limits           map[string]chan struct{}
+	limitsMutex      sync.Mutex
+}
+
+// NewRateLimits creates rate limits using the rate limiting configuration. Users
+// of application services are exempt unless the application service's
+// registration sets rate_limited.
+func NewRateLimits(cfg *config.Dendrite) *RateLimits {
+	return &RateLimits{
+		cfg:              cfg,
+		enabled:          cfg.Matrix.RateLimiting.Enabled,
+		requestThreshold: cfg.Matrix.RateLimiting.Threshold,
+		cooloffDuration:  time.Duration(cfg.Matrix.RateLimiting.CooloffMS) * time.Millisecond,
+		limits:           make(map[string]chan struct{}),
+	}
+}
+
+// Limit counts a request made by the given device towards its user's rate
+// limit. Returns an error response which can be sent to the client if the user
+// has made too many requests recently, or nil if the request may proceed.
+func (l *RateLimits) Limit(device *authtypes.Device) *util.JSONResponse {
+	if !l.enabled {
+		return nil
+	}
+	if l.isExempt(device) {
+		return nil
+	}
+
+	l.limitsMutex.Lock()
+	defer l.limitsMutex.Unlock()
+
+	limit, ok := l.limits[device.UserID]
+	if !ok {
+		limit = make(chan struct{}, l.requestThreshold)
+		l.limits[device.UserID] = limit
+	}
+
+	select {
+	case limit <- struct{}{}:
+	default:
+		return &util.JSONResponse{
+			Code: http.StatusTooManyRequests,
+			JSON: jsonerror.LimitExceeded("You are sending too many requests too quickly!", l.cooloffDuration.Milliseconds()),
+		}
+	}
+
+	// Stop counting the request once the cooloff has passed, forgetting about
+	// the user entirely once none of their requests count any more.
+	time.AfterFunc(l.cooloffDuration, func() {
+		l.limitsMutex.Lock()
+		defer l.limitsMutex.Unlock()
+		<-limit
+		if len(limit) == 0 {
+			delete(l.limits, device.UserID)
+		}
+	})
+	return nil
+}
+
+// isExempt returns whether the device belongs to a user of an application
+// service which isn't rate limited.
+func (l *RateLimits) isExempt(device *authtypes.Device) bool {
+	if device.AppServiceID == "" {
+		return false
+	}
+	for _, as := range l.cfg.AppServices() {
+		if as.ID == device.AppServiceID {
+			return !as.RateLimited
+		}
+	}
+	return false
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package httputil
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+func newTestRateLimits(threshold, cooloffMS int64, appservices ...config.ApplicationService) *RateLimits {
+	cfg := &config.Dendrite{}
+	cfg.Matrix.RateLimiting.Enabled = true
+	cfg.Matrix.RateLimiting.Threshold = threshold
+	cfg.Matrix.RateLimiting.CooloffMS = cooloffMS
+	cfg.Derived.ApplicationServices = appservices
+	return NewRateLimits(cfg)
+}
+
+func TestRateLimitsThreshold(t *testing.T) {
+	l := newTestRateLimits(3, 60000)
+	alice := &authtypes.Device{UserID: "@alice:localhost"}
+	bob := &authtypes.Device{UserID: "@bob:localhost"}
+
+	for i := 0; i < 3; i++ {
+		if res := l.Limit(alice); res != nil {
+			t.Fatalf("request %d was limited, want it to proceed", i+1)
+		}
+	}
+	res := l.Limit(alice)
+	if res == nil {
+		t.Fatalf("request over the threshold proceeded, want it to be limited")
+	}
+	if res.Code != http.StatusTooManyRequests {
+		t.Fatalf("limited request returned code %d, want %d", res.Code, http.StatusTooManyRequests)
+	}
+	if res := l.Limit(bob); res != nil {
+		t.Fatalf("request from another user was limited, want it to proceed")
+	}
+}
+
+func TestRateLimitsCooloff(t *testing.T) {
+	l := newTestRateLimits(1, 10)
+	alice := &authtypes.Device{UserID: "@alice:localhost"}
+
+	if res := l.Limit(alice); res != nil {
+		t.Fatalf("first request was limited, want it to proceed")
+	}
+	if res := l.Limit(alice); res == nil {
+		t.Fatalf("second request proceeded before the cooloff, want it to be limited")
+	}
+
+	// Wait for the first request to stop counting and for the user to be
+	// forgotten about.
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		l.limitsMutex.Lock()
+		_, ok := l.limits[alice.UserID]
+		l.limitsMutex.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("user was still being limited after the cooloff")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if res := l.Limit(alice); res != nil {
+		t.Fatalf("request after the cooloff was limited, want it to proceed")
+	}
+}
+
+func TestRateLimitsDisabled(t *testing.T) {
+	l := newTestRateLimits(1, 60000)
+	l.enabled = false
+	alice := &authtypes.Device{UserID: "@alice:localhost"}
+
+	for i := 0; i < 3; i++ {
+		if res := l.Limit(alice); res != nil {
+			t.Fatalf("request %d was limited with rate limiting disabled", i+1)
+		}
+	}
+}
+
+func TestRateLimitsAppServiceExemption(t *testing.T) {
+	l := newTestRateLimits(1, 60000,
+		config.ApplicationService{ID: "exempt", RateLimited: false},
+		config.ApplicationService{ID: "limited", RateLimited: true},
+	)
+	tests := []struct {
+		name        string
+		device      *authtypes.Device
+		wantLimited bool
+	}{
+		{"exempt appservice", &authtypes.Device{UserID: "@bridge:localhost", AppServiceID: "exempt"}, false},
+		{"rate limited appservice", &authtypes.Device{UserID: "@bot:localhost", AppServiceID: "limited"}, true},
+		{"unknown appservice", &authtypes.Device{UserID: "@ghost:localhost", AppServiceID: "unknown"}, true},
+		{"regular user", &authtypes.Device{UserID: "@alice:localhost"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if res := l.Limit(tt.device); res != nil {
+				t.Fatalf("first request was limited, want it to proceed")
+			}
+			res := l.Limit(tt.device)
+			if limited := res != nil; limited != tt.wantLimited {
+				t.Fatalf("second request limited = %v, want %v", limited, tt.wantLimited)
+			}
+		})
+	}
+}
@@ -14,9 +14,11 @@ package producers
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
 	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -52,3 +54,104 @@ func (p *EDUServerProducer) SendTyping(
 
 	return err
 }
+
+// SendReceipt sends a read receipt event to the EDU server.
+func (p *EDUServerProducer) SendReceipt(
+	ctx context.Context, userID, roomID, eventID, receiptType string,
+	timestamp gomatrixserverlib.Timestamp,
+) error {
+	requestData := api.InputReceiptEvent{
+		UserID:    userID,
+		RoomID:    roomID,
+		EventID:   eventID,
+		Type:      receiptType,
+		Timestamp: timestamp,
+	}
+
+	var response api.InputReceiptEventResponse
+	err := p.InputAPI.InputReceiptEvent(
+		ctx, &api.InputReceiptEventRequest{InputReceiptEvent: requestData}, &response,
+	)
+
+	return err
+}
+
+// SendPresence sends an explicit presence update for a local user to the
+// EDU server.
+func (p *EDUServerProducer) SendPresence(
+	ctx context.Context, userID, presence string, statusMsg *string,
+) error {
+	requestData := api.InputPresenceEvent{
+		UserID:    userID,
+		Presence:  presence,
+		StatusMsg: statusMsg,
+	}
+
+	var response api.InputPresenceEventResponse
+	err := p.InputAPI.InputPresenceEvent(
+		ctx, &api.InputPresenceEventRequest{InputPresenceEvent: requestData}, &response,
+	)
+
+	return err
+}
+
+// SendActivity tells the EDU server that a local user has done something,
+// such as sending an event, which keeps them from going idle.
+func (p *EDUServerProducer) SendActivity(ctx context.Context, userID string) error {
+	requestData := api.InputPresenceEvent{
+		UserID:       userID,
+		Presence:     cache.PresenceOnline,
+		FromActivity: true,
+	}
+
+	var response api.InputPresenceEventResponse
+	err := p.InputAPI.InputPresenceEvent(
+		ctx, &api.InputPresenceEventRequest{InputPresenceEvent: requestData}, &response,
+	)
+
+	return err
+}
+
+// SendRemotePresence sends a presence update received from a remote server
+// to the EDU server.
+func (p *EDUServerProducer) SendRemotePresence(
+	ctx context.Context, userID, presence string, statusMsg *string,
+	lastActiveAgo int64, currentlyActive bool,
+) error {
+	requestData := api.InputPresenceEvent{
+		UserID:          userID,
+		Presence:        presence,
+		StatusMsg:       statusMsg,
+		LastActiveAgo:   lastActiveAgo,
+		CurrentlyActive: currentlyActive,
+	}
+
+	var response api.InputPresenceEventResponse
+	err := p.InputAPI.InputPresenceEvent(
+		ctx, &api.InputPresenceEventRequest{InputPresenceEvent: requestData}, &response,
+	)
+
+	return err
+}
+
+// SendToDevice sends a send-to-device message to the EDU server. The
+// deviceID may be "*" to send the message to all of the user's devices.
+func (p *EDUServerProducer) SendToDevice(
+	ctx context.Context, sender, userID, deviceID, eventType string,
+	content json.RawMessage,
+) error {
+	requestData := api.InputSendToDeviceEvent{
+		UserID:   userID,
+		DeviceID: deviceID,
+		Sender:   sender,
+		Type:     eventType,
+		Content:  content,
+	}
+
+	var response api.InputSendToDeviceEventResponse
+	err := p.InputAPI.InputSendToDeviceEvent(
+		ctx, &api.InputSendToDeviceEventRequest{InputSendToDeviceEvent: requestData}, &response,
+	)
+
+	return err
+}
@@ -0,0 +1,467 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// The number of users or rooms returned by the admin list endpoints if the
+// request doesn't give a limit.
+const defaultAdminListLimit = 100
+
+type adminUser struct {
+	UserID        string `json:"user_id"`
+	IsGuest       bool   `json:"is_guest"`
+	IsAdmin       bool   `json:"admin"`
+	IsDeactivated bool   `json:"deactivated"`
+	AppServiceID  string `json:"appservice_id,omitempty"`
+}
+
+type adminUserDevice struct {
+	DeviceID    string `json:"device_id"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+type adminUserDetails struct {
+	adminUser
+	DisplayName string            `json:"displayname,omitempty"`
+	AvatarURL   string            `json:"avatar_url,omitempty"`
+	Devices     []adminUserDevice `json:"devices"`
+}
+
+type adminUsersResponse struct {
+	Users []adminUser `json:"users"`
+	// The from parameter to pass to get the next page, if there may be one.
+	NextFrom string `json:"next_from,omitempty"`
+}
+
+type adminRoomsResponse struct {
+	Rooms []roomserverAPI.RoomSummary `json:"rooms"`
+	// The from parameter to pass to get the next page, if there may be one.
+	NextFrom string `json:"next_from,omitempty"`
+}
+
+type adminSetAdminRequest struct {
+	Admin bool `json:"admin"`
+}
+
+type adminResetPasswordRequest struct {
+	NewPassword string `json:"new_password"`
+	// Whether to log out all of the user's devices. Defaults to true.
+	LogoutDevices *bool `json:"logout_devices"`
+}
+
+type adminEvictRequest struct {
+	UserIDs []string `json:"user_ids"`
+}
+
+type adminEvictResponse struct {
+	Evicted []string `json:"evicted"`
+}
+
+type adminAppServicesResponse struct {
+	// The IDs of the application services which are registered.
+	AppServices []string `json:"appservices"`
+}
+
+// checkAdmin returns an error response if the device doesn't belong to an
+// admin account.
+func checkAdmin(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+) *util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	account, err := accountDB.GetAccountByLocalpart(req.Context(), localpart)
+	if err == sql.ErrNoRows {
+		// Users without an account, e.g. application service users, can't
+		// be server admins.
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not a server admin"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if !account.IsAdmin || account.IsDeactivated {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not a server admin"),
+		}
+	}
+	return nil
+}
+
+// makeAdminAPI wraps an admin API handler, so that it can only be used by the
+// devices of admin accounts.
+func makeAdminAPI(
+	metricsName string, authData auth.Data, accountDB accounts.Database,
+	f func(*http.Request, *authtypes.Device) util.JSONResponse,
+) http.Handler {
+	return internal.MakeAuthAPI(metricsName, authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		if resErr := checkAdmin(req, accountDB, device); resErr != nil {
+			return *resErr
+		}
+		return f(req, device)
+	})
+}
+
+// parseAdminListParams parses the from and limit query parameters of the
+// admin list endpoints.
+func parseAdminListParams(req *http.Request) (from string, limit int, resErr *util.JSONResponse) {
+	from = req.URL.Query().Get("from")
+	limit = defaultAdminListLimit
+	if l := req.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			return "", 0, &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a positive integer"),
+			}
+		}
+	}
+	return from, limit, nil
+}
+
+// lookupAdminTarget returns the account of the local user targeted by an admin
+// request.
+func lookupAdminTarget(
+	req *http.Request, cfg *config.Dendrite, accountDB accounts.Database, userID string,
+) (*authtypes.Account, *util.JSONResponse) {
+	localpart, err := userutil.ParseUsernameParam(userID, &cfg.Matrix.ServerName)
+	if err != nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	account, err := accountDB.GetAccountByLocalpart(req.Context(), localpart)
+	if err == sql.ErrNoRows {
+		return nil, &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("User not found"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return account, nil
+}
+
+func adminUserFromAccount(account *authtypes.Account) adminUser {
+	return adminUser{
+		UserID:        account.UserID,
+		IsGuest:       account.IsGuest,
+		IsAdmin:       account.IsAdmin,
+		IsDeactivated: account.IsDeactivated,
+		AppServiceID:  account.AppServiceID,
+	}
+}
+
+// AdminListUsers implements GET /_dendrite/admin/users
+func AdminListUsers(
+	req *http.Request, accountDB accounts.Database,
+) util.JSONResponse {
+	from, limit, resErr := parseAdminListParams(req)
+	if resErr != nil {
+		return *resErr
+	}
+	// The from parameter may be given as a user ID or as a localpart.
+	from, err := userutil.ParseUsernameParam(from, nil)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	accs, err := accountDB.GetAccounts(req.Context(), from, limit)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccounts failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminUsersResponse{Users: make([]adminUser, 0, len(accs))}
+	for i := range accs {
+		res.Users = append(res.Users, adminUserFromAccount(&accs[i]))
+	}
+	if len(accs) == limit {
+		res.NextFrom = accs[len(accs)-1].Localpart
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminGetUser implements GET /_dendrite/admin/users/{userID}
+func AdminGetUser(
+	req *http.Request, cfg *config.Dendrite,
+	accountDB accounts.Database, deviceDB devices.Database, userID string,
+) util.JSONResponse {
+	account, resErr := lookupAdminTarget(req, cfg, accountDB, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	res := adminUserDetails{
+		adminUser: adminUserFromAccount(account),
+		Devices:   []adminUserDevice{},
+	}
+	profile, err := accountDB.GetProfileByLocalpart(req.Context(), account.Localpart)
+	if err == nil {
+		res.DisplayName = profile.DisplayName
+		res.AvatarURL = profile.AvatarURL
+	} else if err != sql.ErrNoRows {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetProfileByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	devs, err := deviceDB.GetDevicesByLocalpart(req.Context(), account.Localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetDevicesByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	for _, dev := range devs {
+		res.Devices = append(res.Devices, adminUserDevice{
+			DeviceID:    dev.ID,
+			DisplayName: dev.DisplayName,
+		})
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminSetAdmin implements PUT /_dendrite/admin/users/{userID}/admin
+func AdminSetAdmin(
+	req *http.Request, cfg *config.Dendrite, accountDB accounts.Database, userID string,
+) util.JSONResponse {
+	var r adminSetAdminRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	account, resErr := lookupAdminTarget(req, cfg, accountDB, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	if account.IsDeactivated && r.Admin {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Deactivated users can't be made admins"),
+		}
+	}
+	if err := accountDB.SetAdmin(req.Context(), account.Localpart, r.Admin); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetAdmin failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminDeactivateUser implements POST /_dendrite/admin/users/{userID}/deactivate
+func AdminDeactivateUser(
+	req *http.Request, cfg *config.Dendrite,
+	accountDB accounts.Database, deviceDB devices.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI, keyAPI keyserverAPI.KeyInternalAPI,
+	userID string,
+) util.JSONResponse {
+	account, resErr := lookupAdminTarget(req, cfg, accountDB, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	if resErr = deactivateAccount(req, accountDB, deviceDB, rsAPI, keyAPI, account); resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminResetPassword implements POST /_dendrite/admin/users/{userID}/password
+func AdminResetPassword(
+	req *http.Request, cfg *config.Dendrite,
+	accountDB accounts.Database, deviceDB devices.Database,
+	keyAPI keyserverAPI.KeyInternalAPI, userID string,
+) util.JSONResponse {
+	var r adminResetPasswordRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.NewPassword == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("new_password is required"),
+		}
+	}
+	if resErr := validatePassword(r.NewPassword); resErr != nil {
+		return *resErr
+	}
+	account, resErr := lookupAdminTarget(req, cfg, accountDB, userID)
+	if resErr != nil {
+		return *resErr
+	}
+	err := accountDB.SetPassword(req.Context(), account.Localpart, r.NewPassword)
+	if err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("The user has been deactivated"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetPassword failed")
+		return jsonerror.InternalServerError()
+	}
+	if r.LogoutDevices == nil || *r.LogoutDevices {
+		if resErr = removeAllDevices(req, deviceDB, accountDB, keyAPI, account.UserID, account.Localpart); resErr != nil {
+			return *resErr
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// AdminListRooms implements GET /_dendrite/admin/rooms
+func AdminListRooms(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI,
+) util.JSONResponse {
+	from, limit, resErr := parseAdminListParams(req)
+	if resErr != nil {
+		return *resErr
+	}
+	roomsReq := roomserverAPI.QueryRoomsRequest{
+		From:  from,
+		Limit: limit,
+	}
+	roomsRes := roomserverAPI.QueryRoomsResponse{}
+	if err := rsAPI.QueryRooms(req.Context(), &roomsReq, &roomsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryRooms failed")
+		return jsonerror.InternalServerError()
+	}
+	res := adminRoomsResponse{Rooms: roomsRes.Rooms}
+	if res.Rooms == nil {
+		res.Rooms = []roomserverAPI.RoomSummary{}
+	}
+	if len(res.Rooms) == limit {
+		res.NextFrom = res.Rooms[len(res.Rooms)-1].RoomID
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// AdminPurgeRoom implements POST /_dendrite/admin/rooms/{roomID}/purge
+func AdminPurgeRoom(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, roomID string,
+) util.JSONResponse {
+	purgeReq := roomserverAPI.PerformAdminPurgeRoomRequest{RoomID: roomID}
+	purgeRes := roomserverAPI.PerformAdminPurgeRoomResponse{}
+	if err := rsAPI.PerformAdminPurgeRoom(req.Context(), &purgeReq, &purgeRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformAdminPurgeRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if purgeRes.Error != nil {
+		return adminPerformErrorResponse(purgeRes.Error)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminEvictResponse{Evicted: purgeRes.Evicted},
+	}
+}
+
+// AdminEvictUsers implements POST /_dendrite/admin/rooms/{roomID}/evict
+func AdminEvictUsers(
+	req *http.Request, rsAPI roomserverAPI.RoomserverInternalAPI, roomID string,
+) util.JSONResponse {
+	var r adminEvictRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	evictReq := roomserverAPI.PerformAdminEvictUsersRequest{
+		RoomID:  roomID,
+		UserIDs: r.UserIDs,
+	}
+	evictRes := roomserverAPI.PerformAdminEvictUsersResponse{}
+	if err := rsAPI.PerformAdminEvictUsers(req.Context(), &evictReq, &evictRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformAdminEvictUsers failed")
+		return jsonerror.InternalServerError()
+	}
+	if evictRes.Error != nil {
+		return adminPerformErrorResponse(evictRes.Error)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: adminEvictResponse{Evicted: evictRes.Affected},
+	}
+}
+
+// AdminReloadAppServices implements POST /_dendrite/admin/appservices/reload
+func AdminReloadAppServices(req *http.Request, cfg *config.Dendrite) util.JSONResponse {
+	if err := cfg.ReloadAppServices(); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Warn("cfg.ReloadAppServices failed")
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Unable to reload application services: " + err.Error()),
+		}
+	}
+	res := adminAppServicesResponse{AppServices: []string{}}
+	for _, appservice := range cfg.AppServices() {
+		res.AppServices = append(res.AppServices, appservice.ID)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+func adminPerformErrorResponse(perr *roomserverAPI.PerformError) util.JSONResponse {
+	switch perr.Code {
+	case roomserverAPI.PerformErrorNoRoom:
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound(perr.Msg),
+		}
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown(perr.Msg),
+		}
+	}
+}
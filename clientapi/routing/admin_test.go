@@ -0,0 +1,162 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts/sqlite3"
+	"github.com/matrix-org/dendrite/internal/config"
+)
+
+func mustCreateAccountDB(t *testing.T) (*sqlite3.Database, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-admin")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	db, err := sqlite3.NewDatabase("file:"+filepath.Join(dir, "accounts.db"), "localhost")
+	if err != nil {
+		t.Fatalf("failed to create account database: %s", err)
+	}
+	for _, localpart := range []string{"admin", "alice", "bob", "charlie"} {
+		if _, err = db.CreateAccount(context.Background(), localpart, "password", ""); err != nil {
+			t.Fatalf("CreateAccount returned %s", err)
+		}
+	}
+	if err = db.SetAdmin(context.Background(), "admin", true); err != nil {
+		t.Fatalf("SetAdmin returned %s", err)
+	}
+	return db, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestCheckAdmin(t *testing.T) {
+	db, cleanup := mustCreateAccountDB(t)
+	defer cleanup()
+
+	tests := []struct {
+		userID   string
+		wantCode int
+	}{
+		{"@admin:localhost", 0},
+		{"@alice:localhost", http.StatusForbidden},
+		// Application service users don't have accounts.
+		{"@_irc_bot:localhost", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		res := checkAdmin(req, db, &authtypes.Device{UserID: tt.userID})
+		switch {
+		case tt.wantCode == 0 && res != nil:
+			t.Errorf("checkAdmin(%s) returned %d, want nil", tt.userID, res.Code)
+		case tt.wantCode != 0 && (res == nil || res.Code != tt.wantCode):
+			t.Errorf("checkAdmin(%s) returned %+v, want %d", tt.userID, res, tt.wantCode)
+		}
+	}
+
+	// Deactivated admins lose their powers.
+	if err := db.DeactivateAccount(context.Background(), "admin"); err != nil {
+		t.Fatalf("DeactivateAccount returned %s", err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if res := checkAdmin(req, db, &authtypes.Device{UserID: "@admin:localhost"}); res == nil || res.Code != http.StatusForbidden {
+		t.Errorf("checkAdmin for deactivated admin returned %+v, want 403", res)
+	}
+}
+
+func TestAdminListUsers(t *testing.T) {
+	db, cleanup := mustCreateAccountDB(t)
+	defer cleanup()
+
+	var pages [][]string
+	from := ""
+	for {
+		req := httptest.NewRequest(http.MethodGet, "/?limit=3&from="+from, nil)
+		res := AdminListUsers(req, db)
+		if res.Code != http.StatusOK {
+			t.Fatalf("AdminListUsers returned %d: %+v", res.Code, res.JSON)
+		}
+		body := res.JSON.(adminUsersResponse)
+		var page []string
+		for _, user := range body.Users {
+			page = append(page, user.UserID)
+		}
+		pages = append(pages, page)
+		if body.NextFrom == "" {
+			break
+		}
+		from = body.NextFrom
+	}
+	want := [][]string{
+		{"@admin:localhost", "@alice:localhost", "@bob:localhost"},
+		{"@charlie:localhost"},
+	}
+	if !reflect.DeepEqual(pages, want) {
+		t.Fatalf("AdminListUsers returned pages %v, want %v", pages, want)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/?limit=0", nil)
+	if res := AdminListUsers(req, db); res.Code != http.StatusBadRequest {
+		t.Fatalf("AdminListUsers with limit=0 returned %d, want 400", res.Code)
+	}
+}
+
+func TestAdminSetAdmin(t *testing.T) {
+	db, cleanup := mustCreateAccountDB(t)
+	defer cleanup()
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+
+	tests := []struct {
+		userID    string
+		body      string
+		wantCode  int
+		wantAdmin bool
+	}{
+		{"@alice:localhost", `{"admin":true}`, http.StatusOK, true},
+		{"@alice:localhost", `{"admin":false}`, http.StatusOK, false},
+		{"@nobody:localhost", `{"admin":true}`, http.StatusNotFound, false},
+		{"@alice:remote.example.com", `{"admin":true}`, http.StatusBadRequest, false},
+		{"@bob:localhost", `{"admin":true}`, http.StatusBadRequest, false},
+	}
+	if err := db.DeactivateAccount(context.Background(), "bob"); err != nil {
+		t.Fatalf("DeactivateAccount returned %s", err)
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(tt.body))
+		if res := AdminSetAdmin(req, cfg, db, tt.userID); res.Code != tt.wantCode {
+			t.Errorf("AdminSetAdmin(%s, %s) returned %d, want %d", tt.userID, tt.body, res.Code, tt.wantCode)
+			continue
+		}
+		if tt.wantCode != http.StatusOK {
+			continue
+		}
+		account, err := db.GetAccountByLocalpart(context.Background(), "alice")
+		if err != nil {
+			t.Fatalf("GetAccountByLocalpart returned %s", err)
+		}
+		if account.IsAdmin != tt.wantAdmin {
+			t.Errorf("AdminSetAdmin(%s, %s) left is_admin %v, want %v", tt.userID, tt.body, account.IsAdmin, tt.wantAdmin)
+		}
+	}
+}
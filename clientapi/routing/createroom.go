@@ -60,9 +60,6 @@ const (
 
 const (
 	historyVisibilityShared = "shared"
-	// TODO: These should be implemented once history visibility is implemented
-	// historyVisibilityWorldReadable = "world_readable"
-	// historyVisibilityInvited       = "invited"
 )
 
 func (r createRoomRequest) Validate() *util.JSONResponse {
@@ -162,13 +159,12 @@ func createRoom(
 	if resErr != nil {
 		return *resErr
 	}
-	// TODO: apply rate-limit
 
 	if resErr = r.Validate(); resErr != nil {
 		return *resErr
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, device)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -0,0 +1,169 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type deactivateRequest struct {
+	Auth passwordAuthDict `json:"auth"`
+	// The identity server to unbind the user's 3PIDs from. It is ignored,
+	// as identity servers aren't asked to unbind 3PIDs.
+	IDServer string `json:"id_server"`
+}
+
+type deactivateResponse struct {
+	// Either "success" or "no-support". 3PIDs are only forgotten locally,
+	// so this is always "no-support".
+	IDServerUnbindResult string `json:"id_server_unbind_result"`
+}
+
+// Deactivate implements POST /account/deactivate
+func Deactivate(
+	req *http.Request, cfg *config.Dendrite,
+	accountDB accounts.Database, deviceDB devices.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI, keyAPI keyserverAPI.KeyInternalAPI,
+	device *authtypes.Device,
+) util.JSONResponse {
+	var r deactivateRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if resErr := checkPasswordAuth(req, cfg, accountDB, device, &r.Auth); resErr != nil {
+		return *resErr
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	account, err := accountDB.GetAccountByLocalpart(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	if resErr := deactivateAccount(req, accountDB, deviceDB, rsAPI, keyAPI, account); resErr != nil {
+		return *resErr
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: deactivateResponse{IDServerUnbindResult: "no-support"},
+	}
+}
+
+// deactivateAccount deactivates an account, logs out all of its devices,
+// forgets its 3PIDs, makes it leave all of the rooms that it's joined to and
+// then blanks its profile. The account itself is kept, so that its localpart
+// can't be registered again.
+func deactivateAccount(
+	req *http.Request,
+	accountDB accounts.Database, deviceDB devices.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI, keyAPI keyserverAPI.KeyInternalAPI,
+	account *authtypes.Account,
+) *util.JSONResponse {
+	ctx := req.Context()
+	if err := accountDB.DeactivateAccount(ctx, account.Localpart); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.DeactivateAccount failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if resErr := removeAllDevices(req, deviceDB, accountDB, keyAPI, account.UserID, account.Localpart); resErr != nil {
+		return resErr
+	}
+	pushers, err := accountDB.GetPushersByLocalpart(ctx, account.Localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetPushersByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	for _, pusher := range pushers {
+		if err = accountDB.RemovePusher(ctx, pusher.AppID, pusher.PushKey, account.Localpart); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.RemovePusher failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+	}
+	threepids, err := accountDB.GetThreePIDsForLocalpart(ctx, account.Localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.GetThreePIDsForLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	for _, threepid := range threepids {
+		if err = accountDB.RemoveThreePIDAssociation(ctx, threepid.Address, threepid.Medium); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.RemoveThreePIDAssociation failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+	}
+
+	// Leave the rooms before blanking the profile, so that the rooms don't
+	// get a pointless profile change for the user.
+	leaveAllRooms(ctx, rsAPI, account.UserID)
+
+	if err = accountDB.SetDisplayName(ctx, account.Localpart, ""); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.SetDisplayName failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if err = accountDB.SetAvatarURL(ctx, account.Localpart, ""); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.SetAvatarURL failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
+
+// leaveAllRooms makes the user leave all of the rooms that they're joined to.
+// Failures are logged rather than returned, so that one broken room doesn't
+// stop the user from leaving the others.
+func leaveAllRooms(
+	ctx context.Context, rsAPI roomserverAPI.RoomserverInternalAPI, userID string,
+) {
+	roomsReq := roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         userID,
+		WantMembership: gomatrixserverlib.Join,
+	}
+	roomsRes := roomserverAPI.QueryRoomsForUserResponse{}
+	if err := rsAPI.QueryRoomsForUser(ctx, &roomsReq, &roomsRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryRoomsForUser failed")
+		return
+	}
+	for _, roomID := range roomsRes.RoomIDs {
+		leaveReq := roomserverAPI.PerformLeaveRequest{
+			RoomID: roomID,
+			UserID: userID,
+		}
+		leaveRes := roomserverAPI.PerformLeaveResponse{}
+		if err := rsAPI.PerformLeave(ctx, &leaveReq, &leaveRes); err != nil {
+			util.GetLogger(ctx).WithError(err).WithField("room_id", roomID).Error("rsAPI.PerformLeave failed")
+		}
+	}
+}
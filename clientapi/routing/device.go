@@ -20,8 +20,10 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
@@ -110,8 +112,8 @@ func GetDevicesByLocalpart(
 
 // UpdateDeviceByID handles PUT on /devices/{deviceID}
 func UpdateDeviceByID(
-	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
-	deviceID string,
+	req *http.Request, deviceDB devices.Database, keyAPI keyserverAPI.KeyInternalAPI,
+	device *authtypes.Device, deviceID string,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -152,6 +154,30 @@ func UpdateDeviceByID(
 		return jsonerror.InternalServerError()
 	}
 
+	// The display name is part of the device list that remote servers see,
+	// so let the key server know that it has changed.
+	if payload.DisplayName != nil {
+		var uploadRes keyserverAPI.PerformUploadKeysResponse
+		err = keyAPI.PerformUploadKeys(ctx, &keyserverAPI.PerformUploadKeysRequest{
+			DeviceKeys: []keyserverAPI.DeviceKeys{
+				{
+					UserID:      device.UserID,
+					DeviceID:    deviceID,
+					DisplayName: *payload.DisplayName,
+				},
+			},
+			OnlyDisplayNameUpdates: true,
+		}, &uploadRes)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("keyAPI.PerformUploadKeys failed")
+			return jsonerror.InternalServerError()
+		}
+		if uploadRes.Error != nil {
+			util.GetLogger(req.Context()).WithError(uploadRes.Error).Error("keyAPI.PerformUploadKeys failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
@@ -160,8 +186,8 @@ func UpdateDeviceByID(
 
 // DeleteDeviceById handles DELETE requests to /devices/{deviceId}
 func DeleteDeviceById(
-	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
-	deviceID string,
+	req *http.Request, deviceDB devices.Database, accountDB accounts.Database, keyAPI keyserverAPI.KeyInternalAPI,
+	device *authtypes.Device, deviceID string,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -177,6 +203,15 @@ func DeleteDeviceById(
 		return jsonerror.InternalServerError()
 	}
 
+	if err := accountDB.RemovePushersByDevice(ctx, localpart, deviceID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemovePushersByDevice failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if resErr := deleteDeviceKeys(req, keyAPI, device.UserID, []string{deviceID}); resErr != nil {
+		return *resErr
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
@@ -185,7 +220,8 @@ func DeleteDeviceById(
 
 // DeleteDevices handles POST requests to /delete_devices
 func DeleteDevices(
-	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
+	req *http.Request, deviceDB devices.Database, accountDB accounts.Database, keyAPI keyserverAPI.KeyInternalAPI,
+	device *authtypes.Device,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -208,8 +244,40 @@ func DeleteDevices(
 		return jsonerror.InternalServerError()
 	}
 
+	for _, deviceID := range payload.Devices {
+		if err := accountDB.RemovePushersByDevice(ctx, localpart, deviceID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemovePushersByDevice failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	if resErr := deleteDeviceKeys(req, keyAPI, device.UserID, payload.Devices); resErr != nil {
+		return *resErr
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
 	}
 }
+
+// deleteDeviceKeys removes the keys for devices which have been deleted,
+// so that other users stop encrypting for them.
+func deleteDeviceKeys(
+	req *http.Request, keyAPI keyserverAPI.KeyInternalAPI, userID string, deviceIDs []string,
+) *util.JSONResponse {
+	var res keyserverAPI.PerformDeleteKeysResponse
+	err := keyAPI.PerformDeleteKeys(req.Context(), &keyserverAPI.PerformDeleteKeysRequest{
+		UserID:    userID,
+		DeviceIDs: deviceIDs,
+	}, &res)
+	if err == nil && res.Error != nil {
+		err = res.Error
+	}
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyAPI.PerformDeleteKeys failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
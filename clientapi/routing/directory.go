@@ -137,7 +137,7 @@ func SetLocalAlias(
 	// TODO: This code should eventually be refactored with:
 	// 1. The new method for checking for things matching an AS's namespace
 	// 2. Using an overall Regex object for all AS's just like we did for usernames
-	for _, appservice := range cfg.Derived.ApplicationServices {
+	for _, appservice := range cfg.AppServices() {
 		// Don't prevent AS from creating aliases in its own namespace
 		// Note that Dendrite uses SenderLocalpart as UserID for AS users
 		if device.UserID != appservice.SenderLocalpart {
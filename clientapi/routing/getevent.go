@@ -79,46 +79,27 @@ func GetEvent(
 		requestedEvent: requestedEvent,
 	}
 
-	stateReq := api.QueryStateAfterEventsRequest{
-		RoomID:       r.requestedEvent.RoomID(),
-		PrevEventIDs: r.requestedEvent.PrevEventIDs(),
-		StateToFetch: []gomatrixserverlib.StateKeyTuple{{
-			EventType: gomatrixserverlib.MRoomMember,
-			StateKey:  device.UserID,
-		}},
-	}
-	var stateResp api.QueryStateAfterEventsResponse
-	if err := rsAPI.QueryStateAfterEvents(req.Context(), &stateReq, &stateResp); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("queryAPI.QueryStateAfterEvents failed")
-		return jsonerror.InternalServerError()
-	}
-
-	if !stateResp.RoomExists {
-		util.GetLogger(req.Context()).Errorf("Expected to find room for event %s but failed", r.requestedEvent.EventID())
-		return jsonerror.InternalServerError()
-	}
-
-	if !stateResp.PrevEventsExist {
-		// Missing some events locally; stateResp.StateEvents unavailable.
+	if r.requestedEvent.RoomID() != roomID {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
 		}
 	}
 
-	for _, stateEvent := range stateResp.StateEvents {
-		if stateEvent.StateKeyEquals(r.device.UserID) {
-			membership, err := stateEvent.Membership()
-			if err != nil {
-				util.GetLogger(req.Context()).WithError(err).Error("stateEvent.Membership failed")
-				return jsonerror.InternalServerError()
-			}
-			if membership == gomatrixserverlib.Join {
-				return util.JSONResponse{
-					Code: http.StatusOK,
-					JSON: gomatrixserverlib.ToClientEvent(r.requestedEvent, gomatrixserverlib.FormatAll),
-				}
-			}
+	// Check that the history visibility of the room allows the user to see the event.
+	var allowedRes api.QueryUserAllowedToSeeEventsResponse
+	if err := rsAPI.QueryUserAllowedToSeeEvents(req.Context(), &api.QueryUserAllowedToSeeEventsRequest{
+		EventIDs: []string{eventID},
+		UserID:   device.UserID,
+	}, &allowedRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryUserAllowedToSeeEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if allowedRes.AllowedToSeeEvents[eventID] {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: gomatrixserverlib.ToClientEvent(r.requestedEvent, gomatrixserverlib.FormatAll),
 		}
 	}
 
@@ -37,6 +37,7 @@ func JoinRoomByIDOrAlias(
 	joinReq := roomserverAPI.PerformJoinRequest{
 		RoomIDOrAlias: roomIDOrAlias,
 		UserID:        device.UserID,
+		IsGuest:       device.IsGuest,
 	}
 	joinRes := roomserverAPI.PerformJoinResponse{}
 
@@ -69,6 +70,18 @@ func JoinRoomByIDOrAlias(
 			JSON: jsonerror.Unknown(err.Error()),
 		}
 	}
+	if joinRes.Error != nil {
+		if joinRes.Error.Code == roomserverAPI.PerformErrorGuestAccessForbidden {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.GuestAccessForbidden(joinRes.Error.Msg),
+			}
+		}
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown(joinRes.Error.Msg),
+		}
+	}
 
 	return util.JSONResponse{
 		Code: http.StatusOK,
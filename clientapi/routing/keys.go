@@ -0,0 +1,175 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type uploadKeysRequest struct {
+	DeviceKeys  json.RawMessage            `json:"device_keys"`
+	OneTimeKeys map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+// UploadKeys implements POST /keys/upload
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-keys-upload
+func UploadKeys(
+	req *http.Request, keyAPI api.KeyInternalAPI, deviceDB devices.Database, device *authtypes.Device,
+) util.JSONResponse {
+	var r uploadKeysRequest
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+
+	uploadReq := &api.PerformUploadKeysRequest{}
+	if r.DeviceKeys != nil {
+		// The display name is sent to remote servers along with the keys,
+		// so look up the current one for this device.
+		localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			return jsonerror.InternalServerError()
+		}
+		dev, err := deviceDB.GetDeviceByID(req.Context(), localpart, device.ID)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetDeviceByID failed")
+			return jsonerror.InternalServerError()
+		}
+		uploadReq.DeviceKeys = []api.DeviceKeys{
+			{
+				DeviceID:    device.ID,
+				UserID:      device.UserID,
+				KeyJSON:     r.DeviceKeys,
+				DisplayName: dev.DisplayName,
+			},
+		}
+	}
+	if r.OneTimeKeys != nil {
+		uploadReq.OneTimeKeys = []api.OneTimeKeys{
+			{
+				DeviceID: device.ID,
+				UserID:   device.UserID,
+				KeyJSON:  r.OneTimeKeys,
+			},
+		}
+	}
+
+	var uploadRes api.PerformUploadKeysResponse
+	if err := keyAPI.PerformUploadKeys(req.Context(), uploadReq, &uploadRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyAPI.PerformUploadKeys failed")
+		return jsonerror.InternalServerError()
+	}
+	if uploadRes.Error != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(uploadRes.Error.Error()),
+		}
+	}
+
+	// The response only contains counts for the requesting device, so if no
+	// one-time keys were uploaded then look up the counts ourselves.
+	keyCount := make(map[string]int)
+	if len(uploadRes.OneTimeKeyCounts) > 0 {
+		keyCount = uploadRes.OneTimeKeyCounts[0].KeyCount
+	} else {
+		var queryRes api.QueryOneTimeKeysResponse
+		if err := keyAPI.QueryOneTimeKeys(req.Context(), &api.QueryOneTimeKeysRequest{
+			UserID:   device.UserID,
+			DeviceID: device.ID,
+		}, &queryRes); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("keyAPI.QueryOneTimeKeys failed")
+			return jsonerror.InternalServerError()
+		}
+		keyCount = queryRes.Count.KeyCount
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct {
+			OTKCounts interface{} `json:"one_time_key_counts"`
+		}{keyCount},
+	}
+}
+
+type queryKeysRequest struct {
+	Timeout    int                 `json:"timeout"`
+	Token      string              `json:"token"`
+	DeviceKeys map[string][]string `json:"device_keys"`
+}
+
+// QueryKeys implements POST /keys/query
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-keys-query
+func QueryKeys(req *http.Request, keyAPI api.KeyInternalAPI) util.JSONResponse {
+	var r queryKeysRequest
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+	queryRes := api.QueryKeysResponse{}
+	if err := keyAPI.QueryKeys(req.Context(), &api.QueryKeysRequest{
+		UserToDevices: r.DeviceKeys,
+		TimeoutMS:     int64(r.Timeout),
+	}, &queryRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyAPI.QueryKeys failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"device_keys": queryRes.DeviceKeys,
+			"failures":    queryRes.Failures,
+		},
+	}
+}
+
+type claimKeysRequest struct {
+	Timeout int `json:"timeout"`
+	// The keys to be claimed. A map from user ID, to a map from device ID to algorithm name.
+	OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+}
+
+// ClaimKeys implements POST /keys/claim
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-keys-claim
+func ClaimKeys(req *http.Request, keyAPI api.KeyInternalAPI) util.JSONResponse {
+	var r claimKeysRequest
+	resErr := httputil.UnmarshalJSONRequest(req, &r)
+	if resErr != nil {
+		return *resErr
+	}
+	claimRes := api.PerformClaimKeysResponse{}
+	if err := keyAPI.PerformClaimKeys(req.Context(), &api.PerformClaimKeysRequest{
+		OneTimeKeys: r.OneTimeKeys,
+		TimeoutMS:   int64(r.Timeout),
+	}, &claimRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyAPI.PerformClaimKeys failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"one_time_keys": claimRes.OneTimeKeys,
+			"failures":      claimRes.Failures,
+		},
+	}
+}
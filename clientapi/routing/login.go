@@ -15,17 +15,18 @@
 package routing
 
 import (
-	"net/http"
-
 	"context"
+	"html/template"
+	"net/http"
+	"net/url"
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/login"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
-	"github.com/matrix-org/dendrite/clientapi/userutil"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -36,22 +37,8 @@ type loginFlows struct {
 }
 
 type flow struct {
-	Type   string   `json:"type"`
-	Stages []string `json:"stages"`
-}
-
-type loginIdentifier struct {
-	Type string `json:"type"`
-	User string `json:"user"`
-}
-
-type passwordRequest struct {
-	Identifier loginIdentifier `json:"identifier"`
-	Password   string          `json:"password"`
-	// Both DeviceID and InitialDisplayName can be omitted, or empty strings ("")
-	// Thus a pointer is needed to differentiate between the two
-	InitialDisplayName *string `json:"initial_device_display_name"`
-	DeviceID           *string `json:"device_id"`
+	Type   authtypes.LoginType   `json:"type"`
+	Stages []authtypes.LoginType `json:"stages"`
 }
 
 type loginResponse struct {
@@ -61,62 +48,56 @@ type loginResponse struct {
 	DeviceID    string                       `json:"device_id"`
 }
 
-func passwordLogin() loginFlows {
+func supportedLoginFlows(providers *login.Providers) loginFlows {
 	f := loginFlows{}
-	s := flow{"m.login.password", []string{"m.login.password"}}
-	f.Flows = append(f.Flows, s)
+	for _, loginType := range providers.Flows() {
+		f.Flows = append(f.Flows, flow{loginType, []authtypes.LoginType{loginType}})
+	}
 	return f
 }
 
 // Login implements GET and POST /login
 func Login(
-	req *http.Request, accountDB accounts.Database, deviceDB devices.Database,
+	req *http.Request, providers *login.Providers,
+	accountDB accounts.Database, deviceDB devices.Database,
 	cfg *config.Dendrite,
 ) util.JSONResponse {
-	if req.Method == http.MethodGet { // TODO: support other forms of login other than password, depending on config options
+	if req.Method == http.MethodGet {
 		return util.JSONResponse{
 			Code: http.StatusOK,
-			JSON: passwordLogin(),
+			JSON: supportedLoginFlows(providers),
 		}
 	} else if req.Method == http.MethodPost {
-		var r passwordRequest
-		var acc *authtypes.Account
+		var r login.Request
 		resErr := httputil.UnmarshalJSONRequest(req, &r)
 		if resErr != nil {
 			return *resErr
 		}
-		switch r.Identifier.Type {
-		case "m.id.user":
-			if r.Identifier.User == "" {
-				return util.JSONResponse{
-					Code: http.StatusBadRequest,
-					JSON: jsonerror.BadJSON("'user' must be supplied."),
-				}
-			}
-
-			util.GetLogger(req.Context()).WithField("user", r.Identifier.User).Info("Processing login request")
-
-			localpart, err := userutil.ParseUsernameParam(r.Identifier.User, &cfg.Matrix.ServerName)
-			if err != nil {
-				return util.JSONResponse{
-					Code: http.StatusBadRequest,
-					JSON: jsonerror.InvalidUsername(err.Error()),
-				}
+		if r.Type == "" {
+			// Older clients only send an identifier with their password.
+			r.Type = authtypes.LoginTypePassword
+		}
+		provider := providers.Provider(r.Type)
+		if provider == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown("login type '" + string(r.Type) + "' not supported"),
 			}
+		}
+		localpart, resErr := provider.Login(req.Context(), &r)
+		if resErr != nil {
+			return *resErr
+		}
 
-			acc, err = accountDB.GetAccountByPassword(req.Context(), localpart, r.Password)
-			if err != nil {
-				// Technically we could tell them if the user does not exist by checking if err == sql.ErrNoRows
-				// but that would leak the existence of the user.
-				return util.JSONResponse{
-					Code: http.StatusForbidden,
-					JSON: jsonerror.Forbidden("username or password was incorrect, or the account does not exist"),
-				}
-			}
-		default:
+		acc, err := accountDB.GetAccountByLocalpart(req.Context(), localpart)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetAccountByLocalpart failed")
+			return jsonerror.InternalServerError()
+		}
+		if acc.IsDeactivated {
 			return util.JSONResponse{
-				Code: http.StatusBadRequest,
-				JSON: jsonerror.BadJSON("login identifier '" + r.Identifier.Type + "' not supported"),
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("This account has been deactivated"),
 			}
 		}
 
@@ -150,10 +131,94 @@ func Login(
 	}
 }
 
+// SSORedirect implements GET /login/sso/redirect
+func SSORedirect(req *http.Request, providers *login.Providers) util.JSONResponse {
+	if providers.SSO == nil {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("SSO login is not enabled"),
+		}
+	}
+	authURL, resErr := providers.SSO.AuthorizationURL(req.URL.Query().Get("redirectUrl"))
+	if resErr != nil {
+		return *resErr
+	}
+	return redirectResponse(authURL)
+}
+
+// ssoConfirmTemplate is an HTML template asking the user to confirm that they
+// want to log in to a client which isn't whitelisted, since anyone can start
+// the SSO flow with their own redirect URL.
+const ssoConfirmTemplate = `
+<html>
+<head>
+<title>Continue to your account</title>
+<meta name='viewport' content='width=device-width, initial-scale=1,
+    user-scalable=no, minimum-scale=1.0, maximum-scale=1.0'>
+</head>
+<body>
+    <div>
+        <p>You are about to log in to your account on {{.ServerName}} at:</p>
+        <p><code>{{.Client}}</code></p>
+        <p>If you didn't start this login, or don't recognise this address, close this window.</p>
+        <p><a href="{{.RedirectURL}}">Continue</a></p>
+    </div>
+</body>
+</html>
+`
+
+// SSOCallback implements GET /login/sso/callback, where the identity provider
+// sends the user back to once they have authenticated. Users are sent back to
+// whitelisted clients straight away, and asked to confirm the login otherwise.
+func SSOCallback(
+	w http.ResponseWriter, req *http.Request, providers *login.Providers, cfg *config.Dendrite,
+) *util.JSONResponse {
+	if providers.SSO == nil {
+		return &util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("SSO login is not enabled"),
+		}
+	}
+	query := req.URL.Query()
+	redirectURL, resErr := providers.SSO.Callback(req.Context(), query.Get("state"), query.Get("code"))
+	if resErr != nil {
+		return resErr
+	}
+	if providers.SSO.ClientWhitelisted(redirectURL) {
+		http.Redirect(w, req, redirectURL, http.StatusFound)
+		return nil
+	}
+
+	client := redirectURL
+	if u, err := url.Parse(redirectURL); err == nil {
+		client = u.Scheme + "://" + u.Host + u.Path
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	t := template.Must(template.New("sso_confirm").Parse(ssoConfirmTemplate))
+	if err := t.Execute(w, map[string]interface{}{
+		"ServerName": cfg.Matrix.ServerName,
+		"Client":     client,
+		// AuthorizationURL only accepts URLs with safe schemes, and clients
+		// may use their own schemes, so don't let the template filter them.
+		"RedirectURL": template.URL(redirectURL), // nolint: gosec
+	}); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("t.Execute failed")
+	}
+	return nil
+}
+
+func redirectResponse(location string) util.JSONResponse {
+	return util.JSONResponse{
+		Code:    http.StatusFound,
+		Headers: map[string]string{"Location": location},
+		JSON:    struct{}{},
+	}
+}
+
 // getDevice returns a new or existing device
 func getDevice(
 	ctx context.Context,
-	r passwordRequest,
+	r login.Request,
 	deviceDB devices.Database,
 	acc *authtypes.Account,
 	token string,
@@ -18,15 +18,18 @@ import (
 	"net/http"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 )
 
 // Logout handles POST /logout
 func Logout(
-	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
+	req *http.Request, deviceDB devices.Database, accountDB accounts.Database,
+	keyAPI keyserverAPI.KeyInternalAPI, device *authtypes.Device,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -39,6 +42,15 @@ func Logout(
 		return jsonerror.InternalServerError()
 	}
 
+	if err := accountDB.RemovePushersByDevice(req.Context(), localpart, device.ID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemovePushersByDevice failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if resErr := deleteDeviceKeys(req, keyAPI, device.UserID, []string{device.ID}); resErr != nil {
+		return *resErr
+	}
+
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: struct{}{},
@@ -47,7 +59,8 @@ func Logout(
 
 // LogoutAll handles POST /logout/all
 func LogoutAll(
-	req *http.Request, deviceDB devices.Database, device *authtypes.Device,
+	req *http.Request, deviceDB devices.Database, accountDB accounts.Database,
+	keyAPI keyserverAPI.KeyInternalAPI, device *authtypes.Device,
 ) util.JSONResponse {
 	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
 	if err != nil {
@@ -55,9 +68,8 @@ func LogoutAll(
 		return jsonerror.InternalServerError()
 	}
 
-	if err := deviceDB.RemoveAllDevices(req.Context(), localpart); err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveAllDevices failed")
-		return jsonerror.InternalServerError()
+	if resErr := removeAllDevices(req, deviceDB, accountDB, keyAPI, device.UserID, localpart); resErr != nil {
+		return *resErr
 	}
 
 	return util.JSONResponse{
@@ -65,3 +77,38 @@ func LogoutAll(
 		JSON: struct{}{},
 	}
 }
+
+// removeAllDevices logs out all of the devices of a user and deletes their keys
+// and pushers.
+func removeAllDevices(
+	req *http.Request, deviceDB devices.Database, accountDB accounts.Database,
+	keyAPI keyserverAPI.KeyInternalAPI, userID, localpart string,
+) *util.JSONResponse {
+	deviceList, err := deviceDB.GetDevicesByLocalpart(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetDevicesByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	if err := deviceDB.RemoveAllDevices(req.Context(), localpart); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.RemoveAllDevices failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	deviceIDs := make([]string, 0, len(deviceList))
+	for _, dev := range deviceList {
+		deviceIDs = append(deviceIDs, dev.ID)
+		if err := accountDB.RemovePushersByDevice(req.Context(), localpart, dev.ID); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemovePushersByDevice failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+	}
+	if resErr := deleteDeviceKeys(req, keyAPI, userID, deviceIDs); resErr != nil {
+		return resErr
+	}
+
+	return nil
+}
@@ -48,6 +48,18 @@ func SendMembership(
 	rsAPI roomserverAPI.RoomserverInternalAPI, asAPI appserviceAPI.AppServiceQueryAPI,
 	producer *producers.RoomserverProducer,
 ) util.JSONResponse {
+	// Guests may only join rooms, which goes through the roomserver so that
+	// the room's guest access is checked.
+	if device.IsGuest {
+		if membership != gomatrixserverlib.Join {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.GuestAccessForbidden("Guests can only join rooms"),
+			}
+		}
+		return JoinRoomByIDOrAlias(req, device, rsAPI, accountDB, roomID)
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := rsAPI.QueryRoomVersionForRoom(req.Context(), &verReq, &verRes); err != nil {
@@ -62,7 +74,7 @@ func SendMembership(
 		return *reqErr
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, device)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -0,0 +1,190 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/login"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/userutil"
+	"github.com/matrix-org/dendrite/internal/config"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// passwordAuthDict is the auth dictionary of a request which is authenticated
+// with the user's password through user-interactive auth.
+type passwordAuthDict struct {
+	Type       authtypes.LoginType `json:"type"`
+	Session    string              `json:"session"`
+	Identifier login.Identifier    `json:"identifier"`
+	// The user ID or localpart, if the client uses the deprecated form
+	// rather than an identifier.
+	User     string `json:"user"`
+	Password string `json:"password"`
+}
+
+type newPasswordRequest struct {
+	NewPassword string `json:"new_password"`
+	// Whether to log out the user's other devices. Defaults to true.
+	LogoutDevices *bool            `json:"logout_devices"`
+	Auth          passwordAuthDict `json:"auth"`
+}
+
+// checkPasswordAuth performs user-interactive auth with the m.login.password
+// stage for the user of the device. It returns nil once the user has supplied
+// the correct password, and otherwise the response to send to the client.
+func checkPasswordAuth(
+	req *http.Request, cfg *config.Dendrite, accountDB accounts.Database,
+	device *authtypes.Device, auth *passwordAuthDict,
+) *util.JSONResponse {
+	if auth.Type == "" {
+		// The client hasn't started the auth yet, so tell it what to do.
+		sessionID := auth.Session
+		if sessionID == "" {
+			sessionID = util.RandomString(sessionIDLength)
+		}
+		return &util.JSONResponse{
+			Code: http.StatusUnauthorized,
+			JSON: newUserInteractiveResponse(
+				sessionID,
+				[]authtypes.Flow{{Stages: []authtypes.LoginType{authtypes.LoginTypePassword}}},
+				nil,
+			),
+		}
+	}
+	if auth.Type != authtypes.LoginTypePassword {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Unknown auth.type: " + string(auth.Type)),
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	user := auth.Identifier.User
+	if user == "" {
+		user = auth.User
+	}
+	if user != "" {
+		authLocalpart, err := userutil.ParseUsernameParam(user, &cfg.Matrix.ServerName)
+		if err != nil || authLocalpart != localpart {
+			return &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You can only authenticate as yourself"),
+			}
+		}
+	}
+	if _, err = accountDB.GetAccountByPassword(req.Context(), localpart, auth.Password); err != nil {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Invalid password"),
+		}
+	}
+	return nil
+}
+
+// Password implements POST /account/password
+func Password(
+	req *http.Request, cfg *config.Dendrite,
+	accountDB accounts.Database, deviceDB devices.Database,
+	keyAPI keyserverAPI.KeyInternalAPI, device *authtypes.Device,
+) util.JSONResponse {
+	var r newPasswordRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if resErr := checkPasswordAuth(req, cfg, accountDB, device, &r.Auth); resErr != nil {
+		return *resErr
+	}
+	if r.NewPassword == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("new_password is required"),
+		}
+	}
+	if resErr := validatePassword(r.NewPassword); resErr != nil {
+		return *resErr
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = accountDB.SetPassword(req.Context(), localpart, r.NewPassword); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetPassword failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if r.LogoutDevices == nil || *r.LogoutDevices {
+		if resErr := removeOtherDevices(req, accountDB, deviceDB, keyAPI, device, localpart); resErr != nil {
+			return *resErr
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// removeOtherDevices logs out all of the user's devices apart from the given
+// one, removing their pushers and keys.
+func removeOtherDevices(
+	req *http.Request, accountDB accounts.Database, deviceDB devices.Database,
+	keyAPI keyserverAPI.KeyInternalAPI, device *authtypes.Device, localpart string,
+) *util.JSONResponse {
+	ctx := req.Context()
+	deviceList, err := deviceDB.GetDevicesByLocalpart(ctx, localpart)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("deviceDB.GetDevicesByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	deviceIDs := make([]string, 0, len(deviceList))
+	for _, dev := range deviceList {
+		if dev.ID != device.ID {
+			deviceIDs = append(deviceIDs, dev.ID)
+		}
+	}
+	if len(deviceIDs) == 0 {
+		return nil
+	}
+
+	if err = deviceDB.RemoveDevices(ctx, localpart, deviceIDs); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("deviceDB.RemoveDevices failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	for _, deviceID := range deviceIDs {
+		if err = accountDB.RemovePushersByDevice(ctx, localpart, deviceID); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("accountDB.RemovePushersByDevice failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+	}
+	return deleteDeviceKeys(req, keyAPI, device.UserID, deviceIDs)
+}
@@ -0,0 +1,345 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/login"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices/sqlite3"
+	"github.com/matrix-org/dendrite/internal/config"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+)
+
+// deleteKeysAPI records the devices whose keys are deleted.
+type deleteKeysAPI struct {
+	keyserverAPI.KeyInternalAPI
+	deletedDeviceIDs []string
+}
+
+func (a *deleteKeysAPI) PerformDeleteKeys(
+	ctx context.Context,
+	req *keyserverAPI.PerformDeleteKeysRequest,
+	res *keyserverAPI.PerformDeleteKeysResponse,
+) error {
+	a.deletedDeviceIDs = append(a.deletedDeviceIDs, req.DeviceIDs...)
+	return nil
+}
+
+// leaveRoomserverAPI has the user joined to some rooms and records which of
+// them they leave.
+type leaveRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	joinedRoomIDs []string
+	leftRoomIDs   []string
+}
+
+func (a *leaveRoomserverAPI) QueryRoomsForUser(
+	ctx context.Context,
+	req *roomserverAPI.QueryRoomsForUserRequest,
+	res *roomserverAPI.QueryRoomsForUserResponse,
+) error {
+	res.RoomIDs = a.joinedRoomIDs
+	return nil
+}
+
+func (a *leaveRoomserverAPI) PerformLeave(
+	ctx context.Context,
+	req *roomserverAPI.PerformLeaveRequest,
+	res *roomserverAPI.PerformLeaveResponse,
+) error {
+	a.leftRoomIDs = append(a.leftRoomIDs, req.RoomID)
+	return nil
+}
+
+func mustCreateDeviceDB(t *testing.T, localpart string, deviceIDs ...string) (*sqlite3.Database, func()) {
+	dir, err := ioutil.TempDir("", "dendrite-devices")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	db, err := sqlite3.NewDatabase("file:"+filepath.Join(dir, "devices.db"), "localhost")
+	if err != nil {
+		t.Fatalf("failed to create device database: %s", err)
+	}
+	for _, deviceID := range deviceIDs {
+		deviceID := deviceID
+		if _, err = db.CreateDevice(context.Background(), localpart, &deviceID, "token_"+deviceID, nil); err != nil {
+			t.Fatalf("CreateDevice returned %s", err)
+		}
+	}
+	return db, func() { _ = os.RemoveAll(dir) }
+}
+
+func mustMarshalJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("json.Marshal returned %s", err)
+	}
+	return string(b)
+}
+
+func TestCheckPasswordAuth(t *testing.T) {
+	db, cleanup := mustCreateAccountDB(t)
+	defer cleanup()
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	device := &authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"}
+
+	tests := []struct {
+		name     string
+		auth     passwordAuthDict
+		wantCode int
+	}{
+		{
+			name:     "no auth starts a session",
+			auth:     passwordAuthDict{},
+			wantCode: http.StatusUnauthorized,
+		},
+		{
+			name:     "unknown auth type",
+			auth:     passwordAuthDict{Type: authtypes.LoginTypeDummy},
+			wantCode: http.StatusBadRequest,
+		},
+		{
+			name:     "wrong password",
+			auth:     passwordAuthDict{Type: authtypes.LoginTypePassword, Password: "wrong"},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name: "someone else's identifier",
+			auth: passwordAuthDict{
+				Type:       authtypes.LoginTypePassword,
+				Identifier: login.Identifier{Type: "m.id.user", User: "@bob:localhost"},
+				Password:   "password",
+			},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name: "someone else's deprecated user",
+			auth: passwordAuthDict{
+				Type:     authtypes.LoginTypePassword,
+				User:     "bob",
+				Password: "password",
+			},
+			wantCode: http.StatusForbidden,
+		},
+		{
+			name: "own identifier",
+			auth: passwordAuthDict{
+				Type:       authtypes.LoginTypePassword,
+				Identifier: login.Identifier{Type: "m.id.user", User: "@alice:localhost"},
+				Password:   "password",
+			},
+		},
+		{
+			name: "own deprecated user",
+			auth: passwordAuthDict{
+				Type:     authtypes.LoginTypePassword,
+				User:     "alice",
+				Password: "password",
+			},
+		},
+		{
+			name: "no user",
+			auth: passwordAuthDict{Type: authtypes.LoginTypePassword, Password: "password"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			res := checkPasswordAuth(req, cfg, db, device, &tt.auth)
+			switch {
+			case tt.wantCode == 0 && res != nil:
+				t.Fatalf("checkPasswordAuth returned %d, want nil", res.Code)
+			case tt.wantCode != 0 && (res == nil || res.Code != tt.wantCode):
+				t.Fatalf("checkPasswordAuth returned %+v, want %d", res, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestCheckPasswordAuthFlows(t *testing.T) {
+	db, cleanup := mustCreateAccountDB(t)
+	defer cleanup()
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	device := &authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"}
+
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	res := checkPasswordAuth(req, cfg, db, device, &passwordAuthDict{Session: "abc"})
+	if res == nil || res.Code != http.StatusUnauthorized {
+		t.Fatalf("checkPasswordAuth returned %+v, want %d", res, http.StatusUnauthorized)
+	}
+	uia, ok := res.JSON.(userInteractiveResponse)
+	if !ok {
+		t.Fatalf("checkPasswordAuth returned %T, want a user-interactive response", res.JSON)
+	}
+	if uia.Session != "abc" {
+		t.Errorf("checkPasswordAuth returned session %q, want the client's session", uia.Session)
+	}
+	wantFlows := []authtypes.Flow{{Stages: []authtypes.LoginType{authtypes.LoginTypePassword}}}
+	if !reflect.DeepEqual(uia.Flows, wantFlows) {
+		t.Errorf("checkPasswordAuth returned flows %+v, want %+v", uia.Flows, wantFlows)
+	}
+}
+
+func TestPassword(t *testing.T) {
+	for _, logoutDevices := range []bool{false, true} {
+		accountDB, cleanupAccounts := mustCreateAccountDB(t)
+		defer cleanupAccounts()
+		deviceDB, cleanupDevices := mustCreateDeviceDB(t, "alice", "ALICE", "PHONE", "LAPTOP")
+		defer cleanupDevices()
+		keyAPI := &deleteKeysAPI{}
+		cfg := &config.Dendrite{}
+		cfg.Matrix.ServerName = "localhost"
+		device := &authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"}
+
+		body := mustMarshalJSON(t, map[string]interface{}{
+			"new_password":   "correct horse battery staple",
+			"logout_devices": logoutDevices,
+			"auth": map[string]interface{}{
+				"type":     authtypes.LoginTypePassword,
+				"user":     "alice",
+				"password": "password",
+			},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		res := Password(req, cfg, accountDB, deviceDB, keyAPI, device)
+		if res.Code != http.StatusOK {
+			t.Fatalf("Password returned %d: %+v", res.Code, res.JSON)
+		}
+
+		ctx := context.Background()
+		if _, err := accountDB.GetAccountByPassword(ctx, "alice", "password"); err == nil {
+			t.Errorf("old password still works after changing it")
+		}
+		if _, err := accountDB.GetAccountByPassword(ctx, "alice", "correct horse battery staple"); err != nil {
+			t.Errorf("new password doesn't work after changing it: %s", err)
+		}
+
+		remaining, err := deviceDB.GetDevicesByLocalpart(ctx, "alice")
+		if err != nil {
+			t.Fatalf("GetDevicesByLocalpart returned %s", err)
+		}
+		wantRemaining, wantDeleted := 3, []string(nil)
+		if logoutDevices {
+			wantRemaining, wantDeleted = 1, []string{"LAPTOP", "PHONE"}
+		}
+		if len(remaining) != wantRemaining {
+			t.Errorf("logout_devices=%v left %d devices, want %d", logoutDevices, len(remaining), wantRemaining)
+		}
+		if logoutDevices && remaining[0].ID != device.ID {
+			t.Errorf("logout_devices=%v removed the requesting device", logoutDevices)
+		}
+		sort.Strings(keyAPI.deletedDeviceIDs)
+		if !reflect.DeepEqual(keyAPI.deletedDeviceIDs, wantDeleted) {
+			t.Errorf("logout_devices=%v deleted keys for %v, want %v", logoutDevices, keyAPI.deletedDeviceIDs, wantDeleted)
+		}
+	}
+}
+
+func TestPasswordWrongPassword(t *testing.T) {
+	accountDB, cleanup := mustCreateAccountDB(t)
+	defer cleanup()
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	device := &authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"}
+
+	body := mustMarshalJSON(t, map[string]interface{}{
+		"new_password": "correct horse battery staple",
+		"auth": map[string]interface{}{
+			"type":     authtypes.LoginTypePassword,
+			"password": "wrong",
+		},
+	})
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	if res := Password(req, cfg, accountDB, nil, nil, device); res.Code != http.StatusForbidden {
+		t.Fatalf("Password returned %d, want %d", res.Code, http.StatusForbidden)
+	}
+	if _, err := accountDB.GetAccountByPassword(context.Background(), "alice", "password"); err != nil {
+		t.Fatalf("password was changed without the right password: %s", err)
+	}
+}
+
+func TestDeactivate(t *testing.T) {
+	accountDB, cleanupAccounts := mustCreateAccountDB(t)
+	defer cleanupAccounts()
+	deviceDB, cleanupDevices := mustCreateDeviceDB(t, "alice", "ALICE", "PHONE")
+	defer cleanupDevices()
+	keyAPI := &deleteKeysAPI{}
+	rsAPI := &leaveRoomserverAPI{joinedRoomIDs: []string{"!a:localhost", "!b:localhost"}}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	device := &authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"}
+	ctx := context.Background()
+
+	deactivate := func(password string) int {
+		body := mustMarshalJSON(t, map[string]interface{}{
+			"auth": map[string]interface{}{
+				"type":     authtypes.LoginTypePassword,
+				"password": password,
+			},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		return Deactivate(req, cfg, accountDB, deviceDB, rsAPI, keyAPI, device).Code
+	}
+
+	if code := deactivate("wrong"); code != http.StatusForbidden {
+		t.Fatalf("Deactivate with the wrong password returned %d, want %d", code, http.StatusForbidden)
+	}
+	if account, err := accountDB.GetAccountByLocalpart(ctx, "alice"); err != nil || account.IsDeactivated {
+		t.Fatalf("account was deactivated without the right password (%v)", err)
+	}
+	if len(rsAPI.leftRoomIDs) != 0 {
+		t.Fatalf("user left rooms without the right password")
+	}
+
+	if code := deactivate("password"); code != http.StatusOK {
+		t.Fatalf("Deactivate returned %d, want %d", code, http.StatusOK)
+	}
+	account, err := accountDB.GetAccountByLocalpart(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetAccountByLocalpart returned %s", err)
+	}
+	if !account.IsDeactivated {
+		t.Errorf("account wasn't deactivated")
+	}
+	remaining, err := deviceDB.GetDevicesByLocalpart(ctx, "alice")
+	if err != nil {
+		t.Fatalf("GetDevicesByLocalpart returned %s", err)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("deactivating left %d devices, want none", len(remaining))
+	}
+	sort.Strings(keyAPI.deletedDeviceIDs)
+	if want := []string{"ALICE", "PHONE"}; !reflect.DeepEqual(keyAPI.deletedDeviceIDs, want) {
+		t.Errorf("deactivating deleted keys for %v, want %v", keyAPI.deletedDeviceIDs, want)
+	}
+	if !reflect.DeepEqual(rsAPI.leftRoomIDs, rsAPI.joinedRoomIDs) {
+		t.Errorf("deactivating left rooms %v, want %v", rsAPI.leftRoomIDs, rsAPI.joinedRoomIDs)
+	}
+}
@@ -122,7 +122,7 @@ func SetAvatarURL(
 		return jsonerror.InternalServerError()
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, device)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -236,7 +236,7 @@ func SetDisplayName(
 		return jsonerror.InternalServerError()
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, device)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
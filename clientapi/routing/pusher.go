@@ -0,0 +1,143 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/pushserver/gateway"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	maxPushKeyLength = 512
+	maxAppIDLength   = 64
+)
+
+type pusherJSON struct {
+	authtypes.Pusher
+	// Kind is nil when the pusher should be removed.
+	Kind   *string `json:"kind"`
+	Append bool    `json:"append"`
+}
+
+type pushersResponse struct {
+	Pushers []authtypes.Pusher `json:"pushers"`
+}
+
+// GetPushers implements GET /pushers
+func GetPushers(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	pushers, err := accountDB.GetPushersByLocalpart(req.Context(), localpart)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetPushersByLocalpart failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: pushersResponse{pushers},
+	}
+}
+
+// SetPusher implements POST /pushers/set
+func SetPusher(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var r pusherJSON
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.PushKey == "" || r.AppID == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("pushkey and app_id are required"),
+		}
+	}
+	if len(r.PushKey) > maxPushKeyLength || len(r.AppID) > maxAppIDLength {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("pushkey or app_id is too long"),
+		}
+	}
+
+	// A null kind deletes the pusher.
+	if r.Kind == nil {
+		if err = accountDB.RemovePusher(req.Context(), r.AppID, r.PushKey, localpart); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.RemovePusher failed")
+			return jsonerror.InternalServerError()
+		}
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: struct{}{},
+		}
+	}
+
+	if *r.Kind != "http" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("unsupported pusher kind " + *r.Kind),
+		}
+	}
+	if r.AppDisplayName == "" || r.DeviceDisplayName == "" || r.Language == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("app_display_name, device_display_name and lang are required"),
+		}
+	}
+	// Only push gateways may be pushed to, so that pushers can't be used to
+	// send event content to arbitrary URLs.
+	gatewayURL, _ := r.Data["url"].(string)
+	if u, err := url.Parse(gatewayURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("http pushers require an absolute data.url"),
+		}
+	} else if u.Path != gateway.NotifyPath {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("data.url must use the path " + gateway.NotifyPath),
+		}
+	}
+
+	pusher := r.Pusher
+	pusher.Kind = *r.Kind
+	pusher.DeviceID = device.ID
+	if err = accountDB.SavePusher(req.Context(), localpart, &pusher, !r.Append); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SavePusher failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
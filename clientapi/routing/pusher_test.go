@@ -0,0 +1,73 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+func TestSetPusherGatewayURL(t *testing.T) {
+	db, cleanup := mustCreateAccountDB(t)
+	defer cleanup()
+	device := &authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"}
+
+	tests := []struct {
+		url      string
+		wantCode int
+	}{
+		{"https://push.example.com/_matrix/push/v1/notify", http.StatusOK},
+		{"http://push.example.com:8080/_matrix/push/v1/notify", http.StatusOK},
+		{"https://push.example.com/", http.StatusBadRequest},
+		{"http://169.254.169.254/latest/meta-data", http.StatusBadRequest},
+		{"http://localhost:8008/_matrix/client/r0/rooms", http.StatusBadRequest},
+		{"ftp://push.example.com/_matrix/push/v1/notify", http.StatusBadRequest},
+		{"/_matrix/push/v1/notify", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		body := mustMarshalJSON(t, map[string]interface{}{
+			"pushkey":             "key_" + tt.url,
+			"kind":                "http",
+			"app_id":              "com.example.app",
+			"app_display_name":    "App",
+			"device_display_name": "Phone",
+			"lang":                "en",
+			"data":                map[string]interface{}{"url": tt.url},
+		})
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if res := SetPusher(req, db, device); res.Code != tt.wantCode {
+			t.Errorf("SetPusher with url %q returned %d, want %d", tt.url, res.Code, tt.wantCode)
+		}
+	}
+
+	// Only the pushers with valid URLs were saved.
+	pushers, err := db.GetPushersByLocalpart(context.Background(), "alice")
+	if err != nil {
+		t.Fatalf("GetPushersByLocalpart returned %s", err)
+	}
+	if len(pushers) != 2 {
+		t.Fatalf("%d pushers were saved, want 2", len(pushers))
+	}
+	for _, pusher := range pushers {
+		if url := pusher.Data["url"].(string); !strings.HasSuffix(url, "/_matrix/push/v1/notify") {
+			t.Errorf("pusher with url %q was saved", url)
+		}
+	}
+}
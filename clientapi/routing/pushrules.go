@@ -0,0 +1,403 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// GetAllPushRules implements GET /pushrules/
+func GetAllPushRules(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database, cfg *config.Dendrite,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, accountDB, cfg)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSets,
+	}
+}
+
+// GetPushRulesByScope implements GET /pushrules/{scope}/
+func GetPushRulesByScope(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database, cfg *config.Dendrite,
+	scope string,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, accountDB, cfg)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	ruleSet, resErr := pushRuleSetForScope(ruleSets, scope)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: ruleSet,
+	}
+}
+
+// GetPushRulesByKind implements GET /pushrules/{scope}/{kind}/
+func GetPushRulesByKind(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database, cfg *config.Dendrite,
+	scope, kind string,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, accountDB, cfg)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: *rules,
+	}
+}
+
+// GetPushRuleByRuleID implements GET /pushrules/{scope}/{kind}/{ruleId}
+func GetPushRuleByRuleID(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database, cfg *config.Dendrite,
+	scope, kind, ruleID string,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, accountDB, cfg)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndex(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound(ruleID)
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: (*rules)[i],
+	}
+}
+
+// PutPushRuleByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleId}
+func PutPushRuleByRuleID(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID string,
+) util.JSONResponse {
+	var body struct {
+		Actions    []*pushrules.Action    `json:"actions"`
+		Conditions []*pushrules.Condition `json:"conditions"`
+		Pattern    string                 `json:"pattern"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+	if strings.HasPrefix(ruleID, ".") || strings.Contains(ruleID, "/") || strings.Contains(ruleID, `\`) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("invalid rule ID " + ruleID),
+		}
+	}
+	if len(body.Actions) == 0 {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("actions are required"),
+		}
+	}
+	newRule := &pushrules.Rule{
+		RuleID:  ruleID,
+		Enabled: true,
+		Actions: body.Actions,
+	}
+	switch pushrules.Kind(kind) {
+	case pushrules.OverrideKind, pushrules.UnderrideKind:
+		newRule.Conditions = body.Conditions
+	case pushrules.ContentKind:
+		if body.Pattern == "" {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("content rules require a pattern"),
+			}
+		}
+		newRule.Pattern = body.Pattern
+	}
+	// Rules which can't be evaluated would stop the user's notifications
+	// from working, so they are rejected rather than stored.
+	if err := newRule.Validate(pushrules.Kind(kind)); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, accountDB, cfg)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+
+	beforeRuleID := req.URL.Query().Get("before")
+	afterRuleID := req.URL.Query().Get("after")
+	if i := pushRuleIndex(*rules, ruleID); i >= 0 {
+		if beforeRuleID == "" && afterRuleID == "" {
+			// Updating an existing rule without moving it keeps its position.
+			newRule.Enabled = (*rules)[i].Enabled
+			(*rules)[i] = newRule
+			return savePushRules(req, device.UserID, ruleSets, accountDB, syncProducer)
+		}
+		*rules = append((*rules)[:i], (*rules)[i+1:]...)
+	}
+
+	// New rules are added as the highest priority rule of their kind
+	// unless the client asked for a specific position.
+	pos := 0
+	if beforeRuleID != "" || afterRuleID != "" {
+		relativeTo := beforeRuleID
+		if relativeTo == "" {
+			relativeTo = afterRuleID
+		}
+		if pos = pushRuleIndex(*rules, relativeTo); pos < 0 {
+			return pushRuleNotFound(relativeTo)
+		}
+		if beforeRuleID == "" {
+			pos++
+		}
+	}
+	*rules = append((*rules)[:pos], append([]*pushrules.Rule{newRule}, (*rules)[pos:]...)...)
+	return savePushRules(req, device.UserID, ruleSets, accountDB, syncProducer)
+}
+
+// DeletePushRuleByRuleID implements DELETE /pushrules/{scope}/{kind}/{ruleId}
+func DeletePushRuleByRuleID(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID string,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, accountDB, cfg)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndex(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound(ruleID)
+	}
+	if (*rules)[i].Default {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("server-default rules cannot be deleted"),
+		}
+	}
+	*rules = append((*rules)[:i], (*rules)[i+1:]...)
+	return savePushRules(req, device.UserID, ruleSets, accountDB, syncProducer)
+}
+
+// GetPushRuleAttrByRuleID implements GET /pushrules/{scope}/{kind}/{ruleId}/{attr}
+func GetPushRuleAttrByRuleID(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database, cfg *config.Dendrite,
+	scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, accountDB, cfg)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndex(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound(ruleID)
+	}
+	switch attr {
+	case "enabled":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string]bool{"enabled": (*rules)[i].Enabled},
+		}
+	case "actions":
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: map[string][]*pushrules.Action{"actions": (*rules)[i].Actions},
+		}
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("unknown push rule attribute " + attr),
+		}
+	}
+}
+
+// PutPushRuleAttrByRuleID implements PUT /pushrules/{scope}/{kind}/{ruleId}/{attr}
+func PutPushRuleAttrByRuleID(
+	req *http.Request, device *authtypes.Device, accountDB accounts.Database, cfg *config.Dendrite,
+	syncProducer *producers.SyncAPIProducer, scope, kind, ruleID, attr string,
+) util.JSONResponse {
+	var body struct {
+		Enabled *bool               `json:"enabled"`
+		Actions []*pushrules.Action `json:"actions"`
+	}
+	if resErr := httputil.UnmarshalJSONRequest(req, &body); resErr != nil {
+		return *resErr
+	}
+
+	ruleSets, err := queryPushRules(req.Context(), device.UserID, accountDB, cfg)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("queryPushRules failed")
+		return jsonerror.InternalServerError()
+	}
+	rules, resErr := pushRulesForKind(ruleSets, scope, kind)
+	if resErr != nil {
+		return *resErr
+	}
+	i := pushRuleIndex(*rules, ruleID)
+	if i < 0 {
+		return pushRuleNotFound(ruleID)
+	}
+	switch attr {
+	case "enabled":
+		if body.Enabled == nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("enabled is required"),
+			}
+		}
+		(*rules)[i].Enabled = *body.Enabled
+	case "actions":
+		if len(body.Actions) == 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.MissingArgument("actions are required"),
+			}
+		}
+		(*rules)[i].Actions = body.Actions
+	default:
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("unknown push rule attribute " + attr),
+		}
+	}
+	return savePushRules(req, device.UserID, ruleSets, accountDB, syncProducer)
+}
+
+// queryPushRules returns the push rules of the given user, falling back to
+// the server-default rules if the user has never changed them.
+func queryPushRules(
+	ctx context.Context, userID string, accountDB accounts.Database, cfg *config.Dendrite,
+) (*pushrules.AccountRuleSets, error) {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return nil, err
+	}
+	return pushrules.QueryAccountRuleSets(ctx, accountDB, localpart, cfg.Matrix.ServerName)
+}
+
+// savePushRules stores the push rules of the given user as account data and
+// notifies the sync API of the change.
+func savePushRules(
+	req *http.Request, userID string, ruleSets *pushrules.AccountRuleSets,
+	accountDB accounts.Database, syncProducer *producers.SyncAPIProducer,
+) util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+	content, err := json.Marshal(ruleSets)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = accountDB.SaveAccountData(req.Context(), localpart, "", pushrules.AccountDataType, string(content)); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveAccountData failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = syncProducer.SendData(userID, "", pushrules.AccountDataType); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+func pushRuleSetForScope(ruleSets *pushrules.AccountRuleSets, scope string) (*pushrules.RuleSet, *util.JSONResponse) {
+	if scope != pushrules.GlobalScope {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("unknown push rule scope " + scope),
+		}
+	}
+	return &ruleSets.Global, nil
+}
+
+func pushRulesForKind(ruleSets *pushrules.AccountRuleSets, scope, kind string) (*[]*pushrules.Rule, *util.JSONResponse) {
+	ruleSet, resErr := pushRuleSetForScope(ruleSets, scope)
+	if resErr != nil {
+		return nil, resErr
+	}
+	rules := ruleSet.RulesForKind(pushrules.Kind(kind))
+	if rules == nil {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("unknown push rule kind " + kind),
+		}
+	}
+	return rules, nil
+}
+
+func pushRuleIndex(rules []*pushrules.Rule, ruleID string) int {
+	for i, rule := range rules {
+		if rule.RuleID == ruleID {
+			return i
+		}
+	}
+	return -1
+}
+
+func pushRuleNotFound(ruleID string) util.JSONResponse {
+	return util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("push rule " + ruleID + " not found"),
+	}
+}
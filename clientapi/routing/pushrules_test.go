@@ -0,0 +1,51 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+)
+
+func TestPutPushRuleByRuleIDInvalid(t *testing.T) {
+	device := &authtypes.Device{UserID: "@alice:localhost", ID: "ALICE"}
+	tests := []struct {
+		name   string
+		kind   string
+		ruleID string
+		body   string
+	}{
+		{"unparseable member count", "override", "count", `{"actions":["notify"],"conditions":[{"kind":"room_member_count","is":"abc"}]}`},
+		{"event_match without pattern", "underride", "match", `{"actions":["notify"],"conditions":[{"kind":"event_match","key":"content.body"}]}`},
+		{"unknown condition kind", "override", "unknown", `{"actions":["notify"],"conditions":[{"kind":"frobnicate"}]}`},
+		{"room rule without room ID", "room", "notaroom", `{"actions":["notify"]}`},
+		{"sender rule without user ID", "sender", "!room:localhost", `{"actions":["notify"]}`},
+		{"unknown rule kind", "sideways", "rule", `{"actions":["notify"]}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/", strings.NewReader(tt.body))
+			// Invalid rules are rejected before the account database is used.
+			res := PutPushRuleByRuleID(req, device, nil, nil, nil, "global", tt.kind, tt.ruleID)
+			if res.Code != http.StatusBadRequest {
+				t.Errorf("PutPushRuleByRuleID returned %d, want %d", res.Code, http.StatusBadRequest)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type readMarkerJSON struct {
+	FullyRead string `json:"m.fully_read"`
+	Read      string `json:"m.read"`
+}
+
+type fullyReadContentJSON struct {
+	EventID string `json:"event_id"`
+}
+
+// SetReceipt handles POST /rooms/{roomID}/receipt/{receiptType}/{eventID}
+func SetReceipt(
+	req *http.Request, device *authtypes.Device, roomID, receiptType, eventID string,
+	accountDB accounts.Database, eduProducer *producers.EDUServerProducer,
+) util.JSONResponse {
+	if receiptType != "m.read" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Only m.read receipts are supported"),
+		}
+	}
+
+	if resErr := checkMemberInRoom(req, accountDB, device, roomID); resErr != nil {
+		return *resErr
+	}
+
+	if err := eduProducer.SendReceipt(
+		req.Context(), device.UserID, roomID, eventID, receiptType,
+		gomatrixserverlib.AsTimestamp(time.Now()),
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("eduProducer.SendReceipt failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// SaveReadMarker handles POST /rooms/{roomID}/read_markers
+// The m.fully_read marker is stored as room account data, and the optional
+// m.read marker is sent as a read receipt.
+func SaveReadMarker(
+	req *http.Request, device *authtypes.Device, roomID string,
+	accountDB accounts.Database, syncProducer *producers.SyncAPIProducer,
+	eduProducer *producers.EDUServerProducer,
+) util.JSONResponse {
+	if resErr := checkMemberInRoom(req, accountDB, device, roomID); resErr != nil {
+		return *resErr
+	}
+
+	var r readMarkerJSON
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.FullyRead == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("Missing m.fully_read mandatory field"),
+		}
+	}
+
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		return jsonerror.InternalServerError()
+	}
+
+	content, err := json.Marshal(fullyReadContentJSON{EventID: r.FullyRead})
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("json.Marshal failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if err = accountDB.SaveAccountData(
+		req.Context(), localpart, roomID, "m.fully_read", string(content),
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.SaveAccountData failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if err = syncProducer.SendData(device.UserID, roomID, "m.fully_read"); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncProducer.SendData failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if r.Read != "" {
+		if err = eduProducer.SendReceipt(
+			req.Context(), device.UserID, roomID, r.Read, "m.read",
+			gomatrixserverlib.AsTimestamp(time.Now()),
+		); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("eduProducer.SendReceipt failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
+
+// checkMemberInRoom returns an error response if the device's user is not
+// a member of the given room.
+func checkMemberInRoom(
+	req *http.Request, accountDB accounts.Database, device *authtypes.Device, roomID string,
+) *util.JSONResponse {
+	localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+
+	_, err = accountDB.GetMembershipInRoomByLocalpart(req.Context(), localpart, roomID)
+	if err == sql.ErrNoRows {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("User not in this room"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("accountDB.GetMembershipInRoomByLocalpart failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	return nil
+}
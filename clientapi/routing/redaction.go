@@ -0,0 +1,162 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/clientapi/producers"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/transactions"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type redactionContent struct {
+	Reason string `json:"reason,omitempty"`
+}
+
+// SendRedaction implements:
+//
+//	/rooms/{roomID}/redact/{eventID}/{txnID}
+func SendRedaction(
+	req *http.Request,
+	device *authtypes.Device,
+	roomID, eventID string, txnID *string,
+	cfg *config.Dendrite,
+	rsAPI api.RoomserverInternalAPI,
+	producer *producers.RoomserverProducer,
+	txnCache *transactions.Cache,
+) util.JSONResponse {
+	if txnID != nil {
+		// Try to fetch response from transactionsCache
+		if res, ok := txnCache.FetchTransaction(device.AccessToken, *txnID); ok {
+			return *res
+		}
+	}
+
+	var r redactionContent
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+
+	// Look up the event that is being redacted.
+	eventsReq := api.QueryEventsByIDRequest{EventIDs: []string{eventID}}
+	var eventsRes api.QueryEventsByIDResponse
+	if err := rsAPI.QueryEventsByID(req.Context(), &eventsReq, &eventsRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.QueryEventsByID failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(eventsRes.Events) == 0 || eventsRes.Events[0].RoomID() != roomID {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Event not found"),
+		}
+	}
+	redactedEvent := eventsRes.Events[0]
+
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:  device.UserID,
+		RoomID:  roomID,
+		Type:    gomatrixserverlib.MRoomRedaction,
+		Redacts: eventID,
+	}
+	if err := builder.SetContent(r); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("builder.SetContent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	var queryRes api.QueryLatestEventsAndStateResponse
+	e, err := internal.BuildEvent(req.Context(), &builder, cfg, time.Now(), rsAPI, &queryRes)
+	if err == internal.ErrRoomNoExists {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Room does not exist"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("internal.BuildEvent failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Check that the user is allowed to send the redaction, and that they
+	// are either redacting their own event or have the power to redact
+	// other people's events.
+	stateEvents := make([]*gomatrixserverlib.Event, len(queryRes.StateEvents))
+	var creatorUserID string
+	for i := range queryRes.StateEvents {
+		stateEvents[i] = &queryRes.StateEvents[i].Event
+		if stateEvents[i].Type() == gomatrixserverlib.MRoomCreate {
+			creatorUserID = stateEvents[i].Sender()
+		}
+	}
+	provider := gomatrixserverlib.NewAuthEvents(stateEvents)
+	if err = gomatrixserverlib.Allowed(*e, &provider); err != nil {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden(err.Error()),
+		}
+	}
+	if redactedEvent.Sender() != device.UserID {
+		powerLevels, plErr := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(&provider, creatorUserID)
+		if plErr != nil {
+			util.GetLogger(req.Context()).WithError(plErr).Error("gomatrixserverlib.NewPowerLevelContentFromAuthEvents failed")
+			return jsonerror.InternalServerError()
+		}
+		if powerLevels.UserLevel(device.UserID) < powerLevels.Redact {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You don't have permission to redact this event"),
+			}
+		}
+	}
+
+	var txnAndSessionID *api.TransactionID
+	if txnID != nil {
+		txnAndSessionID = &api.TransactionID{
+			TransactionID: *txnID,
+			SessionID:     device.SessionID,
+		}
+	}
+
+	redactionEventID, err := producer.SendEvents(
+		req.Context(),
+		[]gomatrixserverlib.HeaderedEvent{
+			e.Headered(queryRes.RoomVersion),
+		},
+		cfg.Matrix.ServerName,
+		txnAndSessionID,
+	)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("producer.SendEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	res := util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: sendEventResponse{redactionEventID},
+	}
+	// Add response to transactionsCache
+	if txnID != nil {
+		txnCache.AddTransaction(device.AccessToken, *txnID, &res)
+	}
+
+	return res
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha1"
+	"database/sql"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -138,6 +139,13 @@ type registerRequest struct {
 	// Prevent this user from logging in
 	InhibitLogin internal.WeakBoolean `json:"inhibit_login"`
 
+	// The access token of a guest account, if the guest account is being
+	// upgraded to a full account.
+	GuestAccessToken string `json:"guest_access_token"`
+	// The localpart of the guest account being upgraded, once the guest
+	// access token has been checked.
+	guestLocalpart string
+
 	// Application Services place Type in the root of their registration
 	// request, whereas clients place it in the authDict struct.
 	Type authtypes.LoginType `json:"type"`
@@ -340,7 +348,7 @@ func UserIDIsWithinApplicationServiceNamespace(
 	}
 
 	// Loop through all known application service's namespaces and see if any match
-	for _, knownAppService := range cfg.Derived.ApplicationServices {
+	for _, knownAppService := range cfg.AppServices() {
 		for _, namespace := range knownAppService.NamespaceMap["users"] {
 			// AS namespaces are checked for validity in config
 			if namespace.RegexpObject.MatchString(userID) {
@@ -361,7 +369,7 @@ func UsernameMatchesMultipleExclusiveNamespaces(
 
 	// Check namespaces and see if more than one match
 	matchCount := 0
-	for _, appservice := range cfg.Derived.ApplicationServices {
+	for _, appservice := range cfg.AppServices() {
 		if appservice.OwnsNamespaceCoveringUserId(userID) {
 			if matchCount++; matchCount > 1 {
 				return true
@@ -378,7 +386,7 @@ func UsernameMatchesExclusiveNamespaces(
 	username string,
 ) bool {
 	userID := userutil.MakeUserID(username, cfg.Matrix.ServerName)
-	return cfg.Derived.ExclusiveApplicationServicesUsernameRegexp.MatchString(userID)
+	return cfg.IsExclusiveAppServiceUserID(userID)
 }
 
 // validateApplicationService checks if a provided application service token
@@ -393,7 +401,7 @@ func validateApplicationService(
 	// Check if the token if the application service is valid with one we have
 	// registered in the config.
 	var matchedApplicationService *config.ApplicationService
-	for _, appservice := range cfg.Derived.ApplicationServices {
+	for _, appservice := range cfg.AppServices() {
 		if appservice.ASToken == accessToken {
 			matchedApplicationService = &appservice
 			break
@@ -460,8 +468,14 @@ func Register(
 		sessionID = util.RandomString(sessionIDLength)
 	}
 
-	// Don't allow numeric usernames less than MAX_INT64.
-	if _, err := strconv.ParseInt(r.Username, 10, 64); err == nil {
+	// Guest accounts keep their user ID when they are upgraded, which will
+	// be numeric.
+	if r.GuestAccessToken != "" {
+		if resErr = checkGuestUpgrade(req, &r, deviceDB); resErr != nil {
+			return *resErr
+		}
+	} else if _, err := strconv.ParseInt(r.Username, 10, 64); err == nil {
+		// Don't allow numeric usernames less than MAX_INT64.
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
 			JSON: jsonerror.InvalidUsername("Numeric user IDs are reserved"),
@@ -491,7 +505,7 @@ func Register(
 	// Make sure normal user isn't registering under an exclusive application
 	// service namespace. Skip this check if no app services are registered.
 	if r.Auth.Type != authtypes.LoginTypeApplicationService &&
-		len(cfg.Derived.ApplicationServices) != 0 &&
+		len(cfg.AppServices()) != 0 &&
 		UsernameMatchesExclusiveNamespaces(cfg, r.Username) {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -516,6 +530,12 @@ func handleGuestRegistration(
 	accountDB accounts.Database,
 	deviceDB devices.Database,
 ) util.JSONResponse {
+	if cfg.Matrix.GuestsDisabled {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guest registration is disabled"),
+		}
+	}
 	acc, err := accountDB.CreateGuestAccount(req.Context())
 	if err != nil {
 		return util.JSONResponse{
@@ -536,7 +556,7 @@ func handleGuestRegistration(
 		}
 	}
 	//we don't allow guests to specify their own device_id
-	dev, err := deviceDB.CreateDevice(req.Context(), acc.Localpart, nil, token, r.InitialDisplayName)
+	dev, err := deviceDB.CreateGuestDevice(req.Context(), acc.Localpart, token, r.InitialDisplayName)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusInternalServerError,
@@ -565,9 +585,7 @@ func handleRegistrationFlow(
 	accountDB accounts.Database,
 	deviceDB devices.Database,
 ) util.JSONResponse {
-	// TODO: Shared secret registration (create new user scripts)
 	// TODO: Enable registration config flag
-	// TODO: Guest account upgrading
 
 	// TODO: Handle loading of previous session parameters from database.
 	// TODO: Handle mapping registrationRequest parameters into session parameters
@@ -705,6 +723,12 @@ func checkAndCompleteFlow(
 ) util.JSONResponse {
 	if checkFlowCompleted(flow, cfg.Derived.Registration.Flows) {
 		// This flow was completed, registration can continue
+		if r.guestLocalpart != "" {
+			return completeGuestUpgrade(
+				req.Context(), accountDB, deviceDB, cfg.Matrix.ServerName, r.guestLocalpart, r.Password,
+				r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
+			)
+		}
 		return completeRegistration(
 			req.Context(), accountDB, deviceDB, r.Username, r.Password, "",
 			r.InhibitLogin, r.InitialDisplayName, r.DeviceID,
@@ -844,14 +868,97 @@ func completeRegistration(
 	// Increment prometheus counter for created users
 	amtRegUsers.Inc()
 
+	return completeRegistrationLogin(ctx, deviceDB, username, acc.ServerName, inhibitLogin, displayName, deviceID)
+}
+
+// completeGuestUpgrade turns the guest account with the given localpart into
+// a full account with the given password, then logs in a new device for it.
+// The guest's existing devices keep working, but are no longer guest devices.
+func completeGuestUpgrade(
+	ctx context.Context,
+	accountDB accounts.Database,
+	deviceDB devices.Database,
+	serverName gomatrixserverlib.ServerName,
+	localpart, password string,
+	inhibitLogin internal.WeakBoolean,
+	displayName, deviceID *string,
+) util.JSONResponse {
+	if password == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.BadJSON("missing password"),
+		}
+	}
+
+	if err := accountDB.UpgradeGuestAccount(ctx, localpart, password); err == sql.ErrNoRows {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("This account is not a guest account"),
+		}
+	} else if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("accountDB.UpgradeGuestAccount failed")
+		return jsonerror.InternalServerError()
+	}
+	if err := deviceDB.UpgradeGuestDevices(ctx, localpart); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("deviceDB.UpgradeGuestDevices failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return completeRegistrationLogin(ctx, deviceDB, localpart, serverName, inhibitLogin, displayName, deviceID)
+}
+
+// checkGuestUpgrade checks that the guest access token in a registration
+// request belongs to a guest account, and that the request doesn't ask for a
+// different user ID. Guest accounts keep their user ID when they are upgraded.
+func checkGuestUpgrade(
+	req *http.Request, r *registerRequest, deviceDB devices.Database,
+) *util.JSONResponse {
+	dev, err := deviceDB.GetDeviceByAccessToken(req.Context(), r.GuestAccessToken)
+	if err == sql.ErrNoRows || (err == nil && !dev.IsGuest) {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Invalid guest access token"),
+		}
+	} else if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("deviceDB.GetDeviceByAccessToken failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('@', dev.UserID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("gomatrixserverlib.SplitID failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	if r.Username != "" && strings.ToLower(r.Username) != localpart {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("Guest accounts can only be upgraded to their own user ID"),
+		}
+	}
+	r.Username = localpart
+	r.guestLocalpart = localpart
+	return nil
+}
+
+// completeRegistrationLogin creates a device and access token for a newly
+// registered account, unless inhibitLogin is set.
+func completeRegistrationLogin(
+	ctx context.Context,
+	deviceDB devices.Database,
+	username string,
+	serverName gomatrixserverlib.ServerName,
+	inhibitLogin internal.WeakBoolean,
+	displayName, deviceID *string,
+) util.JSONResponse {
 	// Check whether inhibit_login option is set. If so, don't create an access
 	// token or a device for this user
 	if inhibitLogin {
 		return util.JSONResponse{
 			Code: http.StatusOK,
 			JSON: registerResponse{
-				UserID:     userutil.MakeUserID(username, acc.ServerName),
-				HomeServer: acc.ServerName,
+				UserID:     userutil.MakeUserID(username, serverName),
+				HomeServer: serverName,
 			},
 		}
 	}
@@ -877,7 +984,7 @@ func completeRegistration(
 		JSON: registerResponse{
 			UserID:      dev.UserID,
 			AccessToken: dev.AccessToken,
-			HomeServer:  acc.ServerName,
+			HomeServer:  serverName,
 			DeviceID:    dev.ID,
 		},
 	}
@@ -999,7 +1106,7 @@ func RegisterAvailable(
 
 	// Check if this username is reserved by an application service
 	userID := userutil.MakeUserID(username, cfg.Matrix.ServerName)
-	for _, appservice := range cfg.Derived.ApplicationServices {
+	for _, appservice := range cfg.AppServices() {
 		if appservice.OwnsNamespaceCoveringUserId(userID) {
 			return util.JSONResponse{
 				Code: http.StatusBadRequest,
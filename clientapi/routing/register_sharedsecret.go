@@ -0,0 +1,175 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"crypto/hmac"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/util"
+)
+
+const (
+	sharedSecretNonceLength   = 32
+	sharedSecretNonceLifetime = time.Minute
+)
+
+// nonceDict keeps track of the nonces handed out for shared secret
+// registration. Each nonce can only be used once.
+// It shouldn't be passed by value because it contains a mutex.
+type nonceDict struct {
+	sync.Mutex
+	nonces map[string]time.Time
+}
+
+func newNonceDict() *nonceDict {
+	return &nonceDict{
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// issue returns a new nonce, forgetting any expired ones.
+func (d *nonceDict) issue() string {
+	d.Lock()
+	defer d.Unlock()
+
+	now := time.Now()
+	for nonce, expires := range d.nonces {
+		if now.After(expires) {
+			delete(d.nonces, nonce)
+		}
+	}
+	nonce := util.RandomString(sharedSecretNonceLength)
+	d.nonces[nonce] = now.Add(sharedSecretNonceLifetime)
+	return nonce
+}
+
+// consume forgets the nonce, returning whether it was valid.
+func (d *nonceDict) consume(nonce string) bool {
+	d.Lock()
+	defer d.Unlock()
+
+	expires, ok := d.nonces[nonce]
+	delete(d.nonces, nonce)
+	return ok && time.Now().Before(expires)
+}
+
+// sharedSecretNonces stores the nonces handed out by GET /admin/register.
+var sharedSecretNonces = newNonceDict()
+
+type sharedSecretNonceResponse struct {
+	Nonce string `json:"nonce"`
+}
+
+type sharedSecretRegisterRequest struct {
+	Nonce       string `json:"nonce"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayname"`
+	Password    string `json:"password"`
+	Admin       bool   `json:"admin"`
+	// Dendrite has no user types, but they are part of the HMAC if given.
+	UserType string `json:"user_type"`
+	MAC      string `json:"mac"`
+}
+
+// SharedSecretRegister implements GET and POST /admin/register, which lets
+// anyone who knows the registration shared secret create accounts, even if
+// registration is otherwise disabled.
+func SharedSecretRegister(
+	req *http.Request, cfg *config.Dendrite,
+	accountDB accounts.Database, deviceDB devices.Database,
+) util.JSONResponse {
+	if cfg.Matrix.RegistrationSharedSecret == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.Unknown("Shared secret registration is not enabled"),
+		}
+	}
+
+	if req.Method == http.MethodGet {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: sharedSecretNonceResponse{sharedSecretNonces.issue()},
+		}
+	}
+
+	var r sharedSecretRegisterRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if !sharedSecretNonces.consume(r.Nonce) {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("Unrecognised nonce"),
+		}
+	}
+	if resErr := validateUsername(r.Username); resErr != nil {
+		return *resErr
+	}
+	if resErr := validatePassword(r.Password); resErr != nil {
+		return *resErr
+	}
+
+	expectedMAC := auth.SharedSecretRegistrationMAC(
+		cfg.Matrix.RegistrationSharedSecret, r.Nonce, r.Username, r.Password, r.Admin, r.UserType,
+	)
+	if !hmac.Equal([]byte(r.MAC), []byte(expectedMAC)) {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("HMAC incorrect"),
+		}
+	}
+
+	util.GetLogger(req.Context()).WithField("username", r.Username).Info("Processing shared secret registration request")
+
+	acc, err := accountDB.CreateAccount(req.Context(), r.Username, r.Password, "")
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusInternalServerError,
+			JSON: jsonerror.Unknown("failed to create account: " + err.Error()),
+		}
+	} else if acc == nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.UserInUse("Desired user ID is already taken."),
+		}
+	}
+
+	// Increment prometheus counter for created users
+	amtRegUsers.Inc()
+
+	if r.Admin {
+		if err = accountDB.SetAdmin(req.Context(), r.Username, true); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetAdmin failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	if r.DisplayName != "" {
+		if err = accountDB.SetDisplayName(req.Context(), r.Username, r.DisplayName); err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("accountDB.SetDisplayName failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	return completeRegistrationLogin(req.Context(), deviceDB, r.Username, acc.ServerName, false, nil, nil)
+}
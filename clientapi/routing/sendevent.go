@@ -47,8 +47,17 @@ func SendEvent(
 	cfg *config.Dendrite,
 	rsAPI api.RoomserverInternalAPI,
 	producer *producers.RoomserverProducer,
+	eduProducer *producers.EDUServerProducer,
 	txnCache *transactions.Cache,
 ) util.JSONResponse {
+	// Guests may only send messages.
+	if device.IsGuest && (stateKey != nil || eventType != "m.room.message") {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guests can only send m.room.message events"),
+		}
+	}
+
 	verReq := api.QueryRoomVersionForRoomRequest{RoomID: roomID}
 	verRes := api.QueryRoomVersionForRoomResponse{}
 	if err := rsAPI.QueryRoomVersionForRoom(req.Context(), &verReq, &verRes); err != nil {
@@ -98,6 +107,11 @@ func SendEvent(
 		"room_version": verRes.RoomVersion,
 	}).Info("Sent event to roomserver")
 
+	// Sending an event is activity, so it keeps the user from going idle.
+	if err = eduProducer.SendActivity(req.Context(), device.UserID); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("eduProducer.SendActivity failed")
+	}
+
 	res := util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: sendEventResponse{eventID},
@@ -125,7 +139,7 @@ func generateSendEvent(
 		return nil, resErr
 	}
 
-	evTime, err := httputil.ParseTSParam(req)
+	evTime, err := httputil.ParseTSParam(req, device)
 	if err != nil {
 		return nil, &util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -19,8 +19,10 @@ import (
 	"encoding/json"
 	"net/http"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/auth"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -34,26 +36,19 @@ type stateEventInStateResp struct {
 }
 
 // OnIncomingStateRequest is called when a client makes a /rooms/{roomID}/state
-// request. It will fetch all the state events from the specified room and will
-// append the necessary keys to them if applicable before returning them.
+// request. It will fetch all the state events from the specified room which
+// the user is allowed to see and will append the necessary keys to them if
+// applicable before returning them.
 // Returns an error if something went wrong in the process.
-// TODO: Check if the user is in the room. If not, check if the room's history
-// is publicly visible. Current behaviour is returning an empty array if the
-// user cannot see the room's history.
-func OnIncomingStateRequest(ctx context.Context, rsAPI api.RoomserverInternalAPI, roomID string) util.JSONResponse {
-	// TODO(#287): Auth request and handle the case where the user has left (where
-	// we should return the state at the poin they left)
-	stateReq := api.QueryLatestEventsAndStateRequest{
-		RoomID: roomID,
-	}
-	stateRes := api.QueryLatestEventsAndStateResponse{}
-
-	if err := rsAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
-		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryLatestEventsAndState failed")
-		return jsonerror.InternalServerError()
+func OnIncomingStateRequest(
+	ctx context.Context, device *authtypes.Device, rsAPI api.RoomserverInternalAPI, roomID string,
+) util.JSONResponse {
+	stateEvents, resErr := getStateForUser(ctx, device, rsAPI, roomID, nil)
+	if resErr != nil {
+		return *resErr
 	}
 
-	if len(stateRes.StateEvents) == 0 {
+	if len(stateEvents) == 0 {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("cannot find state"),
@@ -62,7 +57,7 @@ func OnIncomingStateRequest(ctx context.Context, rsAPI api.RoomserverInternalAPI
 
 	resp := []stateEventInStateResp{}
 	// Fill the prev_content and replaces_state keys if necessary
-	for _, event := range stateRes.StateEvents {
+	for _, event := range stateEvents {
 		stateEvent := stateEventInStateResp{
 			ClientEvent: gomatrixserverlib.HeaderedToClientEvents(
 				[]gomatrixserverlib.HeaderedEvent{event}, gomatrixserverlib.FormatAll,
@@ -98,32 +93,27 @@ func OnIncomingStateRequest(ctx context.Context, rsAPI api.RoomserverInternalAPI
 // /rooms/{roomID}/state/{type}/{statekey} request. It will look in current
 // state to see if there is an event with that type and state key, if there
 // is then (by default) we return the content, otherwise a 404.
-func OnIncomingStateTypeRequest(ctx context.Context, rsAPI api.RoomserverInternalAPI, roomID string, evType, stateKey string) util.JSONResponse {
-	// TODO(#287): Auth request and handle the case where the user has left (where
-	// we should return the state at the poin they left)
+func OnIncomingStateTypeRequest(
+	ctx context.Context, device *authtypes.Device, rsAPI api.RoomserverInternalAPI,
+	roomID string, evType, stateKey string,
+) util.JSONResponse {
 	util.GetLogger(ctx).WithFields(log.Fields{
 		"roomID":   roomID,
 		"evType":   evType,
 		"stateKey": stateKey,
 	}).Info("Fetching state")
 
-	stateReq := api.QueryLatestEventsAndStateRequest{
-		RoomID: roomID,
-		StateToFetch: []gomatrixserverlib.StateKeyTuple{
-			gomatrixserverlib.StateKeyTuple{
-				EventType: evType,
-				StateKey:  stateKey,
-			},
+	stateEvents, resErr := getStateForUser(ctx, device, rsAPI, roomID, []gomatrixserverlib.StateKeyTuple{
+		{
+			EventType: evType,
+			StateKey:  stateKey,
 		},
-	}
-	stateRes := api.QueryLatestEventsAndStateResponse{}
-
-	if err := rsAPI.QueryLatestEventsAndState(ctx, &stateReq, &stateRes); err != nil {
-		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryLatestEventsAndState failed")
-		return jsonerror.InternalServerError()
+	})
+	if resErr != nil {
+		return *resErr
 	}
 
-	if len(stateRes.StateEvents) == 0 {
+	if len(stateEvents) == 0 {
 		return util.JSONResponse{
 			Code: http.StatusNotFound,
 			JSON: jsonerror.NotFound("cannot find state"),
@@ -131,7 +121,7 @@ func OnIncomingStateTypeRequest(ctx context.Context, rsAPI api.RoomserverInterna
 	}
 
 	stateEvent := stateEventInStateResp{
-		ClientEvent: gomatrixserverlib.HeaderedToClientEvent(stateRes.StateEvents[0], gomatrixserverlib.FormatAll),
+		ClientEvent: gomatrixserverlib.HeaderedToClientEvent(stateEvents[0], gomatrixserverlib.FormatAll),
 	}
 
 	return util.JSONResponse{
@@ -139,3 +129,103 @@ func OnIncomingStateTypeRequest(ctx context.Context, rsAPI api.RoomserverInterna
 		JSON: stateEvent.Content,
 	}
 }
+
+// getStateForUser returns the state of the room which the user is allowed to
+// see, limited to the given tuples if there are any. Users in the room see the
+// current state, users who have left or been banned see the state at the point
+// they left, and anyone else only sees the current state of world readable rooms.
+func getStateForUser(
+	ctx context.Context, device *authtypes.Device, rsAPI api.RoomserverInternalAPI,
+	roomID string, stateToFetch []gomatrixserverlib.StateKeyTuple,
+) ([]gomatrixserverlib.HeaderedEvent, *util.JSONResponse) {
+	var membershipRes api.QueryMembershipForUserResponse
+	if err := rsAPI.QueryMembershipForUser(ctx, &api.QueryMembershipForUserRequest{
+		RoomID: roomID,
+		UserID: device.UserID,
+	}, &membershipRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryMembershipForUser failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+
+	if !membershipRes.IsInRoom && membershipRes.HasBeenInRoom {
+		var eventsRes api.QueryEventsByIDResponse
+		if err := rsAPI.QueryEventsByID(ctx, &api.QueryEventsByIDRequest{
+			EventIDs: []string{membershipRes.EventID},
+		}, &eventsRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryEventsByID failed")
+			resErr := jsonerror.InternalServerError()
+			return nil, &resErr
+		}
+		if len(eventsRes.Events) == 1 {
+			membership, err := eventsRes.Events[0].Membership()
+			if err == nil && (membership == gomatrixserverlib.Leave || membership == gomatrixserverlib.Ban) {
+				return getStateAfterEvent(ctx, rsAPI, roomID, membershipRes.EventID, stateToFetch)
+			}
+		}
+	}
+
+	if !membershipRes.IsInRoom {
+		var visibilityRes api.QueryLatestEventsAndStateResponse
+		if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+			RoomID: roomID,
+			StateToFetch: []gomatrixserverlib.StateKeyTuple{
+				{EventType: gomatrixserverlib.MRoomHistoryVisibility, StateKey: ""},
+			},
+		}, &visibilityRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryLatestEventsAndState failed")
+			resErr := jsonerror.InternalServerError()
+			return nil, &resErr
+		}
+		if auth.HistoryVisibilityForRoom(gomatrixserverlib.UnwrapEventHeaders(visibilityRes.StateEvents)) != "world_readable" {
+			return nil, &util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden("You aren't a member of the room and weren't previously a member of the room."),
+			}
+		}
+	}
+
+	stateRes := api.QueryLatestEventsAndStateResponse{}
+	if err := rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID,
+		StateToFetch: stateToFetch,
+	}, &stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("queryAPI.QueryLatestEventsAndState failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return stateRes.StateEvents, nil
+}
+
+// getStateAfterEvent returns the state of the room after the given event,
+// limited to the given tuples if there are any.
+func getStateAfterEvent(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI,
+	roomID, eventID string, stateToFetch []gomatrixserverlib.StateKeyTuple,
+) ([]gomatrixserverlib.HeaderedEvent, *util.JSONResponse) {
+	if len(stateToFetch) == 0 {
+		// QueryStateAfterEvents only returns the requested tuples, so use
+		// QueryStateAndAuthChain to get the whole state.
+		var stateRes api.QueryStateAndAuthChainResponse
+		if err := rsAPI.QueryStateAndAuthChain(ctx, &api.QueryStateAndAuthChainRequest{
+			RoomID:       roomID,
+			PrevEventIDs: []string{eventID},
+		}, &stateRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryStateAndAuthChain failed")
+			resErr := jsonerror.InternalServerError()
+			return nil, &resErr
+		}
+		return stateRes.StateEvents, nil
+	}
+	var stateRes api.QueryStateAfterEventsResponse
+	if err := rsAPI.QueryStateAfterEvents(ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{eventID},
+		StateToFetch: stateToFetch,
+	}, &stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryStateAfterEvents failed")
+		resErr := jsonerror.InternalServerError()
+		return nil, &resErr
+	}
+	return stateRes.StateEvents, nil
+}
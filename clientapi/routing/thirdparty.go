@@ -0,0 +1,123 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/util"
+)
+
+// GetThirdPartyProtocols implements GET /thirdparty/protocols
+func GetThirdPartyProtocols(
+	req *http.Request, asAPI appserviceAPI.AppServiceQueryAPI,
+) util.JSONResponse {
+	var res appserviceAPI.ThirdPartyProtocolsResponse
+	if err := asAPI.ThirdPartyProtocols(req.Context(), &appserviceAPI.ThirdPartyProtocolsRequest{}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.ThirdPartyProtocols failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Protocols,
+	}
+}
+
+// GetThirdPartyProtocol implements GET /thirdparty/protocol/{protocol}
+func GetThirdPartyProtocol(
+	req *http.Request, asAPI appserviceAPI.AppServiceQueryAPI, protocol string,
+) util.JSONResponse {
+	var res appserviceAPI.ThirdPartyProtocolsResponse
+	if err := asAPI.ThirdPartyProtocols(req.Context(), &appserviceAPI.ThirdPartyProtocolsRequest{
+		Protocol: protocol,
+	}, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.ThirdPartyProtocols failed")
+		return jsonerror.InternalServerError()
+	}
+	metadata, ok := res.Protocols[protocol]
+	if !ok {
+		return util.JSONResponse{
+			Code: http.StatusNotFound,
+			JSON: jsonerror.NotFound("Unknown protocol"),
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: metadata,
+	}
+}
+
+// GetThirdPartyLocations implements GET /thirdparty/location/{protocol} and,
+// if the protocol is empty, GET /thirdparty/location
+func GetThirdPartyLocations(
+	req *http.Request, asAPI appserviceAPI.AppServiceQueryAPI, protocol string,
+) util.JSONResponse {
+	lookupReq, resErr := thirdPartyLookupRequest(req, protocol, "alias")
+	if resErr != nil {
+		return *resErr
+	}
+	var res appserviceAPI.ThirdPartyLocationsResponse
+	if err := asAPI.ThirdPartyLocations(req.Context(), lookupReq, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.ThirdPartyLocations failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Locations,
+	}
+}
+
+// GetThirdPartyUsers implements GET /thirdparty/user/{protocol} and, if the
+// protocol is empty, GET /thirdparty/user
+func GetThirdPartyUsers(
+	req *http.Request, asAPI appserviceAPI.AppServiceQueryAPI, protocol string,
+) util.JSONResponse {
+	lookupReq, resErr := thirdPartyLookupRequest(req, protocol, "userid")
+	if resErr != nil {
+		return *resErr
+	}
+	var res appserviceAPI.ThirdPartyUsersResponse
+	if err := asAPI.ThirdPartyUsers(req.Context(), lookupReq, &res); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("asAPI.ThirdPartyUsers failed")
+		return jsonerror.InternalServerError()
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res.Users,
+	}
+}
+
+// thirdPartyLookupRequest builds the lookup to send to the application services
+// from the query string of the request. Lookups without a protocol are reverse
+// lookups of the Matrix ID in the given field, which must then be present.
+func thirdPartyLookupRequest(
+	req *http.Request, protocol, reverseField string,
+) (*appserviceAPI.ThirdPartyLookupRequest, *util.JSONResponse) {
+	fields := req.URL.Query()
+	// The access token is the client's, so mustn't be passed on.
+	fields.Del("access_token")
+	if protocol == "" && fields.Get(reverseField) == "" {
+		return nil, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument(reverseField + " is required"),
+		}
+	}
+	return &appserviceAPI.ThirdPartyLookupRequest{
+		Protocol: protocol,
+		Fields:   fields,
+	}, nil
+}
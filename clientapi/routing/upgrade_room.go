@@ -0,0 +1,96 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+type upgradeRoomRequest struct {
+	NewVersion string `json:"new_version"`
+}
+
+type upgradeRoomResponse struct {
+	ReplacementRoom string `json:"replacement_room"`
+}
+
+// UpgradeRoom implements POST /rooms/{roomID}/upgrade
+func UpgradeRoom(
+	req *http.Request,
+	device *authtypes.Device,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+	roomID string,
+) util.JSONResponse {
+	var r upgradeRoomRequest
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	if r.NewVersion == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("new_version is required"),
+		}
+	}
+
+	upgradeReq := roomserverAPI.PerformUpgradeRequest{
+		RoomID:      roomID,
+		UserID:      device.UserID,
+		RoomVersion: gomatrixserverlib.RoomVersion(r.NewVersion),
+	}
+	upgradeRes := roomserverAPI.PerformUpgradeResponse{}
+	if err := rsAPI.PerformUpgrade(req.Context(), &upgradeReq, &upgradeRes); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rsAPI.PerformUpgrade failed")
+		return jsonerror.InternalServerError()
+	}
+
+	if upgradeRes.Error != nil {
+		switch upgradeRes.Error.Code {
+		case roomserverAPI.PerformErrorUnsupportedRoomVersion:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.UnsupportedRoomVersion(upgradeRes.Error.Msg),
+			}
+		case roomserverAPI.PerformErrorNoRoom:
+			return util.JSONResponse{
+				Code: http.StatusNotFound,
+				JSON: jsonerror.NotFound(upgradeRes.Error.Msg),
+			}
+		case roomserverAPI.PerformErrorNotAllowed:
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.Forbidden(upgradeRes.Error.Msg),
+			}
+		default:
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.Unknown(upgradeRes.Error.Msg),
+			}
+		}
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: upgradeRoomResponse{
+			ReplacementRoom: upgradeRes.NewRoomID,
+		},
+	}
+}
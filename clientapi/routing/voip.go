@@ -34,7 +34,6 @@ import (
 func RequestTurnServer(req *http.Request, device *authtypes.Device, cfg *config.Dendrite) util.JSONResponse {
 	turnConfig := cfg.TURN
 
-	// TODO Guest Support
 	if len(turnConfig.URIs) == 0 || turnConfig.UserLifetime == "" {
 		return util.JSONResponse{
 			Code: http.StatusOK,
@@ -42,6 +41,13 @@ func RequestTurnServer(req *http.Request, device *authtypes.Device, cfg *config.
 		}
 	}
 
+	if device.IsGuest && !turnConfig.AllowGuests {
+		return util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.GuestAccessForbidden("Guests are not allowed to use the TURN server"),
+		}
+	}
+
 	// Duration checked at startup, err not possible
 	duration, _ := time.ParseDuration(turnConfig.UserLifetime)
 
@@ -29,6 +29,10 @@ const usage = `Usage: %s
 
 Generate a new Matrix account for testing purposes.
 
+The account is either written directly to the account database given with
+--database, or registered with a running server given with --url, using the
+registration shared secret from the server's config.
+
 Arguments:
 
 `
@@ -39,6 +43,9 @@ var (
 	password      = flag.String("password", "", "Optional. The password to register with. If not specified, this account will be password-less.")
 	serverNameStr = flag.String("servername", "localhost", "The Matrix server domain which will form the domain part of the user ID.")
 	accessToken   = flag.String("token", "", "Optional. The desired access_token to have. If not specified, a random access_token will be made.")
+	admin         = flag.Bool("admin", false, "Optional. Make the account a server admin, which can use the /_dendrite/admin API.")
+	serverURL     = flag.String("url", "", "Optional. The client API URL of a running server to register the account with, e.g. 'https://localhost:8448', instead of writing to the database.")
+	sharedSecret  = flag.String("shared-secret", "", "The registration shared secret of the server, required with --url.")
 )
 
 func main() {
@@ -55,6 +62,24 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *serverURL != "" {
+		if *sharedSecret == "" {
+			flag.Usage()
+			fmt.Println("Missing --shared-secret")
+			os.Exit(1)
+		}
+		res, err := registerWithSharedSecret(*serverURL, *sharedSecret, *username, *password, *admin)
+		if err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("Created account:")
+		fmt.Printf("user_id      = %s\n", res.UserID)
+		fmt.Printf("device_id    = %s\n", res.DeviceID)
+		fmt.Printf("access_token = %s\n", res.AccessToken)
+		return
+	}
+
 	if *database == "" {
 		flag.Usage()
 		fmt.Println("Missing --database")
@@ -78,6 +103,13 @@ func main() {
 		os.Exit(1)
 	}
 
+	if *admin {
+		if err = accountDB.SetAdmin(context.Background(), *username, true); err != nil {
+			fmt.Println(err.Error())
+			os.Exit(1)
+		}
+	}
+
 	deviceDB, err := devices.NewDatabase(*database, nil, serverName)
 	if err != nil {
 		fmt.Println(err.Error())
@@ -0,0 +1,85 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+)
+
+const sharedSecretRegisterPath = "/_matrix/client/r0/admin/register"
+
+type registerResponse struct {
+	UserID      string `json:"user_id"`
+	AccessToken string `json:"access_token"`
+	DeviceID    string `json:"device_id"`
+}
+
+// registerWithSharedSecret registers an account with a running server through
+// the shared secret registration endpoint.
+func registerWithSharedSecret(
+	serverURL, sharedSecret, username, password string, admin bool,
+) (*registerResponse, error) {
+	endpoint := strings.TrimRight(serverURL, "/") + sharedSecretRegisterPath
+
+	var nonceRes struct {
+		Nonce string `json:"nonce"`
+	}
+	res, err := http.Get(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if err = decodeResponse(res, &nonceRes); err != nil {
+		return nil, fmt.Errorf("failed to get nonce: %w", err)
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"nonce":    nonceRes.Nonce,
+		"username": username,
+		"password": password,
+		"admin":    admin,
+		"mac":      auth.SharedSecretRegistrationMAC(sharedSecret, nonceRes.Nonce, username, password, admin, ""),
+	})
+	if err != nil {
+		return nil, err
+	}
+	res, err = http.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	var registerRes registerResponse
+	if err = decodeResponse(res, &registerRes); err != nil {
+		return nil, fmt.Errorf("failed to register: %w", err)
+	}
+	return &registerRes, nil
+}
+
+func decodeResponse(res *http.Response, v interface{}) error {
+	defer res.Body.Close() // nolint: errcheck
+	if res.StatusCode != http.StatusOK {
+		var errRes struct {
+			ErrCode string `json:"errcode"`
+			Err     string `json:"error"`
+		}
+		_ = json.NewDecoder(res.Body).Decode(&errRes)
+		return fmt.Errorf("HTTP %d: %s %s", res.StatusCode, errRes.ErrCode, errRes.Err)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -39,8 +39,10 @@ import (
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/keydb"
 	"github.com/matrix-org/dendrite/internal/transactions"
+	"github.com/matrix-org/dendrite/keyserver"
 	"github.com/matrix-org/dendrite/mediaapi"
 	"github.com/matrix-org/dendrite/publicroomsapi"
+	"github.com/matrix-org/dendrite/pushserver"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/syncapi"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -126,6 +128,10 @@ func main() {
 	cfg.Kafka.Topics.OutputClientData = "clientapiOutput"
 	cfg.Kafka.Topics.OutputTypingEvent = "typingServerOutput"
 	cfg.Kafka.Topics.UserUpdates = "userUpdates"
+	cfg.Kafka.Topics.OutputKeyChangeEvent = "keyChangeOutput"
+	cfg.Kafka.Topics.OutputSendToDeviceEvent = "sendToDeviceOutput"
+	cfg.Kafka.Topics.OutputReceiptEvent = "receiptOutput"
+	cfg.Kafka.Topics.OutputPresenceEvent = "presenceOutput"
 	cfg.Database.Account = config.DataSource(fmt.Sprintf("file:%s-account.db", *instanceName))
 	cfg.Database.Device = config.DataSource(fmt.Sprintf("file:%s-device.db", *instanceName))
 	cfg.Database.MediaAPI = config.DataSource(fmt.Sprintf("file:%s-mediaapi.db", *instanceName))
@@ -133,6 +139,7 @@ func main() {
 	cfg.Database.RoomServer = config.DataSource(fmt.Sprintf("file:%s-roomserver.db", *instanceName))
 	cfg.Database.ServerKey = config.DataSource(fmt.Sprintf("file:%s-serverkey.db", *instanceName))
 	cfg.Database.FederationSender = config.DataSource(fmt.Sprintf("file:%s-federationsender.db", *instanceName))
+	cfg.Database.KeyServer = config.DataSource(fmt.Sprintf("file:%s-keyserver.db", *instanceName))
 	cfg.Database.AppService = config.DataSource(fmt.Sprintf("file:%s-appservice.db", *instanceName))
 	cfg.Database.PublicRoomsAPI = config.DataSource(fmt.Sprintf("file:%s-publicroomsa.db", *instanceName))
 	cfg.Database.Naffka = config.DataSource(fmt.Sprintf("file:%s-naffka.db", *instanceName))
@@ -162,21 +169,25 @@ func main() {
 		&base.Base, federation, rsAPI, &keyRing,
 	)
 	rsAPI.SetFederationSenderAPI(fsAPI)
+	keyAPI := keyserver.SetupKeyServerComponent(
+		&base.Base, federation,
+	)
 
 	clientapi.SetupClientAPIComponent(
 		&base.Base, deviceDB, accountDB,
 		federation, &keyRing, rsAPI,
-		eduInputAPI, asAPI, transactions.New(), fsAPI,
+		eduInputAPI, asAPI, transactions.New(), fsAPI, keyAPI,
 	)
 	eduProducer := producers.NewEDUServerProducer(eduInputAPI)
-	federationapi.SetupFederationAPIComponent(&base.Base, accountDB, deviceDB, federation, &keyRing, rsAPI, asAPI, fsAPI, eduProducer)
-	mediaapi.SetupMediaAPIComponent(&base.Base, deviceDB)
+	federationapi.SetupFederationAPIComponent(&base.Base, accountDB, deviceDB, federation, &keyRing, rsAPI, asAPI, fsAPI, eduProducer, keyAPI)
+	mediaapi.SetupMediaAPIComponent(&base.Base, deviceDB, accountDB)
 	publicRoomsDB, err := storage.NewPublicRoomsServerDatabaseWithPubSub(string(base.Base.Cfg.Database.PublicRoomsAPI), base.LibP2PPubsub)
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to public rooms db")
 	}
-	publicroomsapi.SetupPublicRoomsAPIComponent(&base.Base, deviceDB, publicRoomsDB, rsAPI, federation, nil) // Check this later
-	syncapi.SetupSyncAPIComponent(&base.Base, deviceDB, accountDB, rsAPI, federation, &cfg)
+	publicroomsapi.SetupPublicRoomsAPIComponent(&base.Base, deviceDB, accountDB, publicRoomsDB, rsAPI, federation, nil) // Check this later
+	syncDB := syncapi.SetupSyncAPIComponent(&base.Base, deviceDB, accountDB, rsAPI, eduInputAPI, federation, &cfg)
+	pushserver.SetupPushServerComponent(&base.Base, accountDB, syncDB, rsAPI)
 
 	httpHandler := internal.WrapHandlerInCORS(base.Base.APIMux)
 
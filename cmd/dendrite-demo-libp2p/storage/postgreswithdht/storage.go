@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/publicroomsapi/storage/postgres"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	dht "github.com/libp2p/go-libp2p-kad-dht"
@@ -68,8 +69,8 @@ func (d *PublicRoomsServerDatabase) SetRoomVisibility(ctx context.Context, visib
 	return d.PublicRoomsServerDatabase.SetRoomVisibility(ctx, visible, roomID)
 }
 
-func (d *PublicRoomsServerDatabase) CountPublicRooms(ctx context.Context) (int64, error) {
-	count, err := d.PublicRoomsServerDatabase.CountPublicRooms(ctx)
+func (d *PublicRoomsServerDatabase) CountPublicRooms(ctx context.Context, filter string, network types.NetworkFilter) (int64, error) {
+	count, err := d.PublicRoomsServerDatabase.CountPublicRooms(ctx, filter, network)
 	if err != nil {
 		return 0, err
 	}
@@ -78,12 +79,12 @@ func (d *PublicRoomsServerDatabase) CountPublicRooms(ctx context.Context) (int64
 	return count + int64(len(d.foundRooms)), nil
 }
 
-func (d *PublicRoomsServerDatabase) GetPublicRooms(ctx context.Context, offset int64, limit int16, filter string) ([]gomatrixserverlib.PublicRoom, error) {
+func (d *PublicRoomsServerDatabase) GetPublicRooms(ctx context.Context, offset int64, limit int16, filter string, network types.NetworkFilter) ([]gomatrixserverlib.PublicRoom, error) {
 	realfilter := filter
 	if realfilter == "__local__" {
 		realfilter = ""
 	}
-	rooms, err := d.PublicRoomsServerDatabase.GetPublicRooms(ctx, offset, limit, realfilter)
+	rooms, err := d.PublicRoomsServerDatabase.GetPublicRooms(ctx, offset, limit, realfilter, network)
 	if err != nil {
 		return []gomatrixserverlib.PublicRoom{}, err
 	}
@@ -126,7 +127,7 @@ func (d *PublicRoomsServerDatabase) Interval() {
 func (d *PublicRoomsServerDatabase) AdvertiseRoomsIntoDHT() error {
 	dbCtx, dbCancel := context.WithTimeout(context.Background(), 3*time.Second)
 	_ = dbCancel
-	ourRooms, err := d.GetPublicRooms(dbCtx, 0, 1024, "__local__")
+	ourRooms, err := d.GetPublicRooms(dbCtx, 0, 1024, "__local__", types.NetworkFilter{})
 	if err != nil {
 		return err
 	}
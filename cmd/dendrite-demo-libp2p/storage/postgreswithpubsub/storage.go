@@ -23,6 +23,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/publicroomsapi/storage/postgres"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
@@ -79,16 +80,16 @@ func (d *PublicRoomsServerDatabase) SetRoomVisibility(ctx context.Context, visib
 	return d.PublicRoomsServerDatabase.SetRoomVisibility(ctx, visible, roomID)
 }
 
-func (d *PublicRoomsServerDatabase) CountPublicRooms(ctx context.Context) (int64, error) {
+func (d *PublicRoomsServerDatabase) CountPublicRooms(ctx context.Context, filter string, network types.NetworkFilter) (int64, error) {
 	d.foundRoomsMutex.RLock()
 	defer d.foundRoomsMutex.RUnlock()
 	return int64(len(d.foundRooms)), nil
 }
 
-func (d *PublicRoomsServerDatabase) GetPublicRooms(ctx context.Context, offset int64, limit int16, filter string) ([]gomatrixserverlib.PublicRoom, error) {
+func (d *PublicRoomsServerDatabase) GetPublicRooms(ctx context.Context, offset int64, limit int16, filter string, network types.NetworkFilter) ([]gomatrixserverlib.PublicRoom, error) {
 	var rooms []gomatrixserverlib.PublicRoom
 	if filter == "__local__" {
-		if r, err := d.PublicRoomsServerDatabase.GetPublicRooms(ctx, offset, limit, ""); err == nil {
+		if r, err := d.PublicRoomsServerDatabase.GetPublicRooms(ctx, offset, limit, "", network); err == nil {
 			rooms = append(rooms, r...)
 		} else {
 			return []gomatrixserverlib.PublicRoom{}, err
@@ -138,7 +139,7 @@ func (d *PublicRoomsServerDatabase) Interval() {
 func (d *PublicRoomsServerDatabase) AdvertiseRooms() error {
 	dbCtx, dbCancel := context.WithTimeout(context.Background(), 3*time.Second)
 	_ = dbCancel
-	ourRooms, err := d.GetPublicRooms(dbCtx, 0, 1024, "__local__")
+	ourRooms, err := d.GetPublicRooms(dbCtx, 0, 1024, "__local__", types.NetworkFilter{})
 	if err != nil {
 		return err
 	}
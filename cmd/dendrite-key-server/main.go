@@ -24,10 +24,9 @@ func main() {
 	base := basecomponent.NewBaseDendrite(cfg, "KeyServer", true)
 	defer base.Close() // nolint: errcheck
 
-	accountDB := base.CreateAccountsDB()
-	deviceDB := base.CreateDeviceDB()
+	federation := base.CreateFederationClient()
 
-	keyserver.SetupKeyServerComponent(base, deviceDB, accountDB)
+	keyserver.SetupKeyServerComponent(base, federation)
 
 	base.SetupAndServeHTTP(string(base.Cfg.Bind.KeyServer), string(base.Cfg.Listen.KeyServer))
 
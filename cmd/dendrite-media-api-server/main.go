@@ -25,8 +25,9 @@ func main() {
 	defer base.Close() // nolint: errcheck
 
 	deviceDB := base.CreateDeviceDB()
+	accountDB := base.CreateAccountsDB()
 
-	mediaapi.SetupMediaAPIComponent(base, deviceDB)
+	mediaapi.SetupMediaAPIComponent(base, deviceDB, accountDB)
 
 	base.SetupAndServeHTTP(string(base.Cfg.Bind.MediaAPI), string(base.Cfg.Listen.MediaAPI))
 
@@ -33,6 +33,7 @@ import (
 	"github.com/matrix-org/dendrite/mediaapi"
 	"github.com/matrix-org/dendrite/publicroomsapi"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
+	"github.com/matrix-org/dendrite/pushserver"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/syncapi"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -72,24 +73,25 @@ func main() {
 		base, federation, rsAPI, &keyRing,
 	)
 	rsAPI.SetFederationSenderAPI(fsAPI)
+	keyAPI := keyserver.SetupKeyServerComponent(
+		base, federation,
+	)
 
 	clientapi.SetupClientAPIComponent(
 		base, deviceDB, accountDB,
 		federation, &keyRing, rsAPI,
-		eduInputAPI, asAPI, transactions.New(), fsAPI,
-	)
-	keyserver.SetupKeyServerComponent(
-		base, deviceDB, accountDB,
+		eduInputAPI, asAPI, transactions.New(), fsAPI, keyAPI,
 	)
 	eduProducer := producers.NewEDUServerProducer(eduInputAPI)
-	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, rsAPI, asAPI, fsAPI, eduProducer)
-	mediaapi.SetupMediaAPIComponent(base, deviceDB)
+	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, rsAPI, asAPI, fsAPI, eduProducer, keyAPI)
+	mediaapi.SetupMediaAPIComponent(base, deviceDB, accountDB)
 	publicRoomsDB, err := storage.NewPublicRoomsServerDatabase(string(base.Cfg.Database.PublicRoomsAPI), base.Cfg.DbProperties())
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to public rooms db")
 	}
-	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, publicRoomsDB, rsAPI, federation, nil)
-	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, rsAPI, federation, cfg)
+	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, accountDB, publicRoomsDB, rsAPI, federation, nil)
+	syncDB := syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, rsAPI, eduInputAPI, federation, cfg)
+	pushserver.SetupPushServerComponent(base, accountDB, syncDB, rsAPI)
 
 	httpHandler := internal.WrapHandlerInCORS(base.APIMux)
 
@@ -27,6 +27,7 @@ func main() {
 	defer base.Close() // nolint: errcheck
 
 	deviceDB := base.CreateDeviceDB()
+	accountDB := base.CreateAccountsDB()
 
 	fsAPI := base.CreateHTTPFederationSenderAPIs()
 	rsAPI := base.CreateHTTPRoomserverAPIs()
@@ -36,7 +37,7 @@ func main() {
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to public rooms db")
 	}
-	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, publicRoomsDB, rsAPI, nil, nil)
+	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, accountDB, publicRoomsDB, rsAPI, base.CreateFederationClient(), nil)
 
 	base.SetupAndServeHTTP(string(base.Cfg.Bind.PublicRoomsAPI), string(base.Cfg.Listen.PublicRoomsAPI))
 
@@ -16,6 +16,7 @@ package main
 
 import (
 	"github.com/matrix-org/dendrite/internal/basecomponent"
+	"github.com/matrix-org/dendrite/pushserver"
 	"github.com/matrix-org/dendrite/syncapi"
 )
 
@@ -29,8 +30,10 @@ func main() {
 	federation := base.CreateFederationClient()
 
 	rsAPI := base.CreateHTTPRoomserverAPIs()
+	eduInputAPI := base.CreateHTTPEDUServerAPIs()
 
-	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, rsAPI, federation, cfg)
+	syncDB := syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, rsAPI, eduInputAPI, federation, cfg)
+	pushserver.SetupPushServerComponent(base, accountDB, syncDB, rsAPI)
 
 	base.SetupAndServeHTTP(string(base.Cfg.Bind.SyncAPI), string(base.Cfg.Listen.SyncAPI))
 
@@ -33,9 +33,11 @@ import (
 	"github.com/matrix-org/dendrite/internal/basecomponent"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/internal/transactions"
+	"github.com/matrix-org/dendrite/keyserver"
 	"github.com/matrix-org/dendrite/mediaapi"
 	"github.com/matrix-org/dendrite/publicroomsapi"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
+	"github.com/matrix-org/dendrite/pushserver"
 	"github.com/matrix-org/dendrite/roomserver"
 	"github.com/matrix-org/dendrite/syncapi"
 	go_http_js_libp2p "github.com/matrix-org/go-http-js-libp2p"
@@ -167,6 +169,7 @@ func main() {
 	cfg.Database.AppService = "file:dendritejs_appservice.db"
 	cfg.Database.Device = "file:dendritejs_device.db"
 	cfg.Database.FederationSender = "file:dendritejs_fedsender.db"
+	cfg.Database.KeyServer = "file:dendritejs_keyserver.db"
 	cfg.Database.MediaAPI = "file:dendritejs_mediaapi.db"
 	cfg.Database.Naffka = "file:dendritejs_naffka.db"
 	cfg.Database.PublicRoomsAPI = "file:dendritejs_publicrooms.db"
@@ -177,6 +180,10 @@ func main() {
 	cfg.Kafka.Topics.OutputTypingEvent = "output_typing_event"
 	cfg.Kafka.Topics.OutputClientData = "output_client_data"
 	cfg.Kafka.Topics.OutputRoomEvent = "output_room_event"
+	cfg.Kafka.Topics.OutputKeyChangeEvent = "output_key_change_event"
+	cfg.Kafka.Topics.OutputSendToDeviceEvent = "output_send_to_device_event"
+	cfg.Kafka.Topics.OutputReceiptEvent = "output_receipt_event"
+	cfg.Kafka.Topics.OutputPresenceEvent = "output_presence_event"
 	cfg.Matrix.TrustedIDServers = []string{
 		"matrix.org", "vector.im",
 	}
@@ -211,21 +218,23 @@ func main() {
 	)
 	fedSenderAPI := federationsender.SetupFederationSenderComponent(base, federation, rsAPI, &keyRing)
 	rsAPI.SetFederationSenderAPI(fedSenderAPI)
+	keyAPI := keyserver.SetupKeyServerComponent(base, federation)
 
 	clientapi.SetupClientAPIComponent(
 		base, deviceDB, accountDB,
 		federation, &keyRing, rsAPI,
-		eduInputAPI, asQuery, transactions.New(), fedSenderAPI,
+		eduInputAPI, asQuery, transactions.New(), fedSenderAPI, keyAPI,
 	)
 	eduProducer := producers.NewEDUServerProducer(eduInputAPI)
-	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, rsAPI, asQuery, fedSenderAPI, eduProducer)
-	mediaapi.SetupMediaAPIComponent(base, deviceDB)
+	federationapi.SetupFederationAPIComponent(base, accountDB, deviceDB, federation, &keyRing, rsAPI, asQuery, fedSenderAPI, eduProducer, keyAPI)
+	mediaapi.SetupMediaAPIComponent(base, deviceDB, accountDB)
 	publicRoomsDB, err := storage.NewPublicRoomsServerDatabase(string(base.Cfg.Database.PublicRoomsAPI))
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to public rooms db")
 	}
-	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, publicRoomsDB, rsAPI, federation, p2pPublicRoomProvider)
-	syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, rsAPI, federation, cfg)
+	publicroomsapi.SetupPublicRoomsAPIComponent(base, deviceDB, accountDB, publicRoomsDB, rsAPI, federation, p2pPublicRoomProvider)
+	syncDB := syncapi.SetupSyncAPIComponent(base, deviceDB, accountDB, rsAPI, eduInputAPI, federation, cfg)
+	pushserver.SetupPushServerComponent(base, accountDB, syncDB, rsAPI)
 
 	httpHandler := internal.WrapHandlerInCORS(base.APIMux)
 
@@ -15,6 +15,7 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 
@@ -45,6 +46,81 @@ type InputTypingEventRequest struct {
 // InputTypingEventResponse is a response to InputTypingEvents
 type InputTypingEventResponse struct{}
 
+// InputSendToDeviceEvent is a send-to-device message for a single device,
+// or for all of a user's devices if DeviceID is "*".
+type InputSendToDeviceEvent struct {
+	// UserID of the user to send the message to.
+	UserID string `json:"user_id"`
+	// DeviceID of the device to send the message to, or "*" for all devices.
+	DeviceID string `json:"device_id"`
+	// Sender is the user ID of the user who sent the message.
+	Sender string `json:"sender"`
+	// Type is the event type of the message, e.g. m.room_key_request.
+	Type string `json:"type"`
+	// Content is the content of the message.
+	Content json.RawMessage `json:"content"`
+}
+
+// InputSendToDeviceEventRequest is a request to EDUServerInputAPI
+type InputSendToDeviceEventRequest struct {
+	InputSendToDeviceEvent InputSendToDeviceEvent `json:"input_send_to_device_event"`
+}
+
+// InputSendToDeviceEventResponse is a response to InputSendToDeviceEventRequest
+type InputSendToDeviceEventResponse struct{}
+
+// InputReceiptEvent is a read receipt for an event in a room.
+type InputReceiptEvent struct {
+	// UserID of the user who has read the event.
+	UserID string `json:"user_id"`
+	// RoomID of the room the event is in.
+	RoomID string `json:"room_id"`
+	// EventID of the most recent event the user has read.
+	EventID string `json:"event_id"`
+	// Type of the receipt, e.g. m.read.
+	Type string `json:"type"`
+	// Timestamp when the user read the event.
+	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
+}
+
+// InputReceiptEventRequest is a request to EDUServerInputAPI
+type InputReceiptEventRequest struct {
+	InputReceiptEvent InputReceiptEvent `json:"input_receipt_event"`
+}
+
+// InputReceiptEventResponse is a response to InputReceiptEventRequest
+type InputReceiptEventResponse struct{}
+
+// InputPresenceEvent is an update to the presence of a user.
+type InputPresenceEvent struct {
+	// UserID of the user whose presence has changed.
+	UserID string `json:"user_id"`
+	// Presence is one of online, unavailable or offline.
+	Presence string `json:"presence"`
+	// StatusMsg is an optional status message set by the user.
+	StatusMsg *string `json:"status_msg,omitempty"`
+	// FromSync is true if the update comes from a local user syncing with
+	// the set_presence parameter, rather than from an explicit update.
+	FromSync bool `json:"from_sync"`
+	// FromActivity is true if the update comes from a local user doing
+	// something, such as sending an event, rather than an explicit update.
+	FromActivity bool `json:"from_activity"`
+	// LastActiveAgo is the number of milliseconds since the user was last
+	// active. Only used for remote users.
+	LastActiveAgo int64 `json:"last_active_ago"`
+	// CurrentlyActive is whether the user is currently active. Only used
+	// for remote users.
+	CurrentlyActive bool `json:"currently_active"`
+}
+
+// InputPresenceEventRequest is a request to EDUServerInputAPI
+type InputPresenceEventRequest struct {
+	InputPresenceEvent InputPresenceEvent `json:"input_presence_event"`
+}
+
+// InputPresenceEventResponse is a response to InputPresenceEventRequest
+type InputPresenceEventResponse struct{}
+
 // EDUServerInputAPI is used to write events to the typing server.
 type EDUServerInputAPI interface {
 	InputTypingEvent(
@@ -52,11 +128,38 @@ type EDUServerInputAPI interface {
 		request *InputTypingEventRequest,
 		response *InputTypingEventResponse,
 	) error
+
+	InputSendToDeviceEvent(
+		ctx context.Context,
+		request *InputSendToDeviceEventRequest,
+		response *InputSendToDeviceEventResponse,
+	) error
+
+	InputReceiptEvent(
+		ctx context.Context,
+		request *InputReceiptEventRequest,
+		response *InputReceiptEventResponse,
+	) error
+
+	InputPresenceEvent(
+		ctx context.Context,
+		request *InputPresenceEventRequest,
+		response *InputPresenceEventResponse,
+	) error
 }
 
 // EDUServerInputTypingEventPath is the HTTP path for the InputTypingEvent API.
 const EDUServerInputTypingEventPath = "/api/eduserver/input"
 
+// EDUServerInputSendToDeviceEventPath is the HTTP path for the InputSendToDeviceEvent API.
+const EDUServerInputSendToDeviceEventPath = "/api/eduserver/sendToDevice"
+
+// EDUServerInputReceiptEventPath is the HTTP path for the InputReceiptEvent API.
+const EDUServerInputReceiptEventPath = "/api/eduserver/receipt"
+
+// EDUServerInputPresenceEventPath is the HTTP path for the InputPresenceEvent API.
+const EDUServerInputPresenceEventPath = "/api/eduserver/presence"
+
 // NewEDUServerInputAPIHTTP creates a EDUServerInputAPI implemented by talking to a HTTP POST API.
 func NewEDUServerInputAPIHTTP(eduServerURL string, httpClient *http.Client) (EDUServerInputAPI, error) {
 	if httpClient == nil {
@@ -82,3 +185,42 @@ func (h *httpEDUServerInputAPI) InputTypingEvent(
 	apiURL := h.eduServerURL + EDUServerInputTypingEventPath
 	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// InputSendToDeviceEvent implements EDUServerInputAPI
+func (h *httpEDUServerInputAPI) InputSendToDeviceEvent(
+	ctx context.Context,
+	request *InputSendToDeviceEventRequest,
+	response *InputSendToDeviceEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputSendToDeviceEvent")
+	defer span.Finish()
+
+	apiURL := h.eduServerURL + EDUServerInputSendToDeviceEventPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// InputReceiptEvent implements EDUServerInputAPI
+func (h *httpEDUServerInputAPI) InputReceiptEvent(
+	ctx context.Context,
+	request *InputReceiptEventRequest,
+	response *InputReceiptEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputReceiptEvent")
+	defer span.Finish()
+
+	apiURL := h.eduServerURL + EDUServerInputReceiptEventPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// InputPresenceEvent implements EDUServerInputAPI
+func (h *httpEDUServerInputAPI) InputPresenceEvent(
+	ctx context.Context,
+	request *InputPresenceEventRequest,
+	response *InputPresenceEventResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputPresenceEvent")
+	defer span.Finish()
+
+	apiURL := h.eduServerURL + EDUServerInputPresenceEventPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
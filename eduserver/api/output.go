@@ -12,7 +12,12 @@
 
 package api
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
 
 // OutputTypingEvent is an entry in typing server output kafka log.
 // This contains the event with extra fields used to create 'm.typing' event
@@ -32,3 +37,54 @@ type TypingEvent struct {
 	UserID string `json:"user_id"`
 	Typing bool   `json:"typing"`
 }
+
+// OutputSendToDeviceEvent is an entry in the send-to-device output kafka log.
+// This contains the target user and device along with the message itself.
+// If the target user is local then the sync API will deliver the message,
+// otherwise the federation sender will send it to the remote server.
+type OutputSendToDeviceEvent struct {
+	// UserID of the user the message is for.
+	UserID string `json:"user_id"`
+	// DeviceID of the device the message is for, or "*" for all devices.
+	DeviceID string `json:"device_id"`
+	// The message itself.
+	SendToDeviceEvent
+}
+
+// SendToDeviceEvent represents a send-to-device message as it is
+// delivered to clients in the to_device section of /sync.
+type SendToDeviceEvent struct {
+	Sender  string          `json:"sender"`
+	Type    string          `json:"type"`
+	Content json.RawMessage `json:"content"`
+}
+
+// OutputReceiptEvent is an entry in the receipt output kafka log.
+// It is produced whenever a user, local or remote, sends a read receipt.
+type OutputReceiptEvent struct {
+	// UserID of the user who sent the receipt.
+	UserID string `json:"user_id"`
+	// RoomID of the room the receipt is for.
+	RoomID string `json:"room_id"`
+	// EventID of the event the receipt is for.
+	EventID string `json:"event_id"`
+	// Type of the receipt, e.g. m.read.
+	Type string `json:"type"`
+	// Timestamp when the user read the event.
+	Timestamp gomatrixserverlib.Timestamp `json:"timestamp"`
+}
+
+// OutputPresenceEvent is an entry in the presence output kafka log.
+// It is produced whenever the presence of a user, local or remote, changes.
+type OutputPresenceEvent struct {
+	// UserID of the user whose presence has changed.
+	UserID string `json:"user_id"`
+	// Presence is one of online, unavailable or offline.
+	Presence string `json:"presence"`
+	// StatusMsg is the optional status message set by the user.
+	StatusMsg *string `json:"status_msg,omitempty"`
+	// LastActiveTS is when the user was last active.
+	LastActiveTS gomatrixserverlib.Timestamp `json:"last_active_ts"`
+	// CurrentlyActive is whether the user is currently active.
+	CurrentlyActive bool `json:"currently_active"`
+}
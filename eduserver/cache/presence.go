@@ -0,0 +1,206 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// The possible presence states of a user.
+const (
+	PresenceOnline      = "online"
+	PresenceUnavailable = "unavailable"
+	PresenceOffline     = "offline"
+)
+
+const (
+	// PresenceIdleTimeout is how long a local user can go without any
+	// activity before they are marked as unavailable.
+	PresenceIdleTimeout = 5 * time.Minute
+	// PresenceSyncTimeout is how long a local user can go without syncing
+	// before they are marked as offline.
+	PresenceSyncTimeout = time.Minute
+	// PresenceFederationTimeout is how long we wait for a presence update
+	// for a remote user before assuming that they are offline.
+	PresenceFederationTimeout = 30 * time.Minute
+)
+
+// PresenceState is the current presence of a single user.
+type PresenceState struct {
+	Presence        string
+	StatusMsg       *string
+	LastActiveTS    gomatrixserverlib.Timestamp
+	CurrentlyActive bool
+	// For local users this is when they last synced, for remote users
+	// this is when we last received an update from their server.
+	lastSeen time.Time
+	// onlineSince is when syncing last brought a local user online. The
+	// idle timeout runs from the later of this and LastActiveTS.
+	onlineSince time.Time
+	// idle is true if a local user was marked as unavailable by the idle
+	// timeout rather than by choice.
+	idle  bool
+	local bool
+}
+
+// PresenceCache maintains the presence of local and remote users and
+// applies the idle and offline timeouts.
+type PresenceCache struct {
+	sync.Mutex
+	users map[string]*PresenceState
+}
+
+// NewPresenceCache returns a new PresenceCache initialised for use.
+func NewPresenceCache() *PresenceCache {
+	return &PresenceCache{users: make(map[string]*PresenceState)}
+}
+
+// Get returns the current presence of the user. Users that we know
+// nothing about are offline.
+func (c *PresenceCache) Get(userID string) PresenceState {
+	c.Lock()
+	defer c.Unlock()
+	if st, ok := c.users[userID]; ok {
+		return *st
+	}
+	return PresenceState{Presence: PresenceOffline}
+}
+
+// Must only be called after locking the cache.
+func (c *PresenceCache) getOrCreate(userID string, local bool) *PresenceState {
+	st, ok := c.users[userID]
+	if !ok {
+		st = &PresenceState{Presence: PresenceOffline}
+		c.users[userID] = st
+	}
+	st.local = local
+	return st
+}
+
+// Heartbeat records that a local user is syncing with the given presence,
+// which keeps them from going offline. Syncing isn't activity: syncing as
+// online brings an offline user, or one who chose to be unavailable, back
+// online, but a user who went idle stays unavailable until they do something.
+// Returns the new state and whether it has changed.
+func (c *PresenceCache) Heartbeat(
+	userID, presence string, now time.Time,
+) (PresenceState, bool) {
+	c.Lock()
+	defer c.Unlock()
+	st := c.getOrCreate(userID, true)
+	st.lastSeen = now
+
+	changed := false
+	switch presence {
+	case PresenceOnline:
+		if st.Presence == PresenceOffline || (st.Presence == PresenceUnavailable && !st.idle) {
+			changed = true
+			st.Presence = PresenceOnline
+			st.onlineSince = now
+		}
+	case PresenceUnavailable:
+		changed = st.Presence != PresenceUnavailable
+		st.Presence = PresenceUnavailable
+		st.CurrentlyActive = false
+		st.idle = false
+	}
+	return *st, changed
+}
+
+// MarkActive records that a local user did something, such as sending an
+// event, which brings them online and restarts the idle timeout. Returns
+// the new state and whether it has changed.
+func (c *PresenceCache) MarkActive(userID string, now time.Time) (PresenceState, bool) {
+	c.Lock()
+	defer c.Unlock()
+	st := c.getOrCreate(userID, true)
+	changed := st.Presence != PresenceOnline || !st.CurrentlyActive
+	st.Presence = PresenceOnline
+	st.LastActiveTS = gomatrixserverlib.AsTimestamp(now)
+	st.CurrentlyActive = true
+	st.idle = false
+	if st.lastSeen.Before(now) {
+		st.lastSeen = now
+	}
+	return *st, changed
+}
+
+// SetPresence records an explicit presence update, either from a local
+// user or from a remote server. Setting a local user online counts as
+// activity. Returns the new state.
+func (c *PresenceCache) SetPresence(
+	userID string, local bool, presence string, statusMsg *string,
+	lastActiveTS gomatrixserverlib.Timestamp, currentlyActive bool, now time.Time,
+) PresenceState {
+	c.Lock()
+	defer c.Unlock()
+	st := c.getOrCreate(userID, local)
+	st.lastSeen = now
+	st.Presence = presence
+	st.StatusMsg = statusMsg
+	st.idle = false
+	if local {
+		if presence == PresenceOnline {
+			st.LastActiveTS = gomatrixserverlib.AsTimestamp(now)
+		}
+		st.CurrentlyActive = presence == PresenceOnline
+	} else {
+		st.LastActiveTS = lastActiveTS
+		st.CurrentlyActive = currentlyActive
+	}
+	return *st
+}
+
+// Expire applies the idle and offline timeouts to all users, returning
+// the new state of every user whose presence changed as a result.
+func (c *PresenceCache) Expire(now time.Time) map[string]PresenceState {
+	c.Lock()
+	defer c.Unlock()
+	changes := make(map[string]PresenceState)
+	for userID, st := range c.users {
+		if st.Presence == PresenceOffline {
+			if st.StatusMsg == nil {
+				delete(c.users, userID)
+			}
+			continue
+		}
+		switch {
+		case !st.local && now.Sub(st.lastSeen) > PresenceFederationTimeout:
+			st.Presence = PresenceOffline
+		case !st.local:
+			continue
+		case now.Sub(st.lastSeen) > PresenceSyncTimeout:
+			st.Presence = PresenceOffline
+		case st.Presence == PresenceOnline && now.Sub(st.lastActive()) > PresenceIdleTimeout:
+			st.Presence = PresenceUnavailable
+			st.idle = true
+		default:
+			continue
+		}
+		st.CurrentlyActive = false
+		changes[userID] = *st
+	}
+	return changes
+}
+
+// lastActive returns the time from which the idle timeout of a local user
+// runs.
+func (st *PresenceState) lastActive() time.Time {
+	if lastActive := st.LastActiveTS.Time(); lastActive.After(st.onlineSince) {
+		return lastActive
+	}
+	return st.onlineSince
+}
@@ -0,0 +1,102 @@
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestPresenceCache(t *testing.T) {
+	c := NewPresenceCache()
+	// Last active times only have millisecond precision.
+	start := time.Now().Truncate(time.Millisecond)
+	local, remote := "@alice:localhost", "@bob:remote"
+
+	if st := c.Get(local); st.Presence != PresenceOffline {
+		t.Fatalf("unknown user has presence %q, want offline", st.Presence)
+	}
+
+	// Syncing brings the user online, but only once, and isn't activity.
+	if st, changed := c.Heartbeat(local, PresenceOnline, start); !changed || st.Presence != PresenceOnline || st.CurrentlyActive {
+		t.Fatalf("Heartbeat returned %+v changed=%v, want online but not active", st, changed)
+	}
+	if _, changed := c.Heartbeat(local, PresenceOnline, start.Add(time.Second)); changed {
+		t.Fatalf("second Heartbeat reported a change")
+	}
+
+	c.SetPresence(remote, false, PresenceOnline, nil, 0, true, start)
+
+	// Doing something restarts the idle timeout.
+	active := start.Add(PresenceSyncTimeout / 2)
+	if st, changed := c.MarkActive(local, active); !changed || st.Presence != PresenceOnline || !st.CurrentlyActive || st.LastActiveTS != gomatrixserverlib.AsTimestamp(active) {
+		t.Fatalf("MarkActive returned %+v changed=%v, want active", st, changed)
+	}
+	if _, changed := c.MarkActive(local, active.Add(time.Second)); changed {
+		t.Fatalf("second MarkActive reported a change")
+	}
+	active = active.Add(time.Second)
+
+	// A user who only syncs goes idle after the idle timeout, and syncing as
+	// online doesn't bring them back.
+	var now time.Time
+	for now = active; now.Sub(active) <= PresenceIdleTimeout; now = now.Add(PresenceSyncTimeout / 2) {
+		if _, changed := c.Heartbeat(local, PresenceOnline, now); changed {
+			t.Fatalf("Heartbeat as online reported a change for an online user")
+		}
+		if changes := c.Expire(now); len(changes) != 0 {
+			t.Fatalf("Expire returned %+v before the idle timeout", changes)
+		}
+	}
+	changes := c.Expire(now)
+	if st, ok := changes[local]; !ok || st.Presence != PresenceUnavailable || st.CurrentlyActive {
+		t.Fatalf("Expire returned %+v, want %s unavailable", changes, local)
+	}
+	if st, changed := c.Heartbeat(local, PresenceOnline, now); changed || st.Presence != PresenceUnavailable {
+		t.Fatalf("Heartbeat returned %+v changed=%v, want idle user to stay unavailable", st, changed)
+	}
+
+	// Doing something brings the idle user back.
+	if st, changed := c.MarkActive(local, now); !changed || st.Presence != PresenceOnline || !st.CurrentlyActive {
+		t.Fatalf("MarkActive returned %+v changed=%v, want idle user back online", st, changed)
+	}
+
+	// A user who chose to be unavailable comes back online by syncing.
+	if st, changed := c.Heartbeat(local, PresenceUnavailable, now); !changed || st.Presence != PresenceUnavailable || st.CurrentlyActive {
+		t.Fatalf("Heartbeat returned %+v changed=%v, want unavailable", st, changed)
+	}
+	if st, changed := c.Heartbeat(local, PresenceOnline, now); !changed || st.Presence != PresenceOnline {
+		t.Fatalf("Heartbeat returned %+v changed=%v, want online", st, changed)
+	}
+	if st, changed := c.Heartbeat(local, PresenceUnavailable, now); !changed || st.Presence != PresenceUnavailable {
+		t.Fatalf("Heartbeat returned %+v changed=%v, want unavailable", st, changed)
+	}
+
+	// Stopping syncing takes the user offline.
+	now = now.Add(PresenceSyncTimeout + time.Second)
+	changes = c.Expire(now)
+	if st, ok := changes[local]; !ok || st.Presence != PresenceOffline {
+		t.Fatalf("Expire returned %+v, want %s offline", changes, local)
+	}
+
+	// Remote users only time out after the federation timeout.
+	if st := c.Get(remote); st.Presence != PresenceOnline {
+		t.Fatalf("remote user has presence %q, want online", st.Presence)
+	}
+	changes = c.Expire(start.Add(PresenceFederationTimeout + time.Second))
+	if st, ok := changes[remote]; !ok || st.Presence != PresenceOffline {
+		t.Fatalf("Expire returned %+v, want %s offline", changes, remote)
+	}
+}
@@ -14,6 +14,7 @@ package eduserver
 
 import (
 	"net/http"
+	"time"
 
 	"github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/eduserver/cache"
@@ -21,6 +22,9 @@ import (
 	"github.com/matrix-org/dendrite/internal/basecomponent"
 )
 
+// How often to check whether users have gone idle or offline.
+const presenceExpiryInterval = 15 * time.Second
+
 // SetupEDUServerComponent sets up and registers HTTP handlers for the
 // EDUServer component. Returns instances of the various roomserver APIs,
 // allowing other components running in the same process to hit the query the
@@ -30,9 +34,18 @@ func SetupEDUServerComponent(
 	eduCache *cache.EDUCache,
 ) api.EDUServerInputAPI {
 	inputAPI := &input.EDUServerInputAPI{
-		Cache:                  eduCache,
-		Producer:               base.KafkaProducer,
-		OutputTypingEventTopic: string(base.Cfg.Kafka.Topics.OutputTypingEvent),
+		Cache:                        eduCache,
+		Producer:                     base.KafkaProducer,
+		OutputTypingEventTopic:       string(base.Cfg.Kafka.Topics.OutputTypingEvent),
+		OutputSendToDeviceEventTopic: string(base.Cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		OutputReceiptEventTopic:      string(base.Cfg.Kafka.Topics.OutputReceiptEvent),
+		OutputPresenceEventTopic:     string(base.Cfg.Kafka.Topics.OutputPresenceEvent),
+		ServerName:                   base.Cfg.Matrix.ServerName,
+	}
+
+	if !base.Cfg.Matrix.PresenceDisabled {
+		inputAPI.PresenceCache = cache.NewPresenceCache()
+		go inputAPI.ExpirePresence(presenceExpiryInterval)
 	}
 
 	if base.EnableHTTPAPIs {
@@ -24,6 +24,7 @@ import (
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
+	"github.com/sirupsen/logrus"
 )
 
 // EDUServerInputAPI implements api.EDUServerInputAPI
@@ -32,6 +33,17 @@ type EDUServerInputAPI struct {
 	Cache *cache.EDUCache
 	// The kafka topic to output new typing events to.
 	OutputTypingEventTopic string
+	// The kafka topic to output new send-to-device events to.
+	OutputSendToDeviceEventTopic string
+	// The kafka topic to output new receipt events to.
+	OutputReceiptEventTopic string
+	// Cache to store the current presence of each user. This is nil if
+	// presence is disabled, in which case presence updates are dropped.
+	PresenceCache *cache.PresenceCache
+	// The kafka topic to output presence changes to.
+	OutputPresenceEventTopic string
+	// The server name of this server, used to tell local and remote users apart.
+	ServerName gomatrixserverlib.ServerName
 	// kafka producer
 	Producer sarama.SyncProducer
 }
@@ -56,6 +68,148 @@ func (t *EDUServerInputAPI) InputTypingEvent(
 	return t.sendEvent(ite)
 }
 
+// InputSendToDeviceEvent implements api.EDUServerInputAPI
+func (t *EDUServerInputAPI) InputSendToDeviceEvent(
+	ctx context.Context,
+	request *api.InputSendToDeviceEventRequest,
+	response *api.InputSendToDeviceEventResponse,
+) error {
+	ise := &request.InputSendToDeviceEvent
+	ote := &api.OutputSendToDeviceEvent{
+		UserID:   ise.UserID,
+		DeviceID: ise.DeviceID,
+		SendToDeviceEvent: api.SendToDeviceEvent{
+			Sender:  ise.Sender,
+			Type:    ise.Type,
+			Content: ise.Content,
+		},
+	}
+
+	eventJSON, err := json.Marshal(ote)
+	if err != nil {
+		return err
+	}
+
+	m := &sarama.ProducerMessage{
+		Topic: string(t.OutputSendToDeviceEventTopic),
+		// Key by target user so that messages for a device stay in order.
+		Key:   sarama.StringEncoder(ise.UserID),
+		Value: sarama.ByteEncoder(eventJSON),
+	}
+
+	_, _, err = t.Producer.SendMessage(m)
+	return err
+}
+
+// InputReceiptEvent implements api.EDUServerInputAPI
+func (t *EDUServerInputAPI) InputReceiptEvent(
+	ctx context.Context,
+	request *api.InputReceiptEventRequest,
+	response *api.InputReceiptEventResponse,
+) error {
+	ire := &request.InputReceiptEvent
+	ore := &api.OutputReceiptEvent{
+		UserID:    ire.UserID,
+		RoomID:    ire.RoomID,
+		EventID:   ire.EventID,
+		Type:      ire.Type,
+		Timestamp: ire.Timestamp,
+	}
+
+	eventJSON, err := json.Marshal(ore)
+	if err != nil {
+		return err
+	}
+
+	m := &sarama.ProducerMessage{
+		Topic: string(t.OutputReceiptEventTopic),
+		Key:   sarama.StringEncoder(ire.RoomID),
+		Value: sarama.ByteEncoder(eventJSON),
+	}
+
+	_, _, err = t.Producer.SendMessage(m)
+	return err
+}
+
+// InputPresenceEvent implements api.EDUServerInputAPI
+func (t *EDUServerInputAPI) InputPresenceEvent(
+	ctx context.Context,
+	request *api.InputPresenceEventRequest,
+	response *api.InputPresenceEventResponse,
+) error {
+	if t.PresenceCache == nil {
+		return nil
+	}
+	ipe := &request.InputPresenceEvent
+	_, domain, err := gomatrixserverlib.SplitID('@', ipe.UserID)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var st cache.PresenceState
+	switch {
+	case domain != t.ServerName:
+		lastActive := now.Add(-time.Duration(ipe.LastActiveAgo) * time.Millisecond)
+		st = t.PresenceCache.SetPresence(
+			ipe.UserID, false, ipe.Presence, ipe.StatusMsg,
+			gomatrixserverlib.AsTimestamp(lastActive), ipe.CurrentlyActive, now,
+		)
+	case ipe.FromSync:
+		var changed bool
+		if st, changed = t.PresenceCache.Heartbeat(ipe.UserID, ipe.Presence, now); !changed {
+			return nil
+		}
+	case ipe.FromActivity:
+		var changed bool
+		if st, changed = t.PresenceCache.MarkActive(ipe.UserID, now); !changed {
+			return nil
+		}
+	default:
+		st = t.PresenceCache.SetPresence(
+			ipe.UserID, true, ipe.Presence, ipe.StatusMsg, 0, false, now,
+		)
+	}
+
+	return t.sendPresenceEvent(ipe.UserID, st)
+}
+
+// ExpirePresence applies the presence timeouts at the given interval and
+// sends updates for all users whose presence changed. It never returns.
+func (t *EDUServerInputAPI) ExpirePresence(interval time.Duration) {
+	for now := range time.Tick(interval) {
+		for userID, st := range t.PresenceCache.Expire(now) {
+			if err := t.sendPresenceEvent(userID, st); err != nil {
+				logrus.WithError(err).WithField("user_id", userID).Error("Failed to send presence timeout")
+			}
+		}
+	}
+}
+
+func (t *EDUServerInputAPI) sendPresenceEvent(userID string, st cache.PresenceState) error {
+	ope := &api.OutputPresenceEvent{
+		UserID:          userID,
+		Presence:        st.Presence,
+		StatusMsg:       st.StatusMsg,
+		LastActiveTS:    st.LastActiveTS,
+		CurrentlyActive: st.CurrentlyActive,
+	}
+
+	eventJSON, err := json.Marshal(ope)
+	if err != nil {
+		return err
+	}
+
+	m := &sarama.ProducerMessage{
+		Topic: string(t.OutputPresenceEventTopic),
+		Key:   sarama.StringEncoder(userID),
+		Value: sarama.ByteEncoder(eventJSON),
+	}
+
+	_, _, err = t.Producer.SendMessage(m)
+	return err
+}
+
 func (t *EDUServerInputAPI) sendEvent(ite *api.InputTypingEvent) error {
 	ev := &api.TypingEvent{
 		Type:   gomatrixserverlib.MTyping,
@@ -104,4 +258,43 @@ func (t *EDUServerInputAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(api.EDUServerInputSendToDeviceEventPath,
+		internal.MakeInternalAPI("inputSendToDeviceEvents", func(req *http.Request) util.JSONResponse {
+			var request api.InputSendToDeviceEventRequest
+			var response api.InputSendToDeviceEventResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := t.InputSendToDeviceEvent(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.EDUServerInputReceiptEventPath,
+		internal.MakeInternalAPI("inputReceiptEvents", func(req *http.Request) util.JSONResponse {
+			var request api.InputReceiptEventRequest
+			var response api.InputReceiptEventResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := t.InputReceiptEvent(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.EDUServerInputPresenceEventPath,
+		internal.MakeInternalAPI("inputPresenceEvents", func(req *http.Request) util.JSONResponse {
+			var request api.InputPresenceEventRequest
+			var response api.InputPresenceEventResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := t.InputPresenceEvent(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 }
@@ -20,6 +20,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/basecomponent"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 
 	// TODO: Are we really wanting to pull in the producer from clientapi
@@ -40,12 +41,13 @@ func SetupFederationAPIComponent(
 	asAPI appserviceAPI.AppServiceQueryAPI,
 	federationSenderAPI federationSenderAPI.FederationSenderInternalAPI,
 	eduProducer *producers.EDUServerProducer,
+	keyAPI keyserverAPI.KeyInternalAPI,
 ) {
 	roomserverProducer := producers.NewRoomserverProducer(rsAPI)
 
 	routing.Setup(
 		base.APIMux, base.Cfg, rsAPI, asAPI, roomserverProducer,
 		eduProducer, federationSenderAPI, *keyRing,
-		federation, accountsDB, deviceDB,
+		federation, accountsDB, deviceDB, keyAPI,
 	)
 }
@@ -13,25 +13,34 @@
 package routing
 
 import (
+	"encoding/json"
 	"net/http"
 
-	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/userutil"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/util"
 )
 
+// https://matrix.org/docs/spec/server_server/r0.1.4#get-matrix-federation-v1-user-devices-userid
 type userDevicesResponse struct {
-	UserID   string             `json:"user_id"`
-	StreamID int                `json:"stream_id"`
-	Devices  []authtypes.Device `json:"devices"`
+	UserID   string       `json:"user_id"`
+	StreamID int64        `json:"stream_id"`
+	Devices  []userDevice `json:"devices"`
+}
+
+type userDevice struct {
+	DeviceID          string          `json:"device_id"`
+	DeviceDisplayName string          `json:"device_display_name,omitempty"`
+	Keys              json.RawMessage `json:"keys,omitempty"`
 }
 
 // GetUserDevices for the given user id
 func GetUserDevices(
 	req *http.Request,
 	deviceDB devices.Database,
+	keyAPI keyserverAPI.KeyInternalAPI,
 	userID string,
 ) util.JSONResponse {
 	localpart, err := userutil.ParseUsernameParam(userID, nil)
@@ -48,14 +57,40 @@ func GetUserDevices(
 		return jsonerror.InternalServerError()
 	}
 
+	var res keyserverAPI.QueryDeviceMessagesResponse
+	err = keyAPI.QueryDeviceMessages(req.Context(), &keyserverAPI.QueryDeviceMessagesRequest{
+		UserID: userID,
+	}, &res)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("keyAPI.QueryDeviceMessages failed")
+		return jsonerror.InternalServerError()
+	}
+	if res.Error != nil {
+		util.GetLogger(req.Context()).WithError(res.Error).Error("keyAPI.QueryDeviceMessages failed")
+		return jsonerror.InternalServerError()
+	}
+	deviceKeys := make(map[string]json.RawMessage, len(res.Devices))
+	for _, dev := range res.Devices {
+		if len(dev.KeyJSON) > 0 {
+			deviceKeys[dev.DeviceID] = dev.KeyJSON
+		}
+	}
+
+	response := userDevicesResponse{
+		UserID:   userID,
+		StreamID: res.StreamID,
+		Devices:  make([]userDevice, 0, len(devs)),
+	}
+	for _, dev := range devs {
+		response.Devices = append(response.Devices, userDevice{
+			DeviceID:          dev.ID,
+			DeviceDisplayName: dev.DisplayName,
+			Keys:              deviceKeys[dev.ID],
+		})
+	}
+
 	return util.JSONResponse{
 		Code: 200,
-		// TODO: we should return an incrementing stream ID each time the device
-		// list changes for delta changes to be recognised
-		JSON: userDevicesResponse{
-			UserID:   userID,
-			StreamID: 0,
-			Devices:  devs,
-		},
+		JSON: response,
 	}
 }
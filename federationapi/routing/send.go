@@ -22,7 +22,9 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/clientapi/producers"
+	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/config"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -36,8 +38,10 @@ func Send(
 	txnID gomatrixserverlib.TransactionID,
 	cfg *config.Dendrite,
 	rsAPI api.RoomserverInternalAPI,
+	fsAPI federationSenderAPI.FederationSenderInternalAPI,
 	producer *producers.RoomserverProducer,
 	eduProducer *producers.EDUServerProducer,
+	keyAPI keyserverAPI.KeyInternalAPI,
 	keys gomatrixserverlib.KeyRing,
 	federation *gomatrixserverlib.FederationClient,
 ) util.JSONResponse {
@@ -46,6 +50,7 @@ func Send(
 		rsAPI:       rsAPI,
 		producer:    producer,
 		eduProducer: eduProducer,
+		keyAPI:      keyAPI,
 		keys:        keys,
 		federation:  federation,
 		haveEvents:  make(map[string]*gomatrixserverlib.HeaderedEvent),
@@ -73,6 +78,19 @@ func Send(
 
 	util.GetLogger(httpReq.Context()).Infof("Received transaction %q containing %d PDUs, %d EDUs", txnID, len(t.PDUs), len(t.EDUs))
 
+	// The origin server is evidently up, so stop backing off from it and
+	// retry anything that we have queued for it. This is nearly always a
+	// no-op, so don't make the transaction wait for it.
+	go func(logger *logrus.Entry, origin gomatrixserverlib.ServerName) {
+		if err := fsAPI.PerformResetBackoff(
+			context.Background(),
+			&federationSenderAPI.PerformResetBackoffRequest{ServerNames: []gomatrixserverlib.ServerName{origin}},
+			&federationSenderAPI.PerformResetBackoffResponse{},
+		); err != nil {
+			logger.WithError(err).Error("fsAPI.PerformResetBackoff failed")
+		}
+	}(util.GetLogger(httpReq.Context()), t.Origin)
+
 	resp, err := t.processTransaction()
 	if err != nil {
 		util.GetLogger(httpReq.Context()).WithError(err).Error("t.processTransaction failed")
@@ -94,6 +112,7 @@ type txnReq struct {
 	rsAPI       api.RoomserverInternalAPI
 	producer    *producers.RoomserverProducer
 	eduProducer *producers.EDUServerProducer
+	keyAPI      keyserverAPI.KeyInternalAPI
 	keys        gomatrixserverlib.JSONVerifier
 	federation  txnFederationClient
 	// local cache of events for auth checks, etc - this may include events
@@ -264,12 +283,133 @@ func (t *txnReq) processEDUs(edus []gomatrixserverlib.EDU) {
 			if err := t.eduProducer.SendTyping(t.context, typingPayload.UserID, typingPayload.RoomID, typingPayload.Typing, 30*1000); err != nil {
 				util.GetLogger(t.context).WithError(err).Error("Failed to send typing event to edu server")
 			}
+		case "m.direct_to_device":
+			// https://matrix.org/docs/spec/server_server/r0.1.4#send-to-device-messaging
+			t.processSendToDevice(e)
+		case "m.device_list_update":
+			// https://matrix.org/docs/spec/server_server/r0.1.4#device-management
+			t.processDeviceListUpdate(e)
+		case "m.receipt":
+			// https://matrix.org/docs/spec/server_server/r0.1.4#receipts
+			t.processReceipt(e)
+		case "m.presence":
+			// https://matrix.org/docs/spec/server_server/r0.1.4#presence
+			t.processPresence(e)
 		default:
 			util.GetLogger(t.context).WithField("type", e.Type).Warn("unhandled edu")
 		}
 	}
 }
 
+func (t *txnReq) processSendToDevice(e gomatrixserverlib.EDU) {
+	var payload struct {
+		Sender    string                                `json:"sender"`
+		Type      string                                `json:"type"`
+		MessageID string                                `json:"message_id"`
+		Messages  map[string]map[string]json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(e.Content, &payload); err != nil {
+		util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal send-to-device event")
+		return
+	}
+	// Servers may only send messages on behalf of their own users.
+	_, senderServerName, err := gomatrixserverlib.SplitID('@', payload.Sender)
+	if err != nil || senderServerName != t.Origin {
+		util.GetLogger(t.context).WithField("sender", payload.Sender).Warn("Ignoring send-to-device event with invalid sender")
+		return
+	}
+	for userID, byDevice := range payload.Messages {
+		// Only deliver messages for our own users.
+		_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || serverName != t.Destination {
+			util.GetLogger(t.context).WithField("user_id", userID).Warn("Ignoring send-to-device event for non-local user")
+			continue
+		}
+		for deviceID, message := range byDevice {
+			if err := t.eduProducer.SendToDevice(t.context, payload.Sender, userID, deviceID, payload.Type, message); err != nil {
+				util.GetLogger(t.context).WithError(err).WithField("message_id", payload.MessageID).Error("Failed to send send-to-device event to edu server")
+			}
+		}
+	}
+}
+
+func (t *txnReq) processReceipt(e gomatrixserverlib.EDU) {
+	// The content is keyed by room ID, then receipt type, then user ID.
+	var payload map[string]map[string]map[string]struct {
+		EventIDs []string `json:"event_ids"`
+		Data     struct {
+			TS gomatrixserverlib.Timestamp `json:"ts"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(e.Content, &payload); err != nil {
+		util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal receipt event")
+		return
+	}
+	for roomID, byType := range payload {
+		for receiptType, byUser := range byType {
+			for userID, receipt := range byUser {
+				// Servers may only send receipts on behalf of their own users.
+				_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+				if err != nil || serverName != t.Origin {
+					util.GetLogger(t.context).WithField("user_id", userID).Warn("Ignoring receipt with invalid sender")
+					continue
+				}
+				for _, eventID := range receipt.EventIDs {
+					if err := t.eduProducer.SendReceipt(t.context, userID, roomID, eventID, receiptType, receipt.Data.TS); err != nil {
+						util.GetLogger(t.context).WithError(err).WithField("room_id", roomID).Error("Failed to send receipt event to edu server")
+					}
+				}
+			}
+		}
+	}
+}
+
+func (t *txnReq) processPresence(e gomatrixserverlib.EDU) {
+	var payload struct {
+		Push []struct {
+			UserID          string  `json:"user_id"`
+			Presence        string  `json:"presence"`
+			StatusMsg       *string `json:"status_msg"`
+			LastActiveAgo   int64   `json:"last_active_ago"`
+			CurrentlyActive bool    `json:"currently_active"`
+		} `json:"push"`
+	}
+	if err := json.Unmarshal(e.Content, &payload); err != nil {
+		util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal presence event")
+		return
+	}
+	for _, p := range payload.Push {
+		// Servers may only send presence for their own users.
+		_, serverName, err := gomatrixserverlib.SplitID('@', p.UserID)
+		if err != nil || serverName != t.Origin {
+			util.GetLogger(t.context).WithField("user_id", p.UserID).Warn("Ignoring presence with invalid sender")
+			continue
+		}
+		if err := t.eduProducer.SendRemotePresence(t.context, p.UserID, p.Presence, p.StatusMsg, p.LastActiveAgo, p.CurrentlyActive); err != nil {
+			util.GetLogger(t.context).WithError(err).WithField("user_id", p.UserID).Error("Failed to send presence event to edu server")
+		}
+	}
+}
+
+func (t *txnReq) processDeviceListUpdate(e gomatrixserverlib.EDU) {
+	var payload keyserverAPI.DeviceListUpdateEvent
+	if err := json.Unmarshal(e.Content, &payload); err != nil {
+		util.GetLogger(t.context).WithError(err).Error("Failed to unmarshal device list update event")
+		return
+	}
+	var res keyserverAPI.InputDeviceListUpdateResponse
+	err := t.keyAPI.InputDeviceListUpdate(t.context, &keyserverAPI.InputDeviceListUpdateRequest{
+		Origin: t.Origin,
+		Event:  payload,
+	}, &res)
+	if err == nil && res.Error != nil {
+		err = res.Error
+	}
+	if err != nil {
+		util.GetLogger(t.context).WithError(err).WithField("user_id", payload.UserID).Error("Failed to process device list update")
+	}
+}
+
 func (t *txnReq) processEvent(e gomatrixserverlib.Event, isInboundTxn bool) error {
 	prevEventIDs := e.PrevEventIDs()
 
@@ -77,6 +77,30 @@ func (p *testEDUProducer) InputTypingEvent(
 	return nil
 }
 
+func (p *testEDUProducer) InputSendToDeviceEvent(
+	ctx context.Context,
+	request *eduAPI.InputSendToDeviceEventRequest,
+	response *eduAPI.InputSendToDeviceEventResponse,
+) error {
+	return nil
+}
+
+func (p *testEDUProducer) InputReceiptEvent(
+	ctx context.Context,
+	request *eduAPI.InputReceiptEventRequest,
+	response *eduAPI.InputReceiptEventResponse,
+) error {
+	return nil
+}
+
+func (p *testEDUProducer) InputPresenceEvent(
+	ctx context.Context,
+	request *eduAPI.InputPresenceEventRequest,
+	response *eduAPI.InputPresenceEventResponse,
+) error {
+	return nil
+}
+
 type testRoomserverAPI struct {
 	inputRoomEvents           []api.InputRoomEvent
 	queryStateAfterEvents     func(*api.QueryStateAfterEventsRequest) api.QueryStateAfterEventsResponse
@@ -114,6 +138,30 @@ func (t *testRoomserverAPI) PerformLeave(
 	return nil
 }
 
+func (t *testRoomserverAPI) PerformUpgrade(
+	ctx context.Context,
+	req *api.PerformUpgradeRequest,
+	res *api.PerformUpgradeResponse,
+) error {
+	return nil
+}
+
+func (t *testRoomserverAPI) PerformAdminEvictUsers(
+	ctx context.Context,
+	req *api.PerformAdminEvictUsersRequest,
+	res *api.PerformAdminEvictUsersResponse,
+) error {
+	return nil
+}
+
+func (t *testRoomserverAPI) PerformAdminPurgeRoom(
+	ctx context.Context,
+	req *api.PerformAdminPurgeRoomRequest,
+	res *api.PerformAdminPurgeRoomResponse,
+) error {
+	return nil
+}
+
 // Query the latest events and state for a room from the room server.
 func (t *testRoomserverAPI) QueryLatestEventsAndState(
 	ctx context.Context,
@@ -192,6 +240,15 @@ func (t *testRoomserverAPI) QueryServerAllowedToSeeEvent(
 	return fmt.Errorf("not implemented")
 }
 
+// Query which of the given events a local user is allowed to see
+func (t *testRoomserverAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	request *api.QueryUserAllowedToSeeEventsRequest,
+	response *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
 // Query missing events for a room from roomserver
 func (t *testRoomserverAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -240,6 +297,22 @@ func (t *testRoomserverAPI) QueryRoomVersionForRoom(
 	return nil
 }
 
+func (t *testRoomserverAPI) QueryRoomsForUser(
+	ctx context.Context,
+	request *api.QueryRoomsForUserRequest,
+	response *api.QueryRoomsForUserResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
+func (t *testRoomserverAPI) QueryRooms(
+	ctx context.Context,
+	request *api.QueryRoomsRequest,
+	response *api.QueryRoomsResponse,
+) error {
+	return fmt.Errorf("not implemented")
+}
+
 // Set a room alias
 func (t *testRoomserverAPI) SetRoomAlias(
 	ctx context.Context,
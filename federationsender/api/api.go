@@ -42,6 +42,19 @@ type FederationSenderInternalAPI interface {
 		request *PerformLeaveRequest,
 		response *PerformLeaveResponse,
 	) error
+	// Clear the backoff for remote servers, e.g. because we have heard from
+	// them, and retry anything that is queued for them straight away.
+	PerformResetBackoff(
+		ctx context.Context,
+		request *PerformResetBackoffRequest,
+		response *PerformResetBackoffResponse,
+	) error
+	// Query the remote servers that we are currently backing off from.
+	QueryServerBackoffs(
+		ctx context.Context,
+		request *QueryServerBackoffsRequest,
+		response *QueryServerBackoffsResponse,
+	) error
 }
 
 // NewFederationSenderInternalAPIHTTP creates a FederationSenderInternalAPI implemented by talking to a HTTP POST API.
@@ -18,6 +18,9 @@ const (
 
 	// FederationSenderPerformLeaveRequestPath is the HTTP path for the PerformLeaveRequest API.
 	FederationSenderPerformLeaveRequestPath = "/api/federationsender/performLeaveRequest"
+
+	// FederationSenderPerformResetBackoffPath is the HTTP path for the PerformResetBackoff API.
+	FederationSenderPerformResetBackoffPath = "/api/federationsender/performResetBackoff"
 )
 
 type PerformDirectoryLookupRequest struct {
@@ -87,3 +90,23 @@ func (h *httpFederationSenderInternalAPI) PerformLeave(
 	apiURL := h.federationSenderURL + FederationSenderPerformLeaveRequestPath
 	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+type PerformResetBackoffRequest struct {
+	ServerNames []gomatrixserverlib.ServerName `json:"server_names"`
+}
+
+type PerformResetBackoffResponse struct {
+}
+
+// Handle an instruction to clear the backoff for remote servers.
+func (h *httpFederationSenderInternalAPI) PerformResetBackoff(
+	ctx context.Context,
+	request *PerformResetBackoffRequest,
+	response *PerformResetBackoffResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformResetBackoff")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderPerformResetBackoffPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -16,6 +16,9 @@ const FederationSenderQueryJoinedHostsInRoomPath = "/api/federationsender/queryJ
 // FederationSenderQueryJoinedHostServerNamesInRoomPath is the HTTP path for the QueryJoinedHostServerNamesInRoom API.
 const FederationSenderQueryJoinedHostServerNamesInRoomPath = "/api/federationsender/queryJoinedHostServerNamesInRoom"
 
+// FederationSenderQueryServerBackoffsPath is the HTTP path for the QueryServerBackoffs API.
+const FederationSenderQueryServerBackoffsPath = "/api/federationsender/queryServerBackoffs"
+
 // QueryJoinedHostsInRoomRequest is a request to QueryJoinedHostsInRoom
 type QueryJoinedHostsInRoomRequest struct {
 	RoomID string `json:"room_id"`
@@ -61,3 +64,25 @@ func (h *httpFederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 	apiURL := h.federationSenderURL + FederationSenderQueryJoinedHostServerNamesInRoomPath
 	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+// QueryServerBackoffsRequest is a request to QueryServerBackoffs
+type QueryServerBackoffsRequest struct {
+}
+
+// QueryServerBackoffsResponse is a response to QueryServerBackoffs
+type QueryServerBackoffsResponse struct {
+	Servers []types.ServerBackoff `json:"servers"`
+}
+
+// QueryServerBackoffs implements FederationSenderInternalAPI
+func (h *httpFederationSenderInternalAPI) QueryServerBackoffs(
+	ctx context.Context,
+	request *QueryServerBackoffsRequest,
+	response *QueryServerBackoffsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryServerBackoffs")
+	defer span.Finish()
+
+	apiURL := h.federationSenderURL + FederationSenderQueryServerBackoffsPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -23,6 +23,7 @@ import (
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -105,3 +106,181 @@ func (t *OutputTypingEventConsumer) onMessage(msg *sarama.ConsumerMessage) error
 
 	return t.queues.SendEDU(edu, t.ServerName, names)
 }
+
+// OutputSendToDeviceEventConsumer consumes send-to-device events that originate in EDU server.
+type OutputSendToDeviceEventConsumer struct {
+	consumer   *internal.ContinualConsumer
+	db         storage.Database
+	queues     *queue.OutgoingQueues
+	ServerName gomatrixserverlib.ServerName
+}
+
+// NewOutputSendToDeviceEventConsumer creates a new OutputSendToDeviceEventConsumer. Call Start() to begin consuming from EDU servers.
+func NewOutputSendToDeviceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+) *OutputSendToDeviceEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	c := &OutputSendToDeviceEventConsumer{
+		consumer:   &consumer,
+		queues:     queues,
+		db:         store,
+		ServerName: cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming from EDU servers
+func (t *OutputSendToDeviceEventConsumer) Start() error {
+	return t.consumer.Start()
+}
+
+// onMessage is called for OutputSendToDeviceEvent received from the EDU servers.
+// Parses the msg, creates a matrix federation EDU and sends it to the server
+// that the target user belongs to.
+func (t *OutputSendToDeviceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var ote api.OutputSendToDeviceEvent
+	if err := json.Unmarshal(msg.Value, &ote); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("eduserver output log: message parse failed")
+		return nil
+	}
+
+	// only send send-to-device events which originated from us
+	_, originServerName, err := gomatrixserverlib.SplitID('@', ote.Sender)
+	if err != nil {
+		log.WithError(err).WithField("user_id", ote.Sender).Error("Failed to extract domain from send-to-device sender")
+		return nil
+	}
+	if originServerName != t.ServerName {
+		log.WithField("other_server", originServerName).Info("Suppressing send-to-device: originated elsewhere")
+		return nil
+	}
+
+	// messages for our own users are delivered by the sync API
+	_, destServerName, err := gomatrixserverlib.SplitID('@', ote.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", ote.UserID).Error("Failed to extract domain from send-to-device target")
+		return nil
+	}
+	if destServerName == t.ServerName {
+		return nil
+	}
+
+	// https://matrix.org/docs/spec/server_server/r0.1.4#send-to-device-messaging
+	edu := &gomatrixserverlib.EDU{Type: "m.direct_to_device"}
+	if edu.Content, err = json.Marshal(map[string]interface{}{
+		"sender":     ote.Sender,
+		"type":       ote.Type,
+		"message_id": util.RandomString(32),
+		"messages": map[string]map[string]json.RawMessage{
+			ote.UserID: {
+				ote.DeviceID: ote.Content,
+			},
+		},
+	}); err != nil {
+		return err
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":     ote.UserID,
+		"destination": destServerName,
+		"type":        ote.Type,
+	}).Info("Sending send-to-device message over federation")
+	return t.queues.SendEDU(edu, t.ServerName, []gomatrixserverlib.ServerName{destServerName})
+}
+
+// OutputReceiptEventConsumer consumes receipt events that originate in EDU server.
+type OutputReceiptEventConsumer struct {
+	consumer   *internal.ContinualConsumer
+	db         storage.Database
+	queues     *queue.OutgoingQueues
+	ServerName gomatrixserverlib.ServerName
+}
+
+// NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer. Call Start() to begin consuming from EDU servers.
+func NewOutputReceiptEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+) *OutputReceiptEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputReceiptEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	c := &OutputReceiptEventConsumer{
+		consumer:   &consumer,
+		queues:     queues,
+		db:         store,
+		ServerName: cfg.Matrix.ServerName,
+	}
+	consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming from EDU servers
+func (t *OutputReceiptEventConsumer) Start() error {
+	return t.consumer.Start()
+}
+
+// onMessage is called for OutputReceiptEvent received from the EDU servers.
+// Parses the msg, creates a matrix federation EDU and sends it to joined hosts.
+func (t *OutputReceiptEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	// Extract the receipt event from msg.
+	var ore api.OutputReceiptEvent
+	if err := json.Unmarshal(msg.Value, &ore); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("eduserver output log: message parse failed")
+		return nil
+	}
+
+	// only send receipts which originated from us
+	_, receiptServerName, err := gomatrixserverlib.SplitID('@', ore.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", ore.UserID).Error("Failed to extract domain from receipt sender")
+		return nil
+	}
+	if receiptServerName != t.ServerName {
+		return nil
+	}
+
+	joined, err := t.db.GetJoinedHosts(context.TODO(), ore.RoomID)
+	if err != nil {
+		return err
+	}
+
+	names := make([]gomatrixserverlib.ServerName, len(joined))
+	for i := range joined {
+		names[i] = joined[i].ServerName
+	}
+
+	// The content is keyed by room ID, then receipt type, then user ID.
+	edu := &gomatrixserverlib.EDU{Type: "m.receipt"}
+	if edu.Content, err = json.Marshal(map[string]interface{}{
+		ore.RoomID: map[string]interface{}{
+			ore.Type: map[string]interface{}{
+				ore.UserID: map[string]interface{}{
+					"event_ids": []string{ore.EventID},
+					"data": map[string]interface{}{
+						"ts": ore.Timestamp,
+					},
+				},
+			},
+		},
+	}); err != nil {
+		return err
+	}
+
+	return t.queues.SendEDU(edu, t.ServerName, names)
+}
@@ -0,0 +1,135 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/federationsender/queue"
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputPresenceEventConsumer consumes presence updates that originate in EDU server.
+type OutputPresenceEventConsumer struct {
+	consumer   *internal.ContinualConsumer
+	db         storage.Database
+	queues     *queue.OutgoingQueues
+	serverName gomatrixserverlib.ServerName
+	rsAPI      roomserverAPI.RoomserverInternalAPI
+}
+
+// NewOutputPresenceEventConsumer creates a new OutputPresenceEventConsumer. Call Start() to begin consuming from EDU servers.
+func NewOutputPresenceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	queues *queue.OutgoingQueues,
+	store storage.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) *OutputPresenceEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputPresenceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+	c := &OutputPresenceEventConsumer{
+		consumer:   &consumer,
+		queues:     queues,
+		db:         store,
+		serverName: cfg.Matrix.ServerName,
+		rsAPI:      rsAPI,
+	}
+	consumer.ProcessMessage = c.onMessage
+
+	return c
+}
+
+// Start consuming from EDU servers
+func (t *OutputPresenceEventConsumer) Start() error {
+	return t.consumer.Start()
+}
+
+// onMessage is called for OutputPresenceEvent received from the EDU servers.
+// It sends an m.presence EDU to every server which shares a room with the user.
+func (t *OutputPresenceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var ope api.OutputPresenceEvent
+	if err := json.Unmarshal(msg.Value, &ope); err != nil {
+		// Skip this msg but continue processing messages.
+		log.WithError(err).Errorf("eduserver output log: message parse failed")
+		return nil
+	}
+
+	// only send presence updates which originated from us
+	_, presenceServerName, err := gomatrixserverlib.SplitID('@', ope.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", ope.UserID).Error("Failed to extract domain from presence update")
+		return nil
+	}
+	if presenceServerName != t.serverName {
+		return nil
+	}
+
+	var queryRes roomserverAPI.QueryRoomsForUserResponse
+	err = t.rsAPI.QueryRoomsForUser(context.Background(), &roomserverAPI.QueryRoomsForUserRequest{
+		UserID:         ope.UserID,
+		WantMembership: "join",
+	}, &queryRes)
+	if err != nil {
+		log.WithError(err).Error("failed to calculate joined rooms for user")
+		return nil
+	}
+	var destinations []gomatrixserverlib.ServerName
+	for _, roomID := range queryRes.RoomIDs {
+		joined, err := t.db.GetJoinedHosts(context.Background(), roomID)
+		if err != nil {
+			log.WithError(err).WithField("room_id", roomID).Error("failed to calculate joined hosts for room")
+			return nil
+		}
+		for _, host := range joined {
+			destinations = append(destinations, host.ServerName)
+		}
+	}
+	if len(destinations) == 0 {
+		return nil
+	}
+
+	update := map[string]interface{}{
+		"user_id":          ope.UserID,
+		"presence":         ope.Presence,
+		"currently_active": ope.CurrentlyActive,
+	}
+	if ope.StatusMsg != nil {
+		update["status_msg"] = *ope.StatusMsg
+	}
+	if ope.LastActiveTS != 0 {
+		update["last_active_ago"] = time.Since(ope.LastActiveTS.Time()).Milliseconds()
+	}
+	edu := &gomatrixserverlib.EDU{Type: "m.presence"}
+	if edu.Content, err = json.Marshal(map[string]interface{}{
+		"push": []interface{}{update},
+	}); err != nil {
+		return err
+	}
+
+	return t.queues.SendEDU(edu, t.serverName, destinations)
+}
@@ -118,6 +118,16 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 			}).Panicf("roomserver output log: write invite event failure")
 			return nil
 		}
+	case api.OutputTypePurgeRoom:
+		log.WithField("room_id", output.PurgeRoom.RoomID).Info("received purge room from roomserver")
+
+		if err := s.processPurgeRoom(context.TODO(), *output.PurgeRoom); err != nil {
+			log.WithFields(log.Fields{
+				"room_id":    output.PurgeRoom.RoomID,
+				log.ErrorKey: err,
+			}).Error("roomserver output log: failed to purge room")
+			return err
+		}
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -128,6 +138,18 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 	return nil
 }
 
+// processPurgeRoom forgets the joined hosts for the room and removes its
+// events from the outgoing queues.
+func (s *OutputRoomEventConsumer) processPurgeRoom(ctx context.Context, opr api.OutputPurgeRoom) error {
+	if err := s.db.PurgeRoom(ctx, opr.RoomID); err != nil {
+		return fmt.Errorf("s.db.PurgeRoom: %w", err)
+	}
+	if err := s.queues.PurgeRoom(ctx, opr.RoomID); err != nil {
+		return fmt.Errorf("s.queues.PurgeRoom: %w", err)
+	}
+	return nil
+}
+
 // processMessage updates the list of currently joined hosts in the room
 // and then sends the event to the hosts that were joined before the event.
 func (s *OutputRoomEventConsumer) processMessage(ore api.OutputNewRoomEvent) error {
@@ -15,6 +15,7 @@
 package federationsender
 
 import (
+	"context"
 	"net/http"
 
 	"github.com/matrix-org/dendrite/federationsender/api"
@@ -47,9 +48,12 @@ func SetupFederationSenderComponent(
 		rsAPI, base.Cfg.Matrix.ServerName, base.Cfg.Matrix.KeyID, base.Cfg.Matrix.PrivateKey,
 	)
 
-	statistics := &types.Statistics{}
+	statistics, err := types.NewStatistics(context.Background(), federationSenderDB)
+	if err != nil {
+		logrus.WithError(err).Panic("failed to load federation backoffs")
+	}
 	queues := queue.NewOutgoingQueues(
-		base.Cfg.Matrix.ServerName, federation, roomserverProducer, statistics,
+		federationSenderDB, base.Cfg.Matrix.ServerName, federation, roomserverProducer, statistics,
 	)
 
 	rsConsumer := consumers.NewOutputRoomEventConsumer(
@@ -67,9 +71,39 @@ func SetupFederationSenderComponent(
 		logrus.WithError(err).Panic("failed to start typing server consumer")
 	}
 
+	receiptConsumer := consumers.NewOutputReceiptEventConsumer(
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB,
+	)
+	if err := receiptConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start receipt consumer")
+	}
+
+	if !base.Cfg.Matrix.PresenceDisabled {
+		presenceConsumer := consumers.NewOutputPresenceEventConsumer(
+			base.Cfg, base.KafkaConsumer, queues, federationSenderDB, rsAPI,
+		)
+		if err := presenceConsumer.Start(); err != nil {
+			logrus.WithError(err).Panic("failed to start presence consumer")
+		}
+	}
+
+	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEventConsumer(
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB,
+	)
+	if err := sendToDeviceConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start send-to-device consumer")
+	}
+
+	keyConsumer := consumers.NewKeyChangeConsumer(
+		base.Cfg, base.KafkaConsumer, queues, federationSenderDB, rsAPI,
+	)
+	if err := keyConsumer.Start(); err != nil {
+		logrus.WithError(err).Panic("failed to start key server consumer")
+	}
+
 	queryAPI := internal.NewFederationSenderInternalAPI(
 		federationSenderDB, base.Cfg, roomserverProducer, federation, keyRing,
-		statistics,
+		statistics, queues,
 	)
 
 	if base.EnableHTTPAPIs {
@@ -25,7 +25,7 @@ func (r *FederationSenderInternalAPI) PerformDirectoryLookup(
 		request.RoomAlias,
 	)
 	if err != nil {
-		r.statistics.ForServer(request.ServerName).Failure()
+		r.statistics.ForServer(request.ServerName).RequestFailed(err)
 		return err
 	}
 	response.RoomID = dir.RoomID
@@ -96,7 +96,7 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 	)
 	if err != nil {
 		// TODO: Check if the user was not allowed to join the room.
-		r.statistics.ForServer(serverName).Failure()
+		r.statistics.ForServer(serverName).RequestFailed(err)
 		return fmt.Errorf("r.federation.MakeJoin: %w", err)
 	}
 	r.statistics.ForServer(serverName).Success()
@@ -148,7 +148,7 @@ func (r *FederationSenderInternalAPI) performJoinUsingServer(
 		respMakeJoin.RoomVersion,
 	)
 	if err != nil {
-		r.statistics.ForServer(serverName).Failure()
+		r.statistics.ForServer(serverName).RequestFailed(err)
 		return fmt.Errorf("r.federation.SendJoin: %w", err)
 	}
 	r.statistics.ForServer(serverName).Success()
@@ -198,7 +198,7 @@ func (r *FederationSenderInternalAPI) PerformLeave(
 		if err != nil {
 			// TODO: Check if the user was not allowed to leave the room.
 			logrus.WithError(err).Warnf("r.federation.MakeLeave failed")
-			r.statistics.ForServer(serverName).Failure()
+			r.statistics.ForServer(serverName).RequestFailed(err)
 			continue
 		}
 
@@ -250,7 +250,7 @@ func (r *FederationSenderInternalAPI) PerformLeave(
 		)
 		if err != nil {
 			logrus.WithError(err).Warnf("r.federation.SendLeave failed")
-			r.statistics.ForServer(serverName).Failure()
+			r.statistics.ForServer(serverName).RequestFailed(err)
 			continue
 		}
 
@@ -264,3 +264,15 @@ func (r *FederationSenderInternalAPI) PerformLeave(
 		request.RoomID, len(request.ServerNames),
 	)
 }
+
+// PerformResetBackoff implements api.FederationSenderInternalAPI
+func (r *FederationSenderInternalAPI) PerformResetBackoff(
+	ctx context.Context,
+	request *api.PerformResetBackoffRequest,
+	response *api.PerformResetBackoffResponse,
+) error {
+	for _, serverName := range request.ServerNames {
+		r.queues.RetryServer(serverName)
+	}
+	return nil
+}
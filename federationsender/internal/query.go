@@ -37,3 +37,13 @@ func (f *FederationSenderInternalAPI) QueryJoinedHostServerNamesInRoom(
 
 	return
 }
+
+// QueryServerBackoffs implements api.FederationSenderInternalAPI
+func (f *FederationSenderInternalAPI) QueryServerBackoffs(
+	ctx context.Context,
+	request *api.QueryServerBackoffsRequest,
+	response *api.QueryServerBackoffsResponse,
+) error {
+	response.Servers = f.statistics.Backoffs()
+	return nil
+}
@@ -21,6 +21,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/federationsender/producers"
+	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -29,66 +30,188 @@ import (
 	"go.uber.org/atomic"
 )
 
+const (
+	// maxPDUsPerTransaction is the maximum number of PDUs that the
+	// federation spec allows us to send in a single transaction.
+	maxPDUsPerTransaction = 50
+	// maxEDUsPerTransaction is the maximum number of EDUs that the
+	// federation spec allows us to send in a single transaction.
+	maxEDUsPerTransaction = 100
+)
+
 // destinationQueue is a queue of events for a single destination.
 // It is responsible for sending the events to the destination and
 // ensures that only one request is in flight to a given destination
-// at a time.
+// at a time. Everything in the queue is also persisted in the database
+// so that it survives restarts, and is only removed from there once
+// the destination has accepted it.
 type destinationQueue struct {
-	rsProducer         *producers.RoomserverProducer           // roomserver producer
-	client             *gomatrixserverlib.FederationClient     // federation client
-	origin             gomatrixserverlib.ServerName            // origin of requests
-	destination        gomatrixserverlib.ServerName            // destination of requests
-	running            atomic.Bool                             // is the queue worker running?
-	statistics         *types.ServerStatistics                 // statistics about this remote server
-	incomingPDUs       chan *gomatrixserverlib.HeaderedEvent   // PDUs to send
-	incomingEDUs       chan *gomatrixserverlib.EDU             // EDUs to send
-	incomingInvites    chan *gomatrixserverlib.InviteV2Request // invites to send
-	lastTransactionIDs []gomatrixserverlib.TransactionID       // last transaction ID
-	pendingPDUs        []*gomatrixserverlib.HeaderedEvent      // owned by backgroundSend
-	pendingEDUs        []*gomatrixserverlib.EDU                // owned by backgroundSend
-	pendingInvites     []*gomatrixserverlib.InviteV2Request    // owned by backgroundSend
+	db                 storage.Database                    // database for persisting the queue
+	rsProducer         *producers.RoomserverProducer       // roomserver producer
+	client             *gomatrixserverlib.FederationClient // federation client
+	origin             gomatrixserverlib.ServerName        // origin of requests
+	destination        gomatrixserverlib.ServerName        // destination of requests
+	running            atomic.Bool                         // is the queue worker running?
+	reloadPending      atomic.Bool                         // should the worker reload the pending queues from the database?
+	statistics         *types.ServerStatistics             // statistics about this remote server
+	interruptBackoff   chan bool                           // interrupts the backoff wait
+	incomingPDUs       chan *types.QueuedPDU               // PDUs to send
+	incomingEDUs       chan *types.QueuedEDU               // EDUs to send
+	incomingInvites    chan *types.QueuedInvite            // invites to send
+	lastTransactionIDs []gomatrixserverlib.TransactionID   // last transaction ID
+	pendingPDUs        []*types.QueuedPDU                  // owned by backgroundSend
+	pendingEDUs        []*types.QueuedEDU                  // owned by backgroundSend
+	pendingInvites     []*types.QueuedInvite               // owned by backgroundSend
+}
+
+// retrievePending loads anything that was left in the persisted queue
+// for this destination, e.g. from before a restart, and starts the
+// worker goroutine if there is anything to send. It must only be called
+// before the worker has been started for the first time.
+func (oq *destinationQueue) retrievePending(ctx context.Context) error {
+	if err := oq.loadPending(ctx); err != nil {
+		return err
+	}
+	if oq.statistics.Blacklisted() {
+		// We'll try again when we next hear from the destination.
+		return nil
+	}
+	if len(oq.pendingPDUs) > 0 || len(oq.pendingEDUs) > 0 || len(oq.pendingInvites) > 0 {
+		log.WithFields(log.Fields{
+			"destination": oq.destination,
+			"pdus":        len(oq.pendingPDUs),
+			"edus":        len(oq.pendingEDUs),
+			"invites":     len(oq.pendingInvites),
+		}).Info("Retrying persisted federation queue")
+		go oq.backgroundSend()
+	}
+	return nil
+}
+
+// loadPending replaces the pending queues with everything in the persisted
+// queue for this destination. Entries which failed to persist are kept. It
+// must only be called when the worker isn't running, or by the worker.
+func (oq *destinationQueue) loadPending(ctx context.Context) error {
+	pdus, err := oq.db.GetQueuedPDUs(ctx, oq.destination)
+	if err != nil {
+		return fmt.Errorf("oq.db.GetQueuedPDUs: %w", err)
+	}
+	edus, err := oq.db.GetQueuedEDUs(ctx, oq.destination)
+	if err != nil {
+		return fmt.Errorf("oq.db.GetQueuedEDUs: %w", err)
+	}
+	invites, err := oq.db.GetQueuedInvites(ctx, oq.destination)
+	if err != nil {
+		return fmt.Errorf("oq.db.GetQueuedInvites: %w", err)
+	}
+	pendingPDUs := make([]*types.QueuedPDU, 0, len(pdus))
+	for i := range pdus {
+		pendingPDUs = append(pendingPDUs, &pdus[i])
+	}
+	for _, pdu := range oq.pendingPDUs {
+		if pdu.NID == 0 {
+			pendingPDUs = append(pendingPDUs, pdu)
+		}
+	}
+	pendingEDUs := make([]*types.QueuedEDU, 0, len(edus))
+	for i := range edus {
+		pendingEDUs = append(pendingEDUs, &edus[i])
+	}
+	for _, edu := range oq.pendingEDUs {
+		if edu.NID == 0 {
+			pendingEDUs = append(pendingEDUs, edu)
+		}
+	}
+	pendingInvites := make([]*types.QueuedInvite, 0, len(invites))
+	for i := range invites {
+		pendingInvites = append(pendingInvites, &invites[i])
+	}
+	for _, invite := range oq.pendingInvites {
+		if invite.NID == 0 {
+			pendingInvites = append(pendingInvites, invite)
+		}
+	}
+	oq.pendingPDUs, oq.pendingEDUs, oq.pendingInvites = pendingPDUs, pendingEDUs, pendingInvites
+	return nil
+}
+
+// wakeQueueIfNeeded starts the worker goroutine if it isn't running,
+// or otherwise interrupts its backoff, so that anything pending is
+// retried straight away.
+func (oq *destinationQueue) wakeQueueIfNeeded() {
+	if !oq.running.Load() {
+		go oq.backgroundSend()
+		return
+	}
+	select {
+	case oq.interruptBackoff <- true:
+	default:
+	}
 }
 
 // Send event adds the event to the pending queue for the destination.
 // If the queue is empty then it starts a background goroutine to
 // start sending events to that destination.
 func (oq *destinationQueue) sendEvent(ev *gomatrixserverlib.HeaderedEvent) {
-	if oq.statistics.Blacklisted() {
-		// If the destination is blacklisted then drop the event.
+	nid, err := oq.db.StoreQueuedPDU(context.TODO(), oq.destination, ev)
+	if err != nil {
+		// We can still try to send the event, it just won't survive
+		// a restart.
+		log.WithFields(log.Fields{
+			"event_id":    ev.EventID(),
+			"destination": oq.destination,
+		}).WithError(err).Error("failed to persist PDU in queue")
+	} else if oq.statistics.Blacklisted() {
+		// Don't try to send to a blacklisted destination. The event
+		// will be loaded from the database when we next hear from it.
+		oq.reloadPending.Store(true)
 		return
 	}
 	if !oq.running.Load() {
 		go oq.backgroundSend()
 	}
-	oq.incomingPDUs <- ev
+	oq.incomingPDUs <- &types.QueuedPDU{NID: nid, Event: ev}
 }
 
 // sendEDU adds the EDU event to the pending queue for the destination.
 // If the queue is empty then it starts a background goroutine to
 // start sending events to that destination.
 func (oq *destinationQueue) sendEDU(ev *gomatrixserverlib.EDU) {
-	if oq.statistics.Blacklisted() {
-		// If the destination is blacklisted then drop the event.
+	nid, err := oq.db.StoreQueuedEDU(context.TODO(), oq.destination, ev)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"edu_type":    ev.Type,
+			"destination": oq.destination,
+		}).WithError(err).Error("failed to persist EDU in queue")
+	} else if oq.statistics.Blacklisted() {
+		oq.reloadPending.Store(true)
 		return
 	}
 	if !oq.running.Load() {
 		go oq.backgroundSend()
 	}
-	oq.incomingEDUs <- ev
+	oq.incomingEDUs <- &types.QueuedEDU{NID: nid, EDU: ev}
 }
 
 // sendInvite adds the invite event to the pending queue for the
 // destination. If the queue is empty then it starts a background
 // goroutine to start sending events to that destination.
 func (oq *destinationQueue) sendInvite(ev *gomatrixserverlib.InviteV2Request) {
-	if oq.statistics.Blacklisted() {
-		// If the destination is blacklisted then drop the event.
+	nid, err := oq.db.StoreQueuedInvite(context.TODO(), oq.destination, ev)
+	if err != nil {
+		inviteEvent := ev.Event()
+		log.WithFields(log.Fields{
+			"event_id":    inviteEvent.EventID(),
+			"destination": oq.destination,
+		}).WithError(err).Error("failed to persist invite in queue")
+	} else if oq.statistics.Blacklisted() {
+		oq.reloadPending.Store(true)
 		return
 	}
 	if !oq.running.Load() {
 		go oq.backgroundSend()
 	}
-	oq.incomingInvites <- ev
+	oq.incomingInvites <- &types.QueuedInvite{NID: nid, Invite: ev}
 }
 
 // backgroundSend is the worker goroutine for sending events.
@@ -102,52 +225,61 @@ func (oq *destinationQueue) backgroundSend() {
 	defer oq.running.Store(false)
 
 	for {
-		// Wait either for incoming events, or until we hit an
-		// idle timeout.
-		select {
-		case pdu := <-oq.incomingPDUs:
-			// Ordering of PDUs is important so we add them to the end
-			// of the queue and they will all be added to transactions
-			// in order.
-			oq.pendingPDUs = append(oq.pendingPDUs, pdu)
-		case edu := <-oq.incomingEDUs:
-			// Likewise for EDUs, although we should probably not try
-			// too hard with some EDUs (like typing notifications) after
-			// a certain amount of time has passed.
-			// TODO: think about EDU expiry some more
-			oq.pendingEDUs = append(oq.pendingEDUs, edu)
-		case invite := <-oq.incomingInvites:
-			// There's no strict ordering requirement for invites like
-			// there is for transactions, so we put the invite onto the
-			// front of the queue. This means that if an invite that is
-			// stuck failing already, that it won't block our new invite
-			// from being sent.
-			oq.pendingInvites = append(
-				[]*gomatrixserverlib.InviteV2Request{invite},
-				oq.pendingInvites...,
-			)
-		case <-time.After(time.Second * 30):
-			// The worker is idle so stop the goroutine. It'll
-			// get restarted automatically the next time we
-			// get an event.
-			return
+		// If the persisted queue has changed underneath us then reload it
+		// before deciding whether there is anything to send.
+		oq.reloadPendingIfNeeded()
+
+		if len(oq.pendingPDUs) == 0 && len(oq.pendingEDUs) == 0 && len(oq.pendingInvites) == 0 {
+			// There's nothing left to send, so wait either for incoming
+			// events, or until we hit an idle timeout.
+			select {
+			case pdu := <-oq.incomingPDUs:
+				oq.queuePDU(pdu)
+			case edu := <-oq.incomingEDUs:
+				oq.queueEDU(edu)
+			case invite := <-oq.incomingInvites:
+				oq.queueInvite(invite)
+			case <-time.After(time.Second * 30):
+				// The worker is idle so stop the goroutine. It'll
+				// get restarted automatically the next time we
+				// get an event.
+				return
+			}
 		}
 
+		// Pick up anything else that has arrived in the meantime.
+		oq.collectIncoming()
+
 		// If we are backing off this server then wait for the
-		// backoff duration to complete first.
+		// backoff duration to complete first, unless we are woken
+		// up early because we heard from the server.
 		if backoff, duration := oq.statistics.BackoffDuration(); backoff {
-			<-time.After(duration)
+			select {
+			case <-time.After(duration):
+			case <-oq.interruptBackoff:
+			}
+			oq.reloadPendingIfNeeded()
 		}
 
-		// How many things do we have waiting?
+		// How many things do we have waiting? Transactions have a
+		// maximum size, so anything beyond that will be sent in the
+		// next transaction.
 		numPDUs := len(oq.pendingPDUs)
+		if numPDUs > maxPDUsPerTransaction {
+			numPDUs = maxPDUsPerTransaction
+		}
 		numEDUs := len(oq.pendingEDUs)
+		if numEDUs > maxEDUsPerTransaction {
+			numEDUs = maxEDUsPerTransaction
+		}
 		numInvites := len(oq.pendingInvites)
 
 		// If we have pending PDUs or EDUs then construct a transaction.
 		if numPDUs > 0 || numEDUs > 0 {
 			// Try sending the next transaction and see what happens.
-			transaction, terr := oq.nextTransaction(oq.pendingPDUs, oq.pendingEDUs, oq.statistics.SuccessCount())
+			transaction, terr := oq.nextTransaction(
+				oq.pendingPDUs[:numPDUs], oq.pendingEDUs[:numEDUs], oq.statistics.SuccessCount(),
+			)
 			if terr != nil {
 				// We failed to send the transaction.
 				if giveUp := oq.statistics.Failure(); giveUp {
@@ -157,8 +289,17 @@ func (oq *destinationQueue) backgroundSend() {
 				}
 			} else if transaction {
 				// If we successfully sent the transaction then clear out
-				// the pending events and EDUs.
+				// the pending events and EDUs, both from the database and
+				// from memory.
 				oq.statistics.Success()
+				var nids []int64
+				for _, pdu := range oq.pendingPDUs[:numPDUs] {
+					nids = append(nids, pdu.NID)
+				}
+				for _, edu := range oq.pendingEDUs[:numEDUs] {
+					nids = append(nids, edu.NID)
+				}
+				oq.removeQueued(nids)
 				// Reallocate so that the underlying arrays can be GC'd, as
 				// opposed to growing forever.
 				for i := 0; i < numPDUs; i++ {
@@ -168,11 +309,11 @@ func (oq *destinationQueue) backgroundSend() {
 					oq.pendingEDUs[i] = nil
 				}
 				oq.pendingPDUs = append(
-					[]*gomatrixserverlib.HeaderedEvent{},
+					[]*types.QueuedPDU{},
 					oq.pendingPDUs[numPDUs:]...,
 				)
 				oq.pendingEDUs = append(
-					[]*gomatrixserverlib.EDU{},
+					[]*types.QueuedEDU{},
 					oq.pendingEDUs[numEDUs:]...,
 				)
 			}
@@ -181,6 +322,22 @@ func (oq *destinationQueue) backgroundSend() {
 		// Try sending the next invite and see what happens.
 		if numInvites > 0 {
 			sent, ierr := oq.nextInvites(oq.pendingInvites)
+			if sent > 0 {
+				// Whatever happened to the rest of the invites, these
+				// ones were accepted so clear them out of the database
+				// and the pending invites.
+				var nids []int64
+				for _, invite := range oq.pendingInvites[:sent] {
+					nids = append(nids, invite.NID)
+				}
+				oq.removeQueued(nids)
+				// Reallocate so that the underlying array can be GC'd, as
+				// opposed to growing forever.
+				oq.pendingInvites = append(
+					[]*types.QueuedInvite{},
+					oq.pendingInvites[sent:]...,
+				)
+			}
 			if ierr != nil {
 				// We failed to send the transaction so increase the
 				// backoff and give it another go shortly.
@@ -190,26 +347,98 @@ func (oq *destinationQueue) backgroundSend() {
 					return
 				}
 			} else if sent > 0 {
-				// If we successfully sent the invites then clear out
-				// the pending invites.
 				oq.statistics.Success()
-				// Reallocate so that the underlying array can be GC'd, as
-				// opposed to growing forever.
-				oq.pendingInvites = append(
-					[]*gomatrixserverlib.InviteV2Request{},
-					oq.pendingInvites[sent:]...,
-				)
 			}
 		}
 	}
 }
 
+// queuePDU adds an incoming PDU to the pending queue.
+func (oq *destinationQueue) queuePDU(pdu *types.QueuedPDU) {
+	// Ordering of PDUs is important so we add them to the end
+	// of the queue and they will all be added to transactions
+	// in order.
+	oq.pendingPDUs = append(oq.pendingPDUs, pdu)
+}
+
+// queueEDU adds an incoming EDU to the pending queue.
+func (oq *destinationQueue) queueEDU(edu *types.QueuedEDU) {
+	// Likewise for EDUs, although we should probably not try
+	// too hard with some EDUs (like typing notifications) after
+	// a certain amount of time has passed.
+	// TODO: think about EDU expiry some more
+	oq.pendingEDUs = append(oq.pendingEDUs, edu)
+}
+
+// queueInvite adds an incoming invite to the pending queue.
+func (oq *destinationQueue) queueInvite(invite *types.QueuedInvite) {
+	// There's no strict ordering requirement for invites like
+	// there is for transactions, so we put the invite onto the
+	// front of the queue. This means that if an invite that is
+	// stuck failing already, that it won't block our new invite
+	// from being sent.
+	oq.pendingInvites = append(
+		[]*types.QueuedInvite{invite},
+		oq.pendingInvites...,
+	)
+}
+
+// reloadPendingIfNeeded replaces the pending queues with the persisted
+// queue if anything was queued only in the database, e.g. while the
+// destination was blacklisted, or if entries were removed from the
+// database, e.g. because a room was purged. Anything waiting on the
+// incoming channels is persisted too, so it is picked up first.
+func (oq *destinationQueue) reloadPendingIfNeeded() {
+	if !oq.reloadPending.Swap(false) {
+		return
+	}
+	oq.collectIncoming()
+	if err := oq.loadPending(context.TODO()); err != nil {
+		log.WithFields(log.Fields{
+			"destination": oq.destination,
+		}).WithError(err).Error("failed to reload persisted queue")
+	}
+}
+
+// collectIncoming moves anything waiting on the incoming channels
+// into the pending queues without blocking.
+func (oq *destinationQueue) collectIncoming() {
+	for {
+		select {
+		case pdu := <-oq.incomingPDUs:
+			oq.queuePDU(pdu)
+		case edu := <-oq.incomingEDUs:
+			oq.queueEDU(edu)
+		case invite := <-oq.incomingInvites:
+			oq.queueInvite(invite)
+		default:
+			return
+		}
+	}
+}
+
+// removeQueued removes entries that the destination has accepted from
+// the persisted queue. Entries that failed to persist have no NID.
+func (oq *destinationQueue) removeQueued(nids []int64) {
+	persisted := make([]int64, 0, len(nids))
+	for _, nid := range nids {
+		if nid != 0 {
+			persisted = append(persisted, nid)
+		}
+	}
+	if err := oq.db.RemoveQueued(context.TODO(), persisted); err != nil {
+		log.WithFields(log.Fields{
+			"destination": oq.destination,
+		}).WithError(err).Error("failed to remove sent entries from queue")
+	}
+}
+
 // nextTransaction creates a new transaction from the pending event
 // queue and sends it. Returns true if a transaction was sent or
 // false otherwise.
 func (oq *destinationQueue) nextTransaction(
-	pendingPDUs []*gomatrixserverlib.HeaderedEvent,
-	pendingEDUs []*gomatrixserverlib.EDU,
+	pendingPDUs []*types.QueuedPDU,
+	pendingEDUs []*types.QueuedEDU,
 	sentCounter uint32,
 ) (bool, error) {
 	t := gomatrixserverlib.Transaction{
@@ -231,18 +460,15 @@ func (oq *destinationQueue) nextTransaction(
 	for _, pdu := range pendingPDUs {
 		// Append the JSON of the event, since this is a json.RawMessage type in the
 		// gomatrixserverlib.Transaction struct
-		t.PDUs = append(t.PDUs, (*pdu).JSON())
+		t.PDUs = append(t.PDUs, pdu.Event.JSON())
 	}
 
 	for _, edu := range pendingEDUs {
-		t.EDUs = append(t.EDUs, *edu)
+		t.EDUs = append(t.EDUs, *edu.EDU)
 	}
 
 	logrus.WithField("server_name", oq.destination).Infof("Sending transaction %q containing %d PDUs, %d EDUs", t.TransactionID, len(t.PDUs), len(t.EDUs))
 
-	// TODO: we should check for 500-ish fails vs 400-ish here,
-	// since we shouldn't queue things indefinitely in response
-	// to a 400-ish error
 	_, err := oq.client.SendTransaction(context.TODO(), t)
 	switch e := err.(type) {
 	case nil:
@@ -272,10 +498,11 @@ func (oq *destinationQueue) nextTransaction(
 // nextInvite takes pending invite events from the queue and sends
 // them. Returns true if a transaction was sent or false otherwise.
 func (oq *destinationQueue) nextInvites(
-	pendingInvites []*gomatrixserverlib.InviteV2Request,
+	pendingInvites []*types.QueuedInvite,
 ) (int, error) {
 	done := 0
-	for _, inviteReq := range pendingInvites {
+	for _, queued := range pendingInvites {
+		inviteReq := queued.Invite
 		ev, roomVersion := inviteReq.Event(), inviteReq.RoomVersion()
 
 		log.WithFields(log.Fields{
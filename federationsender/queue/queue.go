@@ -15,10 +15,12 @@
 package queue
 
 import (
+	"context"
 	"fmt"
 	"sync"
 
 	"github.com/matrix-org/dendrite/federationsender/producers"
+	"github.com/matrix-org/dendrite/federationsender/storage"
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -28,6 +30,7 @@ import (
 // OutgoingQueues is a collection of queues for sending transactions to other
 // matrix servers
 type OutgoingQueues struct {
+	db          storage.Database
 	rsProducer  *producers.RoomserverProducer
 	origin      gomatrixserverlib.ServerName
 	client      *gomatrixserverlib.FederationClient
@@ -36,20 +39,42 @@ type OutgoingQueues struct {
 	queues      map[gomatrixserverlib.ServerName]*destinationQueue
 }
 
-// NewOutgoingQueues makes a new OutgoingQueues
+// NewOutgoingQueues makes a new OutgoingQueues. Anything that was left
+// in the persisted queues, e.g. from before a restart, will be retried.
 func NewOutgoingQueues(
+	db storage.Database,
 	origin gomatrixserverlib.ServerName,
 	client *gomatrixserverlib.FederationClient,
 	rsProducer *producers.RoomserverProducer,
 	statistics *types.Statistics,
 ) *OutgoingQueues {
-	return &OutgoingQueues{
+	oqs := &OutgoingQueues{
+		db:         db,
 		rsProducer: rsProducer,
 		origin:     origin,
 		client:     client,
 		statistics: statistics,
 		queues:     map[gomatrixserverlib.ServerName]*destinationQueue{},
 	}
+	oqs.retrievePending(context.Background())
+	return oqs
+}
+
+// retrievePending starts the queues for any destinations that still
+// have entries in the persisted queues.
+func (oqs *OutgoingQueues) retrievePending(ctx context.Context) {
+	serverNames, err := oqs.db.GetQueuedServerNames(ctx)
+	if err != nil {
+		log.WithError(err).Error("failed to retrieve queued destinations")
+		return
+	}
+	for _, serverName := range serverNames {
+		if err = oqs.getQueue(serverName).retrievePending(ctx); err != nil {
+			log.WithFields(log.Fields{
+				"destination": serverName,
+			}).WithError(err).Error("failed to retrieve queue for destination")
+		}
+	}
 }
 
 func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *destinationQueue {
@@ -58,20 +83,37 @@ func (oqs *OutgoingQueues) getQueue(destination gomatrixserverlib.ServerName) *d
 	oq := oqs.queues[destination]
 	if oq == nil {
 		oq = &destinationQueue{
-			rsProducer:      oqs.rsProducer,
-			origin:          oqs.origin,
-			destination:     destination,
-			client:          oqs.client,
-			statistics:      oqs.statistics.ForServer(destination),
-			incomingPDUs:    make(chan *gomatrixserverlib.HeaderedEvent, 128),
-			incomingEDUs:    make(chan *gomatrixserverlib.EDU, 128),
-			incomingInvites: make(chan *gomatrixserverlib.InviteV2Request, 128),
+			db:               oqs.db,
+			rsProducer:       oqs.rsProducer,
+			origin:           oqs.origin,
+			destination:      destination,
+			client:           oqs.client,
+			statistics:       oqs.statistics.ForServer(destination),
+			interruptBackoff: make(chan bool, 1),
+			incomingPDUs:     make(chan *types.QueuedPDU, 128),
+			incomingEDUs:     make(chan *types.QueuedEDU, 128),
+			incomingInvites:  make(chan *types.QueuedInvite, 128),
 		}
 		oqs.queues[destination] = oq
 	}
 	return oq
 }
 
+// RetryServer clears any backoff or blacklist for the destination, e.g.
+// because we have just heard from it, and retries anything that is still
+// queued for it straight away.
+func (oqs *OutgoingQueues) RetryServer(destination gomatrixserverlib.ServerName) {
+	if !oqs.statistics.ForServer(destination).ClearBackoff() {
+		return
+	}
+	oqs.queuesMutex.Lock()
+	oq := oqs.queues[destination]
+	oqs.queuesMutex.Unlock()
+	if oq != nil {
+		oq.wakeQueueIfNeeded()
+	}
+}
+
 // SendEvent sends an event to the destinations
 func (oqs *OutgoingQueues) SendEvent(
 	ev *gomatrixserverlib.HeaderedEvent, origin gomatrixserverlib.ServerName,
@@ -160,6 +202,61 @@ func (oqs *OutgoingQueues) SendEDU(
 	return nil
 }
 
+// PurgeRoom removes the PDUs and invites for the room from the outgoing
+// queues, apart from leave events, which remote servers still need to
+// hear about. Any running queues reload what is left from the database
+// before sending their next transaction.
+func (oqs *OutgoingQueues) PurgeRoom(ctx context.Context, roomID string) error {
+	serverNames, err := oqs.db.GetQueuedServerNames(ctx)
+	if err != nil {
+		return fmt.Errorf("oqs.db.GetQueuedServerNames: %w", err)
+	}
+	for _, serverName := range serverNames {
+		pdus, err := oqs.db.GetQueuedPDUs(ctx, serverName)
+		if err != nil {
+			return fmt.Errorf("oqs.db.GetQueuedPDUs: %w", err)
+		}
+		invites, err := oqs.db.GetQueuedInvites(ctx, serverName)
+		if err != nil {
+			return fmt.Errorf("oqs.db.GetQueuedInvites: %w", err)
+		}
+		nids := purgedNIDs(roomID, pdus, invites)
+		if len(nids) == 0 {
+			continue
+		}
+		if err = oqs.db.RemoveQueued(ctx, nids); err != nil {
+			return fmt.Errorf("oqs.db.RemoveQueued: %w", err)
+		}
+		oqs.getQueue(serverName).reloadPending.Store(true)
+	}
+	return nil
+}
+
+// purgedNIDs returns the queue positions of the PDUs and invites which
+// should be dropped when the room is purged.
+func purgedNIDs(
+	roomID string, pdus []types.QueuedPDU, invites []types.QueuedInvite,
+) []int64 {
+	var nids []int64
+	for _, pdu := range pdus {
+		if pdu.Event.RoomID() != roomID {
+			continue
+		}
+		if pdu.Event.Type() == gomatrixserverlib.MRoomMember {
+			if membership, err := pdu.Event.Membership(); err == nil && membership == gomatrixserverlib.Leave {
+				continue
+			}
+		}
+		nids = append(nids, pdu.NID)
+	}
+	for _, invite := range invites {
+		if ev := invite.Invite.Event(); ev.RoomID() == roomID {
+			nids = append(nids, invite.NID)
+		}
+	}
+	return nids
+}
+
 // filterAndDedupeDests removes our own server from the list of destinations
 // and deduplicates any servers in the list that may appear more than once.
 func filterAndDedupeDests(origin gomatrixserverlib.ServerName, destinations []gomatrixserverlib.ServerName) (
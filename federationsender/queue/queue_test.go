@@ -0,0 +1,95 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/dendrite/federationsender/storage/sqlite3"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var testServer = gomatrixserverlib.ServerName("remote.example.com")
+
+func mustCreateEvent(t *testing.T, eventID, roomID, evType, stateKey, content string) *gomatrixserverlib.HeaderedEvent {
+	stateKeyJSON := ""
+	if evType == gomatrixserverlib.MRoomMember {
+		stateKeyJSON = fmt.Sprintf(`"state_key":%q,`, stateKey)
+	}
+	eventJSON := fmt.Sprintf(
+		`{"auth_events":[],"content":%s,"depth":1,"event_id":%q,"hashes":{"sha256":"abc"},"origin":"localhost","origin_server_ts":1,"prev_events":[],"room_id":%q,"sender":"@alice:localhost","signatures":{},%s"type":%q}`,
+		content, eventID, roomID, stateKeyJSON, evType,
+	)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON returned %s", err)
+	}
+	headered := ev.Headered(gomatrixserverlib.RoomVersionV1)
+	return &headered
+}
+
+func TestPurgeRoom(t *testing.T) {
+	ctx := context.Background()
+	db, err := sqlite3.NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("NewDatabase returned %s", err)
+	}
+	oqs := NewOutgoingQueues(db, "localhost", nil, nil, &types.Statistics{})
+
+	message := mustCreateEvent(t, "$message:localhost", "!purged:localhost", "m.room.message", "", `{"body":"hello"}`)
+	leave := mustCreateEvent(t, "$leave:localhost", "!purged:localhost", gomatrixserverlib.MRoomMember, "@alice:localhost", `{"membership":"leave"}`)
+	other := mustCreateEvent(t, "$other:localhost", "!other:localhost", "m.room.message", "", `{"body":"hello"}`)
+	invite := mustCreateEvent(t, "$invite:localhost", "!purged:localhost", gomatrixserverlib.MRoomMember, "@bob:remote.example.com", `{"membership":"invite"}`)
+	for _, ev := range []*gomatrixserverlib.HeaderedEvent{message, leave, other} {
+		if _, err = db.StoreQueuedPDU(ctx, testServer, ev); err != nil {
+			t.Fatalf("StoreQueuedPDU returned %s", err)
+		}
+	}
+	inviteReq, err := gomatrixserverlib.NewInviteV2Request(invite, nil)
+	if err != nil {
+		t.Fatalf("NewInviteV2Request returned %s", err)
+	}
+	if _, err = db.StoreQueuedInvite(ctx, testServer, &inviteReq); err != nil {
+		t.Fatalf("StoreQueuedInvite returned %s", err)
+	}
+
+	if err = oqs.PurgeRoom(ctx, "!purged:localhost"); err != nil {
+		t.Fatalf("PurgeRoom returned %s", err)
+	}
+
+	// The leave event and the event in the other room are still queued.
+	pdus, err := db.GetQueuedPDUs(ctx, testServer)
+	if err != nil {
+		t.Fatalf("GetQueuedPDUs returned %s", err)
+	}
+	if len(pdus) != 2 || pdus[0].Event.EventID() != leave.EventID() || pdus[1].Event.EventID() != other.EventID() {
+		t.Fatalf("GetQueuedPDUs returned wrong PDUs after purge: %+v", pdus)
+	}
+	invites, err := db.GetQueuedInvites(ctx, testServer)
+	if err != nil {
+		t.Fatalf("GetQueuedInvites returned %s", err)
+	}
+	if len(invites) != 0 {
+		t.Fatalf("GetQueuedInvites returned invites after purge: %+v", invites)
+	}
+
+	// The queue picks up the change before it next sends anything.
+	if !oqs.getQueue(testServer).reloadPending.Load() {
+		t.Fatalf("PurgeRoom didn't ask the queue to reload")
+	}
+}
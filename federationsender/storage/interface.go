@@ -19,10 +19,21 @@ import (
 
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 type Database interface {
 	internal.PartitionStorer
+	types.BackoffStorer
 	UpdateRoom(ctx context.Context, roomID, oldEventID, newEventID string, addHosts []types.JoinedHost, removeHosts []string) (joinedHosts []types.JoinedHost, err error)
 	GetJoinedHosts(ctx context.Context, roomID string) ([]types.JoinedHost, error)
+	PurgeRoom(ctx context.Context, roomID string) error
+	StoreQueuedPDU(ctx context.Context, serverName gomatrixserverlib.ServerName, event *gomatrixserverlib.HeaderedEvent) (int64, error)
+	StoreQueuedEDU(ctx context.Context, serverName gomatrixserverlib.ServerName, edu *gomatrixserverlib.EDU) (int64, error)
+	StoreQueuedInvite(ctx context.Context, serverName gomatrixserverlib.ServerName, invite *gomatrixserverlib.InviteV2Request) (int64, error)
+	GetQueuedPDUs(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]types.QueuedPDU, error)
+	GetQueuedEDUs(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]types.QueuedEDU, error)
+	GetQueuedInvites(ctx context.Context, serverName gomatrixserverlib.ServerName) ([]types.QueuedInvite, error)
+	RemoveQueued(ctx context.Context, nids []int64) error
+	GetQueuedServerNames(ctx context.Context) ([]gomatrixserverlib.ServerName, error)
 }
@@ -0,0 +1,113 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const backoffSchema = `
+-- The backoff table stores the backoff state of remote servers that
+-- we have failed to reach, so that it survives restarts.
+CREATE TABLE IF NOT EXISTS federationsender_backoff (
+    -- The remote server.
+    server_name TEXT NOT NULL PRIMARY KEY,
+    -- How many times in a row we have failed to reach the server.
+    failure_count BIGINT NOT NULL,
+    -- The time until which we won't try the server again, in milliseconds.
+    backoff_until BIGINT NOT NULL,
+    -- Whether we have given up on the server until we hear from it.
+    blacklisted BOOLEAN NOT NULL
+);
+`
+
+const upsertBackoffSQL = "" +
+	"INSERT INTO federationsender_backoff (server_name, failure_count, backoff_until, blacklisted)" +
+	" VALUES ($1, $2, $3, $4)" +
+	" ON CONFLICT (server_name)" +
+	" DO UPDATE SET failure_count = EXCLUDED.failure_count, backoff_until = EXCLUDED.backoff_until, blacklisted = EXCLUDED.blacklisted"
+
+const deleteBackoffSQL = "" +
+	"DELETE FROM federationsender_backoff WHERE server_name = $1"
+
+const selectBackoffsSQL = "" +
+	"SELECT server_name, failure_count, backoff_until, blacklisted FROM federationsender_backoff"
+
+type backoffStatements struct {
+	upsertBackoffStmt  *sql.Stmt
+	deleteBackoffStmt  *sql.Stmt
+	selectBackoffsStmt *sql.Stmt
+}
+
+func (s *backoffStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(backoffSchema)
+	if err != nil {
+		return
+	}
+	if s.upsertBackoffStmt, err = db.Prepare(upsertBackoffSQL); err != nil {
+		return
+	}
+	if s.deleteBackoffStmt, err = db.Prepare(deleteBackoffSQL); err != nil {
+		return
+	}
+	if s.selectBackoffsStmt, err = db.Prepare(selectBackoffsSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *backoffStatements) upsertBackoff(
+	ctx context.Context, backoff types.ServerBackoff,
+) error {
+	_, err := s.upsertBackoffStmt.ExecContext(
+		ctx, backoff.ServerName, backoff.FailureCount, backoff.BackoffUntil, backoff.Blacklisted,
+	)
+	return err
+}
+
+func (s *backoffStatements) deleteBackoff(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) error {
+	_, err := s.deleteBackoffStmt.ExecContext(ctx, serverName)
+	return err
+}
+
+func (s *backoffStatements) selectBackoffs(
+	ctx context.Context,
+) ([]types.ServerBackoff, error) {
+	rows, err := s.selectBackoffsStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectBackoffs: rows.close() failed")
+
+	var result []types.ServerBackoff
+	for rows.Next() {
+		var backoff types.ServerBackoff
+		if err = rows.Scan(
+			&backoff.ServerName, &backoff.FailureCount, &backoff.BackoffUntil, &backoff.Blacklisted,
+		); err != nil {
+			return nil, err
+		}
+		result = append(result, backoff)
+	}
+
+	return result, rows.Err()
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const queueSchema = `
+-- The queue table stores PDUs, EDUs and invites that are waiting to be
+-- sent to a remote server. Entries are only removed once the remote server
+-- has accepted them, so that the queues survive restarts.
+CREATE TABLE IF NOT EXISTS federationsender_queue (
+    -- The position of the entry in the queue.
+    queue_nid BIGSERIAL PRIMARY KEY,
+    -- The destination server that the entry should be sent to.
+    server_name TEXT NOT NULL,
+    -- The type of the entry: "pdu", "edu" or "invite".
+    entry_type TEXT NOT NULL,
+    -- The JSON of the entry.
+    entry_json TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS federationsender_queue_server_name_idx
+    ON federationsender_queue (server_name, entry_type);
+`
+
+const insertQueueEntrySQL = "" +
+	"INSERT INTO federationsender_queue (server_name, entry_type, entry_json)" +
+	" VALUES ($1, $2, $3)" +
+	" RETURNING queue_nid"
+
+const selectQueueEntriesSQL = "" +
+	"SELECT queue_nid, entry_json FROM federationsender_queue" +
+	" WHERE server_name = $1 AND entry_type = $2" +
+	" ORDER BY queue_nid ASC"
+
+const deleteQueueEntriesSQL = "" +
+	"DELETE FROM federationsender_queue WHERE queue_nid = ANY($1)"
+
+const selectQueueServerNamesSQL = "" +
+	"SELECT DISTINCT server_name FROM federationsender_queue"
+
+type queueStatements struct {
+	insertQueueEntryStmt       *sql.Stmt
+	selectQueueEntriesStmt     *sql.Stmt
+	deleteQueueEntriesStmt     *sql.Stmt
+	selectQueueServerNamesStmt *sql.Stmt
+}
+
+// A queueEntry is the raw JSON of an entry in the queue table along
+// with its position in the queue.
+type queueEntry struct {
+	nid  int64
+	json []byte
+}
+
+func (s *queueStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(queueSchema)
+	if err != nil {
+		return
+	}
+	if s.insertQueueEntryStmt, err = db.Prepare(insertQueueEntrySQL); err != nil {
+		return
+	}
+	if s.selectQueueEntriesStmt, err = db.Prepare(selectQueueEntriesSQL); err != nil {
+		return
+	}
+	if s.deleteQueueEntriesStmt, err = db.Prepare(deleteQueueEntriesSQL); err != nil {
+		return
+	}
+	if s.selectQueueServerNamesStmt, err = db.Prepare(selectQueueServerNamesSQL); err != nil {
+		return
+	}
+	return
+}
+
+func (s *queueStatements) insertQueueEntry(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	entryType string, entryJSON []byte,
+) (nid int64, err error) {
+	err = s.insertQueueEntryStmt.QueryRowContext(
+		ctx, serverName, entryType, entryJSON,
+	).Scan(&nid)
+	return
+}
+
+func (s *queueStatements) selectQueueEntries(
+	ctx context.Context, serverName gomatrixserverlib.ServerName, entryType string,
+) ([]queueEntry, error) {
+	rows, err := s.selectQueueEntriesStmt.QueryContext(ctx, serverName, entryType)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectQueueEntries: rows.close() failed")
+
+	var result []queueEntry
+	for rows.Next() {
+		var entry queueEntry
+		if err = rows.Scan(&entry.nid, &entry.json); err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+
+	return result, rows.Err()
+}
+
+func (s *queueStatements) deleteQueueEntries(
+	ctx context.Context, nids []int64,
+) error {
+	_, err := s.deleteQueueEntriesStmt.ExecContext(ctx, pq.Int64Array(nids))
+	return err
+}
+
+func (s *queueStatements) selectQueueServerNames(
+	ctx context.Context,
+) ([]gomatrixserverlib.ServerName, error) {
+	rows, err := s.selectQueueServerNamesStmt.QueryContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectQueueServerNames: rows.close() failed")
+
+	var result []gomatrixserverlib.ServerName
+	for rows.Next() {
+		var serverName string
+		if err = rows.Scan(&serverName); err != nil {
+			return nil, err
+		}
+		result = append(result, gomatrixserverlib.ServerName(serverName))
+	}
+
+	return result, rows.Err()
+}
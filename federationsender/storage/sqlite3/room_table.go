@@ -42,10 +42,14 @@ const selectRoomForUpdateSQL = "" +
 const updateRoomSQL = "" +
 	"UPDATE federationsender_rooms SET last_event_id = $2 WHERE room_id = $1"
 
+const deleteRoomSQL = "" +
+	"DELETE FROM federationsender_rooms WHERE room_id = $1"
+
 type roomStatements struct {
 	insertRoomStmt          *sql.Stmt
 	selectRoomForUpdateStmt *sql.Stmt
 	updateRoomStmt          *sql.Stmt
+	deleteRoomStmt          *sql.Stmt
 }
 
 func (s *roomStatements) prepare(db *sql.DB) (err error) {
@@ -63,6 +67,9 @@ func (s *roomStatements) prepare(db *sql.DB) (err error) {
 	if s.updateRoomStmt, err = db.Prepare(updateRoomSQL); err != nil {
 		return
 	}
+	if s.deleteRoomStmt, err = db.Prepare(deleteRoomSQL); err != nil {
+		return
+	}
 	return
 }
 
@@ -99,3 +106,12 @@ func (s *roomStatements) updateRoom(
 	_, err := stmt.ExecContext(ctx, roomID, lastEventID)
 	return err
 }
+
+// deleteRoom removes the row for the room, if there is one.
+func (s *roomStatements) deleteRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteRoomStmt)
+	_, err := stmt.ExecContext(ctx, roomID)
+	return err
+}
@@ -18,18 +18,22 @@ package sqlite3
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 
 	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/matrix-org/dendrite/federationsender/types"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/gomatrixserverlib"
 )
 
 // Database stores information needed by the federation sender
 type Database struct {
 	joinedHostsStatements
 	roomStatements
+	queueStatements
+	backoffStatements
 	internal.PartitionOffsetStatements
 	db *sql.DB
 }
@@ -58,6 +62,14 @@ func (d *Database) prepare() error {
 		return err
 	}
 
+	if err = d.queueStatements.prepare(d.db); err != nil {
+		return err
+	}
+
+	if err = d.backoffStatements.prepare(d.db); err != nil {
+		return err
+	}
+
 	return d.PartitionOffsetStatements.Prepare(d.db, "federationsender")
 }
 
@@ -123,3 +135,161 @@ func (d *Database) GetJoinedHosts(
 ) ([]types.JoinedHost, error) {
 	return d.selectJoinedHosts(ctx, roomID)
 }
+
+// PurgeRoom forgets the joined hosts and last seen event for the room, so
+// that it is treated as a new room if it is ever rejoined.
+func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.deleteJoinedHostsForRoom(ctx, txn, roomID); err != nil {
+			return err
+		}
+		return d.deleteRoom(ctx, txn, roomID)
+	})
+}
+
+// The types of entry stored in the queue table.
+const (
+	queueEntryPDU    = "pdu"
+	queueEntryEDU    = "edu"
+	queueEntryInvite = "invite"
+)
+
+// StoreQueuedPDU persists a PDU in the outgoing queue for the given
+// destination and returns its position in the queue.
+func (d *Database) StoreQueuedPDU(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	event *gomatrixserverlib.HeaderedEvent,
+) (int64, error) {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return 0, err
+	}
+	return d.insertQueueEntry(ctx, serverName, queueEntryPDU, eventJSON)
+}
+
+// StoreQueuedEDU persists an EDU in the outgoing queue for the given
+// destination and returns its position in the queue.
+func (d *Database) StoreQueuedEDU(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	edu *gomatrixserverlib.EDU,
+) (int64, error) {
+	eduJSON, err := json.Marshal(edu)
+	if err != nil {
+		return 0, err
+	}
+	return d.insertQueueEntry(ctx, serverName, queueEntryEDU, eduJSON)
+}
+
+// StoreQueuedInvite persists an invite request in the outgoing queue for
+// the given destination and returns its position in the queue.
+func (d *Database) StoreQueuedInvite(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+	invite *gomatrixserverlib.InviteV2Request,
+) (int64, error) {
+	inviteJSON, err := json.Marshal(invite)
+	if err != nil {
+		return 0, err
+	}
+	return d.insertQueueEntry(ctx, serverName, queueEntryInvite, inviteJSON)
+}
+
+// GetQueuedPDUs returns the PDUs queued for the given destination,
+// in the order that they were queued.
+func (d *Database) GetQueuedPDUs(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]types.QueuedPDU, error) {
+	entries, err := d.selectQueueEntries(ctx, serverName, queueEntryPDU)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]types.QueuedPDU, len(entries))
+	for i, entry := range entries {
+		result[i].NID = entry.nid
+		result[i].Event = &gomatrixserverlib.HeaderedEvent{}
+		if err = json.Unmarshal(entry.json, result[i].Event); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// GetQueuedEDUs returns the EDUs queued for the given destination,
+// in the order that they were queued.
+func (d *Database) GetQueuedEDUs(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]types.QueuedEDU, error) {
+	entries, err := d.selectQueueEntries(ctx, serverName, queueEntryEDU)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]types.QueuedEDU, len(entries))
+	for i, entry := range entries {
+		result[i].NID = entry.nid
+		result[i].EDU = &gomatrixserverlib.EDU{}
+		if err = json.Unmarshal(entry.json, result[i].EDU); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// GetQueuedInvites returns the invite requests queued for the given
+// destination, in the order that they were queued.
+func (d *Database) GetQueuedInvites(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) ([]types.QueuedInvite, error) {
+	entries, err := d.selectQueueEntries(ctx, serverName, queueEntryInvite)
+	if err != nil {
+		return nil, err
+	}
+	result := make([]types.QueuedInvite, len(entries))
+	for i, entry := range entries {
+		result[i].NID = entry.nid
+		result[i].Invite = &gomatrixserverlib.InviteV2Request{}
+		if err = json.Unmarshal(entry.json, result[i].Invite); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// RemoveQueued removes the entries with the given queue positions from
+// the outgoing queues. This should only be called once the destination
+// has accepted them.
+func (d *Database) RemoveQueued(ctx context.Context, nids []int64) error {
+	if len(nids) == 0 {
+		return nil
+	}
+	return d.deleteQueueEntries(ctx, nids)
+}
+
+// GetQueuedServerNames returns the destinations that have entries
+// waiting in the outgoing queues.
+func (d *Database) GetQueuedServerNames(
+	ctx context.Context,
+) ([]gomatrixserverlib.ServerName, error) {
+	return d.selectQueueServerNames(ctx)
+}
+
+// UpsertServerBackoff persists the backoff state of a remote server.
+func (d *Database) UpsertServerBackoff(
+	ctx context.Context, backoff types.ServerBackoff,
+) error {
+	return d.upsertBackoff(ctx, backoff)
+}
+
+// DeleteServerBackoff removes the persisted backoff state of a remote
+// server, e.g. once it is reachable again.
+func (d *Database) DeleteServerBackoff(
+	ctx context.Context, serverName gomatrixserverlib.ServerName,
+) error {
+	return d.deleteBackoff(ctx, serverName)
+}
+
+// GetServerBackoffs returns the persisted backoff state of all of the
+// remote servers that we are backing off from.
+func (d *Database) GetServerBackoffs(
+	ctx context.Context,
+) ([]types.ServerBackoff, error) {
+	return d.selectBackoffs(ctx)
+}
@@ -0,0 +1,141 @@
+package storage_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/federationsender/storage"
+	"github.com/matrix-org/dendrite/federationsender/storage/sqlite3"
+	"github.com/matrix-org/dendrite/federationsender/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var (
+	ctx        = context.Background()
+	testServer = gomatrixserverlib.ServerName("remote.example.com")
+	testEvent  = []byte(`{"auth_events":[],"content":{"body":"hello"},"depth":1,"event_id":"$a:localhost","hashes":{"sha256":"abc"},"origin":"localhost","origin_server_ts":1,"prev_events":[],"room_id":"!room:localhost","sender":"@alice:localhost","signatures":{},"type":"m.room.message"}`)
+)
+
+func MustCreateDatabase(t *testing.T) storage.Database {
+	db, err := sqlite3.NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("NewDatabase returned %s", err)
+	}
+	return db
+}
+
+func TestQueueSurvivesUntilRemoved(t *testing.T) {
+	db := MustCreateDatabase(t)
+
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON(testEvent, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON returned %s", err)
+	}
+	headered := ev.Headered(gomatrixserverlib.RoomVersionV1)
+	pduNID, err := db.StoreQueuedPDU(ctx, testServer, &headered)
+	if err != nil {
+		t.Fatalf("StoreQueuedPDU returned %s", err)
+	}
+	eduNID, err := db.StoreQueuedEDU(ctx, testServer, &gomatrixserverlib.EDU{Type: "m.typing", Content: []byte(`{}`)})
+	if err != nil {
+		t.Fatalf("StoreQueuedEDU returned %s", err)
+	}
+
+	serverNames, err := db.GetQueuedServerNames(ctx)
+	if err != nil {
+		t.Fatalf("GetQueuedServerNames returned %s", err)
+	}
+	if len(serverNames) != 1 || serverNames[0] != testServer {
+		t.Fatalf("GetQueuedServerNames returned wrong servers: %v", serverNames)
+	}
+
+	pdus, err := db.GetQueuedPDUs(ctx, testServer)
+	if err != nil {
+		t.Fatalf("GetQueuedPDUs returned %s", err)
+	}
+	if len(pdus) != 1 || pdus[0].NID != pduNID || pdus[0].Event.EventID() != "$a:localhost" {
+		t.Fatalf("GetQueuedPDUs returned wrong PDUs: %+v", pdus)
+	}
+	if pdus[0].Event.RoomVersion != gomatrixserverlib.RoomVersionV1 {
+		t.Fatalf("GetQueuedPDUs lost the room version: %q", pdus[0].Event.RoomVersion)
+	}
+	edus, err := db.GetQueuedEDUs(ctx, testServer)
+	if err != nil {
+		t.Fatalf("GetQueuedEDUs returned %s", err)
+	}
+	if len(edus) != 1 || edus[0].NID != eduNID || edus[0].EDU.Type != "m.typing" {
+		t.Fatalf("GetQueuedEDUs returned wrong EDUs: %+v", edus)
+	}
+
+	if err = db.RemoveQueued(ctx, []int64{pduNID, eduNID}); err != nil {
+		t.Fatalf("RemoveQueued returned %s", err)
+	}
+	serverNames, err = db.GetQueuedServerNames(ctx)
+	if err != nil {
+		t.Fatalf("GetQueuedServerNames returned %s", err)
+	}
+	if len(serverNames) != 0 {
+		t.Fatalf("GetQueuedServerNames returned servers after removal: %v", serverNames)
+	}
+}
+
+func TestServerBackoffs(t *testing.T) {
+	db := MustCreateDatabase(t)
+
+	backoff := types.ServerBackoff{
+		ServerName:   testServer,
+		FailureCount: 3,
+		BackoffUntil: gomatrixserverlib.Timestamp(1234),
+		Blacklisted:  false,
+	}
+	if err := db.UpsertServerBackoff(ctx, backoff); err != nil {
+		t.Fatalf("UpsertServerBackoff returned %s", err)
+	}
+	backoff.FailureCount = 4
+	backoff.Blacklisted = true
+	if err := db.UpsertServerBackoff(ctx, backoff); err != nil {
+		t.Fatalf("UpsertServerBackoff returned %s", err)
+	}
+	backoffs, err := db.GetServerBackoffs(ctx)
+	if err != nil {
+		t.Fatalf("GetServerBackoffs returned %s", err)
+	}
+	if len(backoffs) != 1 || backoffs[0] != backoff {
+		t.Fatalf("GetServerBackoffs returned wrong backoffs: %+v", backoffs)
+	}
+
+	if err = db.DeleteServerBackoff(ctx, testServer); err != nil {
+		t.Fatalf("DeleteServerBackoff returned %s", err)
+	}
+	backoffs, err = db.GetServerBackoffs(ctx)
+	if err != nil {
+		t.Fatalf("GetServerBackoffs returned %s", err)
+	}
+	if len(backoffs) != 0 {
+		t.Fatalf("GetServerBackoffs returned backoffs after deletion: %+v", backoffs)
+	}
+}
+
+func TestPurgeRoom(t *testing.T) {
+	db := MustCreateDatabase(t)
+
+	hosts := []types.JoinedHost{{MemberEventID: "$join:remote.example.com", ServerName: testServer}}
+	if _, err := db.UpdateRoom(ctx, "!room:localhost", "", "$join:remote.example.com", hosts, nil); err != nil {
+		t.Fatalf("UpdateRoom returned %s", err)
+	}
+	if err := db.PurgeRoom(ctx, "!room:localhost"); err != nil {
+		t.Fatalf("PurgeRoom returned %s", err)
+	}
+	joined, err := db.GetJoinedHosts(ctx, "!room:localhost")
+	if err != nil {
+		t.Fatalf("GetJoinedHosts returned %s", err)
+	}
+	if len(joined) != 0 {
+		t.Fatalf("GetJoinedHosts returned hosts after purge: %+v", joined)
+	}
+
+	// The room is treated as new if it is rejoined.
+	if _, err = db.UpdateRoom(ctx, "!room:localhost", "", "$rejoin:remote.example.com", hosts[:0], nil); err != nil {
+		t.Fatalf("UpdateRoom after purge returned %s", err)
+	}
+}
@@ -1,61 +1,121 @@
 package types
 
 import (
+	"context"
+	"errors"
 	"math"
 	"sync"
 	"time"
 
+	"github.com/matrix-org/gomatrix"
 	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 	"go.uber.org/atomic"
 )
 
 const (
 	// How many times should we tolerate consecutive failures before we
-	// just blacklist the host altogether? Bear in mind that the backoff
-	// is exponential, so the max time here to attempt is 2**failures.
+	// just blacklist the host until we hear from it again? Bear in mind
+	// that the backoff is exponential, so the max time here to attempt
+	// is 2**failures.
 	FailuresUntilBlacklist = 16 // 16 equates to roughly 18 hours.
 )
 
+// ServerBackoff describes the backoff state of a remote server.
+type ServerBackoff struct {
+	ServerName   gomatrixserverlib.ServerName `json:"server_name"`
+	FailureCount uint32                       `json:"failure_count"`
+	BackoffUntil gomatrixserverlib.Timestamp  `json:"backoff_until"`
+	Blacklisted  bool                         `json:"blacklisted"`
+}
+
+// A BackoffStorer persists the backoff state of remote servers so that
+// it survives restarts.
+type BackoffStorer interface {
+	UpsertServerBackoff(ctx context.Context, backoff ServerBackoff) error
+	DeleteServerBackoff(ctx context.Context, serverName gomatrixserverlib.ServerName) error
+	GetServerBackoffs(ctx context.Context) ([]ServerBackoff, error)
+}
+
 // Statistics contains information about all of the remote federated
 // hosts that we have interacted with. It is basically a threadsafe
 // wrapper.
 type Statistics struct {
+	db      BackoffStorer
 	servers map[gomatrixserverlib.ServerName]*ServerStatistics
 	mutex   sync.RWMutex
 }
 
+// NewStatistics creates statistics that persist backoffs in the given
+// storer, restoring any backoffs that were in place before a restart.
+func NewStatistics(ctx context.Context, db BackoffStorer) (*Statistics, error) {
+	s := &Statistics{
+		db:      db,
+		servers: make(map[gomatrixserverlib.ServerName]*ServerStatistics),
+	}
+	backoffs, err := db.GetServerBackoffs(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, backoff := range backoffs {
+		server := &ServerStatistics{serverName: backoff.ServerName, db: db}
+		server.failCounter.Store(backoff.FailureCount)
+		server.backoffUntil.Store(backoff.BackoffUntil.Time())
+		server.blacklisted.Store(backoff.Blacklisted)
+		s.servers[backoff.ServerName] = server
+	}
+	return s, nil
+}
+
 // ForServer returns server statistics for the given server name. If it
 // does not exist, it will create empty statistics and return those.
 func (s *Statistics) ForServer(serverName gomatrixserverlib.ServerName) *ServerStatistics {
-	// If the map hasn't been initialised yet then do that.
-	if s.servers == nil {
-		s.mutex.Lock()
-		s.servers = make(map[gomatrixserverlib.ServerName]*ServerStatistics)
-		s.mutex.Unlock()
-	}
 	// Look up if we have statistics for this server already.
 	s.mutex.RLock()
 	server, found := s.servers[serverName]
 	s.mutex.RUnlock()
-	// If we don't, then make one.
-	if !found {
-		s.mutex.Lock()
-		server = &ServerStatistics{}
+	if found {
+		return server
+	}
+	// If we don't, then make one, unless someone else has made one since we
+	// looked, so that everyone shares the same statistics for the server.
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.servers == nil {
+		s.servers = make(map[gomatrixserverlib.ServerName]*ServerStatistics)
+	}
+	if server, found = s.servers[serverName]; !found {
+		server = &ServerStatistics{serverName: serverName, db: s.db}
 		s.servers[serverName] = server
-		s.mutex.Unlock()
 	}
 	return server
 }
 
+// Backoffs returns the backoff state of all of the servers that we are
+// currently backing off from or have blacklisted.
+func (s *Statistics) Backoffs() []ServerBackoff {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	var result []ServerBackoff
+	for _, server := range s.servers {
+		if backoff := server.backoff(); backoff.FailureCount > 0 || backoff.Blacklisted {
+			result = append(result, backoff)
+		}
+	}
+	return result
+}
+
 // ServerStatistics contains information about our interactions with a
 // remote federated host, e.g. how many times we were successful, how
 // many times we failed etc. It also manages the backoff time and black-
 // listing a remote host if it remains uncooperative.
 type ServerStatistics struct {
-	blacklisted    atomic.Bool   // is the remote side dead?
-	backoffUntil   atomic.Value  // time.Time to wait until before sending requests
-	failCounter    atomic.Uint32 // how many times have we failed?
-	successCounter atomic.Uint32 // how many times have we succeeded?
+	serverName     gomatrixserverlib.ServerName // the remote server
+	db             BackoffStorer                // where to persist backoffs, if anywhere
+	blacklisted    atomic.Bool                  // is the remote side dead?
+	backoffUntil   atomic.Value                 // time.Time to wait until before sending requests
+	failCounter    atomic.Uint32                // how many times have we failed?
+	successCounter atomic.Uint32                // how many times have we succeeded?
 }
 
 // Success updates the server statistics with a new successful
@@ -64,14 +124,43 @@ type ServerStatistics struct {
 // we will unblacklist it.
 func (s *ServerStatistics) Success() {
 	s.successCounter.Add(1)
-	s.failCounter.Store(0)
-	s.blacklisted.Store(false)
+	s.ClearBackoff()
+}
+
+// ClearBackoff resets the failure counter and any backoff or blacklist,
+// e.g. because we have heard from the server. It returns true if there
+// was a backoff or blacklist in place.
+func (s *ServerStatistics) ClearBackoff() bool {
+	hadFailures := s.failCounter.Swap(0) > 0
+	wasBlacklisted := s.blacklisted.Swap(false)
+	if !hadFailures && !wasBlacklisted {
+		return false
+	}
+	s.backoffUntil.Store(time.Time{})
+	if s.db != nil {
+		if err := s.db.DeleteServerBackoff(context.Background(), s.serverName); err != nil {
+			logrus.WithError(err).WithField("server_name", s.serverName).Error("failed to clear persisted backoff")
+		}
+	}
+	return true
+}
+
+// RequestFailed records that a request to the server failed with the
+// given error. Only errors that show that the server is down count as
+// a failure, see IsServerDown. It returns true if the caller should
+// give up because the host is now blacklisted.
+func (s *ServerStatistics) RequestFailed(err error) bool {
+	if !IsServerDown(err) {
+		s.Success()
+		return false
+	}
+	return s.Failure()
 }
 
 // Failure marks a failure and works out when to backoff until. It
 // returns true if the worker should give up altogether because of
 // too many consecutive failures. At this point the host is marked
-// as blacklisted.
+// as blacklisted until we next hear from it, see ClearBackoff.
 func (s *ServerStatistics) Failure() bool {
 	// Increase the fail counter.
 	failCounter := s.failCounter.Add(1)
@@ -83,6 +172,7 @@ func (s *ServerStatistics) Failure() bool {
 		// now. Mark the host as blacklisted and tell the caller to
 		// give up.
 		s.blacklisted.Store(true)
+		s.persist()
 		return true
 	}
 
@@ -94,9 +184,33 @@ func (s *ServerStatistics) Failure() bool {
 	s.backoffUntil.Store(
 		time.Now().Add(backoffSeconds),
 	)
+	s.persist()
 	return false
 }
 
+// persist stores the current backoff state so that it survives restarts.
+func (s *ServerStatistics) persist() {
+	if s.db == nil {
+		return
+	}
+	if err := s.db.UpsertServerBackoff(context.Background(), s.backoff()); err != nil {
+		logrus.WithError(err).WithField("server_name", s.serverName).Error("failed to persist backoff")
+	}
+}
+
+// backoff returns the current backoff state of the server.
+func (s *ServerStatistics) backoff() ServerBackoff {
+	backoff := ServerBackoff{
+		ServerName:   s.serverName,
+		FailureCount: s.failCounter.Load(),
+		Blacklisted:  s.blacklisted.Load(),
+	}
+	if until, ok := s.backoffUntil.Load().(time.Time); ok && !until.IsZero() {
+		backoff.BackoffUntil = gomatrixserverlib.AsTimestamp(until)
+	}
+	return backoff
+}
+
 // BackoffDuration returns both a bool stating whether to wait,
 // and then if true, a duration to wait for.
 func (s *ServerStatistics) BackoffDuration() (bool, time.Duration) {
@@ -120,3 +234,17 @@ func (s *ServerStatistics) Blacklisted() bool {
 func (s *ServerStatistics) SuccessCount() uint32 {
 	return s.successCounter.Load()
 }
+
+// IsServerDown returns true if the error from a federation request shows
+// that the remote server is unreachable or failing. A 4xx response means
+// that the server is up but refused the request, so it doesn't count.
+func IsServerDown(err error) bool {
+	if err == nil {
+		return false
+	}
+	var httpErr gomatrix.HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.Code < 400 || httpErr.Code > 499
+	}
+	return true
+}
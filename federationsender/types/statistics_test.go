@@ -0,0 +1,110 @@
+package types
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/matrix-org/gomatrix"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type testBackoffStorer struct {
+	backoffs map[gomatrixserverlib.ServerName]ServerBackoff
+}
+
+func (s *testBackoffStorer) UpsertServerBackoff(ctx context.Context, backoff ServerBackoff) error {
+	s.backoffs[backoff.ServerName] = backoff
+	return nil
+}
+
+func (s *testBackoffStorer) DeleteServerBackoff(ctx context.Context, serverName gomatrixserverlib.ServerName) error {
+	delete(s.backoffs, serverName)
+	return nil
+}
+
+func (s *testBackoffStorer) GetServerBackoffs(ctx context.Context) (result []ServerBackoff, err error) {
+	for _, backoff := range s.backoffs {
+		result = append(result, backoff)
+	}
+	return
+}
+
+func TestIsServerDown(t *testing.T) {
+	tests := []struct {
+		err  error
+		down bool
+	}{
+		{nil, false},
+		{errors.New("connection refused"), true},
+		{gomatrix.HTTPError{Code: 404}, false},
+		{gomatrix.HTTPError{Code: 403}, false},
+		{gomatrix.HTTPError{Code: 502}, true},
+	}
+	for _, test := range tests {
+		if down := IsServerDown(test.err); down != test.down {
+			t.Errorf("IsServerDown(%v) returned %v, want %v", test.err, down, test.down)
+		}
+	}
+}
+
+func TestBackoffSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	db := &testBackoffStorer{backoffs: map[gomatrixserverlib.ServerName]ServerBackoff{}}
+	serverName := gomatrixserverlib.ServerName("remote.example.com")
+
+	stats, err := NewStatistics(ctx, db)
+	if err != nil {
+		t.Fatalf("NewStatistics returned %s", err)
+	}
+	server := stats.ForServer(serverName)
+	server.RequestFailed(gomatrix.HTTPError{Code: 404})
+	if len(db.backoffs) != 0 {
+		t.Fatalf("a 4xx response caused a backoff: %+v", db.backoffs)
+	}
+	server.RequestFailed(errors.New("connection refused"))
+	if db.backoffs[serverName].FailureCount != 1 {
+		t.Fatalf("failure was not persisted: %+v", db.backoffs)
+	}
+
+	// Simulate a restart by loading the statistics again.
+	stats, err = NewStatistics(ctx, db)
+	if err != nil {
+		t.Fatalf("NewStatistics returned %s", err)
+	}
+	if backoff, _ := stats.ForServer(serverName).BackoffDuration(); !backoff {
+		t.Fatalf("backoff was not restored")
+	}
+	if backoffs := stats.Backoffs(); len(backoffs) != 1 || backoffs[0].ServerName != serverName {
+		t.Fatalf("Backoffs returned %+v", backoffs)
+	}
+
+	if !stats.ForServer(serverName).ClearBackoff() {
+		t.Fatalf("ClearBackoff reported no backoff")
+	}
+	if len(db.backoffs) != 0 || len(stats.Backoffs()) != 0 {
+		t.Fatalf("backoff was not cleared")
+	}
+}
+
+func TestForServerConcurrent(t *testing.T) {
+	// Everyone asking for the same server at once must get the same
+	// statistics, or failures recorded by one of them would be lost.
+	stats := Statistics{}
+	results := make([]*ServerStatistics, 50)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = stats.ForServer("example.com")
+		}(i)
+	}
+	wg.Wait()
+	for i := range results {
+		if results[i] != results[0] {
+			t.Fatalf("ForServer returned different statistics for the same server")
+		}
+	}
+}
@@ -49,3 +49,25 @@ func (e EventIDMismatchError) Error() string {
 		e.DatabaseID, e.RoomServerID,
 	)
 }
+
+// A QueuedPDU is a PDU waiting in the outgoing federation queue for a
+// destination. The NID is the position of the PDU in the queue.
+type QueuedPDU struct {
+	NID   int64
+	Event *gomatrixserverlib.HeaderedEvent
+}
+
+// A QueuedEDU is an EDU waiting in the outgoing federation queue for a
+// destination. The NID is the position of the EDU in the queue.
+type QueuedEDU struct {
+	NID int64
+	EDU *gomatrixserverlib.EDU
+}
+
+// A QueuedInvite is an invite request waiting in the outgoing federation
+// queue for a destination. The NID is the position of the invite in the
+// queue.
+type QueuedInvite struct {
+	NID    int64
+	Invite *gomatrixserverlib.InviteV2Request
+}
@@ -41,6 +41,7 @@ import (
 	eduServerAPI "github.com/matrix-org/dendrite/eduserver/api"
 	federationSenderAPI "github.com/matrix-org/dendrite/federationsender/api"
 	"github.com/matrix-org/dendrite/internal/config"
+	keyserverAPI "github.com/matrix-org/dendrite/keyserver/api"
 	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/sirupsen/logrus"
 
@@ -90,6 +91,8 @@ func NewBaseDendrite(cfg *config.Dendrite, componentName string, enableHTTPAPIs
 		kafkaConsumer, kafkaProducer = setupKafka(cfg)
 	}
 
+	reloadAppServicesOnSIGHUP(cfg)
+
 	cache, err := caching.NewImmutableInMemoryLRUCache()
 	if err != nil {
 		logrus.WithError(err).Warnf("Failed to create cache")
@@ -153,6 +156,15 @@ func (b *BaseDendrite) CreateHTTPFederationSenderAPIs() federationSenderAPI.Fede
 	return f
 }
 
+// CreateHTTPKeyAPIs returns KeyInternalAPI for hitting the key server over HTTP
+func (b *BaseDendrite) CreateHTTPKeyAPIs() keyserverAPI.KeyInternalAPI {
+	k, err := keyserverAPI.NewKeyInternalAPIHTTP(b.Cfg.KeyServerURL(), b.httpClient)
+	if err != nil {
+		logrus.WithError(err).Panic("NewKeyInternalAPIHTTP failed", b.httpClient)
+	}
+	return k
+}
+
 // CreateDeviceDB creates a new instance of the device database. Should only be
 // called once per component.
 func (b *BaseDendrite) CreateDeviceDB() devices.Database {
@@ -0,0 +1,42 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// +build !wasm
+
+package basecomponent
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/sirupsen/logrus"
+)
+
+// reloadAppServicesOnSIGHUP reloads the application service registrations
+// whenever the process receives SIGHUP.
+func reloadAppServicesOnSIGHUP(cfg *config.Dendrite) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		for range sighup {
+			if err := cfg.ReloadAppServices(); err != nil {
+				logrus.WithError(err).Error("Failed to reload application services")
+				continue
+			}
+			logrus.WithField("appservices", len(cfg.AppServices())).Info("Reloaded application services")
+		}
+	}()
+}
@@ -12,22 +12,10 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package routing
+package basecomponent
 
-import (
-	"net/http"
+import "github.com/matrix-org/dendrite/internal/config"
 
-	"github.com/matrix-org/util"
-)
-
-func QueryKeys(
-	req *http.Request,
-) util.JSONResponse {
-	return util.JSONResponse{
-		Code: http.StatusOK,
-		JSON: map[string]interface{}{
-			"failures":    map[string]interface{}{},
-			"device_keys": map[string]interface{}{},
-		},
-	}
-}
+// reloadAppServicesOnSIGHUP does nothing, as there are no signals in the
+// browser.
+func reloadAppServicesOnSIGHUP(cfg *config.Dendrite) {}
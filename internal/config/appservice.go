@@ -64,6 +64,9 @@ type ApplicationService struct {
 	RateLimited bool `yaml:"rate_limited"`
 	// Any custom protocols that this application service provides (e.g. IRC)
 	Protocols []string `yaml:"protocols"`
+	// Whether to send the application service the typing notifications,
+	// receipts, presence and send-to-device messages within its namespaces
+	ReceiveEphemeral bool `yaml:"receive_ephemeral"`
 }
 
 // IsInterestedInRoomID returns a bool on whether an application service's
@@ -130,10 +133,98 @@ func (a *ApplicationService) IsInterestedInRoomAlias(
 	return false
 }
 
+// AppServices returns the application services which are currently registered.
+// The returned slice is replaced rather than modified when the application
+// services are reloaded, so it is safe to keep using it.
+func (config *Dendrite) AppServices() []ApplicationService {
+	config.appServicesMutex.RLock()
+	defer config.appServicesMutex.RUnlock()
+	return config.Derived.ApplicationServices
+}
+
+// IsExclusiveAppServiceUserID returns a bool on whether the given user ID is
+// within the exclusive namespace of any registered application service
+func (config *Dendrite) IsExclusiveAppServiceUserID(userID string) bool {
+	config.appServicesMutex.RLock()
+	defer config.appServicesMutex.RUnlock()
+	return config.Derived.ExclusiveApplicationServicesUsernameRegexp.MatchString(userID)
+}
+
+// IsExclusiveAppServiceAlias returns a bool on whether the given room alias is
+// within the exclusive namespace of any registered application service
+func (config *Dendrite) IsExclusiveAppServiceAlias(alias string) bool {
+	config.appServicesMutex.RLock()
+	defer config.appServicesMutex.RUnlock()
+	return config.Derived.ExclusiveApplicationServicesAliasRegexp.MatchString(alias)
+}
+
+// ReloadAppServices re-reads the application service config files, replacing
+// the registered application services and the namespace regexes derived from
+// them. If any of the config files can't be read or contain errors then the
+// registered application services are left as they were. Otherwise the
+// functions added with OnAppServicesReloaded are called with the application
+// services which are now registered.
+func (config *Dendrite) ReloadAppServices() error {
+	config.appServicesReloadMutex.Lock()
+	defer config.appServicesReloadMutex.Unlock()
+
+	appservices, err := readAppServices(config.ApplicationServices.ConfigFiles)
+	if err != nil {
+		return err
+	}
+	if err = config.setAppServices(appservices); err != nil {
+		return err
+	}
+
+	for _, f := range config.appServicesReloadHooks {
+		f(appservices)
+	}
+	return nil
+}
+
+// OnAppServicesReloaded adds a function to be called with the application
+// services which are registered whenever they are reloaded.
+func (config *Dendrite) OnAppServicesReloaded(f func([]ApplicationService)) {
+	config.appServicesReloadMutex.Lock()
+	defer config.appServicesReloadMutex.Unlock()
+	config.appServicesReloadHooks = append(config.appServicesReloadHooks, f)
+}
+
 // loadAppServices iterates through all application service config files
 // and loads their data into the config object for later access.
 func loadAppServices(config *Dendrite) error {
-	for _, configPath := range config.ApplicationServices.ConfigFiles {
+	appservices, err := readAppServices(config.ApplicationServices.ConfigFiles)
+	if err != nil {
+		return err
+	}
+	return config.setAppServices(appservices)
+}
+
+// setAppServices checks the given application services for any errors, and if
+// there are none replaces the registered application services and the regexes
+// derived from them with the given ones at once.
+func (config *Dendrite) setAppServices(appservices []ApplicationService) error {
+	// Check for any errors in the loaded application services
+	if err := checkErrors(config, appservices); err != nil {
+		return err
+	}
+	exclusiveUsernameRegexp, exclusiveAliasRegexp, err := setupRegexps(appservices)
+	if err != nil {
+		return err
+	}
+
+	config.appServicesMutex.Lock()
+	defer config.appServicesMutex.Unlock()
+	config.Derived.ApplicationServices = appservices
+	config.Derived.ExclusiveApplicationServicesUsernameRegexp = exclusiveUsernameRegexp
+	config.Derived.ExclusiveApplicationServicesAliasRegexp = exclusiveAliasRegexp
+	return nil
+}
+
+// readAppServices reads the application services from the given config files.
+func readAppServices(configFiles []string) ([]ApplicationService, error) {
+	appservices := make([]ApplicationService, 0, len(configFiles))
+	for _, configPath := range configFiles {
 		// Create a new application service with default options
 		appservice := ApplicationService{
 			RateLimited: true,
@@ -142,41 +233,39 @@ func loadAppServices(config *Dendrite) error {
 		// Create an absolute path from a potentially relative path
 		absPath, err := filepath.Abs(configPath)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// Read the application service's config file
 		configData, err := ioutil.ReadFile(absPath)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
 		// Load the config data into our struct
 		if err = yaml.UnmarshalStrict(configData, &appservice); err != nil {
-			return err
+			return nil, err
 		}
 
-		// Append the parsed application service to the global config
-		config.Derived.ApplicationServices = append(
-			config.Derived.ApplicationServices, appservice,
-		)
+		appservices = append(appservices, appservice)
 	}
 
-	// Check for any errors in the loaded application services
-	return checkErrors(config)
+	return appservices, nil
 }
 
 // setupRegexps will create regex objects for exclusive and non-exclusive
 // usernames, aliases and rooms of all application services, so that other
 // methods can quickly check if a particular string matches any of them.
-func setupRegexps(cfg *Dendrite) (err error) {
+func setupRegexps(appservices []ApplicationService) (
+	exclusiveUsernameRegexp, exclusiveAliasRegexp *regexp.Regexp, err error,
+) {
 	// Combine all exclusive namespaces for later string checking
 	var exclusiveUsernameStrings, exclusiveAliasStrings []string
 
 	// If an application service's regex is marked as exclusive, add
 	// its contents to the overall exlusive regex string. Room regex
 	// not necessary as we aren't denying exclusive room ID creation
-	for _, appservice := range cfg.Derived.ApplicationServices {
+	for _, appservice := range appservices {
 		for key, namespaceSlice := range appservice.NamespaceMap {
 			switch key {
 			case "users":
@@ -203,15 +292,15 @@ func setupRegexps(cfg *Dendrite) (err error) {
 		exclusiveAliases = "^$"
 	}
 
-	// Store compiled Regex
-	if cfg.Derived.ExclusiveApplicationServicesUsernameRegexp, err = regexp.Compile(exclusiveUsernames); err != nil {
-		return err
+	// Compile Regex
+	if exclusiveUsernameRegexp, err = regexp.Compile(exclusiveUsernames); err != nil {
+		return nil, nil, err
 	}
-	if cfg.Derived.ExclusiveApplicationServicesAliasRegexp, err = regexp.Compile(exclusiveAliases); err != nil {
-		return err
+	if exclusiveAliasRegexp, err = regexp.Compile(exclusiveAliases); err != nil {
+		return nil, nil, err
 	}
 
-	return nil
+	return exclusiveUsernameRegexp, exclusiveAliasRegexp, nil
 }
 
 // appendExclusiveNamespaceRegexs takes a slice of strings and a slice of
@@ -234,7 +323,7 @@ func appendExclusiveNamespaceRegexs(
 
 // checkErrors checks for any configuration errors amongst the loaded
 // application services according to the application service spec.
-func checkErrors(config *Dendrite) (err error) {
+func checkErrors(config *Dendrite, appservices []ApplicationService) (err error) {
 	var idMap = make(map[string]bool)
 	var tokenMap = make(map[string]bool)
 
@@ -242,11 +331,12 @@ func checkErrors(config *Dendrite) (err error) {
 	groupIDRegexp := regexp.MustCompile(`\+.*:.*`)
 
 	// Check each application service for any config errors
-	for _, appservice := range config.Derived.ApplicationServices {
+	for i := range appservices {
+		appservice := &appservices[i]
 		// Namespace-related checks
 		for key, namespaceSlice := range appservice.NamespaceMap {
 			for _, namespace := range namespaceSlice {
-				if err := validateNamespace(&appservice, key, &namespace, groupIDRegexp); err != nil {
+				if err := validateNamespace(appservice, key, &namespace, groupIDRegexp); err != nil {
 					return err
 				}
 			}
@@ -273,18 +363,51 @@ func checkErrors(config *Dendrite) (err error) {
 		// seen them.
 		idMap[appservice.ID] = true
 		tokenMap[appservice.ASToken] = true
+	}
 
-		// TODO: Remove once rate_limited is implemented
-		if appservice.RateLimited {
-			log.Warn("WARNING: Application service option rate_limited is currently unimplemented")
-		}
-		// TODO: Remove once protocols is implemented
-		if len(appservice.Protocols) > 0 {
-			log.Warn("WARNING: Application service option protocols is currently unimplemented")
+	return checkExclusiveNamespaces(config, appservices)
+}
+
+// checkExclusiveNamespaces checks that no application service claims a
+// namespace which another application service has exclusively, and that the
+// sender of each application service isn't in another application service's
+// exclusive users namespace.
+func checkExclusiveNamespaces(config *Dendrite, appservices []ApplicationService) error {
+	for i := range appservices {
+		for j := range appservices {
+			if i == j {
+				continue
+			}
+			appservice, other := &appservices[i], &appservices[j]
+			for key, namespaceSlice := range other.NamespaceMap {
+				for _, otherNamespace := range namespaceSlice {
+					if !otherNamespace.Exclusive {
+						continue
+					}
+					for _, namespace := range appservice.NamespaceMap[key] {
+						if namespace.Regex == otherNamespace.Regex {
+							return configErrors([]string{fmt.Sprintf(
+								"Application service %s claims the %s namespace %q which application service %s has exclusively",
+								appservice.ID, key, namespace.Regex, other.ID,
+							)})
+						}
+					}
+					if key != "users" {
+						continue
+					}
+					senderUserID := fmt.Sprintf("@%s:%s", appservice.SenderLocalpart, config.Matrix.ServerName)
+					if regexp.MustCompile(otherNamespace.Regex).MatchString(senderUserID) {
+						return configErrors([]string{fmt.Sprintf(
+							"Sender %s of application service %s is in the exclusive users namespace of application service %s",
+							senderUserID, appservice.ID, other.ID,
+						)})
+					}
+				}
+			}
 		}
 	}
 
-	return setupRegexps(config)
+	return nil
 }
 
 // validateNamespace returns nil or an error based on whether a given
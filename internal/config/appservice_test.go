@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testAppServiceRegistration = `
+id: %s
+url: http://localhost:9000
+as_token: %s_as_token
+hs_token: %s_hs_token
+sender_localpart: %s_bot
+namespaces:
+  users:
+    - exclusive: true
+      regex: "@%s_.*"
+`
+
+func writeTestAppService(t *testing.T, dir, id, namespace string) string {
+	path := filepath.Join(dir, id+".yaml")
+	registration := fmt.Sprintf(testAppServiceRegistration, id, id, id, id, namespace)
+	if err := ioutil.WriteFile(path, []byte(registration), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestReloadAppServices(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dendrite-appservices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+
+	cfg := &Dendrite{}
+	cfg.Matrix.ServerName = "localhost"
+	cfg.ApplicationServices.ConfigFiles = []string{writeTestAppService(t, dir, "irc", "irc")}
+	if err = loadAppServices(cfg); err != nil {
+		t.Fatal("failed to load application services:", err)
+	}
+
+	var reloaded []ApplicationService
+	cfg.OnAppServicesReloaded(func(appservices []ApplicationService) {
+		reloaded = appservices
+	})
+
+	// Adding an application service registers it and its namespaces
+	cfg.ApplicationServices.ConfigFiles = append(
+		cfg.ApplicationServices.ConfigFiles, writeTestAppService(t, dir, "slack", "slack"),
+	)
+	if err = cfg.ReloadAppServices(); err != nil {
+		t.Fatal("failed to reload application services:", err)
+	}
+	if len(cfg.AppServices()) != 2 || len(reloaded) != 2 {
+		t.Fatalf("expected 2 application services, got %d", len(cfg.AppServices()))
+	}
+	if !cfg.IsExclusiveAppServiceUserID("@slack_alice:localhost") {
+		t.Error("expected the added application service's namespace to be exclusive")
+	}
+
+	// Adding an application service which claims another's exclusive namespace
+	// fails, leaving the registered application services as they were
+	cfg.ApplicationServices.ConfigFiles = append(
+		cfg.ApplicationServices.ConfigFiles, writeTestAppService(t, dir, "matrix", "irc"),
+	)
+	if err = cfg.ReloadAppServices(); err == nil {
+		t.Fatal("expected reloading conflicting application services to fail")
+	}
+	if len(cfg.AppServices()) != 2 || len(reloaded) != 2 {
+		t.Fatalf("expected 2 application services, got %d", len(cfg.AppServices()))
+	}
+
+	// Removing an application service unregisters its namespaces
+	cfg.ApplicationServices.ConfigFiles = cfg.ApplicationServices.ConfigFiles[1:2]
+	if err = cfg.ReloadAppServices(); err != nil {
+		t.Fatal("failed to reload application services:", err)
+	}
+	if len(reloaded) != 1 || reloaded[0].ID != "slack" {
+		t.Fatalf("expected only the slack application service, got %v", reloaded)
+	}
+	if cfg.IsExclusiveAppServiceUserID("@irc_alice:localhost") {
+		t.Error("expected the removed application service's namespace not to be exclusive")
+	}
+}
@@ -24,6 +24,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
@@ -99,6 +100,22 @@ type Dendrite struct {
 		// If set disables new users from registering (except via shared
 		// secrets)
 		RegistrationDisabled bool `yaml:"registration_disabled"`
+		// If set disables registration of guest accounts
+		GuestsDisabled bool `yaml:"guests_disabled"`
+		// If set disables presence, which stops the server from tracking
+		// whether users are online and from sending or receiving presence
+		// updates. This can reduce load considerably on large deployments.
+		PresenceDisabled bool `yaml:"presence_disabled"`
+		// Limits how quickly each user can send events and create rooms
+		RateLimiting struct {
+			// Whether rate limiting is applied at all
+			Enabled bool `yaml:"enabled"`
+			// The number of requests a user can make before being rate limited
+			Threshold int64 `yaml:"threshold"`
+			// How long each request counts towards the threshold for, in
+			// milliseconds
+			CooloffMS int64 `yaml:"cooloff_ms"`
+		} `yaml:"rate_limiting"`
 		// Perspective keyservers, to use as a backup when direct key fetch
 		// requests don't succeed
 		KeyPerspectives KeyPerspectives `yaml:"key_perspectives"`
@@ -154,6 +171,15 @@ type Dendrite struct {
 			OutputTypingEvent Topic `yaml:"output_typing_event"`
 			// Topic for user updates (profile, presence)
 			UserUpdates Topic `yaml:"user_updates"`
+			// Topic for keyserver/api.DeviceMessage events, sent whenever a
+			// device or its keys are added, changed or removed.
+			OutputKeyChangeEvent Topic `yaml:"output_key_change_event"`
+			// Topic for eduserver/api.OutputSendToDeviceEvent events.
+			OutputSendToDeviceEvent Topic `yaml:"output_send_to_device_event"`
+			// Topic for eduserver/api.OutputReceiptEvent events.
+			OutputReceiptEvent Topic `yaml:"output_receipt_event"`
+			// Topic for eduserver/api.OutputPresenceEvent events.
+			OutputPresenceEvent Topic `yaml:"output_presence_event"`
 		}
 	} `yaml:"kafka"`
 
@@ -172,7 +198,8 @@ type Dendrite struct {
 		// It may be accessed by the FederationAPI, the ClientAPI, and the MediaAPI.
 		ServerKey DataSource `yaml:"server_key"`
 		// The SyncAPI stores information used by the SyncAPI server.
-		// It is only accessed by the SyncAPI server.
+		// It is accessed by the SyncAPI server, and by the push server for
+		// notification counts.
 		SyncAPI DataSource `yaml:"sync_api"`
 		// The RoomServer database stores information about matrix rooms.
 		// It is only accessed by the RoomServer.
@@ -180,6 +207,9 @@ type Dendrite struct {
 		// The FederationSender database stores information used by the FederationSender
 		// It is only accessed by the FederationSender.
 		FederationSender DataSource `yaml:"federation_sender"`
+		// The KeyServer database stores the end-to-end encryption keys of local
+		// devices. It is only accessed by the KeyServer.
+		KeyServer DataSource `yaml:"key_server"`
 		// The AppServices database stores information used by the AppService component.
 		// It is only accessed by the AppService component.
 		AppService DataSource `yaml:"appservice"`
@@ -198,9 +228,8 @@ type Dendrite struct {
 
 	// TURN Server Config
 	TURN struct {
-		// TODO Guest Support
 		// Whether or not guests can request TURN credentials
-		//AllowGuests bool `yaml:"turn_allow_guests"`
+		AllowGuests bool `yaml:"turn_allow_guests"`
 		// How long the authorization should last
 		UserLifetime string `yaml:"turn_user_lifetime"`
 		// The list of TURN URIs to pass to clients
@@ -216,6 +245,56 @@ type Dendrite struct {
 		Password string `yaml:"turn_password"`
 	} `yaml:"turn"`
 
+	// Login flows in addition to logging in with a password stored locally.
+	Login struct {
+		// How long the login tokens issued at the end of the SSO flow remain
+		// valid for use with m.login.token. Defaults to 2 minutes.
+		TokenLifetime time.Duration `yaml:"token_lifetime"`
+
+		// Checking of passwords against an external user directory, such as an
+		// LDAP server, through a service implementing the REST password provider
+		// API. Accounts are created when users log in for the first time.
+		ExternalPassword struct {
+			// Whether or not external password checks are enabled
+			Enabled bool `yaml:"enabled"`
+			// The URL of the service to POST login attempts to
+			URL string `yaml:"url"`
+		} `yaml:"external_password"`
+
+		// Single sign-on (m.login.sso) against an OpenID Connect provider.
+		// Accounts are created when users log in for the first time.
+		OIDC struct {
+			// Whether or not SSO login is enabled
+			Enabled bool `yaml:"enabled"`
+			// The name under which identities from this provider are recorded.
+			// Changing it will cause users to be given new accounts.
+			// Defaults to "oidc".
+			ProviderID string `yaml:"provider_id"`
+			// The endpoints of the OpenID Connect provider
+			AuthorizationEndpoint string `yaml:"authorization_endpoint"`
+			TokenEndpoint         string `yaml:"token_endpoint"`
+			UserinfoEndpoint      string `yaml:"userinfo_endpoint"`
+			// The client credentials registered with the OpenID Connect provider
+			ClientID     string `yaml:"client_id"`
+			ClientSecret string `yaml:"client_secret"`
+			// The scopes to request. Defaults to "openid" and "profile".
+			Scopes []string `yaml:"scopes"`
+			// The userinfo claim used to pick the localpart of new accounts.
+			// Defaults to "preferred_username".
+			LocalpartClaim string `yaml:"localpart_claim"`
+			// The public URL of this server's SSO callback endpoint, i.e.
+			// https://<host>/_matrix/client/r0/login/sso/callback, which must
+			// be registered as a redirect URI with the provider
+			CallbackURL string `yaml:"callback_url"`
+			// The URL prefixes of clients which users are sent back to with
+			// a login token straight away. Users must confirm that they want
+			// to log in to any other client first.
+			// SSO sessions and login tokens are only held in memory, so the
+			// whole flow must be handled by the same client API server.
+			ClientWhitelist []string `yaml:"client_whitelist"`
+		} `yaml:"oidc"`
+	} `yaml:"login"`
+
 	// The internal addresses the components will listen on.
 	// These should not be exposed externally as they expose metrics and debugging APIs.
 	// Falls back to addresses listed in Listen if not specified
@@ -279,7 +358,9 @@ type Dendrite struct {
 		}
 
 		// Application services parsed from their config files
-		// The paths of which were given above in the main config file
+		// The paths of which were given above in the main config file.
+		// Application services can be reloaded while the server is running,
+		// so use AppServices() to read them.
 		ApplicationServices []ApplicationService
 
 		// Meta-regexes compiled from all exclusive application service
@@ -294,6 +375,14 @@ type Dendrite struct {
 		// Note: An Exclusive Regex for room ID isn't necessary as we aren't blocking
 		// servers from creating RoomIDs in exclusive application service namespaces
 	} `yaml:"-"`
+
+	// Guards the application services and the regexes derived from them,
+	// which are replaced when the application services are reloaded
+	appServicesMutex sync.RWMutex
+	// Serialises reloading the application services, and guards the functions
+	// called when they are reloaded
+	appServicesReloadMutex sync.Mutex
+	appServicesReloadHooks []func([]ApplicationService)
 }
 
 // KeyPerspectives are used to configure perspective key servers for
@@ -484,6 +573,14 @@ func (config *Dendrite) SetDefaults() {
 		config.Matrix.TrustedIDServers = []string{}
 	}
 
+	if config.Matrix.RateLimiting.Threshold == 0 {
+		config.Matrix.RateLimiting.Threshold = 5
+	}
+
+	if config.Matrix.RateLimiting.CooloffMS == 0 {
+		config.Matrix.RateLimiting.CooloffMS = 500
+	}
+
 	if config.Media.MaxThumbnailGenerators == 0 {
 		config.Media.MaxThumbnailGenerators = 10
 	}
@@ -493,6 +590,22 @@ func (config *Dendrite) SetDefaults() {
 		config.Media.MaxFileSizeBytes = &defaultMaxFileSizeBytes
 	}
 
+	if config.Login.TokenLifetime == 0 {
+		config.Login.TokenLifetime = 2 * time.Minute
+	}
+
+	if config.Login.OIDC.ProviderID == "" {
+		config.Login.OIDC.ProviderID = "oidc"
+	}
+
+	if config.Login.OIDC.Scopes == nil {
+		config.Login.OIDC.Scopes = []string{"openid", "profile"}
+	}
+
+	if config.Login.OIDC.LocalpartClaim == "" {
+		config.Login.OIDC.LocalpartClaim = "preferred_username"
+	}
+
 	if config.Database.MaxIdleConns == 0 {
 		config.Database.MaxIdleConns = 2
 	}
@@ -557,6 +670,20 @@ func (config *Dendrite) checkTurn(configErrs *configErrors) {
 	}
 }
 
+// checkLogin verifies the parameters login.* are valid.
+func (config *Dendrite) checkLogin(configErrs *configErrors) {
+	if config.Login.ExternalPassword.Enabled {
+		checkNotEmpty(configErrs, "login.external_password.url", config.Login.ExternalPassword.URL)
+	}
+	if config.Login.OIDC.Enabled {
+		checkNotEmpty(configErrs, "login.oidc.authorization_endpoint", config.Login.OIDC.AuthorizationEndpoint)
+		checkNotEmpty(configErrs, "login.oidc.token_endpoint", config.Login.OIDC.TokenEndpoint)
+		checkNotEmpty(configErrs, "login.oidc.userinfo_endpoint", config.Login.OIDC.UserinfoEndpoint)
+		checkNotEmpty(configErrs, "login.oidc.client_id", config.Login.OIDC.ClientID)
+		checkNotEmpty(configErrs, "login.oidc.callback_url", config.Login.OIDC.CallbackURL)
+	}
+}
+
 // checkMatrix verifies the parameters matrix.* are valid.
 func (config *Dendrite) checkMatrix(configErrs *configErrors) {
 	checkNotEmpty(configErrs, "matrix.server_name", string(config.Matrix.ServerName))
@@ -567,6 +694,10 @@ func (config *Dendrite) checkMatrix(configErrs *configErrors) {
 		checkNotEmpty(configErrs, "matrix.recaptcha_private_key", string(config.Matrix.RecaptchaPrivateKey))
 		checkNotEmpty(configErrs, "matrix.recaptcha_siteverify_api", string(config.Matrix.RecaptchaSiteVerifyAPI))
 	}
+	if config.Matrix.RateLimiting.Enabled {
+		checkPositive(configErrs, "matrix.rate_limiting.threshold", config.Matrix.RateLimiting.Threshold)
+		checkPositive(configErrs, "matrix.rate_limiting.cooloff_ms", config.Matrix.RateLimiting.CooloffMS)
+	}
 }
 
 // checkMedia verifies the parameters media.* are valid.
@@ -600,6 +731,10 @@ func (config *Dendrite) checkKafka(configErrs *configErrors, monolithic bool) {
 	checkNotEmpty(configErrs, "kafka.topics.output_client_data", string(config.Kafka.Topics.OutputClientData))
 	checkNotEmpty(configErrs, "kafka.topics.output_typing_event", string(config.Kafka.Topics.OutputTypingEvent))
 	checkNotEmpty(configErrs, "kafka.topics.user_updates", string(config.Kafka.Topics.UserUpdates))
+	checkNotEmpty(configErrs, "kafka.topics.output_key_change_event", string(config.Kafka.Topics.OutputKeyChangeEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_send_to_device_event", string(config.Kafka.Topics.OutputSendToDeviceEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_receipt_event", string(config.Kafka.Topics.OutputReceiptEvent))
+	checkNotEmpty(configErrs, "kafka.topics.output_presence_event", string(config.Kafka.Topics.OutputPresenceEvent))
 }
 
 // checkDatabase verifies the parameters database.* are valid.
@@ -645,6 +780,7 @@ func (config *Dendrite) check(monolithic bool) error {
 	config.checkMatrix(&configErrs)
 	config.checkMedia(&configErrs)
 	config.checkTurn(&configErrs)
+	config.checkLogin(&configErrs)
 	config.checkKafka(&configErrs, monolithic)
 	config.checkDatabase(&configErrs)
 	config.checkLogging(&configErrs)
@@ -751,6 +887,15 @@ func (config *Dendrite) FederationSenderURL() string {
 	return "http://" + string(config.Listen.FederationSender)
 }
 
+// KeyServerURL returns an HTTP URL for where the key server is listening.
+func (config *Dendrite) KeyServerURL() string {
+	// Hard code the key server to talk HTTP for now.
+	// If we support HTTPS we need to think of a practical way to do certificate validation.
+	// People setting up servers shouldn't need to get a certificate valid for the public
+	// internet for an internal API.
+	return "http://" + string(config.Listen.KeyServer)
+}
+
 // SetupTracing configures the opentracing using the supplied configuration.
 func (config *Dendrite) SetupTracing(serviceName string) (closer io.Closer, err error) {
 	if !config.Tracing.Enabled {
@@ -764,17 +909,17 @@ func (config *Dendrite) SetupTracing(serviceName string) (closer io.Closer, err
 }
 
 // MaxIdleConns returns maximum idle connections to the DB
-func (config Dendrite) MaxIdleConns() int {
+func (config *Dendrite) MaxIdleConns() int {
 	return config.Database.MaxIdleConns
 }
 
 // MaxOpenConns returns maximum open connections to the DB
-func (config Dendrite) MaxOpenConns() int {
+func (config *Dendrite) MaxOpenConns() int {
 	return config.Database.MaxOpenConns
 }
 
 // ConnMaxLifetime returns maximum amount of time a connection may be reused
-func (config Dendrite) ConnMaxLifetime() time.Duration {
+func (config *Dendrite) ConnMaxLifetime() time.Duration {
 	return time.Duration(config.Database.ConnMaxLifetimeSec) * time.Second
 }
 
@@ -786,7 +931,7 @@ type DbProperties interface {
 }
 
 // DbProperties returns cfg as a DbProperties interface
-func (config Dendrite) DbProperties() DbProperties {
+func (config *Dendrite) DbProperties() DbProperties {
 	return config
 }
 
@@ -47,6 +47,10 @@ kafka:
     output_client_data: output.client
     output_typing_event: output.typing
     user_updates: output.user
+    output_key_change_event: output.keychange
+    output_send_to_device_event: output.sendtodevice
+    output_receipt_event: output.receipt
+    output_presence_event: output.presence
 database:
   media_api: "postgresql:///media_api"
   account: "postgresql:///account"
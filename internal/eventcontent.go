@@ -36,6 +36,12 @@ type HistoryVisibilityContent struct {
 	HistoryVisibility string `json:"history_visibility"`
 }
 
+// TombstoneContent is the event content for https://matrix.org/docs/spec/client_server/r0.6.0#m-room-tombstone
+type TombstoneContent struct {
+	Body            string `json:"body"`
+	ReplacementRoom string `json:"replacement_room"`
+}
+
 // CanonicalAlias is the event content for https://matrix.org/docs/spec/client_server/r0.6.0#m-room-canonical-alias
 type CanonicalAlias struct {
 	Alias string `json:"alias"`
@@ -11,6 +11,7 @@ import (
 
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
@@ -29,15 +30,39 @@ type BasicAuth struct {
 }
 
 // MakeAuthAPI turns a util.JSONRequestHandler function into an http.Handler which authenticates the request.
+// Requests from guest accounts are rejected.
 func MakeAuthAPI(
 	metricsName string, data auth.Data,
 	f func(*http.Request, *authtypes.Device) util.JSONResponse,
+) http.Handler {
+	return makeAuthAPI(metricsName, data, false, f)
+}
+
+// MakeGuestAuthAPI is like MakeAuthAPI, but also accepts requests from guest
+// accounts. The handler must check device.IsGuest if only part of the API is
+// open to guests.
+func MakeGuestAuthAPI(
+	metricsName string, data auth.Data,
+	f func(*http.Request, *authtypes.Device) util.JSONResponse,
+) http.Handler {
+	return makeAuthAPI(metricsName, data, true, f)
+}
+
+func makeAuthAPI(
+	metricsName string, data auth.Data, allowGuests bool,
+	f func(*http.Request, *authtypes.Device) util.JSONResponse,
 ) http.Handler {
 	h := func(req *http.Request) util.JSONResponse {
 		device, err := auth.VerifyUserFromRequest(req, data)
 		if err != nil {
 			return *err
 		}
+		if device.IsGuest && !allowGuests {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.GuestAccessForbidden("Guest access not allowed"),
+			}
+		}
 		// add the user ID to the logger
 		logger := util.GetLogger((req.Context()))
 		logger = logger.WithField("user_id", device.UserID)
@@ -1,11 +1,26 @@
 package internal
 
 import (
+	"context"
+	"database/sql"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/util"
 )
 
+type testDeviceDatabase map[string]*authtypes.Device
+
+func (d testDeviceDatabase) GetDeviceByAccessToken(ctx context.Context, token string) (*authtypes.Device, error) {
+	if dev, ok := d[token]; ok {
+		return dev, nil
+	}
+	return nil, sql.ErrNoRows
+}
+
 func TestWrapHandlerInBasicAuth(t *testing.T) {
 	type args struct {
 		h http.Handler
@@ -93,3 +108,38 @@ func TestWrapHandlerInBasicAuth(t *testing.T) {
 		})
 	}
 }
+
+func TestMakeAuthAPIGuests(t *testing.T) {
+	data := auth.Data{
+		DeviceDB: testDeviceDatabase{
+			"user_token":  &authtypes.Device{UserID: "@alice:localhost"},
+			"guest_token": &authtypes.Device{UserID: "@1:localhost", IsGuest: true},
+		},
+	}
+	f := func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return util.JSONResponse{Code: http.StatusOK, JSON: struct{}{}}
+	}
+
+	tests := []struct {
+		name    string
+		handler http.Handler
+		token   string
+		want    int
+	}{
+		{"user on auth API", MakeAuthAPI("test", data, f), "user_token", http.StatusOK},
+		{"guest on auth API", MakeAuthAPI("test", data, f), "guest_token", http.StatusForbidden},
+		{"user on guest API", MakeGuestAuthAPI("test", data, f), "user_token", http.StatusOK},
+		{"guest on guest API", MakeGuestAuthAPI("test", data, f), "guest_token", http.StatusOK},
+		{"unknown token on guest API", MakeGuestAuthAPI("test", data, f), "unknown", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://localhost/test?access_token="+tt.token, nil)
+			w := httptest.NewRecorder()
+			tt.handler.ServeHTTP(w, req)
+			if resp := w.Result(); resp.StatusCode != tt.want {
+				t.Errorf("Expected status code %d, got %d", tt.want, resp.StatusCode)
+			}
+		})
+	}
+}
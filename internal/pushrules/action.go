@@ -0,0 +1,123 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// An ActionKind is the kind of a push rule action.
+type ActionKind string
+
+const (
+	// NotifyAction causes each matching event to generate a notification.
+	NotifyAction ActionKind = "notify"
+	// DontNotifyAction prevents the event from generating a notification.
+	DontNotifyAction ActionKind = "dont_notify"
+	// CoalesceAction is treated like notify, as coalescing is not implemented.
+	CoalesceAction ActionKind = "coalesce"
+	// SetTweakAction sets an entry in the tweaks dictionary of the
+	// notification.
+	SetTweakAction ActionKind = "set_tweak"
+)
+
+// A TweakKey names a notification tweak.
+type TweakKey string
+
+const (
+	SoundTweak     TweakKey = "sound"
+	HighlightTweak TweakKey = "highlight"
+)
+
+// An Action is a single push rule action. On the wire simple actions are
+// plain strings, while tweaks are objects.
+type Action struct {
+	Kind  ActionKind
+	Tweak TweakKey
+	// Value is the tweak value. It is nil if the tweak has no value.
+	Value interface{}
+}
+
+// MarshalJSON implements json.Marshaler.
+func (a *Action) MarshalJSON() ([]byte, error) {
+	if a.Kind != SetTweakAction {
+		return json.Marshal(a.Kind)
+	}
+	m := map[string]interface{}{
+		string(SetTweakAction): a.Tweak,
+	}
+	if a.Value != nil {
+		m["value"] = a.Value
+	}
+	return json.Marshal(m)
+}
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *Action) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err == nil {
+		switch ActionKind(s) {
+		case NotifyAction, DontNotifyAction, CoalesceAction:
+			a.Kind = ActionKind(s)
+			return nil
+		default:
+			return fmt.Errorf("unknown push rule action %q", s)
+		}
+	}
+
+	var m struct {
+		Tweak TweakKey    `json:"set_tweak"`
+		Value interface{} `json:"value"`
+	}
+	if err := json.Unmarshal(bs, &m); err != nil {
+		return err
+	}
+	if m.Tweak == "" {
+		return fmt.Errorf("push rule action object has no set_tweak")
+	}
+	a.Kind = SetTweakAction
+	a.Tweak = m.Tweak
+	a.Value = m.Value
+	return nil
+}
+
+// ActionsToTweaks reduces a list of actions to whether the event should
+// notify, and the tweaks to apply to the notification.
+func ActionsToTweaks(actions []*Action) (notify bool, tweaks map[TweakKey]interface{}) {
+	tweaks = map[TweakKey]interface{}{}
+	for _, a := range actions {
+		switch a.Kind {
+		case NotifyAction, CoalesceAction:
+			notify = true
+		case DontNotifyAction:
+			notify = false
+		case SetTweakAction:
+			tweaks[a.Tweak] = a.Value
+		}
+	}
+	return
+}
+
+// IsHighlight returns whether the given tweaks highlight the event. A
+// highlight tweak without a value counts as true.
+func IsHighlight(tweaks map[TweakKey]interface{}) bool {
+	v, ok := tweaks[HighlightTweak]
+	if !ok {
+		return false
+	}
+	b, isBool := v.(bool)
+	return v == nil || (isBool && b)
+}
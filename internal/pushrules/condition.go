@@ -0,0 +1,73 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A ConditionKind is the kind of a push rule condition.
+type ConditionKind string
+
+const (
+	// EventMatchCondition matches a glob pattern against a dotted key
+	// of the event, e.g. "content.body".
+	EventMatchCondition ConditionKind = "event_match"
+	// ContainsDisplayNameCondition matches events whose body contains
+	// the user's current display name in the room.
+	ContainsDisplayNameCondition ConditionKind = "contains_display_name"
+	// RoomMemberCountCondition compares the number of joined members
+	// of the room, e.g. "is": "==2".
+	RoomMemberCountCondition ConditionKind = "room_member_count"
+	// SenderNotificationPermissionCondition matches if the sender has
+	// the power level needed for the given kind of notification.
+	SenderNotificationPermissionCondition ConditionKind = "sender_notification_permission"
+)
+
+// A Condition is a single push rule condition.
+type Condition struct {
+	Kind ConditionKind `json:"kind"`
+	// Key is the dotted event key for event_match, or the notification
+	// key for sender_notification_permission.
+	Key string `json:"key,omitempty"`
+	// Pattern is the glob pattern for event_match.
+	Pattern string `json:"pattern,omitempty"`
+	// Is is the comparison for room_member_count.
+	Is string `json:"is,omitempty"`
+}
+
+// Validate returns an error if the condition could never be evaluated, so
+// that it can be rejected rather than stored.
+func (c *Condition) Validate() error {
+	switch c.Kind {
+	case EventMatchCondition:
+		if c.Key == "" || c.Pattern == "" {
+			return errors.New("event_match conditions require a key and a pattern")
+		}
+	case ContainsDisplayNameCondition:
+	case RoomMemberCountCondition:
+		if _, err := memberCountMatches(c.Is, 0); err != nil {
+			return err
+		}
+	case SenderNotificationPermissionCondition:
+		if c.Key == "" {
+			return errors.New("sender_notification_permission conditions require a key")
+		}
+	default:
+		return fmt.Errorf("unknown condition kind %q", c.Kind)
+	}
+	return nil
+}
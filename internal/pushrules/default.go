@@ -0,0 +1,175 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DefaultAccountRuleSets returns the server-default push rules for the
+// given user, as listed in the spec.
+func DefaultAccountRuleSets(localpart string, serverName gomatrixserverlib.ServerName) *AccountRuleSets {
+	return &AccountRuleSets{
+		Global: *DefaultGlobalRuleSet(localpart, serverName),
+	}
+}
+
+// DefaultGlobalRuleSet returns the server-default global push rules for
+// the given user.
+func DefaultGlobalRuleSet(localpart string, serverName gomatrixserverlib.ServerName) *RuleSet {
+	userID := "@" + localpart + ":" + string(serverName)
+	return &RuleSet{
+		Override: []*Rule{
+			{
+				RuleID:  ".m.rule.master",
+				Default: true,
+				Enabled: false,
+				Actions: []*Action{{Kind: DontNotifyAction}},
+			},
+			{
+				RuleID:  ".m.rule.suppress_notices",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("content.msgtype", "m.notice"),
+				},
+				Actions: []*Action{{Kind: DontNotifyAction}},
+			},
+			{
+				RuleID:  ".m.rule.invite_for_me",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", "m.room.member"),
+					eventMatch("content.membership", "invite"),
+					eventMatch("state_key", userID),
+				},
+				Actions: notifyActions("default", false),
+			},
+			{
+				RuleID:  ".m.rule.member_event",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", "m.room.member"),
+				},
+				Actions: []*Action{{Kind: DontNotifyAction}},
+			},
+			{
+				RuleID:  ".m.rule.contains_display_name",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					{Kind: ContainsDisplayNameCondition},
+				},
+				Actions: notifyActions("default", true),
+			},
+			{
+				RuleID:  ".m.rule.tombstone",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", "m.room.tombstone"),
+					eventMatch("state_key", ""),
+				},
+				Actions: notifyActions("", true),
+			},
+			{
+				RuleID:  ".m.rule.roomnotif",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("content.body", "@room"),
+					{Kind: SenderNotificationPermissionCondition, Key: "room"},
+				},
+				Actions: notifyActions("", true),
+			},
+		},
+		Content: []*Rule{
+			{
+				RuleID:  ".m.rule.contains_user_name",
+				Default: true,
+				Enabled: true,
+				Pattern: localpart,
+				Actions: notifyActions("default", true),
+			},
+		},
+		Room:   []*Rule{},
+		Sender: []*Rule{},
+		Underride: []*Rule{
+			{
+				RuleID:  ".m.rule.call",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", "m.call.invite"),
+				},
+				Actions: notifyActions("ring", false),
+			},
+			{
+				RuleID:  ".m.rule.encrypted_room_one_to_one",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					{Kind: RoomMemberCountCondition, Is: "2"},
+					eventMatch("type", "m.room.encrypted"),
+				},
+				Actions: notifyActions("default", false),
+			},
+			{
+				RuleID:  ".m.rule.room_one_to_one",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					{Kind: RoomMemberCountCondition, Is: "2"},
+					eventMatch("type", "m.room.message"),
+				},
+				Actions: notifyActions("default", false),
+			},
+			{
+				RuleID:  ".m.rule.message",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", "m.room.message"),
+				},
+				Actions: notifyActions("", false),
+			},
+			{
+				RuleID:  ".m.rule.encrypted",
+				Default: true,
+				Enabled: true,
+				Conditions: []*Condition{
+					eventMatch("type", "m.room.encrypted"),
+				},
+				Actions: notifyActions("", false),
+			},
+		},
+	}
+}
+
+func eventMatch(key, pattern string) *Condition {
+	return &Condition{Kind: EventMatchCondition, Key: key, Pattern: pattern}
+}
+
+// notifyActions returns a notify action with the given sound, or no
+// sound if empty, and highlight tweaks.
+func notifyActions(sound string, highlight bool) []*Action {
+	actions := []*Action{{Kind: NotifyAction}}
+	if sound != "" {
+		actions = append(actions, &Action{Kind: SetTweakAction, Tweak: SoundTweak, Value: sound})
+	}
+	return append(actions, &Action{Kind: SetTweakAction, Tweak: HighlightTweak, Value: highlight})
+}
@@ -0,0 +1,206 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// An EvaluationContext provides the room and user specific information
+// needed to evaluate push rule conditions.
+type EvaluationContext interface {
+	// UserDisplayName returns the display name of the user whose rules
+	// are being evaluated, in the room of the event.
+	UserDisplayName() string
+	// RoomMemberCount returns the number of joined members in the room.
+	RoomMemberCount() (int, error)
+	// HasPowerLevel returns whether the user has at least the power
+	// level required by the given notifications key, e.g. "room".
+	HasPowerLevel(userID, levelKey string) (bool, error)
+}
+
+// A RuleSetEvaluator matches events against a user's rule set.
+type RuleSetEvaluator struct {
+	ec      EvaluationContext
+	ruleSet *RuleSet
+}
+
+// NewRuleSetEvaluator creates a new evaluator for the given rule set.
+func NewRuleSetEvaluator(ec EvaluationContext, ruleSet *RuleSet) *RuleSetEvaluator {
+	return &RuleSetEvaluator{ec: ec, ruleSet: ruleSet}
+}
+
+// MatchEvent returns the first enabled rule which matches the event, or
+// nil if no rule matches.
+func (rse *RuleSetEvaluator) MatchEvent(event *gomatrixserverlib.Event) (*Rule, error) {
+	var fields map[string]interface{}
+	if err := json.Unmarshal(event.JSON(), &fields); err != nil {
+		return nil, err
+	}
+	for _, kind := range Kinds {
+		for _, rule := range *rse.ruleSet.RulesForKind(kind) {
+			if !rule.Enabled {
+				continue
+			}
+			ok, err := rse.ruleMatches(kind, rule, event, fields)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				return rule, nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+func (rse *RuleSetEvaluator) ruleMatches(kind Kind, rule *Rule, event *gomatrixserverlib.Event, fields map[string]interface{}) (bool, error) {
+	switch kind {
+	case OverrideKind, UnderrideKind:
+		for _, cond := range rule.Conditions {
+			ok, err := rse.conditionMatches(cond, event, fields)
+			if err != nil || !ok {
+				return false, err
+			}
+		}
+		return true, nil
+	case ContentKind:
+		return patternMatches("content.body", rule.Pattern, fields)
+	case RoomKind:
+		return rule.RuleID == event.RoomID(), nil
+	case SenderKind:
+		return rule.RuleID == event.Sender(), nil
+	default:
+		return false, nil
+	}
+}
+
+func (rse *RuleSetEvaluator) conditionMatches(cond *Condition, event *gomatrixserverlib.Event, fields map[string]interface{}) (bool, error) {
+	switch cond.Kind {
+	case EventMatchCondition:
+		return patternMatches(cond.Key, cond.Pattern, fields)
+	case ContainsDisplayNameCondition:
+		displayName := rse.ec.UserDisplayName()
+		if displayName == "" {
+			return false, nil
+		}
+		body, ok := lookupKey(fields, "content.body")
+		if !ok {
+			return false, nil
+		}
+		re, err := regexp.Compile(`(?i)(^|\W)` + regexp.QuoteMeta(displayName) + `(\W|$)`)
+		if err != nil {
+			return false, err
+		}
+		return re.MatchString(body), nil
+	case RoomMemberCountCondition:
+		count, err := rse.ec.RoomMemberCount()
+		if err != nil {
+			return false, err
+		}
+		return memberCountMatches(cond.Is, count)
+	case SenderNotificationPermissionCondition:
+		return rse.ec.HasPowerLevel(event.Sender(), cond.Key)
+	default:
+		// Unknown conditions never match, as required by the spec.
+		return false, nil
+	}
+}
+
+// patternMatches matches a glob pattern against the value of a dotted
+// event key. The body is matched on word boundaries, other keys must
+// match entirely.
+func patternMatches(key, pattern string, fields map[string]interface{}) (bool, error) {
+	if pattern == "" {
+		return false, nil
+	}
+	value, ok := lookupKey(fields, key)
+	if !ok {
+		return false, nil
+	}
+	re, err := globToRegexp(pattern, key == "content.body")
+	if err != nil {
+		return false, err
+	}
+	return re.MatchString(value), nil
+}
+
+// lookupKey returns the string value of a dotted key such as
+// "content.body", and false if it is absent or not a string.
+func lookupKey(fields map[string]interface{}, key string) (string, bool) {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		v, ok := fields[part]
+		if !ok {
+			return "", false
+		}
+		if i == len(parts)-1 {
+			s, isString := v.(string)
+			return s, isString
+		}
+		if fields, ok = v.(map[string]interface{}); !ok {
+			return "", false
+		}
+	}
+	return "", false
+}
+
+func globToRegexp(pattern string, wordBoundary bool) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	for _, r := range pattern {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	if wordBoundary {
+		return regexp.Compile(`(?i)(^|\W)` + sb.String() + `(\W|$)`)
+	}
+	return regexp.Compile(`(?i)^` + sb.String() + `$`)
+}
+
+// memberCountMatches compares a member count against a condition such as
+// "2", "==2", "<10" or ">=5".
+func memberCountMatches(is string, count int) (bool, error) {
+	op := strings.TrimRight(is, "0123456789")
+	n, err := strconv.Atoi(is[len(op):])
+	if err != nil {
+		return false, fmt.Errorf("invalid room_member_count condition %q", is)
+	}
+	switch op {
+	case "", "==":
+		return count == n, nil
+	case "<":
+		return count < n, nil
+	case ">":
+		return count > n, nil
+	case "<=":
+		return count <= n, nil
+	case ">=":
+		return count >= n, nil
+	default:
+		return false, fmt.Errorf("invalid room_member_count condition %q", is)
+	}
+}
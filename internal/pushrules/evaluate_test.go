@@ -0,0 +1,165 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+type fakeEvaluationContext struct {
+	displayName string
+	memberCount int
+	powerLevels map[string]bool
+}
+
+func (ec *fakeEvaluationContext) UserDisplayName() string       { return ec.displayName }
+func (ec *fakeEvaluationContext) RoomMemberCount() (int, error) { return ec.memberCount, nil }
+func (ec *fakeEvaluationContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	return ec.powerLevels[userID], nil
+}
+
+func mustEvent(t *testing.T, eventJSON string) *gomatrixserverlib.Event {
+	t.Helper()
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return &ev
+}
+
+func messageEvent(t *testing.T, sender, msgtype, body string) *gomatrixserverlib.Event {
+	return mustEvent(t, fmt.Sprintf(
+		`{"event_id":"$ev:test","room_id":"!room:test","type":"m.room.message","sender":%q,"content":{"msgtype":%q,"body":%q}}`,
+		sender, msgtype, body,
+	))
+}
+
+func TestDefaultRuleSetEvaluation(t *testing.T) {
+	rules := DefaultGlobalRuleSet("alice", "test")
+	ec := &fakeEvaluationContext{
+		displayName: "Alice Smith",
+		memberCount: 5,
+		powerLevels: map[string]bool{"@admin:test": true},
+	}
+	tests := []struct {
+		name      string
+		event     *gomatrixserverlib.Event
+		memberCnt int
+		wantRule  string
+	}{
+		{"plain message", messageEvent(t, "@bob:test", "m.text", "hello"), 5, ".m.rule.message"},
+		{"one to one", messageEvent(t, "@bob:test", "m.text", "hello"), 2, ".m.rule.room_one_to_one"},
+		{"notice", messageEvent(t, "@bob:test", "m.notice", "alice"), 5, ".m.rule.suppress_notices"},
+		{"display name", messageEvent(t, "@bob:test", "m.text", "hi alice smith!"), 5, ".m.rule.contains_display_name"},
+		{"user name", messageEvent(t, "@bob:test", "m.text", "ALICE: ping"), 5, ".m.rule.contains_user_name"},
+		{"user name substring", messageEvent(t, "@bob:test", "m.text", "malice"), 5, ".m.rule.message"},
+		{"room notif", messageEvent(t, "@admin:test", "m.text", "@room hello"), 5, ".m.rule.roomnotif"},
+		{"room notif without permission", messageEvent(t, "@bob:test", "m.text", "@room hello"), 5, ".m.rule.message"},
+		{"invite", mustEvent(t, `{"event_id":"$ev:test","room_id":"!room:test","type":"m.room.member","sender":"@bob:test","state_key":"@alice:test","content":{"membership":"invite"}}`), 5, ".m.rule.invite_for_me"},
+		{"member event", mustEvent(t, `{"event_id":"$ev:test","room_id":"!room:test","type":"m.room.member","sender":"@bob:test","state_key":"@bob:test","content":{"membership":"join"}}`), 5, ".m.rule.member_event"},
+		{"unknown event", mustEvent(t, `{"event_id":"$ev:test","room_id":"!room:test","type":"com.example.test","sender":"@bob:test","content":{}}`), 5, ""},
+	}
+	for _, tc := range tests {
+		ec.memberCount = tc.memberCnt
+		rule, err := NewRuleSetEvaluator(ec, rules).MatchEvent(tc.event)
+		if err != nil {
+			t.Fatalf("%s: MatchEvent returned %s", tc.name, err)
+		}
+		got := ""
+		if rule != nil {
+			got = rule.RuleID
+		}
+		if got != tc.wantRule {
+			t.Errorf("%s: MatchEvent returned rule %q, want %q", tc.name, got, tc.wantRule)
+		}
+	}
+}
+
+func TestRoomAndSenderRules(t *testing.T) {
+	rules := DefaultGlobalRuleSet("alice", "test")
+	rules.Room = append(rules.Room, &Rule{RuleID: "!room:test", Enabled: true, Actions: []*Action{{Kind: DontNotifyAction}}})
+	rules.Sender = append(rules.Sender, &Rule{RuleID: "@bob:test", Enabled: true, Actions: []*Action{{Kind: NotifyAction}}})
+	ec := &fakeEvaluationContext{memberCount: 5}
+
+	rule, err := NewRuleSetEvaluator(ec, rules).MatchEvent(messageEvent(t, "@bob:test", "m.text", "hello"))
+	if err != nil {
+		t.Fatalf("MatchEvent returned %s", err)
+	}
+	if rule == nil || rule.RuleID != "!room:test" {
+		t.Fatalf("MatchEvent returned %+v, want room rule", rule)
+	}
+
+	rules.Room[0].Enabled = false
+	rule, err = NewRuleSetEvaluator(ec, rules).MatchEvent(messageEvent(t, "@bob:test", "m.text", "hello"))
+	if err != nil {
+		t.Fatalf("MatchEvent returned %s", err)
+	}
+	if rule == nil || rule.RuleID != "@bob:test" {
+		t.Fatalf("MatchEvent returned %+v, want sender rule", rule)
+	}
+}
+
+func TestMemberCountMatches(t *testing.T) {
+	tests := []struct {
+		is    string
+		count int
+		want  bool
+	}{
+		{"2", 2, true},
+		{"==2", 3, false},
+		{"<10", 9, true},
+		{">10", 10, false},
+		{"<=10", 10, true},
+		{">=10", 9, false},
+	}
+	for _, tc := range tests {
+		got, err := memberCountMatches(tc.is, tc.count)
+		if err != nil {
+			t.Fatalf("memberCountMatches(%q) returned %s", tc.is, err)
+		}
+		if got != tc.want {
+			t.Errorf("memberCountMatches(%q, %d) = %v, want %v", tc.is, tc.count, got, tc.want)
+		}
+	}
+	if _, err := memberCountMatches("!=2", 2); err == nil {
+		t.Errorf("memberCountMatches(\"!=2\") did not return an error")
+	}
+}
+
+func TestActionJSON(t *testing.T) {
+	in := `["notify",{"set_tweak":"sound","value":"default"},{"set_tweak":"highlight"}]`
+	var actions []*Action
+	if err := json.Unmarshal([]byte(in), &actions); err != nil {
+		t.Fatalf("failed to unmarshal actions: %s", err)
+	}
+	notify, tweaks := ActionsToTweaks(actions)
+	if !notify || tweaks[SoundTweak] != "default" || !IsHighlight(tweaks) {
+		t.Fatalf("ActionsToTweaks returned %v, %v", notify, tweaks)
+	}
+	out, err := json.Marshal(actions)
+	if err != nil {
+		t.Fatalf("failed to marshal actions: %s", err)
+	}
+	if string(out) != in {
+		t.Fatalf("actions marshalled to %s, want %s", string(out), in)
+	}
+	if err := json.Unmarshal([]byte(`["shout"]`), &actions); err == nil {
+		t.Fatalf("unknown action did not return an error")
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pushrules implements the push rules described in
+// https://matrix.org/docs/spec/client_server/r0.6.1#push-rules
+package pushrules
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// AccountDataType is the account data type under which a user's push
+// rules are stored.
+const AccountDataType = "m.push_rules"
+
+// GlobalScope is the only push rule scope currently defined by the spec.
+const GlobalScope = "global"
+
+// A Kind is the kind of a push rule, which also determines the order in
+// which rules are evaluated.
+type Kind string
+
+const (
+	OverrideKind  Kind = "override"
+	ContentKind   Kind = "content"
+	RoomKind      Kind = "room"
+	SenderKind    Kind = "sender"
+	UnderrideKind Kind = "underride"
+)
+
+// Kinds lists all rule kinds in the order they are evaluated.
+var Kinds = []Kind{OverrideKind, ContentKind, RoomKind, SenderKind, UnderrideKind}
+
+// AccountRuleSets holds all the push rules of a user.
+type AccountRuleSets struct {
+	Global RuleSet `json:"global"`
+}
+
+// A RuleSet holds the rules of a single scope, grouped by kind.
+type RuleSet struct {
+	Override  []*Rule `json:"override"`
+	Content   []*Rule `json:"content"`
+	Room      []*Rule `json:"room"`
+	Sender    []*Rule `json:"sender"`
+	Underride []*Rule `json:"underride"`
+}
+
+// RulesForKind returns a pointer to the slice holding the rules of the
+// given kind, or nil if the kind is unknown.
+func (rs *RuleSet) RulesForKind(kind Kind) *[]*Rule {
+	switch kind {
+	case OverrideKind:
+		return &rs.Override
+	case ContentKind:
+		return &rs.Content
+	case RoomKind:
+		return &rs.Room
+	case SenderKind:
+		return &rs.Sender
+	case UnderrideKind:
+		return &rs.Underride
+	default:
+		return nil
+	}
+}
+
+// A Rule is a single push rule.
+type Rule struct {
+	// RuleID identifies the rule. For room and sender rules this is the
+	// room ID or user ID the rule applies to.
+	RuleID string `json:"rule_id"`
+	// Default is true for the server-default rules.
+	Default bool `json:"default"`
+	// Enabled is false if the rule should be skipped during evaluation.
+	Enabled bool `json:"enabled"`
+	// Actions describe what to do when the rule matches.
+	Actions []*Action `json:"actions"`
+	// Conditions must all match for the rule to match. Only used by
+	// override and underride rules.
+	Conditions []*Condition `json:"conditions,omitempty"`
+	// Pattern is the glob pattern matched against the event body. Only
+	// used by content rules.
+	Pattern string `json:"pattern,omitempty"`
+}
+
+// Validate returns an error if the rule isn't a valid rule of the given kind:
+// room and sender rules must be identified by a room ID or user ID, content
+// rules need a pattern and the conditions of other rules must be valid.
+func (r *Rule) Validate(kind Kind) error {
+	switch kind {
+	case OverrideKind, UnderrideKind:
+		for _, cond := range r.Conditions {
+			if cond == nil {
+				return errors.New("conditions must not be null")
+			}
+			if err := cond.Validate(); err != nil {
+				return err
+			}
+		}
+	case ContentKind:
+		if r.Pattern == "" {
+			return errors.New("content rules require a pattern")
+		}
+	case RoomKind:
+		if _, _, err := gomatrixserverlib.SplitID('!', r.RuleID); err != nil {
+			return errors.New("room rules must be identified by a room ID")
+		}
+	case SenderKind:
+		if _, _, err := gomatrixserverlib.SplitID('@', r.RuleID); err != nil {
+			return errors.New("sender rules must be identified by a user ID")
+		}
+	default:
+		return fmt.Errorf("unknown rule kind %q", kind)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import "testing"
+
+func TestRuleValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		kind    Kind
+		rule    Rule
+		wantErr bool
+	}{
+		{"override event_match", OverrideKind, Rule{RuleID: "r", Conditions: []*Condition{{Kind: EventMatchCondition, Key: "content.body", Pattern: "cake"}}}, false},
+		{"override no conditions", OverrideKind, Rule{RuleID: "r"}, false},
+		{"underride member count", UnderrideKind, Rule{RuleID: "r", Conditions: []*Condition{{Kind: RoomMemberCountCondition, Is: ">=2"}}}, false},
+		{"override sender permission", OverrideKind, Rule{RuleID: "r", Conditions: []*Condition{{Kind: SenderNotificationPermissionCondition, Key: "room"}}}, false},
+		{"override display name", OverrideKind, Rule{RuleID: "r", Conditions: []*Condition{{Kind: ContainsDisplayNameCondition}}}, false},
+		{"content", ContentKind, Rule{RuleID: "r", Pattern: "cake"}, false},
+		{"room", RoomKind, Rule{RuleID: "!room:example.com"}, false},
+		{"sender", SenderKind, Rule{RuleID: "@alice:example.com"}, false},
+
+		{"unparseable member count", OverrideKind, Rule{RuleID: "r", Conditions: []*Condition{{Kind: RoomMemberCountCondition, Is: "abc"}}}, true},
+		{"event_match without pattern", OverrideKind, Rule{RuleID: "r", Conditions: []*Condition{{Kind: EventMatchCondition, Key: "content.body"}}}, true},
+		{"event_match without key", UnderrideKind, Rule{RuleID: "r", Conditions: []*Condition{{Kind: EventMatchCondition, Pattern: "cake"}}}, true},
+		{"sender permission without key", OverrideKind, Rule{RuleID: "r", Conditions: []*Condition{{Kind: SenderNotificationPermissionCondition}}}, true},
+		{"unknown condition", OverrideKind, Rule{RuleID: "r", Conditions: []*Condition{{Kind: "frobnicate"}}}, true},
+		{"null condition", OverrideKind, Rule{RuleID: "r", Conditions: []*Condition{nil}}, true},
+		{"content without pattern", ContentKind, Rule{RuleID: "r"}, true},
+		{"room with user ID", RoomKind, Rule{RuleID: "@alice:example.com"}, true},
+		{"sender with room ID", SenderKind, Rule{RuleID: "!room:example.com"}, true},
+		{"unknown kind", Kind("sideways"), Rule{RuleID: "r"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.rule.Validate(tt.kind)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Validate returned %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
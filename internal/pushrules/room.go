@@ -0,0 +1,159 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushrules
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// DefaultRoomNotificationLevel is the power level needed to notify the whole
+// room with "@room" if the power levels don't say otherwise.
+const DefaultRoomNotificationLevel = 50
+
+// An AccountDataDatabase can look up the account data in which a user's push
+// rules are stored.
+type AccountDataDatabase interface {
+	GetAccountDataByType(ctx context.Context, localpart, roomID, dataType string) (*gomatrixserverlib.ClientEvent, error)
+}
+
+// QueryAccountRuleSets returns the push rules of a local user, falling back
+// to the server-default rules if the user has never changed them.
+func QueryAccountRuleSets(
+	ctx context.Context, db AccountDataDatabase, localpart string, serverName gomatrixserverlib.ServerName,
+) (*AccountRuleSets, error) {
+	data, err := db.GetAccountDataByType(ctx, localpart, "", AccountDataType)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return DefaultAccountRuleSets(localpart, serverName), nil
+	}
+	var ruleSets AccountRuleSets
+	if err = json.Unmarshal(data.Content, &ruleSets); err != nil {
+		return nil, err
+	}
+	return &ruleSets, nil
+}
+
+// RoomState holds the parts of the state of a room which are needed to
+// evaluate push rules and build notifications.
+type RoomState struct {
+	Name           string
+	CanonicalAlias string
+	Members        map[string]gomatrixserverlib.MemberContent
+	JoinedCount    int
+	PowerLevels    RoomPowerLevels
+}
+
+// RoomPowerLevels is the content of an m.room.power_levels event, including
+// the levels needed to send notifications.
+type RoomPowerLevels struct {
+	gomatrixserverlib.PowerLevelContent
+	Notifications map[string]int64 `json:"notifications"`
+}
+
+// NewRoomState builds the room state from the given state events. Events
+// which aren't needed for push rules are ignored.
+func NewRoomState(stateEvents []gomatrixserverlib.HeaderedEvent) *RoomState {
+	room := &RoomState{
+		Members: make(map[string]gomatrixserverlib.MemberContent),
+	}
+	for _, ev := range stateEvents {
+		switch ev.Type() {
+		case gomatrixserverlib.MRoomMember:
+			var content gomatrixserverlib.MemberContent
+			if err := json.Unmarshal(ev.Content(), &content); err != nil || ev.StateKey() == nil {
+				continue
+			}
+			room.Members[*ev.StateKey()] = content
+			if content.Membership == gomatrixserverlib.Join {
+				room.JoinedCount++
+			}
+		case gomatrixserverlib.MRoomPowerLevels:
+			_ = json.Unmarshal(ev.Content(), &room.PowerLevels)
+		case "m.room.name":
+			var content struct {
+				Name string `json:"name"`
+			}
+			if json.Unmarshal(ev.Content(), &content) == nil {
+				room.Name = content.Name
+			}
+		case "m.room.canonical_alias":
+			var content struct {
+				Alias string `json:"alias"`
+			}
+			if json.Unmarshal(ev.Content(), &content) == nil {
+				room.CanonicalAlias = content.Alias
+			}
+		}
+	}
+	return room
+}
+
+// LocalTargets returns the local users who may be notified about the event:
+// everyone joined to the room except the sender, and the target of an invite.
+func (r *RoomState) LocalTargets(serverName gomatrixserverlib.ServerName, ev *gomatrixserverlib.HeaderedEvent) []string {
+	var targets []string
+	for userID, member := range r.Members {
+		if userID == ev.Sender() {
+			continue
+		}
+		if member.Membership != gomatrixserverlib.Join &&
+			!(member.Membership == gomatrixserverlib.Invite && ev.StateKeyEquals(userID)) {
+			continue
+		}
+		if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != serverName {
+			continue
+		}
+		targets = append(targets, userID)
+	}
+	return targets
+}
+
+// DisplayName returns the display name of the user in the room.
+func (r *RoomState) DisplayName(userID string) string {
+	return r.Members[userID].DisplayName
+}
+
+// EvaluationContext returns an EvaluationContext for evaluating the push
+// rules of the given user in the room.
+func (r *RoomState) EvaluationContext(userID string) EvaluationContext {
+	return &roomEvaluationContext{room: r, displayName: r.DisplayName(userID)}
+}
+
+// roomEvaluationContext implements EvaluationContext for a user in a room.
+type roomEvaluationContext struct {
+	room        *RoomState
+	displayName string
+}
+
+func (ec *roomEvaluationContext) UserDisplayName() string {
+	return ec.displayName
+}
+
+func (ec *roomEvaluationContext) RoomMemberCount() (int, error) {
+	return ec.room.JoinedCount, nil
+}
+
+func (ec *roomEvaluationContext) HasPowerLevel(userID, levelKey string) (bool, error) {
+	required, ok := ec.room.PowerLevels.Notifications[levelKey]
+	if !ok {
+		required = DefaultRoomNotificationLevel
+	}
+	return ec.room.PowerLevels.UserLevel(userID) >= required, nil
+}
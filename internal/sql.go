@@ -101,6 +101,39 @@ func SQLiteDriverName() string {
 	return "sqlite3"
 }
 
+// SQLiteAddColumnIfNotExists adds a column to a table which was created before
+// the column existed. SQLite doesn't support ADD COLUMN IF NOT EXISTS, so the
+// existing columns are looked up first. Since the table already has rows, the
+// definition must include a default if the column is NOT NULL.
+func SQLiteAddColumnIfNotExists(db *sql.DB, table, column, definition string) error {
+	exists, err := sqliteColumnExists(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func sqliteColumnExists(db *sql.DB, table, column string) (bool, error) {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close() // nolint: errcheck
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
 // DbProperties functions return properties used by database/sql/DB
 type DbProperties interface {
 	MaxIdleConns() int
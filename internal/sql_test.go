@@ -0,0 +1,48 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"database/sql"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestSQLiteAddColumnIfNotExists(t *testing.T) {
+	db, err := sql.Open("sqlite3", "file::memory:")
+	if err != nil {
+		t.Fatalf("failed to open database: %s", err)
+	}
+	defer db.Close() // nolint: errcheck
+	db.SetMaxOpenConns(1)
+
+	if _, err = db.Exec("CREATE TABLE test (id TEXT NOT NULL PRIMARY KEY); INSERT INTO test (id) VALUES ('a')"); err != nil {
+		t.Fatalf("failed to create table: %s", err)
+	}
+	// Adding the column twice should be a no-op the second time.
+	for i := 0; i < 2; i++ {
+		if err = SQLiteAddColumnIfNotExists(db, "test", "flag", "BOOLEAN NOT NULL DEFAULT FALSE"); err != nil {
+			t.Fatalf("SQLiteAddColumnIfNotExists failed: %s", err)
+		}
+	}
+	var flag bool
+	if err = db.QueryRow("SELECT flag FROM test WHERE id = 'a'").Scan(&flag); err != nil {
+		t.Fatalf("failed to select new column: %s", err)
+	}
+	if flag {
+		t.Fatalf("existing row didn't get the column default")
+	}
+}
@@ -85,6 +85,10 @@ func MakeConfig(configDir, kafkaURI, database, host string, startPort int) (*con
 	cfg.Kafka.Topics.OutputClientData = "test.clientapi.output"
 	cfg.Kafka.Topics.OutputTypingEvent = "test.typing.output"
 	cfg.Kafka.Topics.UserUpdates = "test.user.output"
+	cfg.Kafka.Topics.OutputKeyChangeEvent = "test.keychange.output"
+	cfg.Kafka.Topics.OutputSendToDeviceEvent = "test.sendtodevice.output"
+	cfg.Kafka.Topics.OutputReceiptEvent = "test.receipt.output"
+	cfg.Kafka.Topics.OutputPresenceEvent = "test.presence.output"
 
 	// TODO: Use different databases for the different schemas.
 	// Using the same database for every schema currently works because
@@ -98,6 +102,7 @@ func MakeConfig(configDir, kafkaURI, database, host string, startPort int) (*con
 	cfg.Database.ServerKey = config.DataSource(database)
 	cfg.Database.SyncAPI = config.DataSource(database)
 	cfg.Database.PublicRoomsAPI = config.DataSource(database)
+	cfg.Database.KeyServer = config.DataSource(database)
 
 	cfg.Listen.ClientAPI = assignAddress()
 	cfg.Listen.AppServiceAPI = assignAddress()
@@ -107,6 +112,7 @@ func MakeConfig(configDir, kafkaURI, database, host string, startPort int) (*con
 	cfg.Listen.SyncAPI = assignAddress()
 	cfg.Listen.PublicRoomsAPI = assignAddress()
 	cfg.Listen.EDUServer = assignAddress()
+	cfg.Listen.KeyServer = assignAddress()
 
 	// Bind to the same address as the listen address
 	// All microservices are run on the same host in testing
@@ -118,6 +124,7 @@ func MakeConfig(configDir, kafkaURI, database, host string, startPort int) (*con
 	cfg.Bind.SyncAPI = cfg.Listen.SyncAPI
 	cfg.Bind.PublicRoomsAPI = cfg.Listen.PublicRoomsAPI
 	cfg.Bind.EDUServer = cfg.Listen.EDUServer
+	cfg.Bind.KeyServer = cfg.Listen.KeyServer
 
 	return &cfg, port, nil
 }
@@ -0,0 +1,274 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package api provides the types that are used to communicate with the key server.
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// KeyInternalAPI is used to store and retrieve end-to-end encryption keys.
+type KeyInternalAPI interface {
+	// Store device keys and one-time keys for local devices.
+	PerformUploadKeys(
+		ctx context.Context,
+		request *PerformUploadKeysRequest,
+		response *PerformUploadKeysResponse,
+	) error
+	// Claim one-time keys for local or remote devices.
+	PerformClaimKeys(
+		ctx context.Context,
+		request *PerformClaimKeysRequest,
+		response *PerformClaimKeysResponse,
+	) error
+	// Query the device keys for local or remote users.
+	QueryKeys(
+		ctx context.Context,
+		request *QueryKeysRequest,
+		response *QueryKeysResponse,
+	) error
+	// Query how many unclaimed one-time keys a local device has left.
+	QueryOneTimeKeys(
+		ctx context.Context,
+		request *QueryOneTimeKeysRequest,
+		response *QueryOneTimeKeysResponse,
+	) error
+	// Remove the keys for the given local devices, e.g. because they have
+	// been deleted or logged out.
+	PerformDeleteKeys(
+		ctx context.Context,
+		request *PerformDeleteKeysRequest,
+		response *PerformDeleteKeysResponse,
+	) error
+	// Query the current device list for a local user, along with the
+	// latest device list stream ID.
+	QueryDeviceMessages(
+		ctx context.Context,
+		request *QueryDeviceMessagesRequest,
+		response *QueryDeviceMessagesResponse,
+	) error
+	// Handle an m.device_list_update EDU received from a remote server.
+	InputDeviceListUpdate(
+		ctx context.Context,
+		request *InputDeviceListUpdateRequest,
+		response *InputDeviceListUpdateResponse,
+	) error
+}
+
+// KeyError is returned if there was a problem performing/querying the server
+// which should be reported back to the client, e.g. because the uploaded keys
+// were malformed. It is carried in the response rather than returned as an
+// error so that it survives the internal HTTP API.
+type KeyError struct {
+	Err string `json:"error"`
+}
+
+func (k *KeyError) Error() string {
+	return k.Err
+}
+
+// DeviceKeys represents a set of device keys for a single device
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-keys-upload
+type DeviceKeys struct {
+	// The user who owns this device
+	UserID string `json:"user_id"`
+	// The device ID of this device
+	DeviceID string `json:"device_id"`
+	// The raw device key JSON
+	KeyJSON json.RawMessage `json:"key_json"`
+	// The display name of this device, which is shared with remote servers
+	DisplayName string `json:"display_name"`
+}
+
+// DeviceMessage is sent on the key change Kafka topic whenever a device
+// or its keys are added, changed or removed. The StreamID increases
+// monotonically per user.
+type DeviceMessage struct {
+	DeviceKeys
+	// The device list stream ID after this change was applied
+	StreamID int64 `json:"stream_id"`
+	// True if the device was deleted
+	Deleted bool `json:"deleted,omitempty"`
+}
+
+// DeviceListUpdateEvent is the content of an m.device_list_update EDU
+// https://matrix.org/docs/spec/server_server/r0.1.4#m-device-list-update-schema
+type DeviceListUpdateEvent struct {
+	UserID            string          `json:"user_id"`
+	DeviceID          string          `json:"device_id"`
+	DeviceDisplayName string          `json:"device_display_name,omitempty"`
+	StreamID          int64           `json:"stream_id"`
+	PrevID            []int64         `json:"prev_id,omitempty"`
+	Deleted           bool            `json:"deleted,omitempty"`
+	Keys              json.RawMessage `json:"keys,omitempty"`
+}
+
+// OneTimeKeys represents a set of one-time keys for a single device
+// https://matrix.org/docs/spec/client_server/r0.6.1#post-matrix-client-r0-keys-upload
+type OneTimeKeys struct {
+	// The user who owns this device
+	UserID string `json:"user_id"`
+	// The device ID of this device
+	DeviceID string `json:"device_id"`
+	// A map of algorithm:key_id => key JSON
+	KeyJSON map[string]json.RawMessage `json:"key_json"`
+}
+
+// Split a key in KeyJSON into algorithm and key ID
+func (k *OneTimeKeys) Split(keyIDWithAlgo string) (algo string, keyID string) {
+	segments := strings.Split(keyIDWithAlgo, ":")
+	return segments[0], strings.Join(segments[1:], ":")
+}
+
+// OneTimeKeysCount represents the counts of one-time keys for a single device
+type OneTimeKeysCount struct {
+	// The user who owns this device
+	UserID string `json:"user_id"`
+	// The device ID of this device
+	DeviceID string `json:"device_id"`
+	// algorithm to count e.g:
+	// {
+	//   "curve25519": 10,
+	//   "signed_curve25519": 20
+	// }
+	KeyCount map[string]int `json:"key_count"`
+}
+
+// PerformUploadKeysRequest is the request to PerformUploadKeys
+type PerformUploadKeysRequest struct {
+	DeviceKeys  []DeviceKeys  `json:"device_keys"`
+	OneTimeKeys []OneTimeKeys `json:"one_time_keys"`
+	// OnlyDisplayNameUpdates should be set if only the display names of
+	// the devices have changed. The existing key JSON will be kept and
+	// KeyJSON in DeviceKeys will be ignored.
+	OnlyDisplayNameUpdates bool `json:"only_display_name_updates"`
+}
+
+// PerformUploadKeysResponse is the response to PerformUploadKeys
+type PerformUploadKeysResponse struct {
+	// Set if any of the uploaded keys were rejected.
+	Error *KeyError `json:"error,omitempty"`
+	// The counts of one-time keys remaining for each device that
+	// had one-time keys uploaded.
+	OneTimeKeyCounts []OneTimeKeysCount `json:"one_time_key_counts"`
+}
+
+// PerformClaimKeysRequest is the request to PerformClaimKeys
+type PerformClaimKeysRequest struct {
+	// Map of user_id to device_id to algorithm name
+	OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+	// The time to wait for remote servers to respond, in milliseconds.
+	TimeoutMS int64 `json:"timeout_ms"`
+}
+
+// PerformClaimKeysResponse is the response to PerformClaimKeys
+type PerformClaimKeysResponse struct {
+	// Map of user_id to device_id to algorithm:key_id to key JSON
+	OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+	// Map of remote server domain to error JSON
+	Failures map[string]interface{} `json:"failures"`
+}
+
+// QueryKeysRequest is the request to QueryKeys
+type QueryKeysRequest struct {
+	// Maps user IDs to a list of devices. An empty list of devices
+	// means that all devices for that user should be returned.
+	UserToDevices map[string][]string `json:"user_to_devices"`
+	// The time to wait for remote servers to respond, in milliseconds.
+	TimeoutMS int64 `json:"timeout_ms"`
+}
+
+// QueryKeysResponse is the response to QueryKeys
+type QueryKeysResponse struct {
+	// Map of remote server domain to error JSON
+	Failures map[string]interface{} `json:"failures"`
+	// Map of user_id to device_id to device_key
+	DeviceKeys map[string]map[string]json.RawMessage `json:"device_keys"`
+}
+
+// QueryOneTimeKeysRequest is the request to QueryOneTimeKeys
+type QueryOneTimeKeysRequest struct {
+	// The local user to query OTK counts for
+	UserID string `json:"user_id"`
+	// The device to query OTK counts for
+	DeviceID string `json:"device_id"`
+}
+
+// QueryOneTimeKeysResponse is the response to QueryOneTimeKeys
+type QueryOneTimeKeysResponse struct {
+	// OTK key counts, in the extended /sync form described by https://matrix.org/docs/spec/client_server/r0.6.1#id84
+	Count OneTimeKeysCount `json:"count"`
+}
+
+// PerformDeleteKeysRequest is the request to PerformDeleteKeys
+type PerformDeleteKeysRequest struct {
+	// The local user who owns the devices
+	UserID string `json:"user_id"`
+	// The devices to remove keys for
+	DeviceIDs []string `json:"device_ids"`
+}
+
+// PerformDeleteKeysResponse is the response to PerformDeleteKeys
+type PerformDeleteKeysResponse struct {
+	// Set if the keys could not be deleted, e.g. because the user isn't local.
+	Error *KeyError `json:"error,omitempty"`
+}
+
+// QueryDeviceMessagesRequest is the request to QueryDeviceMessages
+type QueryDeviceMessagesRequest struct {
+	// The user to query the device list for
+	UserID string `json:"user_id"`
+}
+
+// QueryDeviceMessagesResponse is the response to QueryDeviceMessages
+type QueryDeviceMessagesResponse struct {
+	// The latest device list stream ID for this user
+	StreamID int64 `json:"stream_id"`
+	// The devices which have keys
+	Devices []DeviceMessage `json:"devices"`
+	Error   *KeyError       `json:"error,omitempty"`
+}
+
+// InputDeviceListUpdateRequest is the request to InputDeviceListUpdate
+type InputDeviceListUpdateRequest struct {
+	// The server which sent the EDU
+	Origin gomatrixserverlib.ServerName `json:"origin"`
+	Event  DeviceListUpdateEvent        `json:"event"`
+}
+
+// InputDeviceListUpdateResponse is the response to InputDeviceListUpdate
+type InputDeviceListUpdateResponse struct {
+	Error *KeyError `json:"error,omitempty"`
+}
+
+// NewKeyInternalAPIHTTP creates a KeyInternalAPI implemented by talking to a HTTP POST API.
+// If httpClient is nil an error is returned
+func NewKeyInternalAPIHTTP(keyServerURL string, httpClient *http.Client) (KeyInternalAPI, error) {
+	if httpClient == nil {
+		return nil, errors.New("NewKeyInternalAPIHTTP: httpClient is <nil>")
+	}
+	return &httpKeyInternalAPI{keyServerURL, httpClient}, nil
+}
+
+type httpKeyInternalAPI struct {
+	keyServerURL string
+	httpClient   *http.Client
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package api
+
+import (
+	"context"
+
+	internalHTTP "github.com/matrix-org/dendrite/internal/http"
+	"github.com/opentracing/opentracing-go"
+)
+
+const (
+	// KeyServerPerformUploadKeysPath is the HTTP path for the PerformUploadKeys API.
+	KeyServerPerformUploadKeysPath = "/api/keyserver/performUploadKeys"
+
+	// KeyServerPerformClaimKeysPath is the HTTP path for the PerformClaimKeys API.
+	KeyServerPerformClaimKeysPath = "/api/keyserver/performClaimKeys"
+
+	// KeyServerQueryKeysPath is the HTTP path for the QueryKeys API.
+	KeyServerQueryKeysPath = "/api/keyserver/queryKeys"
+
+	// KeyServerQueryOneTimeKeysPath is the HTTP path for the QueryOneTimeKeys API.
+	KeyServerQueryOneTimeKeysPath = "/api/keyserver/queryOneTimeKeys"
+
+	// KeyServerPerformDeleteKeysPath is the HTTP path for the PerformDeleteKeys API.
+	KeyServerPerformDeleteKeysPath = "/api/keyserver/performDeleteKeys"
+
+	// KeyServerQueryDeviceMessagesPath is the HTTP path for the QueryDeviceMessages API.
+	KeyServerQueryDeviceMessagesPath = "/api/keyserver/queryDeviceMessages"
+
+	// KeyServerInputDeviceListUpdatePath is the HTTP path for the InputDeviceListUpdate API.
+	KeyServerInputDeviceListUpdatePath = "/api/keyserver/inputDeviceListUpdate"
+)
+
+// PerformUploadKeys implements KeyInternalAPI
+func (h *httpKeyInternalAPI) PerformUploadKeys(
+	ctx context.Context,
+	request *PerformUploadKeysRequest,
+	response *PerformUploadKeysResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUploadKeys")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerPerformUploadKeysPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// PerformClaimKeys implements KeyInternalAPI
+func (h *httpKeyInternalAPI) PerformClaimKeys(
+	ctx context.Context,
+	request *PerformClaimKeysRequest,
+	response *PerformClaimKeysResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformClaimKeys")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerPerformClaimKeysPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryKeys implements KeyInternalAPI
+func (h *httpKeyInternalAPI) QueryKeys(
+	ctx context.Context,
+	request *QueryKeysRequest,
+	response *QueryKeysResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryKeys")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerQueryKeysPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryOneTimeKeys implements KeyInternalAPI
+func (h *httpKeyInternalAPI) QueryOneTimeKeys(
+	ctx context.Context,
+	request *QueryOneTimeKeysRequest,
+	response *QueryOneTimeKeysResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryOneTimeKeys")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerQueryOneTimeKeysPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// PerformDeleteKeys implements KeyInternalAPI
+func (h *httpKeyInternalAPI) PerformDeleteKeys(
+	ctx context.Context,
+	request *PerformDeleteKeysRequest,
+	response *PerformDeleteKeysResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformDeleteKeys")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerPerformDeleteKeysPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryDeviceMessages implements KeyInternalAPI
+func (h *httpKeyInternalAPI) QueryDeviceMessages(
+	ctx context.Context,
+	request *QueryDeviceMessagesRequest,
+	response *QueryDeviceMessagesResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryDeviceMessages")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerQueryDeviceMessagesPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// InputDeviceListUpdate implements KeyInternalAPI
+func (h *httpKeyInternalAPI) InputDeviceListUpdate(
+	ctx context.Context,
+	request *InputDeviceListUpdateRequest,
+	response *InputDeviceListUpdateResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "InputDeviceListUpdate")
+	defer span.Finish()
+
+	apiURL := h.keyServerURL + KeyServerInputDeviceListUpdatePath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -0,0 +1,172 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/producers"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// defaultRemoteTimeout is how long we will wait for a remote server to
+// respond to a key query or claim if the client didn't specify a timeout.
+const defaultRemoteTimeout = 10 * time.Second
+
+// KeyInternalAPI is an implementation of api.KeyInternalAPI
+type KeyInternalAPI struct {
+	DB         storage.Database
+	Cfg        *config.Dendrite
+	FedClient  *gomatrixserverlib.FederationClient
+	ThisServer gomatrixserverlib.ServerName
+	Producer   *producers.KeyChange
+}
+
+// doFederationRequest signs and sends a request to a remote server, decoding
+// the response into resBody. It is used for the federation key endpoints,
+// which the gomatrixserverlib FederationClient does not expose itself.
+func (a *KeyInternalAPI) doFederationRequest(
+	ctx context.Context,
+	destination gomatrixserverlib.ServerName,
+	method, path string,
+	content, resBody interface{},
+) error {
+	req := gomatrixserverlib.NewFederationRequest(method, destination, path)
+	if content != nil {
+		if err := req.SetContent(content); err != nil {
+			return err
+		}
+	}
+	if err := req.Sign(a.ThisServer, a.Cfg.Matrix.KeyID, a.Cfg.Matrix.PrivateKey); err != nil {
+		return err
+	}
+	httpReq, err := req.HTTPRequest()
+	if err != nil {
+		return err
+	}
+	return a.FedClient.DoRequestAndParseResponse(ctx, httpReq, resBody)
+}
+
+// remoteTimeout converts a timeout in milliseconds from a request into a
+// duration, falling back to a sensible default.
+func remoteTimeout(timeoutMS int64) time.Duration {
+	if timeoutMS <= 0 {
+		return defaultRemoteTimeout
+	}
+	return time.Duration(timeoutMS) * time.Millisecond
+}
+
+// SetupHTTP adds the KeyInternalAPI handlers to the http.ServeMux.
+func (a *KeyInternalAPI) SetupHTTP(servMux *http.ServeMux) {
+	servMux.Handle(api.KeyServerPerformUploadKeysPath,
+		internal.MakeInternalAPI("performUploadKeys", func(req *http.Request) util.JSONResponse {
+			var request api.PerformUploadKeysRequest
+			var response api.PerformUploadKeysResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := a.PerformUploadKeys(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.KeyServerPerformClaimKeysPath,
+		internal.MakeInternalAPI("performClaimKeys", func(req *http.Request) util.JSONResponse {
+			var request api.PerformClaimKeysRequest
+			var response api.PerformClaimKeysResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := a.PerformClaimKeys(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.KeyServerQueryKeysPath,
+		internal.MakeInternalAPI("queryKeys", func(req *http.Request) util.JSONResponse {
+			var request api.QueryKeysRequest
+			var response api.QueryKeysResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := a.QueryKeys(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.KeyServerQueryOneTimeKeysPath,
+		internal.MakeInternalAPI("queryOneTimeKeys", func(req *http.Request) util.JSONResponse {
+			var request api.QueryOneTimeKeysRequest
+			var response api.QueryOneTimeKeysResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := a.QueryOneTimeKeys(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.KeyServerPerformDeleteKeysPath,
+		internal.MakeInternalAPI("performDeleteKeys", func(req *http.Request) util.JSONResponse {
+			var request api.PerformDeleteKeysRequest
+			var response api.PerformDeleteKeysResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := a.PerformDeleteKeys(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.KeyServerQueryDeviceMessagesPath,
+		internal.MakeInternalAPI("queryDeviceMessages", func(req *http.Request) util.JSONResponse {
+			var request api.QueryDeviceMessagesRequest
+			var response api.QueryDeviceMessagesResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := a.QueryDeviceMessages(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.KeyServerInputDeviceListUpdatePath,
+		internal.MakeInternalAPI("inputDeviceListUpdate", func(req *http.Request) util.JSONResponse {
+			var request api.InputDeviceListUpdateRequest
+			var response api.InputDeviceListUpdateResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := a.InputDeviceListUpdate(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// resyncTimeout is how long we will wait for a remote server to return
+// the full device list for one of its users.
+const resyncTimeout = 30 * time.Second
+
+// InputDeviceListUpdate implements api.KeyInternalAPI
+func (a *KeyInternalAPI) InputDeviceListUpdate(
+	ctx context.Context,
+	request *api.InputDeviceListUpdateRequest,
+	response *api.InputDeviceListUpdateResponse,
+) error {
+	event := request.Event
+	_, serverName, err := gomatrixserverlib.SplitID('@', event.UserID)
+	if err != nil {
+		response.Error = &api.KeyError{Err: fmt.Sprintf("invalid user ID %q", event.UserID)}
+		return nil
+	}
+	// Servers may only send updates about their own users, and we are the
+	// authority on our own users.
+	if serverName != request.Origin || serverName == a.ThisServer {
+		response.Error = &api.KeyError{
+			Err: fmt.Sprintf("server %q cannot send device list updates for user %q", request.Origin, event.UserID),
+		}
+		return nil
+	}
+
+	prevStreamID, err := a.DB.DeviceListStreamID(ctx, event.UserID)
+	if err != nil {
+		return fmt.Errorf("a.DB.DeviceListStreamID: %w", err)
+	}
+	if event.StreamID <= prevStreamID {
+		// we've already seen this update
+		return nil
+	}
+
+	// If the update refers to a previous update that we haven't seen then
+	// our copy of the device list might be missing changes, so fetch the
+	// whole device list again instead of applying the update on its own.
+	for _, prevID := range event.PrevID {
+		if prevID > prevStreamID {
+			go a.resyncDeviceList(serverName, event)
+			return nil
+		}
+	}
+
+	msg := api.DeviceMessage{
+		DeviceKeys: api.DeviceKeys{
+			UserID:      event.UserID,
+			DeviceID:    event.DeviceID,
+			KeyJSON:     event.Keys,
+			DisplayName: event.DeviceDisplayName,
+		},
+		StreamID: event.StreamID,
+		Deleted:  event.Deleted,
+	}
+	if err = a.DB.StoreRemoteDeviceKeys(ctx, msg); err != nil {
+		return fmt.Errorf("a.DB.StoreRemoteDeviceKeys: %w", err)
+	}
+	if err = a.Producer.ProduceKeyChanges([]api.DeviceMessage{msg}); err != nil {
+		return fmt.Errorf("a.Producer.ProduceKeyChanges: %w", err)
+	}
+	return nil
+}
+
+type userDevicesFederationResponse struct {
+	UserID   string `json:"user_id"`
+	StreamID int64  `json:"stream_id"`
+	Devices  []struct {
+		DeviceID          string                 `json:"device_id"`
+		DeviceDisplayName string                 `json:"device_display_name"`
+		Keys              map[string]interface{} `json:"keys"`
+	} `json:"devices"`
+}
+
+// resyncDeviceList replaces our copy of a remote user's device list with
+// the one that their server returns from /user/devices. It is run in the
+// background so that we don't hold up the transaction that the update
+// arrived in.
+func (a *KeyInternalAPI) resyncDeviceList(serverName gomatrixserverlib.ServerName, event api.DeviceListUpdateEvent) {
+	ctx, cancel := context.WithTimeout(context.Background(), resyncTimeout)
+	defer cancel()
+	logger := util.GetLogger(ctx).WithField("user_id", event.UserID).WithField("server", serverName)
+
+	var res userDevicesFederationResponse
+	path := "/_matrix/federation/v1/user/devices/" + url.PathEscape(event.UserID)
+	if err := a.doFederationRequest(ctx, serverName, http.MethodGet, path, nil, &res); err != nil {
+		logger.WithError(err).Error("failed to resync remote device list")
+		return
+	}
+	if res.UserID != event.UserID {
+		logger.Errorf("remote server returned device list for the wrong user %q", res.UserID)
+		return
+	}
+
+	keys := make([]api.DeviceKeys, 0, len(res.Devices))
+	for _, device := range res.Devices {
+		dk := api.DeviceKeys{
+			UserID:      event.UserID,
+			DeviceID:    device.DeviceID,
+			DisplayName: device.DeviceDisplayName,
+		}
+		if device.Keys != nil {
+			keyJSON, err := json.Marshal(device.Keys)
+			if err != nil {
+				logger.WithError(err).Error("failed to marshal remote device keys")
+				return
+			}
+			dk.KeyJSON = keyJSON
+		}
+		keys = append(keys, dk)
+	}
+	if err := a.DB.ReplaceRemoteDeviceList(ctx, event.UserID, keys, res.StreamID); err != nil {
+		logger.WithError(err).Error("failed to store resynced device list")
+		return
+	}
+
+	// Let the sync API know that this user's devices have changed.
+	msg := api.DeviceMessage{
+		DeviceKeys: api.DeviceKeys{
+			UserID:   event.UserID,
+			DeviceID: event.DeviceID,
+		},
+		StreamID: res.StreamID,
+		Deleted:  event.Deleted,
+	}
+	if err := a.Producer.ProduceKeyChanges([]api.DeviceMessage{msg}); err != nil {
+		logger.WithError(err).Error("failed to produce key change after resync")
+	}
+}
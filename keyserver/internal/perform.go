@@ -0,0 +1,290 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// PerformUploadKeys implements api.KeyInternalAPI
+func (a *KeyInternalAPI) PerformUploadKeys(
+	ctx context.Context,
+	request *api.PerformUploadKeysRequest,
+	response *api.PerformUploadKeysResponse,
+) error {
+	if err := a.uploadDeviceKeys(ctx, request, response); err != nil || response.Error != nil {
+		return err
+	}
+	return a.uploadOneTimeKeys(ctx, request, response)
+}
+
+func (a *KeyInternalAPI) uploadDeviceKeys(
+	ctx context.Context,
+	request *api.PerformUploadKeysRequest,
+	response *api.PerformUploadKeysResponse,
+) error {
+	keysToStore := make([]api.DeviceKeys, 0, len(request.DeviceKeys))
+	for _, key := range request.DeviceKeys {
+		if err := a.checkLocalUser(key.UserID); err != nil {
+			response.Error = err
+			return nil
+		}
+		if request.OnlyDisplayNameUpdates {
+			keysToStore = append(keysToStore, key)
+			continue
+		}
+		// The user and device IDs inside the signed key JSON must match
+		// the device that the keys are being uploaded for, otherwise
+		// one device could publish keys on behalf of another.
+		var deviceKeys struct {
+			UserID   string `json:"user_id"`
+			DeviceID string `json:"device_id"`
+		}
+		if err := json.Unmarshal(key.KeyJSON, &deviceKeys); err != nil {
+			response.Error = &api.KeyError{
+				Err: fmt.Sprintf("malformed device keys for device %q: %s", key.DeviceID, err),
+			}
+			return nil
+		}
+		if deviceKeys.UserID != key.UserID || deviceKeys.DeviceID != key.DeviceID {
+			response.Error = &api.KeyError{
+				Err: fmt.Sprintf(
+					"device keys are for user %q device %q but were uploaded by user %q device %q",
+					deviceKeys.UserID, deviceKeys.DeviceID, key.UserID, key.DeviceID,
+				),
+			}
+			return nil
+		}
+		keysToStore = append(keysToStore, key)
+	}
+	if len(keysToStore) == 0 {
+		return nil
+	}
+
+	// Work out which devices have actually changed, so that we only bump
+	// the device list stream for real changes. Clients re-upload the same
+	// device keys quite often.
+	existingKeys := make([]api.DeviceKeys, len(keysToStore))
+	for i := range keysToStore {
+		existingKeys[i] = api.DeviceKeys{
+			UserID:   keysToStore[i].UserID,
+			DeviceID: keysToStore[i].DeviceID,
+		}
+	}
+	if err := a.DB.DeviceKeysJSON(ctx, existingKeys); err != nil {
+		return fmt.Errorf("a.DB.DeviceKeysJSON: %w", err)
+	}
+	changedKeys := make([]api.DeviceKeys, 0, len(keysToStore))
+	for i, key := range keysToStore {
+		existing := existingKeys[i]
+		if request.OnlyDisplayNameUpdates {
+			if len(existing.KeyJSON) == 0 {
+				// there are no keys for this device yet, so there is
+				// nothing to tell anyone about
+				continue
+			}
+			key.KeyJSON = existing.KeyJSON
+		}
+		if bytes.Equal(existing.KeyJSON, key.KeyJSON) && existing.DisplayName == key.DisplayName {
+			continue
+		}
+		changedKeys = append(changedKeys, key)
+	}
+	if len(changedKeys) == 0 {
+		return nil
+	}
+	msgs, err := a.DB.StoreLocalDeviceKeys(ctx, changedKeys)
+	if err != nil {
+		return fmt.Errorf("a.DB.StoreLocalDeviceKeys: %w", err)
+	}
+	if err = a.Producer.ProduceKeyChanges(msgs); err != nil {
+		return fmt.Errorf("a.Producer.ProduceKeyChanges: %w", err)
+	}
+	return nil
+}
+
+func (a *KeyInternalAPI) uploadOneTimeKeys(
+	ctx context.Context,
+	request *api.PerformUploadKeysRequest,
+	response *api.PerformUploadKeysResponse,
+) error {
+	for _, key := range request.OneTimeKeys {
+		if err := a.checkLocalUser(key.UserID); err != nil {
+			response.Error = err
+			return nil
+		}
+		keyIDsWithAlgorithms := make([]string, 0, len(key.KeyJSON))
+		for keyIDWithAlgo := range key.KeyJSON {
+			keyIDsWithAlgorithms = append(keyIDsWithAlgorithms, keyIDWithAlgo)
+		}
+		// Uploading the same one-time key twice is harmless, but the spec
+		// forbids replacing an existing key with a different one.
+		existingKeys, err := a.DB.ExistingOneTimeKeys(ctx, key.UserID, key.DeviceID, keyIDsWithAlgorithms)
+		if err != nil {
+			return fmt.Errorf("a.DB.ExistingOneTimeKeys: %w", err)
+		}
+		for keyIDWithAlgo, existingJSON := range existingKeys {
+			if !bytes.Equal(existingJSON, key.KeyJSON[keyIDWithAlgo]) {
+				response.Error = &api.KeyError{
+					Err: fmt.Sprintf("one-time key %q already exists for device %q", keyIDWithAlgo, key.DeviceID),
+				}
+				return nil
+			}
+		}
+		counts, err := a.DB.StoreOneTimeKeys(ctx, key)
+		if err != nil {
+			return fmt.Errorf("a.DB.StoreOneTimeKeys: %w", err)
+		}
+		response.OneTimeKeyCounts = append(response.OneTimeKeyCounts, *counts)
+	}
+	return nil
+}
+
+// PerformDeleteKeys implements api.KeyInternalAPI
+func (a *KeyInternalAPI) PerformDeleteKeys(
+	ctx context.Context,
+	request *api.PerformDeleteKeysRequest,
+	response *api.PerformDeleteKeysResponse,
+) error {
+	if err := a.checkLocalUser(request.UserID); err != nil {
+		response.Error = err
+		return nil
+	}
+	if len(request.DeviceIDs) == 0 {
+		return nil
+	}
+	msgs, err := a.DB.DeleteDeviceKeys(ctx, request.UserID, request.DeviceIDs)
+	if err != nil {
+		return fmt.Errorf("a.DB.DeleteDeviceKeys: %w", err)
+	}
+	if err = a.Producer.ProduceKeyChanges(msgs); err != nil {
+		return fmt.Errorf("a.Producer.ProduceKeyChanges: %w", err)
+	}
+	return nil
+}
+
+// PerformClaimKeys implements api.KeyInternalAPI
+func (a *KeyInternalAPI) PerformClaimKeys(
+	ctx context.Context,
+	request *api.PerformClaimKeysRequest,
+	response *api.PerformClaimKeysResponse,
+) error {
+	response.OneTimeKeys = make(map[string]map[string]map[string]json.RawMessage)
+	response.Failures = make(map[string]interface{})
+
+	// Split the request up by server name so that we can claim the local
+	// keys from the database and fan out to the remote servers.
+	domainToDeviceKeys := make(map[gomatrixserverlib.ServerName]map[string]map[string]string)
+	for userID, deviceToAlgo := range request.OneTimeKeys {
+		_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			continue // ignore invalid users
+		}
+		if _, ok := domainToDeviceKeys[serverName]; !ok {
+			domainToDeviceKeys[serverName] = make(map[string]map[string]string)
+		}
+		domainToDeviceKeys[serverName][userID] = deviceToAlgo
+	}
+
+	if local, ok := domainToDeviceKeys[a.ThisServer]; ok {
+		keys, err := a.DB.ClaimKeys(ctx, local)
+		if err != nil {
+			return fmt.Errorf("a.DB.ClaimKeys: %w", err)
+		}
+		for _, key := range keys {
+			if _, ok := response.OneTimeKeys[key.UserID]; !ok {
+				response.OneTimeKeys[key.UserID] = make(map[string]map[string]json.RawMessage)
+			}
+			response.OneTimeKeys[key.UserID][key.DeviceID] = key.KeyJSON
+		}
+		delete(domainToDeviceKeys, a.ThisServer)
+	}
+
+	if len(domainToDeviceKeys) > 0 {
+		a.claimRemoteKeys(ctx, remoteTimeout(request.TimeoutMS), response, domainToDeviceKeys)
+	}
+	return nil
+}
+
+type claimKeysFederationRequest struct {
+	OneTimeKeys map[string]map[string]string `json:"one_time_keys"`
+}
+
+type claimKeysFederationResponse struct {
+	OneTimeKeys map[string]map[string]map[string]json.RawMessage `json:"one_time_keys"`
+}
+
+func (a *KeyInternalAPI) claimRemoteKeys(
+	ctx context.Context, timeout time.Duration, response *api.PerformClaimKeysResponse,
+	domainToDeviceKeys map[gomatrixserverlib.ServerName]map[string]map[string]string,
+) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for domain, keysToClaim := range domainToDeviceKeys {
+		wg.Add(1)
+		go func(serverName gomatrixserverlib.ServerName, keysToClaim map[string]map[string]string) {
+			defer wg.Done()
+			var claimResponse claimKeysFederationResponse
+			err := a.doFederationRequest(
+				ctx, serverName, http.MethodPost, "/_matrix/federation/v1/user/keys/claim",
+				claimKeysFederationRequest{OneTimeKeys: keysToClaim}, &claimResponse,
+			)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).WithField("server", serverName).Error("failed to claim remote one-time keys")
+				response.Failures[string(serverName)] = map[string]interface{}{
+					"message": err.Error(),
+				}
+				return
+			}
+			for userID, devices := range claimResponse.OneTimeKeys {
+				// Only accept keys for users that belong to the server
+				// that we asked.
+				if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != serverName {
+					continue
+				}
+				response.OneTimeKeys[userID] = devices
+			}
+		}(domain, keysToClaim)
+	}
+	wg.Wait()
+}
+
+// checkLocalUser returns a KeyError if the user ID isn't valid or doesn't
+// belong to this server.
+func (a *KeyInternalAPI) checkLocalUser(userID string) *api.KeyError {
+	_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+	if err != nil {
+		return &api.KeyError{Err: fmt.Sprintf("invalid user ID %q", userID)}
+	}
+	if serverName != a.ThisServer {
+		return &api.KeyError{Err: fmt.Sprintf("user %q does not belong to this server", userID)}
+	}
+	return nil
+}
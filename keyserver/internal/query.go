@@ -0,0 +1,164 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// QueryKeys implements api.KeyInternalAPI
+func (a *KeyInternalAPI) QueryKeys(
+	ctx context.Context,
+	request *api.QueryKeysRequest,
+	response *api.QueryKeysResponse,
+) error {
+	response.DeviceKeys = make(map[string]map[string]json.RawMessage)
+	response.Failures = make(map[string]interface{})
+
+	// make a map from domain to device keys
+	domainToDeviceKeys := make(map[gomatrixserverlib.ServerName]map[string][]string)
+	for userID, deviceIDs := range request.UserToDevices {
+		_, serverName, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			continue // ignore invalid users
+		}
+		if serverName == a.ThisServer {
+			// we can get local keys immediately
+			deviceKeys, err := a.DB.DeviceKeysForUser(ctx, userID, deviceIDs)
+			if err != nil {
+				return fmt.Errorf("a.DB.DeviceKeysForUser: %w", err)
+			}
+			for _, dk := range deviceKeys {
+				if len(dk.KeyJSON) == 0 {
+					continue // don't include blank keys
+				}
+				if _, ok := response.DeviceKeys[userID]; !ok {
+					response.DeviceKeys[userID] = make(map[string]json.RawMessage)
+				}
+				response.DeviceKeys[userID][dk.DeviceID] = dk.KeyJSON
+			}
+		} else {
+			if _, ok := domainToDeviceKeys[serverName]; !ok {
+				domainToDeviceKeys[serverName] = make(map[string][]string)
+			}
+			domainToDeviceKeys[serverName][userID] = deviceIDs
+		}
+	}
+
+	if len(domainToDeviceKeys) > 0 {
+		a.queryRemoteKeys(ctx, remoteTimeout(request.TimeoutMS), response, domainToDeviceKeys)
+	}
+	return nil
+}
+
+// QueryDeviceMessages implements api.KeyInternalAPI
+func (a *KeyInternalAPI) QueryDeviceMessages(
+	ctx context.Context,
+	request *api.QueryDeviceMessagesRequest,
+	response *api.QueryDeviceMessagesResponse,
+) error {
+	if err := a.checkLocalUser(request.UserID); err != nil {
+		response.Error = err
+		return nil
+	}
+	streamID, err := a.DB.DeviceListStreamID(ctx, request.UserID)
+	if err != nil {
+		return fmt.Errorf("a.DB.DeviceListStreamID: %w", err)
+	}
+	deviceKeys, err := a.DB.DeviceKeysForUser(ctx, request.UserID, nil)
+	if err != nil {
+		return fmt.Errorf("a.DB.DeviceKeysForUser: %w", err)
+	}
+	response.StreamID = streamID
+	response.Devices = make([]api.DeviceMessage, 0, len(deviceKeys))
+	for _, dk := range deviceKeys {
+		response.Devices = append(response.Devices, api.DeviceMessage{
+			DeviceKeys: dk,
+			StreamID:   streamID,
+		})
+	}
+	return nil
+}
+
+type queryKeysFederationRequest struct {
+	DeviceKeys map[string][]string `json:"device_keys"`
+}
+
+type queryKeysFederationResponse struct {
+	DeviceKeys map[string]map[string]json.RawMessage `json:"device_keys"`
+}
+
+func (a *KeyInternalAPI) queryRemoteKeys(
+	ctx context.Context, timeout time.Duration, response *api.QueryKeysResponse,
+	domainToDeviceKeys map[gomatrixserverlib.ServerName]map[string][]string,
+) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	for domain, deviceKeys := range domainToDeviceKeys {
+		wg.Add(1)
+		go func(serverName gomatrixserverlib.ServerName, deviceKeys map[string][]string) {
+			defer wg.Done()
+			var queryResponse queryKeysFederationResponse
+			err := a.doFederationRequest(
+				ctx, serverName, http.MethodPost, "/_matrix/federation/v1/user/keys/query",
+				queryKeysFederationRequest{DeviceKeys: deviceKeys}, &queryResponse,
+			)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).WithField("server", serverName).Error("failed to query remote device keys")
+				response.Failures[string(serverName)] = map[string]interface{}{
+					"message": err.Error(),
+				}
+				return
+			}
+			for userID, devices := range queryResponse.DeviceKeys {
+				// Only accept keys for users that belong to the server
+				// that we asked.
+				if _, domain, err := gomatrixserverlib.SplitID('@', userID); err != nil || domain != serverName {
+					continue
+				}
+				response.DeviceKeys[userID] = devices
+			}
+		}(domain, deviceKeys)
+	}
+	wg.Wait()
+}
+
+// QueryOneTimeKeys implements api.KeyInternalAPI
+func (a *KeyInternalAPI) QueryOneTimeKeys(
+	ctx context.Context,
+	request *api.QueryOneTimeKeysRequest,
+	response *api.QueryOneTimeKeysResponse,
+) error {
+	count, err := a.DB.OneTimeKeysCount(ctx, request.UserID, request.DeviceID)
+	if err != nil {
+		return fmt.Errorf("a.DB.OneTimeKeysCount: %w", err)
+	}
+	response.Count = *count
+	return nil
+}
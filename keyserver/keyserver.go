@@ -15,18 +15,44 @@
 package keyserver
 
 import (
-	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
-	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"net/http"
+
 	"github.com/matrix-org/dendrite/internal/basecomponent"
-	"github.com/matrix-org/dendrite/keyserver/routing"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/internal"
+	"github.com/matrix-org/dendrite/keyserver/producers"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
 )
 
-// SetupFederationSenderComponent sets up and registers HTTP handlers for the
-// FederationSender component.
+// SetupKeyServerComponent sets up and registers HTTP handlers for the
+// KeyServer component. The client and federation facing key endpoints
+// live in the client API and federation API respectively, which talk to
+// the key server through the returned api.KeyInternalAPI.
 func SetupKeyServerComponent(
 	base *basecomponent.BaseDendrite,
-	deviceDB devices.Database,
-	accountsDB accounts.Database,
-) {
-	routing.Setup(base.APIMux, base.Cfg, accountsDB, deviceDB)
+	federation *gomatrixserverlib.FederationClient,
+) api.KeyInternalAPI {
+	db, err := storage.NewDatabase(string(base.Cfg.Database.KeyServer), base.Cfg.DbProperties())
+	if err != nil {
+		logrus.WithError(err).Panicf("failed to connect to key server database")
+	}
+
+	keyAPI := &internal.KeyInternalAPI{
+		DB:         db,
+		Cfg:        base.Cfg,
+		FedClient:  federation,
+		ThisServer: base.Cfg.Matrix.ServerName,
+		Producer: &producers.KeyChange{
+			Topic:    string(base.Cfg.Kafka.Topics.OutputKeyChangeEvent),
+			Producer: base.KafkaProducer,
+		},
+	}
+
+	if base.EnableHTTPAPIs {
+		keyAPI.SetupHTTP(http.DefaultServeMux)
+	}
+
+	return keyAPI
 }
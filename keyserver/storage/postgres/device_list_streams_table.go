@@ -0,0 +1,87 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+)
+
+var deviceListStreamsSchema = `
+-- Stores the latest device list stream ID for each user
+CREATE TABLE IF NOT EXISTS keyserver_device_list_streams (
+    user_id TEXT NOT NULL PRIMARY KEY,
+    stream_id BIGINT NOT NULL
+);
+`
+
+const selectStreamIDSQL = "" +
+	"SELECT stream_id FROM keyserver_device_list_streams WHERE user_id = $1"
+
+const incrementStreamIDSQL = "" +
+	"INSERT INTO keyserver_device_list_streams (user_id, stream_id) VALUES ($1, 1)" +
+	" ON CONFLICT (user_id)" +
+	" DO UPDATE SET stream_id = keyserver_device_list_streams.stream_id + 1" +
+	" RETURNING stream_id"
+
+const upsertStreamIDSQL = "" +
+	"INSERT INTO keyserver_device_list_streams (user_id, stream_id) VALUES ($1, $2)" +
+	" ON CONFLICT (user_id)" +
+	" DO UPDATE SET stream_id = $2"
+
+type deviceListStreamsStatements struct {
+	selectStreamIDStmt    *sql.Stmt
+	incrementStreamIDStmt *sql.Stmt
+	upsertStreamIDStmt    *sql.Stmt
+}
+
+func NewPostgresDeviceListStreamsTable(db *sql.DB) (tables.DeviceListStreams, error) {
+	s := &deviceListStreamsStatements{}
+	_, err := db.Exec(deviceListStreamsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.selectStreamIDStmt, err = db.Prepare(selectStreamIDSQL); err != nil {
+		return nil, err
+	}
+	if s.incrementStreamIDStmt, err = db.Prepare(incrementStreamIDSQL); err != nil {
+		return nil, err
+	}
+	if s.upsertStreamIDStmt, err = db.Prepare(upsertStreamIDSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *deviceListStreamsStatements) SelectStreamID(ctx context.Context, txn *sql.Tx, userID string) (streamID int64, err error) {
+	err = internal.TxStmt(txn, s.selectStreamIDStmt).QueryRowContext(ctx, userID).Scan(&streamID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return
+}
+
+func (s *deviceListStreamsStatements) IncrementStreamID(ctx context.Context, txn *sql.Tx, userID string) (streamID int64, err error) {
+	err = internal.TxStmt(txn, s.incrementStreamIDStmt).QueryRowContext(ctx, userID).Scan(&streamID)
+	return
+}
+
+func (s *deviceListStreamsStatements) UpsertStreamID(ctx context.Context, txn *sql.Tx, userID string, streamID int64) error {
+	_, err := internal.TxStmt(txn, s.upsertStreamIDStmt).ExecContext(ctx, userID, streamID)
+	return err
+}
@@ -0,0 +1,176 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package shared
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/storage/tables"
+)
+
+// Database contains the storage functions which are shared between the
+// postgres and sqlite3 implementations of the key server database.
+type Database struct {
+	DB                     *sql.DB
+	OneTimeKeysTable       tables.OneTimeKeys
+	DeviceKeysTable        tables.DeviceKeys
+	DeviceListStreamsTable tables.DeviceListStreams
+}
+
+func (d *Database) ExistingOneTimeKeys(ctx context.Context, userID, deviceID string, keyIDsWithAlgorithms []string) (map[string]json.RawMessage, error) {
+	return d.OneTimeKeysTable.SelectOneTimeKeys(ctx, userID, deviceID, keyIDsWithAlgorithms)
+}
+
+func (d *Database) StoreOneTimeKeys(ctx context.Context, keys api.OneTimeKeys) (counts *api.OneTimeKeysCount, err error) {
+	err = internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		counts, err = d.OneTimeKeysTable.InsertOneTimeKeys(ctx, txn, keys)
+		return err
+	})
+	return
+}
+
+func (d *Database) OneTimeKeysCount(ctx context.Context, userID, deviceID string) (*api.OneTimeKeysCount, error) {
+	return d.OneTimeKeysTable.CountOneTimeKeys(ctx, userID, deviceID)
+}
+
+func (d *Database) DeviceKeysJSON(ctx context.Context, keys []api.DeviceKeys) error {
+	return d.DeviceKeysTable.SelectDeviceKeysJSON(ctx, keys)
+}
+
+func (d *Database) StoreDeviceKeys(ctx context.Context, keys []api.DeviceKeys) error {
+	return internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		return d.DeviceKeysTable.InsertDeviceKeys(ctx, txn, keys)
+	})
+}
+
+func (d *Database) DeviceKeysForUser(ctx context.Context, userID string, deviceIDs []string) ([]api.DeviceKeys, error) {
+	return d.DeviceKeysTable.SelectBatchDeviceKeys(ctx, userID, deviceIDs)
+}
+
+func (d *Database) ClaimKeys(ctx context.Context, userToDeviceToAlgorithm map[string]map[string]string) ([]api.OneTimeKeys, error) {
+	var result []api.OneTimeKeys
+	err := internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		for userID, deviceToAlgo := range userToDeviceToAlgorithm {
+			for deviceID, algo := range deviceToAlgo {
+				keyJSON, err := d.OneTimeKeysTable.SelectAndDeleteOneTimeKey(ctx, txn, userID, deviceID, algo)
+				if err != nil {
+					return err
+				}
+				if keyJSON != nil {
+					result = append(result, api.OneTimeKeys{
+						UserID:   userID,
+						DeviceID: deviceID,
+						KeyJSON:  keyJSON,
+					})
+				}
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+func (d *Database) StoreLocalDeviceKeys(ctx context.Context, keys []api.DeviceKeys) ([]api.DeviceMessage, error) {
+	msgs := make([]api.DeviceMessage, 0, len(keys))
+	err := internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		for _, key := range keys {
+			streamID, err := d.DeviceListStreamsTable.IncrementStreamID(ctx, txn, key.UserID)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, api.DeviceMessage{
+				DeviceKeys: key,
+				StreamID:   streamID,
+			})
+		}
+		return d.DeviceKeysTable.InsertDeviceKeys(ctx, txn, keys)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (d *Database) DeleteDeviceKeys(ctx context.Context, userID string, deviceIDs []string) ([]api.DeviceMessage, error) {
+	msgs := make([]api.DeviceMessage, 0, len(deviceIDs))
+	err := internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		for _, deviceID := range deviceIDs {
+			if err := d.DeviceKeysTable.DeleteDeviceKeys(ctx, txn, userID, deviceID); err != nil {
+				return err
+			}
+			if err := d.OneTimeKeysTable.DeleteOneTimeKeys(ctx, txn, userID, deviceID); err != nil {
+				return err
+			}
+			streamID, err := d.DeviceListStreamsTable.IncrementStreamID(ctx, txn, userID)
+			if err != nil {
+				return err
+			}
+			msgs = append(msgs, api.DeviceMessage{
+				DeviceKeys: api.DeviceKeys{
+					UserID:   userID,
+					DeviceID: deviceID,
+				},
+				StreamID: streamID,
+				Deleted:  true,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (d *Database) DeviceListStreamID(ctx context.Context, userID string) (int64, error) {
+	return d.DeviceListStreamsTable.SelectStreamID(ctx, nil, userID)
+}
+
+func (d *Database) StoreRemoteDeviceKeys(ctx context.Context, msg api.DeviceMessage) error {
+	return internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		if msg.Deleted {
+			if err := d.DeviceKeysTable.DeleteDeviceKeys(ctx, txn, msg.UserID, msg.DeviceID); err != nil {
+				return err
+			}
+		} else {
+			if err := d.DeviceKeysTable.InsertDeviceKeys(ctx, txn, []api.DeviceKeys{msg.DeviceKeys}); err != nil {
+				return err
+			}
+		}
+		return d.DeviceListStreamsTable.UpsertStreamID(ctx, txn, msg.UserID, msg.StreamID)
+	})
+}
+
+func (d *Database) ReplaceRemoteDeviceList(ctx context.Context, userID string, keys []api.DeviceKeys, streamID int64) error {
+	existing, err := d.DeviceKeysTable.SelectBatchDeviceKeys(ctx, userID, nil)
+	if err != nil {
+		return err
+	}
+	return internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		for _, dk := range existing {
+			if err := d.DeviceKeysTable.DeleteDeviceKeys(ctx, txn, userID, dk.DeviceID); err != nil {
+				return err
+			}
+		}
+		if err := d.DeviceKeysTable.InsertDeviceKeys(ctx, txn, keys); err != nil {
+			return err
+		}
+		return d.DeviceListStreamsTable.UpsertStreamID(ctx, txn, userID, streamID)
+	})
+}
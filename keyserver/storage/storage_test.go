@@ -0,0 +1,201 @@
+package storage_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/keyserver/storage"
+	"github.com/matrix-org/dendrite/keyserver/storage/sqlite3"
+)
+
+var (
+	ctx          = context.Background()
+	testUserID   = "@alice:localhost"
+	testDeviceID = "ALICEDEVICE"
+)
+
+func MustCreateDatabase(t *testing.T) storage.Database {
+	db, err := sqlite3.NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("NewDatabase returned %s", err)
+	}
+	return db
+}
+
+func TestStoreAndClaimOneTimeKeys(t *testing.T) {
+	db := MustCreateDatabase(t)
+	keys := api.OneTimeKeys{
+		UserID:   testUserID,
+		DeviceID: testDeviceID,
+		KeyJSON: map[string]json.RawMessage{
+			"signed_curve25519:AAAAAQ": json.RawMessage(`{"key":"one"}`),
+			"signed_curve25519:AAAAAg": json.RawMessage(`{"key":"two"}`),
+			"curve25519:AAAAAw":        json.RawMessage(`"three"`),
+		},
+	}
+	counts, err := db.StoreOneTimeKeys(ctx, keys)
+	if err != nil {
+		t.Fatalf("StoreOneTimeKeys returned %s", err)
+	}
+	if counts.KeyCount["signed_curve25519"] != 2 || counts.KeyCount["curve25519"] != 1 {
+		t.Fatalf("StoreOneTimeKeys returned wrong counts: %+v", counts.KeyCount)
+	}
+
+	existing, err := db.ExistingOneTimeKeys(ctx, testUserID, testDeviceID, []string{"signed_curve25519:AAAAAQ", "signed_curve25519:BBBBBB"})
+	if err != nil {
+		t.Fatalf("ExistingOneTimeKeys returned %s", err)
+	}
+	if len(existing) != 1 || string(existing["signed_curve25519:AAAAAQ"]) != `{"key":"one"}` {
+		t.Fatalf("ExistingOneTimeKeys returned wrong keys: %+v", existing)
+	}
+
+	claimed, err := db.ClaimKeys(ctx, map[string]map[string]string{
+		testUserID: {
+			testDeviceID: "signed_curve25519",
+		},
+	})
+	if err != nil {
+		t.Fatalf("ClaimKeys returned %s", err)
+	}
+	if len(claimed) != 1 || len(claimed[0].KeyJSON) != 1 {
+		t.Fatalf("ClaimKeys returned wrong keys: %+v", claimed)
+	}
+
+	counts, err = db.OneTimeKeysCount(ctx, testUserID, testDeviceID)
+	if err != nil {
+		t.Fatalf("OneTimeKeysCount returned %s", err)
+	}
+	if counts.KeyCount["signed_curve25519"] != 1 {
+		t.Fatalf("claimed key was not removed, counts: %+v", counts.KeyCount)
+	}
+}
+
+func TestClaimKeysHandsOutEachKeyOnce(t *testing.T) {
+	db := MustCreateDatabase(t)
+	keys := api.OneTimeKeys{
+		UserID:   testUserID,
+		DeviceID: testDeviceID,
+		KeyJSON: map[string]json.RawMessage{
+			"signed_curve25519:AAAAAQ": json.RawMessage(`{"key":"one"}`),
+			"signed_curve25519:AAAAAg": json.RawMessage(`{"key":"two"}`),
+		},
+	}
+	if _, err := db.StoreOneTimeKeys(ctx, keys); err != nil {
+		t.Fatalf("StoreOneTimeKeys returned %s", err)
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		claimed, err := db.ClaimKeys(ctx, map[string]map[string]string{
+			testUserID: {
+				testDeviceID: "signed_curve25519",
+			},
+		})
+		if err != nil {
+			t.Fatalf("ClaimKeys returned %s", err)
+		}
+		if i == 2 {
+			if len(claimed) != 0 {
+				t.Fatalf("ClaimKeys returned keys after they ran out: %+v", claimed)
+			}
+			break
+		}
+		if len(claimed) != 1 || len(claimed[0].KeyJSON) != 1 {
+			t.Fatalf("ClaimKeys returned wrong keys: %+v", claimed)
+		}
+		for keyID := range claimed[0].KeyJSON {
+			if seen[keyID] {
+				t.Fatalf("ClaimKeys returned %s twice", keyID)
+			}
+			seen[keyID] = true
+		}
+	}
+}
+
+func TestStoreDeviceKeys(t *testing.T) {
+	db := MustCreateDatabase(t)
+	keys := []api.DeviceKeys{
+		{UserID: testUserID, DeviceID: testDeviceID, KeyJSON: json.RawMessage(`{"v":1}`)},
+		{UserID: testUserID, DeviceID: "OTHERDEVICE", KeyJSON: json.RawMessage(`{"v":2}`)},
+	}
+	if err := db.StoreDeviceKeys(ctx, keys); err != nil {
+		t.Fatalf("StoreDeviceKeys returned %s", err)
+	}
+	// replace the keys for the first device
+	keys[0].KeyJSON = json.RawMessage(`{"v":3}`)
+	if err := db.StoreDeviceKeys(ctx, keys[:1]); err != nil {
+		t.Fatalf("StoreDeviceKeys returned %s", err)
+	}
+
+	all, err := db.DeviceKeysForUser(ctx, testUserID, nil)
+	if err != nil {
+		t.Fatalf("DeviceKeysForUser returned %s", err)
+	}
+	if len(all) != 2 {
+		t.Fatalf("DeviceKeysForUser returned %d devices, want 2", len(all))
+	}
+
+	query := []api.DeviceKeys{{UserID: testUserID, DeviceID: testDeviceID}}
+	if err := db.DeviceKeysJSON(ctx, query); err != nil {
+		t.Fatalf("DeviceKeysJSON returned %s", err)
+	}
+	if string(query[0].KeyJSON) != `{"v":3}` {
+		t.Fatalf("DeviceKeysJSON returned %s, want replaced keys", string(query[0].KeyJSON))
+	}
+}
+
+func TestDeviceListStreamIDs(t *testing.T) {
+	db := MustCreateDatabase(t)
+	keys := []api.DeviceKeys{
+		{UserID: testUserID, DeviceID: testDeviceID, KeyJSON: json.RawMessage(`{"v":1}`)},
+		{UserID: testUserID, DeviceID: "OTHERDEVICE", KeyJSON: json.RawMessage(`{"v":2}`)},
+	}
+	msgs, err := db.StoreLocalDeviceKeys(ctx, keys)
+	if err != nil {
+		t.Fatalf("StoreLocalDeviceKeys returned %s", err)
+	}
+	if len(msgs) != 2 || msgs[0].StreamID != 1 || msgs[1].StreamID != 2 {
+		t.Fatalf("StoreLocalDeviceKeys returned wrong stream IDs: %+v", msgs)
+	}
+
+	msgs, err = db.DeleteDeviceKeys(ctx, testUserID, []string{"OTHERDEVICE"})
+	if err != nil {
+		t.Fatalf("DeleteDeviceKeys returned %s", err)
+	}
+	if len(msgs) != 1 || msgs[0].StreamID != 3 || !msgs[0].Deleted {
+		t.Fatalf("DeleteDeviceKeys returned wrong messages: %+v", msgs)
+	}
+	streamID, err := db.DeviceListStreamID(ctx, testUserID)
+	if err != nil {
+		t.Fatalf("DeviceListStreamID returned %s", err)
+	}
+	if streamID != 3 {
+		t.Fatalf("DeviceListStreamID returned %d, want 3", streamID)
+	}
+	all, err := db.DeviceKeysForUser(ctx, testUserID, nil)
+	if err != nil {
+		t.Fatalf("DeviceKeysForUser returned %s", err)
+	}
+	if len(all) != 1 || all[0].DeviceID != testDeviceID {
+		t.Fatalf("DeviceKeysForUser returned %+v, want only %s", all, testDeviceID)
+	}
+
+	// Remote updates set the stream ID to whatever the remote server says.
+	remoteUserID := "@bob:remote"
+	err = db.StoreRemoteDeviceKeys(ctx, api.DeviceMessage{
+		DeviceKeys: api.DeviceKeys{UserID: remoteUserID, DeviceID: "BOBDEVICE", KeyJSON: json.RawMessage(`{"v":4}`)},
+		StreamID:   10,
+	})
+	if err != nil {
+		t.Fatalf("StoreRemoteDeviceKeys returned %s", err)
+	}
+	streamID, err = db.DeviceListStreamID(ctx, remoteUserID)
+	if err != nil {
+		t.Fatalf("DeviceListStreamID returned %s", err)
+	}
+	if streamID != 10 {
+		t.Fatalf("DeviceListStreamID returned %d, want 10", streamID)
+	}
+}
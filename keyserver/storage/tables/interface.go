@@ -0,0 +1,56 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tables
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/keyserver/api"
+)
+
+type OneTimeKeys interface {
+	SelectOneTimeKeys(ctx context.Context, userID, deviceID string, keyIDsWithAlgorithms []string) (map[string]json.RawMessage, error)
+	CountOneTimeKeys(ctx context.Context, userID, deviceID string) (*api.OneTimeKeysCount, error)
+	InsertOneTimeKeys(ctx context.Context, txn *sql.Tx, keys api.OneTimeKeys) (*api.OneTimeKeysCount, error)
+	// SelectAndDeleteOneTimeKey selects a single one time key matching the user/device/algorithm specified and returns the algo:key_id => JSON.
+	// Returns an empty map if the key does not exist.
+	SelectAndDeleteOneTimeKey(ctx context.Context, txn *sql.Tx, userID, deviceID, algorithm string) (map[string]json.RawMessage, error)
+	// DeleteOneTimeKeys removes all one-time keys for the given device.
+	DeleteOneTimeKeys(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
+}
+
+type DeviceKeys interface {
+	SelectDeviceKeysJSON(ctx context.Context, keys []api.DeviceKeys) error
+	InsertDeviceKeys(ctx context.Context, txn *sql.Tx, keys []api.DeviceKeys) error
+	SelectBatchDeviceKeys(ctx context.Context, userID string, deviceIDs []string) ([]api.DeviceKeys, error)
+	DeleteDeviceKeys(ctx context.Context, txn *sql.Tx, userID, deviceID string) error
+}
+
+// DeviceListStreams tracks the latest device list stream ID for each user.
+// The stream ID is incremented every time one of the user's devices is
+// added, removed or has its keys changed, and is sent to remote servers as
+// the stream_id of m.device_list_update EDUs.
+type DeviceListStreams interface {
+	// SelectStreamID returns the latest stream ID for the user, or 0 if the
+	// user's device list has never changed.
+	SelectStreamID(ctx context.Context, txn *sql.Tx, userID string) (int64, error)
+	// IncrementStreamID bumps the stream ID for the user and returns the new value.
+	IncrementStreamID(ctx context.Context, txn *sql.Tx, userID string) (int64, error)
+	// UpsertStreamID sets the stream ID for the user, e.g. when a remote
+	// server tells us about an update to one of their users.
+	UpsertStreamID(ctx context.Context, txn *sql.Tx, userID string, streamID int64) error
+}
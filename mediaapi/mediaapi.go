@@ -15,6 +15,7 @@
 package mediaapi
 
 import (
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/internal/basecomponent"
 	"github.com/matrix-org/dendrite/mediaapi/routing"
@@ -28,6 +29,7 @@ import (
 func SetupMediaAPIComponent(
 	base *basecomponent.BaseDendrite,
 	deviceDB devices.Database,
+	accountDB accounts.Database,
 ) {
 	mediaDB, err := storage.Open(string(base.Cfg.Database.MediaAPI), base.Cfg.DbProperties())
 	if err != nil {
@@ -35,6 +37,6 @@ func SetupMediaAPIComponent(
 	}
 
 	routing.Setup(
-		base.APIMux, base.Cfg, mediaDB, deviceDB, gomatrixserverlib.NewClient(),
+		base.APIMux, base.Cfg, mediaDB, deviceDB, accountDB, gomatrixserverlib.NewClient(),
 	)
 }
@@ -21,6 +21,7 @@ import (
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 
 	"github.com/gorilla/mux"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
@@ -45,6 +46,7 @@ func Setup(
 	cfg *config.Dendrite,
 	db storage.Database,
 	deviceDB devices.Database,
+	accountDB accounts.Database,
 	client *gomatrixserverlib.Client,
 ) {
 	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
@@ -53,12 +55,11 @@ func Setup(
 		PathToResult: map[string]*types.ThumbnailGenerationResult{},
 	}
 	authData := auth.Data{
-		AccountDB:   nil,
+		AccountDB:   accountDB,
 		DeviceDB:    deviceDB,
-		AppServices: nil,
+		AppServices: cfg.AppServices,
 	}
 
-	// TODO: Add AS support
 	r0mux.Handle("/upload", internal.MakeAuthAPI(
 		"upload", authData,
 		func(req *http.Request, _ *authtypes.Device) util.JSONResponse {
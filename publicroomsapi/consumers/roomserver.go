@@ -29,6 +29,7 @@ import (
 
 // OutputRoomEventConsumer consumes events that originated in the room server.
 type OutputRoomEventConsumer struct {
+	cfg        *config.Dendrite
 	rsAPI      api.RoomserverInternalAPI
 	rsConsumer *internal.ContinualConsumer
 	db         storage.Database
@@ -47,6 +48,7 @@ func NewOutputRoomEventConsumer(
 		PartitionStore: store,
 	}
 	s := &OutputRoomEventConsumer{
+		cfg:        cfg,
 		rsConsumer: &consumer,
 		db:         store,
 		rsAPI:      rsAPI,
@@ -71,6 +73,10 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return nil
 	}
 
+	if output.Type == api.OutputTypePurgeRoom {
+		return s.db.DeleteRoom(context.TODO(), output.PurgeRoom.RoomID)
+	}
+
 	if output.Type != api.OutputTypeNewRoomEvent {
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -107,5 +113,105 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		remQueryEvents = append(remQueryEvents, headeredEvent.Event)
 	}
 
-	return s.db.UpdateRoomFromEvents(context.TODO(), addQueryEvents, remQueryEvents)
+	if err := s.db.UpdateRoomFromEvents(context.TODO(), addQueryEvents, remQueryEvents); err != nil {
+		return err
+	}
+
+	// If the room has been upgraded then move its directory entry to the new
+	// room. The tombstone in the old room and the create event in the new room
+	// are on different partitions and may arrive in either order, so check
+	// for an upgrade whenever either of them arrives.
+	for _, event := range addQueryEvents {
+		var oldRoomID, newRoomID string
+		switch event.Type() {
+		case "m.room.tombstone":
+			var content internal.TombstoneContent
+			if err := json.Unmarshal(event.Content(), &content); err != nil {
+				log.WithError(err).Warn("roomserver output log: invalid tombstone event")
+				continue
+			}
+			oldRoomID, newRoomID = event.RoomID(), content.ReplacementRoom
+		case gomatrixserverlib.MRoomCreate:
+			var content gomatrixserverlib.CreateContent
+			if err := json.Unmarshal(event.Content(), &content); err != nil {
+				log.WithError(err).Warn("roomserver output log: invalid create event")
+				continue
+			}
+			oldRoomID, newRoomID = content.Predecessor.RoomID, event.RoomID()
+		}
+		if oldRoomID == "" || newRoomID == "" {
+			continue
+		}
+		if err := s.replaceRoom(context.TODO(), oldRoomID, newRoomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceRoom moves the directory entry of the old room to the new room if
+// the old room was upgraded to the new room by one of our users.
+func (s *OutputRoomEventConsumer) replaceRoom(ctx context.Context, oldRoomID, newRoomID string) error {
+	tombstone, err := s.currentStateEvent(ctx, oldRoomID, "m.room.tombstone")
+	if err != nil || tombstone == nil {
+		return err
+	}
+	create, err := s.currentStateEvent(ctx, newRoomID, gomatrixserverlib.MRoomCreate)
+	if err != nil || create == nil {
+		return err
+	}
+	if !isUpgrade(s.cfg.Matrix.ServerName, tombstone, create) {
+		log.WithFields(log.Fields{
+			"old_room_id": oldRoomID,
+			"new_room_id": newRoomID,
+		}).Warn("roomserver output log: ignoring tombstone which isn't a local room upgrade")
+		return nil
+	}
+	return s.db.ReplaceRoom(ctx, oldRoomID, newRoomID)
+}
+
+// currentStateEvent returns the current state event of the given type with an
+// empty state key in the room, or nil if the room or event doesn't exist.
+func (s *OutputRoomEventConsumer) currentStateEvent(
+	ctx context.Context, roomID, eventType string,
+) (*gomatrixserverlib.Event, error) {
+	req := api.QueryLatestEventsAndStateRequest{
+		RoomID:       roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{{EventType: eventType, StateKey: ""}},
+	}
+	var res api.QueryLatestEventsAndStateResponse
+	if err := s.rsAPI.QueryLatestEventsAndState(ctx, &req, &res); err != nil {
+		return nil, err
+	}
+	for _, event := range res.StateEvents {
+		if event.Type() == eventType {
+			ev := event.Unwrap()
+			return &ev, nil
+		}
+	}
+	return nil, nil
+}
+
+// isUpgrade returns whether the tombstone and create events show that the
+// tombstone's room was upgraded to the create event's room by a local user.
+// Tombstones sent by remote users are ignored, as are tombstones which point
+// to a room that doesn't name the tombstone's room as its predecessor, so that
+// nobody can hijack the directory entry of a room.
+func isUpgrade(
+	serverName gomatrixserverlib.ServerName, tombstone, create *gomatrixserverlib.Event,
+) bool {
+	_, domain, err := gomatrixserverlib.SplitID('@', tombstone.Sender())
+	if err != nil || domain != serverName {
+		return false
+	}
+	var tombstoneContent internal.TombstoneContent
+	if err = json.Unmarshal(tombstone.Content(), &tombstoneContent); err != nil {
+		return false
+	}
+	var createContent gomatrixserverlib.CreateContent
+	if err = json.Unmarshal(create.Content(), &createContent); err != nil {
+		return false
+	}
+	return tombstoneContent.ReplacementRoom == create.RoomID() &&
+		createContent.Predecessor.RoomID == tombstone.RoomID()
 }
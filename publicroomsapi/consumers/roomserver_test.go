@@ -0,0 +1,84 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustCreateEvent(t *testing.T, roomID, sender, eventType, content string) *gomatrixserverlib.Event {
+	eventJSON := fmt.Sprintf(
+		`{"auth_events":[],"content":%s,"depth":1,"event_id":"$%s","hashes":{"sha256":"abc"},"origin":"localhost","origin_server_ts":1,"prev_events":[],"room_id":%q,"sender":%q,"signatures":{},"state_key":"","type":%q}`,
+		content, eventType, roomID, sender, eventType,
+	)
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON returned %s", err)
+	}
+	return &event
+}
+
+func TestIsUpgrade(t *testing.T) {
+	create := mustCreateEvent(t, "!new:localhost", "@alice:localhost", "m.room.create",
+		`{"creator":"@alice:localhost","predecessor":{"room_id":"!old:localhost","event_id":"$last"}}`)
+	unrelatedCreate := mustCreateEvent(t, "!new:localhost", "@alice:localhost", "m.room.create",
+		`{"creator":"@alice:localhost"}`)
+
+	tests := []struct {
+		name      string
+		tombstone *gomatrixserverlib.Event
+		create    *gomatrixserverlib.Event
+		want      bool
+	}{
+		{
+			name:      "local upgrade",
+			tombstone: mustCreateEvent(t, "!old:localhost", "@alice:localhost", "m.room.tombstone", `{"replacement_room":"!new:localhost"}`),
+			create:    create,
+			want:      true,
+		},
+		{
+			name:      "remote tombstone",
+			tombstone: mustCreateEvent(t, "!old:localhost", "@mallory:evil.example.com", "m.room.tombstone", `{"replacement_room":"!new:localhost"}`),
+			create:    create,
+			want:      false,
+		},
+		{
+			name:      "replacement without predecessor",
+			tombstone: mustCreateEvent(t, "!old:localhost", "@alice:localhost", "m.room.tombstone", `{"replacement_room":"!new:localhost"}`),
+			create:    unrelatedCreate,
+			want:      false,
+		},
+		{
+			name:      "tombstone pointing elsewhere",
+			tombstone: mustCreateEvent(t, "!old:localhost", "@alice:localhost", "m.room.tombstone", `{"replacement_room":"!other:localhost"}`),
+			create:    create,
+			want:      false,
+		},
+		{
+			name:      "predecessor is another room",
+			tombstone: mustCreateEvent(t, "!another:localhost", "@alice:localhost", "m.room.tombstone", `{"replacement_room":"!new:localhost"}`),
+			create:    create,
+			want:      false,
+		},
+	}
+	for _, tt := range tests {
+		if got := isUpgrade("localhost", tt.tombstone, tt.create); got != tt.want {
+			t.Errorf("%s: isUpgrade returned %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -118,3 +118,35 @@ func SetVisibility(
 		JSON: struct{}{},
 	}
 }
+
+// SetAppServiceVisibility implements PUT /directory/list/appservice/{networkID}/{roomID},
+// publishing a room to, or removing it from, the room directory of one of the
+// application service's networks.
+func SetAppServiceVisibility(
+	req *http.Request, publicRoomsDatabase storage.Database, appserviceID string,
+	networkID, roomID string,
+) util.JSONResponse {
+	var v roomVisibility
+	if reqErr := httputil.UnmarshalJSONRequest(req, &v); reqErr != nil {
+		return *reqErr
+	}
+	if v.Visibility != gomatrixserverlib.Public && v.Visibility != "private" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("visibility must be public or private"),
+		}
+	}
+
+	isPublic := v.Visibility == gomatrixserverlib.Public
+	if err := publicRoomsDatabase.SetAppServiceRoomVisibility(
+		req.Context(), isPublic, appserviceID, networkID, roomID,
+	); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("publicRoomsDatabase.SetAppServiceRoomVisibility failed")
+		return jsonerror.InternalServerError()
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: struct{}{},
+	}
+}
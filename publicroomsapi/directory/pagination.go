@@ -0,0 +1,63 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// publicRoomsToken is the position in the room directory which is encoded in
+// the opaque since, next_batch and prev_batch tokens.
+type publicRoomsToken struct {
+	// The homeserver whose rooms are being listed, or empty for local rooms.
+	Server gomatrixserverlib.ServerName `json:"s,omitempty"`
+	// The offset into the local rooms.
+	Offset int64 `json:"o,omitempty"`
+	// The homeserver's own pagination token.
+	Since string `json:"t,omitempty"`
+}
+
+// String encodes the token.
+func (t publicRoomsToken) String() string {
+	// Marshalling a struct of strings and integers can't fail.
+	data, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// parseSince decodes the since token of a request. An empty token is the
+// start of the room directory.
+func parseSince(since string) (publicRoomsToken, *util.JSONResponse) {
+	var t publicRoomsToken
+	if since == "" {
+		return t, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(since)
+	if err == nil {
+		err = json.Unmarshal(data, &t)
+	}
+	if err != nil || t.Offset < 0 {
+		return t, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("invalid since token"),
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package directory
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestParseSinceRoundTrip(t *testing.T) {
+	tokens := []publicRoomsToken{
+		{},
+		{Offset: 20},
+		{Server: "example.com"},
+		{Server: "example.com", Since: "remote_token_with/odd+characters="},
+	}
+	for _, want := range tokens {
+		got, resErr := parseSince(want.String())
+		if resErr != nil {
+			t.Errorf("parseSince(%+v) returned %+v", want, resErr)
+			continue
+		}
+		if got != want {
+			t.Errorf("parseSince returned %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestParseSinceEmpty(t *testing.T) {
+	got, resErr := parseSince("")
+	if resErr != nil {
+		t.Fatalf("parseSince returned %+v", resErr)
+	}
+	if got != (publicRoomsToken{}) {
+		t.Fatalf("parseSince returned %+v, want the start of the room directory", got)
+	}
+}
+
+func TestParseSinceInvalid(t *testing.T) {
+	for _, since := range []string{
+		"not base64!",
+		base64.RawURLEncoding.EncodeToString([]byte("not json")),
+		base64.RawURLEncoding.EncodeToString([]byte(`{"o":-10}`)),
+		// Tokens used to be plain offsets.
+		"10",
+	} {
+		_, resErr := parseSince(since)
+		if resErr == nil || resErr.Code != http.StatusBadRequest {
+			t.Errorf("parseSince(%q) returned %+v, want %d", since, resErr, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestNextPublicRoomsServer(t *testing.T) {
+	homeservers := []gomatrixserverlib.ServerName{"a.example.com", "b.example.com"}
+	tests := []struct {
+		name        string
+		server      gomatrixserverlib.ServerName
+		homeservers []gomatrixserverlib.ServerName
+		want        publicRoomsToken
+		wantDone    bool
+	}{
+		{"local to first", "", homeservers, publicRoomsToken{Server: "a.example.com"}, false},
+		{"first to second", "a.example.com", homeservers, publicRoomsToken{Server: "b.example.com"}, false},
+		{"last", "b.example.com", homeservers, publicRoomsToken{}, true},
+		{"unknown server", "c.example.com", homeservers, publicRoomsToken{}, true},
+		{"no homeservers", "", nil, publicRoomsToken{}, true},
+	}
+	for _, tt := range tests {
+		got, done := nextPublicRoomsServer(tt.server, tt.homeservers)
+		if got != tt.want || done != tt.wantDone {
+			t.Errorf("%s: nextPublicRoomsServer returned %+v, %v, want %+v, %v", tt.name, got, done, tt.want, tt.wantDone)
+		}
+	}
+}
+
+func TestPrevOffset(t *testing.T) {
+	tests := []struct {
+		offset int64
+		limit  int
+		want   int64
+	}{
+		{30, 10, 20},
+		{5, 10, 0},
+		{10, 10, 0},
+		{10, 0, 0},
+	}
+	for _, tt := range tests {
+		if got := prevOffset(tt.offset, tt.limit); got != tt.want {
+			t.Errorf("prevOffset(%d, %d) = %d, want %d", tt.offset, tt.limit, got, tt.want)
+		}
+	}
+}
@@ -16,13 +16,15 @@ package directory
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strconv"
-	"sync"
 	"time"
 
+	appserviceAPI "github.com/matrix-org/dendrite/appservice/api"
 	"github.com/matrix-org/dendrite/clientapi/httputil"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
 	"github.com/matrix-org/dendrite/publicroomsapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -30,15 +32,21 @@ import (
 )
 
 type PublicRoomReq struct {
-	Since  string `json:"since,omitempty"`
-	Limit  int16  `json:"limit,omitempty"`
-	Filter filter `json:"filter,omitempty"`
+	Since                string `json:"since,omitempty"`
+	Limit                int16  `json:"limit,omitempty"`
+	Filter               filter `json:"filter,omitempty"`
+	IncludeAllNetworks   bool   `json:"include_all_networks,omitempty"`
+	ThirdPartyInstanceID string `json:"third_party_instance_id,omitempty"`
 }
 
 type filter struct {
 	SearchTerms string `json:"generic_search_term,omitempty"`
 }
 
+// How long to spend querying remote servers for their public rooms before
+// returning what we have.
+const remotePublicRoomsTimeout = 15 * time.Second
+
 // GetPostPublicRooms implements GET and POST /publicRooms
 func GetPostPublicRooms(
 	req *http.Request, publicRoomDatabase storage.Database,
@@ -47,7 +55,21 @@ func GetPostPublicRooms(
 	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
 		return *fillErr
 	}
-	response, err := publicRooms(req.Context(), request, publicRoomDatabase)
+	since, resErr := parseSince(request.Since)
+	if resErr != nil {
+		return *resErr
+	}
+	if since.Server != "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("since token is not for this server"),
+		}
+	}
+	network, resErr := networkFilter(request)
+	if resErr != nil {
+		return *resErr
+	}
+	response, err := publicRooms(req.Context(), request, since.Offset, network, publicRoomDatabase)
 	if err != nil {
 		return jsonerror.InternalServerError()
 	}
@@ -57,162 +79,266 @@ func GetPostPublicRooms(
 	}
 }
 
+// GetPostRemotePublicRooms implements GET and POST /publicRooms?server=,
+// listing the public rooms of a remote server over federation. The remote
+// server's pagination tokens are passed through as they are.
+func GetPostRemotePublicRooms(
+	req *http.Request, cfg *config.Dendrite, fedClient *gomatrixserverlib.FederationClient,
+	server gomatrixserverlib.ServerName,
+) util.JSONResponse {
+	var request PublicRoomReq
+	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
+		return *fillErr
+	}
+	response, err := fetchRemotePublicRooms(req.Context(), cfg, fedClient, server, request)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).WithField("server", server).Error("fetchRemotePublicRooms failed")
+		return util.JSONResponse{
+			Code: http.StatusBadGateway,
+			JSON: jsonerror.Unknown("Failed to fetch the public rooms of " + string(server)),
+		}
+	}
+	if response.Chunk == nil {
+		response.Chunk = []gomatrixserverlib.PublicRoom{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: response,
+	}
+}
+
 // GetPostPublicRoomsWithExternal is the same as GetPostPublicRooms but also mixes in public rooms from the provider supplied.
+// The local rooms are listed first, followed by the rooms of each homeserver in turn, with the pagination tokens
+// recording which homeserver is being listed and where in its rooms we are. Only the local rooms are listed
+// when listing the room directory of one of our application services' networks.
+// nolint: gocyclo
 func GetPostPublicRoomsWithExternal(
-	req *http.Request, publicRoomDatabase storage.Database, fedClient *gomatrixserverlib.FederationClient,
-	extRoomsProvider types.ExternalPublicRoomsProvider,
+	req *http.Request, cfg *config.Dendrite, publicRoomDatabase storage.Database,
+	fedClient *gomatrixserverlib.FederationClient, extRoomsProvider types.ExternalPublicRoomsProvider,
 ) util.JSONResponse {
 	var request PublicRoomReq
 	if fillErr := fillPublicRoomsReq(req, &request); fillErr != nil {
 		return *fillErr
 	}
-	response, err := publicRooms(req.Context(), request, publicRoomDatabase)
-	if err != nil {
-		return jsonerror.InternalServerError()
+	pos, resErr := parseSince(request.Since)
+	if resErr != nil {
+		return *resErr
+	}
+	network, resErr := networkFilter(request)
+	if resErr != nil {
+		return *resErr
 	}
+	ctx := req.Context()
+	filter := request.Filter.SearchTerms
+	limit := int(request.Limit)
 
-	if request.Since != "" {
-		// TODO: handle pagination tokens sensibly rather than ignoring them.
-		// ignore paginated requests since we don't handle them yet over federation.
-		// Only the initial request will contain federated rooms.
-		return util.JSONResponse{
-			Code: http.StatusOK,
-			JSON: response,
+	var homeservers []gomatrixserverlib.ServerName
+	if network.AppServiceID == "" {
+		for _, hs := range extRoomsProvider.Homeservers() {
+			if serverName := gomatrixserverlib.ServerName(hs); serverName != cfg.Matrix.ServerName {
+				homeservers = append(homeservers, serverName)
+			}
 		}
 	}
 
-	// If we have already hit the limit on the number of rooms, bail.
-	var limit int
-	if request.Limit > 0 {
-		limit = int(request.Limit) - len(response.Chunk)
-		if limit <= 0 {
-			return util.JSONResponse{
-				Code: http.StatusOK,
-				JSON: response,
+	count, err := publicRoomDatabase.CountPublicRooms(ctx, filter, network)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("publicRoomDatabase.CountPublicRooms failed")
+		return jsonerror.InternalServerError()
+	}
+	response := gomatrixserverlib.RespPublicRooms{
+		Chunk:                  []gomatrixserverlib.PublicRoom{},
+		TotalRoomCountEstimate: int(count),
+	}
+
+	remoteCtx, cancel := context.WithTimeout(ctx, remotePublicRoomsTimeout)
+	defer cancel()
+
+	done := false
+	first := true
+	for !done && (limit == 0 || len(response.Chunk) < limit) {
+		remaining := 0
+		if limit > 0 {
+			remaining = limit - len(response.Chunk)
+		}
+		if pos.Server == "" {
+			rooms, err := publicRoomDatabase.GetPublicRooms(ctx, pos.Offset, int16(remaining), filter, network)
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("publicRoomDatabase.GetPublicRooms failed")
+				return jsonerror.InternalServerError()
+			}
+			if first && pos.Offset > 0 {
+				response.PrevBatch = publicRoomsToken{Offset: prevOffset(pos.Offset, limit)}.String()
+			}
+			response.Chunk = append(response.Chunk, rooms...)
+			pos.Offset += int64(len(rooms))
+			if limit == 0 || len(rooms) < remaining || pos.Offset >= count {
+				pos, done = nextPublicRoomsServer("", homeservers)
+			}
+		} else {
+			if remoteCtx.Err() != nil {
+				// We've waited long enough, let's tell the client what we got.
+				util.GetLogger(ctx).Info("Timed out querying homeservers for public rooms, returning early")
+				break
+			}
+			res, err := fetchRemotePublicRooms(remoteCtx, cfg, fedClient, pos.Server, PublicRoomReq{
+				Since:              pos.Since,
+				Limit:              int16(remaining),
+				Filter:             request.Filter,
+				IncludeAllNetworks: request.IncludeAllNetworks,
+			})
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).WithField("hs", pos.Server).Warn("Failed to query homeserver for public rooms")
+				if remoteCtx.Err() == nil {
+					pos, done = nextPublicRoomsServer(pos.Server, homeservers)
+				}
+				first = false
+				continue
+			}
+			if first && res.PrevBatch != "" {
+				response.PrevBatch = publicRoomsToken{Server: pos.Server, Since: res.PrevBatch}.String()
+			}
+			response.Chunk = append(response.Chunk, res.Chunk...)
+			response.TotalRoomCountEstimate += res.TotalRoomCountEstimate
+			if res.NextBatch != "" && len(res.Chunk) > 0 {
+				pos.Since = res.NextBatch
+				if limit == 0 {
+					break
+				}
+			} else {
+				pos, done = nextPublicRoomsServer(pos.Server, homeservers)
 			}
 		}
+		first = false
+	}
+	if !done {
+		response.NextBatch = pos.String()
 	}
 
-	// downcasting `limit` is safe as we know it isn't bigger than request.Limit which is int16
-	fedRooms := bulkFetchPublicRoomsFromServers(req.Context(), fedClient, extRoomsProvider.Homeservers(), int16(limit))
-	response.Chunk = append(response.Chunk, fedRooms...)
 	return util.JSONResponse{
 		Code: http.StatusOK,
 		JSON: response,
 	}
 }
 
-// bulkFetchPublicRoomsFromServers fetches public rooms from the list of homeservers.
-// Returns a list of public rooms up to the limit specified.
-func bulkFetchPublicRoomsFromServers(
-	ctx context.Context, fedClient *gomatrixserverlib.FederationClient, homeservers []string, limit int16,
-) (publicRooms []gomatrixserverlib.PublicRoom) {
-	// follow pipeline semantics, see https://blog.golang.org/pipelines for more info.
-	// goroutines send rooms to this channel
-	roomCh := make(chan gomatrixserverlib.PublicRoom, int(limit))
-	// signalling channel to tell goroutines to stop sending rooms and quit
-	done := make(chan bool)
-	// signalling to say when we can close the room channel
-	var wg sync.WaitGroup
-	wg.Add(len(homeservers))
-	// concurrently query for public rooms
-	for _, hs := range homeservers {
-		go func(homeserverDomain string) {
-			defer wg.Done()
-			util.GetLogger(ctx).WithField("hs", homeserverDomain).Info("Querying HS for public rooms")
-			fres, err := fedClient.GetPublicRooms(ctx, gomatrixserverlib.ServerName(homeserverDomain), int(limit), "", false, "")
-			if err != nil {
-				util.GetLogger(ctx).WithError(err).WithField("hs", homeserverDomain).Warn(
-					"bulkFetchPublicRoomsFromServers: failed to query hs",
-				)
-				return
-			}
-			for _, room := range fres.Chunk {
-				// atomically send a room or stop
-				select {
-				case roomCh <- room:
-				case <-done:
-					util.GetLogger(ctx).WithError(err).WithField("hs", homeserverDomain).Info("Interrupted whilst sending rooms")
-					return
-				}
-			}
-		}(hs)
-	}
-
-	// Close the room channel when the goroutines have quit so we don't leak, but don't let it stop the in-flight request.
-	// This also allows the request to fail fast if all HSes experience errors as it will cause the room channel to be
-	// closed.
-	go func() {
-		wg.Wait()
-		util.GetLogger(ctx).Info("Cleaning up resources")
-		close(roomCh)
-	}()
-
-	// fan-in results with timeout. We stop when we reach the limit.
-FanIn:
-	for len(publicRooms) < int(limit) || limit == 0 {
-		// add a room or timeout
-		select {
-		case room, ok := <-roomCh:
-			if !ok {
-				util.GetLogger(ctx).Info("All homeservers have been queried, returning results.")
-				break FanIn
+// nextPublicRoomsServer returns the position at the start of the rooms of the
+// homeserver after the given one, or true if there are no more homeservers.
+// The local server is represented by an empty server name.
+func nextPublicRoomsServer(
+	server gomatrixserverlib.ServerName, homeservers []gomatrixserverlib.ServerName,
+) (publicRoomsToken, bool) {
+	next := 0
+	if server != "" {
+		next = len(homeservers)
+		for i, hs := range homeservers {
+			if hs == server {
+				next = i + 1
+				break
 			}
-			publicRooms = append(publicRooms, room)
-		case <-time.After(15 * time.Second): // we've waited long enough, let's tell the client what we got.
-			util.GetLogger(ctx).Info("Waited 15s for federated public rooms, returning early")
-			break FanIn
-		case <-ctx.Done(): // the client hung up on us, let's stop.
-			util.GetLogger(ctx).Info("Client hung up, returning early")
-			break FanIn
 		}
 	}
-	// tell goroutines to stop
-	close(done)
+	if next >= len(homeservers) {
+		return publicRoomsToken{}, true
+	}
+	return publicRoomsToken{Server: homeservers[next]}, false
+}
+
+// fetchRemotePublicRooms asks a remote server for a page of its public rooms.
+// Requests with a search term are sent with POST, as GET doesn't support them.
+func fetchRemotePublicRooms(
+	ctx context.Context, cfg *config.Dendrite, fedClient *gomatrixserverlib.FederationClient,
+	server gomatrixserverlib.ServerName, request PublicRoomReq,
+) (res gomatrixserverlib.RespPublicRooms, err error) {
+	if fedClient == nil {
+		return res, errors.New("federation is not available")
+	}
+	if request.Filter.SearchTerms == "" {
+		return fedClient.GetPublicRooms(
+			ctx, server, int(request.Limit), request.Since,
+			request.IncludeAllNetworks, request.ThirdPartyInstanceID,
+		)
+	}
 
-	return publicRooms
+	fedReq := gomatrixserverlib.NewFederationRequest("POST", server, "/_matrix/federation/v1/publicRooms")
+	if err = fedReq.SetContent(request); err != nil {
+		return
+	}
+	if err = fedReq.Sign(cfg.Matrix.ServerName, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey); err != nil {
+		return
+	}
+	httpReq, err := fedReq.HTTPRequest()
+	if err != nil {
+		return
+	}
+	err = fedClient.DoRequestAndParseResponse(ctx, httpReq, &res)
+	return
 }
 
-func publicRooms(ctx context.Context, request PublicRoomReq, publicRoomDatabase storage.Database) (*gomatrixserverlib.RespPublicRooms, error) {
+func publicRooms(
+	ctx context.Context, request PublicRoomReq, offset int64, network types.NetworkFilter,
+	publicRoomDatabase storage.Database,
+) (*gomatrixserverlib.RespPublicRooms, error) {
 	var response gomatrixserverlib.RespPublicRooms
-	var limit int16
-	var offset int64
-	limit = request.Limit
-	offset, err := strconv.ParseInt(request.Since, 10, 64)
-	// ParseInt returns 0 and an error when trying to parse an empty string
-	// In that case, we want to assign 0 so we ignore the error
-	if err != nil && len(request.Since) > 0 {
-		util.GetLogger(ctx).WithError(err).Error("strconv.ParseInt failed")
-		return nil, err
-	}
+	limit := request.Limit
 
-	est, err := publicRoomDatabase.CountPublicRooms(ctx)
+	est, err := publicRoomDatabase.CountPublicRooms(ctx, request.Filter.SearchTerms, network)
 	if err != nil {
 		util.GetLogger(ctx).WithError(err).Error("publicRoomDatabase.CountPublicRooms failed")
 		return nil, err
 	}
 	response.TotalRoomCountEstimate = int(est)
 
-	if offset > 0 {
-		response.PrevBatch = strconv.Itoa(int(offset) - 1)
-	}
-	nextIndex := int(offset) + int(limit)
-	if response.TotalRoomCountEstimate > nextIndex {
-		response.NextBatch = strconv.Itoa(nextIndex)
-	}
-
 	if response.Chunk, err = publicRoomDatabase.GetPublicRooms(
-		ctx, offset, limit, request.Filter.SearchTerms,
+		ctx, offset, limit, request.Filter.SearchTerms, network,
 	); err != nil {
 		util.GetLogger(ctx).WithError(err).Error("publicRoomDatabase.GetPublicRooms failed")
 		return nil, err
 	}
 
+	if offset > 0 {
+		response.PrevBatch = publicRoomsToken{Offset: prevOffset(offset, int(limit))}.String()
+	}
+	nextOffset := offset + int64(len(response.Chunk))
+	if limit > 0 && est > nextOffset {
+		response.NextBatch = publicRoomsToken{Offset: nextOffset}.String()
+	}
+
 	return &response, nil
 }
 
-// fillPublicRoomsReq fills the Limit, Since and Filter attributes of a GET or POST request
-// on /publicRooms by parsing the incoming HTTP request
+// networkFilter returns which of the server's room directories the request
+// lists the rooms of.
+func networkFilter(request PublicRoomReq) (types.NetworkFilter, *util.JSONResponse) {
+	if request.ThirdPartyInstanceID == "" {
+		return types.NetworkFilter{IncludeAllNetworks: request.IncludeAllNetworks}, nil
+	}
+	if request.IncludeAllNetworks {
+		return types.NetworkFilter{}, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("third_party_instance_id can't be used with include_all_networks"),
+		}
+	}
+	appserviceID, networkID, err := appserviceAPI.ParseThirdPartyInstanceID(request.ThirdPartyInstanceID)
+	if err != nil {
+		return types.NetworkFilter{}, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(err.Error()),
+		}
+	}
+	return types.NetworkFilter{AppServiceID: appserviceID, NetworkID: networkID}, nil
+}
+
+// prevOffset returns the offset of the page of local rooms before the one at
+// the given offset.
+func prevOffset(offset int64, limit int) int64 {
+	if prev := offset - int64(limit); limit > 0 && prev > 0 {
+		return prev
+	}
+	return 0
+}
+
+// fillPublicRoomsReq fills the attributes of a GET or POST request on /publicRooms
+// by parsing the incoming HTTP request
 // Filter is only filled for POST requests
 func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSONResponse {
 	if httpReq.Method == http.MethodGet {
@@ -226,6 +352,8 @@ func fillPublicRoomsReq(httpReq *http.Request, request *PublicRoomReq) *util.JSO
 		}
 		request.Limit = int16(limit)
 		request.Since = httpReq.FormValue("since")
+		request.IncludeAllNetworks = httpReq.FormValue("include_all_networks") == "true"
+		request.ThirdPartyInstanceID = httpReq.FormValue("third_party_instance_id")
 		return nil
 	} else if httpReq.Method == http.MethodPost {
 		return httputil.UnmarshalJSONRequest(httpReq, request)
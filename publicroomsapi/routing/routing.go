@@ -22,8 +22,10 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/publicroomsapi/directory"
 	"github.com/matrix-org/dendrite/publicroomsapi/storage"
 	"github.com/matrix-org/dendrite/publicroomsapi/types"
@@ -39,15 +41,15 @@ const pathPrefixR0 = "/_matrix/client/r0"
 // applied:
 // nolint: gocyclo
 func Setup(
-	apiMux *mux.Router, deviceDB devices.Database, publicRoomsDB storage.Database, rsAPI api.RoomserverInternalAPI,
+	apiMux *mux.Router, cfg *config.Dendrite, deviceDB devices.Database, accountDB accounts.Database, publicRoomsDB storage.Database, rsAPI api.RoomserverInternalAPI,
 	fedClient *gomatrixserverlib.FederationClient, extRoomsProvider types.ExternalPublicRoomsProvider,
 ) {
 	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
 
 	authData := auth.Data{
-		AccountDB:   nil,
+		AccountDB:   accountDB,
 		DeviceDB:    deviceDB,
-		AppServices: nil,
+		AppServices: cfg.AppServices,
 	}
 
 	r0mux.Handle("/directory/list/room/{roomID}",
@@ -59,7 +61,6 @@ func Setup(
 			return directory.GetVisibility(req, publicRoomsDB, vars["roomID"])
 		}),
 	).Methods(http.MethodGet, http.MethodOptions)
-	// TODO: Add AS support
 	r0mux.Handle("/directory/list/room/{roomID}",
 		internal.MakeAuthAPI("directory_list", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 			vars, err := internal.URLDecodeMapValues(mux.Vars(req))
@@ -69,10 +70,27 @@ func Setup(
 			return directory.SetVisibility(req, publicRoomsDB, rsAPI, device, vars["roomID"])
 		}),
 	).Methods(http.MethodPut, http.MethodOptions)
+	r0mux.Handle("/directory/list/appservice/{networkID}/{roomID}",
+		internal.MakeExternalAPI("directory_list_appservice", func(req *http.Request) util.JSONResponse {
+			appservice, resErr := auth.VerifyAppServiceFromRequest(req, cfg.AppServices())
+			if resErr != nil {
+				return *resErr
+			}
+			vars, err := internal.URLDecodeMapValues(mux.Vars(req))
+			if err != nil {
+				return util.ErrorResponse(err)
+			}
+			return directory.SetAppServiceVisibility(req, publicRoomsDB, appservice.ID, vars["networkID"], vars["roomID"])
+		}),
+	).Methods(http.MethodPut, http.MethodOptions)
 	r0mux.Handle("/publicRooms",
 		internal.MakeExternalAPI("public_rooms", func(req *http.Request) util.JSONResponse {
+			server := gomatrixserverlib.ServerName(req.URL.Query().Get("server"))
+			if server != "" && server != cfg.Matrix.ServerName {
+				return directory.GetPostRemotePublicRooms(req, cfg, fedClient, server)
+			}
 			if extRoomsProvider != nil {
-				return directory.GetPostPublicRoomsWithExternal(req, publicRoomsDB, fedClient, extRoomsProvider)
+				return directory.GetPostPublicRoomsWithExternal(req, cfg, publicRoomsDB, fedClient, extRoomsProvider)
 			}
 			return directory.GetPostPublicRooms(req, publicRoomsDB)
 		}),
@@ -83,5 +101,5 @@ func Setup(
 		internal.MakeExternalAPI("federation_public_rooms", func(req *http.Request) util.JSONResponse {
 			return directory.GetPostPublicRooms(req, publicRoomsDB)
 		}),
-	).Methods(http.MethodGet)
+	).Methods(http.MethodGet, http.MethodPost)
 }
@@ -18,6 +18,7 @@ import (
 	"context"
 
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -25,8 +26,11 @@ type Database interface {
 	internal.PartitionStorer
 	GetRoomVisibility(ctx context.Context, roomID string) (bool, error)
 	SetRoomVisibility(ctx context.Context, visible bool, roomID string) error
-	CountPublicRooms(ctx context.Context) (int64, error)
-	GetPublicRooms(ctx context.Context, offset int64, limit int16, filter string) ([]gomatrixserverlib.PublicRoom, error)
+	SetAppServiceRoomVisibility(ctx context.Context, visible bool, appserviceID, networkID, roomID string) error
+	CountPublicRooms(ctx context.Context, filter string, network types.NetworkFilter) (int64, error)
+	GetPublicRooms(ctx context.Context, offset int64, limit int16, filter string, network types.NetworkFilter) ([]gomatrixserverlib.PublicRoom, error)
 	UpdateRoomFromEvents(ctx context.Context, eventsToAdd []gomatrixserverlib.Event, eventsToRemove []gomatrixserverlib.Event) error
 	UpdateRoomFromEvent(ctx context.Context, event gomatrixserverlib.Event) error
+	ReplaceRoom(ctx context.Context, oldRoomID, newRoomID string) error
+	DeleteRoom(ctx context.Context, roomID string) error
 }
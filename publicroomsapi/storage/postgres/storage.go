@@ -22,6 +22,7 @@ import (
 
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/sqlutil"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 
 	"github.com/matrix-org/gomatrixserverlib"
 )
@@ -30,7 +31,8 @@ import (
 type PublicRoomsServerDatabase struct {
 	db *sql.DB
 	internal.PartitionOffsetStatements
-	statements publicRoomsStatements
+	statements      publicRoomsStatements
+	appserviceRooms appserviceRoomsStatements
 }
 
 type attributeValue interface{}
@@ -48,6 +50,9 @@ func NewPublicRoomsServerDatabase(dataSourceName string, dbProperties internal.D
 	if err = storage.PartitionOffsetStatements.Prepare(db, "publicroomsapi"); err != nil {
 		return nil, err
 	}
+	if err = storage.appserviceRooms.prepare(db); err != nil {
+		return nil, err
+	}
 	if err = storage.statements.prepare(db); err != nil {
 		return nil, err
 	}
@@ -72,21 +77,70 @@ func (d *PublicRoomsServerDatabase) SetRoomVisibility(
 	return d.statements.updateRoomAttribute(ctx, "visibility", visible, roomID)
 }
 
-// CountPublicRooms returns the number of room set as publicly visible on the server.
+// DeleteRoom removes the room from the room directory, e.g. because an admin
+// has purged it from the server.
+func (d *PublicRoomsServerDatabase) DeleteRoom(ctx context.Context, roomID string) error {
+	return d.statements.deleteRoom(ctx, roomID)
+}
+
+// ReplaceRoom moves the entry of a publicly visible room in the room directory
+// to the room which replaced it when the room was upgraded. Does nothing if
+// the old room isn't publicly visible, or if the replacement room isn't known
+// yet, in which case it should be called again once it is.
+// Returns an error if the update failed.
+func (d *PublicRoomsServerDatabase) ReplaceRoom(
+	ctx context.Context, oldRoomID, newRoomID string,
+) error {
+	isPublic, err := d.statements.selectRoomVisibility(ctx, oldRoomID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil || !isPublic {
+		return err
+	}
+	_, err = d.statements.selectRoomVisibility(ctx, newRoomID)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err = d.statements.updateRoomAttribute(ctx, "visibility", true, newRoomID); err != nil {
+		return err
+	}
+	return d.statements.updateRoomAttribute(ctx, "visibility", false, oldRoomID)
+}
+
+// SetAppServiceRoomVisibility publishes a room to, or removes it from, the room
+// directory of one of an application service's networks.
+// Returns an error if the update failed.
+func (d *PublicRoomsServerDatabase) SetAppServiceRoomVisibility(
+	ctx context.Context, visible bool, appserviceID, networkID, roomID string,
+) error {
+	if visible {
+		return d.appserviceRooms.insertAppServiceRoom(ctx, appserviceID, networkID, roomID)
+	}
+	return d.appserviceRooms.deleteAppServiceRoom(ctx, appserviceID, networkID, roomID)
+}
+
+// CountPublicRooms returns the number of room set as publicly visible on the server
+// in the given network's room directory which match the given search term, if any.
 // Returns an error if the retrieval failed.
-func (d *PublicRoomsServerDatabase) CountPublicRooms(ctx context.Context) (int64, error) {
-	return d.statements.countPublicRooms(ctx)
+func (d *PublicRoomsServerDatabase) CountPublicRooms(
+	ctx context.Context, filter string, network types.NetworkFilter,
+) (int64, error) {
+	return d.statements.countPublicRooms(ctx, filter, network)
 }
 
 // GetPublicRooms returns an array containing the local rooms set as publicly visible, ordered by their number
-// of joined members. This array can be limited by a given number of elements, and offset by a given value.
+// of joined members. If a search term is given, only the rooms matching it are returned, ranked by how well
+// they match. This array can be limited by a given number of elements, and offset by a given value.
 // If the limit is 0, doesn't limit the number of results. If the offset is 0 too, the array contains all
-// the rooms set as publicly visible on the server.
+// the rooms set as publicly visible on the server. The network selects which of the server's room directories
+// the rooms are listed from.
 // Returns an error if the retrieval failed.
 func (d *PublicRoomsServerDatabase) GetPublicRooms(
-	ctx context.Context, offset int64, limit int16, filter string,
+	ctx context.Context, offset int64, limit int16, filter string, network types.NetworkFilter,
 ) ([]gomatrixserverlib.PublicRoom, error) {
-	return d.statements.selectPublicRooms(ctx, offset, limit, filter)
+	return d.statements.selectPublicRooms(ctx, offset, limit, filter, network)
 }
 
 // UpdateRoomFromEvents iterate over a slice of state events and call
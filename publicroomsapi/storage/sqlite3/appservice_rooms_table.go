@@ -0,0 +1,73 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+)
+
+const appserviceRoomsSchema = `
+-- Stores the rooms which application services have published to the room
+-- directories of their third party networks
+CREATE TABLE IF NOT EXISTS publicroomsapi_appservice_rooms(
+	-- The ID of the application service which published the room
+	appservice_id TEXT NOT NULL,
+	-- The ID of the application service's network the room is published to
+	network_id TEXT NOT NULL,
+	-- The room's ID
+	room_id TEXT NOT NULL,
+	PRIMARY KEY(appservice_id, network_id, room_id)
+);
+`
+
+const insertAppServiceRoomSQL = "" +
+	"INSERT OR IGNORE INTO publicroomsapi_appservice_rooms(appservice_id, network_id, room_id)" +
+	" VALUES ($1, $2, $3)"
+
+const deleteAppServiceRoomSQL = "" +
+	"DELETE FROM publicroomsapi_appservice_rooms" +
+	" WHERE appservice_id = $1 AND network_id = $2 AND room_id = $3"
+
+type appserviceRoomsStatements struct {
+	insertAppServiceRoomStmt *sql.Stmt
+	deleteAppServiceRoomStmt *sql.Stmt
+}
+
+func (s *appserviceRoomsStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(appserviceRoomsSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.insertAppServiceRoomStmt, insertAppServiceRoomSQL},
+		{&s.deleteAppServiceRoomStmt, deleteAppServiceRoomSQL},
+	}.prepare(db)
+}
+
+func (s *appserviceRoomsStatements) insertAppServiceRoom(
+	ctx context.Context, appserviceID, networkID, roomID string,
+) error {
+	_, err := s.insertAppServiceRoomStmt.ExecContext(ctx, appserviceID, networkID, roomID)
+	return err
+}
+
+func (s *appserviceRoomsStatements) deleteAppServiceRoom(
+	ctx context.Context, appserviceID, networkID, roomID string,
+) error {
+	_, err := s.deleteAppServiceRoomStmt.ExecContext(ctx, appserviceID, networkID, roomID)
+	return err
+}
@@ -21,8 +21,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strings"
 
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 )
 
@@ -53,41 +55,65 @@ CREATE TABLE IF NOT EXISTS publicroomsapi_public_rooms(
 );
 `
 
+// Selects the rooms in the room directory being listed. $1 is the ID of the
+// application service whose network is listed, or empty for the main room
+// directory, $2 is whether the main room directory includes the rooms of every
+// network and $3 is the ID of the network.
+const publicRoomsNetworkSQL = "" +
+	"(($1 = '' AND (visibility = true" +
+	" OR ($2 AND room_id IN (SELECT room_id FROM publicroomsapi_appservice_rooms))))" +
+	" OR ($1 <> '' AND room_id IN (SELECT room_id FROM publicroomsapi_appservice_rooms" +
+	" WHERE appservice_id = $1 AND network_id = $3)))"
+
+// The search term is $4 and a LIKE pattern matching it is $5.
+const publicRoomsFilterSQL = "" +
+	" AND (LOWER(name) = LOWER($4)" +
+	" OR LOWER(name) LIKE $5 ESCAPE '\\'" +
+	" OR LOWER(topic) LIKE $5 ESCAPE '\\'" +
+	" OR LOWER(canonical_alias) LIKE $5 ESCAPE '\\'" +
+	" OR LOWER(aliases) LIKE $5 ESCAPE '\\')"
+
+// Ranks rooms matching the search term by where it matches: exact names and
+// canonical aliases first, then names, aliases and finally topics.
+const publicRoomsRankSQL = "" +
+	"(CASE WHEN LOWER(name) = LOWER($4) OR LOWER(canonical_alias) = LOWER($4) THEN 8 ELSE 0 END)" +
+	" + (CASE WHEN LOWER(name) LIKE $5 ESCAPE '\\' THEN 4 ELSE 0 END)" +
+	" + (CASE WHEN LOWER(canonical_alias) LIKE $5 ESCAPE '\\' OR LOWER(aliases) LIKE $5 ESCAPE '\\' THEN 2 ELSE 0 END)" +
+	" + (CASE WHEN LOWER(topic) LIKE $5 ESCAPE '\\' THEN 1 ELSE 0 END)"
+
 const countPublicRoomsSQL = "" +
 	"SELECT COUNT(*) FROM publicroomsapi_public_rooms" +
-	" WHERE visibility = true"
+	" WHERE " + publicRoomsNetworkSQL
+
+const countPublicRoomsWithFilterSQL = "" +
+	"SELECT COUNT(*) FROM publicroomsapi_public_rooms" +
+	" WHERE " + publicRoomsNetworkSQL + publicRoomsFilterSQL
 
 const selectPublicRoomsSQL = "" +
 	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
-	" FROM publicroomsapi_public_rooms WHERE visibility = true" +
-	" ORDER BY joined_members DESC" +
-	" LIMIT 30 OFFSET $1"
+	" FROM publicroomsapi_public_rooms WHERE " + publicRoomsNetworkSQL +
+	" ORDER BY joined_members DESC, room_id ASC" +
+	" LIMIT -1 OFFSET $4"
 
 const selectPublicRoomsWithLimitSQL = "" +
 	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
-	" FROM publicroomsapi_public_rooms WHERE visibility = true" +
-	" ORDER BY joined_members DESC" +
-	" LIMIT $1 OFFSET $2"
+	" FROM publicroomsapi_public_rooms WHERE " + publicRoomsNetworkSQL +
+	" ORDER BY joined_members DESC, room_id ASC" +
+	" LIMIT $4 OFFSET $5"
 
 const selectPublicRoomsWithFilterSQL = "" +
 	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
 	" FROM publicroomsapi_public_rooms" +
-	" WHERE visibility = true" +
-	" AND (LOWER(name) LIKE LOWER($1)" +
-	" OR LOWER(topic) LIKE LOWER($1)" +
-	" OR LOWER(aliases) LIKE LOWER($1))" + // TODO: Is there a better way to search aliases?
-	" ORDER BY joined_members DESC" +
-	" LIMIT 30 OFFSET $2"
+	" WHERE " + publicRoomsNetworkSQL + publicRoomsFilterSQL +
+	" ORDER BY " + publicRoomsRankSQL + " DESC, joined_members DESC, room_id ASC" +
+	" LIMIT -1 OFFSET $6"
 
 const selectPublicRoomsWithLimitAndFilterSQL = "" +
 	"SELECT room_id, joined_members, aliases, canonical_alias, name, topic, world_readable, guest_can_join, avatar_url" +
 	" FROM publicroomsapi_public_rooms" +
-	" WHERE visibility = true" +
-	" AND (LOWER(name) LIKE LOWER($1)" +
-	" OR LOWER(topic) LIKE LOWER($1)" +
-	" OR LOWER(aliases) LIKE LOWER($1))" + // TODO: Is there a better way to search aliases?
-	" ORDER BY joined_members DESC" +
-	" LIMIT $3 OFFSET $2"
+	" WHERE " + publicRoomsNetworkSQL + publicRoomsFilterSQL +
+	" ORDER BY " + publicRoomsRankSQL + " DESC, joined_members DESC, room_id ASC" +
+	" LIMIT $6 OFFSET $7"
 
 const selectRoomVisibilitySQL = "" +
 	"SELECT visibility FROM publicroomsapi_public_rooms" +
@@ -107,6 +133,9 @@ const decrementJoinedMembersInRoomSQL = "" +
 	" SET joined_members = joined_members - 1" +
 	" WHERE room_id = $1"
 
+const deleteRoomSQL = "" +
+	"DELETE FROM publicroomsapi_public_rooms WHERE room_id = $1"
+
 const updateRoomAttributeSQL = "" +
 	"UPDATE publicroomsapi_public_rooms" +
 	" SET %s = $1" +
@@ -114,6 +143,7 @@ const updateRoomAttributeSQL = "" +
 
 type publicRoomsStatements struct {
 	countPublicRoomsStmt                    *sql.Stmt
+	countPublicRoomsWithFilterStmt          *sql.Stmt
 	selectPublicRoomsStmt                   *sql.Stmt
 	selectPublicRoomsWithLimitStmt          *sql.Stmt
 	selectPublicRoomsWithFilterStmt         *sql.Stmt
@@ -122,6 +152,7 @@ type publicRoomsStatements struct {
 	insertNewRoomStmt                       *sql.Stmt
 	incrementJoinedMembersInRoomStmt        *sql.Stmt
 	decrementJoinedMembersInRoomStmt        *sql.Stmt
+	deleteRoomStmt                          *sql.Stmt
 	updateRoomAttributeStmts                map[string]*sql.Stmt
 }
 
@@ -133,6 +164,7 @@ func (s *publicRoomsStatements) prepare(db *sql.DB) (err error) {
 
 	stmts := statementList{
 		{&s.countPublicRoomsStmt, countPublicRoomsSQL},
+		{&s.countPublicRoomsWithFilterStmt, countPublicRoomsWithFilterSQL},
 		{&s.selectPublicRoomsStmt, selectPublicRoomsSQL},
 		{&s.selectPublicRoomsWithLimitStmt, selectPublicRoomsWithLimitSQL},
 		{&s.selectPublicRoomsWithFilterStmt, selectPublicRoomsWithFilterSQL},
@@ -141,6 +173,7 @@ func (s *publicRoomsStatements) prepare(db *sql.DB) (err error) {
 		{&s.insertNewRoomStmt, insertNewRoomSQL},
 		{&s.incrementJoinedMembersInRoomStmt, incrementJoinedMembersInRoomSQL},
 		{&s.decrementJoinedMembersInRoomStmt, decrementJoinedMembersInRoomSQL},
+		{&s.deleteRoomStmt, deleteRoomSQL},
 	}
 
 	if err = stmts.prepare(db); err != nil {
@@ -158,40 +191,63 @@ func (s *publicRoomsStatements) prepare(db *sql.DB) (err error) {
 	return
 }
 
-func (s *publicRoomsStatements) countPublicRooms(ctx context.Context) (nb int64, err error) {
-	err = s.countPublicRoomsStmt.QueryRowContext(ctx).Scan(&nb)
+// searchPattern returns a LIKE pattern matching values which contain the
+// search term, ignoring case.
+func searchPattern(filter string) string {
+	escaper := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return "%" + escaper.Replace(strings.ToLower(filter)) + "%"
+}
+
+// networkArgs returns the parameters of publicRoomsNetworkSQL which select the
+// rooms of the given network.
+func networkArgs(network types.NetworkFilter) []interface{} {
+	return []interface{}{network.AppServiceID, network.IncludeAllNetworks, network.NetworkID}
+}
+
+func (s *publicRoomsStatements) countPublicRooms(
+	ctx context.Context, filter string, network types.NetworkFilter,
+) (nb int64, err error) {
+	args := networkArgs(network)
+	if len(filter) > 0 {
+		args = append(args, filter, searchPattern(filter))
+		err = s.countPublicRoomsWithFilterStmt.QueryRowContext(ctx, args...).Scan(&nb)
+		return
+	}
+	err = s.countPublicRoomsStmt.QueryRowContext(ctx, args...).Scan(&nb)
 	return
 }
 
 func (s *publicRoomsStatements) selectPublicRooms(
-	ctx context.Context, offset int64, limit int16, filter string,
+	ctx context.Context, offset int64, limit int16, filter string, network types.NetworkFilter,
 ) ([]gomatrixserverlib.PublicRoom, error) {
 	var rows *sql.Rows
 	var err error
 
+	args := networkArgs(network)
+
 	if len(filter) > 0 {
-		pattern := "%" + filter + "%"
+		pattern := searchPattern(filter)
 		if limit == 0 {
 			rows, err = s.selectPublicRoomsWithFilterStmt.QueryContext(
-				ctx, pattern, offset,
+				ctx, append(args, filter, pattern, offset)...,
 			)
 		} else {
 			rows, err = s.selectPublicRoomsWithLimitAndFilterStmt.QueryContext(
-				ctx, pattern, limit, offset,
+				ctx, append(args, filter, pattern, limit, offset)...,
 			)
 		}
 	} else {
 		if limit == 0 {
-			rows, err = s.selectPublicRoomsStmt.QueryContext(ctx, offset)
+			rows, err = s.selectPublicRoomsStmt.QueryContext(ctx, append(args, offset)...)
 		} else {
 			rows, err = s.selectPublicRoomsWithLimitStmt.QueryContext(
-				ctx, limit, offset,
+				ctx, append(args, limit, offset)...,
 			)
 		}
 	}
 
 	if err != nil {
-		return []gomatrixserverlib.PublicRoom{}, nil
+		return nil, err
 	}
 	defer internal.CloseAndLogIfError(ctx, rows, "selectPublicRooms failed to close rows")
 
@@ -248,6 +304,13 @@ func (s *publicRoomsStatements) decrementJoinedMembersInRoom(
 	return err
 }
 
+func (s *publicRoomsStatements) deleteRoom(
+	ctx context.Context, roomID string,
+) error {
+	_, err := s.deleteRoomStmt.ExecContext(ctx, roomID)
+	return err
+}
+
 func (s *publicRoomsStatements) updateRoomAttribute(
 	ctx context.Context, attrName string, attrValue attributeValue, roomID string,
 ) error {
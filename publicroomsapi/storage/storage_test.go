@@ -0,0 +1,152 @@
+package storage_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/publicroomsapi/storage"
+	"github.com/matrix-org/dendrite/publicroomsapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/publicroomsapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+var ctx = context.Background()
+
+func MustCreateDatabase(t *testing.T) storage.Database {
+	db, err := sqlite3.NewPublicRoomsServerDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("NewPublicRoomsServerDatabase returned %s", err)
+	}
+	return db
+}
+
+func MustCreateRoom(t *testing.T, db storage.Database, roomID string, visible bool) {
+	event := mustCreateEvent(t, roomID)
+	if err := db.UpdateRoomFromEvent(ctx, event); err != nil {
+		t.Fatalf("UpdateRoomFromEvent returned %s", err)
+	}
+	if err := db.SetRoomVisibility(ctx, visible, roomID); err != nil {
+		t.Fatalf("SetRoomVisibility returned %s", err)
+	}
+}
+
+func assertVisibility(t *testing.T, db storage.Database, roomID string, want bool) {
+	visible, err := db.GetRoomVisibility(ctx, roomID)
+	if err != nil {
+		t.Fatalf("GetRoomVisibility(%s) returned %s", roomID, err)
+	}
+	if visible != want {
+		t.Fatalf("GetRoomVisibility(%s) returned %v, want %v", roomID, visible, want)
+	}
+}
+
+func TestReplaceRoom(t *testing.T) {
+	db := MustCreateDatabase(t)
+	MustCreateRoom(t, db, "!old:localhost", true)
+
+	// The replacement room isn't known yet, so nothing moves.
+	if err := db.ReplaceRoom(ctx, "!old:localhost", "!new:localhost"); err != nil {
+		t.Fatalf("ReplaceRoom returned %s", err)
+	}
+	assertVisibility(t, db, "!old:localhost", true)
+
+	// Once it is, the entry moves.
+	MustCreateRoom(t, db, "!new:localhost", false)
+	if err := db.ReplaceRoom(ctx, "!old:localhost", "!new:localhost"); err != nil {
+		t.Fatalf("ReplaceRoom returned %s", err)
+	}
+	assertVisibility(t, db, "!old:localhost", false)
+	assertVisibility(t, db, "!new:localhost", true)
+}
+
+func TestReplaceRoomNotPublic(t *testing.T) {
+	db := MustCreateDatabase(t)
+	MustCreateRoom(t, db, "!old:localhost", false)
+	MustCreateRoom(t, db, "!new:localhost", false)
+
+	if err := db.ReplaceRoom(ctx, "!old:localhost", "!new:localhost"); err != nil {
+		t.Fatalf("ReplaceRoom returned %s", err)
+	}
+	assertVisibility(t, db, "!new:localhost", false)
+
+	// Rooms which we don't know about are ignored.
+	if err := db.ReplaceRoom(ctx, "!unknown:localhost", "!new:localhost"); err != nil {
+		t.Fatalf("ReplaceRoom returned %s", err)
+	}
+	assertVisibility(t, db, "!new:localhost", false)
+}
+
+func TestAppServiceRoomDirectories(t *testing.T) {
+	db := MustCreateDatabase(t)
+	MustCreateRoom(t, db, "!main:localhost", true)
+	MustCreateRoom(t, db, "!irc:localhost", false)
+	MustCreateRoom(t, db, "!slack:localhost", false)
+	MustCreateRoom(t, db, "!private:localhost", false)
+	for _, room := range []struct{ networkID, roomID string }{
+		{"irc", "!irc:localhost"},
+		{"slack", "!slack:localhost"},
+		// Rooms can be in the main room directory and a network's too.
+		{"irc", "!main:localhost"},
+	} {
+		if err := db.SetAppServiceRoomVisibility(ctx, true, "bridge", room.networkID, room.roomID); err != nil {
+			t.Fatalf("SetAppServiceRoomVisibility returned %s", err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		network types.NetworkFilter
+		want    []string
+	}{
+		{"main", types.NetworkFilter{}, []string{"!main:localhost"}},
+		{"all networks", types.NetworkFilter{IncludeAllNetworks: true}, []string{"!irc:localhost", "!main:localhost", "!slack:localhost"}},
+		{"irc", types.NetworkFilter{AppServiceID: "bridge", NetworkID: "irc"}, []string{"!irc:localhost", "!main:localhost"}},
+		{"slack", types.NetworkFilter{AppServiceID: "bridge", NetworkID: "slack"}, []string{"!slack:localhost"}},
+		{"other appservice", types.NetworkFilter{AppServiceID: "other", NetworkID: "irc"}, []string{}},
+	}
+	for _, tt := range tests {
+		assertPublicRooms(t, db, tt.name, tt.network, tt.want)
+	}
+
+	// Removing a room from a network's directory leaves it in the others.
+	if err := db.SetAppServiceRoomVisibility(ctx, false, "bridge", "irc", "!main:localhost"); err != nil {
+		t.Fatalf("SetAppServiceRoomVisibility returned %s", err)
+	}
+	assertPublicRooms(t, db, "irc after removal", types.NetworkFilter{AppServiceID: "bridge", NetworkID: "irc"}, []string{"!irc:localhost"})
+	assertPublicRooms(t, db, "main after removal", types.NetworkFilter{}, []string{"!main:localhost"})
+}
+
+func assertPublicRooms(t *testing.T, db storage.Database, name string, network types.NetworkFilter, want []string) {
+	count, err := db.CountPublicRooms(ctx, "", network)
+	if err != nil {
+		t.Fatalf("%s: CountPublicRooms returned %s", name, err)
+	}
+	if count != int64(len(want)) {
+		t.Errorf("%s: CountPublicRooms returned %d, want %d", name, count, len(want))
+	}
+	rooms, err := db.GetPublicRooms(ctx, 0, 0, "", network)
+	if err != nil {
+		t.Fatalf("%s: GetPublicRooms returned %s", name, err)
+	}
+	got := []string{}
+	for _, room := range rooms {
+		got = append(got, room.RoomID)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("%s: GetPublicRooms returned %v, want %v", name, got, want)
+	}
+}
+
+func mustCreateEvent(t *testing.T, roomID string) gomatrixserverlib.Event {
+	eventJSON := fmt.Sprintf(
+		`{"auth_events":[],"content":{"creator":"@alice:localhost"},"depth":1,"event_id":"$create%s","hashes":{"sha256":"abc"},"origin":"localhost","origin_server_ts":1,"prev_events":[],"room_id":%q,"sender":"@alice:localhost","signatures":{},"state_key":"","type":"m.room.create"}`,
+		roomID, roomID,
+	)
+	event, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("NewEventFromTrustedJSON returned %s", err)
+	}
+	return event
+}
@@ -22,3 +22,15 @@ type ExternalPublicRoomsProvider interface {
 	// This will be called -on demand- by clients, so cache appropriately!
 	Homeservers() []string
 }
+
+// NetworkFilter selects which of the room directories published on the server
+// to list. The zero value lists the server's main room directory.
+type NetworkFilter struct {
+	// Whether to list the rooms published to every application service's
+	// networks as well as those in the main room directory.
+	IncludeAllNetworks bool
+	// The application service and the ID of its network whose rooms should
+	// be listed, rather than those in the main room directory.
+	AppServiceID string
+	NetworkID    string
+}
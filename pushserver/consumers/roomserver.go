@@ -0,0 +1,273 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+	"net/url"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/pushserver/gateway"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// notifyWorkers is the number of notifications which are sent to push
+	// gateways at the same time.
+	notifyWorkers = 8
+	// notifyQueueSize is the number of notifications which may wait for a
+	// worker before the consumer stops reading new room events.
+	notifyQueueSize = 256
+)
+
+// OutputRoomEventConsumer consumes events that originated in the room server
+// and sends push notifications for them to the pushers of local users.
+type OutputRoomEventConsumer struct {
+	rsConsumer *internal.ContinualConsumer
+	db         accounts.Database
+	syncDB     storage.Database
+	rsAPI      api.RoomserverInternalAPI
+	gateway    *gateway.Client
+	serverName gomatrixserverlib.ServerName
+	queue      chan *pushNotification
+}
+
+// pushNotification is a notification waiting to be sent to a pusher.
+type pushNotification struct {
+	localpart string
+	pusher    authtypes.Pusher
+	req       *gateway.NotifyRequest
+}
+
+// NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
+func NewOutputRoomEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	store accounts.Database,
+	syncDB storage.Database,
+	rsAPI api.RoomserverInternalAPI,
+	gatewayClient *gateway.Client,
+) *OutputRoomEventConsumer {
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputRoomEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store.PushServerPartitionStore(),
+	}
+	s := &OutputRoomEventConsumer{
+		rsConsumer: &consumer,
+		db:         store,
+		syncDB:     syncDB,
+		rsAPI:      rsAPI,
+		gateway:    gatewayClient,
+		serverName: cfg.Matrix.ServerName,
+		queue:      make(chan *pushNotification, notifyQueueSize),
+	}
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from room servers
+func (s *OutputRoomEventConsumer) Start() error {
+	for i := 0; i < notifyWorkers; i++ {
+		go s.notifyWorker()
+	}
+	return s.rsConsumer.Start()
+}
+
+// onMessage is called when the push server receives a new event from the room server output log.
+func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("roomserver output log: message parse failure")
+		return nil
+	}
+
+	if output.Type != api.OutputTypeNewRoomEvent {
+		return nil
+	}
+
+	ev := output.NewRoomEvent.Event
+	if err := s.notifyLocalUsers(context.TODO(), &ev); err != nil {
+		log.WithError(err).WithField("event_id", ev.EventID()).Error("failed to send push notifications")
+	}
+	return nil
+}
+
+// notifyLocalUsers evaluates the push rules of every local user in the room
+// who has a pusher, and notifies their pushers if the event matches.
+func (s *OutputRoomEventConsumer) notifyLocalUsers(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent) error {
+	var stateRes api.QueryLatestEventsAndStateResponse
+	if err := s.rsAPI.QueryLatestEventsAndState(ctx, &api.QueryLatestEventsAndStateRequest{
+		RoomID: ev.RoomID(),
+	}, &stateRes); err != nil {
+		return err
+	}
+	room := pushrules.NewRoomState(stateRes.StateEvents)
+
+	for _, userID := range room.LocalTargets(s.serverName, ev) {
+		localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			continue
+		}
+		pushers, err := s.db.GetPushersByLocalpart(ctx, localpart)
+		if err != nil {
+			return err
+		}
+		if len(pushers) == 0 {
+			continue
+		}
+		ruleSets, err := pushrules.QueryAccountRuleSets(ctx, s.db, localpart, s.serverName)
+		if err != nil {
+			return err
+		}
+		rule, err := pushrules.NewRuleSetEvaluator(room.EvaluationContext(userID), &ruleSets.Global).MatchEvent(&ev.Event)
+		if err != nil {
+			// One user's broken push rules mustn't stop everyone else in the
+			// room from being notified.
+			log.WithError(err).WithField("user_id", userID).Error("failed to evaluate push rules")
+			continue
+		}
+		if rule == nil {
+			continue
+		}
+		notify, tweaks := pushrules.ActionsToTweaks(rule.Actions)
+		if !notify {
+			continue
+		}
+		counts := s.counts(ctx, userID, ev.RoomID())
+		for _, pusher := range pushers {
+			// Deliver in the background, so that a slow or unavailable push
+			// gateway doesn't hold up the rest of the room event stream
+			// unless the queue is full.
+			req := s.notification(ev, room, userID, pusher, tweaks)
+			req.Notification.Counts = counts
+			s.queue <- &pushNotification{localpart, pusher, req}
+		}
+	}
+	return nil
+}
+
+// notification builds the notification for a pusher, honouring its format.
+func (s *OutputRoomEventConsumer) notification(
+	ev *gomatrixserverlib.HeaderedEvent, room *pushrules.RoomState, userID string,
+	pusher authtypes.Pusher, tweaks map[pushrules.TweakKey]interface{},
+) *gateway.NotifyRequest {
+	device := gateway.Device{
+		AppID:   pusher.AppID,
+		PushKey: pusher.PushKey,
+		Data:    map[string]interface{}{},
+		Tweaks:  map[string]interface{}{},
+	}
+	for k, v := range pusher.Data {
+		// The gateway URL is only for us, not for the gateway.
+		if k != "url" {
+			device.Data[k] = v
+		}
+	}
+	for k, v := range tweaks {
+		device.Tweaks[string(k)] = v
+	}
+
+	priority := "low"
+	if _, ok := tweaks[pushrules.SoundTweak]; ok {
+		priority = "high"
+	}
+
+	n := gateway.Notification{
+		EventID:  ev.EventID(),
+		RoomID:   ev.RoomID(),
+		Priority: priority,
+		Devices:  []gateway.Device{device},
+	}
+	if format, _ := pusher.Data["format"].(string); format != "event_id_only" {
+		n.Type = ev.Type()
+		n.Sender = ev.Sender()
+		n.SenderDisplayName = room.DisplayName(ev.Sender())
+		n.RoomName = room.Name
+		n.RoomAlias = room.CanonicalAlias
+		n.UserIsTarget = ev.StateKeyEquals(userID)
+		n.Content = ev.Content()
+	}
+	return &gateway.NotifyRequest{Notification: n}
+}
+
+// counts returns the badge counts of the user, which is the number of rooms
+// with unread notifications according to the sync API.
+func (s *OutputRoomEventConsumer) counts(ctx context.Context, userID, roomID string) *gateway.Counts {
+	rooms, err := s.syncDB.GetNotificationCounts(ctx, userID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", userID).Error("Failed to get notification counts")
+		return nil
+	}
+	// The sync API counts notifications as it consumes the same room events
+	// as we do, so it may not have counted this one yet.
+	counts := &gateway.Counts{Unread: 1}
+	for id, room := range rooms {
+		if id != roomID && room.NotificationCount > 0 {
+			counts.Unread++
+		}
+	}
+	return counts
+}
+
+// notifyWorker sends queued notifications to push gateways.
+func (s *OutputRoomEventConsumer) notifyWorker() {
+	for n := range s.queue {
+		s.notifyPusher(n.localpart, n.pusher, n.req)
+	}
+}
+
+// notifyPusher sends the notification to the pusher's gateway, and removes
+// the pusher if the gateway rejects its pushkey.
+func (s *OutputRoomEventConsumer) notifyPusher(localpart string, pusher authtypes.Pusher, req *gateway.NotifyRequest) {
+	ctx := context.Background()
+	logger := log.WithFields(log.Fields{
+		"localpart": localpart,
+		"app_id":    pusher.AppID,
+		"event_id":  req.Notification.EventID,
+	})
+	// Pushers saved before the URL was checked when setting them may point
+	// somewhere other than a push gateway, so don't send them anything.
+	gatewayURL, _ := pusher.Data["url"].(string)
+	if u, err := url.Parse(gatewayURL); err != nil || u.Path != gateway.NotifyPath {
+		logger.WithField("url", gatewayURL).Warn("Not sending push notification to a URL which isn't a push gateway")
+		return
+	}
+	res, err := s.gateway.Notify(ctx, gatewayURL, req)
+	if err != nil {
+		logger.WithError(err).Error("Failed to send push notification")
+		return
+	}
+	for _, pushKey := range res.Rejected {
+		if pushKey != pusher.PushKey {
+			continue
+		}
+		logger.Info("Push gateway rejected pushkey, removing pusher")
+		if err = s.db.RemovePusher(ctx, pusher.AppID, pushKey, localpart); err != nil {
+			logger.WithError(err).Error("Failed to remove rejected pusher")
+		}
+	}
+}
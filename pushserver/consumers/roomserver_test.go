@@ -0,0 +1,176 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	accountsSqlite3 "github.com/matrix-org/dendrite/clientapi/auth/storage/accounts/sqlite3"
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustHeaderedEvent(t *testing.T, eventJSON string) gomatrixserverlib.HeaderedEvent {
+	t.Helper()
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev.Headered(gomatrixserverlib.RoomVersionV1)
+}
+
+func TestNotification(t *testing.T) {
+	room := pushrules.NewRoomState([]gomatrixserverlib.HeaderedEvent{
+		mustHeaderedEvent(t, `{"event_id":"$a:test","room_id":"!room:test","type":"m.room.member","sender":"@alice:test","state_key":"@alice:test","content":{"membership":"join","displayname":"Alice"}}`),
+		mustHeaderedEvent(t, `{"event_id":"$b:test","room_id":"!room:test","type":"m.room.member","sender":"@bob:test","state_key":"@bob:test","content":{"membership":"join","displayname":"Bob"}}`),
+		mustHeaderedEvent(t, `{"event_id":"$c:test","room_id":"!room:test","type":"m.room.member","sender":"@carol:remote","state_key":"@carol:remote","content":{"membership":"join"}}`),
+		mustHeaderedEvent(t, `{"event_id":"$d:test","room_id":"!room:test","type":"m.room.name","sender":"@alice:test","state_key":"","content":{"name":"Test Room"}}`),
+	})
+	ev := mustHeaderedEvent(t, `{"event_id":"$msg:test","room_id":"!room:test","type":"m.room.message","sender":"@bob:test","content":{"msgtype":"m.text","body":"hi"}}`)
+
+	targets := room.LocalTargets("test", &ev)
+	if len(targets) != 1 || targets[0] != "@alice:test" || room.JoinedCount != 3 {
+		t.Fatalf("localTargets returned %v with %d joined, want [@alice:test] with 3 joined", targets, room.JoinedCount)
+	}
+
+	s := &OutputRoomEventConsumer{serverName: "test"}
+	pusher := authtypes.Pusher{
+		AppID:   "org.example.app",
+		PushKey: "key",
+		Data:    map[string]interface{}{"url": "https://push.example.org/_matrix/push/v1/notify"},
+	}
+	tweaks := map[pushrules.TweakKey]interface{}{pushrules.SoundTweak: "default"}
+
+	n := s.notification(&ev, room, "@alice:test", pusher, tweaks).Notification
+	if n.SenderDisplayName != "Bob" || n.RoomName != "Test Room" || n.Priority != "high" || string(n.Content) == "" {
+		t.Fatalf("notification returned %+v", n)
+	}
+	if _, ok := n.Devices[0].Data["url"]; ok || n.Devices[0].Tweaks["sound"] != "default" {
+		t.Fatalf("notification returned device %+v", n.Devices[0])
+	}
+
+	pusher.Data["format"] = "event_id_only"
+	n = s.notification(&ev, room, "@alice:test", pusher, nil).Notification
+	if n.EventID != "$msg:test" || n.Sender != "" || n.Content != nil || n.Priority != "low" {
+		t.Fatalf("event_id_only notification returned %+v", n)
+	}
+}
+
+func TestCounts(t *testing.T) {
+	ctx := context.Background()
+	syncDB, err := sqlite3.NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("failed to open sync db: %s", err)
+	}
+	s := &OutputRoomEventConsumer{syncDB: syncDB, serverName: "test"}
+
+	if counts := s.counts(ctx, "@alice:test", "!a:test"); counts == nil || counts.Unread != 1 {
+		t.Fatalf("counts returned %+v before the sync API counted the event, want 1 unread", counts)
+	}
+	for _, roomID := range []string{"!a:test", "!b:test", "!c:test"} {
+		if err = syncDB.IncrementNotificationCounts(ctx, "@alice:test", roomID, false); err != nil {
+			t.Fatalf("failed to increment notification counts: %s", err)
+		}
+	}
+	if err = syncDB.ResetNotificationCounts(ctx, "@alice:test", "!c:test"); err != nil {
+		t.Fatalf("failed to reset notification counts: %s", err)
+	}
+	if counts := s.counts(ctx, "@alice:test", "!a:test"); counts == nil || counts.Unread != 2 {
+		t.Fatalf("counts returned %+v, want 2 unread", counts)
+	}
+}
+
+// stateRoomserverAPI returns the given current state for every room.
+type stateRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	state []gomatrixserverlib.HeaderedEvent
+}
+
+func (a *stateRoomserverAPI) QueryLatestEventsAndState(
+	ctx context.Context,
+	req *api.QueryLatestEventsAndStateRequest,
+	res *api.QueryLatestEventsAndStateResponse,
+) error {
+	res.RoomExists = true
+	res.StateEvents = a.state
+	return nil
+}
+
+func TestNotifyLocalUsersBrokenRules(t *testing.T) {
+	ctx := context.Background()
+	dir, err := ioutil.TempDir("", "dendrite-pushserver")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir) // nolint: errcheck
+	accountDB, err := accountsSqlite3.NewDatabase("file:"+filepath.Join(dir, "accounts.db"), "test")
+	if err != nil {
+		t.Fatalf("failed to open account db: %s", err)
+	}
+	syncDB, err := sqlite3.NewDatabase("file::memory:")
+	if err != nil {
+		t.Fatalf("failed to open sync db: %s", err)
+	}
+
+	// Alice's rules can't be evaluated, but Dave's are the defaults.
+	brokenRules := `{"global":{"override":[{"rule_id":"broken","enabled":true,"actions":["notify"],"conditions":[{"kind":"room_member_count","is":"abc"}]}],"content":[],"room":[],"sender":[],"underride":[]}}`
+	if err = accountDB.SaveAccountData(ctx, "alice", "", pushrules.AccountDataType, brokenRules); err != nil {
+		t.Fatalf("failed to save push rules: %s", err)
+	}
+	for _, localpart := range []string{"alice", "dave"} {
+		if err = accountDB.SavePusher(ctx, localpart, &authtypes.Pusher{
+			Kind:    "http",
+			AppID:   "org.example.app",
+			PushKey: localpart + "_key",
+			Data:    map[string]interface{}{"url": "https://push.example.org/_matrix/push/v1/notify"},
+		}, false); err != nil {
+			t.Fatalf("failed to save pusher: %s", err)
+		}
+	}
+
+	s := &OutputRoomEventConsumer{
+		db:     accountDB,
+		syncDB: syncDB,
+		rsAPI: &stateRoomserverAPI{state: []gomatrixserverlib.HeaderedEvent{
+			mustHeaderedEvent(t, `{"event_id":"$a:test","room_id":"!room:test","type":"m.room.member","sender":"@alice:test","state_key":"@alice:test","content":{"membership":"join"}}`),
+			mustHeaderedEvent(t, `{"event_id":"$b:test","room_id":"!room:test","type":"m.room.member","sender":"@bob:test","state_key":"@bob:test","content":{"membership":"join"}}`),
+			mustHeaderedEvent(t, `{"event_id":"$c:test","room_id":"!room:test","type":"m.room.member","sender":"@carol:test","state_key":"@carol:test","content":{"membership":"join"}}`),
+			mustHeaderedEvent(t, `{"event_id":"$d:test","room_id":"!room:test","type":"m.room.member","sender":"@dave:test","state_key":"@dave:test","content":{"membership":"join"}}`),
+		}},
+		serverName: "test",
+		queue:      make(chan *pushNotification, notifyQueueSize),
+	}
+	ev := mustHeaderedEvent(t, `{"event_id":"$msg:test","room_id":"!room:test","type":"m.room.message","sender":"@bob:test","content":{"msgtype":"m.text","body":"hi"}}`)
+
+	// The users are evaluated in a random order, so try a few times.
+	for i := 0; i < 10; i++ {
+		if err = s.notifyLocalUsers(ctx, &ev); err != nil {
+			t.Fatalf("notifyLocalUsers returned %s", err)
+		}
+		if len(s.queue) != 1 {
+			t.Fatalf("notifyLocalUsers queued %d notifications, want 1", len(s.queue))
+		}
+		if n := <-s.queue; n.localpart != "dave" {
+			t.Fatalf("notifyLocalUsers notified %s, want dave", n.localpart)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package gateway implements a client for the push gateway API described in
+// https://matrix.org/docs/spec/push_gateway/r0.1.1
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// NotifyPath is the path of the push gateway notification endpoint.
+const NotifyPath = "/_matrix/push/v1/notify"
+
+// NotifyRequest is the body of a request to the notify endpoint.
+type NotifyRequest struct {
+	Notification Notification `json:"notification"`
+}
+
+// NotifyResponse is the response of the notify endpoint.
+type NotifyResponse struct {
+	// Rejected lists the pushkeys which the gateway no longer accepts. The
+	// corresponding pushers should be removed.
+	Rejected []string `json:"rejected"`
+}
+
+// Notification describes an event which a user should be notified about.
+type Notification struct {
+	EventID           string          `json:"event_id,omitempty"`
+	RoomID            string          `json:"room_id,omitempty"`
+	Type              string          `json:"type,omitempty"`
+	Sender            string          `json:"sender,omitempty"`
+	SenderDisplayName string          `json:"sender_display_name,omitempty"`
+	RoomName          string          `json:"room_name,omitempty"`
+	RoomAlias         string          `json:"room_alias,omitempty"`
+	UserIsTarget      bool            `json:"user_is_target,omitempty"`
+	Priority          string          `json:"prio,omitempty"`
+	Content           json.RawMessage `json:"content,omitempty"`
+	Counts            *Counts         `json:"counts,omitempty"`
+	Devices           []Device        `json:"devices"`
+}
+
+// Counts are the badge counts of the user receiving the notification.
+type Counts struct {
+	Unread      int `json:"unread,omitempty"`
+	MissedCalls int `json:"missed_calls,omitempty"`
+}
+
+// Device is a pusher which the notification should be delivered to.
+type Device struct {
+	AppID     string                 `json:"app_id"`
+	PushKey   string                 `json:"pushkey"`
+	PushKeyTS int64                  `json:"pushkey_ts,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+	Tweaks    map[string]interface{} `json:"tweaks,omitempty"`
+}
+
+// StatusError is returned when a push gateway responds with a non-200 status.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("push gateway returned HTTP %d", e.StatusCode)
+}
+
+// Client sends notifications to push gateways. Requests which fail because
+// of a network error or a server error are retried with exponential backoff.
+type Client struct {
+	HTTPClient *http.Client
+	// MaxAttempts is the number of times a notification is sent before
+	// giving up.
+	MaxAttempts int
+	// MinBackoff is how long to wait before the first retry. It doubles
+	// for every further retry.
+	MinBackoff time.Duration
+}
+
+// NewClient creates a new push gateway client with the default retry policy.
+func NewClient() *Client {
+	return &Client{
+		HTTPClient: &http.Client{
+			Timeout: time.Second * 30,
+		},
+		MaxAttempts: 5,
+		MinBackoff:  time.Second,
+	}
+}
+
+// Notify sends the notification to the push gateway at the given URL.
+func (c *Client) Notify(ctx context.Context, url string, req *NotifyRequest) (*NotifyResponse, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	backoff := c.MinBackoff
+	for attempt := 1; ; attempt++ {
+		res, err := c.notify(ctx, url, body)
+		if err == nil {
+			return res, nil
+		}
+		if statusErr, ok := err.(*StatusError); ok && statusErr.StatusCode < http.StatusInternalServerError {
+			// The gateway rejected the request, so retrying won't help.
+			return nil, err
+		}
+		if attempt >= c.MaxAttempts {
+			return nil, err
+		}
+		logrus.WithError(err).WithField("url", url).Warnf("Failed to send push notification, retrying in %s", backoff)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) notify(ctx context.Context, url string, body []byte) (*NotifyResponse, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.HTTPClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close() // nolint: errcheck
+	if resp.StatusCode != http.StatusOK {
+		return nil, &StatusError{StatusCode: resp.StatusCode}
+	}
+	var res NotifyResponse
+	if err = json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
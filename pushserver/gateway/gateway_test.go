@@ -0,0 +1,112 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// stubGateway is a local stand-in for a push gateway which fails the first
+// few requests with the given status before accepting notifications.
+type stubGateway struct {
+	failures   int
+	failStatus int
+	requests   []NotifyRequest
+}
+
+func (g *stubGateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost || req.URL.Path != NotifyPath {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	var body NotifyRequest
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	g.requests = append(g.requests, body)
+	if len(g.requests) <= g.failures {
+		w.WriteHeader(g.failStatus)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(NotifyResponse{Rejected: []string{"stale_key"}})
+}
+
+func testClient() *Client {
+	c := NewClient()
+	c.MaxAttempts = 3
+	c.MinBackoff = time.Millisecond
+	return c
+}
+
+func testNotification() *NotifyRequest {
+	return &NotifyRequest{Notification: Notification{
+		EventID: "$event:test",
+		RoomID:  "!room:test",
+		Devices: []Device{{AppID: "org.example.app", PushKey: "stale_key"}},
+	}}
+}
+
+func TestNotifyRetriesServerErrors(t *testing.T) {
+	gw := &stubGateway{failures: 2, failStatus: http.StatusServiceUnavailable}
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	res, err := testClient().Notify(context.Background(), srv.URL+NotifyPath, testNotification())
+	if err != nil {
+		t.Fatalf("Notify returned %s", err)
+	}
+	if len(gw.requests) != 3 {
+		t.Fatalf("gateway received %d requests, want 3", len(gw.requests))
+	}
+	if gw.requests[2].Notification.EventID != "$event:test" {
+		t.Fatalf("gateway received notification %+v", gw.requests[2].Notification)
+	}
+	if len(res.Rejected) != 1 || res.Rejected[0] != "stale_key" {
+		t.Fatalf("Notify returned rejected pushkeys %v, want [stale_key]", res.Rejected)
+	}
+}
+
+func TestNotifyGivesUp(t *testing.T) {
+	gw := &stubGateway{failures: 10, failStatus: http.StatusBadGateway}
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	if _, err := testClient().Notify(context.Background(), srv.URL+NotifyPath, testNotification()); err == nil {
+		t.Fatalf("Notify did not return an error")
+	}
+	if len(gw.requests) != 3 {
+		t.Fatalf("gateway received %d requests, want 3", len(gw.requests))
+	}
+}
+
+func TestNotifyDoesNotRetryClientErrors(t *testing.T) {
+	gw := &stubGateway{failures: 10, failStatus: http.StatusBadRequest}
+	srv := httptest.NewServer(gw)
+	defer srv.Close()
+
+	_, err := testClient().Notify(context.Background(), srv.URL+NotifyPath, testNotification())
+	if statusErr, ok := err.(*StatusError); !ok || statusErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Notify returned %v, want HTTP 400 error", err)
+	}
+	if len(gw.requests) != 1 {
+		t.Fatalf("gateway received %d requests, want 1", len(gw.requests))
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pushserver
+
+import (
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/internal/basecomponent"
+	"github.com/matrix-org/dendrite/pushserver/consumers"
+	"github.com/matrix-org/dendrite/pushserver/gateway"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/sirupsen/logrus"
+)
+
+// SetupPushServerComponent sets up the push server, which sends push
+// notifications for new room events to the pushers of local users. The
+// notification counts are kept by the sync API, which always runs alongside
+// the push server, so it is given the sync API's database.
+func SetupPushServerComponent(
+	base *basecomponent.BaseDendrite,
+	accountsDB accounts.Database,
+	syncDB storage.Database,
+	rsAPI roomserverAPI.RoomserverInternalAPI,
+) {
+	consumer := consumers.NewOutputRoomEventConsumer(
+		base.Cfg, base.KafkaConsumer, accountsDB, syncDB, rsAPI, gateway.NewClient(),
+	)
+	if err := consumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start push server roomserver consumer")
+	}
+}
@@ -30,6 +30,28 @@ type RoomserverInternalAPI interface {
 		res *PerformLeaveResponse,
 	) error
 
+	// Upgrade a room to a new room version, replacing it with a new room.
+	PerformUpgrade(
+		ctx context.Context,
+		req *PerformUpgradeRequest,
+		res *PerformUpgradeResponse,
+	) error
+
+	// Make local users leave a room, on behalf of a server admin.
+	PerformAdminEvictUsers(
+		ctx context.Context,
+		req *PerformAdminEvictUsersRequest,
+		res *PerformAdminEvictUsersResponse,
+	) error
+
+	// Evict all local users from a room and delete it from the roomserver,
+	// on behalf of a server admin.
+	PerformAdminPurgeRoom(
+		ctx context.Context,
+		req *PerformAdminPurgeRoomRequest,
+		res *PerformAdminPurgeRoomResponse,
+	) error
+
 	// Query the latest events and state for a room from the room server.
 	QueryLatestEventsAndState(
 		ctx context.Context,
@@ -79,6 +101,13 @@ type RoomserverInternalAPI interface {
 		response *QueryServerAllowedToSeeEventResponse,
 	) error
 
+	// Query which of the given events a local user is allowed to see
+	QueryUserAllowedToSeeEvents(
+		ctx context.Context,
+		request *QueryUserAllowedToSeeEventsRequest,
+		response *QueryUserAllowedToSeeEventsResponse,
+	) error
+
 	// Query missing events for a room from roomserver
 	QueryMissingEvents(
 		ctx context.Context,
@@ -116,6 +145,20 @@ type RoomserverInternalAPI interface {
 		response *QueryRoomVersionForRoomResponse,
 	) error
 
+	// Asks for the rooms that a user has a given membership in.
+	QueryRoomsForUser(
+		ctx context.Context,
+		request *QueryRoomsForUserRequest,
+		response *QueryRoomsForUserResponse,
+	) error
+
+	// Asks for the rooms known to the server, with their joined member counts.
+	QueryRooms(
+		ctx context.Context,
+		request *QueryRoomsRequest,
+		response *QueryRoomsResponse,
+	) error
+
 	// Set a room alias
 	SetRoomAlias(
 		ctx context.Context,
@@ -28,6 +28,10 @@ const (
 	OutputTypeNewInviteEvent OutputType = "new_invite_event"
 	// OutputTypeRetireInviteEvent indicates that the event is an OutputRetireInviteEvent
 	OutputTypeRetireInviteEvent OutputType = "retire_invite_event"
+	// OutputTypeRedactedEvent indicates that the event is an OutputRedactedEvent
+	OutputTypeRedactedEvent OutputType = "redacted_event"
+	// OutputTypePurgeRoom indicates that the event is an OutputPurgeRoom
+	OutputTypePurgeRoom OutputType = "purge_room"
 )
 
 // An OutputEvent is an entry in the roomserver output kafka log.
@@ -41,6 +45,10 @@ type OutputEvent struct {
 	NewInviteEvent *OutputNewInviteEvent `json:"new_invite_event,omitempty"`
 	// The content of event with type OutputTypeRetireInviteEvent
 	RetireInviteEvent *OutputRetireInviteEvent `json:"retire_invite_event,omitempty"`
+	// The content of event with type OutputTypeRedactedEvent
+	RedactedEvent *OutputRedactedEvent `json:"redacted_event,omitempty"`
+	// The content of event with type OutputTypePurgeRoom
+	PurgeRoom *OutputPurgeRoom `json:"purge_room,omitempty"`
 }
 
 // An OutputNewRoomEvent is written when the roomserver receives a new event.
@@ -138,3 +146,22 @@ type OutputRetireInviteEvent struct {
 	// "leave" or "ban".
 	Membership string
 }
+
+// An OutputRedactedEvent is written whenever a redaction has been validated and
+// applied to the event that it targets. This may be some time after the
+// redaction itself was written as an OutputNewRoomEvent, e.g. if we didn't
+// have the redacted event at the time.
+type OutputRedactedEvent struct {
+	// The event ID that was redacted
+	RedactedEventID string
+	// The value of `unsigned.redacted_because` - the redaction event itself
+	RedactedBecause gomatrixserverlib.HeaderedEvent
+}
+
+// An OutputPurgeRoom is written when an admin has purged a room from the
+// server. It comes after the leave events of any local users who were still
+// joined. Consumers should delete everything they have stored about the room.
+type OutputPurgeRoom struct {
+	// The ID of the room that was purged.
+	RoomID string
+}
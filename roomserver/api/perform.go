@@ -14,16 +14,60 @@ const (
 
 	// RoomserverPerformLeavePath is the HTTP path for the PerformLeave API.
 	RoomserverPerformLeavePath = "/api/roomserver/performLeave"
+
+	// RoomserverPerformUpgradePath is the HTTP path for the PerformUpgrade API.
+	RoomserverPerformUpgradePath = "/api/roomserver/performUpgrade"
+
+	// RoomserverPerformAdminEvictUsersPath is the HTTP path for the PerformAdminEvictUsers API.
+	RoomserverPerformAdminEvictUsersPath = "/api/roomserver/performAdminEvictUsers"
+
+	// RoomserverPerformAdminPurgeRoomPath is the HTTP path for the PerformAdminPurgeRoom API.
+	RoomserverPerformAdminPurgeRoomPath = "/api/roomserver/performAdminPurgeRoom"
+)
+
+// PerformErrorCode describes why a perform request was rejected.
+type PerformErrorCode int
+
+const (
+	// PerformErrorNotAllowed means that the user isn't allowed to do this.
+	PerformErrorNotAllowed PerformErrorCode = iota + 1
+	// PerformErrorBadRequest means that the request wasn't valid.
+	PerformErrorBadRequest
+	// PerformErrorNoRoom means that the room doesn't exist.
+	PerformErrorNoRoom
+	// PerformErrorUnsupportedRoomVersion means that the requested room
+	// version isn't supported by this server.
+	PerformErrorUnsupportedRoomVersion
+	// PerformErrorGuestAccessForbidden means that the user is a guest and
+	// the room doesn't allow guests to do this.
+	PerformErrorGuestAccessForbidden
 )
 
+// PerformError is returned in a perform response when the request was
+// rejected, as opposed to failing because of an internal error. Unlike an
+// error returned by the API, it survives being sent over HTTP.
+type PerformError struct {
+	Msg  string           `json:"msg"`
+	Code PerformErrorCode `json:"code"`
+}
+
+func (p *PerformError) Error() string {
+	return p.Msg
+}
+
 type PerformJoinRequest struct {
 	RoomIDOrAlias string                         `json:"room_id_or_alias"`
 	UserID        string                         `json:"user_id"`
 	Content       map[string]interface{}         `json:"content"`
 	ServerNames   []gomatrixserverlib.ServerName `json:"server_names"`
+	// Whether the user is a guest, in which case the room must allow guests
+	// to join.
+	IsGuest bool `json:"is_guest"`
 }
 
 type PerformJoinResponse struct {
+	// The error, if the join was rejected.
+	Error *PerformError `json:"error,omitempty"`
 }
 
 func (h *httpRoomserverInternalAPI) PerformJoin(
@@ -57,3 +101,77 @@ func (h *httpRoomserverInternalAPI) PerformLeave(
 	apiURL := h.roomserverURL + RoomserverPerformLeavePath
 	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
+
+type PerformUpgradeRequest struct {
+	RoomID      string                        `json:"room_id"`
+	UserID      string                        `json:"user_id"`
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+}
+
+type PerformUpgradeResponse struct {
+	// The ID of the room which replaces the upgraded room.
+	NewRoomID string `json:"new_room_id"`
+	// Set if the upgrade was rejected.
+	Error *PerformError `json:"error,omitempty"`
+}
+
+func (h *httpRoomserverInternalAPI) PerformUpgrade(
+	ctx context.Context,
+	request *PerformUpgradeRequest,
+	response *PerformUpgradeResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformUpgrade")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformUpgradePath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+type PerformAdminEvictUsersRequest struct {
+	RoomID string `json:"room_id"`
+	// The local users to evict. If empty then all of the local users who are
+	// joined to the room are evicted.
+	UserIDs []string `json:"user_ids"`
+}
+
+type PerformAdminEvictUsersResponse struct {
+	// The users who were made to leave the room.
+	Affected []string `json:"affected"`
+	// Set if the eviction was rejected.
+	Error *PerformError `json:"error,omitempty"`
+}
+
+func (h *httpRoomserverInternalAPI) PerformAdminEvictUsers(
+	ctx context.Context,
+	request *PerformAdminEvictUsersRequest,
+	response *PerformAdminEvictUsersResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAdminEvictUsers")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformAdminEvictUsersPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+type PerformAdminPurgeRoomRequest struct {
+	RoomID string `json:"room_id"`
+}
+
+type PerformAdminPurgeRoomResponse struct {
+	// The local users who were evicted from the room before it was purged.
+	Evicted []string `json:"evicted"`
+	// Set if the purge was rejected.
+	Error *PerformError `json:"error,omitempty"`
+}
+
+func (h *httpRoomserverInternalAPI) PerformAdminPurgeRoom(
+	ctx context.Context,
+	request *PerformAdminPurgeRoomRequest,
+	response *PerformAdminPurgeRoomResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "PerformAdminPurgeRoom")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverPerformAdminPurgeRoomPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
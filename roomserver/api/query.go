@@ -175,6 +175,21 @@ type QueryServerAllowedToSeeEventResponse struct {
 	AllowedToSeeEvent bool `json:"can_see_event"`
 }
 
+// QueryUserAllowedToSeeEventsRequest is a request to QueryUserAllowedToSeeEvents
+type QueryUserAllowedToSeeEventsRequest struct {
+	// The IDs of the events to check, which may be in different rooms.
+	EventIDs []string `json:"event_ids"`
+	// The user interested in the events
+	UserID string `json:"user_id"`
+}
+
+// QueryUserAllowedToSeeEventsResponse is a response to QueryUserAllowedToSeeEvents
+type QueryUserAllowedToSeeEventsResponse struct {
+	// Whether the user is allowed to see each event, by event ID. Events
+	// which don't exist are not allowed.
+	AllowedToSeeEvents map[string]bool `json:"can_see_events"`
+}
+
 // QueryMissingEventsRequest is a request to QueryMissingEvents
 type QueryMissingEventsRequest struct {
 	// Events which are known previous to the gap in the timeline.
@@ -272,6 +287,42 @@ type QueryRoomVersionForRoomResponse struct {
 	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
 }
 
+// QueryRoomsForUserRequest is a request to QueryRoomsForUser
+type QueryRoomsForUserRequest struct {
+	// The user to look up rooms for.
+	UserID string `json:"user_id"`
+	// The membership the user must have in the room, e.g. "join".
+	WantMembership string `json:"want_membership"`
+}
+
+// QueryRoomsForUserResponse is a response to QueryRoomsForUser
+type QueryRoomsForUserResponse struct {
+	// The rooms in which the user has the requested membership.
+	RoomIDs []string `json:"room_ids"`
+}
+
+// RoomSummary is a room known to the roomserver.
+type RoomSummary struct {
+	RoomID      string                        `json:"room_id"`
+	RoomVersion gomatrixserverlib.RoomVersion `json:"room_version"`
+	// The number of users, local or remote, joined to the room.
+	JoinedMembers int `json:"joined_members"`
+}
+
+// QueryRoomsRequest is a request to QueryRooms
+type QueryRoomsRequest struct {
+	// Only return rooms whose IDs sort after this one, for pagination.
+	From string `json:"from"`
+	// The maximum number of rooms to return.
+	Limit int `json:"limit"`
+}
+
+// QueryRoomsResponse is a response to QueryRooms
+type QueryRoomsResponse struct {
+	// The rooms, ordered by room ID.
+	Rooms []RoomSummary `json:"rooms"`
+}
+
 // RoomserverQueryLatestEventsAndStatePath is the HTTP path for the QueryLatestEventsAndState API.
 const RoomserverQueryLatestEventsAndStatePath = "/api/roomserver/queryLatestEventsAndState"
 
@@ -293,6 +344,9 @@ const RoomserverQueryInvitesForUserPath = "/api/roomserver/queryInvitesForUser"
 // RoomserverQueryServerAllowedToSeeEventPath is the HTTP path for the QueryServerAllowedToSeeEvent API
 const RoomserverQueryServerAllowedToSeeEventPath = "/api/roomserver/queryServerAllowedToSeeEvent"
 
+// RoomserverQueryUserAllowedToSeeEventsPath is the HTTP path for the QueryUserAllowedToSeeEvents API
+const RoomserverQueryUserAllowedToSeeEventsPath = "/api/roomserver/queryUserAllowedToSeeEvents"
+
 // RoomserverQueryMissingEventsPath is the HTTP path for the QueryMissingEvents API
 const RoomserverQueryMissingEventsPath = "/api/roomserver/queryMissingEvents"
 
@@ -308,6 +362,12 @@ const RoomserverQueryRoomVersionCapabilitiesPath = "/api/roomserver/queryRoomVer
 // RoomserverQueryRoomVersionForRoomPath is the HTTP path for the QueryRoomVersionForRoom API
 const RoomserverQueryRoomVersionForRoomPath = "/api/roomserver/queryRoomVersionForRoom"
 
+// RoomserverQueryRoomsForUserPath is the HTTP path for the QueryRoomsForUser API
+const RoomserverQueryRoomsForUserPath = "/api/roomserver/queryRoomsForUser"
+
+// RoomserverQueryRoomsPath is the HTTP path for the QueryRooms API
+const RoomserverQueryRoomsPath = "/api/roomserver/queryRooms"
+
 // QueryLatestEventsAndState implements RoomserverQueryAPI
 func (h *httpRoomserverInternalAPI) QueryLatestEventsAndState(
 	ctx context.Context,
@@ -399,6 +459,19 @@ func (h *httpRoomserverInternalAPI) QueryServerAllowedToSeeEvent(
 	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
 }
 
+// QueryUserAllowedToSeeEvents implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	request *QueryUserAllowedToSeeEventsRequest,
+	response *QueryUserAllowedToSeeEventsResponse,
+) (err error) {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryUserAllowedToSeeEvents")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryUserAllowedToSeeEventsPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
 // QueryMissingEvents implements RoomServerQueryAPI
 func (h *httpRoomserverInternalAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -472,3 +545,29 @@ func (h *httpRoomserverInternalAPI) QueryRoomVersionForRoom(
 	}
 	return err
 }
+
+// QueryRoomsForUser implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryRoomsForUser(
+	ctx context.Context,
+	request *QueryRoomsForUserRequest,
+	response *QueryRoomsForUserResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRoomsForUser")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomsForUserPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
+
+// QueryRooms implements RoomserverQueryAPI
+func (h *httpRoomserverInternalAPI) QueryRooms(
+	ctx context.Context,
+	request *QueryRoomsRequest,
+	response *QueryRoomsResponse,
+) error {
+	span, ctx := opentracing.StartSpanFromContext(ctx, "QueryRooms")
+	defer span.Finish()
+
+	apiURL := h.roomserverURL + RoomserverQueryRoomsPath
+	return internalHTTP.PostJSON(ctx, span, h.httpClient, apiURL, request, response)
+}
@@ -27,24 +27,56 @@ func IsServerAllowed(
 	serverCurrentlyInRoom bool,
 	authEvents []gomatrixserverlib.Event,
 ) bool {
-	historyVisibility := HistoryVisibilityForRoom(authEvents)
+	return isAllowed(
+		HistoryVisibilityForRoom(authEvents),
+		IsAnyUserOnServerWithMembership(serverName, authEvents, gomatrixserverlib.Join),
+		IsAnyUserOnServerWithMembership(serverName, authEvents, gomatrixserverlib.Invite),
+		serverCurrentlyInRoom,
+	)
+}
 
+// IsUserAllowed returns true if the user is allowed to see the event, given the
+// state of the room before the event and whether the user is currently joined to
+// the room. The state only needs to contain the history visibility and the
+// membership of the user. This function implements https://matrix.org/docs/spec/client_server/r0.6.0#id87
+func IsUserAllowed(
+	userID string,
+	userCurrentlyInRoom bool,
+	event *gomatrixserverlib.Event,
+	stateAtEvent []gomatrixserverlib.Event,
+) bool {
+	membership := MembershipForUser(userID, stateAtEvent)
+	// Users can always see the events which change their own membership, so
+	// use their membership after the event for those.
+	if event.Type() == gomatrixserverlib.MRoomMember && event.StateKeyEquals(userID) {
+		if m, err := event.Membership(); err == nil {
+			membership = m
+		}
+	}
+	return isAllowed(
+		HistoryVisibilityForRoom(stateAtEvent),
+		membership == gomatrixserverlib.Join,
+		membership == gomatrixserverlib.Invite,
+		userCurrentlyInRoom,
+	)
+}
+
+// isAllowed implements the history visibility rules for both users and servers.
+func isAllowed(historyVisibility string, joined, invited, currentlyInRoom bool) bool {
 	// 1. If the history_visibility was set to world_readable, allow.
 	if historyVisibility == "world_readable" {
 		return true
 	}
 	// 2. If the user's membership was join, allow.
-	joinedUserExists := IsAnyUserOnServerWithMembership(serverName, authEvents, gomatrixserverlib.Join)
-	if joinedUserExists {
+	if joined {
 		return true
 	}
 	// 3. If history_visibility was set to shared, and the user joined the room at any point after the event was sent, allow.
-	if historyVisibility == "shared" && serverCurrentlyInRoom {
+	if historyVisibility == "shared" && currentlyInRoom {
 		return true
 	}
 	// 4. If the user's membership was invite, and the history_visibility was set to invited, allow.
-	invitedUserExists := IsAnyUserOnServerWithMembership(serverName, authEvents, gomatrixserverlib.Invite)
-	if invitedUserExists && historyVisibility == "invited" {
+	if invited && historyVisibility == "invited" {
 		return true
 	}
 
@@ -52,6 +84,22 @@ func IsServerAllowed(
 	return false
 }
 
+// MembershipForUser returns the membership of the user in the given state,
+// or "leave" if the state doesn't contain a membership event for them.
+func MembershipForUser(userID string, stateEvents []gomatrixserverlib.Event) string {
+	for _, ev := range stateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || !ev.StateKeyEquals(userID) {
+			continue
+		}
+		membership, err := ev.Membership()
+		if err != nil {
+			break
+		}
+		return membership
+	}
+	return gomatrixserverlib.Leave
+}
+
 func HistoryVisibilityForRoom(authEvents []gomatrixserverlib.Event) string {
 	// https://matrix.org/docs/spec/client_server/r0.6.0#id87
 	// By default if no history_visibility is set, or if the value is not understood, the visibility is assumed to be shared.
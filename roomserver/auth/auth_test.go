@@ -0,0 +1,103 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package auth
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testUserID = "@alice:localhost"
+
+func mustCreateEvent(t *testing.T, id, evType, stateKey, content string) gomatrixserverlib.Event {
+	t.Helper()
+	eventJSON := fmt.Sprintf(`{
+		"event_id":"%s","room_id":"!room:localhost","type":"%s","state_key":"%s",
+		"sender":"@bob:localhost","content":%s,"depth":1,"origin_server_ts":1,
+		"auth_events":[],"prev_events":[],"hashes":{"sha256":""},"signatures":{}
+	}`, id, evType, stateKey, content)
+	ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to create event: %s", err)
+	}
+	return ev
+}
+
+func visibilityEvent(t *testing.T, visibility string) gomatrixserverlib.Event {
+	return mustCreateEvent(t, "$visibility:localhost", gomatrixserverlib.MRoomHistoryVisibility, "",
+		fmt.Sprintf(`{"history_visibility":"%s"}`, visibility))
+}
+
+func memberEvent(t *testing.T, id, userID, membership string) gomatrixserverlib.Event {
+	return mustCreateEvent(t, id, gomatrixserverlib.MRoomMember, userID,
+		fmt.Sprintf(`{"membership":"%s"}`, membership))
+}
+
+func TestIsUserAllowed(t *testing.T) {
+	message := mustCreateEvent(t, "$message:localhost", "m.room.message", "", `{"body":"hello"}`)
+	messagePtr := &message
+	testCases := []struct {
+		name          string
+		visibility    string
+		membership    string
+		currentlyIn   bool
+		event         *gomatrixserverlib.Event
+		expectAllowed bool
+	}{
+		{"world readable", "world_readable", "", false, messagePtr, true},
+		{"joined at event", "joined", gomatrixserverlib.Join, false, messagePtr, true},
+		{"shared and currently joined", "shared", "", true, messagePtr, true},
+		{"shared and not joined", "shared", "", false, messagePtr, false},
+		{"joined and currently joined", "joined", "", true, messagePtr, false},
+		{"invited at event", "invited", gomatrixserverlib.Invite, false, messagePtr, true},
+		{"invited with joined visibility", "joined", gomatrixserverlib.Invite, false, messagePtr, false},
+		{"left at event", "shared", gomatrixserverlib.Leave, false, messagePtr, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := []gomatrixserverlib.Event{visibilityEvent(t, tc.visibility)}
+			if tc.membership != "" {
+				state = append(state, memberEvent(t, "$member:localhost", testUserID, tc.membership))
+			}
+			if got := IsUserAllowed(testUserID, tc.currentlyIn, tc.event, state); got != tc.expectAllowed {
+				t.Errorf("IsUserAllowed: got %v, want %v", got, tc.expectAllowed)
+			}
+		})
+	}
+}
+
+func TestIsUserAllowedOwnMembership(t *testing.T) {
+	state := []gomatrixserverlib.Event{visibilityEvent(t, "joined")}
+	join := memberEvent(t, "$join:localhost", testUserID, gomatrixserverlib.Join)
+	if !IsUserAllowed(testUserID, false, &join, state) {
+		t.Errorf("expected user to be allowed to see their own join event")
+	}
+	other := memberEvent(t, "$other:localhost", "@bob:localhost", gomatrixserverlib.Join)
+	if IsUserAllowed(testUserID, false, &other, state) {
+		t.Errorf("expected user not to be allowed to see another user's join event")
+	}
+}
+
+func TestMembershipForUser(t *testing.T) {
+	if m := MembershipForUser(testUserID, nil); m != gomatrixserverlib.Leave {
+		t.Errorf("expected default membership to be leave, got %q", m)
+	}
+	state := []gomatrixserverlib.Event{memberEvent(t, "$member:localhost", testUserID, gomatrixserverlib.Ban)}
+	if m := MembershipForUser(testUserID, state); m != gomatrixserverlib.Ban {
+		t.Errorf("expected membership to be ban, got %q", m)
+	}
+}
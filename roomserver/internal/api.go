@@ -72,6 +72,45 @@ func (r *RoomserverInternalAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(api.RoomserverPerformUpgradePath,
+		internal.MakeInternalAPI("performUpgrade", func(req *http.Request) util.JSONResponse {
+			var request api.PerformUpgradeRequest
+			var response api.PerformUpgradeResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformUpgrade(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.RoomserverPerformAdminEvictUsersPath,
+		internal.MakeInternalAPI("performAdminEvictUsers", func(req *http.Request) util.JSONResponse {
+			var request api.PerformAdminEvictUsersRequest
+			var response api.PerformAdminEvictUsersResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformAdminEvictUsers(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(api.RoomserverPerformAdminPurgeRoomPath,
+		internal.MakeInternalAPI("performAdminPurgeRoom", func(req *http.Request) util.JSONResponse {
+			var request api.PerformAdminPurgeRoomRequest
+			var response api.PerformAdminPurgeRoomResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.MessageResponse(http.StatusBadRequest, err.Error())
+			}
+			if err := r.PerformAdminPurgeRoom(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverQueryLatestEventsAndStatePath,
 		internal.MakeInternalAPI("queryLatestEventsAndState", func(req *http.Request) util.JSONResponse {
@@ -170,6 +209,20 @@ func (r *RoomserverInternalAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverQueryUserAllowedToSeeEventsPath,
+		internal.MakeInternalAPI("queryUserAllowedToSeeEvents", func(req *http.Request) util.JSONResponse {
+			var request api.QueryUserAllowedToSeeEventsRequest
+			var response api.QueryUserAllowedToSeeEventsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryUserAllowedToSeeEvents(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverQueryMissingEventsPath,
 		internal.MakeInternalAPI("queryMissingEvents", func(req *http.Request) util.JSONResponse {
@@ -240,6 +293,34 @@ func (r *RoomserverInternalAPI) SetupHTTP(servMux *http.ServeMux) {
 			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
 		}),
 	)
+	servMux.Handle(
+		api.RoomserverQueryRoomsForUserPath,
+		internal.MakeInternalAPI("QueryRoomsForUser", func(req *http.Request) util.JSONResponse {
+			var request api.QueryRoomsForUserRequest
+			var response api.QueryRoomsForUserResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryRoomsForUser(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
+	servMux.Handle(
+		api.RoomserverQueryRoomsPath,
+		internal.MakeInternalAPI("QueryRooms", func(req *http.Request) util.JSONResponse {
+			var request api.QueryRoomsRequest
+			var response api.QueryRoomsResponse
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				return util.ErrorResponse(err)
+			}
+			if err := r.QueryRooms(req.Context(), &request, &response); err != nil {
+				return util.ErrorResponse(err)
+			}
+			return util.JSONResponse{Code: http.StatusOK, JSON: &response}
+		}),
+	)
 	servMux.Handle(
 		api.RoomserverSetRoomAliasPath,
 		internal.MakeInternalAPI("setRoomAlias", func(req *http.Request) util.JSONResponse {
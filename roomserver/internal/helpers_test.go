@@ -0,0 +1,248 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/storage/sqlite3"
+	"github.com/matrix-org/gomatrixserverlib"
+	"golang.org/x/crypto/ed25519"
+)
+
+const testOrigin = gomatrixserverlib.ServerName("test")
+
+// testProducer records the messages which the roomserver writes to Kafka.
+type testProducer struct {
+	messages []*sarama.ProducerMessage
+}
+
+func (p *testProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.messages = append(p.messages, msg)
+	return 0, int64(len(p.messages)), nil
+}
+
+func (p *testProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	p.messages = append(p.messages, msgs...)
+	return nil
+}
+
+func (p *testProducer) Close() error { return nil }
+
+// outputEvents returns the output events written since the last call.
+func (p *testProducer) outputEvents(t *testing.T) []api.OutputEvent {
+	t.Helper()
+	var events []api.OutputEvent
+	for _, msg := range p.messages {
+		value, err := msg.Value.Encode()
+		if err != nil {
+			t.Fatalf("failed to encode output event: %s", err)
+		}
+		var ev api.OutputEvent
+		if err = json.Unmarshal(value, &ev); err != nil {
+			t.Fatalf("failed to unmarshal output event: %s", err)
+		}
+		events = append(events, ev)
+	}
+	p.messages = nil
+	return events
+}
+
+// mustCreateRoomserverAPI returns a roomserver for the server "test" backed
+// by a temporary sqlite database.
+func mustCreateRoomserverAPI(t *testing.T) (*RoomserverInternalAPI, *testProducer, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "dendrite-roomserver")
+	if err != nil {
+		t.Fatalf("failed to create temporary directory: %s", err)
+	}
+	db, err := sqlite3.Open("file:" + filepath.Join(dir, "roomserver.db"))
+	if err != nil {
+		t.Fatalf("failed to open roomserver database: %s", err)
+	}
+	cfg := &config.Dendrite{}
+	cfg.Matrix.ServerName = testOrigin
+	cfg.Matrix.KeyID = "ed25519:test"
+	cfg.Matrix.PrivateKey = ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	producer := &testProducer{}
+	r := &RoomserverInternalAPI{
+		DB:                   db,
+		Cfg:                  cfg,
+		Producer:             producer,
+		ServerName:           testOrigin,
+		OutputRoomEventTopic: "roomserverOutput",
+	}
+	return r, producer, func() {
+		os.RemoveAll(dir) // nolint: errcheck
+	}
+}
+
+// testRoom builds the events of a room and sends them to a roomserver,
+// keeping track of the current state so that it can fill in the auth events.
+type testRoom struct {
+	r      *RoomserverInternalAPI
+	roomID string
+	state  map[gomatrixserverlib.StateKeyTuple]gomatrixserverlib.Event
+	latest []gomatrixserverlib.Event
+}
+
+// newTestRoom creates a public room on the roomserver in which the creator
+// has power level 100 and the given users have the given power levels, and
+// joins all of those users to it.
+func newTestRoom(t *testing.T, r *RoomserverInternalAPI, creator string, powerLevels map[string]interface{}) *testRoom {
+	t.Helper()
+	room := &testRoom{
+		r:      r,
+		roomID: "!room:" + string(testOrigin),
+		state:  make(map[gomatrixserverlib.StateKeyTuple]gomatrixserverlib.Event),
+	}
+	room.sendState(t, creator, gomatrixserverlib.MRoomCreate, "", map[string]interface{}{"creator": creator})
+	room.sendState(t, creator, gomatrixserverlib.MRoomMember, creator, map[string]interface{}{"membership": "join"})
+	room.sendState(t, creator, gomatrixserverlib.MRoomPowerLevels, "", powerLevels)
+	room.sendState(t, creator, gomatrixserverlib.MRoomJoinRules, "", map[string]interface{}{"join_rule": "public"})
+	if users, ok := powerLevels["users"].(map[string]interface{}); ok {
+		for userID := range users {
+			if userID != creator {
+				room.sendState(t, userID, gomatrixserverlib.MRoomMember, userID, map[string]interface{}{"membership": "join"})
+			}
+		}
+	}
+	return room
+}
+
+// build builds an event on top of the given events, or the latest events
+// in the room if there are none.
+func (room *testRoom) build(
+	t *testing.T, sender, eventType string, stateKey *string, content interface{}, redacts string,
+	prevEvents ...gomatrixserverlib.Event,
+) gomatrixserverlib.Event {
+	t.Helper()
+	if len(prevEvents) == 0 {
+		prevEvents = room.latest
+	}
+	builder := gomatrixserverlib.EventBuilder{
+		Sender:   sender,
+		RoomID:   room.roomID,
+		Type:     eventType,
+		StateKey: stateKey,
+		Redacts:  redacts,
+	}
+	if err := builder.SetContent(content); err != nil {
+		t.Fatalf("failed to set content: %s", err)
+	}
+	var prevRefs []gomatrixserverlib.EventReference
+	for _, ev := range prevEvents {
+		prevRefs = append(prevRefs, ev.EventReference())
+		if ev.Depth() >= builder.Depth {
+			builder.Depth = ev.Depth() + 1
+		}
+	}
+	builder.PrevEvents = prevRefs
+	stateNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+	if err != nil {
+		t.Fatalf("failed to work out auth events: %s", err)
+	}
+	var authRefs []gomatrixserverlib.EventReference
+	for _, tuple := range stateNeeded.Tuples() {
+		if ev, ok := room.state[tuple]; ok {
+			authRefs = append(authRefs, ev.EventReference())
+		}
+	}
+	builder.AuthEvents = authRefs
+	// The roomserver doesn't check signatures, so every server can use
+	// our key.
+	_, origin, err := gomatrixserverlib.SplitID('@', sender)
+	if err != nil {
+		t.Fatalf("invalid sender %s: %s", sender, err)
+	}
+	cfg := room.r.Cfg
+	ev, err := builder.Build(
+		time.Now(), origin, cfg.Matrix.KeyID, cfg.Matrix.PrivateKey,
+		gomatrixserverlib.RoomVersionV1,
+	)
+	if err != nil {
+		t.Fatalf("failed to build event: %s", err)
+	}
+	return ev
+}
+
+// withEventIDDomain returns the event with its event ID moved to the given
+// domain, as a server other than the sender's could send it in room v1.
+func withEventIDDomain(t *testing.T, ev gomatrixserverlib.Event, domain gomatrixserverlib.ServerName) gomatrixserverlib.Event {
+	t.Helper()
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(ev.JSON(), &fields); err != nil {
+		t.Fatalf("failed to unmarshal event: %s", err)
+	}
+	localpart, _, err := gomatrixserverlib.SplitID('$', ev.EventID())
+	if err != nil {
+		t.Fatalf("invalid event ID %s: %s", ev.EventID(), err)
+	}
+	if fields["event_id"], err = json.Marshal("$" + localpart + ":" + string(domain)); err != nil {
+		t.Fatalf("failed to marshal event ID: %s", err)
+	}
+	eventJSON, err := json.Marshal(fields)
+	if err != nil {
+		t.Fatalf("failed to marshal event: %s", err)
+	}
+	moved, err := gomatrixserverlib.NewEventFromTrustedJSON(eventJSON, false, gomatrixserverlib.RoomVersionV1)
+	if err != nil {
+		t.Fatalf("failed to parse event: %s", err)
+	}
+	return moved
+}
+
+// send sends a built event to the roomserver as a new event, and makes it
+// the latest event in the room.
+func (room *testRoom) send(t *testing.T, ev gomatrixserverlib.Event) {
+	t.Helper()
+	err := room.r.InputRoomEvents(context.Background(), &api.InputRoomEventsRequest{
+		InputRoomEvents: []api.InputRoomEvent{{
+			Kind:         api.KindNew,
+			Event:        ev.Headered(gomatrixserverlib.RoomVersionV1),
+			AuthEventIDs: ev.AuthEventIDs(),
+		}},
+	}, &api.InputRoomEventsResponse{})
+	if err != nil {
+		t.Fatalf("failed to send event %s: %s", ev.EventID(), err)
+	}
+	if ev.StateKey() != nil {
+		room.state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+	}
+	room.latest = []gomatrixserverlib.Event{ev}
+}
+
+func (room *testRoom) sendState(t *testing.T, sender, eventType, stateKey string, content interface{}) gomatrixserverlib.Event {
+	t.Helper()
+	ev := room.build(t, sender, eventType, &stateKey, content, "")
+	room.send(t, ev)
+	return ev
+}
+
+func (room *testRoom) sendMessage(t *testing.T, sender, body string) gomatrixserverlib.Event {
+	t.Helper()
+	ev := room.build(t, sender, "m.room.message", nil, map[string]interface{}{"msgtype": "m.text", "body": body}, "")
+	room.send(t, ev)
+	return ev
+}
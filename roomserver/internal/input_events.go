@@ -70,6 +70,14 @@ func (r *RoomserverInternalAPI) processRoomEvent(
 		return
 	}
 
+	// If the event is a redaction, or the target of a redaction that we
+	// already have, then apply the redaction. If the event itself was
+	// redacted then we carry on with the redacted form.
+	event, err = r.processRedaction(ctx, headered.RoomVersion, event, stateAtEvent.EventNID)
+	if err != nil {
+		return
+	}
+
 	// For outliers we can stop after we've stored the event itself as it
 	// doesn't have any associated state to store and we don't need to
 	// notify anyone about it.
@@ -0,0 +1,173 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/sirupsen/logrus"
+)
+
+// processRedaction applies a redaction to the event that it targets, if we
+// have both the redaction and the target event and the redaction is allowed.
+// The event is either a redaction itself, or an event that may be the target
+// of a redaction that we received earlier. If the event itself was redacted
+// then its redacted form is returned, so that it can be sent on to consumers
+// in that form, otherwise the event is returned unchanged.
+func (r *RoomserverInternalAPI) processRedaction(
+	ctx context.Context,
+	roomVersion gomatrixserverlib.RoomVersion,
+	event gomatrixserverlib.Event,
+	eventNID types.EventNID,
+) (gomatrixserverlib.Event, error) {
+	var redactionEvent, redactedEvent gomatrixserverlib.Event
+	var redactedEventNID types.EventNID
+
+	if event.Type() == gomatrixserverlib.MRoomRedaction && event.Redacts() != "" {
+		// The event is a redaction. Record it so that we can apply it later
+		// if we don't have the event that it targets yet.
+		if err := r.DB.StoreRedaction(ctx, event.EventID(), event.Redacts()); err != nil {
+			return event, fmt.Errorf("r.DB.StoreRedaction: %w", err)
+		}
+		targets, err := r.DB.EventsFromIDs(ctx, []string{event.Redacts()})
+		if err != nil {
+			return event, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+		}
+		if len(targets) == 0 {
+			return event, nil
+		}
+		redactionEvent = event
+		redactedEvent, redactedEventNID = targets[0].Event, targets[0].EventNID
+	} else {
+		// The event might be the target of a redaction that we received
+		// before the event itself.
+		redactionIDs, err := r.DB.PendingRedactions(ctx, event.EventID())
+		if err != nil {
+			return event, fmt.Errorf("r.DB.PendingRedactions: %w", err)
+		}
+		if len(redactionIDs) == 0 {
+			return event, nil
+		}
+		redactions, err := r.DB.EventsFromIDs(ctx, redactionIDs[:1])
+		if err != nil {
+			return event, fmt.Errorf("r.DB.EventsFromIDs: %w", err)
+		}
+		if len(redactions) == 0 {
+			return event, nil
+		}
+		redactionEvent = redactions[0].Event
+		redactedEvent, redactedEventNID = event, eventNID
+	}
+
+	if redactedEvent.RoomID() != redactionEvent.RoomID() {
+		// Redactions can only apply to events in the same room.
+		return event, nil
+	}
+	allowed, err := r.redactionAllowed(ctx, &redactionEvent, &redactedEvent)
+	if err != nil {
+		return event, fmt.Errorf("r.redactionAllowed: %w", err)
+	}
+	if !allowed {
+		logrus.WithFields(logrus.Fields{
+			"redaction_event_id": redactionEvent.EventID(),
+			"redacts_event_id":   redactedEvent.EventID(),
+		}).Info("Ignoring redaction that isn't allowed")
+		return event, nil
+	}
+
+	// Strip the event down to its redacted form and note which event
+	// redacted it, as clients expect to see in the unsigned section.
+	// Events that came to us as headered events are already flagged as
+	// redacted, which would make Redact a no-op, so reparse them first.
+	unredacted, err := gomatrixserverlib.NewEventFromTrustedJSON(redactedEvent.JSON(), false, roomVersion)
+	if err != nil {
+		return event, fmt.Errorf("gomatrixserverlib.NewEventFromTrustedJSON: %w", err)
+	}
+	stripped := unredacted.Redact()
+	redacted, err := gomatrixserverlib.NewEventFromTrustedJSON(stripped.JSON(), true, roomVersion)
+	if err != nil {
+		return event, fmt.Errorf("gomatrixserverlib.NewEventFromTrustedJSON: %w", err)
+	}
+	redacted, err = redacted.SetUnsigned(map[string]interface{}{
+		"redacted_because": gomatrixserverlib.RawJSON(redactionEvent.JSON()),
+	})
+	if err != nil {
+		return event, fmt.Errorf("redacted.SetUnsigned: %w", err)
+	}
+	if err = r.DB.RedactEvent(ctx, redactionEvent.EventID(), redactedEventNID, redacted.JSON()); err != nil {
+		return event, fmt.Errorf("r.DB.RedactEvent: %w", err)
+	}
+
+	if redactedEvent.EventID() == event.EventID() {
+		// The event itself was redacted, so it will be sent on to consumers
+		// in its redacted form.
+		return redacted, nil
+	}
+
+	// Otherwise we've already sent the redacted event on to consumers, so
+	// tell them that it has now been redacted.
+	return event, r.WriteOutputEvents(event.RoomID(), []api.OutputEvent{
+		{
+			Type: api.OutputTypeRedactedEvent,
+			RedactedEvent: &api.OutputRedactedEvent{
+				RedactedEventID: redactedEvent.EventID(),
+				RedactedBecause: redactionEvent.Headered(roomVersion),
+			},
+		},
+	})
+}
+
+// redactionAllowed returns true if the sender of the redaction is allowed to
+// redact the event. Servers are always allowed to redact their own users'
+// events, otherwise the sender needs the "redact" power level.
+func (r *RoomserverInternalAPI) redactionAllowed(
+	ctx context.Context, redactionEvent, redactedEvent *gomatrixserverlib.Event,
+) (bool, error) {
+	_, redactionDomain, err := gomatrixserverlib.SplitID('@', redactionEvent.Sender())
+	if err != nil {
+		return false, err
+	}
+	_, redactedDomain, err := gomatrixserverlib.SplitID('@', redactedEvent.Sender())
+	if err != nil {
+		return false, err
+	}
+	if redactionDomain == redactedDomain {
+		return true, nil
+	}
+
+	// Work out the power levels from the auth events of the redaction.
+	authEvents, err := r.DB.EventsFromIDs(ctx, redactionEvent.AuthEventIDs())
+	if err != nil {
+		return false, err
+	}
+	var creatorUserID string
+	authEventPtrs := make([]*gomatrixserverlib.Event, len(authEvents))
+	for i := range authEvents {
+		authEventPtrs[i] = &authEvents[i].Event
+		if authEvents[i].Type() == gomatrixserverlib.MRoomCreate {
+			creatorUserID = authEvents[i].Sender()
+		}
+	}
+	provider := gomatrixserverlib.NewAuthEvents(authEventPtrs)
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(&provider, creatorUserID)
+	if err != nil {
+		return false, err
+	}
+	return powerLevels.UserLevel(redactionEvent.Sender()) >= powerLevels.Redact, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/tidwall/gjson"
+)
+
+// Alice is an admin on our server, Bob and Carol are ordinary users on
+// other servers.
+func newRedactionTestRoom(t *testing.T, r *RoomserverInternalAPI) *testRoom {
+	return newTestRoom(t, r, "@alice:test", map[string]interface{}{
+		"users":  map[string]interface{}{"@alice:test": 100, "@bob:remote": 0, "@carol:other": 0},
+		"redact": 50,
+	})
+}
+
+// mustStoredEvent returns the event as it is now stored by the roomserver.
+func mustStoredEvent(t *testing.T, r *RoomserverInternalAPI, eventID string) gomatrixserverlib.Event {
+	t.Helper()
+	events, err := r.DB.EventsFromIDs(context.Background(), []string{eventID})
+	if err != nil || len(events) != 1 {
+		t.Fatalf("failed to get event %s: %v", eventID, err)
+	}
+	return events[0].Event
+}
+
+func isRedacted(ev gomatrixserverlib.Event, redactionEventID string) bool {
+	return !gjson.GetBytes(ev.Content(), "body").Exists() &&
+		gjson.GetBytes(ev.Unsigned(), "redacted_because.event_id").Str == redactionEventID
+}
+
+func TestRedactionAfterTarget(t *testing.T) {
+	r, producer, cleanup := mustCreateRoomserverAPI(t)
+	defer cleanup()
+	room := newRedactionTestRoom(t, r)
+
+	tests := []struct {
+		name          string
+		eventIDDomain gomatrixserverlib.ServerName
+		redactedBy    string
+		wantRedacted  bool
+	}{
+		// Anyone can redact events sent by users on their own server.
+		{"own event", "remote", "@bob:remote", true},
+		// Otherwise the redact power level is needed.
+		{"with power level", "remote", "@alice:test", true},
+		// Event auth in room v1 only compares the domain of the redaction's
+		// sender with the domain of the target's event ID, which needn't be
+		// the domain of its sender, so this redaction is accepted but must
+		// not be applied.
+		{"without power level", "other", "@carol:other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := withEventIDDomain(t, room.build(t, "@bob:remote", "m.room.message", nil, map[string]interface{}{"msgtype": "m.text", "body": "hello"}, ""), tt.eventIDDomain)
+			room.send(t, target)
+			producer.outputEvents(t)
+
+			redaction := room.build(t, tt.redactedBy, gomatrixserverlib.MRoomRedaction, nil, map[string]interface{}{}, target.EventID())
+			room.send(t, redaction)
+
+			stored := mustStoredEvent(t, r, target.EventID())
+			if got := isRedacted(stored, redaction.EventID()); got != tt.wantRedacted {
+				t.Fatalf("target redacted is %v, want %v", got, tt.wantRedacted)
+			}
+			if !tt.wantRedacted && string(stored.JSON()) != string(target.JSON()) {
+				t.Fatalf("target was changed to %s", stored.JSON())
+			}
+			// Consumers have already seen the target, so they are told
+			// about the redaction.
+			var gotOutput bool
+			for _, ev := range producer.outputEvents(t) {
+				if ev.Type == api.OutputTypeRedactedEvent {
+					gotOutput = true
+					if ev.RedactedEvent.RedactedEventID != target.EventID() {
+						t.Errorf("redacted event output for %s, want %s", ev.RedactedEvent.RedactedEventID, target.EventID())
+					}
+				}
+			}
+			if gotOutput != tt.wantRedacted {
+				t.Errorf("redacted event output is %v, want %v", gotOutput, tt.wantRedacted)
+			}
+		})
+	}
+}
+
+func TestRedactionBeforeTarget(t *testing.T) {
+	r, producer, cleanup := mustCreateRoomserverAPI(t)
+	defer cleanup()
+	room := newRedactionTestRoom(t, r)
+
+	tests := []struct {
+		name          string
+		eventIDDomain gomatrixserverlib.ServerName
+		redactedBy    string
+		wantRedacted  bool
+	}{
+		{"own event", "remote", "@bob:remote", true},
+		{"with power level", "remote", "@alice:test", true},
+		{"without power level", "other", "@carol:other", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Build the target first, but send the redaction first.
+			prev := room.latest
+			target := withEventIDDomain(t, room.build(t, "@bob:remote", "m.room.message", nil, map[string]interface{}{"msgtype": "m.text", "body": "hello"}, "", prev...), tt.eventIDDomain)
+			redaction := room.build(t, tt.redactedBy, gomatrixserverlib.MRoomRedaction, nil, map[string]interface{}{}, target.EventID(), prev...)
+			room.send(t, redaction)
+			producer.outputEvents(t)
+			room.send(t, target)
+
+			stored := mustStoredEvent(t, r, target.EventID())
+			if got := isRedacted(stored, redaction.EventID()); got != tt.wantRedacted {
+				t.Fatalf("target redacted is %v, want %v", got, tt.wantRedacted)
+			}
+			if !tt.wantRedacted && string(stored.JSON()) != string(target.JSON()) {
+				t.Fatalf("target was changed to %s", stored.JSON())
+			}
+			// Consumers haven't seen the target yet, so they get it in
+			// its redacted form.
+			var found bool
+			for _, ev := range producer.outputEvents(t) {
+				switch {
+				case ev.Type == api.OutputTypeRedactedEvent:
+					t.Errorf("unexpected redacted event output for %s", ev.RedactedEvent.RedactedEventID)
+				case ev.Type == api.OutputTypeNewRoomEvent && ev.NewRoomEvent.Event.EventID() == target.EventID():
+					found = true
+					if got := isRedacted(ev.NewRoomEvent.Event.Unwrap(), redaction.EventID()); got != tt.wantRedacted {
+						t.Errorf("output target redacted is %v, want %v", got, tt.wantRedacted)
+					}
+				}
+			}
+			if !found {
+				t.Errorf("no output event for the target")
+			}
+		})
+	}
+}
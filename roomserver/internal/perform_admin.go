@@ -0,0 +1,139 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// PerformAdminEvictUsers implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformAdminEvictUsers(
+	ctx context.Context,
+	req *api.PerformAdminEvictUsersRequest,
+	res *api.PerformAdminEvictUsersResponse,
+) error {
+	for _, userID := range req.UserIDs {
+		_, domain, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil || domain != r.Cfg.Matrix.ServerName {
+			res.Error = &api.PerformError{
+				Code: api.PerformErrorBadRequest,
+				Msg:  fmt.Sprintf("User %q is not a local user", userID),
+			}
+			return nil
+		}
+	}
+
+	joined, err := r.localJoinedUsers(ctx, req.RoomID)
+	if err != nil {
+		return err
+	}
+	if joined == nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %q does not exist", req.RoomID),
+		}
+		return nil
+	}
+
+	userIDs := req.UserIDs
+	if len(userIDs) == 0 {
+		for userID := range joined {
+			userIDs = append(userIDs, userID)
+		}
+	}
+	res.Affected = []string{}
+	for _, userID := range userIDs {
+		if !joined[userID] {
+			// There's nothing to do for users who aren't in the room.
+			continue
+		}
+		leaveReq := api.PerformLeaveRequest{
+			RoomID: req.RoomID,
+			UserID: userID,
+		}
+		leaveRes := api.PerformLeaveResponse{}
+		if err = r.PerformLeave(ctx, &leaveReq, &leaveRes); err != nil {
+			return fmt.Errorf("r.PerformLeave: %w", err)
+		}
+		res.Affected = append(res.Affected, userID)
+	}
+	return nil
+}
+
+// PerformAdminPurgeRoom implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformAdminPurgeRoom(
+	ctx context.Context,
+	req *api.PerformAdminPurgeRoomRequest,
+	res *api.PerformAdminPurgeRoomResponse,
+) error {
+	// Make everyone leave first, so that the other components and the
+	// clients of the evicted users find out that they're no longer in the
+	// room. The rest of the federation will see the leaves too.
+	evictReq := api.PerformAdminEvictUsersRequest{RoomID: req.RoomID}
+	evictRes := api.PerformAdminEvictUsersResponse{}
+	if err := r.PerformAdminEvictUsers(ctx, &evictReq, &evictRes); err != nil {
+		return err
+	}
+	if evictRes.Error != nil {
+		res.Error = evictRes.Error
+		return nil
+	}
+	res.Evicted = evictRes.Affected
+
+	if err := r.DB.PurgeRoom(ctx, req.RoomID); err != nil {
+		return fmt.Errorf("r.DB.PurgeRoom: %w", err)
+	}
+
+	// Tell the other components to purge the room too.
+	return r.WriteOutputEvents(req.RoomID, []api.OutputEvent{
+		{
+			Type:      api.OutputTypePurgeRoom,
+			PurgeRoom: &api.OutputPurgeRoom{RoomID: req.RoomID},
+		},
+	})
+}
+
+// localJoinedUsers returns the set of local users who are joined to the room,
+// or nil if the room doesn't exist.
+func (r *RoomserverInternalAPI) localJoinedUsers(
+	ctx context.Context, roomID string,
+) (map[string]bool, error) {
+	latestReq := api.QueryLatestEventsAndStateRequest{RoomID: roomID}
+	latestRes := api.QueryLatestEventsAndStateResponse{}
+	if err := r.QueryLatestEventsAndState(ctx, &latestReq, &latestRes); err != nil {
+		return nil, fmt.Errorf("r.QueryLatestEventsAndState: %w", err)
+	}
+	if !latestRes.RoomExists {
+		return nil, nil
+	}
+	joined := map[string]bool{}
+	for _, ev := range latestRes.StateEvents {
+		if ev.Type() != gomatrixserverlib.MRoomMember || ev.StateKey() == nil {
+			continue
+		}
+		_, domain, err := gomatrixserverlib.SplitID('@', *ev.StateKey())
+		if err != nil || domain != r.Cfg.Matrix.ServerName {
+			continue
+		}
+		if membership, err := ev.Membership(); err == nil && membership == gomatrixserverlib.Join {
+			joined[*ev.StateKey()] = true
+		}
+	}
+	return joined, nil
+}
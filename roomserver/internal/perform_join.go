@@ -2,6 +2,7 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 	"time"
@@ -167,6 +168,21 @@ func (r *RoomserverInternalAPI) performJoinRoomByID(
 			}
 		}
 
+		// Guests can only join rooms which allow guest access.
+		if req.IsGuest && !alreadyJoined {
+			var canJoin bool
+			if canJoin, err = r.guestCanJoin(ctx, req.RoomIDOrAlias); err != nil {
+				return fmt.Errorf("r.guestCanJoin: %w", err)
+			}
+			if !canJoin {
+				res.Error = &api.PerformError{
+					Code: api.PerformErrorGuestAccessForbidden,
+					Msg:  "Guest access is not allowed in this room",
+				}
+				return nil
+			}
+		}
+
 		// If we haven't already joined the room then send an event
 		// into the room changing our membership status.
 		if !alreadyJoined {
@@ -205,6 +221,29 @@ func (r *RoomserverInternalAPI) performJoinRoomByID(
 	return nil
 }
 
+// guestCanJoin returns whether the current m.room.guest_access state of the
+// room allows guests to join it.
+func (r *RoomserverInternalAPI) guestCanJoin(ctx context.Context, roomID string) (bool, error) {
+	queryReq := api.QueryLatestEventsAndStateRequest{
+		RoomID: roomID,
+		StateToFetch: []gomatrixserverlib.StateKeyTuple{
+			{EventType: "m.room.guest_access", StateKey: ""},
+		},
+	}
+	var queryRes api.QueryLatestEventsAndStateResponse
+	if err := r.QueryLatestEventsAndState(ctx, &queryReq, &queryRes); err != nil {
+		return false, err
+	}
+	for _, ev := range queryRes.StateEvents {
+		var content internal.GuestAccessContent
+		if err := json.Unmarshal(ev.Content(), &content); err != nil {
+			return false, err
+		}
+		return content.GuestAccess == "can_join", nil
+	}
+	return false, nil
+}
+
 func (r *RoomserverInternalAPI) performFederatedJoinRoomByID(
 	ctx context.Context,
 	req *api.PerformJoinRequest,
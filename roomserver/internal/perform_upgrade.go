@@ -0,0 +1,433 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/roomserver/version"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+// upgradeStateTypes are the types of the state events which are copied from
+// the old room into the replacement room, in the order that they are sent.
+var upgradeStateTypes = []string{
+	gomatrixserverlib.MRoomJoinRules,
+	gomatrixserverlib.MRoomHistoryVisibility,
+	"m.room.guest_access",
+	gomatrixserverlib.MRoomName,
+	"m.room.topic",
+	"m.room.avatar",
+	"m.room.encryption",
+	"m.room.server_acl",
+	gomatrixserverlib.MRoomCanonicalAlias,
+}
+
+// PerformUpgrade implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) PerformUpgrade(
+	ctx context.Context,
+	req *api.PerformUpgradeRequest,
+	res *api.PerformUpgradeResponse,
+) error {
+	_, domain, err := gomatrixserverlib.SplitID('@', req.UserID)
+	if err != nil {
+		return fmt.Errorf("Supplied user ID %q in incorrect format", req.UserID)
+	}
+	if domain != r.Cfg.Matrix.ServerName {
+		return fmt.Errorf("User %q does not belong to this homeserver", req.UserID)
+	}
+	if _, err = version.SupportedRoomVersion(req.RoomVersion); err != nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorUnsupportedRoomVersion,
+			Msg:  fmt.Sprintf("Room version %q is not supported by this server", req.RoomVersion),
+		}
+		return nil
+	}
+
+	// Get the current state of the old room.
+	latestReq := api.QueryLatestEventsAndStateRequest{RoomID: req.RoomID}
+	latestRes := api.QueryLatestEventsAndStateResponse{}
+	if err = r.QueryLatestEventsAndState(ctx, &latestReq, &latestRes); err != nil {
+		return fmt.Errorf("r.QueryLatestEventsAndState: %w", err)
+	}
+	if !latestRes.RoomExists {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNoRoom,
+			Msg:  fmt.Sprintf("Room %q does not exist", req.RoomID),
+		}
+		return nil
+	}
+	oldState := make(map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event, len(latestRes.StateEvents))
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for i := range latestRes.StateEvents {
+		ev := &latestRes.StateEvents[i].Event
+		oldState[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+		if err = authEvents.AddEvent(ev); err != nil {
+			return fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+	}
+
+	// Only users who are joined to the room and who are allowed to send the
+	// tombstone can upgrade it.
+	memberEvent := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: req.UserID}]
+	if memberEvent == nil {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("User %q is not a member of room %q", req.UserID, req.RoomID),
+		}
+		return nil
+	}
+	if membership, merr := memberEvent.Membership(); merr != nil || membership != gomatrixserverlib.Join {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  fmt.Sprintf("User %q is not joined to room %q", req.UserID, req.RoomID),
+		}
+		return nil
+	}
+	createEvent := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomCreate, StateKey: ""}]
+	if createEvent == nil {
+		return fmt.Errorf("Room %q has no create event", req.RoomID)
+	}
+	powerLevels, err := gomatrixserverlib.NewPowerLevelContentFromAuthEvents(&authEvents, createEvent.Sender())
+	if err != nil {
+		return fmt.Errorf("gomatrixserverlib.NewPowerLevelContentFromAuthEvents: %w", err)
+	}
+	if powerLevels.UserLevel(req.UserID) < powerLevels.EventLevel("m.room.tombstone", true) {
+		res.Error = &api.PerformError{
+			Code: api.PerformErrorNotAllowed,
+			Msg:  "You don't have permission to upgrade this room",
+		}
+		return nil
+	}
+
+	newRoomID := fmt.Sprintf("!%s:%s", util.RandomString(16), r.Cfg.Matrix.ServerName)
+
+	// Build the tombstone first, so that the new room can refer to it as the
+	// last event in the old room. It isn't sent until the new room exists.
+	tombstone, oldRoomVersion, err := r.buildUpgradeEvent(ctx, req.UserID, req.RoomID, "m.room.tombstone", internal.TombstoneContent{
+		Body:            "This room has been replaced",
+		ReplacementRoom: newRoomID,
+	})
+	if err != nil {
+		return fmt.Errorf("r.buildUpgradeEvent: %w", err)
+	}
+
+	newRoomEvents, err := r.buildReplacementRoomEvents(
+		req, newRoomID, tombstone.EventID(), createEvent, memberEvent, oldState, &powerLevels,
+	)
+	if err != nil {
+		return fmt.Errorf("r.buildReplacementRoomEvents: %w", err)
+	}
+	if err = r.sendUpgradeEvents(ctx, newRoomEvents); err != nil {
+		return fmt.Errorf("r.sendUpgradeEvents: %w", err)
+	}
+
+	// Now that the replacement room exists, send the tombstone into the old
+	// room.
+	if err = r.sendUpgradeEvents(ctx, []gomatrixserverlib.HeaderedEvent{tombstone.Headered(oldRoomVersion)}); err != nil {
+		return fmt.Errorf("r.sendUpgradeEvents: %w", err)
+	}
+	res.NewRoomID = newRoomID
+
+	// Move the local aliases over to the replacement room. The public room
+	// directory picks up the tombstone and moves its entry by itself.
+	if err = r.moveLocalAliases(ctx, req.UserID, req.RoomID, newRoomID); err != nil {
+		return fmt.Errorf("r.moveLocalAliases: %w", err)
+	}
+
+	// Finally, stop people from talking in the old room, if the user is
+	// allowed to do that.
+	if err = r.restrictOldRoom(ctx, req.UserID, req.RoomID, oldState, &powerLevels); err != nil {
+		return fmt.Errorf("r.restrictOldRoom: %w", err)
+	}
+	return nil
+}
+
+// buildReplacementRoomEvents builds the events which make up the replacement
+// room: the create event, the user's join, the power levels and the state
+// copied from the old room.
+// nolint:gocyclo
+func (r *RoomserverInternalAPI) buildReplacementRoomEvents(
+	req *api.PerformUpgradeRequest,
+	newRoomID, lastEventID string,
+	oldCreateEvent, oldMemberEvent *gomatrixserverlib.Event,
+	oldState map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event,
+	powerLevels *gomatrixserverlib.PowerLevelContent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	type upgradeEvent struct {
+		Type     string
+		StateKey string
+		Content  interface{}
+	}
+
+	createContent := map[string]interface{}{
+		"creator":      req.UserID,
+		"room_version": req.RoomVersion,
+		"predecessor": map[string]string{
+			"room_id":  req.RoomID,
+			"event_id": lastEventID,
+		},
+	}
+	var oldCreateContent map[string]interface{}
+	if err := json.Unmarshal(oldCreateEvent.Content(), &oldCreateContent); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if federate, ok := oldCreateContent["m.federate"]; ok {
+		createContent["m.federate"] = federate
+	}
+
+	memberContent := gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Join}
+	if err := json.Unmarshal(oldMemberEvent.Content(), &memberContent); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	memberContent.Membership = gomatrixserverlib.Join
+
+	// The user might not have enough power to send all of the copied state,
+	// in which case they get it temporarily and the original power levels are
+	// restored afterwards.
+	var powerLevelsContent map[string]interface{}
+	if plEvent := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]; plEvent != nil {
+		if err := json.Unmarshal(plEvent.Content(), &powerLevelsContent); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	} else {
+		content := *powerLevels
+		content.Users = map[string]int64{req.UserID: powerLevels.UserLevel(req.UserID)}
+		js, err := json.Marshal(content)
+		if err != nil {
+			return nil, fmt.Errorf("json.Marshal: %w", err)
+		}
+		if err = json.Unmarshal(js, &powerLevelsContent); err != nil {
+			return nil, fmt.Errorf("json.Unmarshal: %w", err)
+		}
+	}
+	neededLevel := powerLevels.StateDefault
+	if powerLevels.Ban > neededLevel {
+		neededLevel = powerLevels.Ban
+	}
+	for _, level := range powerLevels.Events {
+		if level > neededLevel {
+			neededLevel = level
+		}
+	}
+	initialPowerLevelsContent := powerLevelsContent
+	raisePowerLevels := powerLevels.UserLevel(req.UserID) < neededLevel
+	if raisePowerLevels {
+		initialPowerLevelsContent = make(map[string]interface{}, len(powerLevelsContent))
+		for k, v := range powerLevelsContent {
+			initialPowerLevelsContent[k] = v
+		}
+		users := map[string]interface{}{}
+		if oldUsers, ok := powerLevelsContent["users"].(map[string]interface{}); ok {
+			for k, v := range oldUsers {
+				users[k] = v
+			}
+		}
+		users[req.UserID] = neededLevel
+		initialPowerLevelsContent["users"] = users
+	}
+
+	eventsToMake := []upgradeEvent{
+		{gomatrixserverlib.MRoomCreate, "", createContent},
+		{gomatrixserverlib.MRoomMember, req.UserID, memberContent},
+		{gomatrixserverlib.MRoomPowerLevels, "", initialPowerLevelsContent},
+	}
+	for _, eventType := range upgradeStateTypes {
+		ev := oldState[gomatrixserverlib.StateKeyTuple{EventType: eventType, StateKey: ""}]
+		if ev == nil {
+			continue
+		}
+		eventsToMake = append(eventsToMake, upgradeEvent{eventType, "", json.RawMessage(ev.Content())})
+	}
+	for tuple, ev := range oldState {
+		if tuple.EventType != gomatrixserverlib.MRoomMember {
+			continue
+		}
+		if membership, err := ev.Membership(); err != nil || membership != gomatrixserverlib.Ban {
+			continue
+		}
+		eventsToMake = append(eventsToMake, upgradeEvent{
+			gomatrixserverlib.MRoomMember, tuple.StateKey, gomatrixserverlib.MemberContent{Membership: gomatrixserverlib.Ban},
+		})
+	}
+	if raisePowerLevels {
+		eventsToMake = append(eventsToMake, upgradeEvent{gomatrixserverlib.MRoomPowerLevels, "", powerLevelsContent})
+	}
+
+	evTime := time.Now()
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	builtEvents := make([]gomatrixserverlib.HeaderedEvent, 0, len(eventsToMake))
+	for _, e := range eventsToMake {
+		stateKey := e.StateKey
+		builder := gomatrixserverlib.EventBuilder{
+			Sender:   req.UserID,
+			RoomID:   newRoomID,
+			Type:     e.Type,
+			StateKey: &stateKey,
+			Depth:    int64(len(builtEvents) + 1), // depth starts at 1
+		}
+		if err := builder.SetContent(e.Content); err != nil {
+			return nil, fmt.Errorf("builder.SetContent: %w", err)
+		}
+		if len(builtEvents) > 0 {
+			builder.PrevEvents = []gomatrixserverlib.EventReference{builtEvents[len(builtEvents)-1].EventReference()}
+		}
+		eventsNeeded, err := gomatrixserverlib.StateNeededForEventBuilder(&builder)
+		if err != nil {
+			return nil, fmt.Errorf("gomatrixserverlib.StateNeededForEventBuilder: %w", err)
+		}
+		refs, err := eventsNeeded.AuthEventReferences(&authEvents)
+		if err != nil {
+			return nil, fmt.Errorf("eventsNeeded.AuthEventReferences: %w", err)
+		}
+		builder.AuthEvents = refs
+		ev, err := builder.Build(
+			evTime, r.Cfg.Matrix.ServerName, r.Cfg.Matrix.KeyID,
+			r.Cfg.Matrix.PrivateKey, req.RoomVersion,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("builder.Build: %w", err)
+		}
+		if err = gomatrixserverlib.Allowed(ev, &authEvents); err != nil {
+			if e.Type == gomatrixserverlib.MRoomMember && e.StateKey != req.UserID {
+				// The user isn't allowed to ban this user, e.g. because the
+				// banned user has a higher power level, so skip the ban.
+				continue
+			}
+			return nil, fmt.Errorf("gomatrixserverlib.Allowed: %w", err)
+		}
+		if err = authEvents.AddEvent(&ev); err != nil {
+			return nil, fmt.Errorf("authEvents.AddEvent: %w", err)
+		}
+		builtEvents = append(builtEvents, ev.Headered(req.RoomVersion))
+	}
+	return builtEvents, nil
+}
+
+// buildUpgradeEvent builds a state event with an empty state key in an
+// existing room, returning the event and the version of the room.
+func (r *RoomserverInternalAPI) buildUpgradeEvent(
+	ctx context.Context, userID, roomID, eventType string, content interface{},
+) (*gomatrixserverlib.Event, gomatrixserverlib.RoomVersion, error) {
+	stateKey := ""
+	eb := gomatrixserverlib.EventBuilder{
+		Type:     eventType,
+		Sender:   userID,
+		StateKey: &stateKey,
+		RoomID:   roomID,
+	}
+	if err := eb.SetContent(content); err != nil {
+		return nil, "", fmt.Errorf("eb.SetContent: %w", err)
+	}
+	buildRes := api.QueryLatestEventsAndStateResponse{}
+	event, err := internal.BuildEvent(ctx, &eb, r.Cfg, time.Now(), r, &buildRes)
+	if err != nil {
+		return nil, "", fmt.Errorf("internal.BuildEvent: %w", err)
+	}
+	return event, buildRes.RoomVersion, nil
+}
+
+// sendUpgradeEvents sends events created by this server into the roomserver.
+func (r *RoomserverInternalAPI) sendUpgradeEvents(
+	ctx context.Context, events []gomatrixserverlib.HeaderedEvent,
+) error {
+	inputReq := api.InputRoomEventsRequest{}
+	for _, event := range events {
+		inputReq.InputRoomEvents = append(inputReq.InputRoomEvents, api.InputRoomEvent{
+			Kind:         api.KindNew,
+			Event:        event,
+			AuthEventIDs: event.AuthEventIDs(),
+			SendAsServer: string(r.Cfg.Matrix.ServerName),
+		})
+	}
+	inputRes := api.InputRoomEventsResponse{}
+	return r.InputRoomEvents(ctx, &inputReq, &inputRes)
+}
+
+// moveLocalAliases points all of the local aliases for the old room at the
+// replacement room, and updates the m.room.aliases events in both rooms.
+func (r *RoomserverInternalAPI) moveLocalAliases(
+	ctx context.Context, userID, oldRoomID, newRoomID string,
+) error {
+	aliases, err := r.DB.GetAliasesForRoomID(ctx, oldRoomID)
+	if err != nil {
+		return fmt.Errorf("r.DB.GetAliasesForRoomID: %w", err)
+	}
+	if len(aliases) == 0 {
+		return nil
+	}
+	for _, alias := range aliases {
+		creatorID, err := r.DB.GetCreatorIDForAlias(ctx, alias)
+		if err != nil {
+			return fmt.Errorf("r.DB.GetCreatorIDForAlias: %w", err)
+		}
+		if err = r.DB.RemoveRoomAlias(ctx, alias); err != nil {
+			return fmt.Errorf("r.DB.RemoveRoomAlias: %w", err)
+		}
+		if err = r.DB.SetRoomAlias(ctx, alias, newRoomID, creatorID); err != nil {
+			return fmt.Errorf("r.DB.SetRoomAlias: %w", err)
+		}
+	}
+	if err = r.sendUpdatedAliasesEvent(ctx, userID, oldRoomID); err != nil {
+		return fmt.Errorf("r.sendUpdatedAliasesEvent: %w", err)
+	}
+	return r.sendUpdatedAliasesEvent(ctx, userID, newRoomID)
+}
+
+// restrictOldRoom raises the power levels needed to send messages and invite
+// users in the old room, so that people move to the replacement room. This is
+// skipped if the user isn't allowed to change the power levels.
+func (r *RoomserverInternalAPI) restrictOldRoom(
+	ctx context.Context, userID, roomID string,
+	oldState map[gomatrixserverlib.StateKeyTuple]*gomatrixserverlib.Event,
+	powerLevels *gomatrixserverlib.PowerLevelContent,
+) error {
+	plEvent := oldState[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomPowerLevels, StateKey: ""}]
+	if plEvent == nil {
+		return nil
+	}
+	restrictedLevel := powerLevels.UsersDefault + 1
+	if restrictedLevel < 50 {
+		restrictedLevel = 50
+	}
+	if powerLevels.EventsDefault >= restrictedLevel && powerLevels.Invite >= restrictedLevel {
+		return nil
+	}
+	userLevel := powerLevels.UserLevel(userID)
+	if userLevel < powerLevels.EventLevel(gomatrixserverlib.MRoomPowerLevels, true) || userLevel < restrictedLevel {
+		return nil
+	}
+	var content map[string]interface{}
+	if err := json.Unmarshal(plEvent.Content(), &content); err != nil {
+		return fmt.Errorf("json.Unmarshal: %w", err)
+	}
+	if powerLevels.EventsDefault < restrictedLevel {
+		content["events_default"] = restrictedLevel
+	}
+	if powerLevels.Invite < restrictedLevel {
+		content["invite"] = restrictedLevel
+	}
+	event, roomVersion, err := r.buildUpgradeEvent(ctx, userID, roomID, gomatrixserverlib.MRoomPowerLevels, content)
+	if err != nil {
+		return fmt.Errorf("r.buildUpgradeEvent: %w", err)
+	}
+	return r.sendUpgradeEvents(ctx, []gomatrixserverlib.HeaderedEvent{event.Headered(roomVersion)})
+}
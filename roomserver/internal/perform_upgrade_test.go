@@ -0,0 +1,196 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// newRoomEvents returns the events which were sent into the given room, in
+// the order that they were sent, checking that each of them is allowed by
+// the state before it.
+func newRoomEvents(t *testing.T, outputs []api.OutputEvent, roomID string) []gomatrixserverlib.Event {
+	t.Helper()
+	var events []gomatrixserverlib.Event
+	authEvents := gomatrixserverlib.NewAuthEvents(nil)
+	for _, output := range outputs {
+		if output.Type != api.OutputTypeNewRoomEvent || output.NewRoomEvent.Event.RoomID() != roomID {
+			continue
+		}
+		ev := output.NewRoomEvent.Event.Unwrap()
+		if err := gomatrixserverlib.Allowed(ev, &authEvents); err != nil {
+			t.Fatalf("event %s of type %s isn't allowed: %s", ev.EventID(), ev.Type(), err)
+		}
+		if err := authEvents.AddEvent(&ev); err != nil {
+			t.Fatalf("failed to add auth event: %s", err)
+		}
+		events = append(events, ev)
+	}
+	return events
+}
+
+func powerLevelsOf(t *testing.T, ev gomatrixserverlib.Event) gomatrixserverlib.PowerLevelContent {
+	t.Helper()
+	content, err := gomatrixserverlib.NewPowerLevelContentFromEvent(ev)
+	if err != nil {
+		t.Fatalf("failed to parse power levels: %s", err)
+	}
+	return content
+}
+
+func TestPerformUpgrade(t *testing.T) {
+	r, producer, cleanup := mustCreateRoomserverAPI(t)
+	defer cleanup()
+
+	// Alice can send the tombstone, but not the server ACLs or power levels
+	// that have to be copied to the replacement room.
+	oldPowerLevels := map[string]interface{}{
+		"users": map[string]interface{}{"@admin:test": 100, "@alice:test": 50},
+		"events": map[string]interface{}{
+			"m.room.tombstone":  50,
+			"m.room.server_acl": 100,
+		},
+	}
+	room := newTestRoom(t, r, "@admin:test", oldPowerLevels)
+	room.sendState(t, "@admin:test", "m.room.server_acl", "", map[string]interface{}{"allow": []string{"*"}})
+	room.sendState(t, "@admin:test", gomatrixserverlib.MRoomName, "", map[string]interface{}{"name": "Old room"})
+	// Mallory's ban can be copied, but Boss has the same power level as
+	// Alice gets in the replacement room, so she can't ban him there.
+	room.sendState(t, "@admin:test", gomatrixserverlib.MRoomMember, "@mallory:remote", map[string]interface{}{"membership": "ban"})
+	room.sendState(t, "@admin:test", gomatrixserverlib.MRoomMember, "@boss:remote", map[string]interface{}{"membership": "ban"})
+	oldPowerLevels["users"] = map[string]interface{}{"@admin:test": 100, "@alice:test": 50, "@boss:remote": 100}
+	room.sendState(t, "@admin:test", gomatrixserverlib.MRoomPowerLevels, "", oldPowerLevels)
+	producer.outputEvents(t)
+
+	var res api.PerformUpgradeResponse
+	err := r.PerformUpgrade(context.Background(), &api.PerformUpgradeRequest{
+		RoomID:      room.roomID,
+		UserID:      "@alice:test",
+		RoomVersion: gomatrixserverlib.RoomVersionV5,
+	}, &res)
+	if err != nil {
+		t.Fatalf("PerformUpgrade returned %s", err)
+	}
+	if res.Error != nil {
+		t.Fatalf("PerformUpgrade returned error %+v", res.Error)
+	}
+	outputs := producer.outputEvents(t)
+	events := newRoomEvents(t, outputs, res.NewRoomID)
+
+	var powerLevels []gomatrixserverlib.Event
+	state := make(map[gomatrixserverlib.StateKeyTuple]gomatrixserverlib.Event)
+	for _, ev := range events {
+		if ev.Sender() != "@alice:test" {
+			t.Errorf("event %s was sent by %s, want @alice:test", ev.EventID(), ev.Sender())
+		}
+		if ev.Type() == gomatrixserverlib.MRoomPowerLevels {
+			powerLevels = append(powerLevels, ev)
+		}
+		state[gomatrixserverlib.StateKeyTuple{EventType: ev.Type(), StateKey: *ev.StateKey()}] = ev
+	}
+
+	// Alice's power level was raised to send the state, then restored.
+	if len(powerLevels) != 2 {
+		t.Fatalf("replacement room has %d power levels events, want 2", len(powerLevels))
+	}
+	initial := powerLevelsOf(t, powerLevels[0])
+	if level := initial.UserLevel("@alice:test"); level != 100 {
+		t.Errorf("initial power level of @alice:test is %d, want 100", level)
+	}
+	var gotContent, wantContent map[string]interface{}
+	if err = json.Unmarshal(powerLevels[1].Content(), &gotContent); err != nil {
+		t.Fatalf("failed to unmarshal power levels: %s", err)
+	}
+	wantJSON, err := json.Marshal(oldPowerLevels)
+	if err != nil {
+		t.Fatalf("failed to marshal power levels: %s", err)
+	}
+	if err = json.Unmarshal(wantJSON, &wantContent); err != nil {
+		t.Fatalf("failed to unmarshal power levels: %s", err)
+	}
+	gotJSON, _ := json.Marshal(gotContent)
+	wantJSON, _ = json.Marshal(wantContent)
+	if string(gotJSON) != string(wantJSON) {
+		t.Errorf("final power levels are %s, want %s", gotJSON, wantJSON)
+	}
+
+	// The state was copied, apart from the ban that Alice can't issue.
+	for _, tuple := range []gomatrixserverlib.StateKeyTuple{
+		{EventType: "m.room.server_acl", StateKey: ""},
+		{EventType: gomatrixserverlib.MRoomName, StateKey: ""},
+		{EventType: gomatrixserverlib.MRoomJoinRules, StateKey: ""},
+	} {
+		if _, ok := state[tuple]; !ok {
+			t.Errorf("replacement room has no %s event", tuple.EventType)
+		}
+	}
+	if ev, ok := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: "@mallory:remote"}]; !ok {
+		t.Errorf("@mallory:remote isn't banned from the replacement room")
+	} else if membership, _ := ev.Membership(); membership != gomatrixserverlib.Ban {
+		t.Errorf("@mallory:remote has membership %s, want ban", membership)
+	}
+	if _, ok := state[gomatrixserverlib.StateKeyTuple{EventType: gomatrixserverlib.MRoomMember, StateKey: "@boss:remote"}]; ok {
+		t.Errorf("@boss:remote was banned from the replacement room")
+	}
+
+	// The old room was tombstoned and points at the replacement room.
+	var tombstone *gomatrixserverlib.Event
+	for _, output := range outputs {
+		if output.Type == api.OutputTypeNewRoomEvent && output.NewRoomEvent.Event.Type() == "m.room.tombstone" {
+			ev := output.NewRoomEvent.Event.Unwrap()
+			tombstone = &ev
+		}
+	}
+	if tombstone == nil || tombstone.RoomID() != room.roomID {
+		t.Fatalf("old room wasn't tombstoned")
+	}
+	var tombstoneContent struct {
+		ReplacementRoom string `json:"replacement_room"`
+	}
+	if err = json.Unmarshal(tombstone.Content(), &tombstoneContent); err != nil || tombstoneContent.ReplacementRoom != res.NewRoomID {
+		t.Errorf("tombstone points at %q, want %q", tombstoneContent.ReplacementRoom, res.NewRoomID)
+	}
+}
+
+func TestPerformUpgradeNotAllowed(t *testing.T) {
+	r, producer, cleanup := mustCreateRoomserverAPI(t)
+	defer cleanup()
+	room := newTestRoom(t, r, "@admin:test", map[string]interface{}{
+		"users":  map[string]interface{}{"@admin:test": 100, "@bob:test": 0},
+		"events": map[string]interface{}{"m.room.tombstone": 100},
+	})
+	producer.outputEvents(t)
+
+	var res api.PerformUpgradeResponse
+	err := r.PerformUpgrade(context.Background(), &api.PerformUpgradeRequest{
+		RoomID:      room.roomID,
+		UserID:      "@bob:test",
+		RoomVersion: gomatrixserverlib.RoomVersionV5,
+	}, &res)
+	if err != nil {
+		t.Fatalf("PerformUpgrade returned %s", err)
+	}
+	if res.Error == nil || res.Error.Code != api.PerformErrorNotAllowed {
+		t.Fatalf("PerformUpgrade returned error %+v, want not allowed", res.Error)
+	}
+	if outputs := producer.outputEvents(t); len(outputs) != 0 {
+		t.Fatalf("PerformUpgrade sent %d events, want none", len(outputs))
+	}
+}
@@ -228,6 +228,7 @@ func (r *RoomserverInternalAPI) QueryMembershipForUser(
 		return nil
 	}
 
+	response.HasBeenInRoom = true
 	response.IsInRoom = stillInRoom
 	eventIDMap, err := r.DB.EventIDs(ctx, []types.EventNID{membershipEventNID})
 	if err != nil {
@@ -430,6 +431,95 @@ func (r *RoomserverInternalAPI) checkServerAllowedToSeeEvent(
 	return auth.IsServerAllowed(serverName, isServerInRoom, stateAtEvent), nil
 }
 
+// QueryUserAllowedToSeeEvents implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	request *api.QueryUserAllowedToSeeEventsRequest,
+	response *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	response.AllowedToSeeEvents = make(map[string]bool, len(request.EventIDs))
+	events, err := r.DB.EventsFromIDs(ctx, request.EventIDs)
+	if err != nil || len(events) == 0 {
+		return err
+	}
+	stateKeyNIDs, err := r.DB.EventStateKeyNIDs(ctx, []string{request.UserID})
+	if err != nil {
+		return err
+	}
+	userStateKeyNID := stateKeyNIDs[request.UserID]
+
+	// Work out the state snapshot before each event. Consecutive events which
+	// don't change the state share a snapshot, so each snapshot only needs to
+	// be loaded once.
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	stateAtEvents, err := r.DB.StateAtEventIDs(ctx, eventIDs)
+	if err != nil {
+		return err
+	}
+	snapshotNIDs := make(map[types.EventNID]types.StateSnapshotNID, len(stateAtEvents))
+	uniqueSnapshotNIDs := make([]types.StateSnapshotNID, 0, len(stateAtEvents))
+	for _, stateAtEvent := range stateAtEvents {
+		snapshotNIDs[stateAtEvent.EventNID] = stateAtEvent.BeforeStateSnapshotNID
+		uniqueSnapshotNIDs = append(uniqueSnapshotNIDs, stateAtEvent.BeforeStateSnapshotNID)
+	}
+	roomState := state.NewStateResolution(r.DB)
+	stateAtSnapshots, err := roomState.LoadStateAtSnapshots(ctx, uniqueSnapshotNIDs)
+	if err != nil {
+		return err
+	}
+
+	// The history visibility rules for users only need the history visibility
+	// and the membership of the user, so only load those events, all at once.
+	neededEntries := make(map[types.StateSnapshotNID][]types.StateEntry, len(stateAtSnapshots))
+	var neededEventNIDs []types.EventNID
+	for snapshotNID, stateEntries := range stateAtSnapshots {
+		for _, entry := range stateEntries {
+			switch {
+			case entry.EventTypeNID == types.MRoomHistoryVisibilityNID && entry.EventStateKeyNID == types.EmptyStateKeyNID:
+			case entry.EventTypeNID == types.MRoomMemberNID && userStateKeyNID != 0 && entry.EventStateKeyNID == userStateKeyNID:
+			default:
+				continue
+			}
+			neededEntries[snapshotNID] = append(neededEntries[snapshotNID], entry)
+			neededEventNIDs = append(neededEventNIDs, entry.EventNID)
+		}
+	}
+	stateEvents, err := r.DB.Events(ctx, neededEventNIDs)
+	if err != nil {
+		return err
+	}
+	stateEventsByNID := make(map[types.EventNID]gomatrixserverlib.Event, len(stateEvents))
+	for _, stateEvent := range stateEvents {
+		stateEventsByNID[stateEvent.EventNID] = stateEvent.Event
+	}
+
+	// Whether the user is currently joined only needs working out once per room.
+	isUserInRoom := make(map[string]bool)
+	for _, event := range events {
+		roomID := event.RoomID()
+		inRoom, ok := isUserInRoom[roomID]
+		if !ok {
+			if inRoom, err = r.isUserCurrentlyInRoom(ctx, request.UserID, roomID); err != nil {
+				return err
+			}
+			isUserInRoom[roomID] = inRoom
+		}
+		var stateAtEvent []gomatrixserverlib.Event
+		for _, entry := range neededEntries[snapshotNIDs[event.EventNID]] {
+			if stateEvent, ok := stateEventsByNID[entry.EventNID]; ok {
+				stateAtEvent = append(stateAtEvent, stateEvent)
+			}
+		}
+		response.AllowedToSeeEvents[event.EventID()] = auth.IsUserAllowed(
+			request.UserID, inRoom, &event.Event, stateAtEvent,
+		)
+	}
+	return nil
+}
+
 // QueryMissingEvents implements api.RoomserverInternalAPI
 func (r *RoomserverInternalAPI) QueryMissingEvents(
 	ctx context.Context,
@@ -607,6 +697,15 @@ func (r *RoomserverInternalAPI) isServerCurrentlyInRoom(ctx context.Context, ser
 	return auth.IsAnyUserOnServerWithMembership(serverName, gmslEvents, gomatrixserverlib.Join), nil
 }
 
+func (r *RoomserverInternalAPI) isUserCurrentlyInRoom(ctx context.Context, userID, roomID string) (bool, error) {
+	roomNID, err := r.DB.RoomNID(ctx, roomID)
+	if err != nil {
+		return false, err
+	}
+	_, isInRoom, err := r.DB.GetMembership(ctx, roomNID, userID)
+	return isInRoom, err
+}
+
 // fetchAndStoreMissingEvents does a best-effort fetch and store of missing events specified in stateIDs. Returns no error as it is just
 // best effort.
 func (r *RoomserverInternalAPI) fetchAndStoreMissingEvents(ctx context.Context, roomVer gomatrixserverlib.RoomVersion,
@@ -964,3 +1063,31 @@ func (r *RoomserverInternalAPI) QueryRoomVersionForRoom(
 	r.ImmutableCache.StoreRoomVersion(request.RoomID, response.RoomVersion)
 	return nil
 }
+
+// QueryRoomsForUser implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryRoomsForUser(
+	ctx context.Context,
+	request *api.QueryRoomsForUserRequest,
+	response *api.QueryRoomsForUserResponse,
+) error {
+	roomIDs, err := r.DB.GetRoomsByMembership(ctx, request.UserID, request.WantMembership)
+	if err != nil {
+		return err
+	}
+	response.RoomIDs = roomIDs
+	return nil
+}
+
+// QueryRooms implements api.RoomserverInternalAPI
+func (r *RoomserverInternalAPI) QueryRooms(
+	ctx context.Context,
+	request *api.QueryRoomsRequest,
+	response *api.QueryRoomsResponse,
+) error {
+	rooms, err := r.DB.RoomsWithMemberCounts(ctx, request.From, request.Limit)
+	if err != nil {
+		return err
+	}
+	response.Rooms = rooms
+	return nil
+}
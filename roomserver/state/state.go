@@ -80,6 +80,53 @@ func (v StateResolution) LoadStateAtSnapshot(
 	return fullState, nil
 }
 
+// LoadStateAtSnapshots loads the full state of a room at each of the given
+// snapshots, fetching the state blocks for all of them at once. This is
+// cheaper than calling LoadStateAtSnapshot for each snapshot when looking
+// at many events, since many of them will share the same snapshots.
+// Returns a sorted list of state entries for each snapshot or an error if
+// there was a problem talking to the database.
+func (v StateResolution) LoadStateAtSnapshots(
+	ctx context.Context, stateNIDs []types.StateSnapshotNID,
+) (map[types.StateSnapshotNID][]types.StateEntry, error) {
+	stateNIDs = uniqueStateSnapshotNIDs(stateNIDs)
+	stateBlockNIDLists, err := v.db.StateBlockNIDs(ctx, stateNIDs)
+	if err != nil {
+		return nil, err
+	}
+	var stateBlockNIDs []types.StateBlockNID
+	for _, list := range stateBlockNIDLists {
+		stateBlockNIDs = append(stateBlockNIDs, list.StateBlockNIDs...)
+	}
+	stateEntryLists, err := v.db.StateEntries(ctx, uniqueStateBlockNIDs(stateBlockNIDs))
+	if err != nil {
+		return nil, err
+	}
+	stateEntriesMap := stateEntryListMap(stateEntryLists)
+
+	result := make(map[types.StateSnapshotNID][]types.StateEntry, len(stateBlockNIDLists))
+	for _, stateBlockNIDList := range stateBlockNIDLists {
+		// Combine all the state entries for this snapshot.
+		// The order of state block NIDs in the list tells us the order to combine them in.
+		var fullState []types.StateEntry
+		for _, stateBlockNID := range stateBlockNIDList.StateBlockNIDs {
+			entries, ok := stateEntriesMap.lookup(stateBlockNID)
+			if !ok {
+				// This should only get hit if the database is corrupt.
+				// It should be impossible for an event to reference a NID that doesn't exist
+				panic(fmt.Errorf("Corrupt DB: Missing state block numeric ID %d", stateBlockNID))
+			}
+			fullState = append(fullState, entries...)
+		}
+		// Stable sort so that the most recent entry for each state key stays
+		// remains later in the list than the older entries for the same state key.
+		sort.Stable(stateEntryByStateKeySorter(fullState))
+		// Unique returns the last entry and hence the most recent entry for each state key.
+		result[stateBlockNIDList.StateSnapshotNID] = fullState[:util.Unique(stateEntryByStateKeySorter(fullState))]
+	}
+	return result, nil
+}
+
 // LoadStateAtEvent loads the full state of a room before a particular event.
 func (v StateResolution) LoadStateAtEvent(
 	ctx context.Context, eventID string,
@@ -88,4 +88,20 @@ type Database interface {
 	GetMembershipEventNIDsForRoom(ctx context.Context, roomNID types.RoomNID, joinOnly bool, localOnly bool) ([]types.EventNID, error)
 	EventsFromIDs(ctx context.Context, eventIDs []string) ([]types.Event, error)
 	GetRoomVersionForRoom(ctx context.Context, roomID string) (gomatrixserverlib.RoomVersion, error)
+	// GetRoomsByMembership returns a list of room IDs matching the provided membership and user ID (as state_key).
+	GetRoomsByMembership(ctx context.Context, userID, membership string) ([]string, error)
+	// StoreRedaction records that the redaction event targets the given event.
+	StoreRedaction(ctx context.Context, redactionEventID, redactsEventID string) error
+	// PendingRedactions returns the IDs of redaction events targeting the given
+	// event which haven't been applied to it yet.
+	PendingRedactions(ctx context.Context, redactsEventID string) ([]string, error)
+	// RedactEvent replaces the JSON of the redacted event with its redacted form
+	// and marks the redaction as applied.
+	RedactEvent(ctx context.Context, redactionEventID string, redactedEventNID types.EventNID, redactedEventJSON []byte) error
+	// RoomsWithMemberCounts returns up to limit rooms, ordered by room ID and
+	// starting after the given room ID, with the number of users joined to each.
+	RoomsWithMemberCounts(ctx context.Context, from string, limit int) ([]api.RoomSummary, error)
+	// PurgeRoom deletes everything stored about the room. Returns sql.ErrNoRows
+	// if the room doesn't exist.
+	PurgeRoom(ctx context.Context, roomID string) error
 }
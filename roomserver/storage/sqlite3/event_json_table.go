@@ -36,6 +36,12 @@ const insertEventJSONSQL = `
 	  ON CONFLICT DO NOTHING
 `
 
+// SQLite numbers $N parameters in the order that they appear, so they must
+// appear in order.
+const updateEventJSONSQL = `
+	UPDATE roomserver_event_json SET event_json = $1 WHERE event_nid = $2
+`
+
 // Bulk event JSON lookup by numeric event ID.
 // Sort by the numeric event ID.
 // This means that we can use binary search to lookup by numeric event ID.
@@ -48,6 +54,7 @@ const bulkSelectEventJSONSQL = `
 type eventJSONStatements struct {
 	db                      *sql.DB
 	insertEventJSONStmt     *sql.Stmt
+	updateEventJSONStmt     *sql.Stmt
 	bulkSelectEventJSONStmt *sql.Stmt
 }
 
@@ -59,6 +66,7 @@ func (s *eventJSONStatements) prepare(db *sql.DB) (err error) {
 	}
 	return statementList{
 		{&s.insertEventJSONStmt, insertEventJSONSQL},
+		{&s.updateEventJSONStmt, updateEventJSONSQL},
 		{&s.bulkSelectEventJSONStmt, bulkSelectEventJSONSQL},
 	}.prepare(db)
 }
@@ -70,6 +78,13 @@ func (s *eventJSONStatements) insertEventJSON(
 	return err
 }
 
+func (s *eventJSONStatements) updateEventJSON(
+	ctx context.Context, txn *sql.Tx, eventNID types.EventNID, eventJSON []byte,
+) error {
+	_, err := internal.TxStmt(txn, s.updateEventJSONStmt).ExecContext(ctx, eventJSON, int64(eventNID))
+	return err
+}
+
 type eventJSONPair struct {
 	EventNID  types.EventNID
 	EventJSON []byte
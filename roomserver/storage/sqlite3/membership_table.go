@@ -20,6 +20,7 @@ import (
 	"database/sql"
 
 	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/roomserver/types"
 )
 
@@ -76,6 +77,19 @@ const selectMembershipForUpdateSQL = "" +
 	"SELECT membership_nid FROM roomserver_membership" +
 	" WHERE room_nid = $1 AND target_nid = $2"
 
+const selectRoomsWithMembershipSQL = "" +
+	"SELECT roomserver_rooms.room_id FROM roomserver_membership" +
+	" JOIN roomserver_rooms ON roomserver_membership.room_nid = roomserver_rooms.room_nid" +
+	" WHERE roomserver_membership.target_nid = $1 AND roomserver_membership.membership_nid = $2"
+
+// Rooms which only exist as a stub, because we have received an invite for
+// them, have no state snapshot and are left out.
+const selectRoomsWithMemberCountsSQL = "" +
+	"SELECT r.room_id, r.room_version, COUNT(m.target_nid) FROM roomserver_rooms r" +
+	" LEFT JOIN roomserver_membership m ON m.room_nid = r.room_nid AND m.membership_nid = $1" +
+	" WHERE r.state_snapshot_nid != 0 AND r.room_id > $2" +
+	" GROUP BY r.room_id, r.room_version ORDER BY r.room_id ASC LIMIT $3"
+
 const updateMembershipSQL = "" +
 	"UPDATE roomserver_membership SET sender_nid = $1, membership_nid = $2, event_nid = $3" +
 	" WHERE room_nid = $4 AND target_nid = $5"
@@ -88,6 +102,8 @@ type membershipStatements struct {
 	selectLocalMembershipsFromRoomAndMembershipStmt *sql.Stmt
 	selectMembershipsFromRoomStmt                   *sql.Stmt
 	selectLocalMembershipsFromRoomStmt              *sql.Stmt
+	selectRoomsWithMembershipStmt                   *sql.Stmt
+	selectRoomsWithMemberCountsStmt                 *sql.Stmt
 	updateMembershipStmt                            *sql.Stmt
 }
 
@@ -105,6 +121,8 @@ func (s *membershipStatements) prepare(db *sql.DB) (err error) {
 		{&s.selectLocalMembershipsFromRoomAndMembershipStmt, selectLocalMembershipsFromRoomAndMembershipSQL},
 		{&s.selectMembershipsFromRoomStmt, selectMembershipsFromRoomSQL},
 		{&s.selectLocalMembershipsFromRoomStmt, selectLocalMembershipsFromRoomSQL},
+		{&s.selectRoomsWithMembershipStmt, selectRoomsWithMembershipSQL},
+		{&s.selectRoomsWithMemberCountsStmt, selectRoomsWithMemberCountsSQL},
 		{&s.updateMembershipStmt, updateMembershipSQL},
 	}.prepare(db)
 }
@@ -205,3 +223,48 @@ func (s *membershipStatements) updateMembership(
 	)
 	return err
 }
+
+func (s *membershipStatements) selectRoomsWithMembership(
+	ctx context.Context, txn *sql.Tx,
+	userID types.EventStateKeyNID, membershipState membershipState,
+) ([]string, error) {
+	stmt := internal.TxStmt(txn, s.selectRoomsWithMembershipStmt)
+	rows, err := stmt.QueryContext(ctx, userID, membershipState)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomsWithMembership: rows.close() failed")
+	var roomIDs []string
+	for rows.Next() {
+		var roomID string
+		if err = rows.Scan(&roomID); err != nil {
+			return nil, err
+		}
+		roomIDs = append(roomIDs, roomID)
+	}
+	return roomIDs, rows.Err()
+}
+
+// selectRoomsWithMemberCounts returns up to limit rooms, ordered by room ID
+// and starting after the given room ID, along with the number of users
+// joined to each of them.
+func (s *membershipStatements) selectRoomsWithMemberCounts(
+	ctx context.Context, txn *sql.Tx, from string, limit int,
+) ([]api.RoomSummary, error) {
+	stmt := internal.TxStmt(txn, s.selectRoomsWithMemberCountsStmt)
+	rows, err := stmt.QueryContext(ctx, membershipStateJoin, from, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomsWithMemberCounts: rows.close() failed")
+
+	var rooms []api.RoomSummary
+	for rows.Next() {
+		var room api.RoomSummary
+		if err = rows.Scan(&room.RoomID, &room.RoomVersion, &room.JoinedMembers); err != nil {
+			return nil, err
+		}
+		rooms = append(rooms, room)
+	}
+	return rooms, rows.Err()
+}
@@ -0,0 +1,144 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"encoding/json"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/roomserver/types"
+)
+
+// The statements used to purge a room. They don't have a table of their own,
+// they remove the rows belonging to a room from the other tables.
+
+const selectStateBlockNIDsForRoomSQL = "" +
+	"SELECT state_block_nids FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+const purgeStateBlocksSQL = "" +
+	"DELETE FROM roomserver_state_block WHERE state_block_nid = $1"
+
+const purgeStateSnapshotsSQL = "" +
+	"DELETE FROM roomserver_state_snapshots WHERE room_nid = $1"
+
+const purgeRedactionsSQL = "" +
+	"DELETE FROM roomserver_redactions WHERE redacts_event_id IN (" +
+	"SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	") OR redaction_event_id IN (" +
+	"SELECT event_id FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeEventJSONSQL = "" +
+	"DELETE FROM roomserver_event_json WHERE event_nid IN (" +
+	"SELECT event_nid FROM roomserver_events WHERE room_nid = $1" +
+	")"
+
+const purgeEventsSQL = "" +
+	"DELETE FROM roomserver_events WHERE room_nid = $1"
+
+const purgeMembershipsSQL = "" +
+	"DELETE FROM roomserver_membership WHERE room_nid = $1"
+
+const purgeInvitesSQL = "" +
+	"DELETE FROM roomserver_invites WHERE room_nid = $1"
+
+const purgeRoomAliasesSQL = "" +
+	"DELETE FROM roomserver_room_aliases WHERE room_id = $1"
+
+const purgeRoomSQL = "" +
+	"DELETE FROM roomserver_rooms WHERE room_nid = $1"
+
+type purgeStatements struct {
+	selectStateBlockNIDsForRoomStmt *sql.Stmt
+	purgeStateBlocksStmt            *sql.Stmt
+	purgeStateSnapshotsStmt         *sql.Stmt
+	purgeRedactionsStmt             *sql.Stmt
+	purgeEventJSONStmt              *sql.Stmt
+	purgeEventsStmt                 *sql.Stmt
+	purgeMembershipsStmt            *sql.Stmt
+	purgeInvitesStmt                *sql.Stmt
+	purgeRoomAliasesStmt            *sql.Stmt
+	purgeRoomStmt                   *sql.Stmt
+}
+
+func (s *purgeStatements) prepare(db *sql.DB) (err error) {
+	return statementList{
+		{&s.selectStateBlockNIDsForRoomStmt, selectStateBlockNIDsForRoomSQL},
+		{&s.purgeStateBlocksStmt, purgeStateBlocksSQL},
+		{&s.purgeStateSnapshotsStmt, purgeStateSnapshotsSQL},
+		{&s.purgeRedactionsStmt, purgeRedactionsSQL},
+		{&s.purgeEventJSONStmt, purgeEventJSONSQL},
+		{&s.purgeEventsStmt, purgeEventsSQL},
+		{&s.purgeMembershipsStmt, purgeMembershipsSQL},
+		{&s.purgeInvitesStmt, purgeInvitesSQL},
+		{&s.purgeRoomAliasesStmt, purgeRoomAliasesSQL},
+		{&s.purgeRoomStmt, purgeRoomSQL},
+	}.prepare(db)
+}
+
+// purgeRoom deletes everything that is stored about a room. The rows must be
+// deleted in this order, as some of the deletions look up the rows which are
+// deleted by the later ones.
+func (s *purgeStatements) purgeRoom(
+	ctx context.Context, txn *sql.Tx, roomNID types.RoomNID, roomID string,
+) error {
+	var stateBlockNIDs []int64
+	rows, err := internal.TxStmt(txn, s.selectStateBlockNIDsForRoomStmt).QueryContext(ctx, int64(roomNID))
+	if err != nil {
+		return err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "purgeRoom: rows.close() failed")
+	for rows.Next() {
+		var nidsJSON string
+		var nids []int64
+		if err = rows.Scan(&nidsJSON); err != nil {
+			return err
+		}
+		if err = json.Unmarshal([]byte(nidsJSON), &nids); err != nil {
+			return err
+		}
+		stateBlockNIDs = append(stateBlockNIDs, nids...)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	// There are no array parameters in SQLite, so the state blocks have to
+	// be deleted one at a time.
+	purgeStateBlocksStmt := internal.TxStmt(txn, s.purgeStateBlocksStmt)
+	for _, nid := range stateBlockNIDs {
+		if _, err = purgeStateBlocksStmt.ExecContext(ctx, nid); err != nil {
+			return err
+		}
+	}
+
+	for _, stmt := range []*sql.Stmt{
+		s.purgeStateSnapshotsStmt,
+		s.purgeRedactionsStmt,
+		s.purgeEventJSONStmt,
+		s.purgeEventsStmt,
+		s.purgeMembershipsStmt,
+		s.purgeInvitesStmt,
+		s.purgeRoomStmt,
+	} {
+		if _, err = internal.TxStmt(txn, stmt).ExecContext(ctx, int64(roomNID)); err != nil {
+			return err
+		}
+	}
+	_, err = internal.TxStmt(txn, s.purgeRoomAliasesStmt).ExecContext(ctx, roomID)
+	return err
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+)
+
+const redactionsSchema = `
+-- Stores information about the redacted state of events.
+-- We need to track redactions rather than blindly updating the event JSON table on receipt of a redaction
+-- because we might receive the redaction BEFORE we receive the event which it redacts (think backfill).
+CREATE TABLE IF NOT EXISTS roomserver_redactions (
+    -- The event ID of the m.room.redaction event.
+    redaction_event_id TEXT PRIMARY KEY,
+    -- The event ID of the event that the redaction targets.
+    redacts_event_id TEXT NOT NULL,
+    -- Initially FALSE, set to TRUE when the redaction has been validated
+    -- and applied to the JSON of the event that it targets.
+    validated BOOLEAN NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS roomserver_redactions_redacts_event_id
+    ON roomserver_redactions(redacts_event_id);
+`
+
+const insertRedactionSQL = "" +
+	"INSERT INTO roomserver_redactions (redaction_event_id, redacts_event_id)" +
+	" VALUES ($1, $2)" +
+	" ON CONFLICT DO NOTHING"
+
+const selectPendingRedactionsSQL = "" +
+	"SELECT redaction_event_id FROM roomserver_redactions" +
+	" WHERE redacts_event_id = $1 AND validated = 0"
+
+const markRedactionValidatedSQL = "" +
+	"UPDATE roomserver_redactions SET validated = 1 WHERE redaction_event_id = $1"
+
+type redactionStatements struct {
+	insertRedactionStmt         *sql.Stmt
+	selectPendingRedactionsStmt *sql.Stmt
+	markRedactionValidatedStmt  *sql.Stmt
+}
+
+func (s *redactionStatements) prepare(db *sql.DB) (err error) {
+	_, err = db.Exec(redactionsSchema)
+	if err != nil {
+		return
+	}
+
+	return statementList{
+		{&s.insertRedactionStmt, insertRedactionSQL},
+		{&s.selectPendingRedactionsStmt, selectPendingRedactionsSQL},
+		{&s.markRedactionValidatedStmt, markRedactionValidatedSQL},
+	}.prepare(db)
+}
+
+func (s *redactionStatements) insertRedaction(
+	ctx context.Context, txn *sql.Tx, redactionEventID, redactsEventID string,
+) error {
+	stmt := internal.TxStmt(txn, s.insertRedactionStmt)
+	_, err := stmt.ExecContext(ctx, redactionEventID, redactsEventID)
+	return err
+}
+
+func (s *redactionStatements) selectPendingRedactions(
+	ctx context.Context, txn *sql.Tx, redactsEventID string,
+) ([]string, error) {
+	stmt := internal.TxStmt(txn, s.selectPendingRedactionsStmt)
+	rows, err := stmt.QueryContext(ctx, redactsEventID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPendingRedactions: rows.close() failed")
+
+	var result []string
+	for rows.Next() {
+		var redactionEventID string
+		if err = rows.Scan(&redactionEventID); err != nil {
+			return nil, err
+		}
+		result = append(result, redactionEventID)
+	}
+	return result, rows.Err()
+}
+
+func (s *redactionStatements) markRedactionValidated(
+	ctx context.Context, txn *sql.Tx, redactionEventID string,
+) error {
+	stmt := internal.TxStmt(txn, s.markRedactionValidatedStmt)
+	_, err := stmt.ExecContext(ctx, redactionEventID)
+	return err
+}
@@ -20,6 +20,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"net/url"
 
 	"github.com/matrix-org/dendrite/internal/sqlutil"
@@ -944,6 +945,49 @@ func (d *Database) GetRoomVersionForRoomNID(
 	)
 }
 
+// GetRoomsByMembership implements storage.Database
+func (d *Database) GetRoomsByMembership(
+	ctx context.Context, userID, membership string,
+) ([]string, error) {
+	var membershipState membershipState
+	switch membership {
+	case gomatrixserverlib.Join:
+		membershipState = membershipStateJoin
+	case gomatrixserverlib.Invite:
+		membershipState = membershipStateInvite
+	case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+		membershipState = membershipStateLeaveOrBan
+	default:
+		return nil, fmt.Errorf("GetRoomsByMembership: invalid membership %q", membership)
+	}
+	stateKeyNID, err := d.statements.selectEventStateKeyNID(ctx, nil, userID)
+	if err == sql.ErrNoRows {
+		// We've never seen this user so they can't be in any rooms.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return d.statements.selectRoomsWithMembership(ctx, nil, stateKeyNID, membershipState)
+}
+
+// RoomsWithMemberCounts implements storage.Database
+func (d *Database) RoomsWithMemberCounts(
+	ctx context.Context, from string, limit int,
+) ([]api.RoomSummary, error) {
+	return d.statements.selectRoomsWithMemberCounts(ctx, nil, from, limit)
+}
+
+// PurgeRoom implements storage.Database
+func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		roomNID, err := d.statements.selectRoomNID(ctx, txn, roomID)
+		if err != nil {
+			return err
+		}
+		return d.statements.purgeRoom(ctx, txn, roomNID, roomID)
+	})
+}
+
 type transaction struct {
 	ctx context.Context
 	txn *sql.Tx
@@ -964,3 +1008,30 @@ func (t *transaction) Rollback() error {
 	}
 	return t.txn.Rollback()
 }
+
+// StoreRedaction implements storage.Database
+func (d *Database) StoreRedaction(
+	ctx context.Context, redactionEventID, redactsEventID string,
+) error {
+	return d.statements.insertRedaction(ctx, nil, redactionEventID, redactsEventID)
+}
+
+// PendingRedactions implements storage.Database
+func (d *Database) PendingRedactions(
+	ctx context.Context, redactsEventID string,
+) ([]string, error) {
+	return d.statements.selectPendingRedactions(ctx, nil, redactsEventID)
+}
+
+// RedactEvent implements storage.Database
+func (d *Database) RedactEvent(
+	ctx context.Context, redactionEventID string,
+	redactedEventNID types.EventNID, redactedEventJSON []byte,
+) error {
+	return internal.WithTransaction(d.db, func(txn *sql.Tx) error {
+		if err := d.statements.updateEventJSON(ctx, txn, redactedEventNID, redactedEventJSON); err != nil {
+			return err
+		}
+		return d.statements.markRedactionValidated(ctx, txn, redactionEventID)
+	})
+}
@@ -0,0 +1,105 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/keyserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputKeyChangeEventConsumer consumes events that originated in the key server.
+type OutputKeyChangeEventConsumer struct {
+	keyChangeConsumer *internal.ContinualConsumer
+	db                storage.Database
+	notifier          *sync.Notifier
+}
+
+// NewOutputKeyChangeEventConsumer creates a new OutputKeyChangeEventConsumer.
+// Call Start() to begin consuming from the key server.
+func NewOutputKeyChangeEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+) *OutputKeyChangeEventConsumer {
+
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputKeyChangeEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputKeyChangeEventConsumer{
+		keyChangeConsumer: &consumer,
+		db:                store,
+		notifier:          n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the key server
+func (s *OutputKeyChangeEventConsumer) Start() error {
+	return s.keyChangeConsumer.Start()
+}
+
+// onMessage is called when the sync server receives a device list change
+// from the key server. It records the change and wakes up every user who
+// shares a room with the user whose devices changed.
+func (s *OutputKeyChangeEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.DeviceMessage
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("key server output log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"user_id":   output.UserID,
+		"device_id": output.DeviceID,
+	}).Debug("received data from key server")
+
+	pduPos, err := s.db.StoreKeyChange(context.TODO(), output.UserID)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"user_id":    output.UserID,
+			log.ErrorKey: err,
+		}).Panicf("could not save key change")
+	}
+
+	userIDs, err := s.db.SharedUsers(context.TODO(), output.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", output.UserID).Error("failed to calculate users sharing rooms")
+		return nil
+	}
+	// The user's own devices need to hear about the change even if they
+	// aren't in any rooms yet.
+	userIDs = append(userIDs, output.UserID)
+
+	s.notifier.OnNewEvent(nil, "", userIDs, types.NewStreamToken(pduPos, 0, 0))
+
+	return nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+
+	"github.com/matrix-org/dendrite/internal/pushrules"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// evaluatePushRules runs the event through the push rules of every local
+// user in the room and updates their notification counts. It must be called
+// after the event has been written, so that the current room state includes
+// the event itself.
+func (s *OutputRoomEventConsumer) evaluatePushRules(ctx context.Context, ev *gomatrixserverlib.HeaderedEvent) error {
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	stateFilter.Types = []string{gomatrixserverlib.MRoomMember, gomatrixserverlib.MRoomPowerLevels}
+	stateEvents, err := s.db.GetStateEventsForRoom(ctx, ev.RoomID(), &stateFilter)
+	if err != nil {
+		return err
+	}
+	room := pushrules.NewRoomState(stateEvents)
+
+	// Sending an event into a room implies having read it.
+	if room.Members[ev.Sender()].Membership == gomatrixserverlib.Join {
+		if _, domain, err := gomatrixserverlib.SplitID('@', ev.Sender()); err == nil && domain == s.serverName {
+			if err = s.db.ResetNotificationCounts(ctx, ev.Sender(), ev.RoomID()); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, userID := range room.LocalTargets(s.serverName, ev) {
+		localpart, _, err := gomatrixserverlib.SplitID('@', userID)
+		if err != nil {
+			continue
+		}
+		ruleSets, err := pushrules.QueryAccountRuleSets(ctx, s.accountDB, localpart, s.serverName)
+		if err != nil {
+			log.WithError(err).WithField("user_id", userID).Error("failed to load push rules")
+			continue
+		}
+		rule, err := pushrules.NewRuleSetEvaluator(room.EvaluationContext(userID), &ruleSets.Global).MatchEvent(&ev.Event)
+		if err != nil {
+			// One user's broken push rules mustn't stop everyone else in the
+			// room from being notified.
+			log.WithError(err).WithField("user_id", userID).Error("failed to evaluate push rules")
+			continue
+		}
+		if rule == nil {
+			continue
+		}
+		notify, tweaks := pushrules.ActionsToTweaks(rule.Actions)
+		if !notify {
+			continue
+		}
+		if err = s.db.IncrementNotificationCounts(ctx, userID, ev.RoomID(), pushrules.IsHighlight(tweaks)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
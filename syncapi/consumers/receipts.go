@@ -0,0 +1,108 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputReceiptEventConsumer consumes receipt events that originated in the EDU server.
+type OutputReceiptEventConsumer struct {
+	receiptConsumer *internal.ContinualConsumer
+	db              storage.Database
+	notifier        *sync.Notifier
+}
+
+// NewOutputReceiptEventConsumer creates a new OutputReceiptEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputReceiptEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+) *OutputReceiptEventConsumer {
+
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputReceiptEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputReceiptEventConsumer{
+		receiptConsumer: &consumer,
+		db:              store,
+		notifier:        n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from EDU api
+func (s *OutputReceiptEventConsumer) Start() error {
+	return s.receiptConsumer.Start()
+}
+
+// onMessage is called when the sync server receives a receipt from the EDU
+// server. It stores the receipt and wakes up everyone joined to the room.
+func (s *OutputReceiptEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputReceiptEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"room_id":  output.RoomID,
+		"user_id":  output.UserID,
+		"event_id": output.EventID,
+		"type":     output.Type,
+	}).Debug("received receipt from EDU server")
+
+	receiptPos, err := s.db.StoreReceipt(context.TODO(), output)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"room_id":    output.RoomID,
+			"user_id":    output.UserID,
+			log.ErrorKey: err,
+		}).Panicf("could not store receipt")
+	}
+
+	// A read receipt marks the room as read, so clear the user's unread
+	// notifications. Remote users never have any notifications counted.
+	if err = s.db.ResetNotificationCounts(context.TODO(), output.UserID, output.RoomID); err != nil {
+		log.WithFields(log.Fields{
+			"room_id":    output.RoomID,
+			"user_id":    output.UserID,
+			log.ErrorKey: err,
+		}).Error("could not reset notification counts")
+	}
+
+	s.notifier.OnNewEvent(nil, output.RoomID, nil, types.NewStreamToken(0, 0, receiptPos))
+
+	return nil
+}
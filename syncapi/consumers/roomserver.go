@@ -20,6 +20,7 @@ import (
 	"fmt"
 
 	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -35,7 +36,9 @@ type OutputRoomEventConsumer struct {
 	rsAPI      api.RoomserverInternalAPI
 	rsConsumer *internal.ContinualConsumer
 	db         storage.Database
+	accountDB  accounts.Database
 	notifier   *sync.Notifier
+	serverName gomatrixserverlib.ServerName
 }
 
 // NewOutputRoomEventConsumer creates a new OutputRoomEventConsumer. Call Start() to begin consuming from room servers.
@@ -44,6 +47,7 @@ func NewOutputRoomEventConsumer(
 	kafkaConsumer sarama.Consumer,
 	n *sync.Notifier,
 	store storage.Database,
+	accountDB accounts.Database,
 	rsAPI api.RoomserverInternalAPI,
 ) *OutputRoomEventConsumer {
 
@@ -55,7 +59,9 @@ func NewOutputRoomEventConsumer(
 	s := &OutputRoomEventConsumer{
 		rsConsumer: &consumer,
 		db:         store,
+		accountDB:  accountDB,
 		notifier:   n,
+		serverName: cfg.Matrix.ServerName,
 		rsAPI:      rsAPI,
 	}
 	consumer.ProcessMessage = s.onMessage
@@ -87,6 +93,10 @@ func (s *OutputRoomEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
 		return s.onNewInviteEvent(context.TODO(), *output.NewInviteEvent)
 	case api.OutputTypeRetireInviteEvent:
 		return s.onRetireInviteEvent(context.TODO(), *output.RetireInviteEvent)
+	case api.OutputTypeRedactedEvent:
+		return s.onRedactEvent(context.TODO(), *output.RedactedEvent)
+	case api.OutputTypePurgeRoom:
+		return s.onPurgeRoom(context.TODO(), *output.PurgeRoom)
 	default:
 		log.WithField("type", output.Type).Debug(
 			"roomserver output log: ignoring unknown output type",
@@ -146,7 +156,12 @@ func (s *OutputRoomEventConsumer) onNewRoomEvent(
 		}).Panicf("roomserver output log: write event failure")
 		return nil
 	}
-	s.notifier.OnNewEvent(&ev, "", nil, types.NewStreamToken(pduPos, 0))
+
+	if err = s.evaluatePushRules(ctx, &ev); err != nil {
+		log.WithError(err).WithField("event_id", ev.EventID()).Error("failed to evaluate push rules")
+	}
+
+	s.notifier.OnNewEvent(&ev, "", nil, types.NewStreamToken(pduPos, 0, 0))
 
 	return nil
 }
@@ -164,7 +179,7 @@ func (s *OutputRoomEventConsumer) onNewInviteEvent(
 		}).Panicf("roomserver output log: write invite failure")
 		return nil
 	}
-	s.notifier.OnNewEvent(&msg.Event, "", nil, types.NewStreamToken(pduPos, 0))
+	s.notifier.OnNewEvent(&msg.Event, "", nil, types.NewStreamToken(pduPos, 0, 0))
 	return nil
 }
 
@@ -185,6 +200,33 @@ func (s *OutputRoomEventConsumer) onRetireInviteEvent(
 	return nil
 }
 
+func (s *OutputRoomEventConsumer) onRedactEvent(
+	ctx context.Context, msg api.OutputRedactedEvent,
+) error {
+	err := s.db.RedactEvent(ctx, msg.RedactedEventID, &msg.RedactedBecause)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"event_id":   msg.RedactedEventID,
+			log.ErrorKey: err,
+		}).Error("roomserver output log: failed to redact event")
+		return err
+	}
+	return nil
+}
+
+func (s *OutputRoomEventConsumer) onPurgeRoom(
+	ctx context.Context, msg api.OutputPurgeRoom,
+) error {
+	if err := s.db.PurgeRoom(ctx, msg.RoomID); err != nil {
+		log.WithFields(log.Fields{
+			"room_id":    msg.RoomID,
+			log.ErrorKey: err,
+		}).Error("roomserver output log: failed to purge room")
+		return err
+	}
+	return nil
+}
+
 // lookupStateEvents looks up the state events that are added by a new event.
 func (s *OutputRoomEventConsumer) lookupStateEvents(
 	addsStateEventIDs []string, event gomatrixserverlib.HeaderedEvent,
@@ -0,0 +1,136 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package consumers
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/Shopify/sarama"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/internal/config"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/sync"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	log "github.com/sirupsen/logrus"
+)
+
+// OutputSendToDeviceEventConsumer consumes send-to-device messages that
+// originated in the EDU server.
+type OutputSendToDeviceEventConsumer struct {
+	sendToDeviceConsumer *internal.ContinualConsumer
+	db                   storage.Database
+	deviceDB             devices.Database
+	serverName           gomatrixserverlib.ServerName
+	notifier             *sync.Notifier
+}
+
+// NewOutputSendToDeviceEventConsumer creates a new OutputSendToDeviceEventConsumer.
+// Call Start() to begin consuming from the EDU server.
+func NewOutputSendToDeviceEventConsumer(
+	cfg *config.Dendrite,
+	kafkaConsumer sarama.Consumer,
+	n *sync.Notifier,
+	store storage.Database,
+	deviceDB devices.Database,
+) *OutputSendToDeviceEventConsumer {
+
+	consumer := internal.ContinualConsumer{
+		Topic:          string(cfg.Kafka.Topics.OutputSendToDeviceEvent),
+		Consumer:       kafkaConsumer,
+		PartitionStore: store,
+	}
+
+	s := &OutputSendToDeviceEventConsumer{
+		sendToDeviceConsumer: &consumer,
+		db:                   store,
+		deviceDB:             deviceDB,
+		serverName:           cfg.Matrix.ServerName,
+		notifier:             n,
+	}
+
+	consumer.ProcessMessage = s.onMessage
+
+	return s
+}
+
+// Start consuming from the EDU server
+func (s *OutputSendToDeviceEventConsumer) Start() error {
+	return s.sendToDeviceConsumer.Start()
+}
+
+// onMessage is called when the sync server receives a send-to-device message
+// from the EDU server. Messages for local devices are stored until the device
+// next syncs. A device ID of "*" sends the message to all of the user's devices.
+func (s *OutputSendToDeviceEventConsumer) onMessage(msg *sarama.ConsumerMessage) error {
+	var output api.OutputSendToDeviceEvent
+	if err := json.Unmarshal(msg.Value, &output); err != nil {
+		// If the message was invalid, log it and move on to the next message in the stream
+		log.WithError(err).Errorf("EDU server output log: message parse failure")
+		return nil
+	}
+
+	localpart, domain, err := gomatrixserverlib.SplitID('@', output.UserID)
+	if err != nil {
+		log.WithError(err).WithField("user_id", output.UserID).Error("invalid send-to-device target")
+		return nil
+	}
+	if domain != s.serverName {
+		return nil
+	}
+
+	log.WithFields(log.Fields{
+		"sender":    output.Sender,
+		"user_id":   output.UserID,
+		"device_id": output.DeviceID,
+		"type":      output.Type,
+	}).Debug("received send-to-device message from EDU server")
+
+	deviceIDs := []string{output.DeviceID}
+	if output.DeviceID == "*" {
+		devs, err := s.deviceDB.GetDevicesByLocalpart(context.TODO(), localpart)
+		if err != nil {
+			log.WithError(err).WithField("user_id", output.UserID).Error("failed to get devices for user")
+			return nil
+		}
+		deviceIDs = deviceIDs[:0]
+		for _, dev := range devs {
+			deviceIDs = append(deviceIDs, dev.ID)
+		}
+	}
+
+	var pos types.StreamPosition
+	for _, deviceID := range deviceIDs {
+		pos, err = s.db.StoreNewSendForDeviceMessage(
+			context.TODO(), output.UserID, deviceID, output.SendToDeviceEvent,
+		)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"user_id":    output.UserID,
+				"device_id":  deviceID,
+				log.ErrorKey: err,
+			}).Panicf("could not store send-to-device message")
+		}
+	}
+
+	if pos > 0 {
+		s.notifier.OnNewEvent(nil, "", []string{output.UserID}, types.NewStreamToken(pos, 0, 0))
+	}
+
+	return nil
+}
@@ -0,0 +1,231 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const defaultContextLimit = 10
+
+type contextResp struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	Event        gomatrixserverlib.ClientEvent   `json:"event"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	State        []gomatrixserverlib.ClientEvent `json:"state"`
+}
+
+// Context implements GET /rooms/{roomID}/context/{eventID}
+// The limit is split evenly between the events before and after the event,
+// and the state is the state of the room at the last event returned.
+func Context(
+	req *http.Request, device *authtypes.Device, db storage.Database, rsAPI api.RoomserverInternalAPI,
+	roomID, eventID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	limit := defaultContextLimit
+	if s := req.URL.Query().Get("limit"); len(s) > 0 {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("limit must be a non-negative integer"),
+			}
+		}
+	}
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	if s := req.URL.Query().Get("filter"); len(s) > 0 {
+		if err := json.Unmarshal([]byte(s), &filter); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("filter could not be parsed: " + err.Error()),
+			}
+		}
+	}
+
+	notFound := util.JSONResponse{
+		Code: http.StatusNotFound,
+		JSON: jsonerror.NotFound("The event was not found or you do not have permission to read this event"),
+	}
+	events, err := db.Events(ctx, []string{eventID})
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	if len(events) == 0 || events[0].RoomID() != roomID {
+		return notFound
+	}
+	event := events[0]
+	if visible, err := visibleEvents(ctx, rsAPI, device.UserID, events); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("visibleEvents failed")
+		return jsonerror.InternalServerError()
+	} else if len(visible) == 0 {
+		return notFound
+	}
+
+	// If the filter excludes the room then only the event itself is returned.
+	beforeLimit, afterLimit := limit/2, limit-limit/2
+	if !types.FilterAllowsRoom(roomID, filter.Rooms, filter.NotRooms) {
+		beforeLimit, afterLimit = 0, 0
+	}
+	before, after, start, end, err := eventsAround(ctx, db, rsAPI, device.UserID, &event, filter, beforeLimit, afterLimit)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("eventsAround failed")
+		return jsonerror.InternalServerError()
+	}
+
+	lastEventID := eventID
+	if len(after) > 0 {
+		lastEventID = after[len(after)-1].EventID()
+	}
+	var stateRes api.QueryStateAndAuthChainResponse
+	if err = rsAPI.QueryStateAndAuthChain(ctx, &api.QueryStateAndAuthChainRequest{
+		RoomID:       roomID,
+		PrevEventIDs: []string{lastEventID},
+	}, &stateRes); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rsAPI.QueryStateAndAuthChain failed")
+		return jsonerror.InternalServerError()
+	}
+	state := stateRes.StateEvents
+	if filter.LazyLoadMembers {
+		state = membersOfSenders(state, append(append([]gomatrixserverlib.HeaderedEvent{event}, before...), after...))
+	}
+
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: contextResp{
+			Start:        start.String(),
+			End:          end.String(),
+			EventsBefore: gomatrixserverlib.HeaderedToClientEvents(before, gomatrixserverlib.FormatAll),
+			Event:        gomatrixserverlib.HeaderedToClientEvent(event, gomatrixserverlib.FormatAll),
+			EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(after, gomatrixserverlib.FormatAll),
+			State:        gomatrixserverlib.HeaderedToClientEvents(state, gomatrixserverlib.FormatAll),
+		},
+	}
+}
+
+// eventsAround returns up to the given numbers of events before and after the
+// event which match the filter, along with tokens which can be passed to
+// /messages to paginate further. The events before are in reverse
+// chronological order. Events which the user isn't allowed to see are removed
+// after the tokens are worked out, so that paginating skips past them too.
+func eventsAround(
+	ctx context.Context, db storage.Database, rsAPI api.RoomserverInternalAPI, userID string,
+	event *gomatrixserverlib.HeaderedEvent, filter gomatrixserverlib.RoomEventFilter, beforeLimit, afterLimit int,
+) (before, after []gomatrixserverlib.HeaderedEvent, start, end types.TopologyToken, err error) {
+	roomID := event.RoomID()
+	position, err := db.EventPositionInTopology(ctx, event.EventID())
+	if err != nil {
+		err = fmt.Errorf("db.EventPositionInTopology: %w", err)
+		return
+	}
+
+	// The range going backwards includes the event itself, so ask for one
+	// more and then remove it.
+	filter.Limit = beforeLimit + 1
+	earliest := types.NewTopologyToken(0, 0)
+	beforeStream, err := db.GetEventsInTopologicalRange(ctx, &position, &earliest, roomID, &filter, true)
+	if err != nil {
+		err = fmt.Errorf("db.GetEventsInTopologicalRange: %w", err)
+		return
+	}
+	before = withoutEvent(db.StreamEventsToEvents(nil, beforeStream), event.EventID())
+	if len(before) > beforeLimit {
+		before = before[:beforeLimit]
+	}
+
+	// The range going forwards excludes the upper bound, so go one past the
+	// latest event.
+	latest, err := db.MaxTopologicalPosition(ctx, roomID)
+	if err != nil {
+		err = fmt.Errorf("db.MaxTopologicalPosition: %w", err)
+		return
+	}
+	latest = types.NewTopologyToken(latest.Depth()+1, 0)
+	filter.Limit = afterLimit
+	afterStream, err := db.GetEventsInTopologicalRange(ctx, &position, &latest, roomID, &filter, false)
+	if err != nil {
+		err = fmt.Errorf("db.GetEventsInTopologicalRange: %w", err)
+		return
+	}
+	after = withoutEvent(db.StreamEventsToEvents(nil, afterStream), event.EventID())
+
+	start, end = position, position
+	if len(before) > 0 {
+		if start, err = db.EventPositionInTopology(ctx, before[len(before)-1].EventID()); err != nil {
+			err = fmt.Errorf("db.EventPositionInTopology: %w", err)
+			return
+		}
+	}
+	// Paginating backwards from a token includes the event at it.
+	start.Decrement()
+	if len(after) > 0 {
+		if end, err = db.EventPositionInTopology(ctx, after[len(after)-1].EventID()); err != nil {
+			err = fmt.Errorf("db.EventPositionInTopology: %w", err)
+			return
+		}
+	}
+
+	if before, err = visibleEvents(ctx, rsAPI, userID, before); err != nil {
+		return
+	}
+	after, err = visibleEvents(ctx, rsAPI, userID, after)
+	return
+}
+
+// membersOfSenders returns the membership events in the state for the
+// senders of the given events, for filters which lazy-load members.
+func membersOfSenders(
+	state, events []gomatrixserverlib.HeaderedEvent,
+) []gomatrixserverlib.HeaderedEvent {
+	senders := make(map[string]bool, len(events))
+	for _, ev := range events {
+		senders[ev.Sender()] = true
+	}
+	result := []gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range state {
+		if ev.Type() != gomatrixserverlib.MRoomMember {
+			result = append(result, ev)
+		} else if ev.StateKey() != nil && senders[*ev.StateKey()] {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
+
+// withoutEvent returns the events other than the one with the given ID.
+func withoutEvent(events []gomatrixserverlib.HeaderedEvent, eventID string) []gomatrixserverlib.HeaderedEvent {
+	result := make([]gomatrixserverlib.HeaderedEvent, 0, len(events))
+	for _, ev := range events {
+		if ev.EventID() != eventID {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
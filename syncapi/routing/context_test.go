@@ -0,0 +1,130 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func mustPosition(t *testing.T, db storage.Database, eventID string) types.TopologyToken {
+	position, err := db.EventPositionInTopology(context.Background(), eventID)
+	if err != nil {
+		t.Fatalf("EventPositionInTopology returned %s", err)
+	}
+	return position
+}
+
+func TestEventsAround(t *testing.T) {
+	tests := []struct {
+		name                    string
+		eventID                 string
+		beforeLimit, afterLimit int
+		hidden                  []string
+		wantBefore, wantAfter   []string
+		wantStart, wantEnd      string
+	}{
+		{
+			name:    "events either side",
+			eventID: "$5:localhost", beforeLimit: 2, afterLimit: 2,
+			wantBefore: []string{"$4:localhost", "$3:localhost"},
+			wantAfter:  []string{"$6:localhost", "$7:localhost"},
+			wantStart:  "$3:localhost", wantEnd: "$7:localhost",
+		},
+		{
+			name:    "no limit",
+			eventID: "$5:localhost", beforeLimit: 0, afterLimit: 0,
+			wantBefore: []string{},
+			wantAfter:  []string{},
+			wantStart:  "$5:localhost", wantEnd: "$5:localhost",
+		},
+		{
+			name:    "start of the room",
+			eventID: "$2:localhost", beforeLimit: 3, afterLimit: 1,
+			wantBefore: []string{"$1:localhost"},
+			wantAfter:  []string{"$3:localhost"},
+			wantStart:  "$1:localhost", wantEnd: "$3:localhost",
+		},
+		{
+			name:    "end of the room",
+			eventID: "$9:localhost", beforeLimit: 1, afterLimit: 3,
+			wantBefore: []string{"$8:localhost"},
+			wantAfter:  []string{"$10:localhost"},
+			wantStart:  "$8:localhost", wantEnd: "$10:localhost",
+		},
+		{
+			name:    "hidden events are skipped by the tokens",
+			eventID: "$5:localhost", beforeLimit: 2, afterLimit: 2,
+			hidden:     []string{"$3:localhost", "$6:localhost"},
+			wantBefore: []string{"$4:localhost"},
+			wantAfter:  []string{"$7:localhost"},
+			wantStart:  "$3:localhost", wantEnd: "$7:localhost",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := sqlite3.NewDatabase("file::memory:")
+			if err != nil {
+				t.Fatalf("NewDatabase returned %s", err)
+			}
+			ctx := context.Background()
+			mustWriteMessages(t, db, 10)
+			events, err := db.Events(ctx, []string{tt.eventID})
+			if err != nil || len(events) != 1 {
+				t.Fatalf("Events returned %v, %v", events, err)
+			}
+			hidden := make(map[string]bool)
+			for _, eventID := range tt.hidden {
+				hidden[eventID] = true
+			}
+			rsAPI := &visibilityRoomserverAPI{hidden: hidden}
+
+			before, after, start, end, err := eventsAround(
+				ctx, db, rsAPI, "@bob:localhost", &events[0],
+				gomatrixserverlib.DefaultRoomEventFilter(), tt.beforeLimit, tt.afterLimit,
+			)
+			if err != nil {
+				t.Fatalf("eventsAround returned %s", err)
+			}
+			gotBefore, gotAfter := []string{}, []string{}
+			for _, ev := range before {
+				gotBefore = append(gotBefore, ev.EventID())
+			}
+			for _, ev := range after {
+				gotAfter = append(gotAfter, ev.EventID())
+			}
+			if !reflect.DeepEqual(gotBefore, tt.wantBefore) {
+				t.Errorf("eventsAround returned before %v, want %v", gotBefore, tt.wantBefore)
+			}
+			if !reflect.DeepEqual(gotAfter, tt.wantAfter) {
+				t.Errorf("eventsAround returned after %v, want %v", gotAfter, tt.wantAfter)
+			}
+			wantStart := mustPosition(t, db, tt.wantStart)
+			wantStart.Decrement()
+			if start.String() != wantStart.String() {
+				t.Errorf("eventsAround returned start %s, want the position before %s", start.String(), tt.wantStart)
+			}
+			if wantEnd := mustPosition(t, db, tt.wantEnd); end.String() != wantEnd.String() {
+				t.Errorf("eventsAround returned end %s, want the position of %s", end.String(), tt.wantEnd)
+			}
+		})
+	}
+}
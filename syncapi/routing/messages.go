@@ -16,11 +16,13 @@ package routing
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"sort"
 	"strconv"
 
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
 	"github.com/matrix-org/dendrite/internal/config"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -33,6 +35,7 @@ import (
 
 type messagesReq struct {
 	ctx              context.Context
+	device           *authtypes.Device
 	db               storage.Database
 	rsAPI            api.RoomserverInternalAPI
 	federation       *gomatrixserverlib.FederationClient
@@ -43,6 +46,7 @@ type messagesReq struct {
 	fromStream       *types.StreamingToken
 	wasToProvided    bool
 	limit            int
+	filter           *gomatrixserverlib.RoomEventFilter
 	backwardOrdering bool
 }
 
@@ -50,6 +54,7 @@ type messagesResp struct {
 	Start string                          `json:"start"`
 	End   string                          `json:"end"`
 	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	State []gomatrixserverlib.ClientEvent `json:"state,omitempty"`
 }
 
 const defaultMessagesLimit = 10
@@ -58,7 +63,7 @@ const defaultMessagesLimit = 10
 // client-server API.
 // See: https://matrix.org/docs/spec/client_server/latest.html#get-matrix-client-r0-rooms-roomid-messages
 func OnIncomingMessagesRequest(
-	req *http.Request, db storage.Database, roomID string,
+	req *http.Request, device *authtypes.Device, db storage.Database, roomID string,
 	federation *gomatrixserverlib.FederationClient,
 	rsAPI api.RoomserverInternalAPI,
 	cfg *config.Dendrite,
@@ -128,7 +133,19 @@ func OnIncomingMessagesRequest(
 			}
 		}
 	}
-	// TODO: Implement filtering (#587)
+
+	// The filter is applied on top of the default one, and the number of
+	// events to return is always taken from the limit parameter.
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	if s := req.URL.Query().Get("filter"); len(s) > 0 {
+		if err = json.Unmarshal([]byte(s), &filter); err != nil {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("filter could not be parsed: " + err.Error()),
+			}
+		}
+	}
+	filter.Limit = limit
 
 	// Check the room ID's format.
 	if _, _, err = gomatrixserverlib.SplitID('!', roomID); err != nil {
@@ -140,6 +157,7 @@ func OnIncomingMessagesRequest(
 
 	mReq := messagesReq{
 		ctx:              req.Context(),
+		device:           device,
 		db:               db,
 		rsAPI:            rsAPI,
 		federation:       federation,
@@ -150,14 +168,38 @@ func OnIncomingMessagesRequest(
 		fromStream:       fromStream,
 		wasToProvided:    wasToProvided,
 		limit:            limit,
+		filter:           &filter,
 		backwardOrdering: backwardOrdering,
 	}
 
-	clientEvents, start, end, err := mReq.retrieveEvents()
+	// If the filter excludes the room then there is nothing to return.
+	if !types.FilterAllowsRoom(roomID, filter.Rooms, filter.NotRooms) {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: messagesResp{
+				Chunk: []gomatrixserverlib.ClientEvent{},
+				Start: from.String(),
+				End:   from.String(),
+			},
+		}
+	}
+
+	clientEvents, start, end, err := mReq.retrieveVisibleEvents()
 	if err != nil {
-		util.GetLogger(req.Context()).WithError(err).Error("mreq.retrieveEvents failed")
+		util.GetLogger(req.Context()).WithError(err).Error("mreq.retrieveVisibleEvents failed")
 		return jsonerror.InternalServerError()
 	}
+
+	// If members are lazy-loaded then the membership events of the senders
+	// of the events are sent along with them.
+	var state []gomatrixserverlib.ClientEvent
+	if filter.LazyLoadMembers {
+		state, err = mReq.membersForEvents(clientEvents)
+		if err != nil {
+			util.GetLogger(req.Context()).WithError(err).Error("mreq.membersForEvents failed")
+			return jsonerror.InternalServerError()
+		}
+	}
 	util.GetLogger(req.Context()).WithFields(logrus.Fields{
 		"from":         from.String(),
 		"to":           to.String(),
@@ -174,6 +216,7 @@ func OnIncomingMessagesRequest(
 			Chunk: clientEvents,
 			Start: start.String(),
 			End:   end.String(),
+			State: state,
 		},
 	}
 }
@@ -192,11 +235,11 @@ func (r *messagesReq) retrieveEvents() (
 	if r.fromStream != nil {
 		toStream := r.to.StreamToken()
 		streamEvents, err = r.db.GetEventsInStreamingRange(
-			r.ctx, r.fromStream, &toStream, r.roomID, r.limit, r.backwardOrdering,
+			r.ctx, r.fromStream, &toStream, r.roomID, r.filter, r.backwardOrdering,
 		)
 	} else {
 		streamEvents, err = r.db.GetEventsInTopologicalRange(
-			r.ctx, r.from, r.to, r.roomID, r.limit, r.backwardOrdering,
+			r.ctx, r.from, r.to, r.roomID, r.filter, r.backwardOrdering,
 		)
 	}
 	if err != nil {
@@ -220,6 +263,9 @@ func (r *messagesReq) retrieveEvents() (
 		}
 	}
 
+	// Events fetched from other servers haven't been filtered yet.
+	events = types.FilterRoomEvents(events, r.filter)
+
 	// If we didn't get any event, we don't need to proceed any further.
 	if len(events) == 0 {
 		return []gomatrixserverlib.ClientEvent{}, *r.from, *r.to, nil
@@ -273,6 +319,80 @@ func (r *messagesReq) retrieveEvents() (
 	return clientEvents, start, end, err
 }
 
+// maxHistoryVisibilityPages is how many pages of events are retrieved to make
+// up for events which the user isn't allowed to see, before giving up and
+// returning fewer events than the limit.
+const maxHistoryVisibilityPages = 4
+
+// retrieveVisibleEvents retrieves the events which the user is allowed to see,
+// according to the history visibility of the room. If some of the events are
+// hidden then it carries on paginating from where the previous page ended,
+// just as the client would, until the limit is filled.
+func (r *messagesReq) retrieveVisibleEvents() (
+	clientEvents []gomatrixserverlib.ClientEvent, start,
+	end types.TopologyToken, err error,
+) {
+	limit := r.limit
+	clientEvents = []gomatrixserverlib.ClientEvent{}
+	for page := 0; page < maxHistoryVisibilityPages; page++ {
+		var events []gomatrixserverlib.ClientEvent
+		var pageStart, pageEnd types.TopologyToken
+		events, pageStart, pageEnd, err = r.retrieveEvents()
+		if err != nil {
+			return
+		}
+		if page == 0 {
+			start, end = pageStart, pageEnd
+		}
+		if len(events) == 0 {
+			break
+		}
+		end = pageEnd
+
+		// Remove the events which the user isn't allowed to see. This is done
+		// after working out the tokens so that the client can paginate past them.
+		var visible []gomatrixserverlib.ClientEvent
+		if visible, err = r.applyHistoryVisibility(events); err != nil {
+			return
+		}
+		clientEvents = append(clientEvents, visible...)
+		if len(visible) == len(events) || len(clientEvents) >= limit {
+			break
+		}
+
+		// Carry on from the end of this page for the rest of the events.
+		r.from, r.fromStream = &pageEnd, nil
+		r.limit = limit - len(clientEvents)
+		r.filter.Limit = r.limit
+	}
+	return
+}
+
+// applyHistoryVisibility returns the events which the user is allowed to see,
+// according to the history visibility of the room.
+func (r *messagesReq) applyHistoryVisibility(
+	events []gomatrixserverlib.ClientEvent,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID
+	}
+	var allowedRes api.QueryUserAllowedToSeeEventsResponse
+	if err := r.rsAPI.QueryUserAllowedToSeeEvents(r.ctx, &api.QueryUserAllowedToSeeEventsRequest{
+		EventIDs: eventIDs,
+		UserID:   r.device.UserID,
+	}, &allowedRes); err != nil {
+		return nil, fmt.Errorf("QueryUserAllowedToSeeEvents: %w", err)
+	}
+	result := []gomatrixserverlib.ClientEvent{}
+	for _, ev := range events {
+		if allowedRes.AllowedToSeeEvents[ev.EventID] {
+			result = append(result, ev)
+		}
+	}
+	return result, nil
+}
+
 // handleEmptyEventsSlice handles the case where the initial request to the
 // database returned an empty slice of events. It does so by checking whether
 // the set is empty because we've reached a backward extremity, and if that is
@@ -423,6 +543,52 @@ func (r *messagesReq) backfill(roomID string, backwardsExtremities map[string][]
 	return events, nil
 }
 
+// membersForEvents returns the membership events of the senders of the given
+// events, for filters which lazy-load members. The memberships are taken from
+// the state of the room before the earliest of the events, so that they are
+// the ones which applied when the events were sent.
+func (r *messagesReq) membersForEvents(
+	events []gomatrixserverlib.ClientEvent,
+) ([]gomatrixserverlib.ClientEvent, error) {
+	if len(events) == 0 {
+		return []gomatrixserverlib.ClientEvent{}, nil
+	}
+	earliest := events[0]
+	if r.backwardOrdering {
+		earliest = events[len(events)-1]
+	}
+	earliestEvents, err := r.db.Events(r.ctx, []string{earliest.EventID})
+	if err != nil {
+		return nil, err
+	}
+	if len(earliestEvents) == 0 {
+		return nil, fmt.Errorf("event %s not found", earliest.EventID)
+	}
+
+	seen := make(map[string]bool)
+	var stateToFetch []gomatrixserverlib.StateKeyTuple
+	for _, ev := range events {
+		if seen[ev.Sender] {
+			continue
+		}
+		seen[ev.Sender] = true
+		stateToFetch = append(stateToFetch, gomatrixserverlib.StateKeyTuple{
+			EventType: gomatrixserverlib.MRoomMember,
+			StateKey:  ev.Sender,
+		})
+	}
+	var res api.QueryStateAfterEventsResponse
+	err = r.rsAPI.QueryStateAfterEvents(r.ctx, &api.QueryStateAfterEventsRequest{
+		RoomID:       r.roomID,
+		PrevEventIDs: earliestEvents[0].PrevEventIDs(),
+		StateToFetch: stateToFetch,
+	}, &res)
+	if err != nil {
+		return nil, fmt.Errorf("QueryStateAfterEvents failed: %w", err)
+	}
+	return gomatrixserverlib.HeaderedToClientEvents(res.StateEvents, gomatrixserverlib.FormatAll), nil
+}
+
 // setToDefault returns the default value for the "to" query parameter of a
 // request to /messages if not provided. It defaults to either the earliest
 // topological position (if we're going backward) or to the latest one (if we're
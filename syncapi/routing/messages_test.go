@@ -0,0 +1,229 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const testRoomID = "!messages:localhost"
+
+// visibilityRoomserverAPI hides the given events from everyone.
+type visibilityRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	hidden map[string]bool
+}
+
+func (a *visibilityRoomserverAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	req *api.QueryUserAllowedToSeeEventsRequest,
+	res *api.QueryUserAllowedToSeeEventsResponse,
+) error {
+	res.AllowedToSeeEvents = make(map[string]bool, len(req.EventIDs))
+	for _, eventID := range req.EventIDs {
+		res.AllowedToSeeEvents[eventID] = !a.hidden[eventID]
+	}
+	return nil
+}
+
+// mustWriteMessages writes a chain of messages to the room, with event IDs
+// $1:localhost to $n:localhost.
+func mustWriteMessages(t *testing.T, db storage.Database, n int) {
+	for i := 1; i <= n; i++ {
+		prevEvents := "[]"
+		if i > 1 {
+			prevEvents = fmt.Sprintf(`[["$%d:localhost",{"sha256":"abc"}]]`, i-1)
+		}
+		eventJSON := fmt.Sprintf(
+			`{"auth_events":[],"content":{"body":"%d"},"depth":%d,"event_id":"$%d:localhost","hashes":{"sha256":"abc"},"origin":"localhost","origin_server_ts":%d,"prev_events":%s,"room_id":%q,"sender":"@alice:localhost","signatures":{},"type":"m.room.message"}`,
+			i, i, i, i, prevEvents, testRoomID,
+		)
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("NewEventFromTrustedJSON returned %s", err)
+		}
+		headered := ev.Headered(gomatrixserverlib.RoomVersionV1)
+		if _, err = db.WriteEvent(context.Background(), &headered, nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent returned %s", err)
+		}
+	}
+}
+
+func TestRetrieveVisibleEvents(t *testing.T) {
+	tests := []struct {
+		name       string
+		hidden     []string
+		wantEvents []string
+		wantEnd    string
+	}{
+		{
+			name:       "nothing hidden",
+			wantEvents: []string{"$10:localhost", "$9:localhost", "$8:localhost"},
+			wantEnd:    "$8:localhost",
+		},
+		{
+			name:       "hidden events are made up for",
+			hidden:     []string{"$9:localhost", "$7:localhost"},
+			wantEvents: []string{"$10:localhost", "$8:localhost", "$6:localhost"},
+			wantEnd:    "$6:localhost",
+		},
+		{
+			name:       "everything hidden",
+			hidden:     []string{"$1:localhost", "$2:localhost", "$3:localhost", "$4:localhost", "$5:localhost", "$6:localhost", "$7:localhost", "$8:localhost", "$9:localhost", "$10:localhost"},
+			wantEvents: nil,
+			wantEnd:    "$1:localhost",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := sqlite3.NewDatabase("file::memory:")
+			if err != nil {
+				t.Fatalf("NewDatabase returned %s", err)
+			}
+			ctx := context.Background()
+			mustWriteMessages(t, db, 10)
+			from, err := db.MaxTopologicalPosition(ctx, testRoomID)
+			if err != nil {
+				t.Fatalf("MaxTopologicalPosition returned %s", err)
+			}
+			to := types.NewTopologyToken(0, 0)
+			filter := gomatrixserverlib.DefaultRoomEventFilter()
+			filter.Limit = 3
+
+			hidden := make(map[string]bool)
+			for _, eventID := range tt.hidden {
+				hidden[eventID] = true
+			}
+			r := messagesReq{
+				ctx:              ctx,
+				device:           &authtypes.Device{UserID: "@bob:localhost"},
+				db:               db,
+				rsAPI:            &visibilityRoomserverAPI{hidden: hidden},
+				roomID:           testRoomID,
+				from:             &from,
+				to:               &to,
+				wasToProvided:    false,
+				limit:            filter.Limit,
+				filter:           &filter,
+				backwardOrdering: true,
+			}
+			events, _, end, err := r.retrieveVisibleEvents()
+			if err != nil {
+				t.Fatalf("retrieveVisibleEvents returned %s", err)
+			}
+			var got []string
+			for _, ev := range events {
+				got = append(got, ev.EventID)
+			}
+			if !reflect.DeepEqual(got, tt.wantEvents) {
+				t.Fatalf("retrieveVisibleEvents returned %v, want %v", got, tt.wantEvents)
+			}
+			wantEnd, err := db.EventPositionInTopology(ctx, tt.wantEnd)
+			if err != nil {
+				t.Fatalf("EventPositionInTopology returned %s", err)
+			}
+			wantEnd.Decrement()
+			if end.String() != wantEnd.String() {
+				t.Fatalf("retrieveVisibleEvents returned end %s, want the position before %s", end.String(), tt.wantEnd)
+			}
+		})
+	}
+}
+
+// stateRoomserverAPI records the state which was asked for and returns no
+// events.
+type stateRoomserverAPI struct {
+	api.RoomserverInternalAPI
+	req *api.QueryStateAfterEventsRequest
+}
+
+func (a *stateRoomserverAPI) QueryStateAfterEvents(
+	ctx context.Context,
+	req *api.QueryStateAfterEventsRequest,
+	res *api.QueryStateAfterEventsResponse,
+) error {
+	a.req = req
+	res.RoomExists = true
+	res.PrevEventsExist = true
+	return nil
+}
+
+func TestMembersForEvents(t *testing.T) {
+	tests := []struct {
+		name             string
+		backwardOrdering bool
+		eventIDs         []string
+		wantPrevEventIDs []string
+	}{
+		{
+			name:             "backward",
+			backwardOrdering: true,
+			eventIDs:         []string{"$10:localhost", "$9:localhost", "$8:localhost"},
+			wantPrevEventIDs: []string{"$7:localhost"},
+		},
+		{
+			name:             "forward",
+			backwardOrdering: false,
+			eventIDs:         []string{"$3:localhost", "$4:localhost", "$5:localhost"},
+			wantPrevEventIDs: []string{"$2:localhost"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := sqlite3.NewDatabase("file::memory:")
+			if err != nil {
+				t.Fatalf("NewDatabase returned %s", err)
+			}
+			mustWriteMessages(t, db, 10)
+			rsAPI := &stateRoomserverAPI{}
+			r := messagesReq{
+				ctx:              context.Background(),
+				db:               db,
+				rsAPI:            rsAPI,
+				roomID:           testRoomID,
+				backwardOrdering: tt.backwardOrdering,
+			}
+			var events []gomatrixserverlib.ClientEvent
+			for _, eventID := range tt.eventIDs {
+				events = append(events, gomatrixserverlib.ClientEvent{EventID: eventID, Sender: "@alice:localhost"})
+			}
+			if _, err = r.membersForEvents(events); err != nil {
+				t.Fatalf("membersForEvents returned %s", err)
+			}
+			if rsAPI.req == nil {
+				t.Fatalf("membersForEvents didn't query the state")
+			}
+			if !reflect.DeepEqual(rsAPI.req.PrevEventIDs, tt.wantPrevEventIDs) {
+				t.Fatalf("membersForEvents queried the state after %v, want %v", rsAPI.req.PrevEventIDs, tt.wantPrevEventIDs)
+			}
+			wantStateToFetch := []gomatrixserverlib.StateKeyTuple{
+				{EventType: gomatrixserverlib.MRoomMember, StateKey: "@alice:localhost"},
+			}
+			if !reflect.DeepEqual(rsAPI.req.StateToFetch, wantStateToFetch) {
+				t.Fatalf("membersForEvents queried %v, want %v", rsAPI.req.StateToFetch, wantStateToFetch)
+			}
+		})
+	}
+}
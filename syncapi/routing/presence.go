@@ -0,0 +1,48 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/eduserver/cache"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/util"
+)
+
+// GetPresence implements GET /presence/{userID}/status
+// Users we have never seen any presence for are offline.
+func GetPresence(
+	req *http.Request, syncDB storage.Database, userID string,
+) util.JSONResponse {
+	presence, err := syncDB.GetPresence(req.Context(), userID)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("syncDB.GetPresence failed")
+		return jsonerror.InternalServerError()
+	}
+	if presence == nil {
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: types.PresenceContent{Presence: cache.PresenceOffline},
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: types.NewPresenceContent(presence, time.Now()),
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"github.com/gorilla/mux"
 	"github.com/matrix-org/dendrite/clientapi/auth"
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/internal/config"
@@ -39,28 +40,63 @@ const pathPrefixR0 = "/_matrix/client/r0"
 // nolint: gocyclo
 func Setup(
 	apiMux *mux.Router, srp *sync.RequestPool, syncDB storage.Database,
-	deviceDB devices.Database, federation *gomatrixserverlib.FederationClient,
+	deviceDB devices.Database, accountDB accounts.Database, federation *gomatrixserverlib.FederationClient,
 	rsAPI api.RoomserverInternalAPI,
 	cfg *config.Dendrite,
 ) {
 	r0mux := apiMux.PathPrefix(pathPrefixR0).Subrouter()
 
 	authData := auth.Data{
-		AccountDB:   nil,
+		AccountDB:   accountDB,
 		DeviceDB:    deviceDB,
-		AppServices: nil,
+		AppServices: cfg.AppServices,
 	}
 
-	// TODO: Add AS support for all handlers below.
-	r0mux.Handle("/sync", internal.MakeAuthAPI("sync", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	r0mux.Handle("/sync", internal.MakeGuestAuthAPI("sync", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 		return srp.OnIncomingSyncRequest(req, device)
 	})).Methods(http.MethodGet, http.MethodOptions)
 
-	r0mux.Handle("/rooms/{roomID}/messages", internal.MakeAuthAPI("room_messages", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	r0mux.Handle("/rooms/{roomID}/messages", internal.MakeGuestAuthAPI("room_messages", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
 		vars, err := internal.URLDecodeMapValues(mux.Vars(req))
 		if err != nil {
 			return util.ErrorResponse(err)
 		}
-		return OnIncomingMessagesRequest(req, syncDB, vars["roomID"], federation, rsAPI, cfg)
+		return OnIncomingMessagesRequest(req, device, syncDB, vars["roomID"], federation, rsAPI, cfg)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/initialSync", internal.MakeGuestAuthAPI("rooms_initial_sync", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := internal.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return srp.OnIncomingRoomInitialSyncRequest(req, device, vars["roomID"])
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/events", internal.MakeGuestAuthAPI("events", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return srp.OnIncomingEventsRequest(req, device)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/rooms/{roomID}/context/{eventID}", internal.MakeGuestAuthAPI("context", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := internal.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return Context(req, device, syncDB, rsAPI, vars["roomID"], vars["eventID"])
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/search", internal.MakeAuthAPI("search", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return Search(req, device, syncDB, rsAPI)
+	})).Methods(http.MethodPost, http.MethodOptions)
+
+	r0mux.Handle("/keys/changes", internal.MakeGuestAuthAPI("keys_changes", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		return srp.OnIncomingKeyChangeRequest(req, device)
+	})).Methods(http.MethodGet, http.MethodOptions)
+
+	r0mux.Handle("/presence/{userID}/status", internal.MakeGuestAuthAPI("get_presence", authData, func(req *http.Request, device *authtypes.Device) util.JSONResponse {
+		vars, err := internal.URLDecodeMapValues(mux.Vars(req))
+		if err != nil {
+			return util.ErrorResponse(err)
+		}
+		return GetPresence(req, syncDB, vars["userID"])
 	})).Methods(http.MethodGet, http.MethodOptions)
 }
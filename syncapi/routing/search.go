@@ -0,0 +1,427 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/httputil"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultSearchLimit        = 10
+	defaultSearchContextLimit = 5
+	searchOrderByRank         = "rank"
+	searchOrderByRecent       = "recent"
+	// maxSearchLimit caps the number of results in a page, as every result
+	// needs a visibility check and possibly its context loading.
+	maxSearchLimit = 50
+)
+
+type searchRequest struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsCriteria `json:"room_events"`
+	} `json:"search_categories"`
+}
+
+type roomEventsCriteria struct {
+	SearchTerm   string                            `json:"search_term"`
+	Keys         []string                          `json:"keys"`
+	Filter       gomatrixserverlib.RoomEventFilter `json:"filter"`
+	OrderBy      string                            `json:"order_by"`
+	EventContext *searchEventContext               `json:"event_context"`
+	IncludeState bool                              `json:"include_state"`
+	Groupings    struct {
+		GroupBy []struct {
+			Key string `json:"key"`
+		} `json:"group_by"`
+	} `json:"groupings"`
+}
+
+type searchEventContext struct {
+	BeforeLimit    int  `json:"before_limit"`
+	AfterLimit     int  `json:"after_limit"`
+	IncludeProfile bool `json:"include_profile"`
+}
+
+type searchResponse struct {
+	SearchCategories struct {
+		RoomEvents *roomEventsResults `json:"room_events,omitempty"`
+	} `json:"search_categories"`
+}
+
+type roomEventsResults struct {
+	// Count is an estimate which includes matches that the user can't see,
+	// as checking the visibility of every match would be too expensive.
+	Count      int                                        `json:"count"`
+	Highlights []string                                   `json:"highlights"`
+	Results    []searchResult                             `json:"results"`
+	State      map[string][]gomatrixserverlib.ClientEvent `json:"state,omitempty"`
+	Groups     map[string]map[string]*searchGroup         `json:"groups,omitempty"`
+	NextBatch  string                                     `json:"next_batch,omitempty"`
+}
+
+type searchResult struct {
+	Rank    float64                       `json:"rank"`
+	Result  gomatrixserverlib.ClientEvent `json:"result"`
+	Context *searchResultContext          `json:"context,omitempty"`
+}
+
+type searchResultContext struct {
+	Start        string                          `json:"start"`
+	End          string                          `json:"end"`
+	EventsBefore []gomatrixserverlib.ClientEvent `json:"events_before"`
+	EventsAfter  []gomatrixserverlib.ClientEvent `json:"events_after"`
+	ProfileInfo  map[string]searchUserProfile    `json:"profile_info,omitempty"`
+}
+
+type searchUserProfile struct {
+	DisplayName string `json:"displayname,omitempty"`
+	AvatarURL   string `json:"avatar_url,omitempty"`
+}
+
+type searchGroup struct {
+	NextBatch string   `json:"next_batch,omitempty"`
+	Order     int      `json:"order"`
+	Results   []string `json:"results"`
+}
+
+// Search implements POST /search
+// Only the room_events category is supported. Rooms which the user has left
+// are searched too, as history visibility decides what they can see there.
+// nolint:gocyclo
+func Search(
+	req *http.Request, device *authtypes.Device, db storage.Database, rsAPI api.RoomserverInternalAPI,
+) util.JSONResponse {
+	ctx := req.Context()
+	offset := 0
+	if nextBatch := req.URL.Query().Get("next_batch"); nextBatch != "" {
+		var err error
+		if offset, err = strconv.Atoi(nextBatch); err != nil || offset < 0 {
+			return util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue("Invalid next_batch parameter"),
+			}
+		}
+	}
+
+	// The filter is applied on top of the default one, which has a smaller
+	// limit than usual.
+	criteria := roomEventsCriteria{
+		Filter:  gomatrixserverlib.DefaultRoomEventFilter(),
+		OrderBy: searchOrderByRank,
+	}
+	criteria.Filter.Limit = defaultSearchLimit
+	var r searchRequest
+	r.SearchCategories.RoomEvents = &criteria
+	if resErr := httputil.UnmarshalJSONRequest(req, &r); resErr != nil {
+		return *resErr
+	}
+	var res searchResponse
+	if r.SearchCategories.RoomEvents == nil {
+		return util.JSONResponse{Code: http.StatusOK, JSON: res}
+	}
+	if resErr := validateSearchCriteria(&criteria); resErr != nil {
+		return *resErr
+	}
+
+	roomIDs, err := searchableRoomIDs(ctx, db, device.UserID, &criteria.Filter)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("searchableRoomIDs failed")
+		return jsonerror.InternalServerError()
+	}
+	searchResults, count, err := db.SearchEvents(
+		ctx, criteria.SearchTerm, roomIDs, criteria.Keys,
+		criteria.OrderBy == searchOrderByRank, criteria.Filter.Limit, offset,
+	)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.SearchEvents failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Load the events, and remove the ones which the filter excludes or which
+	// the user isn't allowed to see.
+	eventIDs := make([]string, len(searchResults))
+	for i := range searchResults {
+		eventIDs[i] = searchResults[i].EventID
+	}
+	events, err := db.Events(ctx, eventIDs)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("db.Events failed")
+		return jsonerror.InternalServerError()
+	}
+	events, err = visibleEvents(ctx, rsAPI, device.UserID, types.FilterRoomEvents(events, &criteria.Filter))
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("visibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	eventsByID := make(map[string]gomatrixserverlib.HeaderedEvent, len(events))
+	for _, ev := range events {
+		eventsByID[ev.EventID()] = ev
+	}
+
+	results := &roomEventsResults{
+		Count:      count,
+		Highlights: types.SearchTerms(criteria.SearchTerm),
+		Results:    []searchResult{},
+	}
+	if offset+len(searchResults) < count {
+		results.NextBatch = strconv.Itoa(offset + len(searchResults))
+	}
+	resultRoomIDs := []string{}
+	seenRooms := make(map[string]bool)
+	for _, sr := range searchResults {
+		ev, ok := eventsByID[sr.EventID]
+		if !ok {
+			continue
+		}
+		result := searchResult{
+			Rank:   sr.Rank,
+			Result: gomatrixserverlib.HeaderedToClientEvent(ev, gomatrixserverlib.FormatAll),
+		}
+		if criteria.EventContext != nil {
+			result.Context, err = contextForSearchResult(ctx, db, rsAPI, device.UserID, &ev, criteria.EventContext)
+			if err != nil {
+				util.GetLogger(ctx).WithError(err).Error("contextForSearchResult failed")
+				return jsonerror.InternalServerError()
+			}
+		}
+		results.Results = append(results.Results, result)
+		if !seenRooms[ev.RoomID()] {
+			seenRooms[ev.RoomID()] = true
+			resultRoomIDs = append(resultRoomIDs, ev.RoomID())
+		}
+	}
+
+	if criteria.IncludeState {
+		if results.State, err = currentStateForSearch(ctx, db, device.UserID, resultRoomIDs); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("currentStateForSearch failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+	for _, groupBy := range criteria.Groupings.GroupBy {
+		if results.Groups == nil {
+			results.Groups = make(map[string]map[string]*searchGroup)
+		}
+		groups := make(map[string]*searchGroup)
+		for _, result := range results.Results {
+			value := result.Result.RoomID
+			if groupBy.Key == "sender" {
+				value = result.Result.Sender
+			}
+			group, ok := groups[value]
+			if !ok {
+				group = &searchGroup{Order: len(groups), Results: []string{}}
+				groups[value] = group
+			}
+			group.Results = append(group.Results, result.Result.EventID)
+		}
+		results.Groups[groupBy.Key] = groups
+	}
+
+	res.SearchCategories.RoomEvents = results
+	return util.JSONResponse{Code: http.StatusOK, JSON: res}
+}
+
+// validateSearchCriteria checks the search criteria, filling in the default
+// keys if none were given and capping the limit.
+func validateSearchCriteria(criteria *roomEventsCriteria) *util.JSONResponse {
+	if criteria.SearchTerm == "" {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("search_term is required"),
+		}
+	}
+	if len(criteria.Keys) == 0 {
+		for _, key := range types.SearchableEventTypes {
+			criteria.Keys = append(criteria.Keys, key)
+		}
+	}
+	for _, key := range criteria.Keys {
+		valid := false
+		for _, searchable := range types.SearchableEventTypes {
+			valid = valid || key == searchable
+		}
+		if !valid {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Unknown key %q", key)),
+			}
+		}
+	}
+	if criteria.OrderBy != searchOrderByRank && criteria.OrderBy != searchOrderByRecent {
+		return &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Unknown order_by %q", criteria.OrderBy)),
+		}
+	}
+	for _, groupBy := range criteria.Groupings.GroupBy {
+		if groupBy.Key != "room_id" && groupBy.Key != "sender" {
+			return &util.JSONResponse{
+				Code: http.StatusBadRequest,
+				JSON: jsonerror.InvalidArgumentValue(fmt.Sprintf("Unknown group_by key %q", groupBy.Key)),
+			}
+		}
+	}
+	if criteria.Filter.Limit <= 0 {
+		criteria.Filter.Limit = defaultSearchLimit
+	} else if criteria.Filter.Limit > maxSearchLimit {
+		criteria.Filter.Limit = maxSearchLimit
+	}
+	return nil
+}
+
+// UnmarshalJSON fills in the default limits for any which weren't given.
+func (c *searchEventContext) UnmarshalJSON(data []byte) error {
+	type eventContext searchEventContext
+	ec := eventContext{
+		BeforeLimit: defaultSearchContextLimit,
+		AfterLimit:  defaultSearchContextLimit,
+	}
+	if err := json.Unmarshal(data, &ec); err != nil {
+		return err
+	}
+	*c = searchEventContext(ec)
+	return nil
+}
+
+// searchableRoomIDs returns the rooms which the user is or was in, and which
+// the filter allows.
+func searchableRoomIDs(
+	ctx context.Context, db storage.Database, userID string, filter *gomatrixserverlib.RoomEventFilter,
+) ([]string, error) {
+	roomIDs := []string{}
+	for _, membership := range []string{gomatrixserverlib.Join, gomatrixserverlib.Leave, gomatrixserverlib.Ban} {
+		ids, err := db.RoomIDsWithMembership(ctx, userID, membership)
+		if err != nil {
+			return nil, err
+		}
+		for _, roomID := range ids {
+			if types.FilterAllowsRoom(roomID, filter.Rooms, filter.NotRooms) {
+				roomIDs = append(roomIDs, roomID)
+			}
+		}
+	}
+	return roomIDs, nil
+}
+
+// contextForSearchResult returns the events around the result, along with
+// tokens which can be passed to /messages to paginate further.
+func contextForSearchResult(
+	ctx context.Context, db storage.Database, rsAPI api.RoomserverInternalAPI, userID string,
+	event *gomatrixserverlib.HeaderedEvent, eventContext *searchEventContext,
+) (*searchResultContext, error) {
+	before, after, start, end, err := eventsAround(
+		ctx, db, rsAPI, userID, event, gomatrixserverlib.DefaultRoomEventFilter(),
+		eventContext.BeforeLimit, eventContext.AfterLimit,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("eventsAround: %w", err)
+	}
+
+	result := &searchResultContext{
+		Start:        start.String(),
+		End:          end.String(),
+		EventsBefore: gomatrixserverlib.HeaderedToClientEvents(before, gomatrixserverlib.FormatAll),
+		EventsAfter:  gomatrixserverlib.HeaderedToClientEvents(after, gomatrixserverlib.FormatAll),
+	}
+	if eventContext.IncludeProfile {
+		result.ProfileInfo = make(map[string]searchUserProfile)
+		for _, ev := range append(append([]gomatrixserverlib.HeaderedEvent{*event}, before...), after...) {
+			if _, ok := result.ProfileInfo[ev.Sender()]; ok {
+				continue
+			}
+			memberEvent, err := db.GetStateEvent(ctx, event.RoomID(), gomatrixserverlib.MRoomMember, ev.Sender())
+			if err != nil {
+				return nil, fmt.Errorf("db.GetStateEvent: %w", err)
+			}
+			var profile searchUserProfile
+			if memberEvent != nil {
+				if err = json.Unmarshal(memberEvent.Content(), &profile); err != nil {
+					return nil, fmt.Errorf("json.Unmarshal: %w", err)
+				}
+			}
+			result.ProfileInfo[ev.Sender()] = profile
+		}
+	}
+	return result, nil
+}
+
+// currentStateForSearch returns the current state of the given rooms, for
+// those which the user is still joined to.
+func currentStateForSearch(
+	ctx context.Context, db storage.Database, userID string, roomIDs []string,
+) (map[string][]gomatrixserverlib.ClientEvent, error) {
+	joinedRoomIDs, err := db.RoomIDsWithMembership(ctx, userID, gomatrixserverlib.Join)
+	if err != nil {
+		return nil, fmt.Errorf("db.RoomIDsWithMembership: %w", err)
+	}
+	joined := make(map[string]bool, len(joinedRoomIDs))
+	for _, roomID := range joinedRoomIDs {
+		joined[roomID] = true
+	}
+	state := make(map[string][]gomatrixserverlib.ClientEvent)
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	for _, roomID := range roomIDs {
+		if !joined[roomID] {
+			continue
+		}
+		stateEvents, err := db.GetStateEventsForRoom(ctx, roomID, &stateFilter)
+		if err != nil {
+			return nil, fmt.Errorf("db.GetStateEventsForRoom: %w", err)
+		}
+		state[roomID] = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatAll)
+	}
+	return state, nil
+}
+
+// visibleEvents returns the events which the user is allowed to see,
+// according to the history visibility of their rooms.
+func visibleEvents(
+	ctx context.Context, rsAPI api.RoomserverInternalAPI, userID string, events []gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	if len(events) == 0 {
+		return events, nil
+	}
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	var allowedRes api.QueryUserAllowedToSeeEventsResponse
+	if err := rsAPI.QueryUserAllowedToSeeEvents(ctx, &api.QueryUserAllowedToSeeEventsRequest{
+		EventIDs: eventIDs,
+		UserID:   userID,
+	}, &allowedRes); err != nil {
+		return nil, fmt.Errorf("rsAPI.QueryUserAllowedToSeeEvents: %w", err)
+	}
+	result := []gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range events {
+		if allowedRes.AllowedToSeeEvents[ev.EventID()] {
+			result = append(result, ev)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,48 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package routing
+
+import (
+	"testing"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+func TestValidateSearchCriteriaLimit(t *testing.T) {
+	tests := []struct {
+		limit int
+		want  int
+	}{
+		{0, defaultSearchLimit},
+		{-1, defaultSearchLimit},
+		{20, 20},
+		{maxSearchLimit, maxSearchLimit},
+		{100000, maxSearchLimit},
+	}
+	for _, tt := range tests {
+		criteria := roomEventsCriteria{
+			SearchTerm: "cake",
+			Filter:     gomatrixserverlib.DefaultRoomEventFilter(),
+			OrderBy:    searchOrderByRank,
+		}
+		criteria.Filter.Limit = tt.limit
+		if resErr := validateSearchCriteria(&criteria); resErr != nil {
+			t.Fatalf("validateSearchCriteria returned %+v", resErr)
+		}
+		if criteria.Filter.Limit != tt.want {
+			t.Errorf("limit %d became %d, want %d", tt.limit, criteria.Filter.Limit, tt.want)
+		}
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -56,9 +57,9 @@ type Database interface {
 	// transaction IDs associated with the given device. These transaction IDs come
 	// from when the device sent the event via an API that included a transaction
 	// ID.
-	IncrementalSync(ctx context.Context, device authtypes.Device, fromPos, toPos types.StreamingToken, numRecentEventsPerRoom int, wantFullState bool) (*types.Response, error)
-	// CompleteSync returns a complete /sync API response for the given user.
-	CompleteSync(ctx context.Context, userID string, numRecentEventsPerRoom int) (*types.Response, error)
+	IncrementalSync(ctx context.Context, device authtypes.Device, fromPos, toPos types.StreamingToken, filter *gomatrixserverlib.Filter, wantFullState bool) (*types.Response, error)
+	// CompleteSync returns a complete /sync API response for the given user, applying the given filter.
+	CompleteSync(ctx context.Context, userID string, filter *gomatrixserverlib.Filter) (*types.Response, error)
 	// GetAccountDataInRange returns all account data for a given user inserted or
 	// updated between two given positions
 	// Returns a map following the format data[roomID] = []dataTypes
@@ -72,6 +73,48 @@ type Database interface {
 	// creates a new row, else update the existing one
 	// Returns an error if there was an issue with the upsert
 	UpsertAccountData(ctx context.Context, userID, roomID, dataType string) (types.StreamPosition, error)
+	// StoreKeyChange records that the device list for the given user has changed.
+	// Returns the sync stream position of the change.
+	StoreKeyChange(ctx context.Context, userID string) (types.StreamPosition, error)
+	// KeyChangesInRange returns the IDs of users whose device lists changed
+	// between two given positions.
+	KeyChangesInRange(ctx context.Context, r types.Range) ([]string, error)
+	// StoreNewSendForDeviceMessage stores a send-to-device message for the given
+	// local device. Returns the sync stream position of the message.
+	StoreNewSendForDeviceMessage(ctx context.Context, userID, deviceID string, event eduAPI.SendToDeviceEvent) (types.StreamPosition, error)
+	// SendToDeviceUpdatesForSync deletes the messages for the device up to and including
+	// the since position, which the client has now acknowledged, and returns any remaining
+	// messages up to and including the to position.
+	SendToDeviceUpdatesForSync(ctx context.Context, userID, deviceID string, since, to types.StreamPosition) ([]eduAPI.SendToDeviceEvent, error)
+	// StoreReceipt stores a read receipt, replacing any previous receipt of the
+	// same type from the same user in the same room.
+	// Returns the receipt stream position of the receipt.
+	StoreReceipt(ctx context.Context, receipt eduAPI.OutputReceiptEvent) (types.StreamPosition, error)
+	// StorePresence stores the latest presence of a user.
+	// Returns the sync stream position of the update.
+	StorePresence(ctx context.Context, presence eduAPI.OutputPresenceEvent) (types.StreamPosition, error)
+	// GetPresence returns the latest presence of a user, or nil if we have
+	// never seen any presence for them.
+	GetPresence(ctx context.Context, userID string) (*eduAPI.OutputPresenceEvent, error)
+	// PresenceInRange returns the latest presence of every user whose
+	// presence changed between two given positions.
+	PresenceInRange(ctx context.Context, r types.Range) ([]eduAPI.OutputPresenceEvent, error)
+	// IncrementNotificationCounts records a new notification for the user in the room, which may also be a highlight.
+	IncrementNotificationCounts(ctx context.Context, userID, roomID string, highlight bool) error
+	// ResetNotificationCounts clears the notification counts of the user in the room.
+	ResetNotificationCounts(ctx context.Context, userID, roomID string) error
+	// GetNotificationCounts returns the notification counts of the user in every room with unread notifications.
+	GetNotificationCounts(ctx context.Context, userID string) (map[string]types.UnreadNotifications, error)
+	// PurgeRoom deletes everything stored about the room, e.g. because an admin has purged it from the server.
+	PurgeRoom(ctx context.Context, roomID string) error
+	// SharedUsers returns the IDs of all users who share a room with the given user,
+	// including the user themselves if they are joined to any room.
+	SharedUsers(ctx context.Context, userID string) ([]string, error)
+	// RoomIDsWithMembership returns the IDs of the rooms which the user currently has the given membership in.
+	RoomIDsWithMembership(ctx context.Context, userID, membership string) ([]string, error)
+	// SearchEvents returns the events in the given rooms which match the search term under any of the given
+	// keys, ordered either by rank or by recency, along with the total number of matching events.
+	SearchEvents(ctx context.Context, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int) ([]types.SearchResult, int, error)
 	// AddInviteEvent stores a new invite event for a user.
 	// If the invite was successfully stored this returns the stream ID it was stored at.
 	// Returns an error if there was a problem communicating with the database.
@@ -79,6 +122,9 @@ type Database interface {
 	// RetireInviteEvent removes an old invite event from the database.
 	// Returns an error if there was a problem communicating with the database.
 	RetireInviteEvent(ctx context.Context, inviteEventID string) error
+	// RedactEvent replaces the stored JSON of an event with its redacted form.
+	// Returns an error if there was a problem communicating with the database.
+	RedactEvent(ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent) error
 	// SetTypingTimeoutCallback sets a callback function that is called right after
 	// a user is removed from the typing user list due to timeout.
 	SetTypingTimeoutCallback(fn cache.TimeoutCallbackFn)
@@ -88,10 +134,12 @@ type Database interface {
 	// RemoveTypingUser removes a typing user from the typing cache.
 	// Returns the newly calculated sync position for typing notifications.
 	RemoveTypingUser(userID, roomID string) types.StreamPosition
-	// GetEventsInStreamingRange retrieves all of the events on a given ordering using the given extremities and limit.
-	GetEventsInStreamingRange(ctx context.Context, from, to *types.StreamingToken, roomID string, limit int, backwardOrdering bool) (events []types.StreamEvent, err error)
-	// GetEventsInTopologicalRange retrieves all of the events on a given ordering using the given extremities and limit.
-	GetEventsInTopologicalRange(ctx context.Context, from, to *types.TopologyToken, roomID string, limit int, backwardOrdering bool) (events []types.StreamEvent, err error)
+	// GetEventsInStreamingRange retrieves all of the events on a given ordering using the given extremities,
+	// which match the given filter, up to its limit.
+	GetEventsInStreamingRange(ctx context.Context, from, to *types.StreamingToken, roomID string, eventFilter *gomatrixserverlib.RoomEventFilter, backwardOrdering bool) (events []types.StreamEvent, err error)
+	// GetEventsInTopologicalRange retrieves all of the events on a given ordering using the given extremities,
+	// which match the given filter, up to its limit.
+	GetEventsInTopologicalRange(ctx context.Context, from, to *types.TopologyToken, roomID string, eventFilter *gomatrixserverlib.RoomEventFilter, backwardOrdering bool) (events []types.StreamEvent, err error)
 	// EventPositionInTopology returns the depth and stream position of the given event.
 	EventPositionInTopology(ctx context.Context, eventID string) (types.TopologyToken, error)
 	// BackwardExtremitiesForRoom returns a map of backwards extremity event ID to a list of its prev_events.
@@ -83,6 +83,15 @@ const selectCurrentStateSQL = "" +
 const selectJoinedUsersSQL = "" +
 	"SELECT room_id, state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND membership = 'join'"
 
+const selectSharedUsersSQL = "" +
+	"SELECT DISTINCT state_key FROM syncapi_current_room_state WHERE type = 'm.room.member' AND membership = 'join'" +
+	" AND room_id IN (" +
+	"  SELECT room_id FROM syncapi_current_room_state WHERE type = 'm.room.member' AND state_key = $1 AND membership = 'join'" +
+	" )"
+
+const updateEventJSONInCurrentStateSQL = "" +
+	"UPDATE syncapi_current_room_state SET headered_event_json=$1 WHERE event_id=$2"
+
 const selectStateEventSQL = "" +
 	"SELECT headered_event_json FROM syncapi_current_room_state WHERE room_id = $1 AND type = $2 AND state_key = $3"
 
@@ -100,8 +109,10 @@ type currentRoomStateStatements struct {
 	selectRoomIDsWithMembershipStmt *sql.Stmt
 	selectCurrentStateStmt          *sql.Stmt
 	selectJoinedUsersStmt           *sql.Stmt
+	selectSharedUsersStmt           *sql.Stmt
 	selectEventsWithEventIDsStmt    *sql.Stmt
 	selectStateEventStmt            *sql.Stmt
+	updateEventJSONStmt             *sql.Stmt
 }
 
 func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, error) {
@@ -125,12 +136,18 @@ func NewPostgresCurrentRoomStateTable(db *sql.DB) (tables.CurrentRoomState, erro
 	if s.selectJoinedUsersStmt, err = db.Prepare(selectJoinedUsersSQL); err != nil {
 		return nil, err
 	}
+	if s.selectSharedUsersStmt, err = db.Prepare(selectSharedUsersSQL); err != nil {
+		return nil, err
+	}
 	if s.selectEventsWithEventIDsStmt, err = db.Prepare(selectEventsWithEventIDsSQL); err != nil {
 		return nil, err
 	}
 	if s.selectStateEventStmt, err = db.Prepare(selectStateEventSQL); err != nil {
 		return nil, err
 	}
+	if s.updateEventJSONStmt, err = db.Prepare(updateEventJSONInCurrentStateSQL); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
@@ -158,6 +175,28 @@ func (s *currentRoomStateStatements) SelectJoinedUsers(
 	return result, rows.Err()
 }
 
+// SelectSharedUsers returns the IDs of all users who share a room with the given user.
+func (s *currentRoomStateStatements) SelectSharedUsers(
+	ctx context.Context, txn *sql.Tx, userID string,
+) ([]string, error) {
+	stmt := internal.TxStmt(txn, s.selectSharedUsersStmt)
+	rows, err := stmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectSharedUsers: rows.close() failed")
+
+	var result []string
+	for rows.Next() {
+		var sharedUserID string
+		if err := rows.Scan(&sharedUserID); err != nil {
+			return nil, err
+		}
+		result = append(result, sharedUserID)
+	}
+	return result, rows.Err()
+}
+
 // SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
 func (s *currentRoomStateStatements) SelectRoomIDsWithMembership(
 	ctx context.Context,
@@ -217,13 +256,8 @@ func (s *currentRoomStateStatements) UpsertRoomState(
 	ctx context.Context, txn *sql.Tx,
 	event gomatrixserverlib.HeaderedEvent, membership *string, addedAt types.StreamPosition,
 ) error {
-	// Parse content as JSON and search for an "url" key
-	containsURL := false
-	var content map[string]interface{}
-	if json.Unmarshal(event.Content(), &content) != nil {
-		// Set containsURL to true if url is present
-		_, containsURL = content["url"]
-	}
+	// Check whether the content has an "url" key, for contains_url filters
+	containsURL := types.ContainsURL(event.Content())
 
 	headeredJSON, err := json.Marshal(event)
 	if err != nil {
@@ -266,7 +300,7 @@ func rowsToEvents(rows *sql.Rows) ([]gomatrixserverlib.HeaderedEvent, error) {
 		if err := rows.Scan(&eventBytes); err != nil {
 			return nil, err
 		}
-		// TODO: Handle redacted events
+		// Redacted events are stored in their redacted form, see UpdateEventJSON.
 		var ev gomatrixserverlib.HeaderedEvent
 		if err := json.Unmarshal(eventBytes, &ev); err != nil {
 			return nil, err
@@ -294,3 +328,16 @@ func (s *currentRoomStateStatements) SelectStateEvent(
 	}
 	return &ev, err
 }
+
+// UpdateEventJSON replaces the stored JSON of a state event, e.g. once it
+// has been redacted.
+func (s *currentRoomStateStatements) UpdateEventJSON(
+	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent,
+) error {
+	headeredJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = internal.TxStmt(txn, s.updateEventJSONStmt).ExecContext(ctx, headeredJSON, event.EventID())
+	return err
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const keyChangesSchema = `
+-- This sequence is shared between all the tables generated from kafka logs.
+CREATE SEQUENCE IF NOT EXISTS syncapi_stream_id;
+
+-- Stores the stream ID at which each user's device list last changed.
+CREATE TABLE IF NOT EXISTS syncapi_key_changes (
+    -- An incrementing ID which denotes the position in the log that this change resides at.
+    id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_stream_id'),
+    -- ID of the user whose device list changed
+    user_id TEXT NOT NULL,
+
+    -- We only need to know about the latest change for each user
+    CONSTRAINT syncapi_key_changes_unique UNIQUE (user_id)
+);
+`
+
+const insertKeyChangeSQL = "" +
+	"INSERT INTO syncapi_key_changes (user_id) VALUES ($1)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_key_changes_unique" +
+	" DO UPDATE SET id = EXCLUDED.id" +
+	" RETURNING id"
+
+const selectKeyChangesInRangeSQL = "" +
+	"SELECT user_id FROM syncapi_key_changes WHERE id > $1 AND id <= $2"
+
+const selectMaxKeyChangeIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_key_changes"
+
+type keyChangesStatements struct {
+	insertKeyChangeStmt         *sql.Stmt
+	selectKeyChangesInRangeStmt *sql.Stmt
+	selectMaxKeyChangeIDStmt    *sql.Stmt
+}
+
+func NewPostgresKeyChangesTable(db *sql.DB) (tables.KeyChanges, error) {
+	s := &keyChangesStatements{}
+	_, err := db.Exec(keyChangesSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertKeyChangeStmt, err = db.Prepare(insertKeyChangeSQL); err != nil {
+		return nil, err
+	}
+	if s.selectKeyChangesInRangeStmt, err = db.Prepare(selectKeyChangesInRangeSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMaxKeyChangeIDStmt, err = db.Prepare(selectMaxKeyChangeIDSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *keyChangesStatements) InsertKeyChange(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (pos types.StreamPosition, err error) {
+	stmt := internal.TxStmt(txn, s.insertKeyChangeStmt)
+	err = stmt.QueryRowContext(ctx, userID).Scan(&pos)
+	return
+}
+
+func (s *keyChangesStatements) SelectKeyChangesInRange(
+	ctx context.Context, txn *sql.Tx, r types.Range,
+) ([]string, error) {
+	stmt := internal.TxStmt(txn, s.selectKeyChangesInRangeStmt)
+	rows, err := stmt.QueryContext(ctx, r.Low(), r.High())
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectKeyChangesInRange: rows.close() failed")
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+func (s *keyChangesStatements) SelectMaxKeyChangeID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := internal.TxStmt(txn, s.selectMaxKeyChangeIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const notificationCountsSchema = `
+-- Stores the number of unread notifications of each local user in each room.
+CREATE TABLE IF NOT EXISTS syncapi_notification_counts (
+    user_id TEXT NOT NULL,
+    room_id TEXT NOT NULL,
+    notification_count BIGINT NOT NULL,
+    -- The number of those notifications which are also highlights.
+    highlight_count BIGINT NOT NULL,
+    PRIMARY KEY (user_id, room_id)
+);
+`
+
+const incrementNotificationCountsSQL = "" +
+	"INSERT INTO syncapi_notification_counts (user_id, room_id, notification_count, highlight_count)" +
+	" VALUES ($1, $2, 1, $3)" +
+	" ON CONFLICT (user_id, room_id)" +
+	" DO UPDATE SET notification_count = syncapi_notification_counts.notification_count + 1," +
+	" highlight_count = syncapi_notification_counts.highlight_count + $4"
+
+const deleteNotificationCountsSQL = "" +
+	"DELETE FROM syncapi_notification_counts WHERE user_id = $1 AND room_id = $2"
+
+const selectNotificationCountsSQL = "" +
+	"SELECT room_id, notification_count, highlight_count FROM syncapi_notification_counts" +
+	" WHERE user_id = $1"
+
+type notificationCountsStatements struct {
+	incrementNotificationCountsStmt *sql.Stmt
+	deleteNotificationCountsStmt    *sql.Stmt
+	selectNotificationCountsStmt    *sql.Stmt
+}
+
+func NewPostgresNotificationCountsTable(db *sql.DB) (tables.NotificationCounts, error) {
+	s := &notificationCountsStatements{}
+	_, err := db.Exec(notificationCountsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.incrementNotificationCountsStmt, err = db.Prepare(incrementNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteNotificationCountsStmt, err = db.Prepare(deleteNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	if s.selectNotificationCountsStmt, err = db.Prepare(selectNotificationCountsSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *notificationCountsStatements) IncrementNotificationCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID string, highlight bool,
+) error {
+	highlightCount := 0
+	if highlight {
+		highlightCount = 1
+	}
+	stmt := internal.TxStmt(txn, s.incrementNotificationCountsStmt)
+	_, err := stmt.ExecContext(ctx, userID, roomID, highlightCount, highlightCount)
+	return err
+}
+
+func (s *notificationCountsStatements) DeleteNotificationCounts(
+	ctx context.Context, txn *sql.Tx, userID, roomID string,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteNotificationCountsStmt)
+	_, err := stmt.ExecContext(ctx, userID, roomID)
+	return err
+}
+
+func (s *notificationCountsStatements) SelectNotificationCounts(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (map[string]types.UnreadNotifications, error) {
+	stmt := internal.TxStmt(txn, s.selectNotificationCountsStmt)
+	rows, err := stmt.QueryContext(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectNotificationCounts: rows.close() failed")
+
+	result := make(map[string]types.UnreadNotifications)
+	for rows.Next() {
+		var roomID string
+		var counts types.UnreadNotifications
+		if err = rows.Scan(&roomID, &counts.NotificationCount, &counts.HighlightCount); err != nil {
+			return nil, err
+		}
+		result[roomID] = counts
+	}
+	return result, rows.Err()
+}
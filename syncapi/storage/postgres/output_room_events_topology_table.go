@@ -18,6 +18,7 @@ import (
 	"context"
 	"database/sql"
 
+	"github.com/lib/pq"
 	"github.com/matrix-org/dendrite/internal"
 
 	"github.com/matrix-org/dendrite/syncapi/storage/tables"
@@ -47,18 +48,32 @@ const insertEventInTopologySQL = "" +
 	" ON CONFLICT (topological_position, stream_position, room_id) DO UPDATE SET event_id = $1"
 
 const selectEventIDsInRangeASCSQL = "" +
-	"SELECT event_id FROM syncapi_output_room_events_topology" +
-	" WHERE room_id = $1 AND (" +
-	"(topological_position > $2 AND topological_position < $3) OR" +
-	"(topological_position = $4 AND stream_position <= $5)" +
-	") ORDER BY topological_position ASC, stream_position ASC LIMIT $6"
+	"SELECT t.event_id FROM syncapi_output_room_events_topology t" +
+	" INNER JOIN syncapi_output_room_events e ON e.event_id = t.event_id" +
+	" WHERE t.room_id = $1 AND (" +
+	"(t.topological_position > $2 AND t.topological_position < $3) OR" +
+	"(t.topological_position = $4 AND t.stream_position <= $5)" +
+	")" +
+	" AND ( $6::text[] IS NULL OR     e.sender  = ANY($6)  )" +
+	" AND ( $7::text[] IS NULL OR NOT(e.sender  = ANY($7)) )" +
+	" AND ( $8::text[] IS NULL OR     e.type LIKE ANY($8)  )" +
+	" AND ( $9::text[] IS NULL OR NOT(e.type LIKE ANY($9)) )" +
+	" AND ( $10::bool IS NULL  OR     e.contains_url = $10 )" +
+	" ORDER BY t.topological_position ASC, t.stream_position ASC LIMIT $11"
 
 const selectEventIDsInRangeDESCSQL = "" +
-	"SELECT event_id FROM syncapi_output_room_events_topology" +
-	" WHERE room_id = $1 AND (" +
-	"(topological_position > $2 AND topological_position < $3) OR" +
-	"(topological_position = $4 AND stream_position <= $5)" +
-	") ORDER BY topological_position DESC, stream_position DESC LIMIT $6"
+	"SELECT t.event_id FROM syncapi_output_room_events_topology t" +
+	" INNER JOIN syncapi_output_room_events e ON e.event_id = t.event_id" +
+	" WHERE t.room_id = $1 AND (" +
+	"(t.topological_position > $2 AND t.topological_position < $3) OR" +
+	"(t.topological_position = $4 AND t.stream_position <= $5)" +
+	")" +
+	" AND ( $6::text[] IS NULL OR     e.sender  = ANY($6)  )" +
+	" AND ( $7::text[] IS NULL OR NOT(e.sender  = ANY($7)) )" +
+	" AND ( $8::text[] IS NULL OR     e.type LIKE ANY($8)  )" +
+	" AND ( $9::text[] IS NULL OR NOT(e.type LIKE ANY($9)) )" +
+	" AND ( $10::bool IS NULL  OR     e.contains_url = $10 )" +
+	" ORDER BY t.topological_position DESC, t.stream_position DESC LIMIT $11"
 
 const selectPositionInTopologySQL = "" +
 	"SELECT topological_position, stream_position FROM syncapi_output_room_events_topology" +
@@ -120,7 +135,7 @@ func (s *outputRoomEventsTopologyStatements) InsertEventInTopology(
 // Returns an empty slice if no events match the given range.
 func (s *outputRoomEventsTopologyStatements) SelectEventIDsInRange(
 	ctx context.Context, txn *sql.Tx, roomID string, minDepth, maxDepth, maxStreamPos types.StreamPosition,
-	limit int, chronologicalOrder bool,
+	eventFilter *gomatrixserverlib.RoomEventFilter, chronologicalOrder bool,
 ) (eventIDs []string, err error) {
 	// Decide on the selection's order according to whether chronological order
 	// is requested or not.
@@ -132,7 +147,15 @@ func (s *outputRoomEventsTopologyStatements) SelectEventIDsInRange(
 	}
 
 	// Query the event IDs.
-	rows, err := stmt.QueryContext(ctx, roomID, minDepth, maxDepth, maxDepth, maxStreamPos, limit)
+	rows, err := stmt.QueryContext(
+		ctx, roomID, minDepth, maxDepth, maxDepth, maxStreamPos,
+		pq.StringArray(eventFilter.Senders),
+		pq.StringArray(eventFilter.NotSenders),
+		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.Types)),
+		pq.StringArray(filterConvertTypeWildcardToSQL(eventFilter.NotTypes)),
+		eventFilter.ContainsURL,
+		eventFilter.Limit,
+	)
 	if err == sql.ErrNoRows {
 		// If no event matched the request, return an empty slice.
 		return []string{}, nil
@@ -0,0 +1,152 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const presenceSchema = `
+-- This sequence is shared between all the tables generated from kafka logs.
+CREATE SEQUENCE IF NOT EXISTS syncapi_stream_id;
+
+-- Stores the latest presence of each user.
+CREATE TABLE IF NOT EXISTS syncapi_presence (
+    -- An incrementing ID which denotes the position in the log that this presence update resides at.
+    id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_stream_id'),
+    -- The user whose presence this is
+    user_id TEXT NOT NULL,
+    -- One of online, unavailable or offline
+    presence TEXT NOT NULL,
+    -- The optional status message set by the user
+    status_msg TEXT,
+    -- When the user was last active, in milliseconds since the epoch
+    last_active_ts BIGINT NOT NULL,
+    -- Whether the user is currently active
+    currently_active BOOLEAN NOT NULL,
+    CONSTRAINT syncapi_presence_unique UNIQUE (user_id)
+);
+`
+
+const upsertPresenceSQL = "" +
+	"INSERT INTO syncapi_presence (user_id, presence, status_msg, last_active_ts, currently_active)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_presence_unique" +
+	" DO UPDATE SET id = EXCLUDED.id, presence = EXCLUDED.presence, status_msg = EXCLUDED.status_msg," +
+	" last_active_ts = EXCLUDED.last_active_ts, currently_active = EXCLUDED.currently_active" +
+	" RETURNING id"
+
+const selectPresenceForUserSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts, currently_active FROM syncapi_presence" +
+	" WHERE user_id = $1"
+
+const selectPresenceInRangeSQL = "" +
+	"SELECT user_id, presence, status_msg, last_active_ts, currently_active FROM syncapi_presence" +
+	" WHERE id > $1 AND id <= $2"
+
+const selectMaxPresenceIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_presence"
+
+type presenceStatements struct {
+	upsertPresenceStmt        *sql.Stmt
+	selectPresenceForUserStmt *sql.Stmt
+	selectPresenceInRangeStmt *sql.Stmt
+	selectMaxPresenceIDStmt   *sql.Stmt
+}
+
+func NewPostgresPresenceTable(db *sql.DB) (tables.Presence, error) {
+	s := &presenceStatements{}
+	_, err := db.Exec(presenceSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertPresenceStmt, err = db.Prepare(upsertPresenceSQL); err != nil {
+		return nil, err
+	}
+	if s.selectPresenceForUserStmt, err = db.Prepare(selectPresenceForUserSQL); err != nil {
+		return nil, err
+	}
+	if s.selectPresenceInRangeStmt, err = db.Prepare(selectPresenceInRangeSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMaxPresenceIDStmt, err = db.Prepare(selectMaxPresenceIDSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *presenceStatements) UpsertPresence(
+	ctx context.Context, txn *sql.Tx, presence api.OutputPresenceEvent,
+) (pos types.StreamPosition, err error) {
+	stmt := internal.TxStmt(txn, s.upsertPresenceStmt)
+	err = stmt.QueryRowContext(
+		ctx, presence.UserID, presence.Presence, presence.StatusMsg,
+		presence.LastActiveTS, presence.CurrentlyActive,
+	).Scan(&pos)
+	return
+}
+
+func (s *presenceStatements) SelectPresenceForUser(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (*api.OutputPresenceEvent, error) {
+	var p api.OutputPresenceEvent
+	stmt := internal.TxStmt(txn, s.selectPresenceForUserStmt)
+	err := stmt.QueryRowContext(ctx, userID).Scan(
+		&p.UserID, &p.Presence, &p.StatusMsg, &p.LastActiveTS, &p.CurrentlyActive,
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (s *presenceStatements) SelectPresenceInRange(
+	ctx context.Context, txn *sql.Tx, r types.Range,
+) ([]api.OutputPresenceEvent, error) {
+	stmt := internal.TxStmt(txn, s.selectPresenceInRangeStmt)
+	rows, err := stmt.QueryContext(ctx, r.Low(), r.High())
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectPresenceInRange: rows.close() failed")
+
+	var presences []api.OutputPresenceEvent
+	for rows.Next() {
+		var p api.OutputPresenceEvent
+		if err = rows.Scan(&p.UserID, &p.Presence, &p.StatusMsg, &p.LastActiveTS, &p.CurrentlyActive); err != nil {
+			return nil, err
+		}
+		presences = append(presences, p)
+	}
+	return presences, rows.Err()
+}
+
+func (s *presenceStatements) SelectMaxPresenceID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := internal.TxStmt(txn, s.selectMaxPresenceIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const receiptsSchema = `
+-- Receipts have their own stream position, separate from the PDU stream.
+CREATE SEQUENCE IF NOT EXISTS syncapi_receipt_id;
+
+-- Stores the most recent receipt of each type for each user in each room.
+CREATE TABLE IF NOT EXISTS syncapi_receipts (
+    -- An incrementing ID which denotes the position in the receipt stream.
+    id BIGINT PRIMARY KEY DEFAULT nextval('syncapi_receipt_id'),
+    -- The room the receipt is for
+    room_id TEXT NOT NULL,
+    -- The type of the receipt, e.g. m.read
+    receipt_type TEXT NOT NULL,
+    -- The user who sent the receipt
+    user_id TEXT NOT NULL,
+    -- The event the user has read up to
+    event_id TEXT NOT NULL,
+    -- When the receipt was sent, in milliseconds since the epoch
+    receipt_ts BIGINT NOT NULL,
+    CONSTRAINT syncapi_receipts_unique UNIQUE (room_id, receipt_type, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_receipts_room_id ON syncapi_receipts(room_id);
+`
+
+const upsertReceiptSQL = "" +
+	"INSERT INTO syncapi_receipts (room_id, receipt_type, user_id, event_id, receipt_ts)" +
+	" VALUES ($1, $2, $3, $4, $5)" +
+	" ON CONFLICT ON CONSTRAINT syncapi_receipts_unique" +
+	" DO UPDATE SET id = EXCLUDED.id, event_id = EXCLUDED.event_id, receipt_ts = EXCLUDED.receipt_ts" +
+	" RETURNING id"
+
+const selectRoomReceiptsAfterSQL = "" +
+	"SELECT room_id, receipt_type, user_id, event_id, receipt_ts FROM syncapi_receipts" +
+	" WHERE room_id = ANY($1) AND id > $2"
+
+const selectMaxReceiptIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_receipts"
+
+type receiptStatements struct {
+	upsertReceiptStmt           *sql.Stmt
+	selectRoomReceiptsAfterStmt *sql.Stmt
+	selectMaxReceiptIDStmt      *sql.Stmt
+}
+
+func NewPostgresReceiptsTable(db *sql.DB) (tables.Receipts, error) {
+	s := &receiptStatements{}
+	_, err := db.Exec(receiptsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertReceiptStmt, err = db.Prepare(upsertReceiptSQL); err != nil {
+		return nil, err
+	}
+	if s.selectRoomReceiptsAfterStmt, err = db.Prepare(selectRoomReceiptsAfterSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMaxReceiptIDStmt, err = db.Prepare(selectMaxReceiptIDSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *receiptStatements) UpsertReceipt(
+	ctx context.Context, txn *sql.Tx, receipt api.OutputReceiptEvent,
+) (pos types.StreamPosition, err error) {
+	stmt := internal.TxStmt(txn, s.upsertReceiptStmt)
+	err = stmt.QueryRowContext(
+		ctx, receipt.RoomID, receipt.Type, receipt.UserID, receipt.EventID, receipt.Timestamp,
+	).Scan(&pos)
+	return
+}
+
+func (s *receiptStatements) SelectRoomReceiptsAfter(
+	ctx context.Context, txn *sql.Tx, roomIDs []string, streamPos types.StreamPosition,
+) ([]api.OutputReceiptEvent, error) {
+	stmt := internal.TxStmt(txn, s.selectRoomReceiptsAfterStmt)
+	rows, err := stmt.QueryContext(ctx, pq.Array(roomIDs), streamPos)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomReceiptsAfter: rows.close() failed")
+
+	var receipts []api.OutputReceiptEvent
+	for rows.Next() {
+		var r api.OutputReceiptEvent
+		if err = rows.Scan(&r.RoomID, &r.Type, &r.UserID, &r.EventID, &r.Timestamp); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, r)
+	}
+	return receipts, rows.Err()
+}
+
+func (s *receiptStatements) SelectMaxReceiptID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := internal.TxStmt(txn, s.selectMaxReceiptIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/lib/pq"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const searchSchema = `
+-- Stores a full-text index of the searchable parts of room events.
+CREATE TABLE IF NOT EXISTS syncapi_search (
+    event_id TEXT NOT NULL PRIMARY KEY,
+    room_id TEXT NOT NULL,
+    -- The part of the event which was indexed, e.g. "content.body".
+    key TEXT NOT NULL,
+    -- The position of the event in the sync stream, used to order by recency.
+    stream_pos BIGINT NOT NULL,
+    vector tsvector NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_vector_idx ON syncapi_search USING GIN (vector);
+CREATE INDEX IF NOT EXISTS syncapi_search_room_id_idx ON syncapi_search (room_id);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT INTO syncapi_search (event_id, room_id, key, stream_pos, vector)" +
+	" VALUES ($1, $2, $3, $4, to_tsvector('english', $5))" +
+	" ON CONFLICT (event_id) DO NOTHING"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search WHERE event_id = $1"
+
+const selectSearchResultsByRankSQL = "" +
+	"SELECT event_id, ts_rank_cd(vector, query) AS rank" +
+	" FROM syncapi_search, to_tsquery('english', $1) AS query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" ORDER BY rank DESC, stream_pos DESC LIMIT $4 OFFSET $5"
+
+const selectSearchResultsByRecencySQL = "" +
+	"SELECT event_id, ts_rank_cd(vector, query) AS rank" +
+	" FROM syncapi_search, to_tsquery('english', $1) AS query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)" +
+	" ORDER BY stream_pos DESC LIMIT $4 OFFSET $5"
+
+const selectSearchResultsCountSQL = "" +
+	"SELECT COUNT(*) FROM syncapi_search, to_tsquery('english', $1) AS query" +
+	" WHERE vector @@ query AND room_id = ANY($2) AND key = ANY($3)"
+
+type searchStatements struct {
+	insertSearchEventStmt            *sql.Stmt
+	deleteSearchEventStmt            *sql.Stmt
+	selectSearchResultsByRankStmt    *sql.Stmt
+	selectSearchResultsByRecencyStmt *sql.Stmt
+	selectSearchResultsCountStmt     *sql.Stmt
+}
+
+func NewPostgresSearchTable(db *sql.DB) (tables.Search, error) {
+	s := &searchStatements{}
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertSearchEventStmt, err = db.Prepare(insertSearchEventSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSearchEventStmt, err = db.Prepare(deleteSearchEventSQL); err != nil {
+		return nil, err
+	}
+	if s.selectSearchResultsByRankStmt, err = db.Prepare(selectSearchResultsByRankSQL); err != nil {
+		return nil, err
+	}
+	if s.selectSearchResultsByRecencyStmt, err = db.Prepare(selectSearchResultsByRecencySQL); err != nil {
+		return nil, err
+	}
+	if s.selectSearchResultsCountStmt, err = db.Prepare(selectSearchResultsCountSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent,
+	pos types.StreamPosition, key, value string,
+) error {
+	stmt := internal.TxStmt(txn, s.insertSearchEventStmt)
+	_, err := stmt.ExecContext(ctx, event.EventID(), event.RoomID(), key, pos, value)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteSearchEventStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+func (s *searchStatements) SelectSearchResults(
+	ctx context.Context, txn *sql.Tx, searchTerm string, roomIDs, keys []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	terms := types.SearchTerms(searchTerm)
+	if len(terms) == 0 || len(roomIDs) == 0 || len(keys) == 0 {
+		return []types.SearchResult{}, 0, nil
+	}
+	// Every word has to match, allowing for prefixes of longer words.
+	query := strings.Join(terms, ":* & ") + ":*"
+
+	var count int
+	stmt := internal.TxStmt(txn, s.selectSearchResultsCountStmt)
+	err := stmt.QueryRowContext(ctx, query, pq.StringArray(roomIDs), pq.StringArray(keys)).Scan(&count)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stmt = internal.TxStmt(txn, s.selectSearchResultsByRecencyStmt)
+	if orderByRank {
+		stmt = internal.TxStmt(txn, s.selectSearchResultsByRankStmt)
+	}
+	rows, err := stmt.QueryContext(ctx, query, pq.StringArray(roomIDs), pq.StringArray(keys), limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectSearchResults: rows.close() failed")
+
+	results := []types.SearchResult{}
+	for rows.Next() {
+		var result types.SearchResult
+		if err = rows.Scan(&result.EventID, &result.Rank); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	return results, count, rows.Err()
+}
@@ -69,6 +69,34 @@ func NewDatabase(dbDataSourceName string, dbProperties internal.DbProperties) (*
 	if err != nil {
 		return nil, err
 	}
+	keyChanges, err := NewPostgresKeyChangesTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	sendToDevice, err := NewPostgresSendToDeviceTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	receipts, err := NewPostgresReceiptsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	presence, err := NewPostgresPresenceTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	notificationCounts, err := NewPostgresNotificationCountsTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	search, err := NewPostgresSearchTable(d.db)
+	if err != nil {
+		return nil, err
+	}
+	purge, err := NewPostgresPurgeStatements(d.db)
+	if err != nil {
+		return nil, err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Invites:             invites,
@@ -77,6 +105,13 @@ func NewDatabase(dbDataSourceName string, dbProperties internal.DbProperties) (*
 		Topology:            topology,
 		CurrentRoomState:    currState,
 		BackwardExtremities: backwardExtremities,
+		KeyChanges:          keyChanges,
+		SendToDevice:        sendToDevice,
+		Receipts:            receipts,
+		Presence:            presence,
+		NotificationCounts:  notificationCounts,
+		Search:              search,
+		Purge:               purge,
 		EDUCache:            cache.New(),
 	}
 	return &d, nil
@@ -5,9 +5,12 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"math"
+	"strings"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/internal"
 	"github.com/matrix-org/dendrite/roomserver/api"
@@ -15,6 +18,7 @@ import (
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/sirupsen/logrus"
+	"github.com/tidwall/gjson"
 )
 
 // Database is a temporary struct until we have made syncserver.go the same for both pq/sqlite
@@ -27,6 +31,13 @@ type Database struct {
 	Topology            tables.Topology
 	CurrentRoomState    tables.CurrentRoomState
 	BackwardExtremities tables.BackwardsExtremities
+	KeyChanges          tables.KeyChanges
+	SendToDevice        tables.SendToDevice
+	Receipts            tables.Receipts
+	Presence            tables.Presence
+	NotificationCounts  tables.NotificationCounts
+	Search              tables.Search
+	Purge               tables.Purge
 	EDUCache            *cache.EDUCache
 }
 
@@ -47,11 +58,11 @@ func (d *Database) Events(ctx context.Context, eventIDs []string) ([]gomatrixser
 }
 
 // GetEventsInStreamingRange retrieves all of the events on a given ordering using the
-// given extremities and limit.
+// given extremities, which match the given filter, up to its limit.
 func (d *Database) GetEventsInStreamingRange(
 	ctx context.Context,
 	from, to *types.StreamingToken,
-	roomID string, limit int,
+	roomID string, eventFilter *gomatrixserverlib.RoomEventFilter,
 	backwardOrdering bool,
 ) (events []types.StreamEvent, err error) {
 	r := types.Range{
@@ -62,14 +73,14 @@ func (d *Database) GetEventsInStreamingRange(
 	if backwardOrdering {
 		// When using backward ordering, we want the most recent events first.
 		if events, err = d.OutputEvents.SelectRecentEvents(
-			ctx, nil, roomID, r, limit, false, false,
+			ctx, nil, roomID, r, eventFilter, false, false,
 		); err != nil {
 			return
 		}
 	} else {
 		// When using forward ordering, we want the least recent events first.
 		if events, err = d.OutputEvents.SelectEarlyEvents(
-			ctx, nil, roomID, r, limit,
+			ctx, nil, roomID, r, eventFilter,
 		); err != nil {
 			return
 		}
@@ -137,6 +148,30 @@ func (d *Database) SyncStreamPosition(ctx context.Context) (types.StreamPosition
 		if maxInviteID > maxID {
 			maxID = maxInviteID
 		}
+		var maxKeyChangeID int64
+		maxKeyChangeID, err = d.KeyChanges.SelectMaxKeyChangeID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if maxKeyChangeID > maxID {
+			maxID = maxKeyChangeID
+		}
+		var maxSendToDeviceID int64
+		maxSendToDeviceID, err = d.SendToDevice.SelectMaxSendToDeviceMessageID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if maxSendToDeviceID > maxID {
+			maxID = maxSendToDeviceID
+		}
+		var maxPresenceID int64
+		maxPresenceID, err = d.Presence.SelectMaxPresenceID(ctx, txn)
+		if err != nil {
+			return err
+		}
+		if maxPresenceID > maxID {
+			maxID = maxPresenceID
+		}
 		return nil
 	})
 	return types.StreamPosition(maxID), err
@@ -166,6 +201,51 @@ func (d *Database) RetireInviteEvent(
 	return err
 }
 
+// RedactEvent replaces the stored JSON of the redacted event with its redacted
+// form, so that it is only ever returned redacted from now on. It is a no-op
+// if we don't have the event.
+func (d *Database) RedactEvent(
+	ctx context.Context, redactedEventID string, redactedBecause *gomatrixserverlib.HeaderedEvent,
+) error {
+	redactedEvents, err := d.Events(ctx, []string{redactedEventID})
+	if err != nil {
+		return err
+	}
+	if len(redactedEvents) == 0 {
+		return nil
+	}
+	// Events loaded from the database are already flagged as redacted,
+	// which would make Redact a no-op, so reparse them first.
+	roomVersion := redactedEvents[0].RoomVersion
+	eventToRedact, err := gomatrixserverlib.NewEventFromTrustedJSON(redactedEvents[0].JSON(), false, roomVersion)
+	if err != nil {
+		return err
+	}
+	redactionEvent := redactedBecause.Unwrap()
+	stripped := eventToRedact.Redact()
+	redacted, err := gomatrixserverlib.NewEventFromTrustedJSON(stripped.JSON(), true, roomVersion)
+	if err != nil {
+		return err
+	}
+	redacted, err = redacted.SetUnsigned(map[string]interface{}{
+		"redacted_because": gomatrixserverlib.RawJSON(redactionEvent.JSON()),
+	})
+	if err != nil {
+		return err
+	}
+	headered := redacted.Headered(roomVersion)
+	return internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		if err = d.OutputEvents.UpdateEventJSON(ctx, txn, &headered); err != nil {
+			return err
+		}
+		// The redacted content can't be searched for any more.
+		if err = d.Search.DeleteSearchEvent(ctx, txn, redactedEventID); err != nil {
+			return err
+		}
+		return d.CurrentRoomState.UpdateEventJSON(ctx, txn, &headered)
+	})
+}
+
 // GetAccountDataInRange returns all account data for a given user inserted or
 // updated between two given positions
 // Returns a map following the format data[roomID] = []dataTypes
@@ -194,6 +274,190 @@ func (d *Database) UpsertAccountData(
 	return
 }
 
+// StoreKeyChange records that the device list for the given user has changed.
+// Returns the sync stream position of the change.
+// Returns an error if there was an issue with the upsert
+func (d *Database) StoreKeyChange(
+	ctx context.Context, userID string,
+) (sp types.StreamPosition, err error) {
+	err = internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		sp, err = d.KeyChanges.InsertKeyChange(ctx, txn, userID)
+		return err
+	})
+	return
+}
+
+// KeyChangesInRange returns the IDs of users whose device lists changed
+// between two given positions.
+func (d *Database) KeyChangesInRange(
+	ctx context.Context, r types.Range,
+) ([]string, error) {
+	return d.KeyChanges.SelectKeyChangesInRange(ctx, nil, r)
+}
+
+// StoreNewSendForDeviceMessage stores a send-to-device message for the given
+// local device until the device has received it.
+// Returns the sync stream position of the message.
+func (d *Database) StoreNewSendForDeviceMessage(
+	ctx context.Context, userID, deviceID string, event eduAPI.SendToDeviceEvent,
+) (sp types.StreamPosition, err error) {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	err = internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		sp, err = d.SendToDevice.InsertSendToDeviceMessage(ctx, txn, userID, deviceID, string(content))
+		return err
+	})
+	return
+}
+
+// SendToDeviceUpdatesForSync removes all send-to-device messages for the device
+// which the client acknowledged by syncing from the since position, and returns
+// all messages which are still pending up to the to position.
+func (d *Database) SendToDeviceUpdatesForSync(
+	ctx context.Context, userID, deviceID string, since, to types.StreamPosition,
+) (events []eduAPI.SendToDeviceEvent, err error) {
+	err = internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		if since > 0 {
+			if err = d.SendToDevice.DeleteSendToDeviceMessages(ctx, txn, userID, deviceID, since); err != nil {
+				return err
+			}
+		}
+		var messages []string
+		messages, err = d.SendToDevice.SelectSendToDeviceMessages(ctx, txn, userID, deviceID, to)
+		if err != nil {
+			return err
+		}
+		for _, message := range messages {
+			var event eduAPI.SendToDeviceEvent
+			if err = json.Unmarshal([]byte(message), &event); err != nil {
+				return err
+			}
+			events = append(events, event)
+		}
+		return nil
+	})
+	return
+}
+
+// StoreReceipt stores a read receipt, replacing any previous receipt of the
+// same type from the same user in the same room.
+// Returns the receipt stream position of the receipt.
+func (d *Database) StoreReceipt(
+	ctx context.Context, receipt eduAPI.OutputReceiptEvent,
+) (sp types.StreamPosition, err error) {
+	err = internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		sp, err = d.Receipts.UpsertReceipt(ctx, txn, receipt)
+		return err
+	})
+	return
+}
+
+// StorePresence stores the latest presence of a user.
+// Returns the sync stream position of the update.
+func (d *Database) StorePresence(
+	ctx context.Context, presence eduAPI.OutputPresenceEvent,
+) (sp types.StreamPosition, err error) {
+	err = internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		sp, err = d.Presence.UpsertPresence(ctx, txn, presence)
+		return err
+	})
+	return
+}
+
+// GetPresence returns the latest presence of a user, or nil if we have
+// never seen any presence for them.
+func (d *Database) GetPresence(
+	ctx context.Context, userID string,
+) (*eduAPI.OutputPresenceEvent, error) {
+	presence, err := d.Presence.SelectPresenceForUser(ctx, nil, userID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return presence, err
+}
+
+// PresenceInRange returns the latest presence of every user whose
+// presence changed between two given positions.
+func (d *Database) PresenceInRange(
+	ctx context.Context, r types.Range,
+) ([]eduAPI.OutputPresenceEvent, error) {
+	return d.Presence.SelectPresenceInRange(ctx, nil, r)
+}
+
+// IncrementNotificationCounts records a new notification for the user in the
+// room, which may also be a highlight.
+func (d *Database) IncrementNotificationCounts(
+	ctx context.Context, userID, roomID string, highlight bool,
+) error {
+	return d.NotificationCounts.IncrementNotificationCounts(ctx, nil, userID, roomID, highlight)
+}
+
+// ResetNotificationCounts clears the notification counts of the user in the room.
+func (d *Database) ResetNotificationCounts(
+	ctx context.Context, userID, roomID string,
+) error {
+	return d.NotificationCounts.DeleteNotificationCounts(ctx, nil, userID, roomID)
+}
+
+// PurgeRoom deletes everything stored about the room, e.g. because an admin
+// has purged it from the server.
+func (d *Database) PurgeRoom(ctx context.Context, roomID string) error {
+	return internal.WithTransaction(d.DB, func(txn *sql.Tx) error {
+		return d.Purge.PurgeRoom(ctx, txn, roomID)
+	})
+}
+
+// GetNotificationCounts returns the notification counts of the user in every
+// room with unread notifications, keyed by room ID.
+func (d *Database) GetNotificationCounts(
+	ctx context.Context, userID string,
+) (map[string]types.UnreadNotifications, error) {
+	return d.NotificationCounts.SelectNotificationCounts(ctx, nil, userID)
+}
+
+// SharedUsers returns the IDs of all users who share a room with the given user,
+// including the user themselves if they are joined to any room.
+func (d *Database) SharedUsers(
+	ctx context.Context, userID string,
+) ([]string, error) {
+	return d.CurrentRoomState.SelectSharedUsers(ctx, nil, userID)
+}
+
+// RoomIDsWithMembership returns the IDs of the rooms which the user currently
+// has the given membership in.
+func (d *Database) RoomIDsWithMembership(
+	ctx context.Context, userID, membership string,
+) ([]string, error) {
+	return d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, nil, userID, membership)
+}
+
+// SearchEvents returns the events in the given rooms which match the search
+// term under any of the given keys, along with the total number of matches.
+func (d *Database) SearchEvents(
+	ctx context.Context, searchTerm string, roomIDs, keys []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	return d.Search.SelectSearchResults(ctx, nil, searchTerm, roomIDs, keys, orderByRank, limit, offset)
+}
+
+// indexEventForSearch adds the searchable part of the event's content to the
+// search index, if it has one.
+func (d *Database) indexEventForSearch(
+	ctx context.Context, txn *sql.Tx, ev *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition,
+) error {
+	key, ok := types.SearchableEventTypes[ev.Type()]
+	if !ok {
+		return nil
+	}
+	value := gjson.GetBytes(ev.Content(), strings.TrimPrefix(key, "content."))
+	if value.Type != gjson.String || value.Str == "" {
+		return nil
+	}
+	return d.Search.InsertSearchEvent(ctx, txn, ev, pos, key, value.Str)
+}
+
 func (d *Database) StreamEventsToEvents(device *authtypes.Device, in []types.StreamEvent) []gomatrixserverlib.HeaderedEvent {
 	out := make([]gomatrixserverlib.HeaderedEvent, len(in))
 	for i := 0; i < len(in); i++ {
@@ -269,6 +533,10 @@ func (d *Database) WriteEvent(
 			return err
 		}
 
+		if err = d.indexEventForSearch(ctx, txn, ev, pos); err != nil {
+			return err
+		}
+
 		if err = d.handleBackwardExtremities(ctx, txn, ev); err != nil {
 			return err
 		}
@@ -322,7 +590,7 @@ func (d *Database) updateRoomState(
 func (d *Database) GetEventsInTopologicalRange(
 	ctx context.Context,
 	from, to *types.TopologyToken,
-	roomID string, limit int,
+	roomID string, eventFilter *gomatrixserverlib.RoomEventFilter,
 	backwardOrdering bool,
 ) (events []types.StreamEvent, err error) {
 	var minDepth, maxDepth, maxStreamPosForMaxDepth types.StreamPosition
@@ -343,7 +611,7 @@ func (d *Database) GetEventsInTopologicalRange(
 	// Select the event IDs from the defined range.
 	var eIDs []string
 	eIDs, err = d.Topology.SelectEventIDsInRange(
-		ctx, nil, roomID, minDepth, maxDepth, maxStreamPosForMaxDepth, limit, !backwardOrdering,
+		ctx, nil, roomID, minDepth, maxDepth, maxStreamPosForMaxDepth, eventFilter, !backwardOrdering,
 	)
 	if err != nil {
 		return
@@ -414,7 +682,36 @@ func (d *Database) syncPositionTx(
 	if maxInviteID > maxEventID {
 		maxEventID = maxInviteID
 	}
-	sp = types.NewStreamToken(types.StreamPosition(maxEventID), types.StreamPosition(d.EDUCache.GetLatestSyncPosition()))
+	maxKeyChangeID, err := d.KeyChanges.SelectMaxKeyChangeID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	if maxKeyChangeID > maxEventID {
+		maxEventID = maxKeyChangeID
+	}
+	maxSendToDeviceID, err := d.SendToDevice.SelectMaxSendToDeviceMessageID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	if maxSendToDeviceID > maxEventID {
+		maxEventID = maxSendToDeviceID
+	}
+	maxPresenceID, err := d.Presence.SelectMaxPresenceID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	if maxPresenceID > maxEventID {
+		maxEventID = maxPresenceID
+	}
+	maxReceiptID, err := d.Receipts.SelectMaxReceiptID(ctx, txn)
+	if err != nil {
+		return sp, err
+	}
+	sp = types.NewStreamToken(
+		types.StreamPosition(maxEventID),
+		types.StreamPosition(d.EDUCache.GetLatestSyncPosition()),
+		types.StreamPosition(maxReceiptID),
+	)
 	return
 }
 
@@ -424,7 +721,7 @@ func (d *Database) addPDUDeltaToResponse(
 	ctx context.Context,
 	device authtypes.Device,
 	r types.Range,
-	numRecentEventsPerRoom int,
+	filter *gomatrixserverlib.Filter,
 	wantFullState bool,
 	res *types.Response,
 ) (joinedRoomIDs []string, err error) {
@@ -440,8 +737,6 @@ func (d *Database) addPDUDeltaToResponse(
 		}
 	}()
 
-	stateFilter := gomatrixserverlib.DefaultStateFilter() // TODO: use filter provided in request
-
 	// Work out which rooms to return in the response. This is done by getting not only the currently
 	// joined rooms, but also which rooms have membership transitions for this user between the 2 PDU stream positions.
 	// This works out what the 'state' key should be for each room as well as which membership block
@@ -449,11 +744,11 @@ func (d *Database) addPDUDeltaToResponse(
 	var deltas []stateDelta
 	if !wantFullState {
 		deltas, joinedRoomIDs, err = d.getStateDeltas(
-			ctx, &device, txn, r, device.UserID, &stateFilter,
+			ctx, &device, txn, r, device.UserID, &filter.Room.State,
 		)
 	} else {
 		deltas, joinedRoomIDs, err = d.getStateDeltasForFullStateSync(
-			ctx, &device, txn, r, device.UserID, &stateFilter,
+			ctx, &device, txn, r, device.UserID, &filter.Room.State,
 		)
 	}
 	if err != nil {
@@ -461,14 +756,17 @@ func (d *Database) addPDUDeltaToResponse(
 	}
 
 	for _, delta := range deltas {
-		err = d.addRoomDeltaToResponse(ctx, &device, txn, r, delta, numRecentEventsPerRoom, res)
+		if !roomAllowedByFilter(filter, delta.roomID) {
+			continue
+		}
+		err = d.addRoomDeltaToResponse(ctx, &device, txn, r, delta, filter, res)
 		if err != nil {
 			return nil, err
 		}
 	}
 
 	// TODO: This should be done in getStateDeltas
-	if err = d.addInvitesToResponse(ctx, txn, device.UserID, r, res); err != nil {
+	if err = d.addInvitesToResponse(ctx, txn, device.UserID, r, filter, res); err != nil {
 		return nil, err
 	}
 
@@ -510,28 +808,117 @@ func (d *Database) addTypingDeltaToResponse(
 	return nil
 }
 
+// addReceiptDeltaToResponse adds all receipts in the joined rooms to a sync
+// response since the specified position.
+func (d *Database) addReceiptDeltaToResponse(
+	ctx context.Context,
+	since types.StreamingToken,
+	joinedRoomIDs []string,
+	res *types.Response,
+) error {
+	receipts, err := d.Receipts.SelectRoomReceiptsAfter(ctx, nil, joinedRoomIDs, since.ReceiptPosition())
+	if err != nil {
+		return err
+	}
+
+	// Group the receipts by room, then by event ID, receipt type and user ID,
+	// which is the format of the m.receipt event content.
+	type receiptTS struct {
+		TS gomatrixserverlib.Timestamp `json:"ts"`
+	}
+	contents := make(map[string]map[string]map[string]map[string]receiptTS)
+	for _, r := range receipts {
+		content, ok := contents[r.RoomID]
+		if !ok {
+			content = make(map[string]map[string]map[string]receiptTS)
+			contents[r.RoomID] = content
+		}
+		if _, ok = content[r.EventID]; !ok {
+			content[r.EventID] = make(map[string]map[string]receiptTS)
+		}
+		if _, ok = content[r.EventID][r.Type]; !ok {
+			content[r.EventID][r.Type] = make(map[string]receiptTS)
+		}
+		content[r.EventID][r.Type][r.UserID] = receiptTS{TS: r.Timestamp}
+	}
+
+	for roomID, content := range contents {
+		ev := gomatrixserverlib.ClientEvent{
+			Type:   "m.receipt",
+			RoomID: roomID,
+		}
+		ev.Content, err = json.Marshal(content)
+		if err != nil {
+			return err
+		}
+
+		jr, ok := res.Rooms.Join[roomID]
+		if !ok {
+			jr = *types.NewJoinResponse()
+		}
+		jr.Ephemeral.Events = append(jr.Ephemeral.Events, ev)
+		res.Rooms.Join[roomID] = jr
+	}
+	return nil
+}
+
 // addEDUDeltaToResponse adds updates for EDUs of each type since fromPos if
 // the positions of that type are not equal in fromPos and toPos.
 func (d *Database) addEDUDeltaToResponse(
+	ctx context.Context,
 	fromPos, toPos types.StreamingToken,
 	joinedRoomIDs []string,
+	filter *gomatrixserverlib.Filter,
 	res *types.Response,
 ) (err error) {
+	// Only send EDUs for the rooms which are allowed by the filter.
+	ephemeralFilter := &filter.Room.Ephemeral
+	var ephemeralRoomIDs []string
+	for _, roomID := range joinedRoomIDs {
+		if roomAllowedByFilter(filter, roomID) &&
+			types.FilterAllowsRoom(roomID, ephemeralFilter.Rooms, ephemeralFilter.NotRooms) {
+			ephemeralRoomIDs = append(ephemeralRoomIDs, roomID)
+		}
+	}
+	if len(ephemeralRoomIDs) == 0 {
+		return
+	}
 
-	if fromPos.EDUPosition() != toPos.EDUPosition() {
+	if fromPos.EDUPosition() != toPos.EDUPosition() && ephemeralTypeAllowed(ephemeralFilter, gomatrixserverlib.MTyping) {
 		err = d.addTypingDeltaToResponse(
-			fromPos, joinedRoomIDs, res,
+			fromPos, ephemeralRoomIDs, res,
+		)
+		if err != nil {
+			return
+		}
+	}
+
+	if fromPos.ReceiptPosition() != toPos.ReceiptPosition() && ephemeralTypeAllowed(ephemeralFilter, "m.receipt") {
+		err = d.addReceiptDeltaToResponse(
+			ctx, fromPos, ephemeralRoomIDs, res,
 		)
 	}
 
 	return
 }
 
+// ephemeralTypeAllowed returns true if EDUs of the given type pass the
+// ephemeral filter. EDUs have no sender, so only the [not_]types apply.
+func ephemeralTypeAllowed(filter *gomatrixserverlib.RoomEventFilter, eduType string) bool {
+	return types.FilterAllowsEvent(eduType, "", filter.Types, filter.NotTypes, nil, nil)
+}
+
+// roomAllowedByFilter returns true if the room passes the rooms and
+// not_rooms lists of the room filter.
+func roomAllowedByFilter(filter *gomatrixserverlib.Filter, roomID string) bool {
+	return types.FilterAllowsRoom(roomID, filter.Room.Rooms, filter.Room.NotRooms)
+}
+
 func (d *Database) IncrementalSync(
 	ctx context.Context,
 	device authtypes.Device,
 	fromPos, toPos types.StreamingToken,
-	numRecentEventsPerRoom int,
+	filter *gomatrixserverlib.Filter,
 	wantFullState bool,
 ) (*types.Response, error) {
 	nextBatchPos := fromPos.WithUpdates(toPos)
@@ -545,7 +932,7 @@ func (d *Database) IncrementalSync(
 			To:   toPos.PDUPosition(),
 		}
 		joinedRoomIDs, err = d.addPDUDeltaToResponse(
-			ctx, device, r, numRecentEventsPerRoom, wantFullState, res,
+			ctx, device, r, filter, wantFullState, res,
 		)
 	} else {
 		joinedRoomIDs, err = d.CurrentRoomState.SelectRoomIDsWithMembership(
@@ -557,7 +944,7 @@ func (d *Database) IncrementalSync(
 	}
 
 	err = d.addEDUDeltaToResponse(
-		fromPos, toPos, joinedRoomIDs, res,
+		ctx, fromPos, toPos, joinedRoomIDs, filter, res,
 	)
 	if err != nil {
 		return nil, err
@@ -571,7 +958,7 @@ func (d *Database) IncrementalSync(
 func (d *Database) getResponseWithPDUsForCompleteSync(
 	ctx context.Context,
 	userID string,
-	numRecentEventsPerRoom int,
+	filter *gomatrixserverlib.Filter,
 ) (
 	res *types.Response,
 	toPos types.StreamingToken,
@@ -612,52 +999,42 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 		return
 	}
 
-	stateFilter := gomatrixserverlib.DefaultStateFilter() // TODO: use filter provided in request
-
 	// Build up a /sync response. Add joined rooms.
 	for _, roomID := range joinedRoomIDs {
+		if !roomAllowedByFilter(filter, roomID) {
+			continue
+		}
 		var stateEvents []gomatrixserverlib.HeaderedEvent
-		stateEvents, err = d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, &stateFilter)
+		stateEvents, err = d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, &filter.Room.State)
 		if err != nil {
 			return
 		}
-		// TODO: When filters are added, we may need to call this multiple times to get enough events.
-		//       See: https://github.com/matrix-org/synapse/blob/v0.19.3/synapse/handlers/sync.py#L316
-		var recentStreamEvents []types.StreamEvent
-		recentStreamEvents, err = d.OutputEvents.SelectRecentEvents(
-			ctx, txn, roomID, r, numRecentEventsPerRoom, true, true,
+		var recentEvents []gomatrixserverlib.HeaderedEvent
+		var prevBatch types.TopologyToken
+		var limited bool
+		stateEvents, recentEvents, prevBatch, limited, err = d.getRoomForCompleteSync(
+			ctx, txn, userID, roomID, r, filter, stateEvents,
 		)
 		if err != nil {
 			return
 		}
-
-		// Retrieve the backward topology position, i.e. the position of the
-		// oldest event in the room's topology.
-		var prevBatchStr string
-		if len(recentStreamEvents) > 0 {
-			var backwardTopologyPos, backwardStreamPos types.StreamPosition
-			backwardTopologyPos, backwardStreamPos, err = d.Topology.SelectPositionInTopology(ctx, txn, recentStreamEvents[0].EventID())
-			if err != nil {
-				return
-			}
-			prevBatch := types.NewTopologyToken(backwardTopologyPos, backwardStreamPos)
-			prevBatch.Decrement()
-			prevBatchStr = prevBatch.String()
-		}
-
-		// We don't include a device here as we don't need to send down
-		// transaction IDs for complete syncs
-		recentEvents := d.StreamEventsToEvents(nil, recentStreamEvents)
-		stateEvents = removeDuplicates(stateEvents, recentEvents)
 		jr := types.NewJoinResponse()
-		jr.Timeline.PrevBatch = prevBatchStr
+		jr.Timeline.PrevBatch = prevBatch.String()
 		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		jr.Timeline.Limited = true
+		jr.Timeline.Limited = limited
 		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Join[roomID] = *jr
 	}
 
-	if err = d.addInvitesToResponse(ctx, txn, userID, r, res); err != nil {
+	// Add the rooms which the user has left or been banned from, if the
+	// filter asks for them.
+	if filter.Room.IncludeLeave {
+		if err = d.addLeftRoomsToResponse(ctx, txn, userID, r, filter, res); err != nil {
+			return
+		}
+	}
+
+	if err = d.addInvitesToResponse(ctx, txn, userID, r, filter, res); err != nil {
 		return
 	}
 
@@ -666,10 +1043,10 @@ func (d *Database) getResponseWithPDUsForCompleteSync(
 }
 
 func (d *Database) CompleteSync(
-	ctx context.Context, userID string, numRecentEventsPerRoom int,
+	ctx context.Context, userID string, filter *gomatrixserverlib.Filter,
 ) (*types.Response, error) {
 	res, toPos, joinedRoomIDs, err := d.getResponseWithPDUsForCompleteSync(
-		ctx, userID, numRecentEventsPerRoom,
+		ctx, userID, filter,
 	)
 	if err != nil {
 		return nil, err
@@ -677,7 +1054,7 @@ func (d *Database) CompleteSync(
 
 	// Use a zero value SyncPosition for fromPos so all EDU states are added.
 	err = d.addEDUDeltaToResponse(
-		types.NewStreamToken(0, 0), toPos, joinedRoomIDs, res,
+		ctx, types.NewStreamToken(0, 0, 0), toPos, joinedRoomIDs, filter, res,
 	)
 	if err != nil {
 		return nil, err
@@ -686,6 +1063,114 @@ func (d *Database) CompleteSync(
 	return res, nil
 }
 
+// getRoomForCompleteSync returns the timeline of a room for a complete sync,
+// along with the given state of the room with the timeline events removed.
+func (d *Database) getRoomForCompleteSync(
+	ctx context.Context, txn *sql.Tx,
+	userID, roomID string,
+	r types.Range,
+	filter *gomatrixserverlib.Filter,
+	stateEvents []gomatrixserverlib.HeaderedEvent,
+) (
+	state, recentEvents []gomatrixserverlib.HeaderedEvent,
+	prevBatch types.TopologyToken,
+	limited bool,
+	err error,
+) {
+	var recentStreamEvents []types.StreamEvent
+	recentStreamEvents, limited, err = d.selectRecentEventsForRoom(ctx, txn, roomID, r, filter)
+	if err != nil {
+		return
+	}
+	prevBatch, err = d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
+	if err != nil {
+		return
+	}
+
+	// We don't include a device here as we don't need to send down
+	// transaction IDs for complete syncs
+	recentEvents = d.StreamEventsToEvents(nil, recentStreamEvents)
+	state = removeDuplicates(stateEvents, recentEvents)
+	if !types.FilterAllowsRoom(roomID, filter.Room.State.Rooms, filter.Room.State.NotRooms) {
+		state = nil
+	} else if filter.Room.State.LazyLoadMembers {
+		state, err = d.lazyLoadMembers(ctx, userID, roomID, &filter.Room.State, state, recentEvents)
+	}
+	return
+}
+
+// addLeftRoomsToResponse adds the rooms which the user has left or been
+// banned from to a complete sync response, for filters with include_leave.
+// The timeline and state are cut off at the user's membership event, so
+// that nothing which happened after they left is leaked.
+func (d *Database) addLeftRoomsToResponse(
+	ctx context.Context, txn *sql.Tx,
+	userID string,
+	r types.Range,
+	filter *gomatrixserverlib.Filter,
+	res *types.Response,
+) error {
+	for _, membership := range []string{gomatrixserverlib.Leave, gomatrixserverlib.Ban} {
+		roomIDs, err := d.CurrentRoomState.SelectRoomIDsWithMembership(ctx, txn, userID, membership)
+		if err != nil {
+			return err
+		}
+		for _, roomID := range roomIDs {
+			if !roomAllowedByFilter(filter, roomID) {
+				continue
+			}
+			membershipEvent, err := d.CurrentRoomState.SelectStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, userID)
+			if err != nil {
+				return err
+			}
+			if membershipEvent == nil {
+				continue
+			}
+			stateEvents, err := d.CurrentRoomState.SelectCurrentState(ctx, txn, roomID, &filter.Room.State)
+			if err != nil {
+				return err
+			}
+
+			// Work out when each of the state events was added to the current
+			// state, so that we can leave out the ones added after the user left.
+			eventIDs := []string{membershipEvent.EventID()}
+			for _, ev := range stateEvents {
+				eventIDs = append(eventIDs, ev.EventID())
+			}
+			streamEvents, err := d.CurrentRoomState.SelectEventsWithEventIDs(ctx, txn, eventIDs)
+			if err != nil {
+				return err
+			}
+			addedAt := make(map[string]types.StreamPosition, len(streamEvents))
+			for _, ev := range streamEvents {
+				addedAt[ev.EventID()] = ev.StreamPosition
+			}
+			leftRange := r
+			leftRange.To = addedAt[membershipEvent.EventID()]
+			var stateAtLeave []gomatrixserverlib.HeaderedEvent
+			for _, ev := range stateEvents {
+				if addedAt[ev.EventID()] <= leftRange.To {
+					stateAtLeave = append(stateAtLeave, ev)
+				}
+			}
+
+			stateAtLeave, recentEvents, prevBatch, limited, err := d.getRoomForCompleteSync(
+				ctx, txn, userID, roomID, leftRange, filter, stateAtLeave,
+			)
+			if err != nil {
+				return err
+			}
+			lr := types.NewLeaveResponse()
+			lr.Timeline.PrevBatch = prevBatch.String()
+			lr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
+			lr.Timeline.Limited = limited
+			lr.State.Events = gomatrixserverlib.HeaderedToClientEvents(stateAtLeave, gomatrixserverlib.FormatSync)
+			res.Rooms.Leave[roomID] = *lr
+		}
+	}
+	return nil
+}
+
 var txReadOnlySnapshot = sql.TxOptions{
 	// Set the isolation level so that we see a snapshot of the database.
 	// In PostgreSQL repeatable read transactions will see a snapshot taken
@@ -700,6 +1185,7 @@ func (d *Database) addInvitesToResponse(
 	ctx context.Context, txn *sql.Tx,
 	userID string,
 	r types.Range,
+	filter *gomatrixserverlib.Filter,
 	res *types.Response,
 ) error {
 	invites, err := d.Invites.SelectInviteEventsInRange(
@@ -709,6 +1195,9 @@ func (d *Database) addInvitesToResponse(
 		return err
 	}
 	for roomID, inviteEvent := range invites {
+		if !roomAllowedByFilter(filter, roomID) {
+			continue
+		}
 		ir := types.NewInviteResponse(inviteEvent)
 		res.Rooms.Invite[roomID] = *ir
 	}
@@ -734,6 +1223,80 @@ func (d *Database) getBackwardTopologyPos(
 	return tok, nil
 }
 
+// selectRecentEventsForRoom returns the most recent events in the room which
+// match the timeline filter, and whether there were more of them than the
+// limit of the filter.
+func (d *Database) selectRecentEventsForRoom(
+	ctx context.Context, txn *sql.Tx,
+	roomID string,
+	r types.Range,
+	filter *gomatrixserverlib.Filter,
+) ([]types.StreamEvent, bool, error) {
+	timelineFilter := filter.Room.Timeline
+	if !types.FilterAllowsRoom(roomID, timelineFilter.Rooms, timelineFilter.NotRooms) {
+		return nil, false, nil
+	}
+	// Ask for one more event than the limit, so that we know whether the
+	// timeline was limited.
+	if timelineFilter.Limit < math.MaxInt32 {
+		timelineFilter.Limit++
+	}
+	events, err := d.OutputEvents.SelectRecentEvents(ctx, txn, roomID, r, &timelineFilter, true, true)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(events) > filter.Room.Timeline.Limit {
+		// The events are in chronological order, so drop the oldest.
+		return events[len(events)-filter.Room.Timeline.Limit:], true, nil
+	}
+	return events, false, nil
+}
+
+// lazyLoadMembers applies the lazy_load_members option of the state filter
+// by only keeping the membership events of the syncing user and of the
+// senders of the timeline events in the state. Those of the senders which
+// aren't in the state or the timeline are fetched from the current state.
+func (d *Database) lazyLoadMembers(
+	ctx context.Context,
+	userID, roomID string,
+	stateFilter *gomatrixserverlib.StateFilter,
+	stateEvents, timelineEvents []gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	senders := make(map[string]bool)
+	have := make(map[string]bool)
+	for _, ev := range timelineEvents {
+		senders[ev.Sender()] = true
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil {
+			have[*ev.StateKey()] = true
+		}
+	}
+	result := make([]gomatrixserverlib.HeaderedEvent, 0, len(stateEvents))
+	for _, ev := range stateEvents {
+		if ev.Type() == gomatrixserverlib.MRoomMember && ev.StateKey() != nil {
+			stateKey := *ev.StateKey()
+			if stateKey != userID && !senders[stateKey] {
+				continue
+			}
+			have[stateKey] = true
+		}
+		result = append(result, ev)
+	}
+	var missing []gomatrixserverlib.HeaderedEvent
+	for sender := range senders {
+		if have[sender] {
+			continue
+		}
+		ev, err := d.CurrentRoomState.SelectStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, sender)
+		if err != nil {
+			return nil, err
+		}
+		if ev != nil {
+			missing = append(missing, *ev)
+		}
+	}
+	return append(result, types.FilterStateEvents(missing, stateFilter)...), nil
+}
+
 // addRoomDeltaToResponse adds a room state delta to a sync response
 func (d *Database) addRoomDeltaToResponse(
 	ctx context.Context,
@@ -741,27 +1304,31 @@ func (d *Database) addRoomDeltaToResponse(
 	txn *sql.Tx,
 	r types.Range,
 	delta stateDelta,
-	numRecentEventsPerRoom int,
+	filter *gomatrixserverlib.Filter,
 	res *types.Response,
 ) error {
 	if delta.membershipPos > 0 && delta.membership == gomatrixserverlib.Leave {
 		// make sure we don't leak recent events after the leave event.
-		// TODO: History visibility makes this somewhat complex to handle correctly. For example:
-		// TODO: This doesn't work for join -> leave in a single /sync request (see events prior to join).
-		// TODO: This will fail on join -> leave -> sensitive msg -> join -> leave
-		//       in a single /sync request
-		// This is all "okay" assuming history_visibility == "shared" which it is by default.
+		// Any remaining events which the user isn't allowed to see are
+		// removed by the request pool, based on the room's history visibility.
 		r.To = delta.membershipPos
 	}
-	recentStreamEvents, err := d.OutputEvents.SelectRecentEvents(
-		ctx, txn, delta.roomID, r,
-		numRecentEventsPerRoom, true, true,
+	recentStreamEvents, limited, err := d.selectRecentEventsForRoom(
+		ctx, txn, delta.roomID, r, filter,
 	)
 	if err != nil {
 		return err
 	}
 	recentEvents := d.StreamEventsToEvents(device, recentStreamEvents)
 	delta.stateEvents = removeDuplicates(delta.stateEvents, recentEvents) // roll back
+	if !types.FilterAllowsRoom(delta.roomID, filter.Room.State.Rooms, filter.Room.State.NotRooms) {
+		delta.stateEvents = nil
+	} else if filter.Room.State.LazyLoadMembers {
+		delta.stateEvents, err = d.lazyLoadMembers(ctx, device.UserID, delta.roomID, &filter.Room.State, delta.stateEvents, recentEvents)
+		if err != nil {
+			return err
+		}
+	}
 	prevBatch, err := d.getBackwardTopologyPos(ctx, txn, recentStreamEvents)
 	if err != nil {
 		return err
@@ -773,18 +1340,16 @@ func (d *Database) addRoomDeltaToResponse(
 
 		jr.Timeline.PrevBatch = prevBatch.String()
 		jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		jr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+		jr.Timeline.Limited = limited
 		jr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Join[delta.roomID] = *jr
 	case gomatrixserverlib.Leave:
 		fallthrough // transitions to leave are the same as ban
 	case gomatrixserverlib.Ban:
-		// TODO: recentEvents may contain events that this user is not allowed to see because they are
-		//       no longer in the room.
 		lr := types.NewLeaveResponse()
 		lr.Timeline.PrevBatch = prevBatch.String()
 		lr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(recentEvents, gomatrixserverlib.FormatSync)
-		lr.Timeline.Limited = false // TODO: if len(events) >= numRecents + 1 and then set limited:true
+		lr.Timeline.Limited = limited
 		lr.State.Events = gomatrixserverlib.HeaderedToClientEvents(delta.stateEvents, gomatrixserverlib.FormatSync)
 		res.Rooms.Leave[delta.roomID] = *lr
 	}
@@ -897,8 +1462,11 @@ func (d *Database) getStateDeltas(
 	// - Get all CURRENTLY joined rooms, and add them to 'joined' block.
 	var deltas []stateDelta
 
-	// get all the state events ever between these two positions
-	stateNeeded, eventMap, err := d.OutputEvents.SelectStateInRange(ctx, txn, r, stateFilter)
+	// get all the state events ever between these two positions. The state
+	// filter isn't applied here as we need all the membership events to work
+	// out the transitions, so it is applied to the deltas instead.
+	allStateFilter := gomatrixserverlib.DefaultStateFilter()
+	stateNeeded, eventMap, err := d.OutputEvents.SelectStateInRange(ctx, txn, r, &allStateFilter)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -929,7 +1497,7 @@ func (d *Database) getStateDeltas(
 				deltas = append(deltas, stateDelta{
 					membership:    membership,
 					membershipPos: ev.StreamPosition,
-					stateEvents:   d.StreamEventsToEvents(device, stateStreamEvents),
+					stateEvents:   types.FilterStateEvents(d.StreamEventsToEvents(device, stateStreamEvents), stateFilter),
 					roomID:        roomID,
 				})
 				break
@@ -945,7 +1513,7 @@ func (d *Database) getStateDeltas(
 	for _, joinedRoomID := range joinedRoomIDs {
 		deltas = append(deltas, stateDelta{
 			membership:  gomatrixserverlib.Join,
-			stateEvents: d.StreamEventsToEvents(device, state[joinedRoomID]),
+			stateEvents: types.FilterStateEvents(d.StreamEventsToEvents(device, state[joinedRoomID]), stateFilter),
 			roomID:      joinedRoomID,
 		})
 	}
@@ -983,8 +1551,10 @@ func (d *Database) getStateDeltasForFullStateSync(
 		})
 	}
 
-	// Get all the state events ever between these two positions
-	stateNeeded, eventMap, err := d.OutputEvents.SelectStateInRange(ctx, txn, r, stateFilter)
+	// Get all the state events ever between these two positions, filtering
+	// them afterwards as in getStateDeltas.
+	allStateFilter := gomatrixserverlib.DefaultStateFilter()
+	stateNeeded, eventMap, err := d.OutputEvents.SelectStateInRange(ctx, txn, r, &allStateFilter)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -1000,7 +1570,7 @@ func (d *Database) getStateDeltasForFullStateSync(
 					deltas = append(deltas, stateDelta{
 						membership:    membership,
 						membershipPos: ev.StreamPosition,
-						stateEvents:   d.StreamEventsToEvents(device, stateStreamEvents),
+						stateEvents:   types.FilterStateEvents(d.StreamEventsToEvents(device, stateStreamEvents), stateFilter),
 						roomID:        roomID,
 					})
 				}
@@ -115,17 +115,12 @@ func (s *accountDataStatements) SelectAccountDataInRange(
 		// check if we should add this by looking at the filter.
 		// It would be nice if we could do this in SQL-land, but the mix of variadic
 		// and positional parameters makes the query annoyingly hard to do, it's easier
-		// and clearer to do it in Go-land. If there are no filters for [not]types then
-		// this gets skipped.
-		for _, includeType := range accountDataFilterPart.Types {
-			if includeType != dataType { // TODO: wildcard support
-				continue
-			}
-		}
-		for _, excludeType := range accountDataFilterPart.NotTypes {
-			if excludeType == dataType { // TODO: wildcard support
-				continue
-			}
+		// and clearer to do it in Go-land. Account data has no sender, so only the
+		// [not_]types of the filter apply.
+		if !types.FilterAllowsEvent(
+			dataType, "", accountDataFilterPart.Types, accountDataFilterPart.NotTypes, nil, nil,
+		) {
+			continue
 		}
 
 		if len(data[roomID]) > 0 {
@@ -0,0 +1,102 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+)
+
+// filterConvertTypeWildcardToSQL converts wildcards as defined in
+// https://matrix.org/docs/spec/client_server/r0.3.0.html#post-matrix-client-r0-user-userid-filter
+// to SQL wildcards that can be used with LIKE()
+func filterConvertTypeWildcardToSQL(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	ret := make([]string, len(values))
+	for i := range values {
+		ret[i] = strings.Replace(values[i], "*", "%", -1)
+	}
+	return ret
+}
+
+// prepareWithFilters appends the sender, type and contains_url parts of a
+// filter to a query which ends in a WHERE clause, followed by the given
+// ordering and the limit. SQLite has no array parameters, so the lists have
+// to be expanded into the query, which means that it can't be prepared
+// ahead of time. Returns the query and its parameters.
+func prepareWithFilters(
+	query string, params []interface{},
+	senders, notSenders, types, notTypes []string, containsURL *bool,
+	orderBy string, limit int,
+) (string, []interface{}) {
+	offset := len(params)
+	if senders != nil {
+		query += " AND sender IN " + internal.QueryVariadicOffset(len(senders), offset)
+		for _, v := range senders {
+			params = append(params, v)
+		}
+		offset += len(senders)
+	}
+	if len(notSenders) > 0 {
+		query += " AND sender NOT IN " + internal.QueryVariadicOffset(len(notSenders), offset)
+		for _, v := range notSenders {
+			params = append(params, v)
+		}
+		offset += len(notSenders)
+	}
+	if types != nil {
+		clauses := make([]string, len(types))
+		for i, v := range filterConvertTypeWildcardToSQL(types) {
+			offset++
+			clauses[i] = fmt.Sprintf("type LIKE $%d", offset)
+			params = append(params, v)
+		}
+		if len(clauses) == 0 {
+			// An empty list of types matches nothing.
+			clauses = []string{"1 = 0"}
+		}
+		query += " AND (" + strings.Join(clauses, " OR ") + ")"
+	}
+	for _, v := range filterConvertTypeWildcardToSQL(notTypes) {
+		offset++
+		query += fmt.Sprintf(" AND type NOT LIKE $%d", offset)
+		params = append(params, v)
+	}
+	if containsURL != nil {
+		offset++
+		query += fmt.Sprintf(" AND contains_url = $%d", offset)
+		params = append(params, *containsURL)
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT $%d", orderBy, offset+1)
+	params = append(params, limit)
+	return query, params
+}
+
+// queryWithFilters runs a query built by prepareWithFilters, in the
+// transaction if one is given.
+func queryWithFilters(
+	ctx context.Context, db *sql.DB, txn *sql.Tx, query string, params []interface{},
+) (*sql.Rows, error) {
+	if txn != nil {
+		return txn.QueryContext(ctx, query, params...)
+	}
+	return db.QueryContext(ctx, query, params...)
+}
@@ -0,0 +1,114 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const keyChangesSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_key_changes (
+    id INTEGER PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    UNIQUE (user_id)
+);
+`
+
+const insertKeyChangeSQL = "" +
+	"INSERT INTO syncapi_key_changes (id, user_id) VALUES ($1, $2)" +
+	" ON CONFLICT (user_id) DO UPDATE" +
+	" SET id = EXCLUDED.id"
+
+const selectKeyChangesInRangeSQL = "" +
+	"SELECT user_id FROM syncapi_key_changes WHERE id > $1 AND id <= $2"
+
+const selectMaxKeyChangeIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_key_changes"
+
+type keyChangesStatements struct {
+	streamIDStatements          *streamIDStatements
+	insertKeyChangeStmt         *sql.Stmt
+	selectKeyChangesInRangeStmt *sql.Stmt
+	selectMaxKeyChangeIDStmt    *sql.Stmt
+}
+
+func NewSqliteKeyChangesTable(db *sql.DB, streamID *streamIDStatements) (tables.KeyChanges, error) {
+	s := &keyChangesStatements{
+		streamIDStatements: streamID,
+	}
+	_, err := db.Exec(keyChangesSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertKeyChangeStmt, err = db.Prepare(insertKeyChangeSQL); err != nil {
+		return nil, err
+	}
+	if s.selectKeyChangesInRangeStmt, err = db.Prepare(selectKeyChangesInRangeSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMaxKeyChangeIDStmt, err = db.Prepare(selectMaxKeyChangeIDSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *keyChangesStatements) InsertKeyChange(
+	ctx context.Context, txn *sql.Tx, userID string,
+) (pos types.StreamPosition, err error) {
+	pos, err = s.streamIDStatements.nextStreamID(ctx, txn)
+	if err != nil {
+		return
+	}
+	_, err = txn.Stmt(s.insertKeyChangeStmt).ExecContext(ctx, pos, userID)
+	return
+}
+
+func (s *keyChangesStatements) SelectKeyChangesInRange(
+	ctx context.Context, txn *sql.Tx, r types.Range,
+) ([]string, error) {
+	stmt := internal.TxStmt(txn, s.selectKeyChangesInRangeStmt)
+	rows, err := stmt.QueryContext(ctx, r.Low(), r.High())
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectKeyChangesInRange: rows.close() failed")
+
+	var userIDs []string
+	for rows.Next() {
+		var userID string
+		if err = rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
+
+func (s *keyChangesStatements) SelectMaxKeyChangeID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := internal.TxStmt(txn, s.selectMaxKeyChangeIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -54,23 +54,24 @@ const insertEventSQL = "" +
 	") VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) " +
 	"ON CONFLICT (event_id) DO UPDATE SET exclude_from_sync = $13"
 
+const updateEventJSONSQL = "" +
+	"UPDATE syncapi_output_room_events SET headered_event_json=$1 WHERE event_id=$2"
+
 const selectEventsSQL = "" +
 	"SELECT id, headered_event_json, session_id, exclude_from_sync, transaction_id FROM syncapi_output_room_events WHERE event_id = $1"
 
+// The filter, ordering and limit are added to these by prepareWithFilters.
 const selectRecentEventsSQL = "" +
 	"SELECT id, headered_event_json, session_id, exclude_from_sync, transaction_id FROM syncapi_output_room_events" +
-	" WHERE room_id = $1 AND id > $2 AND id <= $3" +
-	" ORDER BY id DESC LIMIT $4"
+	" WHERE room_id = $1 AND id > $2 AND id <= $3"
 
 const selectRecentEventsForSyncSQL = "" +
 	"SELECT id, headered_event_json, session_id, exclude_from_sync, transaction_id FROM syncapi_output_room_events" +
-	" WHERE room_id = $1 AND id > $2 AND id <= $3 AND exclude_from_sync = FALSE" +
-	" ORDER BY id DESC LIMIT $4"
+	" WHERE room_id = $1 AND id > $2 AND id <= $3 AND exclude_from_sync = FALSE"
 
 const selectEarlyEventsSQL = "" +
 	"SELECT id, headered_event_json, session_id, exclude_from_sync, transaction_id FROM syncapi_output_room_events" +
-	" WHERE room_id = $1 AND id > $2 AND id <= $3" +
-	" ORDER BY id ASC LIMIT $4"
+	" WHERE room_id = $1 AND id > $2 AND id <= $3"
 
 const selectMaxEventIDSQL = "" +
 	"SELECT MAX(id) FROM syncapi_output_room_events"
@@ -100,18 +101,18 @@ const selectStateInRangeSQL = "" +
 	" LIMIT $8" // limit
 
 type outputRoomEventsStatements struct {
-	streamIDStatements            *streamIDStatements
-	insertEventStmt               *sql.Stmt
-	selectEventsStmt              *sql.Stmt
-	selectMaxEventIDStmt          *sql.Stmt
-	selectRecentEventsStmt        *sql.Stmt
-	selectRecentEventsForSyncStmt *sql.Stmt
-	selectEarlyEventsStmt         *sql.Stmt
-	selectStateInRangeStmt        *sql.Stmt
+	db                     *sql.DB
+	streamIDStatements     *streamIDStatements
+	insertEventStmt        *sql.Stmt
+	updateEventJSONStmt    *sql.Stmt
+	selectEventsStmt       *sql.Stmt
+	selectMaxEventIDStmt   *sql.Stmt
+	selectStateInRangeStmt *sql.Stmt
 }
 
 func NewSqliteEventsTable(db *sql.DB, streamID *streamIDStatements) (tables.Events, error) {
 	s := &outputRoomEventsStatements{
+		db:                 db,
 		streamIDStatements: streamID,
 	}
 	_, err := db.Exec(outputRoomEventsSchema)
@@ -121,19 +122,13 @@ func NewSqliteEventsTable(db *sql.DB, streamID *streamIDStatements) (tables.Even
 	if s.insertEventStmt, err = db.Prepare(insertEventSQL); err != nil {
 		return nil, err
 	}
-	if s.selectEventsStmt, err = db.Prepare(selectEventsSQL); err != nil {
-		return nil, err
-	}
-	if s.selectMaxEventIDStmt, err = db.Prepare(selectMaxEventIDSQL); err != nil {
+	if s.updateEventJSONStmt, err = db.Prepare(updateEventJSONSQL); err != nil {
 		return nil, err
 	}
-	if s.selectRecentEventsStmt, err = db.Prepare(selectRecentEventsSQL); err != nil {
-		return nil, err
-	}
-	if s.selectRecentEventsForSyncStmt, err = db.Prepare(selectRecentEventsForSyncSQL); err != nil {
+	if s.selectEventsStmt, err = db.Prepare(selectEventsSQL); err != nil {
 		return nil, err
 	}
-	if s.selectEarlyEventsStmt, err = db.Prepare(selectEarlyEventsSQL); err != nil {
+	if s.selectMaxEventIDStmt, err = db.Prepare(selectMaxEventIDSQL); err != nil {
 		return nil, err
 	}
 	if s.selectStateInRangeStmt, err = db.Prepare(selectStateInRangeSQL); err != nil {
@@ -202,7 +197,7 @@ func (s *outputRoomEventsStatements) SelectStateInRange(
 			}).Warn("StateBetween: ignoring deleted state")
 		}
 
-		// TODO: Handle redacted events
+		// Redacted events are stored in their redacted form, see UpdateEventJSON.
 		var ev gomatrixserverlib.HeaderedEvent
 		if err := json.Unmarshal(eventBytes, &ev); err != nil {
 			return nil, nil, err
@@ -258,13 +253,8 @@ func (s *outputRoomEventsStatements) InsertEvent(
 		txnID = &transactionID.TransactionID
 	}
 
-	// Parse content as JSON and search for an "url" key
-	containsURL := false
-	var content map[string]interface{}
-	if json.Unmarshal(event.Content(), &content) != nil {
-		// Set containsURL to true if url is present
-		_, containsURL = content["url"]
-	}
+	// Check whether the content has an "url" key, for contains_url filters
+	containsURL := types.ContainsURL(event.Content())
 
 	var headeredJSON []byte
 	headeredJSON, err = json.Marshal(event)
@@ -308,17 +298,20 @@ func (s *outputRoomEventsStatements) InsertEvent(
 
 func (s *outputRoomEventsStatements) SelectRecentEvents(
 	ctx context.Context, txn *sql.Tx,
-	roomID string, r types.Range, limit int,
+	roomID string, r types.Range, eventFilter *gomatrixserverlib.RoomEventFilter,
 	chronologicalOrder bool, onlySyncEvents bool,
 ) ([]types.StreamEvent, error) {
-	var stmt *sql.Stmt
+	query := selectRecentEventsSQL
 	if onlySyncEvents {
-		stmt = internal.TxStmt(txn, s.selectRecentEventsForSyncStmt)
-	} else {
-		stmt = internal.TxStmt(txn, s.selectRecentEventsStmt)
+		query = selectRecentEventsForSyncSQL
 	}
-
-	rows, err := stmt.QueryContext(ctx, roomID, r.Low(), r.High(), limit)
+	query, params := prepareWithFilters(
+		query, []interface{}{roomID, r.Low(), r.High()},
+		eventFilter.Senders, eventFilter.NotSenders,
+		eventFilter.Types, eventFilter.NotTypes,
+		eventFilter.ContainsURL, "id DESC", eventFilter.Limit,
+	)
+	rows, err := queryWithFilters(ctx, s.db, txn, query, params)
 	if err != nil {
 		return nil, err
 	}
@@ -340,10 +333,15 @@ func (s *outputRoomEventsStatements) SelectRecentEvents(
 
 func (s *outputRoomEventsStatements) SelectEarlyEvents(
 	ctx context.Context, txn *sql.Tx,
-	roomID string, r types.Range, limit int,
+	roomID string, r types.Range, eventFilter *gomatrixserverlib.RoomEventFilter,
 ) ([]types.StreamEvent, error) {
-	stmt := internal.TxStmt(txn, s.selectEarlyEventsStmt)
-	rows, err := stmt.QueryContext(ctx, roomID, r.Low(), r.High(), limit)
+	query, params := prepareWithFilters(
+		selectEarlyEventsSQL, []interface{}{roomID, r.Low(), r.High()},
+		eventFilter.Senders, eventFilter.NotSenders,
+		eventFilter.Types, eventFilter.NotTypes,
+		eventFilter.ContainsURL, "id ASC", eventFilter.Limit,
+	)
+	rows, err := queryWithFilters(ctx, s.db, txn, query, params)
 	if err != nil {
 		return nil, err
 	}
@@ -395,7 +393,7 @@ func rowsToStreamEvents(rows *sql.Rows) ([]types.StreamEvent, error) {
 		if err := rows.Scan(&streamPos, &eventBytes, &sessionID, &excludeFromSync, &txnID); err != nil {
 			return nil, err
 		}
-		// TODO: Handle redacted events
+		// Redacted events are stored in their redacted form, see UpdateEventJSON.
 		var ev gomatrixserverlib.HeaderedEvent
 		if err := json.Unmarshal(eventBytes, &ev); err != nil {
 			return nil, err
@@ -431,3 +429,16 @@ func unmarshalStateIDs(addIDsJSON, delIDsJSON string) (addIDs []string, delIDs [
 	}
 	return
 }
+
+// UpdateEventJSON replaces the stored JSON of an event, e.g. once it has
+// been redacted.
+func (s *outputRoomEventsStatements) UpdateEventJSON(
+	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent,
+) error {
+	headeredJSON, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = internal.TxStmt(txn, s.updateEventJSONStmt).ExecContext(ctx, headeredJSON, event.EventID())
+	return err
+}
@@ -43,19 +43,15 @@ const insertEventInTopologySQL = "" +
 	" VALUES ($1, $2, $3, $4)" +
 	" ON CONFLICT DO NOTHING"
 
-const selectEventIDsInRangeASCSQL = "" +
-	"SELECT event_id FROM syncapi_output_room_events_topology" +
-	" WHERE room_id = $1 AND (" +
-	"(topological_position > $2 AND topological_position < $3) OR" +
-	"(topological_position = $4 AND stream_position <= $5)" +
-	") ORDER BY topological_position ASC, stream_position ASC LIMIT $6"
-
-const selectEventIDsInRangeDESCSQL = "" +
-	"SELECT event_id  FROM syncapi_output_room_events_topology" +
-	" WHERE room_id = $1 AND (" +
-	"(topological_position > $2 AND topological_position < $3) OR" +
-	"(topological_position = $4 AND stream_position <= $5)" +
-	") ORDER BY topological_position DESC, stream_position DESC LIMIT $6"
+// The filter, ordering and limit are added to this by prepareWithFilters.
+// The events table is joined so that the filter can be applied to the events.
+const selectEventIDsInRangeSQL = "" +
+	"SELECT t.event_id FROM syncapi_output_room_events_topology t" +
+	" INNER JOIN syncapi_output_room_events e ON e.event_id = t.event_id" +
+	" WHERE t.room_id = $1 AND (" +
+	"(t.topological_position > $2 AND t.topological_position < $3) OR" +
+	"(t.topological_position = $4 AND t.stream_position <= $5)" +
+	")"
 
 const selectPositionInTopologySQL = "" +
 	"SELECT topological_position, stream_position FROM syncapi_output_room_events_topology" +
@@ -66,15 +62,16 @@ const selectMaxPositionInTopologySQL = "" +
 	" WHERE room_id = $1 ORDER BY stream_position DESC"
 
 type outputRoomEventsTopologyStatements struct {
+	db                              *sql.DB
 	insertEventInTopologyStmt       *sql.Stmt
-	selectEventIDsInRangeASCStmt    *sql.Stmt
-	selectEventIDsInRangeDESCStmt   *sql.Stmt
 	selectPositionInTopologyStmt    *sql.Stmt
 	selectMaxPositionInTopologyStmt *sql.Stmt
 }
 
 func NewSqliteTopologyTable(db *sql.DB) (tables.Topology, error) {
-	s := &outputRoomEventsTopologyStatements{}
+	s := &outputRoomEventsTopologyStatements{
+		db: db,
+	}
 	_, err := db.Exec(outputRoomEventsTopologySchema)
 	if err != nil {
 		return nil, err
@@ -82,12 +79,6 @@ func NewSqliteTopologyTable(db *sql.DB) (tables.Topology, error) {
 	if s.insertEventInTopologyStmt, err = db.Prepare(insertEventInTopologySQL); err != nil {
 		return nil, err
 	}
-	if s.selectEventIDsInRangeASCStmt, err = db.Prepare(selectEventIDsInRangeASCSQL); err != nil {
-		return nil, err
-	}
-	if s.selectEventIDsInRangeDESCStmt, err = db.Prepare(selectEventIDsInRangeDESCSQL); err != nil {
-		return nil, err
-	}
 	if s.selectPositionInTopologyStmt, err = db.Prepare(selectPositionInTopologySQL); err != nil {
 		return nil, err
 	}
@@ -112,25 +103,30 @@ func (s *outputRoomEventsTopologyStatements) InsertEventInTopology(
 func (s *outputRoomEventsTopologyStatements) SelectEventIDsInRange(
 	ctx context.Context, txn *sql.Tx, roomID string,
 	minDepth, maxDepth, maxStreamPos types.StreamPosition,
-	limit int, chronologicalOrder bool,
+	eventFilter *gomatrixserverlib.RoomEventFilter, chronologicalOrder bool,
 ) (eventIDs []string, err error) {
 	// Decide on the selection's order according to whether chronological order
 	// is requested or not.
-	var stmt *sql.Stmt
+	orderBy := "t.topological_position DESC, t.stream_position DESC"
 	if chronologicalOrder {
-		stmt = internal.TxStmt(txn, s.selectEventIDsInRangeASCStmt)
-	} else {
-		stmt = internal.TxStmt(txn, s.selectEventIDsInRangeDESCStmt)
+		orderBy = "t.topological_position ASC, t.stream_position ASC"
 	}
 
 	// Query the event IDs.
-	rows, err := stmt.QueryContext(ctx, roomID, minDepth, maxDepth, maxDepth, maxStreamPos, limit)
+	query, params := prepareWithFilters(
+		selectEventIDsInRangeSQL, []interface{}{roomID, minDepth, maxDepth, maxDepth, maxStreamPos},
+		eventFilter.Senders, eventFilter.NotSenders,
+		eventFilter.Types, eventFilter.NotTypes,
+		eventFilter.ContainsURL, orderBy, eventFilter.Limit,
+	)
+	rows, err := queryWithFilters(ctx, s.db, txn, query, params)
 	if err == sql.ErrNoRows {
 		// If no event matched the request, return an empty slice.
 		return []string{}, nil
 	} else if err != nil {
 		return
 	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectEventIDsInRange: rows.close() failed")
 
 	// Return the IDs.
 	var eventID string
@@ -0,0 +1,96 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+)
+
+// The statements used to purge a room. They don't have a table of their own,
+// they remove the rows belonging to a room from the other tables.
+
+const purgeSearchValuesSQL = "" +
+	"DELETE FROM syncapi_search_fts WHERE docid IN (SELECT id FROM syncapi_search WHERE room_id = $1)"
+
+const purgeSearchSQL = "" +
+	"DELETE FROM syncapi_search WHERE room_id = $1"
+
+const purgeOutputRoomEventsSQL = "" +
+	"DELETE FROM syncapi_output_room_events WHERE room_id = $1"
+
+const purgeTopologySQL = "" +
+	"DELETE FROM syncapi_output_room_events_topology WHERE room_id = $1"
+
+const purgeCurrentRoomStateSQL = "" +
+	"DELETE FROM syncapi_current_room_state WHERE room_id = $1"
+
+const purgeBackwardExtremitiesSQL = "" +
+	"DELETE FROM syncapi_backward_extremities WHERE room_id = $1"
+
+const purgeInvitesSQL = "" +
+	"DELETE FROM syncapi_invite_events WHERE room_id = $1"
+
+const purgeReceiptsSQL = "" +
+	"DELETE FROM syncapi_receipts WHERE room_id = $1"
+
+const purgeNotificationCountsSQL = "" +
+	"DELETE FROM syncapi_notification_counts WHERE room_id = $1"
+
+const purgeAccountDataSQL = "" +
+	"DELETE FROM syncapi_account_data_type WHERE room_id = $1"
+
+type purgeStatements struct {
+	purgeStmts []*sql.Stmt
+}
+
+func NewSqlitePurgeStatements(db *sql.DB) (tables.Purge, error) {
+	s := &purgeStatements{}
+	// The full-text values must be purged before the indexed events they are
+	// looked up by.
+	for _, query := range []string{
+		purgeSearchValuesSQL,
+		purgeSearchSQL,
+		purgeOutputRoomEventsSQL,
+		purgeTopologySQL,
+		purgeCurrentRoomStateSQL,
+		purgeBackwardExtremitiesSQL,
+		purgeInvitesSQL,
+		purgeReceiptsSQL,
+		purgeNotificationCountsSQL,
+		purgeAccountDataSQL,
+	} {
+		stmt, err := db.Prepare(query)
+		if err != nil {
+			return nil, err
+		}
+		s.purgeStmts = append(s.purgeStmts, stmt)
+	}
+	return s, nil
+}
+
+func (s *purgeStatements) PurgeRoom(
+	ctx context.Context, txn *sql.Tx, roomID string,
+) error {
+	for _, stmt := range s.purgeStmts {
+		if _, err := internal.TxStmt(txn, stmt).ExecContext(ctx, roomID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+
+	"github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const receiptsSchema = `
+-- Stores the most recent receipt of each type for each user in each room.
+CREATE TABLE IF NOT EXISTS syncapi_receipts (
+    id BIGINT PRIMARY KEY,
+    room_id TEXT NOT NULL,
+    receipt_type TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    event_id TEXT NOT NULL,
+    receipt_ts BIGINT NOT NULL,
+    UNIQUE (room_id, receipt_type, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_receipts_room_id_idx ON syncapi_receipts(room_id);
+`
+
+const upsertReceiptSQL = "" +
+	"INSERT INTO syncapi_receipts (id, room_id, receipt_type, user_id, event_id, receipt_ts)" +
+	" VALUES ($1, $2, $3, $4, $5, $6)" +
+	" ON CONFLICT (room_id, receipt_type, user_id)" +
+	" DO UPDATE SET id = $7, event_id = $8, receipt_ts = $9"
+
+const selectRoomReceiptsAfterSQL = "" +
+	"SELECT room_id, receipt_type, user_id, event_id, receipt_ts FROM syncapi_receipts" +
+	" WHERE id > $1 AND room_id IN ($2)"
+
+const selectMaxReceiptIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_receipts"
+
+type receiptStatements struct {
+	db                     *sql.DB
+	streamIDStatements     *streamIDStatements
+	upsertReceiptStmt      *sql.Stmt
+	selectMaxReceiptIDStmt *sql.Stmt
+}
+
+func NewSqliteReceiptsTable(db *sql.DB, streamID *streamIDStatements) (tables.Receipts, error) {
+	s := &receiptStatements{
+		db:                 db,
+		streamIDStatements: streamID,
+	}
+	_, err := db.Exec(receiptsSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.upsertReceiptStmt, err = db.Prepare(upsertReceiptSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMaxReceiptIDStmt, err = db.Prepare(selectMaxReceiptIDSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *receiptStatements) UpsertReceipt(
+	ctx context.Context, txn *sql.Tx, receipt api.OutputReceiptEvent,
+) (pos types.StreamPosition, err error) {
+	pos, err = s.streamIDStatements.nextReceiptID(ctx, txn)
+	if err != nil {
+		return
+	}
+	_, err = txn.Stmt(s.upsertReceiptStmt).ExecContext(
+		ctx, pos, receipt.RoomID, receipt.Type, receipt.UserID, receipt.EventID, receipt.Timestamp,
+		pos, receipt.EventID, receipt.Timestamp,
+	)
+	return
+}
+
+func (s *receiptStatements) SelectRoomReceiptsAfter(
+	ctx context.Context, txn *sql.Tx, roomIDs []string, streamPos types.StreamPosition,
+) ([]api.OutputReceiptEvent, error) {
+	if len(roomIDs) == 0 {
+		return nil, nil
+	}
+	params := make([]interface{}, len(roomIDs)+1)
+	params[0] = streamPos
+	for k, v := range roomIDs {
+		params[k+1] = v
+	}
+	query := strings.Replace(selectRoomReceiptsAfterSQL, "($2)", internal.QueryVariadicOffset(len(roomIDs), 1), 1)
+	var rows *sql.Rows
+	var err error
+	if txn != nil {
+		rows, err = txn.QueryContext(ctx, query, params...)
+	} else {
+		rows, err = s.db.QueryContext(ctx, query, params...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectRoomReceiptsAfter: rows.close() failed")
+
+	var receipts []api.OutputReceiptEvent
+	for rows.Next() {
+		var r api.OutputReceiptEvent
+		if err = rows.Scan(&r.RoomID, &r.Type, &r.UserID, &r.EventID, &r.Timestamp); err != nil {
+			return nil, err
+		}
+		receipts = append(receipts, r)
+	}
+	return receipts, rows.Err()
+}
+
+func (s *receiptStatements) SelectMaxReceiptID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := internal.TxStmt(txn, s.selectMaxReceiptIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const searchSchema = `
+-- Stores the events which are in the full-text index.
+CREATE TABLE IF NOT EXISTS syncapi_search (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    event_id TEXT NOT NULL UNIQUE,
+    room_id TEXT NOT NULL,
+    -- The part of the event which was indexed, e.g. "content.body".
+    key TEXT NOT NULL,
+    -- The position of the event in the sync stream, used to order by recency.
+    stream_pos BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS syncapi_search_room_id_idx ON syncapi_search (room_id);
+-- The full-text index itself, where the docid is the id in syncapi_search.
+CREATE VIRTUAL TABLE IF NOT EXISTS syncapi_search_fts USING fts4(value, tokenize=porter);
+`
+
+const insertSearchEventSQL = "" +
+	"INSERT OR IGNORE INTO syncapi_search (event_id, room_id, key, stream_pos)" +
+	" VALUES ($1, $2, $3, $4)"
+
+const insertSearchValueSQL = "" +
+	"INSERT INTO syncapi_search_fts (docid, value) VALUES ($1, $2)"
+
+const deleteSearchValueSQL = "" +
+	"DELETE FROM syncapi_search_fts WHERE docid IN (SELECT id FROM syncapi_search WHERE event_id = $1)"
+
+const deleteSearchEventSQL = "" +
+	"DELETE FROM syncapi_search WHERE event_id = $1"
+
+// The room ID and key lists are added to this by SelectSearchResults.
+const selectSearchResultsSQL = "" +
+	"SELECT s.event_id, s.stream_pos, matchinfo(syncapi_search_fts, 'pcx')" +
+	" FROM syncapi_search_fts INNER JOIN syncapi_search s ON s.id = syncapi_search_fts.docid" +
+	" WHERE syncapi_search_fts MATCH $1"
+
+type searchStatements struct {
+	db                    *sql.DB
+	insertSearchEventStmt *sql.Stmt
+	insertSearchValueStmt *sql.Stmt
+	deleteSearchValueStmt *sql.Stmt
+	deleteSearchEventStmt *sql.Stmt
+}
+
+func NewSqliteSearchTable(db *sql.DB) (tables.Search, error) {
+	s := &searchStatements{
+		db: db,
+	}
+	_, err := db.Exec(searchSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertSearchEventStmt, err = db.Prepare(insertSearchEventSQL); err != nil {
+		return nil, err
+	}
+	if s.insertSearchValueStmt, err = db.Prepare(insertSearchValueSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSearchValueStmt, err = db.Prepare(deleteSearchValueSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSearchEventStmt, err = db.Prepare(deleteSearchEventSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *searchStatements) InsertSearchEvent(
+	ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent,
+	pos types.StreamPosition, key, value string,
+) error {
+	stmt := internal.TxStmt(txn, s.insertSearchEventStmt)
+	res, err := stmt.ExecContext(ctx, event.EventID(), event.RoomID(), key, pos)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+		// The event is already in the index.
+		return err
+	}
+	docID, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	stmt = internal.TxStmt(txn, s.insertSearchValueStmt)
+	_, err = stmt.ExecContext(ctx, docID, value)
+	return err
+}
+
+func (s *searchStatements) DeleteSearchEvent(
+	ctx context.Context, txn *sql.Tx, eventID string,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteSearchValueStmt)
+	if _, err := stmt.ExecContext(ctx, eventID); err != nil {
+		return err
+	}
+	stmt = internal.TxStmt(txn, s.deleteSearchEventStmt)
+	_, err := stmt.ExecContext(ctx, eventID)
+	return err
+}
+
+// SelectSearchResults ranks the results itself, as FTS4 has no ranking
+// function, so it has to load every matching event before paginating.
+func (s *searchStatements) SelectSearchResults(
+	ctx context.Context, txn *sql.Tx, searchTerm string, roomIDs, keys []string,
+	orderByRank bool, limit, offset int,
+) ([]types.SearchResult, int, error) {
+	terms := types.SearchTerms(searchTerm)
+	if len(terms) == 0 || len(roomIDs) == 0 || len(keys) == 0 {
+		return []types.SearchResult{}, 0, nil
+	}
+	// Every word has to match, allowing for prefixes of longer words.
+	params := []interface{}{strings.Join(terms, "* ") + "*"}
+	query := selectSearchResultsSQL +
+		" AND s.room_id IN " + internal.QueryVariadicOffset(len(roomIDs), len(params))
+	for _, roomID := range roomIDs {
+		params = append(params, roomID)
+	}
+	query += " AND s.key IN " + internal.QueryVariadicOffset(len(keys), len(params))
+	for _, key := range keys {
+		params = append(params, key)
+	}
+	query += " ORDER BY s.stream_pos DESC"
+
+	rows, err := queryWithFilters(ctx, s.db, txn, query, params)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectSearchResults: rows.close() failed")
+
+	results := []types.SearchResult{}
+	for rows.Next() {
+		var result types.SearchResult
+		var streamPos types.StreamPosition
+		var matchInfo []byte
+		if err = rows.Scan(&result.EventID, &streamPos, &matchInfo); err != nil {
+			return nil, 0, err
+		}
+		if result.Rank, err = rankFromMatchInfo(matchInfo); err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	if orderByRank {
+		// The results are already ordered by recency, which breaks ties.
+		sort.SliceStable(results, func(i, j int) bool {
+			return results[i].Rank > results[j].Rank
+		})
+	}
+	count := len(results)
+	if offset >= count {
+		return []types.SearchResult{}, count, nil
+	}
+	results = results[offset:]
+	if limit < len(results) {
+		results = results[:limit]
+	}
+	return results, count, nil
+}
+
+// rankFromMatchInfo calculates the rank of a result from the output of the
+// FTS4 matchinfo function with the "pcx" format, which is a list of 32-bit
+// integers: the number of phrases and columns, followed by three integers
+// for each phrase and column. The first two are the number of hits for the
+// phrase in the column of this row and in the column of all rows, so rarer
+// words count for more.
+func rankFromMatchInfo(matchInfo []byte) (float64, error) {
+	if len(matchInfo) < 8 || len(matchInfo)%4 != 0 {
+		return 0, fmt.Errorf("invalid matchinfo length %d", len(matchInfo))
+	}
+	ints := make([]uint32, len(matchInfo)/4)
+	for i := range ints {
+		ints[i] = binary.LittleEndian.Uint32(matchInfo[i*4:])
+	}
+	phrases, columns := int(ints[0]), int(ints[1])
+	if len(ints) < 2+phrases*columns*3 {
+		return 0, fmt.Errorf("invalid matchinfo for %d phrases and %d columns", phrases, columns)
+	}
+	var rank float64
+	for p := 0; p < phrases; p++ {
+		for c := 0; c < columns; c++ {
+			i := 2 + (p*columns+c)*3
+			if hitsInRow, hitsInAllRows := ints[i], ints[i+1]; hitsInRow > 0 && hitsInAllRows > 0 {
+				rank += float64(hitsInRow) / float64(hitsInAllRows)
+			}
+		}
+	}
+	return rank, nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sqlite3
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/matrix-org/dendrite/internal"
+	"github.com/matrix-org/dendrite/syncapi/storage/tables"
+	"github.com/matrix-org/dendrite/syncapi/types"
+)
+
+const sendToDeviceSchema = `
+CREATE TABLE IF NOT EXISTS syncapi_send_to_device (
+    id INTEGER PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    device_id TEXT NOT NULL,
+    content TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS syncapi_send_to_device_user_id_device_id_idx ON syncapi_send_to_device(user_id, device_id);
+`
+
+const insertSendToDeviceMessageSQL = "" +
+	"INSERT INTO syncapi_send_to_device (id, user_id, device_id, content) VALUES ($1, $2, $3, $4)"
+
+const selectSendToDeviceMessagesSQL = "" +
+	"SELECT content FROM syncapi_send_to_device" +
+	" WHERE user_id = $1 AND device_id = $2 AND id <= $3" +
+	" ORDER BY id ASC"
+
+const deleteSendToDeviceMessagesSQL = "" +
+	"DELETE FROM syncapi_send_to_device WHERE user_id = $1 AND device_id = $2 AND id <= $3"
+
+const selectMaxSendToDeviceMessageIDSQL = "" +
+	"SELECT MAX(id) FROM syncapi_send_to_device"
+
+type sendToDeviceStatements struct {
+	streamIDStatements                 *streamIDStatements
+	insertSendToDeviceMessageStmt      *sql.Stmt
+	selectSendToDeviceMessagesStmt     *sql.Stmt
+	deleteSendToDeviceMessagesStmt     *sql.Stmt
+	selectMaxSendToDeviceMessageIDStmt *sql.Stmt
+}
+
+func NewSqliteSendToDeviceTable(db *sql.DB, streamID *streamIDStatements) (tables.SendToDevice, error) {
+	s := &sendToDeviceStatements{
+		streamIDStatements: streamID,
+	}
+	_, err := db.Exec(sendToDeviceSchema)
+	if err != nil {
+		return nil, err
+	}
+	if s.insertSendToDeviceMessageStmt, err = db.Prepare(insertSendToDeviceMessageSQL); err != nil {
+		return nil, err
+	}
+	if s.selectSendToDeviceMessagesStmt, err = db.Prepare(selectSendToDeviceMessagesSQL); err != nil {
+		return nil, err
+	}
+	if s.deleteSendToDeviceMessagesStmt, err = db.Prepare(deleteSendToDeviceMessagesSQL); err != nil {
+		return nil, err
+	}
+	if s.selectMaxSendToDeviceMessageIDStmt, err = db.Prepare(selectMaxSendToDeviceMessageIDSQL); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sendToDeviceStatements) InsertSendToDeviceMessage(
+	ctx context.Context, txn *sql.Tx, userID, deviceID, content string,
+) (pos types.StreamPosition, err error) {
+	pos, err = s.streamIDStatements.nextStreamID(ctx, txn)
+	if err != nil {
+		return
+	}
+	_, err = txn.Stmt(s.insertSendToDeviceMessageStmt).ExecContext(ctx, pos, userID, deviceID, content)
+	return
+}
+
+func (s *sendToDeviceStatements) SelectSendToDeviceMessages(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, to types.StreamPosition,
+) ([]string, error) {
+	stmt := internal.TxStmt(txn, s.selectSendToDeviceMessagesStmt)
+	rows, err := stmt.QueryContext(ctx, userID, deviceID, to)
+	if err != nil {
+		return nil, err
+	}
+	defer internal.CloseAndLogIfError(ctx, rows, "selectSendToDeviceMessages: rows.close() failed")
+
+	var messages []string
+	for rows.Next() {
+		var content string
+		if err = rows.Scan(&content); err != nil {
+			return nil, err
+		}
+		messages = append(messages, content)
+	}
+	return messages, rows.Err()
+}
+
+func (s *sendToDeviceStatements) DeleteSendToDeviceMessages(
+	ctx context.Context, txn *sql.Tx, userID, deviceID string, to types.StreamPosition,
+) error {
+	stmt := internal.TxStmt(txn, s.deleteSendToDeviceMessagesStmt)
+	_, err := stmt.ExecContext(ctx, userID, deviceID, to)
+	return err
+}
+
+func (s *sendToDeviceStatements) SelectMaxSendToDeviceMessageID(
+	ctx context.Context, txn *sql.Tx,
+) (id int64, err error) {
+	var nullableID sql.NullInt64
+	stmt := internal.TxStmt(txn, s.selectMaxSendToDeviceMessageIDStmt)
+	err = stmt.QueryRowContext(ctx).Scan(&nullableID)
+	if nullableID.Valid {
+		id = nullableID.Int64
+	}
+	return
+}
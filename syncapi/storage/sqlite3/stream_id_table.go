@@ -18,6 +18,8 @@ CREATE TABLE IF NOT EXISTS syncapi_stream_id (
 );
 INSERT INTO syncapi_stream_id (stream_name, stream_id) VALUES ("global", 0)
   ON CONFLICT DO NOTHING;
+INSERT INTO syncapi_stream_id (stream_name, stream_id) VALUES ("receipt", 0)
+  ON CONFLICT DO NOTHING;
 `
 
 const increaseStreamIDStmt = "" +
@@ -46,12 +48,20 @@ func (s *streamIDStatements) prepare(db *sql.DB) (err error) {
 }
 
 func (s *streamIDStatements) nextStreamID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.nextID(ctx, txn, "global")
+}
+
+func (s *streamIDStatements) nextReceiptID(ctx context.Context, txn *sql.Tx) (pos types.StreamPosition, err error) {
+	return s.nextID(ctx, txn, "receipt")
+}
+
+func (s *streamIDStatements) nextID(ctx context.Context, txn *sql.Tx, streamName string) (pos types.StreamPosition, err error) {
 	increaseStmt := internal.TxStmt(txn, s.increaseStreamIDStmt)
 	selectStmt := internal.TxStmt(txn, s.selectStreamIDStmt)
-	if _, err = increaseStmt.ExecContext(ctx, "global"); err != nil {
+	if _, err = increaseStmt.ExecContext(ctx, streamName); err != nil {
 		return
 	}
-	if err = selectStmt.QueryRowContext(ctx, "global").Scan(&pos); err != nil {
+	if err = selectStmt.QueryRowContext(ctx, streamName).Scan(&pos); err != nil {
 		return
 	}
 	return
@@ -95,6 +95,34 @@ func (d *SyncServerDatasource) prepare() (err error) {
 	if err != nil {
 		return err
 	}
+	keyChanges, err := NewSqliteKeyChangesTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	sendToDevice, err := NewSqliteSendToDeviceTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	receipts, err := NewSqliteReceiptsTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	presence, err := NewSqlitePresenceTable(d.db, &d.streamID)
+	if err != nil {
+		return err
+	}
+	notificationCounts, err := NewSqliteNotificationCountsTable(d.db)
+	if err != nil {
+		return err
+	}
+	search, err := NewSqliteSearchTable(d.db)
+	if err != nil {
+		return err
+	}
+	purge, err := NewSqlitePurgeStatements(d.db)
+	if err != nil {
+		return err
+	}
 	d.Database = shared.Database{
 		DB:                  d.db,
 		Invites:             invites,
@@ -103,6 +131,13 @@ func (d *SyncServerDatasource) prepare() (err error) {
 		BackwardExtremities: bwExtrem,
 		CurrentRoomState:    roomState,
 		Topology:            topology,
+		KeyChanges:          keyChanges,
+		SendToDevice:        sendToDevice,
+		Receipts:            receipts,
+		Presence:            presence,
+		NotificationCounts:  notificationCounts,
+		Search:              search,
+		Purge:               purge,
 		EDUCache:            cache.New(),
 	}
 	return nil
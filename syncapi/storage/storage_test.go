@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
 	"github.com/matrix-org/dendrite/syncapi/types"
@@ -155,9 +156,9 @@ func TestSyncResponse(t *testing.T) {
 			Name: "IncrementalSync penultimate",
 			DoSync: func() (*types.Response, error) {
 				from := types.NewStreamToken( // pretend we are at the penultimate event
-					positions[len(positions)-2], types.StreamPosition(0),
+					positions[len(positions)-2], types.StreamPosition(0), types.StreamPosition(0),
 				)
-				return db.IncrementalSync(ctx, testUserDeviceA, from, latest, 5, false)
+				return db.IncrementalSync(ctx, testUserDeviceA, from, latest, filterWithLimit(5), false)
 			},
 			WantTimeline: events[len(events)-1:],
 		},
@@ -167,10 +168,10 @@ func TestSyncResponse(t *testing.T) {
 			Name: "IncrementalSync limited",
 			DoSync: func() (*types.Response, error) {
 				from := types.NewStreamToken( // pretend we are 10 events behind
-					positions[len(positions)-11], types.StreamPosition(0),
+					positions[len(positions)-11], types.StreamPosition(0), types.StreamPosition(0),
 				)
 				// limit is set to 5
-				return db.IncrementalSync(ctx, testUserDeviceA, from, latest, 5, false)
+				return db.IncrementalSync(ctx, testUserDeviceA, from, latest, filterWithLimit(5), false)
 			},
 			// want the last 5 events, NOT the last 10.
 			WantTimeline: events[len(events)-5:],
@@ -181,7 +182,7 @@ func TestSyncResponse(t *testing.T) {
 			Name: "CompleteSync limited",
 			DoSync: func() (*types.Response, error) {
 				// limit set to 5
-				return db.CompleteSync(ctx, testUserIDA, 5)
+				return db.CompleteSync(ctx, testUserIDA, filterWithLimit(5))
 			},
 			// want the last 5 events
 			WantTimeline: events[len(events)-5:],
@@ -193,7 +194,7 @@ func TestSyncResponse(t *testing.T) {
 		{
 			Name: "CompleteSync",
 			DoSync: func() (*types.Response, error) {
-				return db.CompleteSync(ctx, testUserIDA, len(events)+1)
+				return db.CompleteSync(ctx, testUserIDA, filterWithLimit(len(events)+1))
 			},
 			WantTimeline: events,
 			// We want no state at all as that field in /sync is the delta between the token (beginning of time)
@@ -207,7 +208,7 @@ func TestSyncResponse(t *testing.T) {
 			if err != nil {
 				st.Fatalf("failed to do sync: %s", err)
 			}
-			next := types.NewStreamToken(latest.PDUPosition(), latest.EDUPosition())
+			next := types.NewStreamToken(latest.PDUPosition(), latest.EDUPosition(), latest.ReceiptPosition())
 			if res.NextBatch != next.String() {
 				st.Errorf("NextBatch got %s want %s", res.NextBatch, next.String())
 			}
@@ -231,10 +232,10 @@ func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 		t.Fatalf("failed to get SyncPosition: %s", err)
 	}
 	from := types.NewStreamToken(
-		positions[len(positions)-2], types.StreamPosition(0),
+		positions[len(positions)-2], types.StreamPosition(0), types.StreamPosition(0),
 	)
 
-	res, err := db.IncrementalSync(ctx, testUserDeviceA, from, latest, 5, false)
+	res, err := db.IncrementalSync(ctx, testUserDeviceA, from, latest, filterWithLimit(5), false)
 	if err != nil {
 		t.Fatalf("failed to IncrementalSync with latest token")
 	}
@@ -256,7 +257,7 @@ func TestGetEventsInRangeWithPrevBatch(t *testing.T) {
 	// backpaginate 5 messages starting at the latest position.
 	// head towards the beginning of time
 	to := types.NewTopologyToken(0, 0)
-	paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, &prevBatchToken, &to, testRoomID, 5, true)
+	paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, &prevBatchToken, &to, testRoomID, eventFilterWithLimit(5), true)
 	if err != nil {
 		t.Fatalf("GetEventsInRange returned an error: %s", err)
 	}
@@ -275,10 +276,10 @@ func TestGetEventsInRangeWithStreamToken(t *testing.T) {
 		t.Fatalf("failed to get SyncPosition: %s", err)
 	}
 	// head towards the beginning of time
-	to := types.NewStreamToken(0, 0)
+	to := types.NewStreamToken(0, 0, 0)
 
 	// backpaginate 5 messages starting at the latest position.
-	paginatedEvents, err := db.GetEventsInStreamingRange(ctx, &latest, &to, testRoomID, 5, true)
+	paginatedEvents, err := db.GetEventsInStreamingRange(ctx, &latest, &to, testRoomID, eventFilterWithLimit(5), true)
 	if err != nil {
 		t.Fatalf("GetEventsInRange returned an error: %s", err)
 	}
@@ -300,7 +301,7 @@ func TestGetEventsInRangeWithTopologyToken(t *testing.T) {
 	to := types.NewTopologyToken(0, 0)
 
 	// backpaginate 5 messages starting at the latest position.
-	paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, &from, &to, testRoomID, 5, true)
+	paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, &from, &to, testRoomID, eventFilterWithLimit(5), true)
 	if err != nil {
 		t.Fatalf("GetEventsInRange returned an error: %s", err)
 	}
@@ -308,6 +309,79 @@ func TestGetEventsInRangeWithTopologyToken(t *testing.T) {
 	assertEventsEqual(t, "", true, gots, reversed(events[len(events)-5:]))
 }
 
+// The purpose of this test is to make sure that filters are applied before the limit when paginating.
+func TestGetEventsInRangeWithFilter(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.MaxTopologicalPosition(ctx, testRoomID)
+	if err != nil {
+		t.Fatalf("failed to get MaxTopologicalPosition: %s", err)
+	}
+	to := types.NewTopologyToken(0, 0)
+
+	// backpaginate the last 5 messages sent by user A, which come before all of user B's events.
+	filter := eventFilterWithLimit(5)
+	filter.Senders = []string{testUserIDA}
+	filter.Types = []string{"m.room.mes*"}
+	paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, &from, &to, testRoomID, filter, true)
+	if err != nil {
+		t.Fatalf("GetEventsInRange returned an error: %s", err)
+	}
+	gots := gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(&testUserDeviceA, paginatedEvents), gomatrixserverlib.FormatAll)
+	assertEventsEqual(t, "topological", true, gots, reversed(events[7:12]))
+
+	// the same again with a streaming token, excluding user B instead.
+	latest, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	streamTo := types.NewStreamToken(0, 0, 0)
+	filter = eventFilterWithLimit(5)
+	filter.NotSenders = []string{testUserIDB}
+	filter.NotTypes = []string{"m.room.member", "m.room.create"}
+	paginatedEvents, err = db.GetEventsInStreamingRange(ctx, &latest, &streamTo, testRoomID, filter, true)
+	if err != nil {
+		t.Fatalf("GetEventsInRange returned an error: %s", err)
+	}
+	gots = gomatrixserverlib.HeaderedToClientEvents(db.StreamEventsToEvents(&testUserDeviceA, paginatedEvents), gomatrixserverlib.FormatAll)
+	assertEventsEqual(t, "streaming", true, gots, reversed(events[7:12]))
+}
+
+// The purpose of this test is to check that CompleteSync applies the room and state parts of a filter.
+func TestCompleteSyncWithFilter(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, state := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+
+	filter := filterWithLimit(3)
+	filter.Room.State.Types = []string{"m.room.create"}
+	res, err := db.CompleteSync(ctx, testUserIDA, filter)
+	if err != nil {
+		t.Fatalf("CompleteSync returned an error: %s", err)
+	}
+	roomRes, ok := res.Rooms.Join[testRoomID]
+	if !ok {
+		t.Fatalf("CompleteSync response missing room %s - response: %+v", testRoomID, res)
+	}
+	if !roomRes.Timeline.Limited {
+		t.Errorf("CompleteSync timeline should be limited")
+	}
+	assertEventsEqual(t, "Timeline", false, roomRes.Timeline.Events, events[len(events)-3:])
+	assertEventsEqual(t, "State", false, roomRes.State.Events, state[:1])
+
+	filter.Room.NotRooms = []string{testRoomID}
+	res, err = db.CompleteSync(ctx, testUserIDA, filter)
+	if err != nil {
+		t.Fatalf("CompleteSync returned an error: %s", err)
+	}
+	if _, ok = res.Rooms.Join[testRoomID]; ok {
+		t.Fatalf("CompleteSync response contains room %s excluded by the filter", testRoomID)
+	}
+}
+
 // The purpose of this test is to make sure that backpagination returns all events, even if some events have the same depth.
 // For cases where events have the same depth, the streaming token should be used to tie break so events written via WriteEvent
 // will appear FIRST when going backwards. This test creates a DAG like:
@@ -396,7 +470,7 @@ func TestGetEventsInRangeWithEventsSameDepth(t *testing.T) {
 
 	for _, tc := range testCases {
 		// backpaginate messages starting at the latest position.
-		paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, &tc.From, &to, testRoomID, tc.Limit, true)
+		paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, &tc.From, &to, testRoomID, eventFilterWithLimit(tc.Limit), true)
 		if err != nil {
 			t.Fatalf("%s GetEventsInRange returned an error: %s", tc.Name, err)
 		}
@@ -446,7 +520,7 @@ func TestGetEventsInTopologicalRangeMultiRoom(t *testing.T) {
 
 	// Query using room B as room A was inserted first and hence A will have lower stream positions but identical depths,
 	// allowing this bug to surface.
-	paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, &from, &to, roomB, 5, true)
+	paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, &from, &to, roomB, eventFilterWithLimit(5), true)
 	if err != nil {
 		t.Fatalf("GetEventsInRange returned an error: %s", err)
 	}
@@ -498,7 +572,7 @@ func TestGetEventsInRangeWithEventsInsertedLikeBackfill(t *testing.T) {
 	chunkSize = 3
 	events = reversed(events)
 	for i := 0; i < len(events); i += chunkSize {
-		paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, from, &to, testRoomID, chunkSize, true)
+		paginatedEvents, err := db.GetEventsInTopologicalRange(ctx, from, &to, testRoomID, eventFilterWithLimit(chunkSize), true)
 		if err != nil {
 			t.Fatalf("GetEventsInRange returned an error: %s", err)
 		}
@@ -561,6 +635,20 @@ func topologyTokenBefore(t *testing.T, db storage.Database, eventID string) *typ
 	return &tok
 }
 
+// filterWithLimit returns the default sync filter with the given timeline limit.
+func filterWithLimit(limit int) *gomatrixserverlib.Filter {
+	filter := gomatrixserverlib.DefaultFilter()
+	filter.Room.Timeline.Limit = limit
+	return &filter
+}
+
+// eventFilterWithLimit returns the default room event filter with the given limit.
+func eventFilterWithLimit(limit int) *gomatrixserverlib.RoomEventFilter {
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	filter.Limit = limit
+	return &filter
+}
+
 func reversed(in []gomatrixserverlib.HeaderedEvent) []gomatrixserverlib.HeaderedEvent {
 	out := make([]gomatrixserverlib.HeaderedEvent, len(in))
 	for i := 0; i < len(in); i++ {
@@ -568,3 +656,392 @@ func reversed(in []gomatrixserverlib.HeaderedEvent) []gomatrixserverlib.Headered
 	}
 	return out
 }
+
+func TestKeyChanges(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	positions := MustWriteEvents(t, db, events)
+	latest := positions[len(positions)-1]
+
+	shared, err := db.SharedUsers(ctx, testUserIDA)
+	if err != nil {
+		t.Fatalf("SharedUsers returned %s", err)
+	}
+	if len(shared) != 2 {
+		t.Fatalf("SharedUsers returned %v, want both users", shared)
+	}
+
+	pos, err := db.StoreKeyChange(ctx, testUserIDB)
+	if err != nil {
+		t.Fatalf("StoreKeyChange returned %s", err)
+	}
+	if pos <= latest {
+		t.Fatalf("StoreKeyChange returned position %d, want > %d", pos, latest)
+	}
+	syncPos, err := db.SyncStreamPosition(ctx)
+	if err != nil {
+		t.Fatalf("SyncStreamPosition returned %s", err)
+	}
+	if syncPos != pos {
+		t.Fatalf("SyncStreamPosition returned %d, want %d", syncPos, pos)
+	}
+
+	changed, err := db.KeyChangesInRange(ctx, types.Range{From: latest, To: pos})
+	if err != nil {
+		t.Fatalf("KeyChangesInRange returned %s", err)
+	}
+	if len(changed) != 1 || changed[0] != testUserIDB {
+		t.Fatalf("KeyChangesInRange returned %v, want [%s]", changed, testUserIDB)
+	}
+	changed, err = db.KeyChangesInRange(ctx, types.Range{From: pos, To: pos + 1})
+	if err != nil {
+		t.Fatalf("KeyChangesInRange returned %s", err)
+	}
+	if len(changed) != 0 {
+		t.Fatalf("KeyChangesInRange returned %v after the change, want none", changed)
+	}
+}
+
+func TestSendToDeviceInbox(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	userID, deviceID := testUserDeviceA.UserID, testUserDeviceA.ID
+
+	first, err := db.StoreNewSendForDeviceMessage(ctx, userID, deviceID, eduAPI.SendToDeviceEvent{
+		Sender:  testUserIDB,
+		Type:    "m.room_key_request",
+		Content: []byte(`{"n":1}`),
+	})
+	if err != nil {
+		t.Fatalf("StoreNewSendForDeviceMessage returned %s", err)
+	}
+	second, err := db.StoreNewSendForDeviceMessage(ctx, userID, deviceID, eduAPI.SendToDeviceEvent{
+		Sender:  testUserIDB,
+		Type:    "m.room_key_request",
+		Content: []byte(`{"n":2}`),
+	})
+	if err != nil {
+		t.Fatalf("StoreNewSendForDeviceMessage returned %s", err)
+	}
+	syncPos, err := db.SyncStreamPosition(ctx)
+	if err != nil {
+		t.Fatalf("SyncStreamPosition returned %s", err)
+	}
+	if syncPos != second {
+		t.Fatalf("SyncStreamPosition returned %d, want %d", syncPos, second)
+	}
+
+	// An initial sync up to the first message only sees that message.
+	events, err := db.SendToDeviceUpdatesForSync(ctx, userID, deviceID, 0, first)
+	if err != nil {
+		t.Fatalf("SendToDeviceUpdatesForSync returned %s", err)
+	}
+	if len(events) != 1 || string(events[0].Content) != `{"n":1}` {
+		t.Fatalf("SendToDeviceUpdatesForSync returned %+v, want the first message", events)
+	}
+
+	// Messages are kept until they have been acknowledged.
+	events, err = db.SendToDeviceUpdatesForSync(ctx, userID, deviceID, 0, second)
+	if err != nil {
+		t.Fatalf("SendToDeviceUpdatesForSync returned %s", err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("SendToDeviceUpdatesForSync returned %d messages, want 2", len(events))
+	}
+
+	// Syncing from the first position acknowledges the first message.
+	events, err = db.SendToDeviceUpdatesForSync(ctx, userID, deviceID, first, second)
+	if err != nil {
+		t.Fatalf("SendToDeviceUpdatesForSync returned %s", err)
+	}
+	if len(events) != 1 || string(events[0].Content) != `{"n":2}` {
+		t.Fatalf("SendToDeviceUpdatesForSync returned %+v, want the second message", events)
+	}
+
+	// Other devices have their own inbox.
+	events, err = db.SendToDeviceUpdatesForSync(ctx, userID, "other_device", 0, second)
+	if err != nil {
+		t.Fatalf("SendToDeviceUpdatesForSync returned %s", err)
+	}
+	if len(events) != 0 {
+		t.Fatalf("SendToDeviceUpdatesForSync returned %+v for another device, want none", events)
+	}
+}
+
+func TestReceipts(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	lastEventID := events[len(events)-1].EventID()
+	receiptPos, err := db.StoreReceipt(ctx, eduAPI.OutputReceiptEvent{
+		UserID:    testUserIDB,
+		RoomID:    testRoomID,
+		EventID:   lastEventID,
+		Type:      "m.read",
+		Timestamp: 1234,
+	})
+	if err != nil {
+		t.Fatalf("StoreReceipt returned %s", err)
+	}
+	to, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	if to.ReceiptPosition() != receiptPos || to.PDUPosition() != from.PDUPosition() {
+		t.Fatalf("SyncPosition returned %s, want receipt position %d and unchanged PDU position", to.String(), receiptPos)
+	}
+
+	res, err := db.IncrementalSync(ctx, testUserDeviceA, from, to, filterWithLimit(5), false)
+	if err != nil {
+		t.Fatalf("IncrementalSync returned %s", err)
+	}
+	jr, ok := res.Rooms.Join[testRoomID]
+	if !ok || len(jr.Ephemeral.Events) != 1 {
+		t.Fatalf("IncrementalSync returned no receipt for %s", testRoomID)
+	}
+	ev := jr.Ephemeral.Events[0]
+	want := fmt.Sprintf(`{"%s":{"m.read":{"%s":{"ts":1234}}}}`, lastEventID, testUserIDB)
+	if ev.Type != "m.receipt" || string(ev.Content) != want {
+		t.Fatalf("IncrementalSync returned receipt %s %s, want m.receipt %s", ev.Type, string(ev.Content), want)
+	}
+
+	// Syncing from the new position should not return the receipt again.
+	res, err = db.IncrementalSync(ctx, testUserDeviceA, to, to, filterWithLimit(5), false)
+	if err != nil {
+		t.Fatalf("IncrementalSync returned %s", err)
+	}
+	if _, ok = res.Rooms.Join[testRoomID]; ok {
+		t.Fatalf("IncrementalSync returned the receipt again")
+	}
+}
+
+func TestPresence(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	from, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+
+	if p, err := db.GetPresence(ctx, testUserIDA); err != nil || p != nil {
+		t.Fatalf("GetPresence returned %v, %v for unknown user, want nil", p, err)
+	}
+
+	statusMsg := "away for lunch"
+	for _, presence := range []string{"online", "unavailable"} {
+		if _, err = db.StorePresence(ctx, eduAPI.OutputPresenceEvent{
+			UserID:    testUserIDA,
+			Presence:  presence,
+			StatusMsg: &statusMsg,
+		}); err != nil {
+			t.Fatalf("StorePresence returned %s", err)
+		}
+	}
+	to, err := db.SyncPosition(ctx)
+	if err != nil {
+		t.Fatalf("failed to get SyncPosition: %s", err)
+	}
+	if to.PDUPosition() <= from.PDUPosition() {
+		t.Fatalf("SyncPosition returned %s, want position after %s", to.String(), from.String())
+	}
+
+	p, err := db.GetPresence(ctx, testUserIDA)
+	if err != nil || p == nil {
+		t.Fatalf("GetPresence returned %v, %v", p, err)
+	}
+	if p.Presence != "unavailable" || p.StatusMsg == nil || *p.StatusMsg != statusMsg {
+		t.Fatalf("GetPresence returned %+v, want latest presence", p)
+	}
+
+	updates, err := db.PresenceInRange(ctx, types.Range{From: from.PDUPosition(), To: to.PDUPosition()})
+	if err != nil {
+		t.Fatalf("PresenceInRange returned %s", err)
+	}
+	if len(updates) != 1 || updates[0].Presence != "unavailable" {
+		t.Fatalf("PresenceInRange returned %+v, want one unavailable update", updates)
+	}
+	updates, err = db.PresenceInRange(ctx, types.Range{From: to.PDUPosition(), To: to.PDUPosition()})
+	if err != nil {
+		t.Fatalf("PresenceInRange returned %s", err)
+	}
+	if len(updates) != 0 {
+		t.Fatalf("PresenceInRange returned %+v for empty range, want none", updates)
+	}
+}
+
+func TestNotificationCounts(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	for _, highlight := range []bool{false, true, false} {
+		if err := db.IncrementNotificationCounts(ctx, testUserIDA, testRoomID, highlight); err != nil {
+			t.Fatalf("IncrementNotificationCounts returned %s", err)
+		}
+	}
+	counts, err := db.GetNotificationCounts(ctx, testUserIDA)
+	if err != nil {
+		t.Fatalf("GetNotificationCounts returned %s", err)
+	}
+	want := types.UnreadNotifications{NotificationCount: 3, HighlightCount: 1}
+	if counts[testRoomID] != want {
+		t.Fatalf("GetNotificationCounts returned %+v, want %+v", counts[testRoomID], want)
+	}
+
+	if err = db.ResetNotificationCounts(ctx, testUserIDA, testRoomID); err != nil {
+		t.Fatalf("ResetNotificationCounts returned %s", err)
+	}
+	counts, err = db.GetNotificationCounts(ctx, testUserIDA)
+	if err != nil {
+		t.Fatalf("GetNotificationCounts returned %s", err)
+	}
+	if len(counts) != 0 {
+		t.Fatalf("GetNotificationCounts returned %+v after reset, want none", counts)
+	}
+}
+
+func TestRedactEvent(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+
+	target := events[len(events)-1]
+	redaction := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{target}, &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{"reason":"spam"}`),
+		Type:    "m.room.redaction",
+		Sender:  testUserIDB,
+		Redacts: target.EventID(),
+		Depth:   target.Depth() + 1,
+	})
+	MustWriteEvents(t, db, []gomatrixserverlib.HeaderedEvent{redaction})
+
+	if err := db.RedactEvent(ctx, target.EventID(), &redaction); err != nil {
+		t.Fatalf("RedactEvent returned %s", err)
+	}
+	got, err := db.Events(ctx, []string{target.EventID()})
+	if err != nil || len(got) != 1 {
+		t.Fatalf("Events returned %v, %v", got, err)
+	}
+	if string(got[0].Content()) != "{}" {
+		t.Fatalf("redacted event has content %s, want {}", string(got[0].Content()))
+	}
+	if got[0].EventID() != target.EventID() {
+		t.Fatalf("redacted event has ID %s, want %s", got[0].EventID(), target.EventID())
+	}
+}
+
+func TestSearchEvents(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	keys := []string{"content.body", "content.name", "content.topic"}
+
+	// Every message matches, so ordering by recency returns the latest first.
+	results, count, err := db.SearchEvents(ctx, "message", []string{testRoomID}, keys, false, 5, 0)
+	if err != nil {
+		t.Fatalf("SearchEvents returned %s", err)
+	}
+	if count != 20 || len(results) != 5 {
+		t.Fatalf("SearchEvents returned %d results with count %d, want 5 with count 20", len(results), count)
+	}
+	if results[0].EventID != events[len(events)-1].EventID() {
+		t.Fatalf("SearchEvents returned %s first, want %s", results[0].EventID, events[len(events)-1].EventID())
+	}
+
+	// Every word has to match, and words can be prefixes.
+	results, count, err = db.SearchEvents(ctx, "mess a", []string{testRoomID}, keys, true, 20, 0)
+	if err != nil {
+		t.Fatalf("SearchEvents returned %s", err)
+	}
+	if count != 10 || len(results) != 10 {
+		t.Fatalf("SearchEvents returned %d results with count %d, want 10", len(results), count)
+	}
+
+	// Rooms and keys which weren't asked for are excluded.
+	if _, count, err = db.SearchEvents(ctx, "message", []string{"!other:localhost"}, keys, false, 20, 0); err != nil || count != 0 {
+		t.Fatalf("SearchEvents in other room returned count %d, err %v, want 0", count, err)
+	}
+	if _, count, err = db.SearchEvents(ctx, "message", []string{testRoomID}, []string{"content.name"}, false, 20, 0); err != nil || count != 0 {
+		t.Fatalf("SearchEvents on content.name returned count %d, err %v, want 0", count, err)
+	}
+
+	// Redacted events are removed from the index.
+	target := events[len(events)-1]
+	redaction := MustCreateEvent(t, testRoomID, []gomatrixserverlib.HeaderedEvent{target}, &gomatrixserverlib.EventBuilder{
+		Content: []byte(`{}`),
+		Type:    "m.room.redaction",
+		Sender:  testUserIDB,
+		Redacts: target.EventID(),
+		Depth:   target.Depth() + 1,
+	})
+	MustWriteEvents(t, db, []gomatrixserverlib.HeaderedEvent{redaction})
+	if err = db.RedactEvent(ctx, target.EventID(), &redaction); err != nil {
+		t.Fatalf("RedactEvent returned %s", err)
+	}
+	results, count, err = db.SearchEvents(ctx, "message", []string{testRoomID}, keys, false, 20, 0)
+	if err != nil {
+		t.Fatalf("SearchEvents returned %s", err)
+	}
+	if count != 19 || results[0].EventID == target.EventID() {
+		t.Fatalf("SearchEvents returned count %d after redaction, want 19 without the redacted event", count)
+	}
+}
+
+func TestPurgeRoom(t *testing.T) {
+	t.Parallel()
+	db := MustCreateDatabase(t)
+	otherRoomID := fmt.Sprintf("!crossroads:%s", testOrigin)
+	events, _ := SimpleRoom(t, testRoomID, testUserIDA, testUserIDB)
+	otherEvents, _ := SimpleRoom(t, otherRoomID, testUserIDA, testUserIDB)
+	MustWriteEvents(t, db, events)
+	MustWriteEvents(t, db, otherEvents)
+	for _, roomID := range []string{testRoomID, otherRoomID} {
+		if err := db.IncrementNotificationCounts(ctx, testUserIDA, roomID, false); err != nil {
+			t.Fatalf("IncrementNotificationCounts returned %s", err)
+		}
+	}
+
+	if err := db.PurgeRoom(ctx, testRoomID); err != nil {
+		t.Fatalf("PurgeRoom returned %s", err)
+	}
+
+	// Nothing is left of the purged room.
+	got, err := db.Events(ctx, []string{events[0].EventID(), events[len(events)-1].EventID()})
+	if err != nil || len(got) != 0 {
+		t.Fatalf("Events in purged room returned %d events, err %v, want none", len(got), err)
+	}
+	ev, err := db.GetStateEvent(ctx, testRoomID, "m.room.create", "")
+	if err != nil || ev != nil {
+		t.Fatalf("GetStateEvent in purged room returned %v, %v, want nothing", ev, err)
+	}
+	keys := []string{"content.body"}
+	if _, count, serr := db.SearchEvents(ctx, "message", []string{testRoomID}, keys, false, 20, 0); serr != nil || count != 0 {
+		t.Fatalf("SearchEvents in purged room returned count %d, err %v, want 0", count, serr)
+	}
+	counts, err := db.GetNotificationCounts(ctx, testUserIDA)
+	if err != nil {
+		t.Fatalf("GetNotificationCounts returned %s", err)
+	}
+	if _, ok := counts[testRoomID]; ok {
+		t.Fatalf("GetNotificationCounts returned counts for the purged room")
+	}
+
+	// Other rooms are untouched.
+	if _, ok := counts[otherRoomID]; !ok {
+		t.Fatalf("GetNotificationCounts didn't return counts for the other room")
+	}
+	got, err = db.Events(ctx, []string{otherEvents[0].EventID()})
+	if err != nil || len(got) != 1 {
+		t.Fatalf("Events in other room returned %d events, err %v, want 1", len(got), err)
+	}
+	if _, count, serr := db.SearchEvents(ctx, "message", []string{otherRoomID}, keys, false, 20, 0); serr != nil || count != 20 {
+		t.Fatalf("SearchEvents in other room returned count %d, err %v, want 20", count, serr)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -30,11 +31,13 @@ type Events interface {
 	InsertEvent(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, addState, removeState []string, transactionID *api.TransactionID, excludeFromSync bool) (streamPos types.StreamPosition, err error)
 	// SelectRecentEvents returns events between the two stream positions: exclusive of low and inclusive of high.
 	// If onlySyncEvents has a value of true, only returns the events that aren't marked as to exclude from sync.
-	// Returns up to `limit` events.
-	SelectRecentEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, limit int, chronologicalOrder bool, onlySyncEvents bool) ([]types.StreamEvent, error)
-	// SelectEarlyEvents returns the earliest events in the given room.
-	SelectEarlyEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, limit int) ([]types.StreamEvent, error)
+	// Returns up to `eventFilter.Limit` events which match the filter.
+	SelectRecentEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, eventFilter *gomatrixserverlib.RoomEventFilter, chronologicalOrder bool, onlySyncEvents bool) ([]types.StreamEvent, error)
+	// SelectEarlyEvents returns the earliest events in the given room which match the filter.
+	SelectEarlyEvents(ctx context.Context, txn *sql.Tx, roomID string, r types.Range, eventFilter *gomatrixserverlib.RoomEventFilter) ([]types.StreamEvent, error)
 	SelectEvents(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.StreamEvent, error)
+	// UpdateEventJSON replaces the stored JSON of an event, e.g. once it has been redacted.
+	UpdateEventJSON(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent) error
 }
 
 // Topology keeps track of the depths and stream positions for all events.
@@ -46,8 +49,9 @@ type Topology interface {
 	// SelectEventIDsInRange selects the IDs of events whose depths are within a given range in a given room's topological order.
 	// Events with `minDepth` are *exclusive*, as is the event which has exactly `minDepth`,`maxStreamPos`.
 	// `maxStreamPos` is only used when events have the same depth as `maxDepth`, which results in events less than `maxStreamPos` being returned.
+	// Only events matching the filter are returned, up to `eventFilter.Limit` of them.
 	// Returns an empty slice if no events match the given range.
-	SelectEventIDsInRange(ctx context.Context, txn *sql.Tx, roomID string, minDepth, maxDepth, maxStreamPos types.StreamPosition, limit int, chronologicalOrder bool) (eventIDs []string, err error)
+	SelectEventIDsInRange(ctx context.Context, txn *sql.Tx, roomID string, minDepth, maxDepth, maxStreamPos types.StreamPosition, eventFilter *gomatrixserverlib.RoomEventFilter, chronologicalOrder bool) (eventIDs []string, err error)
 	// SelectPositionInTopology returns the depth and stream position of a given event in the topology of the room it belongs to.
 	SelectPositionInTopology(ctx context.Context, txn *sql.Tx, eventID string) (depth, spos types.StreamPosition, err error)
 	// SelectMaxPositionInTopology returns the event which has the highest depth, and if there are multiple, the event with the highest stream position.
@@ -59,12 +63,68 @@ type CurrentRoomState interface {
 	SelectEventsWithEventIDs(ctx context.Context, txn *sql.Tx, eventIDs []string) ([]types.StreamEvent, error)
 	UpsertRoomState(ctx context.Context, txn *sql.Tx, event gomatrixserverlib.HeaderedEvent, membership *string, addedAt types.StreamPosition) error
 	DeleteRoomStateByEventID(ctx context.Context, txn *sql.Tx, eventID string) error
+	// UpdateEventJSON replaces the stored JSON of a state event, e.g. once it has been redacted.
+	UpdateEventJSON(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent) error
 	// SelectCurrentState returns all the current state events for the given room.
 	SelectCurrentState(ctx context.Context, txn *sql.Tx, roomID string, stateFilter *gomatrixserverlib.StateFilter) ([]gomatrixserverlib.HeaderedEvent, error)
 	// SelectRoomIDsWithMembership returns the list of room IDs which have the given user in the given membership state.
 	SelectRoomIDsWithMembership(ctx context.Context, txn *sql.Tx, userID string, membership string) ([]string, error)
 	// SelectJoinedUsers returns a map of room ID to a list of joined user IDs.
 	SelectJoinedUsers(ctx context.Context) (map[string][]string, error)
+	// SelectSharedUsers returns the IDs of all users who are joined to at least one room that the given user is joined to,
+	// including the given user themselves if they are joined to any room.
+	SelectSharedUsers(ctx context.Context, txn *sql.Tx, userID string) ([]string, error)
+}
+
+// SendToDevice stores send-to-device messages for each local device until
+// the device has acknowledged them by syncing past their stream position.
+type SendToDevice interface {
+	// InsertSendToDeviceMessage stores a new message for the given device, returning its stream position.
+	InsertSendToDeviceMessage(ctx context.Context, txn *sql.Tx, userID, deviceID, content string) (types.StreamPosition, error)
+	// SelectSendToDeviceMessages returns the JSON of all messages for the device up to and including the given stream position.
+	SelectSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, to types.StreamPosition) ([]string, error)
+	// DeleteSendToDeviceMessages removes all messages for the device up to and including the given stream position.
+	DeleteSendToDeviceMessages(ctx context.Context, txn *sql.Tx, userID, deviceID string, to types.StreamPosition) error
+	SelectMaxSendToDeviceMessageID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
+// Receipts stores the most recent receipt of each type for each user in
+// each room, with a stream position separate from the PDU stream.
+type Receipts interface {
+	UpsertReceipt(ctx context.Context, txn *sql.Tx, receipt eduAPI.OutputReceiptEvent) (pos types.StreamPosition, err error)
+	// SelectRoomReceiptsAfter returns all receipts in the given rooms stored after the given stream position.
+	SelectRoomReceiptsAfter(ctx context.Context, txn *sql.Tx, roomIDs []string, streamPos types.StreamPosition) ([]eduAPI.OutputReceiptEvent, error)
+	SelectMaxReceiptID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
+// Presence stores the latest presence of each user.
+type Presence interface {
+	UpsertPresence(ctx context.Context, txn *sql.Tx, presence eduAPI.OutputPresenceEvent) (pos types.StreamPosition, err error)
+	// SelectPresenceForUser returns sql.ErrNoRows if there is no presence for the user.
+	SelectPresenceForUser(ctx context.Context, txn *sql.Tx, userID string) (*eduAPI.OutputPresenceEvent, error)
+	SelectPresenceInRange(ctx context.Context, txn *sql.Tx, r types.Range) ([]eduAPI.OutputPresenceEvent, error)
+	SelectMaxPresenceID(ctx context.Context, txn *sql.Tx) (id int64, err error)
+}
+
+// NotificationCounts stores the number of unread notifications and highlights
+// of each local user in each room, as decided by their push rules.
+type NotificationCounts interface {
+	IncrementNotificationCounts(ctx context.Context, txn *sql.Tx, userID, roomID string, highlight bool) error
+	// DeleteNotificationCounts resets the counts of the user in the room, e.g. after they read it.
+	DeleteNotificationCounts(ctx context.Context, txn *sql.Tx, userID, roomID string) error
+	// SelectNotificationCounts returns the counts of the user, keyed by room ID.
+	SelectNotificationCounts(ctx context.Context, txn *sql.Tx, userID string) (map[string]types.UnreadNotifications, error)
+}
+
+// KeyChanges tracks which users have had their device lists change, so that
+// clients can be told to refresh the device keys for those users.
+type KeyChanges interface {
+	// InsertKeyChange records that the device list for the given user has changed, returning the new stream position.
+	InsertKeyChange(ctx context.Context, txn *sql.Tx, userID string) (types.StreamPosition, error)
+	// SelectKeyChangesInRange returns the IDs of users whose device lists changed between the two stream positions:
+	// exclusive of low and inclusive of high.
+	SelectKeyChangesInRange(ctx context.Context, txn *sql.Tx, r types.Range) ([]string, error)
+	SelectMaxKeyChangeID(ctx context.Context, txn *sql.Tx) (id int64, err error)
 }
 
 // BackwardsExtremities keeps track of backwards extremities for a room.
@@ -94,3 +154,23 @@ type BackwardsExtremities interface {
 	// DeleteBackwardExtremity removes a backwards extremity for a room, if one existed.
 	DeleteBackwardExtremity(ctx context.Context, txn *sql.Tx, roomID, knownEventID string) (err error)
 }
+
+// Purge removes everything stored about a room from the other tables.
+type Purge interface {
+	// PurgeRoom deletes all the rows belonging to the room.
+	PurgeRoom(ctx context.Context, txn *sql.Tx, roomID string) error
+}
+
+// Search is a full-text index over the searchable parts of room events, such
+// as the body of a message or the name of a room.
+type Search interface {
+	// InsertSearchEvent indexes the value of the event's content under the given key, e.g. "content.body".
+	InsertSearchEvent(ctx context.Context, txn *sql.Tx, event *gomatrixserverlib.HeaderedEvent, pos types.StreamPosition, key, value string) error
+	// DeleteSearchEvent removes the event from the index, e.g. because it has been redacted.
+	DeleteSearchEvent(ctx context.Context, txn *sql.Tx, eventID string) error
+	// SelectSearchResults returns the events in the given rooms which match the search term under any of the
+	// given keys, ordered either by rank or by recency, along with the total number of matching events.
+	SelectSearchResults(
+		ctx context.Context, txn *sql.Tx, searchTerm string, roomIDs, keys []string, orderByRank bool, limit, offset int,
+	) (results []types.SearchResult, count int, err error)
+}
@@ -33,7 +33,10 @@ import (
 type Notifier struct {
 	// A map of RoomID => Set<UserID> : Must only be accessed by the OnNewEvent goroutine
 	roomIDToJoinedUsers map[string]userIDSet
-	// Protects currPos and userStreams.
+	// A map of RoomID => UserID => number of requests peeking into the room.
+	// Protected by streamLock, as peeks are added by request goroutines.
+	roomIDToPeekingUsers map[string]map[string]int
+	// Protects currPos, userStreams and roomIDToPeekingUsers.
 	streamLock *sync.Mutex
 	// The latest sync position
 	currPos types.StreamingToken
@@ -48,11 +51,12 @@ type Notifier struct {
 // the joined users within each of them by calling Notifier.Load(*storage.SyncServerDatabase).
 func NewNotifier(pos types.StreamingToken) *Notifier {
 	return &Notifier{
-		currPos:             pos,
-		roomIDToJoinedUsers: make(map[string]userIDSet),
-		userStreams:         make(map[string]*UserStream),
-		streamLock:          &sync.Mutex{},
-		lastCleanUpTime:     time.Now(),
+		currPos:              pos,
+		roomIDToJoinedUsers:  make(map[string]userIDSet),
+		roomIDToPeekingUsers: make(map[string]map[string]int),
+		userStreams:          make(map[string]*UserStream),
+		streamLock:           &sync.Mutex{},
+		lastCleanUpTime:      time.Now(),
 	}
 }
 
@@ -81,7 +85,7 @@ func (n *Notifier) OnNewEvent(
 
 	if ev != nil {
 		// Map this event's room_id to a list of joined users, and wake them up.
-		usersToNotify := n.joinedUsers(ev.RoomID())
+		usersToNotify := append(n.joinedUsers(ev.RoomID()), n.peekingUsers(ev.RoomID())...)
 		// If this is an invite, also add in the invitee to this list.
 		if ev.Type() == "m.room.member" && ev.StateKey() != nil {
 			targetUserID := *ev.StateKey()
@@ -110,7 +114,7 @@ func (n *Notifier) OnNewEvent(
 
 		n.wakeupUsers(usersToNotify, latestPos)
 	} else if roomID != "" {
-		n.wakeupUsers(n.joinedUsers(roomID), latestPos)
+		n.wakeupUsers(append(n.joinedUsers(roomID), n.peekingUsers(roomID)...), latestPos)
 	} else if len(userIDs) > 0 {
 		n.wakeupUsers(userIDs, latestPos)
 	} else {
@@ -128,9 +132,8 @@ func (n *Notifier) GetListener(req syncRequest) UserStreamListener {
 	// - Bucket request into a lookup map keyed off a list of joined room IDs and separately a user ID
 	// - Incoming events wake requests for a matching room ID
 	// - Incoming events wake requests for a matching user ID (needed for invites)
-
-	// TODO: v1 /events 'peeking' has an 'explicit room ID' which is also tracked,
-	//       but given we don't do /events, let's pretend it doesn't exist.
+	// v1 /events 'peeking' has an 'explicit room ID' which is tracked using
+	// AddPeek and RemovePeek.
 
 	n.streamLock.Lock()
 	defer n.streamLock.Unlock()
@@ -140,6 +143,36 @@ func (n *Notifier) GetListener(req syncRequest) UserStreamListener {
 	return n.fetchUserStream(req.device.UserID, true).GetListener(req.ctx)
 }
 
+// AddPeek marks the user as peeking into the room, so that new events in the
+// room wake the user's requests even if they aren't joined to it. Each call
+// must be matched by a call to RemovePeek once the request is done.
+func (n *Notifier) AddPeek(roomID, userID string) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	if _, ok := n.roomIDToPeekingUsers[roomID]; !ok {
+		n.roomIDToPeekingUsers[roomID] = make(map[string]int)
+	}
+	n.roomIDToPeekingUsers[roomID][userID]++
+}
+
+// RemovePeek undoes a call to AddPeek.
+func (n *Notifier) RemovePeek(roomID, userID string) {
+	n.streamLock.Lock()
+	defer n.streamLock.Unlock()
+
+	peeks, ok := n.roomIDToPeekingUsers[roomID]
+	if !ok {
+		return
+	}
+	if peeks[userID]--; peeks[userID] <= 0 {
+		delete(peeks, userID)
+	}
+	if len(peeks) == 0 {
+		delete(n.roomIDToPeekingUsers, roomID)
+	}
+}
+
 // Load the membership states required to notify users correctly.
 func (n *Notifier) Load(ctx context.Context, db storage.Database) error {
 	roomToUsers, err := db.AllJoinedUsersInRooms(ctx)
@@ -220,6 +253,14 @@ func (n *Notifier) joinedUsers(roomID string) (userIDs []string) {
 	return n.roomIDToJoinedUsers[roomID].values()
 }
 
+// NB: Callers should have locked the mutex before calling this function.
+func (n *Notifier) peekingUsers(roomID string) (userIDs []string) {
+	for userID := range n.roomIDToPeekingUsers[roomID] {
+		userIDs = append(userIDs, userID)
+	}
+	return
+}
+
 // removeEmptyUserStreams iterates through the user stream map and removes any
 // that have been empty for a certain amount of time. This is a crude way of
 // ensuring that the userStreams map doesn't grow forver.
@@ -33,11 +33,11 @@ var (
 	randomMessageEvent  gomatrixserverlib.HeaderedEvent
 	aliceInviteBobEvent gomatrixserverlib.HeaderedEvent
 	bobLeaveEvent       gomatrixserverlib.HeaderedEvent
-	syncPositionVeryOld = types.NewStreamToken(5, 0)
-	syncPositionBefore  = types.NewStreamToken(11, 0)
-	syncPositionAfter   = types.NewStreamToken(12, 0)
-	syncPositionNewEDU  = types.NewStreamToken(syncPositionAfter.PDUPosition(), 1)
-	syncPositionAfter2  = types.NewStreamToken(13, 0)
+	syncPositionVeryOld = types.NewStreamToken(5, 0, 0)
+	syncPositionBefore  = types.NewStreamToken(11, 0, 0)
+	syncPositionAfter   = types.NewStreamToken(12, 0, 0)
+	syncPositionNewEDU  = types.NewStreamToken(syncPositionAfter.PDUPosition(), 1, 0)
+	syncPositionAfter2  = types.NewStreamToken(13, 0, 0)
 )
 
 var (
@@ -140,6 +140,39 @@ func TestNewEventAndJoinedToRoom(t *testing.T) {
 	wg.Wait()
 }
 
+// Test that a new event in a room wakes up a user peeking into the room, and
+// that the user is no longer woken once they stop peeking.
+func TestNewEventAndPeekingIntoRoom(t *testing.T) {
+	n := NewNotifier(syncPositionBefore)
+	n.AddPeek(roomID, bob)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		pos, err := waitForEvents(n, newTestSyncRequest(bob, syncPositionBefore))
+		if err != nil {
+			t.Errorf("TestNewEventAndPeekingIntoRoom error: %s", err)
+		}
+		mustEqualPositions(t, pos, syncPositionAfter)
+		wg.Done()
+	}()
+
+	stream := lockedFetchUserStream(n, bob)
+	waitForBlocking(stream, 1)
+
+	n.OnNewEvent(&randomMessageEvent, "", nil, syncPositionAfter)
+
+	wg.Wait()
+
+	n.RemovePeek(roomID, bob)
+	n.streamLock.Lock()
+	peeking := n.peekingUsers(roomID)
+	n.streamLock.Unlock()
+	if len(peeking) != 0 {
+		t.Fatalf("TestNewEventAndPeekingIntoRoom: expected no peeking users, got %v", peeking)
+	}
+}
+
 // Test that an invite unblocks the request
 func TestNewInviteEventForUser(t *testing.T) {
 	n := NewNotifier(syncPositionBefore)
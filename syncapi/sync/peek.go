@@ -0,0 +1,387 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	"github.com/matrix-org/dendrite/internal"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+	"github.com/matrix-org/util"
+)
+
+const (
+	defaultRoomInitialSyncLimit = 10
+	defaultEventsLimit          = 10
+	defaultEventsTimeout        = 30 * time.Second
+)
+
+type roomInitialSyncMessages struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	Start string                          `json:"start"`
+	End   string                          `json:"end"`
+}
+
+type roomInitialSyncResponse struct {
+	RoomID      string                          `json:"room_id"`
+	Membership  string                          `json:"membership,omitempty"`
+	Messages    roomInitialSyncMessages         `json:"messages"`
+	State       []gomatrixserverlib.ClientEvent `json:"state"`
+	Presence    []gomatrixserverlib.ClientEvent `json:"presence"`
+	AccountData []gomatrixserverlib.ClientEvent `json:"account_data"`
+}
+
+type eventsResponse struct {
+	Chunk []gomatrixserverlib.ClientEvent `json:"chunk"`
+	Start string                          `json:"start"`
+	End   string                          `json:"end"`
+}
+
+// OnIncomingRoomInitialSyncRequest implements GET /rooms/{roomID}/initialSync.
+// Users who have left the room see it as it was when they left. Users who
+// were never in the room, including guests, can peek into it if it is world
+// readable.
+func (rp *RequestPool) OnIncomingRoomInitialSyncRequest(
+	req *http.Request, device *authtypes.Device, roomID string,
+) util.JSONResponse {
+	ctx := req.Context()
+	limit, resErr := parseNonNegativeInt(req, "limit", defaultRoomInitialSyncLimit)
+	if resErr != nil {
+		return *resErr
+	}
+
+	membership, memberEventID, err := rp.membershipInRoom(ctx, device.UserID, roomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.membershipInRoom failed")
+		return jsonerror.InternalServerError()
+	}
+
+	// Work out where the room's timeline ends for this user, and the state
+	// of the room at that point.
+	var from types.TopologyToken
+	var state []gomatrixserverlib.HeaderedEvent
+	switch membership {
+	case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+		if from, err = rp.db.EventPositionInTopology(ctx, memberEventID); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rp.db.EventPositionInTopology failed")
+			return jsonerror.InternalServerError()
+		}
+		var stateRes roomserverAPI.QueryStateAndAuthChainResponse
+		if err = rp.rsAPI.QueryStateAndAuthChain(ctx, &roomserverAPI.QueryStateAndAuthChainRequest{
+			RoomID:       roomID,
+			PrevEventIDs: []string{memberEventID},
+		}, &stateRes); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rp.rsAPI.QueryStateAndAuthChain failed")
+			return jsonerror.InternalServerError()
+		}
+		state = stateRes.StateEvents
+	default:
+		if membership != gomatrixserverlib.Join {
+			if resErr = rp.checkPeek(ctx, roomID); resErr != nil {
+				return *resErr
+			}
+		}
+		if from, err = rp.db.MaxTopologicalPosition(ctx, roomID); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rp.db.MaxTopologicalPosition failed")
+			return jsonerror.InternalServerError()
+		}
+		stateFilter := gomatrixserverlib.DefaultStateFilter()
+		if state, err = rp.db.GetStateEventsForRoom(ctx, roomID, &stateFilter); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rp.db.GetStateEventsForRoom failed")
+			return jsonerror.InternalServerError()
+		}
+	}
+
+	// Paginating backwards includes the event at the token, so the latest
+	// event is included.
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	filter.Limit = limit
+	earliest := types.NewTopologyToken(0, 0)
+	streamEvents, err := rp.db.GetEventsInTopologicalRange(ctx, &from, &earliest, roomID, &filter, true)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.db.GetEventsInTopologicalRange failed")
+		return jsonerror.InternalServerError()
+	}
+	events := rp.db.StreamEventsToEvents(device, streamEvents)
+	start := from
+	if len(events) > 0 {
+		if start, err = rp.db.EventPositionInTopology(ctx, events[len(events)-1].EventID()); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rp.db.EventPositionInTopology failed")
+			return jsonerror.InternalServerError()
+		}
+		start.Decrement()
+	}
+	if events, err = rp.visibleEvents(ctx, device.UserID, events); err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.visibleEvents failed")
+		return jsonerror.InternalServerError()
+	}
+	// The events are in reverse chronological order.
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+
+	// Members can carry on with /events from the current position, whereas
+	// the timeline stops where users who have left did.
+	end := from.String()
+	if membership != gomatrixserverlib.Leave && membership != gomatrixserverlib.Ban {
+		currPos := rp.notifier.CurrentPosition()
+		end = currPos.String()
+	}
+
+	res := roomInitialSyncResponse{
+		RoomID:     roomID,
+		Membership: membership,
+		Messages: roomInitialSyncMessages{
+			Chunk: gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll),
+			Start: start.String(),
+			End:   end,
+		},
+		State:       gomatrixserverlib.HeaderedToClientEvents(state, gomatrixserverlib.FormatAll),
+		Presence:    []gomatrixserverlib.ClientEvent{},
+		AccountData: []gomatrixserverlib.ClientEvent{},
+	}
+	if membership != "" {
+		localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("gomatrixserverlib.SplitID failed")
+			return jsonerror.InternalServerError()
+		}
+		_, rooms, err := rp.accountDB.GetAccountData(ctx, localpart)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rp.accountDB.GetAccountData failed")
+			return jsonerror.InternalServerError()
+		}
+		if len(rooms[roomID]) > 0 {
+			res.AccountData = rooms[roomID]
+		}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: res,
+	}
+}
+
+// OnIncomingEventsRequest implements GET /events. Only peeking into a single
+// room with the room_id parameter is supported, which is how guests and other
+// users who aren't joined follow world readable rooms.
+func (rp *RequestPool) OnIncomingEventsRequest(
+	req *http.Request, device *authtypes.Device,
+) util.JSONResponse {
+	ctx := req.Context()
+	limit, resErr := parseNonNegativeInt(req, "limit", defaultEventsLimit)
+	if resErr != nil {
+		return *resErr
+	}
+	timeoutMS, resErr := parseNonNegativeInt(req, "timeout", int(defaultEventsTimeout/time.Millisecond))
+	if resErr != nil {
+		return *resErr
+	}
+	from := rp.notifier.CurrentPosition()
+	if s := req.URL.Query().Get("from"); s != "" {
+		var err error
+		if from, err = types.NewStreamTokenFromString(s); err != nil {
+			topologyToken, err2 := types.NewTopologyTokenFromString(s)
+			if err2 != nil {
+				return util.JSONResponse{
+					Code: http.StatusBadRequest,
+					JSON: jsonerror.InvalidArgumentValue("Invalid from parameter: " + err.Error()),
+				}
+			}
+			from = topologyToken.StreamToken()
+		}
+	}
+
+	roomID := req.URL.Query().Get("room_id")
+	if roomID == "" {
+		if device.IsGuest {
+			return util.JSONResponse{
+				Code: http.StatusForbidden,
+				JSON: jsonerror.GuestAccessForbidden("Guests can only use /events to peek into rooms"),
+			}
+		}
+		// The global event stream has been replaced by /sync.
+		return util.JSONResponse{
+			Code: http.StatusOK,
+			JSON: eventsResponse{
+				Chunk: []gomatrixserverlib.ClientEvent{},
+				Start: from.String(),
+				End:   from.String(),
+			},
+		}
+	}
+
+	membership, _, err := rp.membershipInRoom(ctx, device.UserID, roomID)
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.membershipInRoom failed")
+		return jsonerror.InternalServerError()
+	}
+	if membership != gomatrixserverlib.Join {
+		if resErr = rp.checkPeek(ctx, roomID); resErr != nil {
+			return *resErr
+		}
+	}
+
+	// Make sure that new events in the room wake us up before looking for
+	// any, so that none are missed.
+	rp.notifier.AddPeek(roomID, device.UserID)
+	defer rp.notifier.RemovePeek(roomID, device.UserID)
+	listener := rp.notifier.GetListener(syncRequest{ctx: ctx, device: *device})
+	defer listener.Close()
+	timer := time.NewTimer(time.Duration(timeoutMS) * time.Millisecond)
+	defer timer.Stop()
+
+	sincePos := listener.GetSyncPosition()
+	for {
+		events, end, err := rp.eventsSince(ctx, device, roomID, from, limit)
+		if err != nil {
+			util.GetLogger(ctx).WithError(err).Error("rp.eventsSince failed")
+			return jsonerror.InternalServerError()
+		}
+		if len(events) > 0 || timeoutMS == 0 {
+			return util.JSONResponse{
+				Code: http.StatusOK,
+				JSON: eventsResponse{
+					Chunk: gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatAll),
+					Start: from.String(),
+					End:   end.String(),
+				},
+			}
+		}
+		// Nothing to see yet, including events we aren't allowed to see, so
+		// carry on from where we got to.
+		from = end
+
+		select {
+		case <-listener.GetNotifyChannel(sincePos):
+			sincePos = listener.GetSyncPosition()
+		case <-timer.C:
+			timeoutMS = 0
+		case <-ctx.Done():
+			util.GetLogger(ctx).WithError(ctx.Err()).Error("request cancelled")
+			return jsonerror.InternalServerError()
+		}
+	}
+}
+
+// eventsSince returns up to limit events in the room after the given position
+// which the user is allowed to see, along with the position to carry on from.
+func (rp *RequestPool) eventsSince(
+	ctx context.Context, device *authtypes.Device, roomID string, from types.StreamingToken, limit int,
+) ([]gomatrixserverlib.HeaderedEvent, types.StreamingToken, error) {
+	to := rp.notifier.CurrentPosition()
+	filter := gomatrixserverlib.DefaultRoomEventFilter()
+	filter.Limit = limit
+	streamEvents, err := rp.db.GetEventsInStreamingRange(ctx, &from, &to, roomID, &filter, false)
+	if err != nil {
+		return nil, from, err
+	}
+	end := to
+	if limit > 0 && len(streamEvents) == limit {
+		end = to.WithUpdates(types.NewStreamToken(streamEvents[len(streamEvents)-1].StreamPosition, 0, 0))
+	}
+	events, err := rp.visibleEvents(ctx, device.UserID, rp.db.StreamEventsToEvents(device, streamEvents))
+	return events, end, err
+}
+
+// membershipInRoom returns the user's current membership of the room, and the
+// ID of their membership event. The membership is empty if they have none.
+func (rp *RequestPool) membershipInRoom(
+	ctx context.Context, userID, roomID string,
+) (string, string, error) {
+	ev, err := rp.db.GetStateEvent(ctx, roomID, gomatrixserverlib.MRoomMember, userID)
+	if err != nil || ev == nil {
+		return "", "", err
+	}
+	membership, err := ev.Membership()
+	return membership, ev.EventID(), err
+}
+
+// checkPeek returns an error response unless the room can be peeked into by
+// users who aren't members, which is the case if it is world readable.
+func (rp *RequestPool) checkPeek(ctx context.Context, roomID string) *util.JSONResponse {
+	ev, err := rp.db.GetStateEvent(ctx, roomID, "m.room.history_visibility", "")
+	if err != nil {
+		util.GetLogger(ctx).WithError(err).Error("rp.db.GetStateEvent failed")
+		resErr := jsonerror.InternalServerError()
+		return &resErr
+	}
+	var content internal.HistoryVisibilityContent
+	if ev != nil {
+		if err = json.Unmarshal(ev.Content(), &content); err != nil {
+			util.GetLogger(ctx).WithError(err).Error("json.Unmarshal failed")
+			resErr := jsonerror.InternalServerError()
+			return &resErr
+		}
+	}
+	if content.HistoryVisibility != "world_readable" {
+		return &util.JSONResponse{
+			Code: http.StatusForbidden,
+			JSON: jsonerror.Forbidden("You are not a member of this room and it is not world readable"),
+		}
+	}
+	return nil
+}
+
+// visibleEvents returns the events which the user is allowed to see.
+func (rp *RequestPool) visibleEvents(
+	ctx context.Context, userID string, events []gomatrixserverlib.HeaderedEvent,
+) ([]gomatrixserverlib.HeaderedEvent, error) {
+	if len(events) == 0 {
+		return events, nil
+	}
+	eventIDs := make([]string, len(events))
+	for i := range events {
+		eventIDs[i] = events[i].EventID()
+	}
+	var allowedRes roomserverAPI.QueryUserAllowedToSeeEventsResponse
+	if err := rp.rsAPI.QueryUserAllowedToSeeEvents(ctx, &roomserverAPI.QueryUserAllowedToSeeEventsRequest{
+		EventIDs: eventIDs,
+		UserID:   userID,
+	}, &allowedRes); err != nil {
+		return nil, err
+	}
+	result := []gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range events {
+		if allowedRes.AllowedToSeeEvents[ev.EventID()] {
+			result = append(result, ev)
+		}
+	}
+	return result, nil
+}
+
+// parseNonNegativeInt parses the named query parameter, which must be a
+// non-negative integer if it is given.
+func parseNonNegativeInt(req *http.Request, name string, defaultValue int) (int, *util.JSONResponse) {
+	s := req.URL.Query().Get(name)
+	if s == "" {
+		return defaultValue, nil
+	}
+	i, err := strconv.Atoi(s)
+	if err != nil || i < 0 {
+		return 0, &util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue(name + " must be a non-negative integer"),
+		}
+	}
+	return i, nil
+}
@@ -16,14 +16,18 @@ package sync
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
-
+	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
+	"github.com/matrix-org/dendrite/eduserver/cache"
 	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/matrix-org/util"
 	log "github.com/sirupsen/logrus"
 )
@@ -31,26 +35,20 @@ import (
 const defaultSyncTimeout = time.Duration(0)
 const defaultTimelineLimit = 20
 
-type filter struct {
-	Room struct {
-		Timeline struct {
-			Limit *int `json:"limit"`
-		} `json:"timeline"`
-	} `json:"room"`
-}
-
 // syncRequest represents a /sync request, with sensible defaults/sanity checks applied.
 type syncRequest struct {
 	ctx           context.Context
 	device        authtypes.Device
+	filter        gomatrixserverlib.Filter
 	limit         int
 	timeout       time.Duration
 	since         *types.StreamingToken // nil means that no since token was supplied
 	wantFullState bool
+	setPresence   string
 	log           *log.Entry
 }
 
-func newSyncRequest(req *http.Request, device authtypes.Device) (*syncRequest, error) {
+func newSyncRequest(req *http.Request, device authtypes.Device, accountDB accounts.Database) (*syncRequest, error) {
 	timeout := getTimeout(req.URL.Query().Get("timeout"))
 	fullState := req.URL.Query().Get("full_state")
 	wantFullState := fullState != "" && fullState != "false"
@@ -63,29 +61,64 @@ func newSyncRequest(req *http.Request, device authtypes.Device) (*syncRequest, e
 		}
 		since = &tok
 	}
-	timelineLimit := defaultTimelineLimit
-	// TODO: read from stored filters too
-	filterQuery := req.URL.Query().Get("filter")
-	if filterQuery != "" && filterQuery[0] == '{' {
-		// attempt to parse the timeline limit at least
-		var f filter
-		err := json.Unmarshal([]byte(filterQuery), &f)
-		if err == nil && f.Room.Timeline.Limit != nil {
-			timelineLimit = *f.Room.Timeline.Limit
-		}
+	filter, err := getFilter(req.Context(), req.URL.Query().Get("filter"), device, accountDB)
+	if err != nil {
+		return nil, err
+	}
+	// The client is online unless it asks otherwise.
+	setPresence := req.URL.Query().Get("set_presence")
+	switch setPresence {
+	case cache.PresenceOnline, cache.PresenceUnavailable, cache.PresenceOffline:
+	default:
+		setPresence = cache.PresenceOnline
 	}
-	// TODO: Additional query params: set_presence, filter
 	return &syncRequest{
 		ctx:           req.Context(),
 		device:        device,
+		filter:        filter,
 		timeout:       timeout,
 		since:         since,
 		wantFullState: wantFullState,
-		limit:         timelineLimit,
+		setPresence:   setPresence,
+		limit:         filter.Room.Timeline.Limit,
 		log:           util.GetLogger(req.Context()),
 	}, nil
 }
 
+// getFilter returns the filter given in the filter query parameter, which is
+// either the JSON of a filter or the ID of one which the user has uploaded.
+// Any parts of the filter which aren't given take their default values.
+func getFilter(
+	ctx context.Context, filterQuery string, device authtypes.Device, accountDB accounts.Database,
+) (gomatrixserverlib.Filter, error) {
+	filter := gomatrixserverlib.DefaultFilter()
+	if filterQuery == "" {
+		return filter, nil
+	}
+	filterJSON := []byte(filterQuery)
+	if filterQuery[0] != '{' {
+		localpart, _, err := gomatrixserverlib.SplitID('@', device.UserID)
+		if err != nil {
+			return filter, err
+		}
+		stored, err := accountDB.GetFilter(ctx, localpart, filterQuery)
+		if err == sql.ErrNoRows {
+			return filter, fmt.Errorf("filter %q not found", filterQuery)
+		} else if err != nil {
+			return filter, err
+		}
+		// Stored filters are loaded without their defaults, so marshal it
+		// again to apply it over the default filter below.
+		if filterJSON, err = json.Marshal(stored); err != nil {
+			return filter, err
+		}
+	}
+	if err := json.Unmarshal(filterJSON, &filter); err != nil {
+		return filter, fmt.Errorf("invalid filter: %w", err)
+	}
+	return filter, nil
+}
+
 func getTimeout(timeoutMS string) time.Duration {
 	if timeoutMS == "" {
 		return defaultSyncTimeout
@@ -15,12 +15,18 @@
 package sync
 
 import (
+	"encoding/json"
+	"math"
 	"net/http"
+	"sort"
 	"time"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/accounts"
 	"github.com/matrix-org/dendrite/clientapi/jsonerror"
+	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
+	"github.com/matrix-org/dendrite/internal/config"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/dendrite/syncapi/storage"
 	"github.com/matrix-org/dendrite/syncapi/types"
 	"github.com/matrix-org/gomatrixserverlib"
@@ -33,11 +39,18 @@ type RequestPool struct {
 	db        storage.Database
 	accountDB accounts.Database
 	notifier  *Notifier
+	eduAPI    eduserverAPI.EDUServerInputAPI
+	rsAPI     roomserverAPI.RoomserverInternalAPI
+	cfg       *config.Dendrite
 }
 
 // NewRequestPool makes a new RequestPool
-func NewRequestPool(db storage.Database, n *Notifier, adb accounts.Database) *RequestPool {
-	return &RequestPool{db, adb, n}
+func NewRequestPool(
+	db storage.Database, n *Notifier, adb accounts.Database,
+	eduAPI eduserverAPI.EDUServerInputAPI, rsAPI roomserverAPI.RoomserverInternalAPI,
+	cfg *config.Dendrite,
+) *RequestPool {
+	return &RequestPool{db, adb, n, eduAPI, rsAPI, cfg}
 }
 
 // OnIncomingSyncRequest is called when a client makes a /sync request. This function MUST be
@@ -48,7 +61,7 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 
 	// Extract values from request
 	userID := device.UserID
-	syncReq, err := newSyncRequest(req, *device)
+	syncReq, err := newSyncRequest(req, *device, rp.accountDB)
 	if err != nil {
 		return util.JSONResponse{
 			Code: http.StatusBadRequest,
@@ -62,6 +75,8 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 		"limit":   syncReq.limit,
 	})
 
+	rp.updatePresence(syncReq)
+
 	currPos := rp.notifier.CurrentPosition()
 
 	if shouldReturnImmediately(syncReq) {
@@ -136,23 +151,441 @@ func (rp *RequestPool) OnIncomingSyncRequest(req *http.Request, device *authtype
 func (rp *RequestPool) currentSyncForUser(req syncRequest, latestPos types.StreamingToken) (res *types.Response, err error) {
 	// TODO: handle ignored users
 	if req.since == nil {
-		res, err = rp.db.CompleteSync(req.ctx, req.device.UserID, req.limit)
+		res, err = rp.db.CompleteSync(req.ctx, req.device.UserID, &req.filter)
 	} else {
-		res, err = rp.db.IncrementalSync(req.ctx, req.device, *req.since, latestPos, req.limit, req.wantFullState)
+		res, err = rp.db.IncrementalSync(req.ctx, req.device, *req.since, latestPos, &req.filter, req.wantFullState)
+	}
+
+	if err != nil {
+		return
 	}
 
+	if err = rp.applyHistoryVisibility(req, res); err != nil {
+		return
+	}
+
+	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition())
 	if err != nil {
 		return
 	}
 
-	accountDataFilter := gomatrixserverlib.DefaultEventFilter() // TODO: use filter provided in req instead
-	res, err = rp.appendAccountData(res, req.device.UserID, req, latestPos.PDUPosition(), &accountDataFilter)
+	// Device list changes are only sent in incremental syncs. After an
+	// initial sync the client is expected to query the keys of everyone
+	// it shares a room with.
+	if req.since != nil {
+		if err = rp.appendDeviceLists(req, res, *req.since, latestPos); err != nil {
+			return
+		}
+	}
+
+	if !rp.cfg.Matrix.PresenceDisabled {
+		if err = rp.appendPresence(req, res, latestPos); err != nil {
+			return
+		}
+	}
+
+	if err = rp.appendNotificationCounts(req, res); err != nil {
+		return
+	}
+
+	// Syncing from a given position acknowledges all send-to-device messages
+	// up to that position, so they can be removed before sending the rest.
+	var since types.StreamPosition
+	if req.since != nil {
+		since = req.since.PDUPosition()
+	}
+	events, err := rp.db.SendToDeviceUpdatesForSync(
+		req.ctx, req.device.UserID, req.device.ID, since, latestPos.PDUPosition(),
+	)
+	if err != nil {
+		return
+	}
+	res.ToDevice.Events = append(res.ToDevice.Events, events...)
 	return
 }
 
+// maxHistoryVisibilityFetches is how many times the timeline of a room is
+// extended with older events to make up for events which the user isn't
+// allowed to see, before giving up and returning a shorter timeline.
+const maxHistoryVisibilityFetches = 3
+
+// applyHistoryVisibility removes the timeline events which the user isn't
+// allowed to see, according to the history visibility of their rooms, from
+// the joined and left rooms in the response. Limited timelines are extended
+// with older events so that they are still filled up to the limit.
+func (rp *RequestPool) applyHistoryVisibility(req syncRequest, res *types.Response) error {
+	var eventIDs []string
+	for _, jr := range res.Rooms.Join {
+		for _, ev := range jr.Timeline.Events {
+			eventIDs = append(eventIDs, ev.EventID)
+		}
+	}
+	for _, lr := range res.Rooms.Leave {
+		for _, ev := range lr.Timeline.Events {
+			eventIDs = append(eventIDs, ev.EventID)
+		}
+	}
+	if len(eventIDs) == 0 {
+		return nil
+	}
+	allowed, err := rp.allowedToSeeEvents(req, eventIDs)
+	if err != nil {
+		return err
+	}
+	for roomID, jr := range res.Rooms.Join {
+		visible := visibleEvents(jr.Timeline.Events, allowed)
+		if hidden := len(jr.Timeline.Events) - len(visible); hidden > 0 && jr.Timeline.Limited {
+			if visible, jr.Timeline.PrevBatch, err = rp.extendTimeline(
+				req, roomID, visible, jr.Timeline.PrevBatch, hidden,
+			); err != nil {
+				return err
+			}
+			jr.State.Events = removeEvents(jr.State.Events, visible)
+		}
+		jr.Timeline.Events = visible
+		res.Rooms.Join[roomID] = jr
+	}
+	for roomID, lr := range res.Rooms.Leave {
+		visible := visibleEvents(lr.Timeline.Events, allowed)
+		if hidden := len(lr.Timeline.Events) - len(visible); hidden > 0 && lr.Timeline.Limited {
+			if visible, lr.Timeline.PrevBatch, err = rp.extendTimeline(
+				req, roomID, visible, lr.Timeline.PrevBatch, hidden,
+			); err != nil {
+				return err
+			}
+			lr.State.Events = removeEvents(lr.State.Events, visible)
+		}
+		lr.Timeline.Events = visible
+		res.Rooms.Leave[roomID] = lr
+	}
+	return nil
+}
+
+// extendTimeline prepends up to the wanted number of older events, which the
+// user is allowed to see, to the timeline of the room. Returns the extended
+// timeline and the prev_batch token from before its earliest event.
+func (rp *RequestPool) extendTimeline(
+	req syncRequest, roomID string, timeline []gomatrixserverlib.ClientEvent,
+	prevBatch string, wanted int,
+) ([]gomatrixserverlib.ClientEvent, string, error) {
+	filter := req.filter.Room.Timeline
+	to := types.NewTopologyToken(0, 0)
+	for i := 0; i < maxHistoryVisibilityFetches && wanted > 0; i++ {
+		from, err := types.NewTopologyTokenFromString(prevBatch)
+		if err != nil {
+			return nil, "", err
+		}
+		filter.Limit = wanted
+		streamEvents, err := rp.db.GetEventsInTopologicalRange(req.ctx, &from, &to, roomID, &filter, true)
+		if err != nil {
+			return nil, "", err
+		}
+		if len(streamEvents) == 0 {
+			break
+		}
+		events := rp.db.StreamEventsToEvents(&req.device, streamEvents)
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].Depth() < events[j].Depth()
+		})
+		pos, err := rp.db.EventPositionInTopology(req.ctx, events[0].EventID())
+		if err != nil {
+			return nil, "", err
+		}
+		pos.Decrement()
+		prevBatch = pos.String()
+
+		eventIDs := make([]string, len(events))
+		for i := range events {
+			eventIDs[i] = events[i].EventID()
+		}
+		allowed, err := rp.allowedToSeeEvents(req, eventIDs)
+		if err != nil {
+			return nil, "", err
+		}
+		older := visibleEvents(gomatrixserverlib.HeaderedToClientEvents(events, gomatrixserverlib.FormatSync), allowed)
+		timeline = append(older, timeline...)
+		wanted -= len(older)
+	}
+	return timeline, prevBatch, nil
+}
+
+// allowedToSeeEvents asks the roomserver which of the events the user is
+// allowed to see.
+func (rp *RequestPool) allowedToSeeEvents(req syncRequest, eventIDs []string) (map[string]bool, error) {
+	var allowedRes roomserverAPI.QueryUserAllowedToSeeEventsResponse
+	if err := rp.rsAPI.QueryUserAllowedToSeeEvents(req.ctx, &roomserverAPI.QueryUserAllowedToSeeEventsRequest{
+		EventIDs: eventIDs,
+		UserID:   req.device.UserID,
+	}, &allowedRes); err != nil {
+		return nil, err
+	}
+	return allowedRes.AllowedToSeeEvents, nil
+}
+
+// visibleEvents returns the events which are allowed.
+func visibleEvents(events []gomatrixserverlib.ClientEvent, allowed map[string]bool) []gomatrixserverlib.ClientEvent {
+	result := []gomatrixserverlib.ClientEvent{}
+	for _, ev := range events {
+		if allowed[ev.EventID] {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
+
+// removeEvents returns the state events which aren't in the timeline, as the
+// state of a room in a sync response is the state before its timeline.
+func removeEvents(state, timeline []gomatrixserverlib.ClientEvent) []gomatrixserverlib.ClientEvent {
+	inTimeline := make(map[string]bool, len(timeline))
+	for _, ev := range timeline {
+		inTimeline[ev.EventID] = true
+	}
+	result := []gomatrixserverlib.ClientEvent{}
+	for _, ev := range state {
+		if !inTimeline[ev.EventID] {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
+
+// appendNotificationCounts fills in the unread notification counts of every
+// joined room in the response.
+func (rp *RequestPool) appendNotificationCounts(req syncRequest, res *types.Response) error {
+	if len(res.Rooms.Join) == 0 {
+		return nil
+	}
+	counts, err := rp.db.GetNotificationCounts(req.ctx, req.device.UserID)
+	if err != nil {
+		return err
+	}
+	for roomID, jr := range res.Rooms.Join {
+		jr.UnreadNotifications = counts[roomID]
+		res.Rooms.Join[roomID] = jr
+	}
+	return nil
+}
+
+// OnIncomingKeyChangeRequest implements GET /keys/changes
+// https://matrix.org/docs/spec/client_server/r0.6.1#get-matrix-client-r0-keys-changes
+func (rp *RequestPool) OnIncomingKeyChangeRequest(req *http.Request, device *authtypes.Device) util.JSONResponse {
+	from := req.URL.Query().Get("from")
+	to := req.URL.Query().Get("to")
+	if from == "" || to == "" {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.MissingArgument("missing ?from= or ?to="),
+		}
+	}
+	fromToken, err := types.NewStreamTokenFromString(from)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("bad 'from' value: " + err.Error()),
+		}
+	}
+	toToken, err := types.NewStreamTokenFromString(to)
+	if err != nil {
+		return util.JSONResponse{
+			Code: http.StatusBadRequest,
+			JSON: jsonerror.InvalidArgumentValue("bad 'to' value: " + err.Error()),
+		}
+	}
+
+	syncReq := syncRequest{
+		ctx:    req.Context(),
+		device: *device,
+		filter: gomatrixserverlib.DefaultFilter(),
+		limit:  defaultTimelineLimit,
+	}
+	// Only the membership changes are needed, so don't fetch any timelines.
+	syncReq.filter.Room.Timeline.Limit = 0
+	res, err := rp.db.IncrementalSync(req.Context(), *device, fromToken, toToken, &syncReq.filter, false)
+	if err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rp.db.IncrementalSync failed")
+		return jsonerror.InternalServerError()
+	}
+	if err = rp.appendDeviceLists(syncReq, res, fromToken, toToken); err != nil {
+		util.GetLogger(req.Context()).WithError(err).Error("rp.appendDeviceLists failed")
+		return jsonerror.InternalServerError()
+	}
+
+	changed, left := res.DeviceLists.Changed, res.DeviceLists.Left
+	if changed == nil {
+		changed = []string{}
+	}
+	if left == nil {
+		left = []string{}
+	}
+	return util.JSONResponse{
+		Code: http.StatusOK,
+		JSON: map[string]interface{}{
+			"changed": changed,
+			"left":    left,
+		},
+	}
+}
+
+// appendDeviceLists fills in the device_lists section of a sync response.
+// A user is "changed" if their device list changed between the two positions
+// or if they started sharing a room with the syncing user, and "left" if the
+// syncing user no longer shares any rooms with them. The membership changes
+// are worked out from the member events already in the response.
+func (rp *RequestPool) appendDeviceLists(
+	req syncRequest, data *types.Response, fromPos, toPos types.StreamingToken,
+) error {
+	userID := req.device.UserID
+	sharedUsers, err := rp.db.SharedUsers(req.ctx, userID)
+	if err != nil {
+		return err
+	}
+	shared := make(map[string]bool, len(sharedUsers)+1)
+	for _, u := range sharedUsers {
+		shared[u] = true
+	}
+	// Always tell the user about changes to their own devices.
+	shared[userID] = true
+
+	changed := make(map[string]bool)
+	left := make(map[string]bool)
+
+	if fromPos.PDUPosition() < toPos.PDUPosition() {
+		keyChanges, err := rp.db.KeyChangesInRange(req.ctx, types.Range{
+			From: fromPos.PDUPosition(),
+			To:   toPos.PDUPosition(),
+		})
+		if err != nil {
+			return err
+		}
+		for _, u := range keyChanges {
+			changed[u] = true
+		}
+	}
+
+	for _, jr := range data.Rooms.Join {
+		membershipChanges(jr.State.Events, userID, changed, left)
+		membershipChanges(jr.Timeline.Events, userID, changed, left)
+	}
+	stateFilter := gomatrixserverlib.DefaultStateFilter()
+	for roomID, lr := range data.Rooms.Leave {
+		membershipChanges(lr.State.Events, userID, left, left)
+		membershipChanges(lr.Timeline.Events, userID, left, left)
+		// We've left this room, so everyone who is still in it is a
+		// candidate for no longer sharing any rooms with us.
+		stateEvents, err := rp.db.GetStateEventsForRoom(req.ctx, roomID, &stateFilter)
+		if err != nil {
+			return err
+		}
+		membershipChanges(
+			gomatrixserverlib.HeaderedToClientEvents(stateEvents, gomatrixserverlib.FormatSync),
+			userID, left, left,
+		)
+	}
+
+	for u := range changed {
+		if shared[u] {
+			data.DeviceLists.Changed = append(data.DeviceLists.Changed, u)
+		}
+	}
+	for u := range left {
+		if !shared[u] {
+			data.DeviceLists.Left = append(data.DeviceLists.Left, u)
+		}
+	}
+	sort.Strings(data.DeviceLists.Changed)
+	sort.Strings(data.DeviceLists.Left)
+	return nil
+}
+
+// membershipChanges adds the targets of any m.room.member events in the
+// given list to joined or left depending on their membership. Events about
+// the syncing user themselves are ignored.
+func membershipChanges(events []gomatrixserverlib.ClientEvent, userID string, joined, left map[string]bool) {
+	for _, ev := range events {
+		if ev.Type != gomatrixserverlib.MRoomMember || ev.StateKey == nil || *ev.StateKey == userID {
+			continue
+		}
+		var content struct {
+			Membership string `json:"membership"`
+		}
+		if err := json.Unmarshal(ev.Content, &content); err != nil {
+			continue
+		}
+		switch content.Membership {
+		case gomatrixserverlib.Join:
+			joined[*ev.StateKey] = true
+		case gomatrixserverlib.Leave, gomatrixserverlib.Ban:
+			left[*ev.StateKey] = true
+		}
+	}
+}
+
+// updatePresence tells the EDU server that the user is syncing with the
+// presence given in set_presence, which keeps them from going offline.
+func (rp *RequestPool) updatePresence(req *syncRequest) {
+	if rp.cfg.Matrix.PresenceDisabled {
+		return
+	}
+	var res eduserverAPI.InputPresenceEventResponse
+	err := rp.eduAPI.InputPresenceEvent(req.ctx, &eduserverAPI.InputPresenceEventRequest{
+		InputPresenceEvent: eduserverAPI.InputPresenceEvent{
+			UserID:   req.device.UserID,
+			Presence: req.setPresence,
+			FromSync: true,
+		},
+	}, &res)
+	if err != nil {
+		req.log.WithError(err).Error("rp.eduAPI.InputPresenceEvent failed")
+	}
+}
+
+// appendPresence fills in the presence section of a sync response with the
+// presence of the syncing user and everyone who shares a room with them,
+// for every user whose presence changed since the last sync.
+func (rp *RequestPool) appendPresence(
+	req syncRequest, data *types.Response, toPos types.StreamingToken,
+) error {
+	r := types.Range{To: toPos.PDUPosition()}
+	if req.since != nil {
+		r.From = req.since.PDUPosition()
+	}
+	presences, err := rp.db.PresenceInRange(req.ctx, r)
+	if err != nil || len(presences) == 0 {
+		return err
+	}
+
+	userID := req.device.UserID
+	sharedUsers, err := rp.db.SharedUsers(req.ctx, userID)
+	if err != nil {
+		return err
+	}
+	visible := map[string]bool{userID: true}
+	for _, u := range sharedUsers {
+		visible[u] = true
+	}
+
+	now := time.Now()
+	for i := range presences {
+		p := &presences[i]
+		if !visible[p.UserID] {
+			continue
+		}
+		ev := gomatrixserverlib.ClientEvent{
+			Type:   "m.presence",
+			Sender: p.UserID,
+		}
+		ev.Content, err = json.Marshal(types.NewPresenceContent(p, now))
+		if err != nil {
+			return err
+		}
+		data.Presence.Events = append(data.Presence.Events, ev)
+	}
+	data.Presence.Events = types.FilterClientEvents(data.Presence.Events, &req.filter.Presence)
+	return nil
+}
+
 func (rp *RequestPool) appendAccountData(
 	data *types.Response, userID string, req syncRequest, currentPos types.StreamPosition,
-	accountDataFilter *gomatrixserverlib.EventFilter,
 ) (*types.Response, error) {
 	// TODO: Account data doesn't have a sync position of its own, meaning that
 	// account data might be sent multiple time to the client if multiple account
@@ -173,11 +606,11 @@ func (rp *RequestPool) appendAccountData(
 		if err != nil {
 			return nil, err
 		}
-		data.AccountData.Events = global
+		data.AccountData.Events = filterAccountData(global, "", &req.filter)
 
 		for r, j := range data.Rooms.Join {
-			if len(rooms[r]) > 0 {
-				j.AccountData.Events = rooms[r]
+			if events := filterAccountData(rooms[r], r, &req.filter); len(events) > 0 {
+				j.AccountData.Events = events
 				data.Rooms.Join[r] = j
 			}
 		}
@@ -196,9 +629,12 @@ func (rp *RequestPool) appendAccountData(
 		r.From--
 	}
 
-	// Sync is not initial, get all account data since the latest sync
+	// Sync is not initial, get all account data since the latest sync. The
+	// filter is applied below, as the global and room account data each have
+	// their own filters.
+	allAccountData := gomatrixserverlib.EventFilter{Limit: math.MaxInt32}
 	dataTypes, err := rp.db.GetAccountDataInRange(
-		req.ctx, userID, r, accountDataFilter,
+		req.ctx, userID, r, &allAccountData,
 	)
 	if err != nil {
 		return nil, err
@@ -221,6 +657,10 @@ func (rp *RequestPool) appendAccountData(
 			}
 			events = append(events, *event)
 		}
+		events = filterAccountData(events, roomID, &req.filter)
+		if len(events) == 0 {
+			continue
+		}
 
 		// Append the data to the response
 		if len(roomID) > 0 {
@@ -235,6 +675,34 @@ func (rp *RequestPool) appendAccountData(
 	return data, nil
 }
 
+// filterAccountData returns the account data events which pass the filter,
+// using the global account data filter if the room ID is empty and the room
+// account data filter otherwise. Account data has no sender, so only the
+// [not_]types of the filters apply.
+func filterAccountData(
+	events []gomatrixserverlib.ClientEvent, roomID string, filter *gomatrixserverlib.Filter,
+) []gomatrixserverlib.ClientEvent {
+	evTypes, notTypes, limit := filter.AccountData.Types, filter.AccountData.NotTypes, filter.AccountData.Limit
+	if roomID != "" {
+		roomFilter := &filter.Room.AccountData
+		if !types.FilterAllowsRoom(roomID, filter.Room.Rooms, filter.Room.NotRooms) ||
+			!types.FilterAllowsRoom(roomID, roomFilter.Rooms, roomFilter.NotRooms) {
+			return nil
+		}
+		evTypes, notTypes, limit = roomFilter.Types, roomFilter.NotTypes, roomFilter.Limit
+	}
+	result := []gomatrixserverlib.ClientEvent{}
+	for _, ev := range events {
+		if len(result) >= limit {
+			break
+		}
+		if types.FilterAllowsEvent(ev.Type, "", evTypes, notTypes, nil, nil) {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
+
 // shouldReturnImmediately returns whether the /sync request is an initial sync,
 // or timeout=0, or full_state=true, in any of the cases the request should
 // return immediately.
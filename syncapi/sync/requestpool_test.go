@@ -0,0 +1,161 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package sync
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/matrix-org/dendrite/clientapi/auth/authtypes"
+	roomserverAPI "github.com/matrix-org/dendrite/roomserver/api"
+	"github.com/matrix-org/dendrite/syncapi/storage"
+	"github.com/matrix-org/dendrite/syncapi/storage/sqlite3"
+	"github.com/matrix-org/dendrite/syncapi/types"
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+const visibilityTestRoomID = "!visibility:localhost"
+
+// visibilityRoomserverAPI hides the given events from everyone.
+type visibilityRoomserverAPI struct {
+	roomserverAPI.RoomserverInternalAPI
+	hidden map[string]bool
+}
+
+func (a *visibilityRoomserverAPI) QueryUserAllowedToSeeEvents(
+	ctx context.Context,
+	req *roomserverAPI.QueryUserAllowedToSeeEventsRequest,
+	res *roomserverAPI.QueryUserAllowedToSeeEventsResponse,
+) error {
+	res.AllowedToSeeEvents = make(map[string]bool, len(req.EventIDs))
+	for _, eventID := range req.EventIDs {
+		res.AllowedToSeeEvents[eventID] = !a.hidden[eventID]
+	}
+	return nil
+}
+
+// mustWriteMessages writes a chain of messages to the room, with event IDs
+// $1:localhost to $n:localhost.
+func mustWriteMessages(t *testing.T, db storage.Database, n int) []gomatrixserverlib.HeaderedEvent {
+	var events []gomatrixserverlib.HeaderedEvent
+	for i := 1; i <= n; i++ {
+		prevEvents := "[]"
+		if i > 1 {
+			prevEvents = fmt.Sprintf(`[["$%d:localhost",{"sha256":"abc"}]]`, i-1)
+		}
+		eventJSON := fmt.Sprintf(
+			`{"auth_events":[],"content":{"body":"%d"},"depth":%d,"event_id":"$%d:localhost","hashes":{"sha256":"abc"},"origin":"localhost","origin_server_ts":%d,"prev_events":%s,"room_id":%q,"sender":"@alice:localhost","signatures":{},"type":"m.room.message"}`,
+			i, i, i, i, prevEvents, visibilityTestRoomID,
+		)
+		ev, err := gomatrixserverlib.NewEventFromTrustedJSON([]byte(eventJSON), false, gomatrixserverlib.RoomVersionV1)
+		if err != nil {
+			t.Fatalf("NewEventFromTrustedJSON returned %s", err)
+		}
+		headered := ev.Headered(gomatrixserverlib.RoomVersionV1)
+		if _, err = db.WriteEvent(context.Background(), &headered, nil, nil, nil, nil, false); err != nil {
+			t.Fatalf("WriteEvent returned %s", err)
+		}
+		events = append(events, headered)
+	}
+	return events
+}
+
+func TestApplyHistoryVisibilityFillsTimeline(t *testing.T) {
+	tests := []struct {
+		name          string
+		hidden        []string
+		wantTimeline  []string
+		wantPrevBatch string
+	}{
+		{
+			name:          "nothing hidden",
+			wantTimeline:  []string{"$8:localhost", "$9:localhost", "$10:localhost"},
+			wantPrevBatch: "$8:localhost",
+		},
+		{
+			name:          "one hidden",
+			hidden:        []string{"$9:localhost"},
+			wantTimeline:  []string{"$7:localhost", "$8:localhost", "$10:localhost"},
+			wantPrevBatch: "$7:localhost",
+		},
+		{
+			name:          "older events hidden too",
+			hidden:        []string{"$9:localhost", "$7:localhost", "$6:localhost"},
+			wantTimeline:  []string{"$5:localhost", "$8:localhost", "$10:localhost"},
+			wantPrevBatch: "$5:localhost",
+		},
+		{
+			name:          "too many hidden",
+			hidden:        []string{"$9:localhost", "$7:localhost", "$6:localhost", "$5:localhost"},
+			wantTimeline:  []string{"$8:localhost", "$10:localhost"},
+			wantPrevBatch: "$5:localhost",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := sqlite3.NewDatabase("file::memory:")
+			if err != nil {
+				t.Fatalf("NewDatabase returned %s", err)
+			}
+			ctx := context.Background()
+			events := mustWriteMessages(t, db, 10)
+			prevBatch, err := db.EventPositionInTopology(ctx, events[7].EventID())
+			if err != nil {
+				t.Fatalf("EventPositionInTopology returned %s", err)
+			}
+			prevBatch.Decrement()
+
+			res := types.NewResponse(types.NewStreamToken(0, 0, 0))
+			jr := types.NewJoinResponse()
+			jr.Timeline.Events = gomatrixserverlib.HeaderedToClientEvents(events[7:], gomatrixserverlib.FormatSync)
+			jr.Timeline.Limited = true
+			jr.Timeline.PrevBatch = prevBatch.String()
+			res.Rooms.Join[visibilityTestRoomID] = *jr
+
+			hidden := make(map[string]bool)
+			for _, eventID := range tt.hidden {
+				hidden[eventID] = true
+			}
+			rp := &RequestPool{db: db, rsAPI: &visibilityRoomserverAPI{hidden: hidden}}
+			req := syncRequest{
+				ctx:    ctx,
+				device: authtypes.Device{UserID: "@bob:localhost"},
+				filter: gomatrixserverlib.DefaultFilter(),
+			}
+			if err = rp.applyHistoryVisibility(req, res); err != nil {
+				t.Fatalf("applyHistoryVisibility returned %s", err)
+			}
+
+			timeline := res.Rooms.Join[visibilityTestRoomID].Timeline
+			var got []string
+			for _, ev := range timeline.Events {
+				got = append(got, ev.EventID)
+			}
+			if !reflect.DeepEqual(got, tt.wantTimeline) {
+				t.Fatalf("timeline is %v, want %v", got, tt.wantTimeline)
+			}
+			wantPrevBatch, err := db.EventPositionInTopology(ctx, tt.wantPrevBatch)
+			if err != nil {
+				t.Fatalf("EventPositionInTopology returned %s", err)
+			}
+			wantPrevBatch.Decrement()
+			if timeline.PrevBatch != wantPrevBatch.String() {
+				t.Fatalf("prev_batch is %s, want the position before %s", timeline.PrevBatch, tt.wantPrevBatch)
+			}
+		})
+	}
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/matrix-org/gomatrixserverlib"
 
 	"github.com/matrix-org/dendrite/clientapi/auth/storage/devices"
+	eduserverAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/syncapi/consumers"
 	"github.com/matrix-org/dendrite/syncapi/routing"
 	"github.com/matrix-org/dendrite/syncapi/storage"
@@ -33,15 +34,17 @@ import (
 )
 
 // SetupSyncAPIComponent sets up and registers HTTP handlers for the SyncAPI
-// component.
+// component. Returns the sync API database, so that the push server can share
+// it rather than opening it again.
 func SetupSyncAPIComponent(
 	base *basecomponent.BaseDendrite,
 	deviceDB devices.Database,
 	accountsDB accounts.Database,
 	rsAPI api.RoomserverInternalAPI,
+	eduAPI eduserverAPI.EDUServerInputAPI,
 	federation *gomatrixserverlib.FederationClient,
 	cfg *config.Dendrite,
-) {
+) storage.Database {
 	syncDB, err := storage.NewSyncServerDatasource(string(base.Cfg.Database.SyncAPI), base.Cfg.DbProperties())
 	if err != nil {
 		logrus.WithError(err).Panicf("failed to connect to sync db")
@@ -58,10 +61,10 @@ func SetupSyncAPIComponent(
 		logrus.WithError(err).Panicf("failed to start notifier")
 	}
 
-	requestPool := sync.NewRequestPool(syncDB, notifier, accountsDB)
+	requestPool := sync.NewRequestPool(syncDB, notifier, accountsDB, eduAPI, rsAPI, cfg)
 
 	roomConsumer := consumers.NewOutputRoomEventConsumer(
-		base.Cfg, base.KafkaConsumer, notifier, syncDB, rsAPI,
+		base.Cfg, base.KafkaConsumer, notifier, syncDB, accountsDB, rsAPI,
 	)
 	if err = roomConsumer.Start(); err != nil {
 		logrus.WithError(err).Panicf("failed to start room server consumer")
@@ -81,5 +84,37 @@ func SetupSyncAPIComponent(
 		logrus.WithError(err).Panicf("failed to start typing server consumer")
 	}
 
-	routing.Setup(base.APIMux, requestPool, syncDB, deviceDB, federation, rsAPI, cfg)
+	receiptConsumer := consumers.NewOutputReceiptEventConsumer(
+		base.Cfg, base.KafkaConsumer, notifier, syncDB,
+	)
+	if err = receiptConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start receipts consumer")
+	}
+
+	if !cfg.Matrix.PresenceDisabled {
+		presenceConsumer := consumers.NewOutputPresenceEventConsumer(
+			base.Cfg, base.KafkaConsumer, notifier, syncDB,
+		)
+		if err = presenceConsumer.Start(); err != nil {
+			logrus.WithError(err).Panicf("failed to start presence consumer")
+		}
+	}
+
+	keyChangeConsumer := consumers.NewOutputKeyChangeEventConsumer(
+		base.Cfg, base.KafkaConsumer, notifier, syncDB,
+	)
+	if err = keyChangeConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start key change consumer")
+	}
+
+	sendToDeviceConsumer := consumers.NewOutputSendToDeviceEventConsumer(
+		base.Cfg, base.KafkaConsumer, notifier, syncDB, deviceDB,
+	)
+	if err = sendToDeviceConsumer.Start(); err != nil {
+		logrus.WithError(err).Panicf("failed to start send-to-device consumer")
+	}
+
+	routing.Setup(base.APIMux, requestPool, syncDB, deviceDB, accountsDB, federation, rsAPI, cfg)
+
+	return syncDB
 }
@@ -0,0 +1,174 @@
+// Copyright 2020 The Matrix.org Foundation C.I.C.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package types
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/matrix-org/gomatrixserverlib"
+)
+
+// These functions apply the parts of a filter which can't be done by the
+// database, e.g. to EDUs or to state which is needed in full to work out
+// membership changes. A nil list places no restriction, whereas an empty
+// list matches nothing, which is the same as the SQL queries.
+
+// FilterAllowsRoom returns true if the room passes the rooms and not_rooms
+// lists of a filter.
+func FilterAllowsRoom(roomID string, rooms, notRooms []string) bool {
+	for _, r := range notRooms {
+		if r == roomID {
+			return false
+		}
+	}
+	if rooms == nil {
+		return true
+	}
+	for _, r := range rooms {
+		if r == roomID {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterAllowsEvent returns true if an event with the given type and sender
+// passes the types, not_types, senders and not_senders lists of a filter.
+// Types may contain '*' wildcards.
+func FilterAllowsEvent(
+	evType, sender string, types, notTypes, senders, notSenders []string,
+) bool {
+	for _, s := range notSenders {
+		if s == sender {
+			return false
+		}
+	}
+	if senders != nil {
+		allowed := false
+		for _, s := range senders {
+			if s == sender {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return false
+		}
+	}
+	for _, t := range notTypes {
+		if typeMatches(t, evType) {
+			return false
+		}
+	}
+	if types == nil {
+		return true
+	}
+	for _, t := range types {
+		if typeMatches(t, evType) {
+			return true
+		}
+	}
+	return false
+}
+
+// FilterStateEvents returns the events which pass the state filter, up to
+// its limit.
+func FilterStateEvents(
+	events []gomatrixserverlib.HeaderedEvent, filter *gomatrixserverlib.StateFilter,
+) []gomatrixserverlib.HeaderedEvent {
+	return filterHeaderedEvents(
+		events, filter.Types, filter.NotTypes, filter.Senders, filter.NotSenders, filter.ContainsURL, filter.Limit,
+	)
+}
+
+// FilterRoomEvents returns the events which pass the room event filter, up
+// to its limit.
+func FilterRoomEvents(
+	events []gomatrixserverlib.HeaderedEvent, filter *gomatrixserverlib.RoomEventFilter,
+) []gomatrixserverlib.HeaderedEvent {
+	return filterHeaderedEvents(
+		events, filter.Types, filter.NotTypes, filter.Senders, filter.NotSenders, filter.ContainsURL, filter.Limit,
+	)
+}
+
+func filterHeaderedEvents(
+	events []gomatrixserverlib.HeaderedEvent,
+	types, notTypes, senders, notSenders []string, containsURL *bool, limit int,
+) []gomatrixserverlib.HeaderedEvent {
+	result := []gomatrixserverlib.HeaderedEvent{}
+	for _, ev := range events {
+		if len(result) >= limit {
+			break
+		}
+		if !FilterAllowsEvent(ev.Type(), ev.Sender(), types, notTypes, senders, notSenders) {
+			continue
+		}
+		if containsURL != nil && *containsURL != ContainsURL(ev.Content()) {
+			continue
+		}
+		result = append(result, ev)
+	}
+	return result
+}
+
+// FilterClientEvents returns the events which pass the event filter, up to
+// its limit.
+func FilterClientEvents(
+	events []gomatrixserverlib.ClientEvent, filter *gomatrixserverlib.EventFilter,
+) []gomatrixserverlib.ClientEvent {
+	result := []gomatrixserverlib.ClientEvent{}
+	for _, ev := range events {
+		if len(result) >= filter.Limit {
+			break
+		}
+		if FilterAllowsEvent(ev.Type, ev.Sender, filter.Types, filter.NotTypes, filter.Senders, filter.NotSenders) {
+			result = append(result, ev)
+		}
+	}
+	return result
+}
+
+// ContainsURL returns true if the event content has a "url" key, which is
+// what the contains_url part of a filter matches against.
+func ContainsURL(content []byte) bool {
+	var c map[string]interface{}
+	if err := json.Unmarshal(content, &c); err != nil {
+		return false
+	}
+	_, ok := c["url"]
+	return ok
+}
+
+// typeMatches returns true if the event type matches the pattern, where a
+// '*' in the pattern matches any sequence of characters.
+func typeMatches(pattern, evType string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == evType
+	}
+	if !strings.HasPrefix(evType, parts[0]) {
+		return false
+	}
+	evType = evType[len(parts[0]):]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(evType, part)
+		if i < 0 {
+			return false
+		}
+		evType = evType[i+len(part):]
+	}
+	return strings.HasSuffix(evType, parts[len(parts)-1])
+}
@@ -20,7 +20,10 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
 
+	eduAPI "github.com/matrix-org/dendrite/eduserver/api"
 	"github.com/matrix-org/dendrite/roomserver/api"
 	"github.com/matrix-org/gomatrixserverlib"
 	"github.com/tidwall/gjson"
@@ -98,6 +101,9 @@ func (t *StreamingToken) PDUPosition() StreamPosition {
 func (t *StreamingToken) EDUPosition() StreamPosition {
 	return t.Positions[1]
 }
+func (t *StreamingToken) ReceiptPosition() StreamPosition {
+	return t.Positions[2]
+}
 
 // IsAfter returns true if ANY position in this token is greater than `other`.
 func (t *StreamingToken) IsAfter(other StreamingToken) bool {
@@ -136,7 +142,7 @@ func (t *TopologyToken) PDUPosition() StreamPosition {
 	return t.Positions[1]
 }
 func (t *TopologyToken) StreamToken() StreamingToken {
-	return NewStreamToken(t.PDUPosition(), 0)
+	return NewStreamToken(t.PDUPosition(), 0, 0)
 }
 func (t *TopologyToken) String() string {
 	return t.syncToken.String()
@@ -230,11 +236,11 @@ func NewTopologyTokenFromString(tok string) (token TopologyToken, err error) {
 }
 
 // NewStreamToken creates a new sync token for /sync
-func NewStreamToken(pduPos, eduPos StreamPosition) StreamingToken {
+func NewStreamToken(pduPos, eduPos, receiptPos StreamPosition) StreamingToken {
 	return StreamingToken{
 		syncToken: syncToken{
 			Type:      SyncTokenTypeStream,
-			Positions: []StreamPosition{pduPos, eduPos},
+			Positions: []StreamPosition{pduPos, eduPos, receiptPos},
 		},
 	}
 }
@@ -247,8 +253,14 @@ func NewStreamTokenFromString(tok string) (token StreamingToken, err error) {
 		err = fmt.Errorf("token %s is not a streaming token", tok)
 		return
 	}
-	if len(t.Positions) != 2 {
-		err = fmt.Errorf("token %s wrong number of values, got %d want 2", tok, len(t.Positions))
+	switch len(t.Positions) {
+	case 2:
+		// Tokens issued before receipts had their own stream position
+		// have no receipt position, so start from the beginning.
+		t.Positions = append(t.Positions, 0)
+	case 3:
+	default:
+		err = fmt.Errorf("token %s wrong number of values, got %d want 3", tok, len(t.Positions))
 		return
 	}
 	return StreamingToken{
@@ -282,6 +294,29 @@ type PrevEventRef struct {
 	PrevSender    string          `json:"prev_sender"`
 }
 
+// PresenceContent is the content of an m.presence event, as it is sent to
+// clients in /sync and returned from GET /presence/{userID}/status.
+type PresenceContent struct {
+	Presence        string  `json:"presence"`
+	StatusMsg       *string `json:"status_msg,omitempty"`
+	LastActiveAgo   int64   `json:"last_active_ago,omitempty"`
+	CurrentlyActive bool    `json:"currently_active"`
+}
+
+// NewPresenceContent creates the content of an m.presence event from a
+// stored presence update, relative to the current time.
+func NewPresenceContent(p *eduAPI.OutputPresenceEvent, now time.Time) PresenceContent {
+	content := PresenceContent{
+		Presence:        p.Presence,
+		StatusMsg:       p.StatusMsg,
+		CurrentlyActive: p.CurrentlyActive,
+	}
+	if p.LastActiveTS != 0 {
+		content.LastActiveAgo = now.Sub(p.LastActiveTS.Time()).Milliseconds()
+	}
+	return content
+}
+
 // Response represents a /sync API response. See https://matrix.org/docs/spec/client_server/r0.2.0.html#get-matrix-client-r0-sync
 type Response struct {
 	NextBatch   string `json:"next_batch"`
@@ -296,6 +331,13 @@ type Response struct {
 		Invite map[string]InviteResponse `json:"invite"`
 		Leave  map[string]LeaveResponse  `json:"leave"`
 	} `json:"rooms"`
+	DeviceLists struct {
+		Changed []string `json:"changed,omitempty"`
+		Left    []string `json:"left,omitempty"`
+	} `json:"device_lists,omitempty"`
+	ToDevice struct {
+		Events []eduAPI.SendToDeviceEvent `json:"events"`
+	} `json:"to_device"`
 }
 
 // NewResponse creates an empty response with initialised maps.
@@ -315,6 +357,7 @@ func NewResponse(token StreamingToken) *Response {
 	//       This also applies to NewJoinResponse, NewInviteResponse and NewLeaveResponse.
 	res.AccountData.Events = make([]gomatrixserverlib.ClientEvent, 0)
 	res.Presence.Events = make([]gomatrixserverlib.ClientEvent, 0)
+	res.ToDevice.Events = make([]eduAPI.SendToDeviceEvent, 0)
 
 	return &res
 }
@@ -326,7 +369,10 @@ func (r *Response) IsEmpty() bool {
 		len(r.Rooms.Invite) == 0 &&
 		len(r.Rooms.Leave) == 0 &&
 		len(r.AccountData.Events) == 0 &&
-		len(r.Presence.Events) == 0
+		len(r.Presence.Events) == 0 &&
+		len(r.DeviceLists.Changed) == 0 &&
+		len(r.DeviceLists.Left) == 0 &&
+		len(r.ToDevice.Events) == 0
 }
 
 // JoinResponse represents a /sync response for a room which is under the 'join' key.
@@ -345,6 +391,13 @@ type JoinResponse struct {
 	AccountData struct {
 		Events []gomatrixserverlib.ClientEvent `json:"events"`
 	} `json:"account_data"`
+	UnreadNotifications UnreadNotifications `json:"unread_notifications"`
+}
+
+// UnreadNotifications contains the notification counts of a joined room.
+type UnreadNotifications struct {
+	HighlightCount    int `json:"highlight_count"`
+	NotificationCount int `json:"notification_count"`
 }
 
 // NewJoinResponse creates an empty response with initialised arrays.
@@ -393,3 +446,28 @@ func NewLeaveResponse() *LeaveResponse {
 	res.Timeline.Events = make([]gomatrixserverlib.ClientEvent, 0)
 	return &res
 }
+
+// SearchableEventTypes maps the types of the events which can be searched to
+// the key of the part of their content which is indexed.
+var SearchableEventTypes = map[string]string{
+	"m.room.message": "content.body",
+	"m.room.name":    "content.name",
+	"m.room.topic":   "content.topic",
+}
+
+// SearchResult is an event which matched a full-text search, along with how
+// well it matched.
+type SearchResult struct {
+	EventID string
+	Rank    float64
+}
+
+// SearchTerms splits a search term into the lower-cased words which are
+// looked up in the search index. Anything other than letters and digits is
+// treated as a separator, so that the words are safe to use in a full-text
+// query.
+func SearchTerms(searchTerm string) []string {
+	return strings.FieldsFunc(strings.ToLower(searchTerm), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
@@ -4,9 +4,10 @@ import "testing"
 
 func TestNewSyncTokenFromString(t *testing.T) {
 	shouldPass := map[string]syncToken{
-		"s4_0": NewStreamToken(4, 0).syncToken,
-		"s3_1": NewStreamToken(3, 1).syncToken,
-		"t3_1": NewTopologyToken(3, 1).syncToken,
+		"s4_0_0": NewStreamToken(4, 0, 0).syncToken,
+		"s3_1_0": NewStreamToken(3, 1, 0).syncToken,
+		"s3_1_2": NewStreamToken(3, 1, 2).syncToken,
+		"t3_1":   NewTopologyToken(3, 1).syncToken,
 	}
 
 	shouldFail := []string{
@@ -36,3 +37,88 @@ func TestNewSyncTokenFromString(t *testing.T) {
 		}
 	}
 }
+
+func TestNewStreamTokenFromString(t *testing.T) {
+	shouldPass := map[string]StreamingToken{
+		"s4_0":   NewStreamToken(4, 0, 0),
+		"s3_1_2": NewStreamToken(3, 1, 2),
+	}
+
+	shouldFail := []string{
+		"s4",
+		"s1_2_3_4",
+		"t3_1",
+	}
+
+	for test, expected := range shouldPass {
+		result, err := NewStreamTokenFromString(test)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if result.String() != expected.String() {
+			t.Errorf("%s expected %v but got %v", test, expected.String(), result.String())
+		}
+	}
+
+	for _, test := range shouldFail {
+		if _, err := NewStreamTokenFromString(test); err == nil {
+			t.Errorf("input '%v' should have errored but didn't", test)
+		}
+	}
+}
+
+func TestFilterAllowsEvent(t *testing.T) {
+	shouldPass := map[string][]string{
+		"m.room.message": {"m.room.message"},
+		"m.room.member":  {"m.room.*"},
+		"m.receipt":      {"*"},
+		"m.typing":       {"m.*ing", "m.room.*"},
+	}
+	shouldFail := map[string][]string{
+		"m.room.message": {"m.room.member"},
+		"m.typing":       {"m.room.*"},
+		"m.receipt":      {},
+	}
+
+	for evType, types := range shouldPass {
+		if !FilterAllowsEvent(evType, "@alice:localhost", types, nil, nil, nil) {
+			t.Errorf("%s should be allowed by types %v", evType, types)
+		}
+		if FilterAllowsEvent(evType, "@alice:localhost", nil, types, nil, nil) {
+			t.Errorf("%s should not be allowed by not_types %v", evType, types)
+		}
+	}
+	for evType, types := range shouldFail {
+		if FilterAllowsEvent(evType, "@alice:localhost", types, nil, nil, nil) {
+			t.Errorf("%s should not be allowed by types %v", evType, types)
+		}
+	}
+	if FilterAllowsEvent("m.room.message", "@alice:localhost", nil, nil, []string{"@bob:localhost"}, nil) {
+		t.Errorf("sender should not be allowed by senders")
+	}
+	if FilterAllowsEvent("m.room.message", "@alice:localhost", nil, nil, nil, []string{"@alice:localhost"}) {
+		t.Errorf("sender should not be allowed by not_senders")
+	}
+}
+
+func TestSearchTerms(t *testing.T) {
+	for input, want := range map[string][]string{
+		"Hello World":           {"hello", "world"},
+		"  what's up?  ":        {"what", "s", "up"},
+		"\"quoted\" OR (thing)": {"quoted", "or", "thing"},
+		"***":                   {},
+	} {
+		got := SearchTerms(input)
+		if len(got) != len(want) {
+			t.Errorf("SearchTerms(%q): got %v, want %v", input, got, want)
+			continue
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Errorf("SearchTerms(%q): got %v, want %v", input, got, want)
+				break
+			}
+		}
+	}
+}